@@ -15,6 +15,7 @@ import (
 )
 
 var kubeConfigFile = flag.String("kubeconfig", "", "location of the kube config file. Defaults to ~/.kube/config")
+var kubeContext = flag.String("context", "", "context of the kube config file to use. Defaults to the current context")
 
 func init() {
 	flag.Usage = func() {
@@ -32,7 +33,7 @@ func main() {
 		*kubeConfigFile = filepath.Join(homedir.HomeDir(), ".kube", "config")
 	}
 
-	kubeconf := endpoints.WithKubeConfig(*kubeConfigFile)
+	kubeconf := endpoints.WithKubeConfigContext(*kubeConfigFile, *kubeContext)
 	ktr, err := endpoints.NewKubernetesTargetRetriever("prometheus.io/scrape", false, kubeconf)
 	if err != nil {
 		logrus.Fatalf("could not create KubernetesTargetRetriever: %v", err)
@@ -0,0 +1,21 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"io"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+)
+
+const auditCommand = "audit"
+
+// audit scrapes the configured targets once and writes a report of the
+// attributes likely containing personal data, without emitting anything.
+func audit(w io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return scraper.Audit(cfg, w)
+}
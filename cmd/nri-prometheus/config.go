@@ -4,42 +4,137 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"reflect"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
+// Environment variables set when the integration is run by the New Relic
+// infrastructure agent, so the credentials managed by the agent aren't
+// duplicated in the configuration of the integration.
+const (
+	// agentConfigPathEnv is the path of the configuration file the agent
+	// writes from the config of the integration, with its variables and
+	// secrets already resolved, set with NRI_PROMETHEUS_CONFIG_PATH:
+	// ${config.path} in the env of the integration. It's prefixed, unlike
+	// the CONFIG_PATH of the agent, so a variable set for other programs
+	// isn't taken as the configuration.
+	agentConfigPathEnv = "NRI_PROMETHEUS_CONFIG_PATH"
+	// agentLicenseKeyEnv is the license key of the agent, available to the
+	// integration when listed in the passthrough_environment of the agent.
+	agentLicenseKeyEnv = "NRIA_LICENSE_KEY"
+)
+
 func loadConfig() (*scraper.Config, error) {
+	_, scraperCfg, err := readConfig()
+	return scraperCfg, err
+}
+
+// readConfig returns the Viper registry with the configuration, from the
+// defaults, the configuration file and the environment, and the scraper
+// configuration it resolves to.
+func readConfig() (*viper.Viper, *scraper.Config, error) {
 	cfg := viper.New()
 	cfg.SetConfigName("config")
 	cfg.SetConfigType("yaml")
 	cfg.AddConfigPath("/etc/nri-prometheus/")
 	cfg.AddConfigPath(".")
+	if path := os.Getenv(agentConfigPathEnv); path != "" {
+		cfg.SetConfigFile(path)
+	}
 	setViperDefaults(cfg)
 
 	err := cfg.ReadInConfig()
 	if err != nil {
-		return nil, errors.Wrap(err, "could not read configuration")
+		return nil, nil, errors.Wrap(err, "could not read configuration")
+	}
+
+	// The flag takes precedence over the configuration file and the
+	// environment.
+	if stages, ok := disableFlag(os.Args[1:]); ok {
+		cfg.Set("disabled_stages", stages)
 	}
+	// The faults are only injected with the flag, so a configuration
+	// copied from a testing environment doesn't inject them.
+	cfg.Set("fault_injection.enabled", hasFlag(os.Args[1:], faultInjectionFlagName))
 
 	var scraperCfg scraper.Config
 	bindViperEnv(cfg, scraperCfg)
-	err = cfg.Unmarshal(&scraperCfg)
+	applyDeprecatedKeys(cfg)
+	var metadata mapstructure.Metadata
+	err = cfg.Unmarshal(&scraperCfg, func(c *mapstructure.DecoderConfig) {
+		c.Metadata = &metadata
+		c.DecodeHook = mapstructure.ComposeDecodeHookFunc(c.DecodeHook, scraper.EmitterConfigHook())
+	})
 
 	if err != nil {
-		return nil, errors.Wrap(err, "could not parse configuration file")
+		return nil, nil, errors.Wrap(err, "could not parse configuration file")
+	}
+	// The options of the emitter blocks are resolved first, as they may set
+	// the license key the Metric API URLs are determined from.
+	if err := scraper.ResolveEmitters(&scraperCfg); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid emitters configuration")
+	}
+
+	if err := checkUnknownKeys(metadata.Unused, scraperCfg.StrictConfig); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid configuration file")
 	}
 
+	if scraperCfg.LicenseKey == "" {
+		scraperCfg.LicenseKey = scraper.LicenseKey(os.Getenv(agentLicenseKeyEnv))
+	}
 	if scraperCfg.MetricAPIURL == "" {
 		scraperCfg.MetricAPIURL = determineMetricAPIURL(string(scraperCfg.LicenseKey))
 	}
+	for i, instance := range scraperCfg.TelemetryEmitters {
+		if instance.MetricAPIURL == "" && instance.LicenseKey != "" {
+			scraperCfg.TelemetryEmitters[i].MetricAPIURL = determineMetricAPIURL(string(instance.LicenseKey))
+		}
+	}
+
+	return cfg, &scraperCfg, nil
+}
 
-	return &scraperCfg, nil
+// disableFlagName is the flag disabling pipeline stages.
+const disableFlagName = "--disable"
+
+// disableFlag returns the stages of the --disable flag in args, as
+// --disable=stage,... or --disable stage,..., and whether it was set.
+func disableFlag(args []string) ([]string, bool) {
+	var stages []string
+	found := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case strings.HasPrefix(args[i], disableFlagName+"="):
+			stages = append(stages, strings.TrimPrefix(args[i], disableFlagName+"="))
+			found = true
+		case args[i] == disableFlagName && i+1 < len(args):
+			stages = append(stages, args[i+1])
+			found = true
+			i++
+		}
+	}
+	return stages, found
+}
+
+// faultInjectionFlagName is the flag enabling the fault injection.
+const faultInjectionFlagName = "--fault-injection"
+
+// hasFlag returns whether the boolean flag is set in args.
+func hasFlag(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name || arg == name+"=true" {
+			return true
+		}
+	}
+	return false
 }
 
 // setViperDefaults loads the default configuration into the given Viper registry.
@@ -55,6 +150,42 @@ func setViperDefaults(viper *viper.Viper) {
 	viper.SetDefault("auto_decorate", false)
 	viper.SetDefault("insecure_skip_verify", false)
 	viper.SetDefault("percentiles", []float64{50.0, 95.0, 99.0})
+	viper.SetDefault("target_cache_warmup_timeout", 5*time.Minute)
+	viper.SetDefault("kubernetes_backoff_min", time.Second)
+	viper.SetDefault("kubernetes_backoff_max", 2*time.Minute)
+	viper.SetDefault("detect_cluster_name", true)
+	viper.SetDefault("openshift", false)
+	viper.SetDefault("openshift_service_ca_file", "/var/run/secrets/kubernetes.io/serviceaccount/service-ca.crt")
+	viper.SetDefault("service_mesh", "")
+	viper.SetDefault("service_mesh_split_proxy_metrics", false)
+	viper.SetDefault("skip_not_ready_pods", false)
+	viper.SetDefault("skip_terminating_pods", false)
+	viper.SetDefault("kubernetes_refresh_interval", 0)
+	viper.SetDefault("emit_target_changes", false)
+	viper.SetDefault("parse_failure_capture_kb", 0)
+	viper.SetDefault("parse_failure_capture_count", 10)
+	viper.SetDefault("debug_capture_enabled", false)
+	viper.SetDefault("debug_capture_max_duration", 5*time.Minute)
+	viper.SetDefault("strict_content_type", false)
+	viper.SetDefault("scrape_retries", 0)
+	viper.SetDefault("scrape_retry_backoff", "500ms")
+	viper.SetDefault("scrape_max_concurrency_per_host", 0)
+	viper.SetDefault("track_series", false)
+	viper.SetDefault("series_ttl", 5*time.Minute)
+	viper.SetDefault("series_growth_threshold", 0)
+	viper.SetDefault("emit_queue_size", 0)
+	viper.SetDefault("emit_queue_policy", "block")
+	viper.SetDefault("emitter_common_attributes", false)
+	viper.SetDefault("telemetry_emitter_pre_encode_attributes", false)
+	viper.SetDefault("emitter_load_shedding_failures", 0)
+	viper.SetDefault("emitter_load_shedding_gauge_sample_rate", 10)
+	viper.SetDefault("emitter_cumulative_counter_prefixes", []string{})
+	viper.SetDefault("emitter_integer_gauge_prefixes", []string{})
+	viper.SetDefault("disabled_stages", []string{})
+	viper.SetDefault("gomaxprocs", 0)
+	viper.SetDefault("strict_config", false)
+	viper.SetDefault("samples_policy", "latest")
+	viper.SetDefault("success_ratio_windows", []string{})
 }
 
 // bindViperEnv automatically binds the variables in given configuration struct to environment variables.
@@ -0,0 +1,152 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// deprecatedConfigKeys maps the deprecated configuration keys to the keys
+// replacing them. The value of a deprecated key is used for its replacement
+// unless the replacement is also set.
+var deprecatedConfigKeys = map[string]string{}
+
+// maxSuggestionDistance is the maximum edit distance between an unknown key
+// and a known one for the latter to be suggested. Short keys allow for 1
+// edit every 3 characters.
+const maxSuggestionDistance = 3
+
+// applyDeprecatedKeys warns about the deprecated keys that are set, moving
+// their values to their replacements.
+func applyDeprecatedKeys(cfg *viper.Viper) {
+	for deprecated, replacement := range deprecatedConfigKeys {
+		if !cfg.InConfig(deprecated) {
+			continue
+		}
+		logrus.Warnf("configuration key %q is deprecated, use %q instead", deprecated, replacement)
+		if !cfg.InConfig(replacement) {
+			cfg.Set(replacement, cfg.Get(deprecated))
+		}
+	}
+}
+
+// checkUnknownKeys reports the configuration keys that don't match any
+// option, suggesting the closest known key. They are errors if strict is
+// set, and warnings otherwise.
+func checkUnknownKeys(unused []string, strict bool) error {
+	var unknown []string
+	for _, key := range unused {
+		if _, ok := deprecatedConfigKeys[key]; ok {
+			continue
+		}
+		msg := fmt.Sprintf("unknown configuration key %q", key)
+		if suggestion := suggestConfigKey(key); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %q?", suggestion)
+		}
+		unknown = append(unknown, msg)
+	}
+	sort.Strings(unknown)
+
+	if strict && len(unknown) > 0 {
+		return fmt.Errorf("%s", strings.Join(unknown, "; "))
+	}
+	for _, msg := range unknown {
+		logrus.Warn(msg)
+	}
+	return nil
+}
+
+// suggestConfigKey returns the known key closest to the unknown one, or an
+// empty string if none is close enough. Only the last part of nested keys is
+// compared.
+func suggestConfigKey(key string) string {
+	prefix, name := "", key
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		prefix, name = key[:i+1], key[i+1:]
+	}
+
+	maxDistance := len(name) / 3
+	if maxDistance > maxSuggestionDistance {
+		maxDistance = maxSuggestionDistance
+	}
+	best, bestDistance := "", maxDistance+1
+	for _, known := range knownConfigKeys() {
+		if d := editDistance(name, known); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return prefix + best
+}
+
+// knownConfigKeys returns the keys of all the options of the configuration,
+// at any level.
+func knownConfigKeys() []string {
+	keys := map[string]bool{}
+	collectConfigKeys(reflect.TypeOf(scraper.Config{}), keys)
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func collectConfigKeys(t reflect.Type, keys map[string]bool) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		collectConfigKeys(t.Elem(), keys)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			// Untagged fields are matched by name, and are either plain
+			// values or aren't read from the configuration.
+			name, ok := f.Tag.Lookup("mapstructure")
+			if !ok {
+				keys[strings.ToLower(f.Name)] = true
+				continue
+			}
+			keys[name] = true
+			collectConfigKeys(f.Type, keys)
+		}
+	}
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultsAreKnownKeys(t *testing.T) {
+	cfg := viper.New()
+	setViperDefaults(cfg)
+
+	known := map[string]bool{}
+	for _, k := range knownConfigKeys() {
+		known[k] = true
+	}
+	for _, k := range cfg.AllKeys() {
+		assert.True(t, known[k], "default for unknown key %q", k)
+	}
+}
+
+func TestSuggestConfigKey(t *testing.T) {
+	tests := []struct {
+		key        string
+		suggestion string
+	}{
+		{"scrape_duraton", "scrape_duration"},
+		{"scrape_intervall", ""},
+		{"verbos", "verbose"},
+		{"targets[0].urks", "targets[0].urls"},
+		{"targets[0].gateway.urk", "targets[0].gateway.url"},
+		{"targets[1].tls_config.ca_file_pth", "targets[1].tls_config.ca_file_path"},
+		{"completely_unrelated", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.suggestion, suggestConfigKey(tt.key))
+		})
+	}
+}
+
+func TestCheckUnknownKeys(t *testing.T) {
+	assert.NoError(t, checkUnknownKeys([]string{"verbos"}, false))
+	assert.NoError(t, checkUnknownKeys(nil, true))
+
+	err := checkUnknownKeys([]string{"verbos", "foo"}, true)
+	require.Error(t, err)
+	assert.Equal(t, `unknown configuration key "foo"; unknown configuration key "verbos", did you mean "verbose"?`, err.Error())
+}
+
+func TestApplyDeprecatedKeys(t *testing.T) {
+	defer func(keys map[string]string) { deprecatedConfigKeys = keys }(deprecatedConfigKeys)
+	deprecatedConfigKeys = map[string]string{"old_debug": "debug"}
+
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	require.NoError(t, cfg.ReadConfig(strings.NewReader("old_debug: true\n")))
+	applyDeprecatedKeys(cfg)
+	assert.True(t, cfg.GetBool("debug"))
+	assert.NoError(t, checkUnknownKeys([]string{"old_debug"}, true))
+}
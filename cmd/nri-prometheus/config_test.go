@@ -4,7 +4,17 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
 )
 
 func TestDetermineMetricAPIURL(t *testing.T) {
@@ -29,3 +39,110 @@ func TestDetermineMetricAPIURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDisableFlag(t *testing.T) {
+	testCases := []struct {
+		args   []string
+		stages []string
+		found  bool
+	}{
+		{args: nil, stages: nil, found: false},
+		{args: []string{"--disable=percentiles,buckets"}, stages: []string{"percentiles,buckets"}, found: true},
+		{args: []string{"--disable", "rules", "--disable=decoration"}, stages: []string{"rules", "decoration"}, found: true},
+		{args: []string{"--disable"}, stages: nil, found: false},
+		{args: []string{"--disabled=rules"}, stages: nil, found: false},
+	}
+
+	for _, tt := range testCases {
+		stages, found := disableFlag(tt.args)
+		if found != tt.found || !reflect.DeepEqual(stages, tt.stages) {
+			t.Fatalf("unexpected stages for %v, got=%v %t, expected=%v %t", tt.args, stages, found, tt.stages, tt.found)
+		}
+	}
+}
+
+func TestHasFlag(t *testing.T) {
+	assert.True(t, hasFlag([]string{"--disable=rules", "--fault-injection"}, faultInjectionFlagName))
+	assert.True(t, hasFlag([]string{"--fault-injection=true"}, faultInjectionFlagName))
+	assert.False(t, hasFlag([]string{"--fault-injection=false"}, faultInjectionFlagName))
+	assert.False(t, hasFlag(nil, faultInjectionFlagName))
+}
+
+func TestReadConfig_InfraAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nri-prometheus-config.yml")
+	require.NoError(t, ioutil.WriteFile(path, []byte("cluster_name: agent\n"), 0600))
+
+	require.NoError(t, os.Setenv(agentConfigPathEnv, path))
+	defer os.Unsetenv(agentConfigPathEnv)
+	require.NoError(t, os.Setenv(agentLicenseKeyEnv, "eu01xx6789012345678901234567890123456789"))
+	defer os.Unsetenv(agentLicenseKeyEnv)
+
+	_, cfg, err := readConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "agent", cfg.ClusterName)
+	assert.Equal(t, scraper.LicenseKey("eu01xx6789012345678901234567890123456789"), cfg.LicenseKey)
+	assert.Equal(t, fmt.Sprintf(metricAPIRegionURL, "eu"), cfg.MetricAPIURL)
+}
+
+func TestReadConfig_FaultInjection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nri-prometheus-config.yml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`license_key: "0123456789012345678901234567890123456789"
+fault_injection:
+  enabled: true
+  scrape_failure_rate: 0.1
+  emit_delay_rate: 0.5
+  emit_delay: 30s
+`), 0600))
+
+	require.NoError(t, os.Setenv(agentConfigPathEnv, path))
+	defer os.Unsetenv(agentConfigPathEnv)
+
+	_, cfg, err := readConfig()
+	require.NoError(t, err)
+	assert.False(t, cfg.FaultInjection.Enabled, "the faults are only injected with the flag")
+	assert.Equal(t, 0.1, cfg.FaultInjection.ScrapeFailureRate)
+	assert.Equal(t, 30*time.Second, cfg.FaultInjection.EmitDelay)
+}
+
+func TestReadConfig_EmitterBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nri-prometheus-config.yml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`cluster_name: blocks
+license_key: "0123456789012345678901234567890123456789"
+stdout_format: json
+emitters:
+  - telemetry
+  - type: telemetry
+    name: eu
+    license_key: "eu01xx6789012345678901234567890123456789"
+  - type: stdout
+    format: ndjson
+  - type: file
+    path: /var/log/metrics.json
+    max_backups: 3
+`), 0600))
+	require.NoError(t, os.Setenv(agentConfigPathEnv, path))
+	defer os.Unsetenv(agentConfigPathEnv)
+
+	_, cfg, err := readConfig()
+	require.NoError(t, err)
+	assert.Equal(t, scraper.Emitters("telemetry", "stdout", "file"), cfg.Emitters)
+	assert.Equal(t, "ndjson", cfg.StdoutFormat)
+	assert.Equal(t, "/var/log/metrics.json", cfg.File.Path)
+	assert.Equal(t, 3, cfg.File.MaxBackups)
+	require.Len(t, cfg.TelemetryEmitters, 1)
+	assert.Equal(t, "eu", cfg.TelemetryEmitters[0].Name)
+	assert.Equal(t, fmt.Sprintf(metricAPIRegionURL, "eu"), cfg.TelemetryEmitters[0].MetricAPIURL)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("cluster_name: blocks\nemitters:\n  - type: stdout\n    colour: red\n"), 0600))
+	_, _, err = readConfig()
+	assert.Error(t, err, "unknown options are rejected")
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+)
+
+const diffCommand = "diff"
+
+// The exit codes of the diff command, as the ones of diff(1), so scripts
+// can tell the snapshots that differ from the ones that can't be compared.
+const (
+	diffExitDifferent = 1
+	diffExitError     = 2
+)
+
+// diff compares two recorded snapshots of scrapes or emissions and writes
+// the added, removed and changed series. It returns whether they differ.
+func diff(args []string, w io.Writer) (bool, error) {
+	fs := flag.NewFlagSet(diffCommand, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	minChange := fs.Float64("min-change", 0, "minimum value change reported, relative to the old value, e.g. 0.05 for 5%")
+	ignoreLabels := fs.String("ignore-labels", "", "comma separated labels removed from the series before comparing them")
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if fs.NArg() != 2 {
+		return false, fmt.Errorf("usage: nri-prometheus diff [-min-change 0.05] [-ignore-labels a,b] snapshotA snapshotB")
+	}
+
+	var ignored []string
+	if *ignoreLabels != "" {
+		ignored = strings.Split(*ignoreLabels, ",")
+	}
+	old, err := readSnapshot(fs.Arg(0), ignored)
+	if err != nil {
+		return false, err
+	}
+	new, err := readSnapshot(fs.Arg(1), ignored)
+	if err != nil {
+		return false, err
+	}
+	d := integration.DiffSnapshots(old, new, *minChange)
+	return !d.IsEmpty(), d.Write(w)
+}
+
+// readSnapshot reads the series of the snapshot file.
+func readSnapshot(path string, ignoredLabels []string) (integration.SnapshotSeries, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	series, err := integration.ReadSnapshot(f, ignoredLabels...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return series, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a.prom")
+	b := filepath.Join(dir, "b.ndjson")
+	require.NoError(t, ioutil.WriteFile(a, []byte("up{job=\"node\",instance=\"a\"} 1\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(b, []byte(`{"name":"up","type":"gauge","value":1,"attributes":{"job":"node","instance":"b"}}`+"\n"), 0600))
+
+	var out bytes.Buffer
+	differ, err := diff([]string{a, b}, &out)
+	require.NoError(t, err)
+	assert.True(t, differ)
+	assert.Contains(t, out.String(), "1 added, 1 removed, 0 changed, 0 unchanged")
+
+	out.Reset()
+	differ, err = diff([]string{"-ignore-labels", "instance", a, b}, &out)
+	require.NoError(t, err)
+	assert.False(t, differ)
+	assert.Equal(t, "0 added, 0 removed, 0 changed, 1 unchanged\n", out.String())
+
+	_, err = diff([]string{a}, &out)
+	assert.Error(t, err)
+	_, err = diff([]string{a, filepath.Join(dir, "missing")}, &out)
+	assert.Error(t, err)
+}
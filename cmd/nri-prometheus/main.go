@@ -3,12 +3,46 @@
 package main
 
 import (
+	"os"
+
 	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
 	"github.com/sirupsen/logrus"
 )
 
 //go:generate go run -ldflags "-X main.majorVersion=$MAJOR_VERSION -X main.minorVersion=$MINOR_VERSION" ../../tools/deploy-yaml/main.go
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == printConfigCommand {
+		if err := printConfig(os.Stdout); err != nil {
+			logrus.WithError(err).Fatal("while printing configuration")
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == auditCommand {
+		if err := audit(os.Stdout); err != nil {
+			logrus.WithError(err).Fatal("while auditing the scraped metrics")
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == diffCommand {
+		differ, err := diff(os.Args[2:], os.Stdout)
+		if err != nil {
+			logrus.WithError(err).Error("while comparing the snapshots")
+			os.Exit(diffExitError)
+		}
+		if differ {
+			os.Exit(diffExitDifferent)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == selfTestCommand {
+		if err := selfTest(os.Stdout); err != nil {
+			logrus.WithError(err).Fatal("self test failed")
+		}
+		return
+	}
+
 	cfg, err := loadConfig()
 	if err != nil {
 		logrus.WithError(err).Fatal("while loading configuration")
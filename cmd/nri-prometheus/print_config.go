@@ -0,0 +1,144 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const printConfigCommand = "print-config"
+
+// redactedValue replaces the secrets in the printed configuration.
+var redactedValue = scraper.LicenseKey("").String()
+
+// printConfig writes the effective configuration as YAML: the defaults, the
+// configuration file and the environment variables, resolved as the scraper
+// would see them, with the secrets redacted. Its keys are sorted, so the
+// output of different instances can be compared.
+func printConfig(w io.Writer) error {
+	cfg, scraperCfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	settings := cfg.AllSettings()
+	settings["metric_api_url"] = scraperCfg.MetricAPIURL
+	out, err := yaml.Marshal(redactSettings("", settings))
+	if err != nil {
+		return errors.Wrap(err, "could not encode configuration")
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// redactSettings returns the value of the key with its secrets redacted: the
+// values of keys named after secrets, of the headers, and the passwords of
+// URLs.
+func redactSettings(key string, value interface{}) interface{} {
+	if strings.EqualFold(key, "headers") {
+		return redactHeaders(value)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, kv := range v {
+			redacted[k] = redactSettings(k, kv)
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(v))
+		for k, kv := range v {
+			ks, _ := k.(string)
+			redacted[k] = redactSettings(ks, kv)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, iv := range v {
+			redacted[i] = redactSettings(key, iv)
+		}
+		return redacted
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = redactString(key, s)
+		}
+		return redacted
+	case string:
+		return redactString(key, v)
+	default:
+		return value
+	}
+}
+
+// redactHeaders returns the headers with all their values redacted, as their
+// names, like Authorization or X-Api-Key, don't tell whether they're secrets.
+func redactHeaders(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k := range v {
+			redacted[k] = redactedValue
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(v))
+		for k := range v {
+			redacted[k] = redactedValue
+		}
+		return redacted
+	case map[string]string:
+		redacted := make(map[string]string, len(v))
+		for k := range v {
+			redacted[k] = redactedValue
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+func redactString(key, value string) string {
+	if value == "" {
+		return value
+	}
+	if isSecretKey(key) {
+		return redactedValue
+	}
+	if !strings.Contains(value, "@") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, has := u.User.Password(); has {
+		// Redacted as the target URLs are in the logs.
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		return u.String()
+	}
+	return value
+}
+
+// isSecretKey returns true if the key holds a secret. Keys holding the path
+// of a file with a secret aren't redacted.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "_file") || strings.HasSuffix(key, "_path") {
+		return false
+	}
+	// The salt of the hashed attribute values is a secret, as they could be
+	// guessed with it.
+	for _, secret := range []string{"license_key", "password", "token", "secret", "salt"} {
+		if strings.Contains(key, secret) {
+			return true
+		}
+	}
+	return false
+}
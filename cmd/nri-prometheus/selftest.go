@@ -0,0 +1,21 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package main
+
+import (
+	"io"
+
+	"github.com/newrelic/nri-prometheus/internal/cmd/scraper"
+)
+
+const selfTestCommand = "--selftest"
+
+// selfTest runs the whole pipeline with the configuration against a mock
+// Metric API, to verify the deployment environment.
+func selfTest(w io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return scraper.SelfTest(cfg, w)
+}
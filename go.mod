@@ -11,6 +11,7 @@ require (
 	github.com/hashicorp/hcl v1.0.1-0.20190611123218-cf7d376da96d // indirect
 	github.com/imdario/mergo v0.3.8 // indirect
 	github.com/kardianos/govendor v1.0.9 // indirect
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/newrelic/newrelic-telemetry-sdk-go v0.2.1-0.20200116224429-790ff853d12b
 	github.com/onsi/ginkgo v1.10.1 // indirect
 	github.com/onsi/gomega v1.7.0 // indirect
@@ -19,6 +20,7 @@ require (
 	github.com/prometheus/client_golang v0.9.3
 	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/prometheus/common v0.4.0
+	github.com/segmentio/kafka-go v0.3.10
 	github.com/sirupsen/logrus v1.3.0
 	github.com/spf13/cast v1.3.1-0.20190531093228-c01685bb8421 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
@@ -27,7 +29,9 @@ require (
 	github.com/stretchr/testify v1.6.1
 	github.com/subosito/gotenv v1.2.0 // indirect
 	golang.org/x/crypto v0.0.0-20200220183623-bac4c82f6975 // indirect
+	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/api v0.16.10
 	k8s.io/apimachinery v0.16.10
 	k8s.io/client-go v0.15.12
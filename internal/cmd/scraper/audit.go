@@ -0,0 +1,40 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit scrapes the targets once and writes to w a report of the attributes
+// likely containing personal data, according to the configured PII patterns
+// or the default ones. No metric is emitted, so neither the license key nor
+// the emitters are required.
+func Audit(cfg *Config, w io.Writer) error {
+	if err := validateOptions(cfg); err != nil {
+		return fmt.Errorf("while getting configuration options: %w", err)
+	}
+	if cfg.Verbose {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	patterns := cfg.PIIPatterns
+	if len(patterns) == 0 {
+		patterns = integration.DefaultPIIPatterns
+	}
+	audit, err := integration.NewPIIAudit(patterns...)
+	if err != nil {
+		return fmt.Errorf("while parsing PII patterns: %w", err)
+	}
+
+	p, err := newPipeline(cfg, nil)
+	if err != nil {
+		return err
+	}
+	integration.Audit(p.retrievers, p.fetcher, p.processor, audit)
+	return audit.WriteReport(w)
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// EmitterConfig is an entry of the emitters list: the type of the emitter,
+// and the options of its block, like {type: stdout, format: ndjson}. An
+// entry can also be just the type, like stdout, for the emitters configured
+// with their top-level block.
+type EmitterConfig struct {
+	Type string
+	// Options are the other keys of the block, parsed into the options of
+	// the type, which replace the ones of its top-level block.
+	Options map[string]interface{}
+}
+
+// emitterTypeKey is the key of the type of the emitter blocks.
+const emitterTypeKey = "type"
+
+// Emitters returns a list of emitters of the given types, configured with
+// their top-level blocks.
+func Emitters(types ...string) []EmitterConfig {
+	emitters := make([]EmitterConfig, 0, len(types))
+	for _, t := range types {
+		emitters = append(emitters, EmitterConfig{Type: t})
+	}
+	return emitters
+}
+
+// EmitterConfigHook is the decode hook parsing the entries of the emitters
+// list, either types or blocks with a type.
+func EmitterConfigHook() mapstructure.DecodeHookFunc {
+	return func(_ reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if t != reflect.TypeOf(EmitterConfig{}) {
+			return data, nil
+		}
+		switch d := data.(type) {
+		case string:
+			return EmitterConfig{Type: strings.TrimSpace(d)}, nil
+		case map[string]interface{}:
+			return newEmitterConfig(d)
+		case map[interface{}]interface{}:
+			block := make(map[string]interface{}, len(d))
+			for k, v := range d {
+				block[fmt.Sprint(k)] = v
+			}
+			return newEmitterConfig(block)
+		}
+		return data, nil
+	}
+}
+
+func newEmitterConfig(block map[string]interface{}) (EmitterConfig, error) {
+	typ, ok := block[emitterTypeKey].(string)
+	if !ok || typ == "" {
+		return EmitterConfig{}, fmt.Errorf("emitter blocks need a type")
+	}
+	cfg := EmitterConfig{Type: typ}
+	for k, v := range block {
+		if k == emitterTypeKey {
+			continue
+		}
+		if cfg.Options == nil {
+			cfg.Options = map[string]interface{}{}
+		}
+		cfg.Options[k] = v
+	}
+	return cfg, nil
+}
+
+// telemetryEmitterOptions are the options of the telemetry emitter blocks
+// without a name, which configure the main telemetry emitter.
+type telemetryEmitterOptions struct {
+	MetricAPIURL string     `mapstructure:"metric_api_url"`
+	LicenseKey   LicenseKey `mapstructure:"license_key"`
+}
+
+// stdoutEmitterOptions are the options of the stdout emitter blocks.
+type stdoutEmitterOptions struct {
+	Format string `mapstructure:"format"`
+}
+
+// ResolveEmitters parses the options of the blocks of the emitters list
+// into the configuration of their emitters. The telemetry blocks with a
+// name are additional telemetry emitters, so they are moved to the
+// TelemetryEmitters. It returns an error for unknown types, unknown
+// options, and types listed more than once. The options are consumed, so
+// resolving the emitters again is a no-op.
+func ResolveEmitters(cfg *Config) error {
+	seen := map[string]bool{}
+	var emitters []EmitterConfig
+	for i, e := range cfg.Emitters {
+		var err error
+		switch e.Type {
+		case "telemetry":
+			if name, ok := e.Options["name"]; ok && name != "" {
+				var instance TelemetryEmitterInstance
+				if err := decodeEmitterOptions(e.Options, &instance); err != nil {
+					return fmt.Errorf("emitters[%d] (%s): %w", i, e.Type, err)
+				}
+				cfg.TelemetryEmitters = append(cfg.TelemetryEmitters, instance)
+				continue
+			}
+			var options telemetryEmitterOptions
+			err = decodeEmitterOptions(e.Options, &options)
+			if options.MetricAPIURL != "" {
+				cfg.MetricAPIURL = options.MetricAPIURL
+			}
+			if options.LicenseKey != "" {
+				cfg.LicenseKey = options.LicenseKey
+			}
+		case "stdout":
+			options := stdoutEmitterOptions{Format: cfg.StdoutFormat}
+			err = decodeEmitterOptions(e.Options, &options)
+			cfg.StdoutFormat = options.Format
+		case "remote_write":
+			err = decodeEmitterOptions(e.Options, &cfg.RemoteWrite)
+		case "kafka":
+			err = decodeEmitterOptions(e.Options, &cfg.Kafka)
+		case "file":
+			err = decodeEmitterOptions(e.Options, &cfg.File)
+		case "statsd":
+			err = decodeEmitterOptions(e.Options, &cfg.Statsd)
+		default:
+			return fmt.Errorf("emitters[%d]: unknown emitter type %q", i, e.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("emitters[%d] (%s): %w", i, e.Type, err)
+		}
+		if seen[e.Type] {
+			return fmt.Errorf("emitters[%d]: the %s emitter is listed more than once", i, e.Type)
+		}
+		seen[e.Type] = true
+		emitters = append(emitters, EmitterConfig{Type: e.Type})
+	}
+	cfg.Emitters = emitters
+	return nil
+}
+
+// decodeEmitterOptions parses the options of an emitter block into the
+// options of its type, failing on unknown options.
+func decodeEmitterOptions(options map[string]interface{}, result interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           result,
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(options)
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitterConfigHook(t *testing.T) {
+	var cfg Config
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:     &cfg,
+		DecodeHook: EmitterConfigHook(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, decoder.Decode(map[string]interface{}{
+		"emitters": []interface{}{
+			"telemetry",
+			map[interface{}]interface{}{"type": "stdout", "format": "ndjson"},
+		},
+	}))
+	assert.Equal(t, []EmitterConfig{
+		{Type: "telemetry"},
+		{Type: "stdout", Options: map[string]interface{}{"format": "ndjson"}},
+	}, cfg.Emitters)
+
+	_, err = EmitterConfigHook().(func(reflect.Type, reflect.Type, interface{}) (interface{}, error))(
+		reflect.TypeOf(map[string]interface{}{}), reflect.TypeOf(EmitterConfig{}), map[string]interface{}{"format": "json"})
+	assert.Error(t, err, "blocks need a type")
+}
+
+func TestResolveEmitters(t *testing.T) {
+	cfg := &Config{
+		StdoutFormat: "json",
+		Emitters: []EmitterConfig{
+			{Type: "telemetry", Options: map[string]interface{}{"metric_api_url": "https://gateway/metric/v1"}},
+			{Type: "telemetry", Options: map[string]interface{}{"name": "eu", "match": map[string]interface{}{"env": "eu"}}},
+			{Type: "stdout"},
+			{Type: "kafka", Options: map[string]interface{}{"brokers": "a:9092,b:9092", "topic": "metrics"}},
+			{Type: "file", Options: map[string]interface{}{"path": "/tmp/metrics", "rotate_interval": "1h"}},
+		},
+	}
+	require.NoError(t, ResolveEmitters(cfg))
+	assert.Equal(t, Emitters("telemetry", "stdout", "kafka", "file"), cfg.Emitters)
+	assert.Equal(t, "https://gateway/metric/v1", cfg.MetricAPIURL)
+	assert.Equal(t, []TelemetryEmitterInstance{{Name: "eu", Match: map[string]string{"env": "eu"}}}, cfg.TelemetryEmitters)
+	assert.Equal(t, "json", cfg.StdoutFormat, "the top-level block is used without options")
+	assert.Equal(t, []string{"a:9092", "b:9092"}, cfg.Kafka.Brokers)
+	assert.Equal(t, "metrics", cfg.Kafka.Topic)
+	assert.Equal(t, time.Hour, cfg.File.RotateInterval)
+
+	require.NoError(t, ResolveEmitters(cfg))
+	assert.Len(t, cfg.TelemetryEmitters, 1, "resolving again is a no-op")
+
+	for name, emitters := range map[string][]EmitterConfig{
+		"unknown type":   {{Type: "carrier-pigeon"}},
+		"unknown option": {{Type: "stdout", Options: map[string]interface{}{"colour": "red"}}},
+		"listed twice":   {{Type: "stdout"}, {Type: "stdout"}},
+	} {
+		assert.Error(t, ResolveEmitters(&Config{Emitters: emitters}), name)
+	}
+}
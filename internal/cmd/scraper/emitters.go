@@ -0,0 +1,431 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/pkg/errors"
+)
+
+// TelemetryEmitterInstance is an additional telemetry emitter, sending the
+// metrics to its own Metric API URL, e.g. of another region or an internal
+// gateway, with its own license key. The license key defaults to the global
+// one, and the URL to the one of the license key region. If Match is set,
+// only the metrics with all of its attribute values are sent, and they
+// aren't sent to the global telemetry emitter. If Account is
+// set, only the metrics of the targets annotated with newrelic.io/account:
+// <Account> are sent, and they aren't sent to the other telemetry emitters.
+type TelemetryEmitterInstance struct {
+	Name         string            `mapstructure:"name"`
+	MetricAPIURL string            `mapstructure:"metric_api_url"`
+	LicenseKey   LicenseKey        `mapstructure:"license_key"`
+	Match        map[string]string `mapstructure:"match"`
+	Account      string            `mapstructure:"account"`
+}
+
+// emitterName is the name of the emitter of the instance. The zero instance
+// is the telemetry emitter of the global configuration.
+func (i TelemetryEmitterInstance) emitterName() string {
+	if i.Name == "" {
+		return "telemetry"
+	}
+	return "telemetry-" + i.Name
+}
+
+// validateTelemetryEmitters checks that the additional telemetry emitters
+// have unique names.
+func validateTelemetryEmitters(instances []TelemetryEmitterInstance) error {
+	names := map[string]bool{}
+	for _, i := range instances {
+		if i.Name == "" {
+			return fmt.Errorf("telemetry_emitters need a name")
+		}
+		if names[i.Name] {
+			return fmt.Errorf("duplicated telemetry emitter name %q", i.Name)
+		}
+		names[i.Name] = true
+	}
+	return nil
+}
+
+// routedAccounts returns the accounts of the telemetry emitters, whose
+// metrics are routed to them.
+func routedAccounts(cfg *Config) []string {
+	var accounts []string
+	for _, i := range cfg.TelemetryEmitters {
+		if i.Account != "" {
+			accounts = append(accounts, i.Account)
+		}
+	}
+	return accounts
+}
+
+// routedMatches returns the matches of the telemetry emitters, whose
+// metrics are routed to them instead of the global telemetry emitter.
+func routedMatches(cfg *Config) []map[string]string {
+	var matches []map[string]string
+	for _, i := range cfg.TelemetryEmitters {
+		if len(i.Match) > 0 {
+			matches = append(matches, i.Match)
+		}
+	}
+	return matches
+}
+
+// enabledEmitters returns the names of the emitters of the configuration.
+func enabledEmitters(cfg *Config) map[string]bool {
+	enabled := map[string]bool{}
+	for _, e := range cfg.Emitters {
+		enabled[e.Type] = true
+	}
+	for _, i := range cfg.TelemetryEmitters {
+		enabled[i.emitterName()] = true
+	}
+	return enabled
+}
+
+// validateEmitterFilters checks that the emitter filters are of enabled
+// emitters, so a typo doesn't silently send everything.
+func validateEmitterFilters(cfg *Config) error {
+	enabled := enabledEmitters(cfg)
+	for name := range cfg.EmitterFilters {
+		if !enabled[name] {
+			return fmt.Errorf("emitter_filters has a filter of %q, which is not an enabled emitter", name)
+		}
+	}
+	return nil
+}
+
+// EmitterFailoverConfig is a chain of emitters, each falling back to the
+// next one when it fails for Failures consecutive harvests, and retried
+// after the FailbackInterval.
+type EmitterFailoverConfig struct {
+	Chain            []string      `mapstructure:"chain"`
+	Failures         int           `mapstructure:"failures"`
+	FailbackInterval time.Duration `mapstructure:"failback_interval"`
+}
+
+// validateEmitterFailover checks that the failover chain has at least two
+// different enabled emitters.
+func validateEmitterFailover(cfg *Config) error {
+	chain := cfg.EmitterFailover.Chain
+	if len(chain) == 0 {
+		return nil
+	}
+	if len(chain) < 2 {
+		return fmt.Errorf("emitter_failover chain needs at least two emitters")
+	}
+	enabled := enabledEmitters(cfg)
+	seen := map[string]bool{}
+	for _, name := range chain {
+		if !enabled[name] {
+			return fmt.Errorf("emitter_failover chain has %q, which is not an enabled emitter", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("emitter_failover chain has %q more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// failsOver returns whether the emitter falls back to another one of the
+// failover chain.
+func failsOver(cfg *Config, name string) bool {
+	chain := cfg.EmitterFailover.Chain
+	for i := 0; i < len(chain)-1; i++ {
+		if chain[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverEmitters replaces the emitters of the failover chain with a
+// FailoverEmitter of them, in the position of the first one.
+func failoverEmitters(emitters []integration.Emitter, cfg EmitterFailoverConfig) []integration.Emitter {
+	if len(cfg.Chain) < 2 {
+		return emitters
+	}
+	byName := map[string]integration.Emitter{}
+	for _, e := range emitters {
+		byName[e.Name()] = e
+	}
+	chained := make(map[string]bool, len(cfg.Chain))
+	for _, name := range cfg.Chain {
+		chained[name] = true
+	}
+	chain := byName[cfg.Chain[len(cfg.Chain)-1]]
+	for i := len(cfg.Chain) - 2; i >= 0; i-- {
+		chain = integration.NewFailoverEmitter(byName[cfg.Chain[i]], chain, cfg.Failures, cfg.FailbackInterval)
+	}
+
+	result := make([]integration.Emitter, 0, len(emitters))
+	for _, e := range emitters {
+		switch {
+		case e.Name() == cfg.Chain[0]:
+			result = append(result, chain)
+		case !chained[e.Name()]:
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// filterEmitters wraps the emitters with a filter so they only emit the
+// metrics it selects.
+func filterEmitters(emitters []integration.Emitter, filters map[string]integration.EmitterFilter) []integration.Emitter {
+	filtered := make([]integration.Emitter, 0, len(emitters))
+	for _, e := range emitters {
+		if filter, ok := filters[e.Name()]; ok && !filter.IsEmpty() {
+			e = integration.FilteredEmitter(e, filter)
+		}
+		filtered = append(filtered, e)
+	}
+	return filtered
+}
+
+// commonAttributesEmitters adds the default attributes to the metrics of the
+// emitters other than the telemetry ones, which send them as the common
+// attributes of their harvests, when they aren't added by the processing
+// rules.
+func commonAttributesEmitters(emitters []integration.Emitter, cfg *Config) []integration.Emitter {
+	if !cfg.EmitterCommonAttributes {
+		return emitters
+	}
+	wrapped := make([]integration.Emitter, 0, len(emitters))
+	for _, e := range emitters {
+		if e.Name() != "telemetry" && !strings.HasPrefix(e.Name(), "telemetry-") {
+			e = integration.CommonAttributesEmitter(e, defaultAttributes(cfg))
+		}
+		wrapped = append(wrapped, e)
+	}
+	return wrapped
+}
+
+// faultInjectingEmitters wraps the emitters so their emits are delayed as
+// configured.
+func faultInjectingEmitters(emitters []integration.Emitter, cfg integration.FaultInjectionConfig) []integration.Emitter {
+	wrapped := make([]integration.Emitter, 0, len(emitters))
+	for _, e := range emitters {
+		wrapped = append(wrapped, integration.FaultInjectingEmitter(e, cfg))
+	}
+	return wrapped
+}
+
+// newTelemetryEmitter creates a telemetry emitter of the instance, with the
+// options of the global configuration.
+func newTelemetryEmitter(cfg *Config, instance TelemetryEmitterInstance, ratios *integration.SuccessRatios) (integration.Emitter, error) {
+	licenseKey := cfg.LicenseKey
+	if instance.LicenseKey != "" {
+		licenseKey = instance.LicenseKey
+	}
+	metricAPIURL := cfg.MetricAPIURL
+	if instance.MetricAPIURL != "" {
+		metricAPIURL = instance.MetricAPIURL
+	}
+
+	hTime, err := time.ParseDuration(cfg.EmitterHarvestPeriod)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"invalid telemetry emitter harvest period %s: %w",
+			cfg.EmitterHarvestPeriod,
+			err,
+		)
+	}
+
+	if licenseKey == "" && cfg.EmitterSigning.OmitLicenseKey {
+		// The harvester requires a key, which is removed from the
+		// requests.
+		licenseKey = omittedLicenseKey
+	}
+
+	harvesterOpts := []func(*telemetry.Config){
+		telemetry.ConfigAPIKey(string(licenseKey)),
+		telemetry.ConfigBasicErrorLogger(os.Stdout),
+		integration.TelemetryHarvesterWithMetricsURL(metricAPIURL),
+		integration.TelemetryHarvesterWithHarvestPeriod(hTime),
+	}
+
+	if cfg.EmitterProxyURL != nil {
+		harvesterOpts = append(
+			harvesterOpts,
+			integration.TelemetryHarvesterWithProxy(cfg.EmitterProxyURL),
+		)
+	}
+
+	tlsConfig, err := emitterTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		harvesterOpts = append(
+			harvesterOpts,
+			integration.TelemetryHarvesterWithTLSConfig(tlsConfig),
+		)
+	}
+
+	signer, err := cfg.EmitterSigning.Signer()
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		harvesterOpts = append(harvesterOpts, integration.TelemetryHarvesterWithSigner(signer))
+	}
+
+	// Options that rely on modifying the emitter Client Transport
+	// should go before this one, as this changes the type of the
+	// Transport to `integration.licenseKeyRoundTripper`.
+	if cfg.EmitterSigning.OmitLicenseKey {
+		harvesterOpts = append(harvesterOpts, integration.TelemetryHarvesterWithoutLicenseKey())
+	} else {
+		harvesterOpts = append(
+			harvesterOpts,
+			integration.TelemetryHarvesterWithLicenseKeyRoundTripper(string(licenseKey)),
+		)
+	}
+
+	if cfg.Verbose {
+		harvesterOpts = append(harvesterOpts, telemetry.ConfigBasicDebugLogger(os.Stdout))
+	}
+
+	disabled, err := integration.ParseDisabledStages(cfg.DisabledStages)
+	if err != nil {
+		return nil, err
+	}
+	percentileFormat, err := integration.ParsePercentileFormat(cfg.PercentileFormat)
+	if err != nil {
+		return nil, err
+	}
+	counterOutput, err := integration.ParseCounterOutput(cfg.CounterOutput)
+	if err != nil {
+		return nil, err
+	}
+	percentileEstimator, err := integration.ParsePercentileEstimator(cfg.PercentileEstimator)
+	if err != nil {
+		return nil, err
+	}
+
+	var scrapeInterval time.Duration
+	if cfg.ScrapeDuration != "" {
+		if scrapeInterval, err = time.ParseDuration(cfg.ScrapeDuration); err != nil {
+			return nil, fmt.Errorf("parsing scrape_duration value (%v): %w", cfg.ScrapeDuration, err)
+		}
+	}
+
+	c := integration.TelemetryEmitterConfig{
+		Name:                          instance.emitterName(),
+		Percentiles:                   cfg.Percentiles,
+		HarvesterOpts:                 harvesterOpts,
+		DeltaExpirationAge:            cfg.TelemetryEmitterDeltaExpirationAge,
+		DeltaExpirationCheckInternval: cfg.TelemetryEmitterDeltaExpirationCheckInterval,
+		ScrapeInterval:                scrapeInterval,
+		PreEncodeAttributes:           cfg.TelemetryEmitterPreEncodeAttributes,
+		LoadSheddingFailures:          cfg.EmitterLoadSheddingFailures,
+		LoadSheddingGaugeSampleRate:   cfg.EmitterLoadSheddingGaugeSampleRate,
+		SuccessRatios:                 ratios,
+		CumulativeCounterPrefixes:     cfg.EmitterCumulativeCounterPrefixes,
+		IntegerGaugePrefixes:          cfg.EmitterIntegerGaugePrefixes,
+		DisablePercentiles:            disabled.Percentiles,
+		DisableBuckets:                disabled.Buckets,
+		PercentileFormat:              percentileFormat,
+		ReportHarvestErrors:           failsOver(cfg, instance.emitterName()),
+		Spool:                         cfg.EmitterSpool,
+		RejectionDetails:              cfg.EmitterRejectionDetails,
+		DeltaStateDir:                 cfg.DeltaStateDir,
+		DeltaStateMaxAge:              cfg.DeltaStateMaxAge,
+		CounterOutput:                 counterOutput,
+		SummaryCountAndSum:            cfg.SummaryCountAndSum,
+		HistogramModes:                cfg.HistogramModes,
+		PercentileEstimator:           percentileEstimator,
+		PercentileRelativeAccuracy:    cfg.PercentileRelativeAccuracy,
+	}
+	if cfg.EmitterCommonAttributes {
+		c.CommonAttributes = defaultAttributes(cfg)
+		// The common attributes aren't processed, so they are
+		// normalized here as the attributes of the metrics.
+		if normalizer, _ := integration.NewAttributeNormalizer(cfg.AttributeNormalization); normalizer != nil {
+			c.CommonAttributes = normalizer.Attributes(c.CommonAttributes)
+		}
+	}
+
+	var emitter integration.Emitter
+	if cfg.EmitterHarvesterPool.Key != "" {
+		emitter, err = integration.NewTelemetryEmitterPool(c, cfg.EmitterHarvesterPool)
+	} else {
+		emitter, err = integration.NewTelemetryEmitter(c)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create new TelemetryEmitter")
+	}
+	if instance.Account != "" {
+		emitter = integration.AccountEmitter(emitter, instance.Account)
+	} else if accounts := routedAccounts(cfg); len(accounts) > 0 {
+		emitter = integration.UnroutedEmitter(emitter, accounts)
+	}
+	if len(instance.Match) > 0 {
+		return integration.MatchingEmitter(emitter, instance.Match), nil
+	}
+	if matches := routedMatches(cfg); instance.Name == "" && len(matches) > 0 {
+		emitter = integration.UnmatchedEmitter(emitter, matches)
+	}
+	return emitter, nil
+}
+
+// omittedLicenseKey is the key of the harvesters whose license key is added
+// by the gateway.
+const omittedLicenseKey = "omitted"
+
+// emitterTLSConfig returns the TLS configuration of the emitters, with their
+// CA and the client certificate of emitter_signing, or nil if they have
+// neither.
+func emitterTLSConfig(cfg *Config) (*tls.Config, error) {
+	certs, err := cfg.EmitterSigning.Certificates()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.EmitterCAFile == "" && len(certs) == 0 {
+		return nil, nil
+	}
+	tlsConfig, err := integration.NewTLSConfig(cfg.EmitterCAFile, cfg.EmitterInsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	tlsConfig.Certificates = certs
+	return tlsConfig, nil
+}
+
+// newRemoteWriteEmitter creates the remote_write emitter, with the proxy, the
+// CA and the signing of the emitters.
+func newRemoteWriteEmitter(cfg *Config) (integration.Emitter, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.EmitterProxyURL != nil {
+		transport.Proxy = http.ProxyURL(cfg.EmitterProxyURL)
+	}
+	tlsConfig, err := emitterTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	rwCfg := cfg.RemoteWrite
+	rwCfg.Transport = transport
+	if rwCfg.Signer, err = cfg.EmitterSigning.Signer(); err != nil {
+		return nil, err
+	}
+	emitter, err := integration.NewRemoteWriteEmitter(rwCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create new RemoteWriteEmitter")
+	}
+	return emitter, nil
+}
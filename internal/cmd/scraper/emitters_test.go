@@ -0,0 +1,201 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+)
+
+func TestValidateTelemetryEmitters(t *testing.T) {
+	assert.NoError(t, validateTelemetryEmitters([]TelemetryEmitterInstance{{Name: "eu"}, {Name: "gateway"}}))
+	assert.Error(t, validateTelemetryEmitters([]TelemetryEmitterInstance{{MetricAPIURL: "http://gateway"}}))
+	assert.Error(t, validateTelemetryEmitters([]TelemetryEmitterInstance{{Name: "eu"}, {Name: "eu"}}))
+}
+
+func TestNewTelemetryEmitter_Instances(t *testing.T) {
+	cfg := &Config{
+		LicenseKey:           "global",
+		MetricAPIURL:         "http://localhost/metric/v1",
+		EmitterHarvestPeriod: "1h",
+	}
+
+	emitter, err := newTelemetryEmitter(cfg, TelemetryEmitterInstance{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "telemetry", emitter.Name())
+
+	emitter, err = newTelemetryEmitter(cfg, TelemetryEmitterInstance{
+		Name:         "gateway",
+		MetricAPIURL: "http://gateway/metric/v1",
+		Match:        map[string]string{"namespaceName": "shop"},
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "telemetry-gateway", emitter.Name())
+}
+
+func TestNewRemoteWriteEmitter(t *testing.T) {
+	cfg := &Config{Emitters: Emitters("telemetry", "remote_write")}
+	assert.Error(t, validateOptions(cfg), "the remote_write emitter requires a URL")
+
+	cfg.RemoteWrite.URL = "http://mimir:9009/api/v1/push"
+	require.NoError(t, validateOptions(cfg))
+	emitter, err := newRemoteWriteEmitter(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, "remote_write", emitter.Name())
+}
+
+func TestValidateOptions_Kafka(t *testing.T) {
+	cfg := &Config{Emitters: Emitters("kafka")}
+	assert.Error(t, validateOptions(cfg), "the kafka emitter requires brokers and a topic")
+
+	cfg.Kafka.Brokers = []string{"kafka:9092"}
+	cfg.Kafka.Topic = "metrics"
+	assert.NoError(t, validateOptions(cfg))
+}
+
+func TestValidateOptions_File(t *testing.T) {
+	cfg := &Config{Emitters: Emitters("file")}
+	assert.Error(t, validateOptions(cfg), "the file emitter requires a path")
+
+	cfg.File.Path = "/var/lib/nri-prometheus/metrics.ndjson"
+	assert.NoError(t, validateOptions(cfg))
+}
+
+func TestValidateOptions_Stdout(t *testing.T) {
+	cfg := &Config{Emitters: Emitters("stdout"), StdoutFormat: "prom-text"}
+	assert.NoError(t, validateOptions(cfg))
+
+	cfg.StdoutFormat = "yaml"
+	assert.Error(t, validateOptions(cfg))
+}
+
+func TestValidateOptions_Statsd(t *testing.T) {
+	cfg := &Config{Emitters: Emitters("statsd")}
+	assert.Error(t, validateOptions(cfg), "the statsd emitter requires an address")
+
+	cfg.Statsd.Address = "unix:///var/run/datadog/dsd.socket"
+	assert.NoError(t, validateOptions(cfg))
+}
+
+func TestValidateConfig_EmitterSigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "hmac.key")
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("secret"), 0600))
+
+	cfg := &Config{ClusterName: "cluster", EmitterSigning: integration.PayloadSigningConfig{HMACKeyFile: keyFile}}
+	assert.Error(t, validateConfig(cfg), "the license key is required unless it's omitted")
+
+	cfg.EmitterSigning.OmitLicenseKey = true
+	require.NoError(t, validateConfig(cfg))
+	cfg.EmitterHarvestPeriod = "1s"
+	_, err = newTelemetryEmitter(cfg, TelemetryEmitterInstance{}, nil)
+	assert.NoError(t, err)
+
+	cfg.EmitterSigning.HMACKeyFile = filepath.Join(dir, "missing.key")
+	assert.Error(t, validateConfig(cfg))
+}
+
+func TestEmitterFilters(t *testing.T) {
+	cfg := &Config{
+		Emitters:          Emitters("telemetry", "stdout"),
+		TelemetryEmitters: []TelemetryEmitterInstance{{Name: "eu"}},
+		EmitterFilters: map[string]integration.EmitterFilter{
+			"stdout":       {MetricPrefixes: []string{"http_"}},
+			"telemetry-eu": {Match: map[string]string{"region": "eu"}},
+		},
+	}
+	require.NoError(t, validateEmitterFilters(cfg))
+
+	cfg.EmitterFilters["file"] = integration.EmitterFilter{MetricPrefixes: []string{"http_"}}
+	assert.Error(t, validateEmitterFilters(cfg), "the file emitter is not enabled")
+
+	stdout := integration.NewStdoutEmitter()
+	emitters := filterEmitters([]integration.Emitter{stdout}, nil)
+	assert.Same(t, stdout, emitters[0], "emitters without filter are not wrapped")
+	emitters = filterEmitters([]integration.Emitter{stdout}, cfg.EmitterFilters)
+	assert.NotSame(t, stdout, emitters[0])
+	assert.Equal(t, "stdout", emitters[0].Name())
+}
+
+func TestEmitterFailover(t *testing.T) {
+	cfg := &Config{
+		Emitters:        Emitters("telemetry", "stdout", "file"),
+		EmitterFailover: EmitterFailoverConfig{Chain: []string{"telemetry", "file"}},
+	}
+	require.NoError(t, validateEmitterFailover(cfg))
+	assert.True(t, failsOver(cfg, "telemetry"))
+	assert.False(t, failsOver(cfg, "file"))
+
+	for _, chain := range [][]string{{"telemetry"}, {"telemetry", "kafka"}, {"telemetry", "telemetry"}} {
+		cfg.EmitterFailover.Chain = chain
+		assert.Error(t, validateEmitterFailover(cfg), chain)
+	}
+
+	telemetry := &namedEmitter{name: "telemetry"}
+	stdout := &namedEmitter{name: "stdout"}
+	file := &namedEmitter{name: "file"}
+	emitters := failoverEmitters([]integration.Emitter{stdout, telemetry, file},
+		EmitterFailoverConfig{Chain: []string{"telemetry", "file"}})
+	require.Len(t, emitters, 2, "the chain replaces its emitters")
+	assert.Same(t, stdout, emitters[0])
+	assert.IsType(t, &integration.FailoverEmitter{}, emitters[1])
+	assert.Equal(t, "telemetry", emitters[1].Name())
+}
+
+func TestCommonAttributesEmitters(t *testing.T) {
+	telemetry := &namedEmitter{name: "telemetry"}
+	telemetryEU := &namedEmitter{name: "telemetry-eu"}
+	stdout := &namedEmitter{name: "stdout"}
+	emitters := []integration.Emitter{telemetry, telemetryEU, stdout}
+
+	wrapped := commonAttributesEmitters(emitters, &Config{ClusterName: "my-cluster"})
+	assert.Equal(t, emitters, wrapped, "the attributes are added by the processing rules")
+
+	wrapped = commonAttributesEmitters(emitters, &Config{ClusterName: "my-cluster", EmitterCommonAttributes: true})
+	assert.Same(t, telemetry, wrapped[0])
+	assert.Same(t, telemetryEU, wrapped[1])
+	assert.NotSame(t, stdout, wrapped[2], "the emitters without common attributes get them on every metric")
+	assert.Equal(t, "stdout", wrapped[2].Name())
+}
+
+type namedEmitter struct {
+	name string
+}
+
+func (e *namedEmitter) Name() string {
+	return e.name
+}
+
+func (e *namedEmitter) Emit([]integration.Metric) error {
+	return nil
+}
+
+func TestNewTelemetryEmitter_Accounts(t *testing.T) {
+	cfg := &Config{
+		LicenseKey:           "global",
+		MetricAPIURL:         "http://localhost/metric/v1",
+		EmitterHarvestPeriod: "1h",
+		TelemetryEmitters: []TelemetryEmitterInstance{
+			{Name: "team-a", LicenseKey: "team-a", Account: "team-a"},
+			{Name: "gateway", MetricAPIURL: "http://gateway/metric/v1"},
+			{Name: "shop", Match: map[string]string{"namespaceName": "shop"}},
+		},
+	}
+	assert.Equal(t, []string{"team-a"}, routedAccounts(cfg))
+	assert.Equal(t, []map[string]string{{"namespaceName": "shop"}}, routedMatches(cfg))
+
+	for _, instance := range append([]TelemetryEmitterInstance{{}}, cfg.TelemetryEmitters...) {
+		emitter, err := newTelemetryEmitter(cfg, instance, nil)
+		require.NoError(t, err)
+		assert.Equal(t, instance.emitterName(), emitter.Name(), "the routing keeps the emitter name")
+	}
+}
@@ -4,20 +4,32 @@
 package scraper
 
 import (
+	"context"
+	"crypto/subtle"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
 	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/clustername"
+	"github.com/newrelic/nri-prometheus/internal/pkg/cpuquota"
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
-	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 // Config is the config struct for the scraper.
@@ -28,7 +40,7 @@ type Config struct {
 	ClusterName                       string                       `mapstructure:"cluster_name"`
 	Debug                             bool                         `mapstructure:"debug"`
 	Verbose                           bool                         `mapstructure:"verbose"`
-	Emitters                          []string                     `mapstructure:"emitters"`
+	Emitters                          []EmitterConfig              `mapstructure:"emitters"`
 	ScrapeEnabledLabel                string                       `mapstructure:"scrape_enabled_label"`
 	RequireScrapeEnabledLabelForNodes bool                         `mapstructure:"require_scrape_enabled_label_for_nodes"`
 	ScrapeTimeout                     time.Duration                `mapstructure:"scrape_timeout"`
@@ -45,10 +57,188 @@ type Config struct {
 	EmitterProxy                      string `mapstructure:"emitter_proxy"`
 	// Parsed version of `EmitterProxy`
 	EmitterProxyURL                              *url.URL
-	EmitterCAFile                                string        `mapstructure:"emitter_ca_file"`
-	EmitterInsecureSkipVerify                    bool          `mapstructure:"emitter_insecure_skip_verify" default:"false"`
-	TelemetryEmitterDeltaExpirationAge           time.Duration `mapstructure:"telemetry_emitter_delta_expiration_age"`
-	TelemetryEmitterDeltaExpirationCheckInterval time.Duration `mapstructure:"telemetry_emitter_delta_expiration_check_interval"`
+	EmitterCAFile                                string                    `mapstructure:"emitter_ca_file"`
+	EmitterInsecureSkipVerify                    bool                      `mapstructure:"emitter_insecure_skip_verify" default:"false"`
+	TelemetryEmitterDeltaExpirationAge           time.Duration             `mapstructure:"telemetry_emitter_delta_expiration_age"`
+	TelemetryEmitterDeltaExpirationCheckInterval time.Duration             `mapstructure:"telemetry_emitter_delta_expiration_check_interval"`
+	TelemetryEmitterPreEncodeAttributes          bool                      `mapstructure:"telemetry_emitter_pre_encode_attributes"`
+	EmitterLoadSheddingFailures                  int                       `mapstructure:"emitter_load_shedding_failures"`
+	EmitterLoadSheddingGaugeSampleRate           int                       `mapstructure:"emitter_load_shedding_gauge_sample_rate"`
+	GOMAXPROCS                                   int                       `mapstructure:"gomaxprocs"`
+	TargetCacheDir                               string                    `mapstructure:"target_cache_dir"`
+	TargetCacheWarmupTimeout                     time.Duration             `mapstructure:"target_cache_warmup_timeout"`
+	KubernetesAPIQPS                             float32                   `mapstructure:"kubernetes_api_qps"`
+	KubernetesAPIBurst                           int                       `mapstructure:"kubernetes_api_burst"`
+	KubernetesAPITimeout                         time.Duration             `mapstructure:"kubernetes_api_timeout"`
+	KubernetesBackoffMin                         time.Duration             `mapstructure:"kubernetes_backoff_min"`
+	KubernetesBackoffMax                         time.Duration             `mapstructure:"kubernetes_backoff_max"`
+	KubernetesClusters                           []endpoints.ClusterConfig `mapstructure:"kubernetes_clusters"`
+	DetectClusterName                            bool                      `mapstructure:"detect_cluster_name"`
+	ClusterNameConfigMap                         string                    `mapstructure:"cluster_name_configmap"`
+	OpenShift                                    bool                      `mapstructure:"openshift"`
+	OpenShiftServiceCAFile                       string                    `mapstructure:"openshift_service_ca_file"`
+	ServiceMesh                                  string                    `mapstructure:"service_mesh"`
+	ServiceMeshSplitProxyMetrics                 bool                      `mapstructure:"service_mesh_split_proxy_metrics"`
+	SkipNotReadyPods                             bool                      `mapstructure:"skip_not_ready_pods"`
+	SkipTerminatingPods                          bool                      `mapstructure:"skip_terminating_pods"`
+	KubernetesRefreshInterval                    time.Duration             `mapstructure:"kubernetes_refresh_interval"`
+	EmitTargetChanges                            bool                      `mapstructure:"emit_target_changes"`
+	ParseFailureCaptureKB                        int                       `mapstructure:"parse_failure_capture_kb"`
+	ParseFailureCaptureCount                     int                       `mapstructure:"parse_failure_capture_count"`
+	StrictContentType                            bool                      `mapstructure:"strict_content_type"`
+	ScrapeRetries                                int                       `mapstructure:"scrape_retries"`
+	ScrapeRetryBackoff                           time.Duration             `mapstructure:"scrape_retry_backoff"`
+	TrackSeries                                  bool                      `mapstructure:"track_series"`
+	SeriesTTL                                    time.Duration             `mapstructure:"series_ttl"`
+	SeriesGrowthThreshold                        float64                   `mapstructure:"series_growth_threshold"`
+	EmitQueueSize                                int                       `mapstructure:"emit_queue_size"`
+	EmitQueuePolicy                              string                    `mapstructure:"emit_queue_policy"`
+	EmitterCommonAttributes                      bool                      `mapstructure:"emitter_common_attributes"`
+	StrictConfig                                 bool                      `mapstructure:"strict_config"`
+	SamplesPolicy                                string                    `mapstructure:"samples_policy"`
+	SuccessRatioWindows                          []time.Duration           `mapstructure:"success_ratio_windows"`
+	// Query parameters added to the scrape URL of the matching targets.
+	TargetParams []integration.TargetParamsRule `mapstructure:"target_params"`
+	// Patterns of the personal data looked for by the audit command.
+	PIIPatterns []integration.PIIPattern `mapstructure:"pii_patterns"`
+	// Normalization of the attribute keys of the metrics of all emitters.
+	AttributeNormalization integration.NormalizationConfig `mapstructure:"attribute_normalization"`
+	// Additional telemetry emitters with their own Metric API URL.
+	TelemetryEmitters []TelemetryEmitterInstance `mapstructure:"telemetry_emitters"`
+	// Prefixes of the counters sent with their cumulative values.
+	EmitterCumulativeCounterPrefixes []string `mapstructure:"emitter_cumulative_counter_prefixes"`
+	// Pipeline stages skipped, also set with the --disable flag.
+	DisabledStages []string `mapstructure:"disabled_stages"`
+	// Prefixes of the gauges sent with integer values.
+	EmitterIntegerGaugePrefixes []string `mapstructure:"emitter_integer_gauge_prefixes"`
+	// Attributes added to the static targets from lookups of their hosts.
+	TargetEnrichment endpoints.EnrichmentConfig `mapstructure:"target_enrichment"`
+	// Endpoint of the remote_write emitter.
+	RemoteWrite integration.RemoteWriteConfig `mapstructure:"remote_write"`
+	// Enables the /-/debug/capture endpoint, with captures of up to the
+	// max duration, for the requests with the bearer token of the token
+	// file.
+	DebugCaptureEnabled     bool          `mapstructure:"debug_capture_enabled"`
+	DebugCaptureMaxDuration time.Duration `mapstructure:"debug_capture_max_duration"`
+	DebugCaptureTokenFile   string        `mapstructure:"debug_capture_token_file"`
+	// Split of the targets among the replicas of a StatefulSet.
+	Sharding endpoints.ShardingConfig `mapstructure:"sharding"`
+	// Brokers and topic of the kafka emitter.
+	Kafka integration.KafkaConfig `mapstructure:"kafka"`
+	// Path and rotation of the file emitter.
+	File integration.FileEmitterConfig `mapstructure:"file"`
+	// Metrics declared in the configuration, emitted every harvest.
+	StaticMetrics []integration.StaticMetric `mapstructure:"static_metrics"`
+	// Metrics sent to each emitter, by emitter name.
+	EmitterFilters map[string]integration.EmitterFilter `mapstructure:"emitter_filters"`
+	// Chain of emitters falling back to the next one when they fail.
+	EmitterFailover EmitterFailoverConfig `mapstructure:"emitter_failover"`
+	// Maximum number of concurrent scrapes of the same host, so the targets
+	// behind a shared gateway don't overload it. Unlimited if 0.
+	ScrapeMaxConcurrencyPerHost int `mapstructure:"scrape_max_concurrency_per_host"`
+	// Disk spool of the failed requests of the telemetry emitters.
+	EmitterSpool integration.SpoolConfig `mapstructure:"emitter_spool"`
+	// Parse the Metric API error responses of the telemetry emitters, to
+	// count and log the reasons of the rejected payloads.
+	EmitterRejectionDetails bool `mapstructure:"emitter_rejection_details"`
+	// Limit of the attributes of every metric, dropping the lowest priority
+	// ones beyond it.
+	AttributeLimit integration.AttributeLimitConfig `mapstructure:"attribute_limit"`
+	// Server and tags of the statsd emitter.
+	Statsd integration.StatsdConfig `mapstructure:"statsd"`
+	// Format of the stdout emitter: json, ndjson, pretty or prom-text.
+	StdoutFormat string `mapstructure:"stdout_format"`
+	// Whether the OpenMetrics exemplars of the targets are scraped as the
+	// <sample>_exemplar gauges. Each new exemplar is a new series of its
+	// trace.id.
+	ScrapeExemplars bool `mapstructure:"scrape_exemplars"`
+	// Groups of targets sharing the scrape workers in proportion to their
+	// weight.
+	ScrapeJobs []integration.ScrapeJob `mapstructure:"scrape_jobs"`
+	// Whether the native histograms of the targets are scraped, with at
+	// most NativeHistogramMaxBuckets buckets if greater than 0.
+	ScrapeNativeHistograms    bool `mapstructure:"scrape_native_histograms"`
+	NativeHistogramMaxBuckets int  `mapstructure:"native_histogram_max_buckets"`
+	// File the summary of the last harvest is persisted to, if any.
+	LastHarvestFile string `mapstructure:"last_harvest_file"`
+	// Whether the protocol buffer format is requested to the targets,
+	// falling back to the text formats for the ones not supporting it.
+	ScrapeProtobuf bool `mapstructure:"scrape_protobuf"`
+	// How the emitters authenticate to an internal telemetry gateway, by
+	// signing the payloads or with a client certificate.
+	EmitterSigning integration.PayloadSigningConfig `mapstructure:"emitter_signing"`
+	// Minimum number of series of the chunks the targets are scraped in,
+	// so their whole payloads aren't kept in memory. They are scraped whole
+	// if 0.
+	ScrapeChunkSize int `mapstructure:"scrape_chunk_size"`
+	// Gauges only emitted when their value changes, or every keep-alive
+	// intervals.
+	ReportOnChange integration.ReportOnChangeConfig `mapstructure:"report_on_change"`
+	// Annotated Ingresses and Gateway API HTTPRoutes scraped through their
+	// external hosts.
+	KubernetesEdge endpoints.EdgeConfig `mapstructure:"kubernetes_edge"`
+	// Directory the credential files of the annotations of the Kubernetes
+	// objects are relative to. The file annotations are ignored if empty.
+	KubernetesCredentialsDir string `mapstructure:"kubernetes_credentials_dir"`
+	// Namespaces and label selector of the Kubernetes objects whose
+	// prometheus.io/service-account-auth annotation is honored.
+	KubernetesServiceAccountAuth endpoints.ServiceAccountAuthConfig `mapstructure:"kubernetes_service_account_auth"`
+	// Accounts the Kubernetes objects of each namespace can route their
+	// metrics to with the newrelic.io/account annotation.
+	KubernetesAccountNamespaces map[string][]string `mapstructure:"kubernetes_account_namespaces"`
+	// Alarms on the internal state of the integration, like a discovery
+	// that lost all its targets, and the recoveries they trigger.
+	Watchdog integration.WatchdogConfig `mapstructure:"watchdog"`
+	// Timeouts of the phases of the scrapes, on top of the scrape_timeout.
+	ScrapeTimeouts integration.ScrapeTimeouts `mapstructure:"scrape_timeouts"`
+	// Window the scrapes of the targets are spread over from the start of
+	// every interval, at a stable offset of each target. Disabled if 0.
+	ScrapeJitter time.Duration `mapstructure:"scrape_jitter"`
+	// Type of the percentile attribute: numeric, string or both.
+	PercentileFormat string `mapstructure:"percentile_format"`
+	// Emits the samples exposed with a timestamp at their timestamp instead
+	// of the scrape time.
+	HonorTimestamps bool `mapstructure:"honor_timestamps"`
+	// Splits the harvester of the telemetry emitters into a pool keyed by
+	// an attribute of the metrics, like the namespace or the job.
+	EmitterHarvesterPool integration.HarvesterPoolConfig `mapstructure:"emitter_harvester_pool"`
+	// What is emitted for the series that disappear since the previous
+	// scrape of their target: zero or marker. Disabled if empty.
+	StaleSeries string `mapstructure:"stale_series"`
+	// Directory where the telemetry emitters persist the delta state of the
+	// counters, to restore it on restart. Disabled if empty.
+	DeltaStateDir string `mapstructure:"delta_state_dir"`
+	// Age of the oldest values of the counters restored from
+	// DeltaStateDir. Defaults to 10m.
+	DeltaStateMaxAge time.Duration `mapstructure:"delta_state_max_age"`
+	// Number of emitted metrics chosen at random that are logged every
+	// harvest. Disabled if 0.
+	LogSampledMetrics int `mapstructure:"log_sampled_metrics"`
+	// How the telemetry emitters send the counters: delta, cumulative or
+	// rate. Defaults to delta.
+	CounterOutput string `mapstructure:"counter_output"`
+	// Workarounds of the known issues of the exporters, applied to the
+	// targets whose exporter they detect.
+	Quirks integration.QuirksConfig `mapstructure:"quirks"`
+	// Send the count and sum of the summaries as delta counters besides
+	// their percentiles.
+	SummaryCountAndSum bool `mapstructure:"summary_count_and_sum"`
+	// Faults injected into the scrapes and emits to validate the alerting
+	// on the integration, only when enabled with the --fault-injection flag.
+	FaultInjection integration.FaultInjectionConfig `mapstructure:"fault_injection"`
+	// What the telemetry emitters send of the histograms, by the first rule
+	// matching their name.
+	HistogramModes []integration.HistogramModeRule `mapstructure:"histogram_modes"`
+	// Estimator of the percentiles of the histograms: linear or ddsketch,
+	// with the relative accuracy of the latter, 0.01 if 0.
+	PercentileEstimator        string  `mapstructure:"percentile_estimator"`
+	PercentileRelativeAccuracy float64 `mapstructure:"percentile_relative_accuracy"`
+	// Serve the metrics emitted with another type than their Prometheus one
+	// at /-/type-coercions.
+	TypeCoercionReport bool `mapstructure:"type_coercion_report"`
+	// File of the bearer token of the requests to /-/refresh-targets, which
+	// is only served when set.
+	RefreshTargetsTokenFile string `mapstructure:"refresh_targets_token_file"`
 }
 
 const maskedLicenseKey = "****"
@@ -72,14 +262,28 @@ const maxTargetConnections = 4
 // channel length for entities
 const queueLength = 100
 
+// shutdownTimeout bounds the last harvest and the stop of the server on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func validateConfig(cfg *Config) error {
 	requiredMsg := "%s is required and can't be empty"
 	if cfg.ClusterName == "" {
 		return fmt.Errorf(requiredMsg, "cluster_name")
 	}
-	if cfg.LicenseKey == "" {
+	// The license key is added by the gateway when it's omitted.
+	if cfg.LicenseKey == "" && !cfg.EmitterSigning.OmitLicenseKey {
 		return fmt.Errorf(requiredMsg, "license_key")
 	}
+	return validateOptions(cfg)
+}
+
+// validateOptions validates the options of the configuration that aren't
+// required.
+func validateOptions(cfg *Config) error {
+	if err := ResolveEmitters(cfg); err != nil {
+		return err
+	}
 	for _, p := range cfg.Percentiles {
 		if p < 0.0 {
 			return fmt.Errorf("percentiles must be greater than or equal to 0.0, got %f", p)
@@ -89,6 +293,137 @@ func validateConfig(cfg *Config) error {
 		}
 	}
 
+	if _, err := integration.ParseDisabledStages(cfg.DisabledStages); err != nil {
+		return err
+	}
+
+	if err := cfg.TargetEnrichment.Validate(); err != nil {
+		return fmt.Errorf("invalid target enrichment: %w", err)
+	}
+	if err := cfg.Sharding.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.KubernetesEdge.Validate(); err != nil {
+		return err
+	}
+	if err := validateTelemetryEmitters(cfg.TelemetryEmitters); err != nil {
+		return err
+	}
+	if err := validateEmitterFilters(cfg); err != nil {
+		return err
+	}
+	if err := validateEmitterFailover(cfg); err != nil {
+		return err
+	}
+	if err := cfg.EmitterHarvesterPool.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.EmitterSpool.Validate(); err != nil {
+		return err
+	}
+	for _, e := range cfg.Emitters {
+		switch e.Type {
+		case "remote_write":
+			if err := cfg.RemoteWrite.Validate(); err != nil {
+				return err
+			}
+		case "kafka":
+			if err := cfg.Kafka.Validate(); err != nil {
+				return err
+			}
+		case "file":
+			if err := cfg.File.Validate(); err != nil {
+				return err
+			}
+		case "stdout":
+			if err := integration.ValidateStdoutFormat(cfg.StdoutFormat); err != nil {
+				return err
+			}
+		case "statsd":
+			if err := cfg.Statsd.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := integration.NewAttributeNormalizer(cfg.AttributeNormalization); err != nil {
+		return err
+	}
+	if _, err := integration.NewStaticMetrics(cfg.StaticMetrics); err != nil {
+		return err
+	}
+	if _, err := integration.NewAttributeLimiter(cfg.AttributeLimit); err != nil {
+		return err
+	}
+	if err := integration.ValidateScrapeJobs(cfg.ScrapeJobs); err != nil {
+		return err
+	}
+	if cfg.NativeHistogramMaxBuckets < 0 {
+		return fmt.Errorf("native_histogram_max_buckets can't be negative, got %d", cfg.NativeHistogramMaxBuckets)
+	}
+	if err := cfg.EmitterSigning.Validate(); err != nil {
+		return err
+	}
+	if cfg.ScrapeChunkSize < 0 {
+		return fmt.Errorf("scrape_chunk_size can't be negative, got %d", cfg.ScrapeChunkSize)
+	}
+	if err := cfg.ReportOnChange.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Watchdog.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.ScrapeTimeouts.Validate(); err != nil {
+		return err
+	}
+	if cfg.ScrapeJitter < 0 {
+		return fmt.Errorf("scrape_jitter can't be negative, got %s", cfg.ScrapeJitter)
+	}
+	if _, err := integration.ParsePercentileFormat(cfg.PercentileFormat); err != nil {
+		return err
+	}
+	if cfg.StaleSeries != "" {
+		if _, err := integration.ParseStaleSeriesPolicy(cfg.StaleSeries); err != nil {
+			return err
+		}
+	}
+	if _, err := integration.ParseCounterOutput(cfg.CounterOutput); err != nil {
+		return err
+	}
+	if err := cfg.Quirks.Validate(); err != nil {
+		return err
+	}
+	if cfg.DebugCaptureEnabled && cfg.DebugCaptureTokenFile == "" {
+		return fmt.Errorf("debug_capture_enabled requires debug_capture_token_file")
+	}
+	if cfg.LogSampledMetrics < 0 {
+		return fmt.Errorf("log_sampled_metrics can't be negative, got %d", cfg.LogSampledMetrics)
+	}
+	if err := cfg.FaultInjection.Validate(); err != nil {
+		return err
+	}
+	if err := integration.ValidateHistogramModes(cfg.HistogramModes); err != nil {
+		return err
+	}
+	if _, err := integration.ParsePercentileEstimator(cfg.PercentileEstimator); err != nil {
+		return err
+	}
+	if err := integration.ValidatePercentileRelativeAccuracy(cfg.PercentileRelativeAccuracy); err != nil {
+		return err
+	}
+
+	for _, pr := range cfg.ProcessingRules {
+		for _, r := range pr.RedactAttributes {
+			if err := r.Validate(); err != nil {
+				return err
+			}
+		}
+		for _, r := range pr.TemplateAttributes {
+			if err := r.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+
 	if cfg.EmitterProxy != "" {
 		proxyURL, err := url.Parse(cfg.EmitterProxy)
 		if err != nil {
@@ -109,77 +444,475 @@ func validateConfig(cfg *Config) error {
 
 // RunWithEmitters runs the scraper with preselected emitters.
 func RunWithEmitters(cfg *Config, emitters []integration.Emitter) error {
+	return runWithEmitters(cfg, emitters, newSuccessRatios(cfg))
+}
+
+// newSuccessRatios returns the registered SuccessRatios of the configured
+// windows, or nil if there are none.
+func newSuccessRatios(cfg *Config) *integration.SuccessRatios {
+	if len(cfg.SuccessRatioWindows) == 0 {
+		return nil
+	}
+	ratios := integration.NewSuccessRatios(cfg.SuccessRatioWindows...)
+	prometheus.MustRegister(ratios)
+	return ratios
+}
+
+func runWithEmitters(cfg *Config, emitters []integration.Emitter, ratios *integration.SuccessRatios) error {
 	logrus.Infof("Starting New Relic's Prometheus OpenMetrics Integration version %s", integration.Version)
 	logrus.Debugf("Config: %#v", cfg)
 
 	if len(emitters) == 0 {
 		return fmt.Errorf("you need to configure at least one valid emitter")
 	}
+	if disabled, _ := integration.ParseDisabledStages(cfg.DisabledStages); disabled != (integration.DisabledStages{}) {
+		logrus.WithField("stages", disabled.String()).Warn("pipeline stages are disabled")
+	}
+	if !cfg.FaultInjection.IsEmpty() {
+		logrus.WithField("config", fmt.Sprintf("%+v", cfg.FaultInjection)).Warn("fault injection is enabled, scrapes and emits fail on purpose")
+		emitters = faultInjectingEmitters(emitters, cfg.FaultInjection)
+	}
 
 	selfRetriever, err := endpoints.SelfRetriever()
 	if err != nil {
 		return fmt.Errorf("while parsing provided endpoints: %w", err)
 	}
+	p, err := newPipeline(cfg, ratios)
+	if err != nil {
+		return err
+	}
+
+	var executeOpts []integration.ExecuteOption
+	if cfg.EmitTargetChanges {
+		executeOpts = append(executeOpts, integration.WithTargetChangeMetrics())
+	}
+	if cfg.TrackSeries {
+		executeOpts = append(executeOpts, integration.WithSeriesTracking(cfg.SeriesTTL, cfg.SeriesGrowthThreshold))
+	}
+	if cfg.EmitQueueSize > 0 {
+		policy, err := integration.ParseQueuePolicy(cfg.EmitQueuePolicy)
+		if err != nil {
+			return err
+		}
+		executeOpts = append(executeOpts, integration.WithEmitQueue(cfg.EmitQueueSize, policy))
+	}
+	if len(cfg.StaticMetrics) > 0 {
+		static, err := integration.NewStaticMetrics(cfg.StaticMetrics)
+		if err != nil {
+			return err
+		}
+		executeOpts = append(executeOpts, integration.WithStaticMetrics(static))
+	}
+
+	if !cfg.ReportOnChange.IsEmpty() {
+		executeOpts = append(executeOpts, integration.WithReportOnChange(cfg.ReportOnChange))
+	}
+	if cfg.StaleSeries != "" {
+		policy, err := integration.ParseStaleSeriesPolicy(cfg.StaleSeries)
+		if err != nil {
+			return err
+		}
+		executeOpts = append(executeOpts, integration.WithStaleSeries(policy))
+	}
+	if cfg.LogSampledMetrics > 0 {
+		executeOpts = append(executeOpts, integration.WithSampleLogging(cfg.LogSampledMetrics))
+	}
+	var coercions *integration.TypeCoercions
+	if cfg.TypeCoercionReport {
+		counterOutput, _ := integration.ParseCounterOutput(cfg.CounterOutput)
+		coercions = integration.NewTypeCoercions(cfg.EmitterCumulativeCounterPrefixes, counterOutput)
+		executeOpts = append(executeOpts, integration.WithTypeCoercionReport(coercions))
+	}
+	if !cfg.Watchdog.IsEmpty() {
+		executeOpts = append(executeOpts, integration.WithWatchdog(cfg.Watchdog))
+	}
+
+	if p.debugCapture != nil {
+		emitters = append(emitters, commonAttributesEmitters([]integration.Emitter{p.debugCapture}, cfg)...)
+	}
+
+	summary := integration.NewHarvestSummary(cfg.LastHarvestFile)
+	executeOpts = append(executeOpts, integration.WithHarvestSummary(summary))
+
+	go integration.Execute(
+		p.scrapeDuration,
+		selfRetriever,
+		p.retrievers,
+		p.fetcher,
+		p.processor,
+		emitters,
+		executeOpts...)
+
+	r := http.NewServeMux()
+	r.Handle("/metrics", promhttp.Handler())
+	if cfg.RefreshTargetsTokenFile != "" {
+		r.Handle("/-/refresh-targets", withBearerToken(cfg.RefreshTargetsTokenFile, refreshTargetsHandler(p.retrievers)))
+	}
+	r.Handle("/-/last-harvest", summary)
+	publishExpvars()
+	r.Handle("/debug/vars", expvar.Handler())
+	if p.parseFailures != nil {
+		r.Handle("/-/parse-failures", p.parseFailures)
+	}
+	if p.debugCapture != nil {
+		r.Handle("/-/debug/capture", withBearerToken(cfg.DebugCaptureTokenFile, p.debugCapture))
+	}
+	if p.sharder != nil {
+		r.Handle("/-/shard", p.sharder)
+	}
+	if coercions != nil {
+		r.Handle("/-/type-coercions", coercions)
+	}
+	if cfg.Debug {
+		r.HandleFunc("/debug/pprof/", pprof.Index)
+		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	server := &http.Server{Addr: ":8080", Handler: r}
+	go shutdownOnSignal(server, emitters)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// shutdownOnSignal saves the delta state of the emitters and stops the
+// server on SIGTERM or SIGINT, like when the pod is deleted, so the values
+// of the counters since the last save aren't lost.
+func shutdownOnSignal(server *http.Server, emitters []integration.Emitter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	logrus.WithField("signal", sig.String()).Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	integration.SaveDeltaStates(ctx, emitters)
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Warn("error stopping the server")
+	}
+}
+
+// pipeline holds the stages of the integration loop built from the
+// configuration.
+type pipeline struct {
+	scrapeDuration time.Duration
+	retrievers     []endpoints.TargetRetriever
+	fetcher        integration.Fetcher
+	processor      integration.Processor
+	// parseFailures is nil unless the capture of parse failures is enabled.
+	parseFailures *integration.ParseFailures
+	// debugCapture is nil unless the debug capture endpoint is enabled.
+	debugCapture *integration.DebugCapture
+	// sharder is nil unless sharding is enabled.
+	sharder *endpoints.Sharder
+}
+
+// newPipeline builds the target retrievers, the fetcher and the processor
+// of the configuration. The scrapes are recorded in ratios if not nil.
+func newPipeline(cfg *Config, ratios *integration.SuccessRatios) (*pipeline, error) {
 	var retrievers []endpoints.TargetRetriever
 	fixedRetriever, err := endpoints.FixedRetriever(cfg.TargetConfigs...)
 	if err != nil {
-		return fmt.Errorf("while parsing provided endpoints: %w", err)
+		return nil, fmt.Errorf("while parsing provided endpoints: %w", err)
+	}
+	if !cfg.TargetEnrichment.IsEmpty() {
+		fixedRetriever = endpoints.EnrichedRetriever(fixedRetriever, cfg.TargetEnrichment.CacheTTL, cfg.TargetEnrichment.Timeout, endpoints.NewEnrichers(cfg.TargetEnrichment)...)
 	}
 	retrievers = append(retrievers, fixedRetriever)
 
-	kubernetesRetriever, err := endpoints.NewKubernetesTargetRetriever(cfg.ScrapeEnabledLabel, cfg.RequireScrapeEnabledLabelForNodes, endpoints.WithInClusterConfig())
+	if len(cfg.KubernetesClusters) == 0 {
+		kubernetesRetriever, err := newKubernetesRetriever(cfg, endpoints.WithInClusterConfig())
+		if err != nil {
+			logrus.WithError(err).Errorf("not possible to get a Kubernetes client. If you aren't running this integration in a Kubernetes cluster, you can ignore this error")
+		} else {
+			checkPermissions(kubernetesRetriever)
+			retrievers = append(retrievers, withTargetCache(cfg, kubernetesRetriever))
+		}
+	}
+	for _, cluster := range cfg.KubernetesClusters {
+		clusterOpt, err := cluster.Option()
+		if err != nil {
+			return nil, fmt.Errorf("while parsing kubernetes clusters: %w", err)
+		}
+		clusterOpts := []endpoints.Option{clusterOpt, endpoints.WithClusterName(cluster.ClusterName)}
+		if cluster.RefreshInterval != nil {
+			clusterOpts = append(clusterOpts, endpoints.WithRefreshInterval(*cluster.RefreshInterval))
+		}
+		kubernetesRetriever, err := newKubernetesRetriever(cfg, clusterOpts...)
+		if err != nil {
+			logrus.WithError(err).WithField("cluster", cluster.ClusterName).Error("not possible to get a Kubernetes client, the cluster won't be scraped")
+			continue
+		}
+		checkPermissions(kubernetesRetriever)
+		retrievers = append(retrievers, withTargetCache(cfg, kubernetesRetriever))
+	}
+	var sharder *endpoints.Sharder
+	if !cfg.Sharding.IsEmpty() {
+		if sharder, err = newSharder(cfg.Sharding); err != nil {
+			return nil, err
+		}
+		for i, retriever := range retrievers {
+			retrievers[i] = endpoints.ShardedRetriever(retriever, sharder)
+		}
+	}
+
+	disabled, err := integration.ParseDisabledStages(cfg.DisabledStages)
 	if err != nil {
-		logrus.WithError(err).Errorf("not possible to get a Kubernetes client. If you aren't running this integration in a Kubernetes cluster, you can ignore this error")
-	} else {
-		retrievers = append(retrievers, kubernetesRetriever)
-	}
-	defaultTransformations := integration.ProcessingRule{
-		Description: "Default transformation rules",
-		AddAttributes: []integration.AddAttributesRule{
-			{
-				MetricPrefix: "",
-				Attributes: map[string]interface{}{
-					"k8s.cluster.name":   cfg.ClusterName,
-					"clusterName":        cfg.ClusterName,
-					"integrationVersion": integration.Version,
-					"integrationName":    integration.Name,
+		return nil, err
+	}
+	processingRules := cfg.ProcessingRules
+	if disabled.Rules {
+		processingRules = redactionRules(cfg.ProcessingRules)
+	}
+	if !cfg.EmitterCommonAttributes {
+		defaultTransformations := integration.ProcessingRule{
+			Description: "Default transformation rules",
+			AddAttributes: []integration.AddAttributesRule{
+				{
+					MetricPrefix: "",
+					Attributes:   defaultAttributes(cfg),
 				},
 			},
-		},
+		}
+		processingRules = append(processingRules, defaultTransformations)
 	}
-	processingRules := append(cfg.ProcessingRules, defaultTransformations)
 
 	scrapeDuration, err := time.ParseDuration(cfg.ScrapeDuration)
 	if err != nil {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"parsing scrape_duration value (%v): %w",
 			cfg.ScrapeDuration,
 			err,
 		)
 	}
 
-	go integration.Execute(
-		scrapeDuration,
-		selfRetriever,
-		retrievers,
-		integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, maxTargetConnections, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength),
-		integration.RuleProcessor(processingRules, queueLength),
-		emitters)
+	var fetcherOpts []integration.FetcherOption
+	if cfg.OpenShift && cfg.OpenShiftServiceCAFile != "" {
+		// Targets managed by the cluster monitoring operator serve
+		// certificates signed by the service CA.
+		if _, err := os.Stat(cfg.OpenShiftServiceCAFile); err == nil {
+			fetcherOpts = append(fetcherOpts, integration.WithAdditionalCAFiles(cfg.OpenShiftServiceCAFile))
+		} else {
+			logrus.WithError(err).Warn("OpenShift service CA file not found, targets using service serving certificates may fail")
+		}
+	}
 
-	r := http.NewServeMux()
-	r.Handle("/metrics", promhttp.Handler())
-	if cfg.Debug {
-		r.HandleFunc("/debug/pprof/", pprof.Index)
-		r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		r.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if cfg.StrictContentType {
+		fetcherOpts = append(fetcherOpts, integration.WithStrictContentType())
 	}
-	return http.ListenAndServe(":8080", r)
+
+	if cfg.ScrapeExemplars {
+		fetcherOpts = append(fetcherOpts, integration.WithExemplars())
+	}
+
+	if cfg.ScrapeChunkSize > 0 {
+		fetcherOpts = append(fetcherOpts, integration.WithScrapeChunkSize(cfg.ScrapeChunkSize))
+	}
+
+	if cfg.ScrapeProtobuf {
+		fetcherOpts = append(fetcherOpts, integration.WithProtobuf())
+	}
+
+	if cfg.ScrapeNativeHistograms {
+		fetcherOpts = append(fetcherOpts, integration.WithNativeHistograms(cfg.NativeHistogramMaxBuckets))
+	}
+
+	if len(cfg.ScrapeJobs) > 0 {
+		fetcherOpts = append(fetcherOpts, integration.WithScrapeJobs(cfg.ScrapeJobs...))
+	}
+
+	if cfg.ScrapeRetries > 0 {
+		fetcherOpts = append(fetcherOpts, integration.WithScrapeRetries(cfg.ScrapeRetries, cfg.ScrapeRetryBackoff))
+	}
+
+	if cfg.ScrapeMaxConcurrencyPerHost > 0 {
+		fetcherOpts = append(fetcherOpts, integration.WithMaxConcurrencyPerHost(cfg.ScrapeMaxConcurrencyPerHost))
+	}
+	if !cfg.ScrapeTimeouts.IsEmpty() {
+		fetcherOpts = append(fetcherOpts, integration.WithScrapeTimeouts(cfg.ScrapeTimeouts))
+	}
+	if cfg.HonorTimestamps {
+		fetcherOpts = append(fetcherOpts, integration.WithHonorTimestamps())
+	}
+	if quirks := cfg.Quirks.Quirks(); len(quirks) > 0 {
+		fetcherOpts = append(fetcherOpts, integration.WithQuirks(quirks))
+	}
+	if !cfg.FaultInjection.IsEmpty() {
+		fetcherOpts = append(fetcherOpts, integration.WithFaultInjection(cfg.FaultInjection))
+	}
+	if cfg.ScrapeJitter > 0 {
+		if cfg.ScrapeJitter > scrapeDuration {
+			return nil, fmt.Errorf("scrape_jitter (%s) can't be longer than scrape_duration (%s)", cfg.ScrapeJitter, scrapeDuration)
+		}
+		fetcherOpts = append(fetcherOpts, integration.WithScrapeJitter(cfg.ScrapeJitter))
+	}
+
+	if cfg.SamplesPolicy != "" {
+		policy, err := integration.ParseSamplesPolicy(cfg.SamplesPolicy)
+		if err != nil {
+			return nil, err
+		}
+		fetcherOpts = append(fetcherOpts, integration.WithSamplesPolicy(policy))
+	}
+
+	if ratios != nil {
+		fetcherOpts = append(fetcherOpts, integration.WithSuccessRatios(ratios))
+	}
+
+	if len(cfg.TargetParams) > 0 {
+		fetcherOpts = append(fetcherOpts, integration.WithTargetParams(cfg.TargetParams...))
+	}
+
+	normalizer, err := integration.NewAttributeNormalizer(cfg.AttributeNormalization)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter, err := integration.NewAttributeLimiter(cfg.AttributeLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	processorOpts := []integration.ProcessorOption{
+		integration.WithAttributeNormalizer(normalizer),
+		integration.WithAttributeLimiter(limiter),
+	}
+	if disabled.Decoration {
+		processorOpts = append(processorOpts, integration.WithoutDecoration())
+	}
+
+	p := &pipeline{
+		scrapeDuration: scrapeDuration,
+		retrievers:     retrievers,
+		sharder:        sharder,
+		processor:      integration.RuleProcessor(processingRules, queueLength, processorOpts...),
+	}
+	if cfg.ParseFailureCaptureKB > 0 {
+		p.parseFailures = integration.NewParseFailures(cfg.ParseFailureCaptureCount)
+		fetcherOpts = append(fetcherOpts, integration.WithParseFailureCapture(p.parseFailures, cfg.ParseFailureCaptureKB*1024))
+	}
+	if cfg.DebugCaptureEnabled {
+		p.debugCapture = integration.NewDebugCapture(cfg.DebugCaptureMaxDuration, 0)
+		fetcherOpts = append(fetcherOpts, integration.WithDebugCapture(p.debugCapture))
+	}
+	p.fetcher = integration.NewFetcher(scrapeDuration, cfg.ScrapeTimeout, maxTargetConnections, cfg.BearerTokenFile, cfg.CaFile, cfg.InsecureSkipVerify, queueLength, fetcherOpts...)
+	return p, nil
+}
+
+// newSharder returns the Sharder of the replica, whose index defaults to the
+// ordinal of the hostname.
+func newSharder(cfg endpoints.ShardingConfig) (*endpoints.Sharder, error) {
+	hostname, _ := os.Hostname()
+	replica, err := cfg.ReplicaIndex(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("while configuring sharding: %w", err)
+	}
+	logrus.WithField("replica", replica).WithField("replicas", cfg.Replicas).Info("scraping the targets of the replica in sharded mode")
+	return endpoints.NewSharder(replica, cfg.Replicas), nil
+}
+
+// redactionRules returns the redaction rules of the processing rules, which
+// are kept when the rules stage is disabled.
+func redactionRules(rules []integration.ProcessingRule) []integration.ProcessingRule {
+	var redaction []integration.ProcessingRule
+	for _, pr := range rules {
+		if len(pr.RedactAttributes) > 0 {
+			redaction = append(redaction, integration.ProcessingRule{
+				Description:      pr.Description,
+				RedactAttributes: pr.RedactAttributes,
+			})
+		}
+	}
+	return redaction
+}
+
+// checkPermissions logs the permissions the service account is missing to
+// discover targets in the cluster of the retriever.
+func checkPermissions(retriever *endpoints.KubernetesTargetRetriever) {
+	log := logrus.WithField("retriever", retriever.Name())
+	missing, err := retriever.MissingPermissions()
+	if err != nil {
+		log.WithError(err).Warn("couldn't check the RBAC permissions of the service account")
+		return
+	}
+	if len(missing) == 0 {
+		return
+	}
+	permissions := make([]string, 0, len(missing))
+	for _, p := range missing {
+		permissions = append(permissions, p.String())
+	}
+	log.WithField("missing", strings.Join(permissions, ", ")).Error(
+		"the service account is missing RBAC permissions, targets from these resources won't be discovered. " +
+			"Grant them in the ClusterRole bound to the service account")
+}
+
+// newKubernetesRetriever creates a KubernetesTargetRetriever with the common
+// configuration options and the given cluster options.
+func newKubernetesRetriever(cfg *Config, clusterOpts ...endpoints.Option) (*endpoints.KubernetesTargetRetriever, error) {
+	opts := []endpoints.Option{
+		endpoints.WithAPIRequestBudget(cfg.KubernetesAPIQPS, cfg.KubernetesAPIBurst, cfg.KubernetesAPITimeout),
+		endpoints.WithBackoff(cfg.KubernetesBackoffMin, cfg.KubernetesBackoffMax),
+		endpoints.WithServiceMesh(cfg.ServiceMesh, cfg.ServiceMeshSplitProxyMetrics),
+		endpoints.WithPodReadiness(cfg.SkipNotReadyPods, cfg.SkipTerminatingPods),
+		endpoints.WithRefreshInterval(cfg.KubernetesRefreshInterval),
+		endpoints.WithCredentialsDir(cfg.KubernetesCredentialsDir),
+		endpoints.WithServiceAccountAuth(cfg.KubernetesServiceAccountAuth),
+		endpoints.WithAccountNamespaces(cfg.KubernetesAccountNamespaces),
+	}
+	if cfg.OpenShift {
+		opts = append(opts, endpoints.WithOpenShiftRoutes())
+	}
+	if !cfg.KubernetesEdge.IsEmpty() {
+		opts = append(opts, endpoints.WithEdgeResources(cfg.KubernetesEdge))
+	}
+	// The cluster options are applied last so they override the common ones.
+	opts = append(opts, clusterOpts...)
+	return endpoints.NewKubernetesTargetRetriever(cfg.ScrapeEnabledLabel, cfg.RequireScrapeEnabledLabelForNodes, opts...)
+}
+
+// withTargetCache wraps the retriever so its targets are persisted into the
+// configured cache directory. If no directory is configured, the retriever is
+// returned as is.
+func withTargetCache(cfg *Config, retriever endpoints.TargetRetriever) endpoints.TargetRetriever {
+	if cfg.TargetCacheDir == "" {
+		return retriever
+	}
+	cacheFile := filepath.Join(cfg.TargetCacheDir, retriever.Name()+".json")
+	return endpoints.CachedRetriever(retriever, cacheFile, cfg.TargetCacheWarmupTimeout)
+}
+
+// detectClusterName detects the name of the cluster the integration runs in.
+func detectClusterName(cfg *Config) (string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return "", fmt.Errorf("could not read inclusterconfig: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("could create kubernetes client: %w", err)
+	}
+
+	name, source, err := clustername.NewDetector(client, cfg.ClusterNameConfigMap).Detect()
+	if err != nil {
+		return "", err
+	}
+	logrus.WithField("source", source).Infof("cluster_name not configured, using detected cluster name %q", name)
+	return name, nil
 }
 
 // Run runs the scraper
 func Run(cfg *Config) error {
+	if cfg.ClusterName == "" && cfg.DetectClusterName {
+		name, err := detectClusterName(cfg)
+		if err != nil {
+			logrus.WithError(err).Warn("couldn't detect the cluster name")
+		}
+		cfg.ClusterName = name
+	}
+
 	err := validateConfig(cfg)
 	if err != nil {
 		return fmt.Errorf("while getting configuration options: %w", err)
@@ -187,79 +920,198 @@ func Run(cfg *Config) error {
 	if cfg.Verbose {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
+	setGOMAXPROCS(cfg.GOMAXPROCS)
 
+	ratios := newSuccessRatios(cfg)
 	var emitters []integration.Emitter
 	for _, e := range cfg.Emitters {
-		switch e {
+		switch e.Type {
 		case "stdout":
-			emitters = append(emitters, integration.NewStdoutEmitter())
-		case "telemetry":
-			hTime, err := time.ParseDuration(cfg.EmitterHarvestPeriod)
+			emitter, err := integration.NewStdoutEmitterWithFormat(cfg.StdoutFormat)
 			if err != nil {
-				return fmt.Errorf(
-					"invalid telemetry emitter harvest period %s: %w",
-					cfg.EmitterHarvestPeriod,
-					err,
-				)
-			}
-
-			harvesterOpts := []func(*telemetry.Config){
-				telemetry.ConfigAPIKey(string(cfg.LicenseKey)),
-				telemetry.ConfigBasicErrorLogger(os.Stdout),
-				integration.TelemetryHarvesterWithMetricsURL(cfg.MetricAPIURL),
-				integration.TelemetryHarvesterWithHarvestPeriod(hTime),
+				return fmt.Errorf("could not create new StdoutEmitter: %w", err)
 			}
-
-			if cfg.EmitterProxyURL != nil {
-				harvesterOpts = append(
-					harvesterOpts,
-					integration.TelemetryHarvesterWithProxy(cfg.EmitterProxyURL),
-				)
+			emitters = append(emitters, emitter)
+		case "telemetry":
+			emitter, err := newTelemetryEmitter(cfg, TelemetryEmitterInstance{}, ratios)
+			if err != nil {
+				return err
 			}
-
-			if cfg.EmitterCAFile != "" {
-				tlsConfig, err := integration.NewTLSConfig(
-					cfg.EmitterCAFile,
-					cfg.EmitterInsecureSkipVerify,
-				)
-				if err != nil {
-					return fmt.Errorf("invalid TLS configuration: %w", err)
-				}
-				harvesterOpts = append(
-					harvesterOpts,
-					integration.TelemetryHarvesterWithTLSConfig(tlsConfig),
-				)
+			emitters = append(emitters, emitter)
+		case "remote_write":
+			emitter, err := newRemoteWriteEmitter(cfg)
+			if err != nil {
+				return err
 			}
-
-			// Options that rely on modifying the emitter Client Transport
-			// should go before this one, as this changes the type of the
-			// Transport to `integration.licenseKeyRoundTripper`.
-			harvesterOpts = append(
-				harvesterOpts,
-				integration.TelemetryHarvesterWithLicenseKeyRoundTripper(string(cfg.LicenseKey)),
-			)
-
-			if cfg.Verbose {
-				harvesterOpts = append(harvesterOpts, telemetry.ConfigBasicDebugLogger(os.Stdout))
+			emitters = append(emitters, emitter)
+		case "kafka":
+			emitter, err := integration.NewKafkaEmitter(cfg.Kafka)
+			if err != nil {
+				return fmt.Errorf("could not create new KafkaEmitter: %w", err)
 			}
-
-			c := integration.TelemetryEmitterConfig{
-				Percentiles:                   cfg.Percentiles,
-				HarvesterOpts:                 harvesterOpts,
-				DeltaExpirationAge:            cfg.TelemetryEmitterDeltaExpirationAge,
-				DeltaExpirationCheckInternval: cfg.TelemetryEmitterDeltaExpirationCheckInterval,
+			emitters = append(emitters, emitter)
+		case "file":
+			emitter, err := integration.NewFileEmitter(cfg.File)
+			if err != nil {
+				return fmt.Errorf("could not create new FileEmitter: %w", err)
 			}
-
-			emitter, err := integration.NewTelemetryEmitter(c)
+			emitters = append(emitters, emitter)
+		case "statsd":
+			emitter, err := integration.NewStatsdEmitter(cfg.Statsd)
 			if err != nil {
-				return errors.Wrap(err, "could not create new TelemetryEmitter")
+				return fmt.Errorf("could not create new StatsdEmitter: %w", err)
 			}
 			emitters = append(emitters, emitter)
 		default:
-			logrus.Debugf("unknown emitter: %s", e)
+			logrus.Debugf("unknown emitter: %s", e.Type)
 			continue
 		}
 	}
 
-	return RunWithEmitters(cfg, emitters)
+	for _, instance := range cfg.TelemetryEmitters {
+		emitter, err := newTelemetryEmitter(cfg, instance, ratios)
+		if err != nil {
+			return fmt.Errorf("telemetry emitter %s: %w", instance.Name, err)
+		}
+		emitters = append(emitters, emitter)
+	}
+
+	emitters = filterEmitters(commonAttributesEmitters(emitters, cfg), cfg.EmitterFilters)
+	return runWithEmitters(cfg, failoverEmitters(emitters, cfg.EmitterFailover), ratios)
+}
+
+// setGOMAXPROCS sets the number of threads running Go code. If procs is 0,
+// it's detected from the CPU limit of the container, unless the GOMAXPROCS
+// environment variable is set, so the scraper isn't throttled when it is
+// limited to a fraction of the CPUs of the node. Negative values keep the
+// runtime default.
+func setGOMAXPROCS(procs int) {
+	if procs < 0 {
+		return
+	}
+	if procs == 0 {
+		if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+			return
+		}
+		cpus, limited, err := cpuquota.Limit()
+		if err != nil {
+			logrus.WithError(err).Warn("couldn't detect the CPU limit, keeping the default GOMAXPROCS")
+			return
+		}
+		if !limited {
+			return
+		}
+		procs = cpuquota.GOMAXPROCS(cpus)
+		logrus.Debugf("detected a CPU limit of %g CPUs", cpus)
+	}
+	previous := runtime.GOMAXPROCS(procs)
+	logrus.Infof("GOMAXPROCS set to %d (was %d)", procs, previous)
+}
+
+// defaultAttributes returns the attributes added to all the metrics.
+func defaultAttributes(cfg *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"k8s.cluster.name":   cfg.ClusterName,
+		"clusterName":        cfg.ClusterName,
+		"integrationVersion": integration.Version,
+		"integrationName":    integration.Name,
+	}
+}
+
+// withBearerToken only passes to the handler the requests with the bearer
+// token of the token file, which is read for every request so it can be
+// rotated.
+func withBearerToken(tokenFile string, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			logrus.WithError(err).WithField("path", r.URL.Path).Warn("couldn't read the endpoint token")
+			http.Error(w, "couldn't read the token", http.StatusInternalServerError)
+			return
+		}
+		expected := "Bearer " + strings.TrimSpace(string(token))
+		if strings.TrimSpace(string(token)) == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// refreshTargetsHandler forces the immediate re-discovery of the targets of
+// the retrievers that support it, so changes of the annotations don't have
+// to wait for the next refresh.
+func refreshTargetsHandler(retrievers []endpoints.TargetRetriever) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := http.StatusOK
+		var body strings.Builder
+		for _, retriever := range retrievers {
+			refresher, ok := retriever.(endpoints.Refresher)
+			if !ok {
+				continue
+			}
+			if err := refresher.Refresh(); err != nil {
+				logrus.WithError(err).WithField("retriever", retriever.Name()).Warn("couldn't refresh targets")
+				status = http.StatusInternalServerError
+				fmt.Fprintf(&body, "%s: %v\n", retriever.Name(), err)
+				continue
+			}
+			fmt.Fprintf(&body, "%s: refreshed\n", retriever.Name())
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body.String()))
+	}
+}
+
+// expvarName is the name of the expvar holding the self-metrics.
+const expvarName = "nr_stats"
+
+// publishExpvars publishes the self-metrics of the integration as an expvar,
+// for tooling that already inspects expvars. The values are gathered from the
+// Prometheus self-metrics when the expvar is read, keyed by metric name and,
+// for the metrics with labels, by their label values.
+func publishExpvars() {
+	if expvar.Get(expvarName) != nil {
+		return
+	}
+	expvar.Publish(expvarName, expvar.Func(func() interface{} {
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			return err.Error()
+		}
+		vars := map[string]interface{}{}
+		for _, mf := range mfs {
+			if !strings.HasPrefix(mf.GetName(), expvarName+"_") {
+				continue
+			}
+			if len(mf.GetMetric()) == 1 && len(mf.GetMetric()[0].GetLabel()) == 0 {
+				vars[mf.GetName()] = metricValue(mf.GetMetric()[0])
+				continue
+			}
+			byLabels := map[string]float64{}
+			for _, m := range mf.GetMetric() {
+				values := make([]string, 0, len(m.GetLabel()))
+				for _, l := range m.GetLabel() {
+					values = append(values, l.GetName()+"="+l.GetValue())
+				}
+				byLabels[strings.Join(values, ",")] = metricValue(m)
+			}
+			vars[mf.GetName()] = byLabels
+		}
+		return vars
+	}))
+}
+
+// metricValue returns the value of a gauge or counter.
+func metricValue(m *dto.Metric) float64 {
+	if m.GetCounter() != nil {
+		return m.GetCounter().GetValue()
+	}
+	return m.GetGauge().GetValue()
 }
@@ -5,10 +5,21 @@ package scraper
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 
 	"github.com/sirupsen/logrus"
@@ -86,3 +97,124 @@ func TestConfigParseWithCustomType(t *testing.T) {
 
 	assert.Equal(t, licenseKey, string(cfg.LicenseKey))
 }
+
+type fakeRefresher struct {
+	name      string
+	err       error
+	refreshed bool
+}
+
+func (f *fakeRefresher) GetTargets() ([]endpoints.Target, error) { return nil, nil }
+func (f *fakeRefresher) Watch() error                            { return nil }
+func (f *fakeRefresher) Name() string                            { return f.name }
+func (f *fakeRefresher) Refresh() error {
+	f.refreshed = true
+	return f.err
+}
+
+func TestRefreshTargetsHandler(t *testing.T) {
+	fixed, err := endpoints.FixedRetriever()
+	require.NoError(t, err)
+	ok := &fakeRefresher{name: "kubernetes-a"}
+	failing := &fakeRefresher{name: "kubernetes-b", err: errors.New("forbidden")}
+	tokenFile, err := ioutil.TempFile("", "refresh-token")
+	require.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("s3cr3t\n")
+	require.NoError(t, err)
+	require.NoError(t, tokenFile.Close())
+	handler := withBearerToken(tokenFile.Name(), refreshTargetsHandler([]endpoints.TargetRetriever{fixed, ok, failing}))
+	request := func(method, authorization string) *http.Request {
+		req := httptest.NewRequest(method, "/-/refresh-targets", nil)
+		req.Header.Set("Authorization", authorization)
+		return req
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, request(http.MethodGet, "Bearer s3cr3t"))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.False(t, ok.refreshed)
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		rec = httptest.NewRecorder()
+		handler(rec, request(http.MethodPost, authorization))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.False(t, ok.refreshed)
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, request(http.MethodPost, "Bearer s3cr3t"))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.True(t, ok.refreshed)
+	assert.True(t, failing.refreshed)
+	assert.Equal(t, "kubernetes-a: refreshed\nkubernetes-b: forbidden\n", rec.Body.String())
+}
+
+func TestPublishExpvars(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Name:      "expvar_test_total",
+	}, []string{"target"})
+	require.NoError(t, prometheus.Register(counter))
+	defer prometheus.Unregister(counter)
+	counter.WithLabelValues("a").Add(3)
+
+	publishExpvars()
+	publishExpvars() // publishing twice must not panic
+
+	var vars map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get(expvarName).String()), &vars))
+	assert.Equal(t, map[string]interface{}{"target=a": float64(3)}, vars["nr_stats_expvar_test_total"])
+	assert.NotContains(t, vars, "go_goroutines")
+}
+
+func TestRedactionRules(t *testing.T) {
+	rules := []integration.ProcessingRule{
+		{
+			Description:   "rename",
+			IgnoreMetrics: []integration.IgnoreRule{{Prefixes: []string{"go_"}}},
+		},
+		{
+			Description:      "compliance",
+			AddAttributes:    []integration.AddAttributesRule{{Attributes: map[string]interface{}{"team": "a"}}},
+			RedactAttributes: []integration.RedactRule{{AttributeName: "email"}},
+		},
+	}
+
+	assert.Equal(t, []integration.ProcessingRule{{
+		Description:      "compliance",
+		RedactAttributes: []integration.RedactRule{{AttributeName: "email"}},
+	}}, redactionRules(rules))
+}
+
+func TestValidateOptions_DebugCapture(t *testing.T) {
+	cfg := &Config{Emitters: Emitters("stdout"), DebugCaptureEnabled: true}
+	assert.Error(t, validateOptions(cfg), "the debug capture requires a token")
+
+	cfg.DebugCaptureTokenFile = "/etc/nri-prometheus/debug-token"
+	assert.NoError(t, validateOptions(cfg))
+}
+
+func TestWithBearerToken_DebugCapture(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "debug-token")
+	require.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, err = tokenFile.WriteString("s3cr3t\n")
+	require.NoError(t, err)
+	require.NoError(t, tokenFile.Close())
+
+	handler := withBearerToken(tokenFile.Name(), integration.NewDebugCapture(time.Minute, 0))
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		req := httptest.NewRequest(http.MethodPost, "/-/debug/capture?target=exporter", nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/-/debug/capture?target=exporter&duration=1h", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the authorized requests reach the capture")
+}
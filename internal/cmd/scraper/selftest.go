@@ -0,0 +1,113 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/metricapitest"
+)
+
+// selfTestTimeout is how long the self test waits for the metrics to reach
+// the mock Metric API.
+const selfTestTimeout = 30 * time.Second
+
+// selfTestMetrics is the payload of the target scraped by the self test.
+const selfTestMetrics = `# HELP selftest_requests_total Requests served.
+# TYPE selftest_requests_total counter
+selftest_requests_total{code="200"} 10
+selftest_requests_total{code="500"} 1
+# HELP selftest_in_flight Requests in flight.
+# TYPE selftest_in_flight gauge
+selftest_in_flight 2
+# HELP selftest_duration_seconds Request durations.
+# TYPE selftest_duration_seconds histogram
+selftest_duration_seconds_bucket{le="0.1"} 5
+selftest_duration_seconds_bucket{le="1"} 10
+selftest_duration_seconds_bucket{le="+Inf"} 11
+selftest_duration_seconds_sum 4.2
+selftest_duration_seconds_count 11
+# HELP selftest_size_bytes Response sizes.
+# TYPE selftest_size_bytes summary
+selftest_size_bytes{quantile="0.5"} 512
+selftest_size_bytes{quantile="0.99"} 2048
+selftest_size_bytes_sum 6000
+selftest_size_bytes_count 11
+`
+
+// selfTestErrors are the responses of the mock Metric API before it accepts
+// the metrics, so the self test covers the retries of the harvests.
+var selfTestErrors = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+
+// SelfTest exercises the whole pipeline against a mock Metric API: a local
+// target is scraped, and its metrics are processed with the configured
+// rules and sent by a telemetry emitter with the configured options, except
+// the destination, proxy and CA. The mock API first answers with errors to
+// check the harvests are retried. The steps are written to w, and an error
+// is returned if the metrics don't arrive.
+func SelfTest(cfg *Config, w io.Writer) error {
+	if err := validateOptions(cfg); err != nil {
+		return fmt.Errorf("while getting configuration options: %w", err)
+	}
+
+	api := metricapitest.NewServer()
+	defer api.Close()
+	api.RespondWith(selfTestErrors...)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = io.WriteString(w, selfTestMetrics)
+	}))
+	defer target.Close()
+
+	testCfg := *cfg
+	testCfg.TargetConfigs = []endpoints.TargetConfig{{URLs: []string{target.URL}}}
+	testCfg.KubernetesClusters = nil
+	testCfg.TelemetryEmitters = nil
+	testCfg.MetricAPIURL = api.URL
+	testCfg.EmitterHarvestPeriod = "1s"
+	testCfg.EmitterProxyURL = nil
+	testCfg.EmitterCAFile = ""
+	if testCfg.LicenseKey == "" {
+		testCfg.LicenseKey = "selftest"
+	}
+
+	p, err := newPipeline(&testCfg, nil)
+	if err != nil {
+		return err
+	}
+	fixedRetriever, err := endpoints.FixedRetriever(testCfg.TargetConfigs...)
+	if err != nil {
+		return err
+	}
+	emitter, err := newTelemetryEmitter(&testCfg, TelemetryEmitterInstance{}, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "scraping test target %s\n", target.URL)
+	integration.ExecuteOnce([]endpoints.TargetRetriever{fixedRetriever}, p.fetcher, p.processor, []integration.Emitter{emitter})
+
+	fmt.Fprintf(w, "waiting for the metrics to reach the mock Metric API %s\n", api.URL)
+	if !api.WaitForMetrics(selfTestTimeout) {
+		for _, r := range api.Requests() {
+			fmt.Fprintf(w, "metric API responded %d\n", r.Status)
+		}
+		return fmt.Errorf("no metrics reached the mock Metric API in %s", selfTestTimeout)
+	}
+	for _, r := range api.Requests() {
+		if r.Status == http.StatusAccepted {
+			fmt.Fprintf(w, "metric API accepted %d metrics (%d bytes)\n", len(r.Metrics), r.PayloadBytes)
+			continue
+		}
+		fmt.Fprintf(w, "metric API responded %d, harvest retried\n", r.Status)
+	}
+	fmt.Fprintln(w, "self test passed")
+	return nil
+}
@@ -0,0 +1,26 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package scraper
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	cfg := &Config{
+		ScrapeDuration: "30s",
+		ScrapeTimeout:  5 * time.Second,
+		Percentiles:    []float64{50, 99},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, SelfTest(cfg, &out))
+	assert.Contains(t, out.String(), "metric API responded 429, harvest retried")
+	assert.Contains(t, out.String(), "metric API responded 503, harvest retried")
+	assert.Contains(t, out.String(), "self test passed")
+}
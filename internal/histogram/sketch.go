@@ -0,0 +1,147 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package histogram
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxSketchBins bounds the memory of a sketch, for buckets spanning too many
+// orders of magnitude for the relative accuracy.
+const maxSketchBins = 1 << 14
+
+// Sketch is a DDSketch of the observations of a histogram, built from its
+// bucket counts. The observations of a bucket are assumed to be distributed
+// uniformly in the logarithmic scale between its bounds, closer to the usual
+// latency distributions than the linear interpolation of Percentile, and
+// are binned in logarithmic bins of the relative accuracy.
+//
+// The percentiles of the sketch have a relative error of at most the
+// relative accuracy with respect to the ones of the assumed distribution.
+// Like with Percentile, they can't be more accurate than the buckets.
+type Sketch struct {
+	gamma    float64
+	logGamma float64
+	// offset is the index of the first bin.
+	offset int
+	counts []float64
+	// total is the count of all the observations, and overflow the one of
+	// the +Inf bucket, whose percentiles are the upper bound of the highest
+	// finite bucket, maxBound.
+	total    float64
+	overflow float64
+	maxBound float64
+	// linear holds the buckets of the sketches falling back to the linear
+	// interpolation, when the buckets can't be represented in the
+	// logarithmic scale.
+	linear Buckets
+}
+
+// NewSketch returns the sketch of the buckets with the relative accuracy,
+// between 0 and 1 excluded. The buckets are sorted, and must be valid for
+// Percentile. Buckets with non-positive bounds, or with a single finite
+// bucket, can't be represented in the logarithmic scale, so the sketch falls
+// back to the linear interpolation of Percentile for them.
+func NewSketch(buckets Buckets, relativeAccuracy float64) (*Sketch, error) {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return nil, fmt.Errorf("invalid relative accuracy: %g (must be between 0.0 and 1.0)", relativeAccuracy)
+	}
+	if len(buckets) < 2 {
+		return nil, fmt.Errorf("invalid buckets: minimum of 2 buckets required, got %d", len(buckets))
+	}
+	sort.Sort(buckets)
+	if !math.IsInf(buckets[len(buckets)-1].UpperBound, +1) {
+		return nil, errors.New("invalid buckets: highest bucket is not +Inf")
+	}
+	buckets = coalesceBuckets(buckets)
+	ensureMonotonic(buckets)
+	if len(buckets) < 3 || buckets[0].UpperBound <= 0 {
+		return &Sketch{linear: buckets}, nil
+	}
+
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	s := &Sketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		total:    buckets[len(buckets)-1].Count,
+		maxBound: buckets[len(buckets)-2].UpperBound,
+	}
+	s.overflow = s.total - buckets[len(buckets)-2].Count
+
+	// The lowest bucket has the same ratio between its bounds as the next
+	// one, as with the usual exponential buckets.
+	lower := buckets[0].UpperBound * buckets[0].UpperBound / buckets[1].UpperBound
+	if bins := math.Log(s.maxBound/lower) / s.logGamma; lower == 0 || bins+2 > maxSketchBins {
+		return nil, fmt.Errorf("invalid buckets: %g to %g needs more than %d bins", lower, s.maxBound, maxSketchBins)
+	}
+	first, last := s.index(lower), s.index(s.maxBound)
+	s.offset = first
+	s.counts = make([]float64, last-first+1)
+
+	var previous float64
+	for _, b := range buckets[:len(buckets)-1] {
+		s.add(lower, b.UpperBound, b.Count-previous)
+		lower, previous = b.UpperBound, b.Count
+	}
+	return s, nil
+}
+
+// index returns the index of the bin of the value, which holds the values
+// in (gamma^(index-1), gamma^index].
+func (s *Sketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / s.logGamma))
+}
+
+// add distributes the count of the bucket between the bounds to the bins it
+// overlaps, by the length of the overlap in the logarithmic scale.
+func (s *Sketch) add(lower, upper, count float64) {
+	if count <= 0 || upper <= lower {
+		return
+	}
+	logLower, logUpper := math.Log(lower), math.Log(upper)
+	width := logUpper - logLower
+	for i := s.index(lower); i <= s.index(upper); i++ {
+		from := math.Max(logLower, float64(i-1)*s.logGamma)
+		to := math.Min(logUpper, float64(i)*s.logGamma)
+		if to > from {
+			s.counts[i-s.offset] += count * (to - from) / width
+		}
+	}
+}
+
+// Percentile returns the percentile p of the observations. If it falls into
+// the +Inf bucket, the upper bound of the highest finite bucket is
+// returned, as with Percentile.
+func (s *Sketch) Percentile(p float64) (float64, error) {
+	if p < 0.0 {
+		return 0, fmt.Errorf("invalid percentile: %g (must be greater than 0.0)", p)
+	}
+	if p > 100.0 {
+		return 0, fmt.Errorf("invalid percentile: %g (must be less than 100.0)", p)
+	}
+	if s.linear != nil {
+		return Percentile(p, s.linear)
+	}
+	if s.total == 0 {
+		return math.NaN(), nil
+	}
+
+	rank := (p / 100.0) * s.total
+	if rank > s.total-s.overflow {
+		return s.maxBound, nil
+	}
+	var cumulative float64
+	for i, count := range s.counts {
+		cumulative += count
+		if count > 0 && cumulative >= rank {
+			// The mean of the bounds of the bin, relative to them, which
+			// is within the relative accuracy of all its values.
+			value := 2 * math.Pow(s.gamma, float64(i+s.offset)) / (s.gamma + 1)
+			return math.Min(value, s.maxBound), nil
+		}
+	}
+	return s.maxBound, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package histogram
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSketchPercentile(t *testing.T) {
+	// Observations uniformly distributed in the logarithmic scale from 1 to
+	// 1000, with a tenth of them beyond.
+	buckets := Buckets{
+		{UpperBound: 1, Count: 0},
+		{UpperBound: 10, Count: 30},
+		{UpperBound: 100, Count: 60},
+		{UpperBound: 1000, Count: 90},
+		{UpperBound: math.Inf(1), Count: 100},
+	}
+	const accuracy = 0.01
+
+	testCases := []struct {
+		p    float64
+		want float64
+	}{
+		{p: 15, want: math.Pow(10, 0.5)},
+		{p: 45, want: math.Pow(10, 1.5)},
+		{p: 80, want: math.Pow(10, 2+2.0/3)},
+		{p: 95, want: 1000},
+	}
+	for _, tt := range testCases {
+		sketch, err := NewSketch(append(Buckets{}, buckets...), accuracy)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got, err := sketch.Percentile(tt.p)
+		if err != nil {
+			t.Fatalf("unexpected error for p%g: %v", tt.p, err)
+		}
+		if math.Abs(got-tt.want)/tt.want > accuracy {
+			t.Errorf("p%g = %g, want %g within %g", tt.p, got, tt.want, accuracy)
+		}
+	}
+
+	linear, _ := Percentile(45, append(Buckets{}, buckets...))
+	if math.Abs(linear-math.Pow(10, 1.5))/math.Pow(10, 1.5) < 0.5 {
+		t.Errorf("the linear interpolation is expected to be inaccurate, got %g", linear)
+	}
+}
+
+func TestSketchLinearFallback(t *testing.T) {
+	buckets := Buckets{
+		{UpperBound: -1, Count: 1},
+		{UpperBound: 1, Count: 3},
+		{UpperBound: math.Inf(1), Count: 4},
+	}
+	sketch, err := NewSketch(append(Buckets{}, buckets...), 0.01)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := sketch.Percentile(50)
+	want, _ := Percentile(50, buckets)
+	if got != want {
+		t.Errorf("non-positive bounds: got %g, want the linear %g", got, want)
+	}
+}
+
+func TestNewSketchErrors(t *testing.T) {
+	valid := Buckets{{UpperBound: 1, Count: 1}, {UpperBound: 2, Count: 2}, {UpperBound: math.Inf(1), Count: 2}}
+	for _, accuracy := range []float64{0, -0.1, 1} {
+		if _, err := NewSketch(valid, accuracy); err == nil {
+			t.Errorf("expected an error for the relative accuracy %g", accuracy)
+		}
+	}
+	if _, err := NewSketch(Buckets{{UpperBound: 1, Count: 1}, {UpperBound: 2, Count: 2}}, 0.01); err == nil {
+		t.Error("expected an error without a +Inf bucket")
+	}
+	if _, err := NewSketch(Buckets{{UpperBound: 1e-300, Count: 1}, {UpperBound: 1, Count: 2}, {UpperBound: 1e300, Count: 2}, {UpperBound: math.Inf(1), Count: 2}}, 0.0001); err == nil {
+		t.Error("expected an error for too many bins")
+	}
+}
@@ -0,0 +1,78 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import "github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+
+// accountEmitter emits only the metrics of the targets of the accounts it
+// accepts, by their endpoints.AccountLabel attribute.
+type accountEmitter struct {
+	Emitter
+	accepts func(account string) bool
+}
+
+// AccountEmitter wraps the emitter of the account so it only emits the
+// metrics of the targets annotated with it.
+func AccountEmitter(emitter Emitter, account string) Emitter {
+	return &accountEmitter{
+		Emitter: emitter,
+		accepts: func(a string) bool { return a == account },
+	}
+}
+
+// UnroutedEmitter wraps the emitter so it doesn't emit the metrics of the
+// targets of the accounts routed to other emitters. The metrics of the
+// targets without an account, or of accounts without an emitter, are
+// emitted.
+func UnroutedEmitter(emitter Emitter, routed []string) Emitter {
+	accounts := make(map[string]bool, len(routed))
+	for _, a := range routed {
+		accounts[a] = true
+	}
+	return &accountEmitter{
+		Emitter: emitter,
+		accepts: func(a string) bool { return !accounts[a] },
+	}
+}
+
+// setAccount sets the endpoints.AccountLabel attribute of the metrics to the
+// account of their target, removing it if the target has none, so the
+// exporters can't route their metrics to another account by exposing the
+// label, whatever the processing rules and stages.
+func setAccount(targetMetrics *TargetMetrics) {
+	account, ok := targetMetrics.Target.Object.Labels[endpoints.AccountLabel]
+	for mi := range targetMetrics.Metrics {
+		attrs := targetMetrics.Metrics[mi].attributes
+		if ok {
+			attrs[endpoints.AccountLabel] = account
+		} else {
+			delete(attrs, endpoints.AccountLabel)
+		}
+	}
+}
+
+// Emit emits the metrics of the accepted accounts.
+func (ae *accountEmitter) Emit(metrics []Metric) error {
+	accepted := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		account, _ := m.attributes[endpoints.AccountLabel].(string)
+		if ae.accepts(account) {
+			accepted = append(accepted, m)
+		}
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	return ae.Emitter.Emit(accepted)
+}
+
+// wrappedEmitters returns the wrapped emitter.
+func (ae *accountEmitter) wrappedEmitters() []Emitter {
+	return []Emitter{ae.Emitter}
+}
+
+// endHarvest notifies the wrapped emitter that the harvest ended.
+func (ae *accountEmitter) endHarvest() {
+	endHarvest([]Emitter{ae.Emitter})
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestAccountEmitters(t *testing.T) {
+	metrics := []Metric{
+		{name: "team_a", attributes: labels.Set{endpoints.AccountLabel: "team-a"}},
+		{name: "team_b", attributes: labels.Set{endpoints.AccountLabel: "team-b"}},
+		{name: "unknown_team", attributes: labels.Set{endpoints.AccountLabel: "team-c"}},
+		{name: "no_team", attributes: labels.Set{"namespaceName": "shop"}},
+	}
+	names := func(metrics []Metric) []string {
+		var names []string
+		for _, m := range metrics {
+			names = append(names, m.name)
+		}
+		return names
+	}
+
+	teamA := &recordingEmitter{}
+	require.NoError(t, AccountEmitter(teamA, "team-a").Emit(metrics))
+	assert.Equal(t, []string{"team_a"}, names(teamA.metrics))
+
+	unrouted := &recordingEmitter{}
+	require.NoError(t, UnroutedEmitter(unrouted, []string{"team-a", "team-b"}).Emit(metrics))
+	assert.Equal(t, []string{"unknown_team", "no_team"}, names(unrouted.metrics))
+}
+
+// The exporters can't route their metrics to another account by exposing
+// the account label themselves.
+func TestRuleProcessor_Account(t *testing.T) {
+	spoofed := func(name string) []Metric {
+		return []Metric{{name: name, metricType: metricType_GAUGE, attributes: labels.Set{endpoints.AccountLabel: "team-b"}}}
+	}
+	pairs := make(chan TargetMetrics, 2)
+	pairs <- TargetMetrics{
+		Target:  endpoints.Target{Name: "annotated", Object: endpoints.Object{Labels: labels.Set{endpoints.AccountLabel: "team-a"}}},
+		Metrics: spoofed("annotated"),
+	}
+	pairs <- TargetMetrics{
+		Target:  endpoints.Target{Name: "unannotated"},
+		Metrics: spoofed("unannotated"),
+	}
+	close(pairs)
+
+	teamA, teamB, unrouted := &recordingEmitter{}, &recordingEmitter{}, &recordingEmitter{}
+	emitters := []Emitter{
+		AccountEmitter(teamA, "team-a"),
+		AccountEmitter(teamB, "team-b"),
+		UnroutedEmitter(unrouted, []string{"team-a", "team-b"}),
+	}
+	for pair := range RuleProcessor([]ProcessingRule{}, queueLength, WithoutDecoration())(pairs) {
+		for _, e := range emitters {
+			require.NoError(t, e.Emit(pair.Metrics))
+		}
+	}
+	require.Len(t, teamA.metrics, 1)
+	assert.Equal(t, "annotated", teamA.metrics[0].name)
+	assert.Empty(t, teamB.metrics)
+	require.Len(t, unrouted.metrics, 1)
+	assert.Equal(t, "unannotated", unrouted.metrics[0].name)
+	assert.NotContains(t, unrouted.metrics[0].attributes, endpoints.AccountLabel)
+}
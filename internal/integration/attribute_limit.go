@@ -0,0 +1,105 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// AttributeLimitConfig configures the attributes dropped from the metrics
+// with more than MaxAttributes once processed, so the Metric API doesn't
+// reject their data points. The attributes are kept in the order of
+// Priority, whose entries are attribute keys, after the normalization, or
+// key prefixes ending with *. The attributes not listed have the lowest
+// priority and are kept in alphabetical order, so the same attributes are
+// dropped from every data point of a metric.
+type AttributeLimitConfig struct {
+	// MaxAttributes of every metric. Disabled if 0.
+	MaxAttributes int      `mapstructure:"max_attributes"`
+	Priority      []string `mapstructure:"priority"`
+}
+
+// AttributeLimiter drops the lowest priority attributes of the metrics with
+// too many of them.
+type AttributeLimiter struct {
+	max      int
+	priority []string
+}
+
+// NewAttributeLimiter returns the limiter of the configuration, or nil if
+// disabled.
+func NewAttributeLimiter(cfg AttributeLimitConfig) (*AttributeLimiter, error) {
+	if cfg.MaxAttributes < 0 {
+		return nil, fmt.Errorf("the attribute limit max_attributes can't be negative")
+	}
+	for _, p := range cfg.Priority {
+		if p == "" || p == "*" {
+			return nil, fmt.Errorf("invalid attribute limit priority %q", p)
+		}
+	}
+	if cfg.MaxAttributes == 0 {
+		return nil, nil
+	}
+	return &AttributeLimiter{max: cfg.MaxAttributes, priority: cfg.Priority}, nil
+}
+
+// rank returns the position of the key in the priority. The internal
+// attributes, read by the emitters, go first and the keys not listed last.
+func (l *AttributeLimiter) rank(key string) int {
+	if internalAttributes[key] {
+		return -1
+	}
+	for i, p := range l.priority {
+		if p == key || strings.HasSuffix(p, "*") && strings.HasPrefix(key, p[:len(p)-1]) {
+			return i
+		}
+	}
+	return len(l.priority)
+}
+
+// Limit returns the attributes with at most the maximum of them, and the
+// number of attributes dropped. The attributes within the limit are
+// returned as is.
+func (l *AttributeLimiter) Limit(attributes labels.Set) (labels.Set, int) {
+	if len(attributes) <= l.max {
+		return attributes, 0
+	}
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := l.rank(keys[i]), l.rank(keys[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+	limited := make(labels.Set, l.max)
+	for _, k := range keys[:l.max] {
+		limited[k] = attributes[k]
+	}
+	return limited, len(keys) - l.max
+}
+
+// limitAttributes drops the lowest priority attributes of the metrics beyond
+// the limit.
+func limitAttributes(targetMetrics *TargetMetrics, l *AttributeLimiter) {
+	if l == nil {
+		return
+	}
+	var dropped int
+	for mi := range targetMetrics.Metrics {
+		var n int
+		targetMetrics.Metrics[mi].attributes, n = l.Limit(targetMetrics.Metrics[mi].attributes)
+		dropped += n
+	}
+	if dropped > 0 {
+		droppedAttributesMetric.WithLabelValues(targetMetrics.Target.Name).Add(float64(dropped))
+	}
+}
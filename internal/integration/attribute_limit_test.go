@@ -0,0 +1,96 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestNewAttributeLimiter(t *testing.T) {
+	l, err := NewAttributeLimiter(AttributeLimitConfig{Priority: []string{"podName"}})
+	require.NoError(t, err)
+	assert.Nil(t, l, "disabled without a maximum")
+
+	_, err = NewAttributeLimiter(AttributeLimitConfig{MaxAttributes: -1})
+	assert.Error(t, err)
+	_, err = NewAttributeLimiter(AttributeLimitConfig{MaxAttributes: 10, Priority: []string{"*"}})
+	assert.Error(t, err)
+}
+
+func TestAttributeLimiter_Limit(t *testing.T) {
+	l, err := NewAttributeLimiter(AttributeLimitConfig{
+		MaxAttributes: 4,
+		Priority:      []string{"podName", "label.app*"},
+	})
+	require.NoError(t, err)
+
+	attrs := labels.Set{"nrMetricType": "gauge", "job": "node"}
+	limited, dropped := l.Limit(attrs)
+	assert.Equal(t, attrs, limited)
+	assert.Zero(t, dropped)
+
+	limited, dropped = l.Limit(labels.Set{
+		"nrMetricType":       "gauge",
+		"zone":               "a",
+		"job":                "node",
+		"label.appName":      "shop",
+		"label.tier":         "web",
+		"podName":            "shop-1",
+		"scrapedTargetKind":  "pod",
+		"label.appComponent": "api",
+	})
+	assert.Equal(t, 4, dropped)
+	assert.Equal(t, labels.Set{
+		"nrMetricType":       "gauge",
+		"podName":            "shop-1",
+		"label.appComponent": "api",
+		"label.appName":      "shop",
+	}, limited)
+
+	limited, dropped = l.Limit(labels.Set{
+		"nrMetricType":   "gauge",
+		"promMetricType": "gauge",
+		"targetName":     "shop-1:9100",
+		"podName":        "shop-1",
+		"label.appName":  "shop",
+		"zone":           "a",
+	})
+	assert.Equal(t, 2, dropped)
+	assert.Equal(t, labels.Set{
+		"nrMetricType":   "gauge",
+		"promMetricType": "gauge",
+		"targetName":     "shop-1:9100",
+		"podName":        "shop-1",
+	}, limited, "the attributes read by the emitters are kept")
+
+	l.max = 6
+	limited, _ = l.Limit(labels.Set{"podName": "shop-1", "d": 1, "c": 1, "b": 1, "a": 1, "e": 1, "f": 1})
+	assert.Equal(t, labels.Set{"podName": "shop-1", "a": 1, "b": 1, "c": 1, "d": 1, "e": 1}, limited,
+		"the attributes not listed are kept in alphabetical order")
+}
+
+func TestRuleProcessor_AttributeLimiter(t *testing.T) {
+	u, err := url.Parse("http://10.0.0.1:9100/metrics")
+	require.NoError(t, err)
+	target := endpoints.New("limited", *u, endpoints.Object{Name: "pod", Kind: "pod", Labels: labels.Set{"namespaceName": "shop"}})
+	l, err := NewAttributeLimiter(AttributeLimitConfig{MaxAttributes: 2, Priority: []string{"job"}})
+	require.NoError(t, err)
+
+	input := make(chan TargetMetrics, 1)
+	input <- TargetMetrics{Target: target, Metrics: []Metric{{name: "up", attributes: labels.Set{"job": "node", "instance": "a"}}}}
+	close(input)
+	pair := <-RuleProcessor(nil, 1, WithAttributeLimiter(l))(input)
+
+	assert.Len(t, pair.Metrics[0].attributes, 2)
+	assert.Equal(t, "node", pair.Metrics[0].attributes["job"])
+	assert.Equal(t, float64(len(target.Metadata())), testutil.ToFloat64(droppedAttributesMetric.WithLabelValues("limited")),
+		"the decoration attributes are limited too")
+}
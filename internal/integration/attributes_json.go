@@ -0,0 +1,270 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// arenaChunkSize is the size of the chunks the encoded attributes are stored
+// in, so they are allocated in bulk instead of once per metric.
+const arenaChunkSize = 64 * 1024
+
+// attributesEncoder encodes the attributes of the metrics to JSON, with their
+// keys sorted, so they are handed pre-encoded to the harvester. Encoded
+// attributes are stored in chunks that are never reused, as the harvester
+// keeps them until the next harvest.
+type attributesEncoder struct {
+	scratch []byte
+	keys    []string
+	chunk   []byte
+}
+
+// encode returns the JSON of the attributes. If extraKey is not empty, it is
+// encoded with extraValue as if it was one of the attributes.
+func (e *attributesEncoder) encode(attrs map[string]interface{}, extraKey string, extraValue float64) json.RawMessage {
+	e.keys = e.keys[:0]
+	for k, v := range attrs {
+		if validAttributeValue(v) && k != extraKey {
+			e.keys = append(e.keys, k)
+		}
+	}
+	if extraKey != "" {
+		e.keys = append(e.keys, extraKey)
+	}
+	sort.Strings(e.keys)
+
+	b := append(e.scratch[:0], '{')
+	for i, k := range e.keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+		if k == extraKey {
+			b = appendJSONFloat(b, extraValue)
+		} else {
+			b = appendJSONValue(b, attrs[k])
+		}
+	}
+	b = append(b, '}')
+	e.scratch = b
+	return e.store(b)
+}
+
+// store copies the encoded attributes to the current chunk.
+func (e *attributesEncoder) store(b []byte) json.RawMessage {
+	if len(b) > cap(e.chunk)-len(e.chunk) {
+		size := arenaChunkSize
+		if len(b) > size {
+			size = len(b)
+		}
+		e.chunk = make([]byte, 0, size)
+	}
+	start := len(e.chunk)
+	e.chunk = append(e.chunk, b...)
+	return e.chunk[start:len(e.chunk):len(e.chunk)]
+}
+
+// validAttributeValue returns true if the value is of one of the types
+// accepted by the telemetry SDK. The attributes with other values are
+// dropped, as the harvester does.
+func validAttributeValue(v interface{}) bool {
+	switch v.(type) {
+	case string, bool, uint8, uint16, uint32, uint64, int8, int16,
+		int32, int64, float32, float64, uint, int, uintptr:
+		return true
+	default:
+		return false
+	}
+}
+
+// appendJSONValue encodes the attribute value the same way the telemetry
+// SDK does.
+func appendJSONValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return appendJSONString(b, v)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case float64:
+		return appendJSONFloat(b, v)
+	case float32:
+		return appendJSONFloat(b, float64(v))
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(b, v, 10)
+	case int32:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int16:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int8:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uint:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uint64:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uint32:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uint16:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uint8:
+		return strconv.AppendInt(b, int64(v), 10)
+	case uintptr:
+		return strconv.AppendInt(b, int64(v), 10)
+	default:
+		return appendJSONString(b, fmt.Sprintf("%T", v))
+	}
+}
+
+func appendJSONFloat(b []byte, f float64) []byte {
+	if math.IsInf(f, 0) {
+		return append(b, `"infinity"`...)
+	}
+	if math.IsNaN(f) {
+		return append(b, `"NaN"`...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
+
+// safeJSONByte are the ASCII bytes that don't need escaping. <, > and & are
+// escaped like the telemetry SDK does.
+var safeJSONByte = func() (safe [utf8.RuneSelf]bool) {
+	for b := 0x20; b < utf8.RuneSelf; b++ {
+		safe[b] = b != '"' && b != '\\' && b != '<' && b != '>' && b != '&'
+	}
+	return safe
+}()
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString encodes the string as the telemetry SDK does, appending it
+// at once when it doesn't need escaping, which is the usual case.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	i := 0
+	for i < len(s) && s[i] < utf8.RuneSelf && safeJSONByte[s[i]] {
+		i++
+	}
+	if i == len(s) {
+		b = append(b, s...)
+		return append(b, '"')
+	}
+
+	b = append(b, s[:i]...)
+	start := i
+	for i < len(s) {
+		if c := s[i]; c < utf8.RuneSelf {
+			if safeJSONByte[c] {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '\\', '"':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+type cumulativeValue struct {
+	when  time.Time
+	value float64
+}
+
+// encodedDeltaCalculator creates Count metrics from cumulative values like
+// the telemetry SDK cumulative.DeltaCalculator, identifying the series by
+// their pre-encoded attributes.
+type encodedDeltaCalculator struct {
+	datapoints              map[string]*cumulativeValue
+	lastClean               time.Time
+	expirationCheckInterval time.Duration
+	expirationAge           time.Duration
+	key                     []byte
+}
+
+func newEncodedDeltaCalculator(expirationAge, expirationCheckInterval time.Duration) *encodedDeltaCalculator {
+	return &encodedDeltaCalculator{
+		datapoints:              map[string]*cumulativeValue{},
+		expirationAge:           expirationAge,
+		expirationCheckInterval: expirationCheckInterval,
+	}
+}
+
+// countMetric returns the Count metric of the difference with the previous
+// value of the series. It is not valid the first time the series is seen,
+// or if the value decreased.
+func (dc *encodedDeltaCalculator) countMetric(name string, attributesJSON json.RawMessage, val float64, now time.Time) (count telemetry.Count, valid bool) {
+	if now.Sub(dc.lastClean) > dc.expirationCheckInterval {
+		cutoff := now.Add(-dc.expirationAge)
+		for k, v := range dc.datapoints {
+			if v.when.Before(cutoff) {
+				delete(dc.datapoints, k)
+			}
+		}
+		dc.lastClean = now
+	}
+
+	dc.key = append(append(append(dc.key[:0], name...), 0), attributesJSON...)
+	last, ok := dc.datapoints[string(dc.key)]
+	if !ok {
+		dc.datapoints[string(dc.key)] = &cumulativeValue{value: val, when: now}
+		return count, false
+	}
+	if !now.After(last.when) {
+		return count, false
+	}
+	if delta := val - last.value; delta >= 0 {
+		count = telemetry.Count{
+			Name:           name,
+			AttributesJSON: attributesJSON,
+			Value:          delta,
+			Timestamp:      last.when,
+			Interval:       now.Sub(last.when),
+		}
+		valid = true
+	}
+	last.value = val
+	last.when = now
+	return count, valid
+}
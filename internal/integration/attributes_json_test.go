@@ -0,0 +1,45 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendJSONString(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"container_cpu_usage_seconds_total",
+		`quotes " and \ backslashes`,
+		"control\n\r\t\x01 bytes",
+		"<html> & friends",
+		"unicode ñ 日本",
+		"separators \u2028\u2029",
+	} {
+		expected, err := json.Marshal(s)
+		assert.NoError(t, err)
+		assert.Equal(t, string(expected), string(appendJSONString(nil, s)), s)
+	}
+	assert.Equal(t, `"invalid \ufffd utf8"`, string(appendJSONString(nil, "invalid \xff utf8")))
+}
+
+func TestAttributesEncoder(t *testing.T) {
+	e := &attributesEncoder{}
+	attrs := map[string]interface{}{
+		"targetName": "target-a",
+		"up":         true,
+		"count":      3,
+		"ratio":      0.5,
+		"invalid":    struct{}{},
+		"nil":        nil,
+	}
+	first := e.encode(attrs, "", 0)
+	assert.Equal(t, `{"count":3,"ratio":0.5,"targetName":"target-a","up":true}`, string(first))
+	assert.Equal(t, `{"count":3,"percentile":99.9,"ratio":0.5,"targetName":"target-a","up":true}`, string(e.encode(attrs, "percentile", 99.9)))
+	assert.Equal(t, `{"le":"infinity"}`, string(e.encode(nil, "le", math.Inf(1))))
+	assert.Equal(t, `{"count":3,"ratio":0.5,"targetName":"target-a","up":true}`, string(first), "encoded attributes must not be overwritten")
+}
@@ -0,0 +1,146 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// isAuthError returns true if the scrape failed because the target rejected
+// the credentials, or the TLS handshake failed, so another authentication
+// method may succeed.
+func isAuthError(err error) bool {
+	var authErr *prometheus.AuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &invalidCert) || errors.As(err, &hostname) {
+		return true
+	}
+	// The alerts sent by the targets, like a missing or bad client
+	// certificate, have no exported type.
+	return strings.Contains(err.Error(), "remote error: tls:")
+}
+
+// errServiceAccountOverHTTP is the error of the requests that would send
+// the token of the service account in clear.
+var errServiceAccountOverHTTP = errors.New("the service account token is only sent over https")
+
+// httpsOnlyRoundTripper refuses the requests that aren't sent over https,
+// like the redirects to http, so the credentials it wraps aren't sent in
+// clear.
+type httpsOnlyRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t httpsOnlyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, errServiceAccountOverHTTP
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// fetchWithAuth gets the metrics of a target trying its authentication
+// methods in order, starting with the one that worked last. Only the
+// authentication errors move on to the next method.
+func (pf *prometheusFetcher) fetchWithAuth(t *endpoints.Target) (prometheus.MetricFamiliesByName, error) {
+	first := 0
+	if i, ok := pf.authMethods.Load(t.URL.String()); ok && i.(int) < len(t.Auth) {
+		first = i.(int)
+	}
+
+	var lastErr error
+	for n := 0; n < len(t.Auth); n++ {
+		i := (first + n) % len(t.Auth)
+		if t.Auth[i].IsServiceAccount() && t.URL.Scheme != "https" {
+			lastErr = errServiceAccountOverHTTP
+			pf.log.WithField("target", t.Name).Debugf("auth method %d skipped: %s", i, lastErr)
+			continue
+		}
+		client, err := pf.authClient(t, t.Auth[i])
+		if err == nil {
+			var mfs prometheus.MetricFamiliesByName
+			mfs, err = pf.getMetricsWithRetries(withScrapeTimeout(client, t), t.Name, pf.scrapeURL(t))
+			if err == nil {
+				if i != first {
+					pf.log.WithField("target", t.Name).Infof("authenticated with auth method %d", i)
+				}
+				pf.authMethods.Store(t.URL.String(), i)
+				fetchAuthMethodMetric.WithLabelValues(t.Name).Set(float64(i))
+				return mfs, nil
+			}
+			if !isAuthError(err) {
+				return mfs, err
+			}
+		}
+		pf.log.WithError(err).WithField("target", t.Name).Debugf("auth method %d failed", i)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("all the %d auth methods failed, last error: %w", len(t.Auth), lastErr)
+}
+
+// authClient returns the HTTP client of an authentication method. Clients
+// are shared by the targets of the same job with the same method, DNS and
+// gateway configuration.
+func (pf *prometheusFetcher) authClient(t *endpoints.Target, auth endpoints.AuthConfig) (prometheus.HTTPDoer, error) {
+	job := pf.jobClient(t)
+	// The secrets are masked when formatted, so they're added hashed, to
+	// not keep them in the keys.
+	secrets := []string{string(auth.BearerToken), string(auth.BasicAuth.Password), string(auth.SigV4.SecretKey), string(auth.AzureAD.ClientSecret)}
+	key := job.clientKey(fmt.Sprintf("%v|%v|%v|%s", t.DNS, t.Gateway, auth, sha256Hex([]byte(strings.Join(secrets, "\x00")))))
+	if client, ok := pf.authClients.Load(key); ok {
+		return client.(prometheus.HTTPDoer), nil
+	}
+
+	tlsConfig := job.tlsConfig
+	// The token of the service account is only sent to the targets verified
+	// with the CA of the cluster.
+	if auth.IsServiceAccount() {
+		auth.TLSConfig = endpoints.ServiceAccountAuth().TLSConfig
+	}
+	if auth.TLSConfig != (endpoints.TLSConfig{}) {
+		var err error
+		if tlsConfig, err = newMutualTLSConfig(auth.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
+	transport := job.newTransport(tlsConfig, !t.Gateway.IsConnect())
+	dial, err := dialContext(t.DNS, t.Gateway)
+	if err != nil {
+		return nil, err
+	}
+	transport.DialContext = job.timeouts.dial(dial)
+	var rt http.RoundTripper = transport
+	if auth.IsServiceAccount() {
+		rt = httpsOnlyRoundTripper{rt: NewBearerAuthFileRoundTripper(auth.BearerTokenFile, rt)}
+	} else if auth.BearerTokenFile != "" {
+		rt = NewBearerAuthFileRoundTripper(auth.BearerTokenFile, rt)
+	} else if auth.BearerTokenEnv != "" {
+		rt = NewBearerAuthEnvRoundTripper(auth.BearerTokenEnv, rt)
+	} else if auth.BearerToken != "" {
+		rt = NewBearerAuthRoundTripper(string(auth.BearerToken), rt)
+	} else if !auth.BasicAuth.IsEmpty() {
+		rt = NewBasicAuthRoundTripper(auth.BasicAuth, rt)
+	} else if !auth.SigV4.IsEmpty() {
+		rt = NewSigV4RoundTripper(auth.SigV4, rt)
+	} else if !auth.AzureAD.IsEmpty() {
+		rt = NewAzureADRoundTripper(auth.AzureAD, rt)
+	}
+
+	client, _ := pf.authClients.LoadOrStore(key, &http.Client{
+		Transport: rt,
+		Timeout:   pf.fetchTimeout,
+	})
+	return client.(prometheus.HTTPDoer), nil
+}
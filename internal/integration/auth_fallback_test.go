@@ -0,0 +1,207 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func TestFetcher_AuthFallback(t *testing.T) {
+	var rejected int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer new-token" {
+			atomic.AddInt32(&rejected, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("# TYPE up gauge\nup 1\n"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldToken := filepath.Join(dir, "old")
+	newToken := filepath.Join(dir, "new")
+	require.NoError(t, ioutil.WriteFile(oldToken, []byte("old-token"), 0600))
+	require.NoError(t, ioutil.WriteFile(newToken, []byte("new-token"), 0600))
+
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{
+		URLs: []string{ts.URL},
+		Auth: []endpoints.AuthConfig{
+			{TLSConfig: endpoints.TLSConfig{CertFilePath: filepath.Join(dir, "missing.pem")}},
+			{BearerTokenFile: oldToken},
+			{BearerTokenFile: newToken},
+		},
+	})
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength)
+	for i := 0; i < 2; i++ {
+		var fetched []TargetMetrics
+		for pair := range fetcher.Fetch(targets) {
+			fetched = append(fetched, pair)
+		}
+		require.Len(t, fetched, 1)
+		assert.Equal(t, "up", fetched[0].Metrics[0].name)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&rejected), "the method that worked is tried first")
+}
+
+func TestFetcher_AuthFallback_OtherErrors(t *testing.T) {
+	fetcher := NewFetcher(time.Minute, fetchTimeout, maxConnections, "", "", false, queueLength)
+	var calls int32
+	fetcher.(*prometheusFetcher).getMetrics = func(client prometheus.HTTPDoer, url string) (prometheus.MetricFamiliesByName, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, &prometheus.ParseError{Err: errors.New("bad")}
+	}
+
+	target := endpoints.New("hello", url.URL{Scheme: "http", Host: "hello", Path: "/metrics"}, endpoints.Object{})
+	target.Auth = []endpoints.AuthConfig{{}, {BearerTokenFile: "token"}}
+	for range fetcher.Fetch([]endpoints.Target{target}) {
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "only authentication errors try the next method")
+}
+
+func TestFetcher_ServiceAccountAuthOverHTTP(t *testing.T) {
+	var authorizations []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer ts.Close()
+
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{
+		URLs:               []string{ts.URL},
+		ServiceAccountAuth: true,
+		Auth:               []endpoints.AuthConfig{{BearerToken: "target-token"}},
+	})
+	require.NoError(t, err)
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength)
+	for range fetcher.Fetch(targets) {
+	}
+	assert.Equal(t, []string{"Bearer target-token"}, authorizations, "the service account token is only sent over https")
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	_, err = httpsOnlyRoundTripper{rt: http.DefaultTransport}.RoundTrip(req)
+	assert.Equal(t, errServiceAccountOverHTTP, err, "the redirects to http are refused")
+}
+
+func TestIsAuthError(t *testing.T) {
+	assert.True(t, isAuthError(&prometheus.AuthError{StatusCode: http.StatusForbidden}))
+	assert.True(t, isAuthError(&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}))
+	assert.True(t, isAuthError(&url.Error{Op: "Get", Err: errors.New("remote error: tls: certificate required")}))
+	assert.False(t, isAuthError(&url.Error{Op: "Get", Err: timeoutError{}}))
+}
+
+func TestBearerAuthEnvRoundTripper(t *testing.T) {
+	var authorization string
+	rt := NewBearerAuthEnvRoundTripper("NRI_PROMETHEUS_TEST_TOKEN", roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		authorization = req.Header.Get("Authorization")
+		return emptyResponse(http.StatusOK), nil
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://exporter/metrics", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	assert.Error(t, err, "the variable is not set")
+
+	require.NoError(t, os.Setenv("NRI_PROMETHEUS_TEST_TOKEN", " env-token\n"))
+	defer os.Unsetenv("NRI_PROMETHEUS_TEST_TOKEN")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer env-token", authorization)
+	assert.Empty(t, req.Header.Get("Authorization"), "the request is not modified")
+}
+
+func TestFetcher_TargetBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "prometheus" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("# TYPE up gauge\nup 1\n"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{
+		URLs: []string{ts.URL},
+		Auth: []endpoints.AuthConfig{
+			{BasicAuth: endpoints.BasicAuthConfig{Username: "prometheus", Password: "wrong"}},
+			{BasicAuth: endpoints.BasicAuthConfig{Username: "prometheus", PasswordFile: passwordFile}},
+		},
+	})
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength)
+	var fetched []TargetMetrics
+	for pair := range fetcher.Fetch(targets) {
+		fetched = append(fetched, pair)
+	}
+	require.Len(t, fetched, 1)
+	assert.Equal(t, "up", fetched[0].Metrics[0].name)
+
+	fetcher.(*prometheusFetcher).authClients.Range(func(key, _ interface{}) bool {
+		assert.NotContains(t, key, "wrong", "the secrets aren't kept in the client keys")
+		return true
+	})
+}
+
+func TestBearerAuthRoundTripper(t *testing.T) {
+	var authorization string
+	rt := NewBearerAuthRoundTripper("inline-token", roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		authorization = req.Header.Get("Authorization")
+		return emptyResponse(http.StatusOK), nil
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://exporter/metrics", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer inline-token", authorization)
+	assert.Empty(t, req.Header.Get("Authorization"), "the request is not modified")
+}
+
+func TestBasicAuthRoundTripper(t *testing.T) {
+	var user, password string
+	rt := NewBasicAuthRoundTripper(endpoints.BasicAuthConfig{Username: "prometheus", PasswordFile: "missing"}, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		user, password, _ = req.BasicAuth()
+		return emptyResponse(http.StatusOK), nil
+	}))
+
+	req, err := http.NewRequest(http.MethodGet, "http://exporter/metrics", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	assert.Error(t, err, "the password file doesn't exist")
+
+	rt.(*basicAuthRoundTripper).cfg = endpoints.BasicAuthConfig{Username: "prometheus", Password: "inline"}
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "prometheus", user)
+	assert.Equal(t, "inline", password)
+}
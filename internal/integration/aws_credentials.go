@@ -0,0 +1,270 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// awsCredentialsExpiryMargin is the time before their expiration the
+	// temporary AWS credentials are renewed.
+	awsCredentialsExpiryMargin = 5 * time.Minute
+	awsCredentialsTimeout      = 5 * time.Second
+	// defaultAWSRoleSessionName is the session name of the web identity
+	// roles, without AWS_ROLE_SESSION_NAME.
+	defaultAWSRoleSessionName = "nri-prometheus"
+)
+
+// The endpoints of the temporary AWS credentials. The STS endpoint is the
+// one of the region. They're variables so the tests can replace them.
+var (
+	awsSTSURL               = "https://sts.%s.amazonaws.com"
+	awsContainerCredentials = "http://169.254.170.2"
+	awsInstanceMetadataURL  = "http://169.254.169.254"
+)
+
+// awsCredentialSource gets the AWS credentials of the default credential
+// chain of the AWS SDKs. They're, in order, the ones of the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, the ones
+// of the AWS_ROLE_ARN the web identity token of AWS_WEB_IDENTITY_TOKEN_FILE
+// is exchanged for, like with the IAM roles of the EKS service accounts, the
+// container credentials of AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI, like in ECS tasks or with the EKS pod
+// identities, and the ones of the role of the EC2 instance, from the instance
+// metadata service, unless AWS_EC2_METADATA_DISABLED is true. The temporary
+// credentials are cached until they're about to expire.
+type awsCredentialSource struct {
+	region string
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	creds     sigV4Credentials
+	expiresAt time.Time
+}
+
+func newAWSCredentialSource(region string) *awsCredentialSource {
+	return &awsCredentialSource{
+		region: region,
+		client: &http.Client{Timeout: awsCredentialsTimeout},
+		now:    time.Now,
+	}
+}
+
+// awsTemporaryCredentials are the credentials of the container and instance
+// metadata endpoints.
+type awsTemporaryCredentials struct {
+	Code            string    `json:"Code"`
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// stsWebIdentityResponse is the response of AssumeRoleWithWebIdentity.
+type stsWebIdentityResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+}
+
+// credentials returns the credentials of the first provider of the chain
+// that has them.
+func (s *awsCredentialSource) credentials() (sigV4Credentials, error) {
+	creds := sigV4Credentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.accessKey != "" && creds.secretKey != "" {
+		return creds, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.creds.accessKey != "" && now.Before(s.expiresAt.Add(-awsCredentialsExpiryMargin)) {
+		return s.creds, nil
+	}
+
+	var temporary awsTemporaryCredentials
+	var err error
+	switch {
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		temporary, err = s.webIdentityCredentials()
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		temporary, err = s.containerCredentials()
+	case strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		return creds, errors.New("unable to sign the request with sigv4: no AWS credentials in the environment, and the instance metadata is disabled")
+	default:
+		temporary, err = s.instanceCredentials()
+	}
+	if err != nil {
+		return creds, fmt.Errorf("unable to sign the request with sigv4: %w", err)
+	}
+	if temporary.AccessKeyID == "" || temporary.SecretAccessKey == "" {
+		return creds, errors.New("unable to sign the request with sigv4: the AWS credentials are incomplete")
+	}
+
+	s.creds = sigV4Credentials{accessKey: temporary.AccessKeyID, secretKey: temporary.SecretAccessKey, sessionToken: temporary.Token}
+	s.expiresAt = temporary.Expiration
+	return s.creds, nil
+}
+
+// webIdentityCredentials exchanges the web identity token for the
+// credentials of the role with STS.
+func (s *awsCredentialSource) webIdentityCredentials() (awsTemporaryCredentials, error) {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("unable to read the web identity token file %s: %s", tokenFile, err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = defaultAWSRoleSessionName
+	}
+	region := s.region
+	for _, env := range []string{"AWS_DEFAULT_REGION", "AWS_REGION"} {
+		if v := os.Getenv(env); v != "" {
+			region = v
+		}
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(awsSTSURL, region), strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsTemporaryCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := s.get(req)
+	if err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("assuming the role with the web identity: %w", err)
+	}
+	var resp stsWebIdentityResponse
+	if err := xml.Unmarshal(body, &resp); err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("decoding the web identity credentials: %w", err)
+	}
+	return awsTemporaryCredentials{
+		AccessKeyID:     resp.Credentials.AccessKeyID,
+		SecretAccessKey: resp.Credentials.SecretAccessKey,
+		Token:           resp.Credentials.SessionToken,
+		Expiration:      resp.Credentials.Expiration,
+	}, nil
+}
+
+// containerCredentials gets the credentials of the container endpoint,
+// authorized with the token of AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE or
+// AWS_CONTAINER_AUTHORIZATION_TOKEN, if any.
+func (s *awsCredentialSource) containerCredentials() (awsTemporaryCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = awsContainerCredentials + relative
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsTemporaryCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return awsTemporaryCredentials{}, fmt.Errorf("unable to read the container authorization token file %s: %s", tokenFile, err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	body, err := s.get(req)
+	if err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("getting the container credentials: %w", err)
+	}
+	var creds awsTemporaryCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("decoding the container credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// instanceCredentials gets the credentials of the role of the instance from
+// the instance metadata service, with a session token of IMDSv2 if it
+// issues them.
+func (s *awsCredentialSource) instanceCredentials() (awsTemporaryCredentials, error) {
+	header := http.Header{}
+	req, err := http.NewRequest(http.MethodPut, awsInstanceMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return awsTemporaryCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if token, err := s.get(req); err == nil {
+		header.Set("X-aws-ec2-metadata-token", strings.TrimSpace(string(token)))
+	}
+
+	credentialsURL := awsInstanceMetadataURL + "/latest/meta-data/iam/security-credentials/"
+	if req, err = http.NewRequest(http.MethodGet, credentialsURL, nil); err != nil {
+		return awsTemporaryCredentials{}, err
+	}
+	req.Header = header
+	roles, err := s.get(req)
+	if err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("getting the role of the instance: %w", err)
+	}
+	names := strings.Fields(string(roles))
+	if len(names) == 0 {
+		return awsTemporaryCredentials{}, errors.New("the instance has no role")
+	}
+
+	if req, err = http.NewRequest(http.MethodGet, credentialsURL+url.PathEscape(names[0]), nil); err != nil {
+		return awsTemporaryCredentials{}, err
+	}
+	req.Header = header
+	body, err := s.get(req)
+	if err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("getting the instance credentials: %w", err)
+	}
+	var creds awsTemporaryCredentials
+	if err := json.Unmarshal(body, &creds); err != nil {
+		return awsTemporaryCredentials{}, fmt.Errorf("decoding the instance credentials: %w", err)
+	}
+	if creds.Code != "" && creds.Code != "Success" {
+		return awsTemporaryCredentials{}, fmt.Errorf("the instance credentials aren't available: %s", creds.Code)
+	}
+	return creds, nil
+}
+
+// get sends the request, returning the body of its successful response.
+func (s *awsCredentialSource) get(req *http.Request) ([]byte, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+	return body, nil
+}
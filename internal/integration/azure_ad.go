@@ -0,0 +1,178 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+const (
+	defaultAzureAuthorityHost = "https://login.microsoftonline.com"
+	// azureTokenExpiryMargin is the time before their expiration the Azure
+	// AD tokens are renewed.
+	azureTokenExpiryMargin = 5 * time.Minute
+	azureTokenTimeout      = 10 * time.Second
+)
+
+// imdsTokenURL is the token endpoint of the managed identities of the Azure
+// Instance Metadata Service. App Service and Functions set their own in the
+// IDENTITY_ENDPOINT environment variable.
+var imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// NewAzureADRoundTripper adds an Azure AD token of the configuration as a
+// bearer token to a request unless the authorization header has already
+// been set.
+func NewAzureADRoundTripper(cfg endpoints.AzureADConfig, rt http.RoundTripper) http.RoundTripper {
+	return &azureADRoundTripper{source: newAzureADTokenSource(cfg), rt: rt}
+}
+
+type azureADRoundTripper struct {
+	source *azureADTokenSource
+	rt     http.RoundTripper
+}
+
+func (rt *azureADRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) == 0 {
+		token, err := rt.source.token()
+		if err != nil {
+			return nil, err
+		}
+		req = cloneRequest(req)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return rt.rt.RoundTrip(req)
+}
+
+// azureADTokenSource requests the Azure AD tokens, caching them until they
+// are about to expire.
+type azureADTokenSource struct {
+	cfg    endpoints.AzureADConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newAzureADTokenSource(cfg endpoints.AzureADConfig) *azureADTokenSource {
+	if cfg.AuthorityHost == "" {
+		cfg.AuthorityHost = defaultAzureAuthorityHost
+	}
+	return &azureADTokenSource{
+		cfg:    cfg,
+		client: &http.Client{Timeout: azureTokenTimeout},
+		now:    time.Now,
+	}
+}
+
+// azureADToken is the response of the token endpoints. The managed identity
+// endpoints send expires_in as a string.
+type azureADToken struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+// token returns the cached token, or a new one if it's about to expire.
+func (s *azureADTokenSource) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.accessToken != "" && now.Before(s.expiresAt.Add(-azureTokenExpiryMargin)) {
+		return s.accessToken, nil
+	}
+
+	req, err := s.tokenRequest()
+	if err != nil {
+		return "", fmt.Errorf("unable to request an azure ad token: %w", err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to request an azure ad token: %w", err)
+	}
+	defer resp.Body.Close()
+	var token azureADToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("unable to decode the azure ad token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("azure ad token request failed with status %d: %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		return "", fmt.Errorf("invalid expires_in of the azure ad token: %w", err)
+	}
+
+	s.accessToken = token.AccessToken
+	s.expiresAt = now.Add(time.Duration(expiresIn) * time.Second)
+	return s.accessToken, nil
+}
+
+// tokenRequest returns the request of a token with the client credentials,
+// or else the managed identity of the host.
+func (s *azureADTokenSource) tokenRequest() (*http.Request, error) {
+	if s.cfg.TenantID != "" {
+		return s.clientCredentialsRequest()
+	}
+
+	query := url.Values{"resource": {s.cfg.Resource}}
+	if s.cfg.ClientID != "" {
+		query.Set("client_id", s.cfg.ClientID)
+	}
+	endpoint, header, value := imdsTokenURL, "Metadata", "true"
+	query.Set("api-version", "2018-02-01")
+	if identityEndpoint := os.Getenv("IDENTITY_ENDPOINT"); identityEndpoint != "" {
+		endpoint, header, value = identityEndpoint, "X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER")
+		query.Set("api-version", "2019-08-01")
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(header, value)
+	return req, nil
+}
+
+// clientCredentialsRequest returns the request of a token of the v2.0
+// endpoint of the tenant, for the default scope of the resource.
+func (s *azureADTokenSource) clientCredentialsRequest() (*http.Request, error) {
+	secret := string(s.cfg.ClientSecret)
+	if s.cfg.ClientSecretFile != "" {
+		b, err := ioutil.ReadFile(s.cfg.ClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read azure ad client secret file %s: %s", s.cfg.ClientSecretFile, err)
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	scope := s.cfg.Resource
+	if !strings.HasSuffix(scope, "/.default") {
+		scope = strings.TrimSuffix(scope, "/") + "/.default"
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {s.cfg.ClientID},
+		"client_secret": {secret},
+		"scope":         {scope},
+	}
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(s.cfg.AuthorityHost, "/"), url.PathEscape(s.cfg.TenantID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
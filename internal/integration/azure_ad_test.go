@@ -0,0 +1,93 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func TestAzureADTokenSource_ManagedIdentity(t *testing.T) {
+	var requests int
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, "api://exporter", r.URL.Query().Get("resource"))
+		assert.Equal(t, "identity-id", r.URL.Query().Get("client_id"))
+		// The managed identity endpoints send the expiration as a string.
+		fmt.Fprintf(w, `{"access_token": "token-%d", "expires_in": "3600"}`, requests)
+	}))
+	defer imds.Close()
+	defer func(u string) { imdsTokenURL = u }(imdsTokenURL)
+	imdsTokenURL = imds.URL
+	defer os.Setenv("IDENTITY_ENDPOINT", os.Getenv("IDENTITY_ENDPOINT"))
+	require.NoError(t, os.Unsetenv("IDENTITY_ENDPOINT"))
+
+	source := newAzureADTokenSource(endpoints.AzureADConfig{Resource: "api://exporter", ClientID: "identity-id"})
+	now := time.Now()
+	source.now = func() time.Time { return now }
+
+	token, err := source.token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	now = now.Add(50 * time.Minute)
+	token, err = source.token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token, "the token is cached")
+
+	now = now.Add(6 * time.Minute)
+	token, err = source.token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token, "the token is renewed before it expires")
+}
+
+func TestAzureADTokenSource_ClientCredentials(t *testing.T) {
+	authority := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "/tenant-id/oauth2/v2.0/token", r.URL.Path)
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "app-id", r.PostForm.Get("client_id"))
+		assert.Equal(t, "api://exporter/.default", r.PostForm.Get("scope"))
+		if r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided."}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token": "app-token", "expires_in": 3599}`))
+	}))
+	defer authority.Close()
+
+	var sent *http.Request
+	rt := NewAzureADRoundTripper(endpoints.AzureADConfig{
+		Resource:      "api://exporter",
+		ClientID:      "app-id",
+		TenantID:      "tenant-id",
+		ClientSecret:  "secret",
+		AuthorityHost: authority.URL,
+	}, recordingRoundTripper(&sent))
+	req, err := http.NewRequest(http.MethodGet, "https://exporter.example.com/metrics", nil)
+	require.NoError(t, err)
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer app-token", sent.Header.Get("Authorization"))
+
+	source := newAzureADTokenSource(endpoints.AzureADConfig{
+		Resource:      "api://exporter",
+		ClientID:      "app-id",
+		TenantID:      "tenant-id",
+		ClientSecret:  "wrong",
+		AuthorityHost: authority.URL,
+	})
+	_, err = source.token()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "status 401: invalid_client")
+}
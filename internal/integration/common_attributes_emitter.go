@@ -0,0 +1,50 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import "github.com/newrelic/nri-prometheus/internal/pkg/labels"
+
+// commonAttributesEmitter adds the common attributes to the metrics it
+// emits.
+type commonAttributesEmitter struct {
+	Emitter
+	attributes labels.Set
+}
+
+// CommonAttributesEmitter wraps the emitter so the attributes are added to
+// every metric it emits, for the emitters that can't send them once per
+// harvest like the telemetry emitter. The attributes of the metrics take
+// precedence, as with the add_attributes processing rules.
+func CommonAttributesEmitter(emitter Emitter, attributes map[string]interface{}) Emitter {
+	if len(attributes) == 0 {
+		return emitter
+	}
+	return &commonAttributesEmitter{Emitter: emitter, attributes: attributes}
+}
+
+// Emit emits the metrics with the common attributes. The metrics are copied,
+// as they're shared with the other emitters.
+func (ce *commonAttributesEmitter) Emit(metrics []Metric) error {
+	withAttributes := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		attributes := make(labels.Set, len(m.attributes)+len(ce.attributes))
+		for k, v := range m.attributes {
+			attributes[k] = v
+		}
+		labels.Accumulate(attributes, ce.attributes)
+		m.attributes = attributes
+		withAttributes[i] = m
+	}
+	return ce.Emitter.Emit(withAttributes)
+}
+
+// wrappedEmitters returns the wrapped emitter.
+func (ce *commonAttributesEmitter) wrappedEmitters() []Emitter {
+	return []Emitter{ce.Emitter}
+}
+
+// endHarvest notifies the wrapped emitter that the harvest ended.
+func (ce *commonAttributesEmitter) endHarvest() {
+	endHarvest([]Emitter{ce.Emitter})
+}
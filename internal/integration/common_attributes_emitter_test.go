@@ -0,0 +1,29 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestCommonAttributesEmitter(t *testing.T) {
+	metrics := []Metric{
+		{name: "a", attributes: labels.Set{"targetName": "a"}},
+		{name: "b", attributes: labels.Set{"targetName": "b", "clusterName": "own"}},
+	}
+	recorder := &recordingEmitter{}
+	emitter := CommonAttributesEmitter(recorder, map[string]interface{}{"clusterName": "common", "integrationName": "nri-prometheus"})
+
+	require.NoError(t, emitter.Emit(metrics))
+	require.Len(t, recorder.metrics, 2)
+	assert.Equal(t, labels.Set{"targetName": "a", "clusterName": "common", "integrationName": "nri-prometheus"}, recorder.metrics[0].attributes)
+	assert.Equal(t, labels.Set{"targetName": "b", "clusterName": "own", "integrationName": "nri-prometheus"}, recorder.metrics[1].attributes)
+	assert.Equal(t, labels.Set{"targetName": "a"}, metrics[0].attributes, "the shared metrics must not be modified")
+
+	assert.Equal(t, Emitter(recorder), CommonAttributesEmitter(recorder, nil))
+}
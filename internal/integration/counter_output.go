@@ -0,0 +1,54 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// CounterOutput is how the telemetry emitter sends the counters.
+type CounterOutput string
+
+const (
+	// CounterOutputDelta sends the difference of the counters with their
+	// previous value, so their first value is only used as the base of the
+	// next delta.
+	CounterOutputDelta CounterOutput = "delta"
+	// CounterOutputCumulative sends the cumulative value of all the
+	// counters as gauges, as the CumulativeCounterPrefixes do, and of the
+	// counts, sums and buckets of the histograms and summaries, so their
+	// first value isn't lost. The pinned telemetry SDK can't send counts
+	// with a start time.
+	CounterOutputCumulative CounterOutput = "cumulative"
+	// CounterOutputRate sends the per-second rate of the counters, their
+	// delta divided by the interval between their observations, as gauges
+	// at the time of the observation.
+	CounterOutputRate CounterOutput = "rate"
+)
+
+// ParseCounterOutput returns the counter output of the name, delta if empty.
+func ParseCounterOutput(name string) (CounterOutput, error) {
+	switch output := CounterOutput(name); output {
+	case "":
+		return CounterOutputDelta, nil
+	case CounterOutputDelta, CounterOutputCumulative, CounterOutputRate:
+		return output, nil
+	default:
+		return "", fmt.Errorf("unknown counter output %q, expected delta, cumulative or rate", name)
+	}
+}
+
+// rateGauge returns the gauge of the per-second rate of the delta count, at
+// the end of its interval.
+func rateGauge(count telemetry.Count) telemetry.Gauge {
+	return telemetry.Gauge{
+		Name:           count.Name,
+		Attributes:     count.Attributes,
+		AttributesJSON: count.AttributesJSON,
+		Value:          count.Value / count.Interval.Seconds(),
+		Timestamp:      count.Timestamp.Add(count.Interval),
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestParseCounterOutput(t *testing.T) {
+	output, err := ParseCounterOutput("")
+	require.NoError(t, err)
+	assert.Equal(t, CounterOutputDelta, output)
+	output, err = ParseCounterOutput("cumulative")
+	require.NoError(t, err)
+	assert.Equal(t, CounterOutputCumulative, output)
+	_, err = ParseCounterOutput("gauge")
+	assert.Error(t, err)
+}
+
+func TestTelemetryEmitter_CumulativeCounterOutput(t *testing.T) {
+	var sent []map[string]interface{}
+	e := counterOutputEmitter(t, CounterOutputCumulative, &sent)
+
+	require.NoError(t, e.Emit([]Metric{{
+		name:       "requests_total",
+		value:      10,
+		metricType: metricType_COUNTER,
+		attributes: labels.Set{"path": "/"},
+	}}))
+	e.harvester.HarvestNow(context.Background())
+
+	require.Len(t, sent, 1, "the first value isn't lost")
+	assert.Equal(t, "gauge", sent[0]["type"])
+	assert.Equal(t, 10.0, sent[0]["value"])
+}
+
+func TestTelemetryEmitter_CumulativeCounterOutputHistogram(t *testing.T) {
+	var sent []map[string]interface{}
+	e := counterOutputEmitter(t, CounterOutputCumulative, &sent)
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+
+	require.NoError(t, e.Emit([]Metric{{
+		name:       "latency",
+		metricType: metricType_HISTOGRAM,
+		attributes: labels.Set{},
+		histogram:  hist,
+	}}))
+	e.harvester.HarvestNow(context.Background())
+
+	types := map[string]string{}
+	values := map[string][]float64{}
+	for _, m := range sent {
+		name := m["name"].(string)
+		types[name] = m["type"].(string)
+		values[name] = append(values[name], m["value"].(float64))
+	}
+	assert.Equal(t, "gauge", types["latency.sum"], "the sum isn't sent as a delta")
+	assert.Equal(t, []float64{3}, values["latency.sum"])
+	assert.Equal(t, "gauge", types["latency.buckets"])
+	assert.ElementsMatch(t, []float64{1, 2}, values["latency.buckets"], "the first values of the buckets aren't lost")
+}
+
+func TestTelemetryEmitter_RateCounterOutput(t *testing.T) {
+	var sent []map[string]interface{}
+	e := counterOutputEmitter(t, CounterOutputRate, &sent)
+
+	start := time.Now().Add(-time.Minute)
+	for i, value := range []float64{10, 70} {
+		require.NoError(t, e.Emit([]Metric{{
+			name:       "requests_total",
+			value:      value,
+			metricType: metricType_COUNTER,
+			attributes: labels.Set{"path": "/"},
+			timestamp:  start.Add(time.Duration(i) * time.Minute),
+		}}))
+	}
+	e.harvester.HarvestNow(context.Background())
+
+	require.Len(t, sent, 1)
+	assert.Equal(t, "gauge", sent[0]["type"])
+	assert.Equal(t, 1.0, sent[0]["value"], "60 requests in a minute")
+	assert.Equal(t, float64(start.Add(time.Minute).UnixNano()/1e6), sent[0]["timestamp"])
+}
+
+func counterOutputEmitter(t *testing.T, output CounterOutput, sent *[]map[string]interface{}) *TelemetryEmitter {
+	e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					var payload []map[string]interface{}
+					reader, err := gzip.NewReader(req.Body)
+					require.NoError(t, err)
+					require.NoError(t, json.NewDecoder(reader).Decode(&payload))
+					for _, m := range payload[0]["metrics"].([]interface{}) {
+						*sent = append(*sent, m.(map[string]interface{}))
+					}
+					return emptyResponse(http.StatusAccepted), nil
+				})
+			},
+		},
+		CounterOutput: output,
+	})
+	require.NoError(t, err)
+	return e
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/metricapitest"
+)
+
+func TestTelemetryEmitterCumulativeCounters(t *testing.T) {
+	api := metricapitest.NewServer()
+	defer api.Close()
+
+	te, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL(api.URL),
+			TelemetryHarvesterWithHarvestPeriod(0),
+		},
+		CumulativeCounterPrefixes: []string{"http_"},
+	})
+	require.NoError(t, err)
+
+	emit := func(value float64) {
+		require.NoError(t, te.Emit([]Metric{
+			{name: "http_requests_total", metricType: metricType_COUNTER, value: value, attributes: labels.Set{"code": "200"}},
+			{name: "rpc_requests_total", metricType: metricType_COUNTER, value: value, attributes: labels.Set{"code": "200"}},
+		}))
+		te.harvester.HarvestNow(context.Background())
+	}
+	emit(10)
+	emit(15)
+
+	var cumulative []float64
+	var deltas []float64
+	for _, m := range api.Metrics() {
+		switch m.Name {
+		case "http_requests_total":
+			assert.Equal(t, "gauge", m.Type)
+			cumulative = append(cumulative, m.Value.(float64))
+		case "rpc_requests_total":
+			assert.Equal(t, "count", m.Type)
+			deltas = append(deltas, m.Value.(float64))
+		}
+	}
+	assert.Equal(t, []float64{10, 15}, cumulative, "the cumulative values are sent from the first emission")
+	assert.Equal(t, []float64{5}, deltas, "the first value of the other counters is the base of the delta")
+}
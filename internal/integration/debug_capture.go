@@ -0,0 +1,462 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+const (
+	defaultCaptureDuration    = time.Minute
+	defaultCaptureMaxDuration = 5 * time.Minute
+	defaultCaptureMaxBytes    = 32 << 20
+	// redactedHeaderValue replaces the values of the credential headers.
+	redactedHeaderValue = "REDACTED"
+)
+
+// capturedHeaders are the headers with credentials, redacted in the
+// captures.
+var capturedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// secretParams are the substrings of the names of the query parameters with
+// credentials, like access_token or X-Amz-Signature, redacted in the
+// captures.
+var secretParams = []string{"token", "secret", "password", "key", "signature", "credential", "auth"}
+
+var clog = logrus.WithField("component", "DebugCapture")
+
+// unsafeFileChars are replaced in the name of the bundles.
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// DebugCapture records, for a limited time, the scrape requests and
+// responses of a single target and the metrics emitted from them, so
+// evidence of the problems of a target can be gathered in production. Only
+// one capture runs at a time, and it stops recording when its size reaches
+// the limit. It's an Emitter, recording the metrics of the captured target,
+// and an http.Handler starting the captures.
+type DebugCapture struct {
+	maxDuration time.Duration
+	maxBytes    int
+
+	mu      sync.Mutex
+	current *capture
+}
+
+// capture is the data recorded by a running capture.
+type capture struct {
+	target  string
+	start   time.Time
+	end     time.Time
+	size    int
+	full    bool
+	targets map[string]bool
+	files   []captureFile
+	scrapes int
+	emits   int
+}
+
+type captureFile struct {
+	name string
+	body []byte
+}
+
+// captureSummary is the capture.json file of the bundles.
+type captureSummary struct {
+	Target    string    `json:"target"`
+	Targets   []string  `json:"matchedTargets"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Scrapes   int       `json:"scrapes"`
+	Emissions int       `json:"emissions"`
+	// Truncated is true if the size limit was reached and the capture
+	// stopped recording.
+	Truncated bool `json:"truncated"`
+}
+
+// NewDebugCapture returns a DebugCapture whose captures last at most
+// maxDuration, 5m if 0, and record at most maxBytes, 32MiB if 0.
+func NewDebugCapture(maxDuration time.Duration, maxBytes int) *DebugCapture {
+	if maxDuration == 0 {
+		maxDuration = defaultCaptureMaxDuration
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultCaptureMaxBytes
+	}
+	return &DebugCapture{maxDuration: maxDuration, maxBytes: maxBytes}
+}
+
+// WithDebugCapture records the scrapes of the captured targets into dc.
+func WithDebugCapture(dc *DebugCapture) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.debugCapture = dc
+	}
+}
+
+// start begins a capture of the target, which is matched by name or scrape
+// URL. It fails if a capture is already running.
+func (dc *DebugCapture) start(target string, now time.Time) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.current != nil {
+		return fmt.Errorf("a capture of target %q is already running", dc.current.target)
+	}
+	dc.current = &capture{target: target, start: now, targets: map[string]bool{}}
+	return nil
+}
+
+// stop ends the running capture and returns it.
+func (dc *DebugCapture) stop(now time.Time) *capture {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	c := dc.current
+	dc.current = nil
+	if c != nil {
+		c.end = now
+	}
+	return c
+}
+
+// record adds the file to the running capture, if there is room for it. It
+// returns false if there's no capture or it's full.
+func (dc *DebugCapture) record(c *capture, name string, body []byte) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.current != c || c.full {
+		return false
+	}
+	if c.size+len(body) > dc.maxBytes {
+		c.full = true
+		return false
+	}
+	c.size += len(body)
+	c.files = append(c.files, captureFile{name: name, body: body})
+	return true
+}
+
+// room returns the number of bytes the capture can still record.
+func (dc *DebugCapture) room(c *capture) int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.maxBytes - c.size
+}
+
+// markFull stops the recording of the capture.
+func (dc *DebugCapture) markFull(c *capture) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	c.full = true
+}
+
+// capturing returns the running capture if it matches the target name or
+// scrape URL.
+func (dc *DebugCapture) capturing(targetName, url string) *capture {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	c := dc.current
+	if c == nil || c.full || (c.target != targetName && c.target != url) {
+		return nil
+	}
+	c.targets[targetName] = true
+	return c
+}
+
+// doer returns the client recording the scrapes of the target, or the given
+// client if the target is not captured.
+func (dc *DebugCapture) doer(client prometheus.HTTPDoer, targetName, url string) prometheus.HTTPDoer {
+	if dc == nil {
+		return client
+	}
+	c := dc.capturing(targetName, url)
+	if c == nil {
+		return client
+	}
+	return &capturingDoer{client: client, dc: dc, capture: c}
+}
+
+// capturingDoer records the requests and the responses of the scrapes.
+type capturingDoer struct {
+	client  prometheus.HTTPDoer
+	dc      *DebugCapture
+	capture *capture
+}
+
+func (d *capturingDoer) Do(req *http.Request) (*http.Response, error) {
+	d.dc.mu.Lock()
+	d.capture.scrapes++
+	prefix := fmt.Sprintf("scrapes/%04d-", d.capture.scrapes)
+	d.dc.mu.Unlock()
+
+	start := time.Now()
+	if dump, err := httputil.DumpRequest(redactRequest(req), false); err == nil {
+		d.dc.record(d.capture, prefix+"request.txt", dump)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.dc.record(d.capture, prefix+"error.txt", []byte(fmt.Sprintf("%s after %s\n", err, time.Since(start))))
+		return resp, err
+	}
+
+	headers := *resp
+	headers.Header = redactHeaderValues(resp.Header)
+	dump, _ := httputil.DumpResponse(&headers, false)
+	dump = append(dump, fmt.Sprintf("X-Capture-Duration: %s\r\n\r\n", time.Since(start))...)
+	// The body is recorded as the scrape reads it, so it isn't buffered
+	// beyond the room left in the capture.
+	resp.Body = &capturingBody{
+		ReadCloser: resp.Body,
+		dc:         d.dc,
+		capture:    d.capture,
+		prefix:     prefix,
+		dump:       dump,
+		room:       d.dc.room(d.capture) - len(dump),
+	}
+	return resp, nil
+}
+
+// capturingBody records the body of a response as it's read, up to the room
+// left in the capture. The response is recorded once the body is read to
+// the end or closed, and the capture stops recording if it didn't fit.
+type capturingBody struct {
+	io.ReadCloser
+	dc      *DebugCapture
+	capture *capture
+	prefix  string
+	dump    []byte
+	room    int
+
+	body      bytes.Buffer
+	truncated bool
+	once      sync.Once
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	keep := b.room - b.body.Len()
+	if keep > n {
+		keep = n
+	}
+	if keep > 0 {
+		b.body.Write(p[:keep])
+	}
+	if n > keep {
+		b.truncated = true
+	}
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *capturingBody) Close() error {
+	b.finish(nil)
+	return b.ReadCloser.Close()
+}
+
+// finish records the response read so far, and the error reading it if any.
+func (b *capturingBody) finish(readErr error) {
+	b.once.Do(func() {
+		b.dc.record(b.capture, b.prefix+"response.txt", append(b.dump, b.body.Bytes()...))
+		if readErr != nil {
+			b.dc.record(b.capture, b.prefix+"error.txt", []byte(fmt.Sprintf("reading body: %s\n", readErr)))
+		}
+		if b.truncated {
+			b.dc.markFull(b.capture)
+		}
+	})
+}
+
+// redactRequest returns a copy of the request with the credential headers
+// and query parameters redacted.
+func redactRequest(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header = redactHeaderValues(req.Header)
+	r.URL = redactQuery(req.URL)
+	return r
+}
+
+// redactQuery returns a copy of the URL with the values of the secret query
+// parameters, and the password of the user info, redacted.
+func redactQuery(u *url.URL) *url.URL {
+	redacted := *u
+	if _, ok := u.User.Password(); ok {
+		redacted.User = url.UserPassword(u.User.Username(), redactedHeaderValue)
+	}
+	query, changed := u.Query(), false
+	for name := range query {
+		if isSecretParam(name) {
+			query[name] = []string{redactedHeaderValue}
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return &redacted
+}
+
+func isSecretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range secretParams {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactHeaderValues(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range capturedHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, redactedHeaderValue)
+		}
+	}
+	return redacted
+}
+
+// Name is the DebugCapture emitter name.
+func (dc *DebugCapture) Name() string {
+	return "debug_capture"
+}
+
+// Emit records the metrics of the captured targets.
+func (dc *DebugCapture) Emit(metrics []Metric) error {
+	dc.mu.Lock()
+	c := dc.current
+	var captured []metricRecord
+	if c != nil && !c.full {
+		for _, m := range metrics {
+			name, _ := m.attributes["targetName"].(string)
+			if !c.targets[name] {
+				continue
+			}
+			captured = append(captured, newMetricRecord(m, m.timestamp))
+		}
+	}
+	if len(captured) == 0 {
+		dc.mu.Unlock()
+		return nil
+	}
+	c.emits++
+	name := fmt.Sprintf("metrics/%04d.json", c.emits)
+	// The metrics are encoded with the lock held, as the attributes may be
+	// changed once emitted.
+	b, err := json.MarshalIndent(captured, "", "  ")
+	dc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dc.record(c, name, b)
+	return nil
+}
+
+// ServeHTTP starts a capture of the target query parameter for the duration
+// parameter, 1m by default, and responds with its bundle: a tar.gz file with
+// the requests and responses of the scrapes and the emitted metrics. The
+// capture stops early if the client disconnects.
+func (dc *DebugCapture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "the target parameter is required", http.StatusBadRequest)
+		return
+	}
+	duration := defaultCaptureDuration
+	if d := r.URL.Query().Get("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", d), http.StatusBadRequest)
+			return
+		}
+	}
+	if duration > dc.maxDuration {
+		http.Error(w, fmt.Sprintf("the duration can't be longer than %s", dc.maxDuration), http.StatusBadRequest)
+		return
+	}
+
+	if err := dc.start(target, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	clog.WithField("target", target).WithField("duration", duration).Warn("debug capture started")
+	timer := time.NewTimer(duration)
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		timer.Stop()
+	}
+	c := dc.stop(time.Now())
+	clog.WithField("target", target).WithField("scrapes", c.scrapes).Warn("debug capture finished")
+	if r.Context().Err() != nil {
+		return
+	}
+
+	fileName := fmt.Sprintf("capture-%s-%s.tar.gz", unsafeFileChars.ReplaceAllString(target, "_"), c.start.UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	if err := c.writeBundle(w); err != nil {
+		clog.WithError(err).Warn("writing debug capture bundle")
+	}
+}
+
+// writeBundle writes the tar.gz bundle of the capture.
+func (c *capture) writeBundle(w io.Writer) error {
+	summary := captureSummary{
+		Target:    c.target,
+		Targets:   []string{},
+		Start:     c.start,
+		End:       c.end,
+		Scrapes:   c.scrapes,
+		Emissions: c.emits,
+		Truncated: c.full,
+	}
+	for t := range c.targets {
+		summary.Targets = append(summary.Targets, t)
+	}
+	sort.Strings(summary.Targets)
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	files := append([]captureFile{{name: "capture.json", body: b}}, c.files...)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.body)), ModTime: c.end}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,153 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultDeltaStateMaxAge is the age of the oldest values of the counters
+// restored, without DeltaStateMaxAge.
+const defaultDeltaStateMaxAge = 10 * time.Minute
+
+// savedDeltaState is the delta state of the counters of an emitter, as
+// persisted to disk.
+type savedDeltaState struct {
+	SavedAt time.Time    `json:"savedAt"`
+	Series  []savedDelta `json:"series"`
+}
+
+// savedDelta is the last cumulative value of a series, identified by its
+// name and encoded attributes.
+type savedDelta struct {
+	Key   string    `json:"key"`
+	Value float64   `json:"value"`
+	When  time.Time `json:"when"`
+}
+
+// snapshot returns the last values of the series. The values that can't be
+// encoded to JSON are skipped.
+func (dc *encodedDeltaCalculator) snapshot() []savedDelta {
+	series := make([]savedDelta, 0, len(dc.datapoints))
+	for key, v := range dc.datapoints {
+		if math.IsNaN(v.value) || math.IsInf(v.value, 0) {
+			continue
+		}
+		series = append(series, savedDelta{Key: key, Value: v.value, When: v.when})
+	}
+	return series
+}
+
+// restore sets the last values of the series that aren't older than the
+// cutoff, returning how many were restored.
+func (dc *encodedDeltaCalculator) restore(series []savedDelta, cutoff time.Time) int {
+	restored := 0
+	for _, s := range series {
+		if s.When.Before(cutoff) {
+			continue
+		}
+		dc.datapoints[s.Key] = &cumulativeValue{value: s.Value, when: s.When}
+		restored++
+	}
+	return restored
+}
+
+// deltaStateFile returns the file of the delta state of the emitter in the
+// directory.
+func deltaStateFile(dir, emitter string) string {
+	return filepath.Join(dir, emitter+".json")
+}
+
+// readDeltaState reads the delta state of the file. There's no state if the
+// file doesn't exist.
+func readDeltaState(file string) ([]savedDelta, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedDeltaState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return state.Series, nil
+}
+
+// writeDeltaState writes the delta state to the file. The file is replaced
+// atomically.
+func writeDeltaState(file string, series []savedDelta, now time.Time) error {
+	b, err := json.Marshal(savedDeltaState{SavedAt: now, Series: series})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// restoreDeltaState restores the delta state of the counters of the emitter
+// from its file.
+func (te *TelemetryEmitter) restoreDeltaState() {
+	log := ilog.WithField("emitter", te.name).WithField("file", te.deltaStateFile)
+	series, err := readDeltaState(te.deltaStateFile)
+	if err != nil {
+		log.WithError(err).Warn("couldn't restore the counters delta state, their first deltas will be skipped")
+		return
+	}
+	te.mu.Lock()
+	restored := te.encodedDeltaCalculator.restore(series, time.Now().Add(-te.deltaStateMaxAge))
+	te.mu.Unlock()
+	log.Debugf("restored the delta state of %d counters", restored)
+}
+
+// writeDeltaState saves the delta state of the counters of the emitter to
+// its file.
+func (te *TelemetryEmitter) writeDeltaState(now time.Time) {
+	te.mu.Lock()
+	series := te.encodedDeltaCalculator.snapshot()
+	te.mu.Unlock()
+	if err := writeDeltaState(te.deltaStateFile, series, now); err != nil {
+		ilog.WithError(err).WithField("emitter", te.name).WithField("file", te.deltaStateFile).Warn("couldn't save the counters delta state")
+	}
+}
+
+// SaveDeltaStates harvests the metrics of the telemetry emitters of the
+// emitters persisting their delta state, and saves it, whenever it was last
+// saved, so the values since the last save aren't lost on shutdown.
+func SaveDeltaStates(ctx context.Context, emitters []Emitter) {
+	for _, te := range telemetryEmitters(emitters) {
+		if te.deltaStateFile == "" {
+			continue
+		}
+		te.harvesterMu.RLock()
+		harvester := te.harvester
+		te.harvesterMu.RUnlock()
+		harvester.HarvestNow(ctx)
+		te.writeDeltaState(time.Now())
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestTelemetryEmitter_DeltaState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var sent []map[string]interface{}
+	newEmitter := func() *TelemetryEmitter {
+		e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+			HarvesterOpts: []TelemetryHarvesterOpt{
+				telemetry.ConfigAPIKey("api key"),
+				TelemetryHarvesterWithMetricsURL("nilapiurl"),
+				func(cfg *telemetry.Config) {
+					cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+						var payload []map[string]interface{}
+						reader, err := gzip.NewReader(req.Body)
+						require.NoError(t, err)
+						require.NoError(t, json.NewDecoder(reader).Decode(&payload))
+						for _, m := range payload[0]["metrics"].([]interface{}) {
+							sent = append(sent, m.(map[string]interface{}))
+						}
+						return emptyResponse(http.StatusAccepted), nil
+					})
+				},
+			},
+			DeltaStateDir: dir,
+		})
+		require.NoError(t, err)
+		return e
+	}
+	counter := func(value float64, timestamp time.Time) []Metric {
+		return []Metric{{
+			name:       "requests_total",
+			value:      value,
+			metricType: metricType_COUNTER,
+			attributes: labels.Set{"path": "/"},
+			timestamp:  timestamp,
+		}}
+	}
+
+	start := time.Now().Add(-time.Minute)
+	e := newEmitter()
+	require.NoError(t, e.Emit(counter(10, start)))
+	e.endHarvest()
+	e.harvester.HarvestNow(context.Background())
+	assert.Empty(t, sent, "the first value of the counter has no delta")
+	assert.FileExists(t, filepath.Join(dir, "telemetry.json"))
+
+	restarted := newEmitter()
+	require.NoError(t, restarted.Emit(counter(15, start.Add(30*time.Second))))
+	restarted.harvester.HarvestNow(context.Background())
+	require.Len(t, sent, 1, "the delta is calculated with the restored state")
+	assert.Equal(t, 5.0, sent[0]["value"])
+}
+
+func TestEncodedDeltaCalculator_Restore(t *testing.T) {
+	now := time.Now()
+	dc := newEncodedDeltaCalculator(5*time.Minute, 5*time.Minute)
+	dc.datapoints["a"] = &cumulativeValue{value: 1, when: now}
+	dc.datapoints["nan"] = &cumulativeValue{value: math.NaN(), when: now}
+	series := dc.snapshot()
+	require.Len(t, series, 1, "the values that can't be encoded are skipped")
+
+	series = append(series, savedDelta{Key: "expired", Value: 1, When: now.Add(-10 * time.Minute)})
+	restored := newEncodedDeltaCalculator(5*time.Minute, 5*time.Minute)
+	assert.Equal(t, 1, restored.restore(series, now.Add(-5*time.Minute)), "the values older than the cutoff aren't restored")
+	assert.Equal(t, &cumulativeValue{value: 1, when: now}, restored.datapoints["a"])
+}
+
+func TestTelemetryEmitter_DeltaStateMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	require.NoError(t, writeDeltaState(deltaStateFile(dir, "telemetry"), []savedDelta{
+		{Key: "recent", Value: 1, When: now.Add(-time.Minute)},
+		{Key: "old", Value: 1, When: now.Add(-3 * time.Minute)},
+	}, now))
+
+	newEmitter := func(maxAge time.Duration) *TelemetryEmitter {
+		e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+			HarvesterOpts: []TelemetryHarvesterOpt{
+				telemetry.ConfigAPIKey("api key"),
+				TelemetryHarvesterWithMetricsURL("nilapiurl"),
+				TelemetryHarvesterWithHarvestPeriod(0),
+			},
+			DeltaStateDir:      dir,
+			DeltaStateMaxAge:   maxAge,
+			DeltaExpirationAge: time.Hour,
+		})
+		require.NoError(t, err)
+		return e
+	}
+	assert.Len(t, newEmitter(0).encodedDeltaCalculator.datapoints, 2, "the default max age is independent of the expiration age")
+	e := newEmitter(2 * time.Minute)
+	assert.Len(t, e.encodedDeltaCalculator.datapoints, 1)
+	assert.Contains(t, e.encodedDeltaCalculator.datapoints, "recent")
+}
+
+func TestSaveDeltaStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			TelemetryHarvesterWithHarvestPeriod(0),
+		},
+		DeltaStateDir: dir,
+	})
+	require.NoError(t, err)
+	counter := func(value float64) []Metric {
+		return []Metric{{name: "requests_total", value: value, metricType: metricType_COUNTER, attributes: labels.Set{}}}
+	}
+
+	require.NoError(t, e.Emit(counter(10)))
+	e.endHarvest()
+	require.NoError(t, e.Emit(counter(15)))
+	e.endHarvest()
+	series, err := readDeltaState(deltaStateFile(dir, "telemetry"))
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, float64(15), series[0].Value, "the state is saved after every harvest")
+
+	require.NoError(t, e.Emit(counter(20)))
+	SaveDeltaStates(context.Background(), []Emitter{e})
+	series, err = readDeltaState(deltaStateFile(dir, "telemetry"))
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, float64(20), series[0].Value, "the state is saved on shutdown")
+}
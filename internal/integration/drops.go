@@ -0,0 +1,161 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// The reasons the scraped metrics are dropped, counted by job in the
+// nr_stats_integration_dropped_metrics_total self-metric so the metrics
+// missing in New Relic can be accounted for. The metrics dropped by an
+// emitter are counted with its name, as every emitter drops its own copy.
+const (
+	// dropReasonRule is for the metrics ignored by the processing rules and
+	// the metric filters of the targets.
+	dropReasonRule = "rule"
+	// dropReasonLimit is for the metrics dropped to stay within the limits,
+	// by a full emit queue, a degraded emitter shedding its load or the
+	// Metric API rejecting a payload too large.
+	dropReasonLimit = "limit"
+	// dropReasonConvert is for the metrics that can't be converted to New
+	// Relic metrics, like the summaries with invalid quantiles.
+	dropReasonConvert = "convert_error"
+	// dropReasonEmit is for the metrics an emitter failed to emit.
+	dropReasonEmit = "emit_error"
+	// dropReasonQuirk is for the samples dropped by the workarounds of the
+	// exporter quirks, like the duplicated series.
+	dropReasonQuirk = "quirk"
+)
+
+// countDropped counts n metrics of the job dropped for the reason before
+// they reach the emitters.
+func countDropped(job, reason string, n int) {
+	countEmitterDropped(job, "", reason, n)
+}
+
+// countEmitterDropped counts n metrics of the job dropped by the emitter for
+// the reason.
+func countEmitterDropped(job, emitter, reason string, n int) {
+	if n > 0 {
+		droppedMetricsMetric.WithLabelValues(job, emitter, reason).Add(float64(n))
+	}
+}
+
+// job returns the scrape job of the target, or the default job if it wasn't
+// scraped by the fetcher.
+func (tm *TargetMetrics) job() string {
+	if tm.Job == "" {
+		return defaultScrapeJob
+	}
+	return tm.Job
+}
+
+// conversionError is returned by the telemetry emitter when some metrics
+// can't be converted, while the rest of them are emitted.
+type conversionError struct {
+	err error
+	// metrics is the number of metrics that weren't converted.
+	metrics int
+}
+
+func (e *conversionError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the conversion errors.
+func (e *conversionError) Unwrap() error {
+	return e.err
+}
+
+// countEmitDropped counts the metrics of the pair dropped by the emitter,
+// given the error of the emission: the metrics that weren't converted, or
+// all of them if the emission failed, plus the ones shed or rejected as too
+// large since the last emission. The telemetry emitters send their metrics
+// in the background, so the rejected ones are accounted to the job of the
+// next emission.
+func countEmitDropped(pair *TargetMetrics, e Emitter, err error) {
+	job := pair.job()
+	var convErr *conversionError
+	switch {
+	case errors.As(err, &convErr):
+		countEmitterDropped(job, e.Name(), dropReasonConvert, convErr.metrics)
+	case err != nil:
+		countEmitterDropped(job, e.Name(), dropReasonEmit, len(pair.Metrics))
+	}
+	countEmitterDropped(job, e.Name(), dropReasonLimit, takeShedMetrics(e))
+}
+
+// takeShedMetrics returns the metrics shed by the telemetry emitters of e,
+// or rejected by the Metric API as too large, since the last call.
+func takeShedMetrics(e Emitter) int {
+	var shed uint64
+	for _, te := range telemetryEmitters([]Emitter{e}) {
+		shed += atomic.SwapUint64(&te.shedMetrics, 0)
+		if te.rejectedMetrics != nil {
+			shed += atomic.SwapUint64(te.rejectedMetrics, 0)
+		}
+	}
+	return int(shed)
+}
+
+// countRejectedMetrics wraps the harvester client transport to count the
+// metrics of the payloads the Metric API rejects as too large, which the
+// harvester drops.
+func countRejectedMetrics(rejected *uint64) TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		rt := cfg.Client.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = rejectedMetricsRoundTripper{rejected: rejected, rt: rt}
+	}
+}
+
+// rejectedMetricsRoundTripper counts the metrics of the payloads rejected
+// with a 413 response.
+type rejectedMetricsRoundTripper struct {
+	rejected *uint64
+	rt       http.RoundTripper
+}
+
+// RoundTrip sends the request, counting its metrics if it's rejected as too
+// large.
+func (t rejectedMetricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusRequestEntityTooLarge && req.GetBody != nil {
+		if body, berr := req.GetBody(); berr == nil {
+			atomic.AddUint64(t.rejected, uint64(payloadMetrics(body)))
+		}
+	}
+	return resp, err
+}
+
+// payloadMetrics returns the number of metrics of a gzipped Metric API
+// payload, or 0 if it can't be decoded.
+func payloadMetrics(body io.ReadCloser) int {
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return 0
+	}
+	var batches []struct {
+		Metrics []json.RawMessage `json:"metrics"`
+	}
+	if err := json.NewDecoder(gz).Decode(&batches); err != nil {
+		return 0
+	}
+	var n int
+	for _, b := range batches {
+		n += len(b.Metrics)
+	}
+	return n
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func droppedMetrics(job, emitter, reason string) float64 {
+	return testutil.ToFloat64(droppedMetricsMetric.WithLabelValues(job, emitter, reason))
+}
+
+func TestFetcher_TargetMetricsJob(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer ts.Close()
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength,
+		WithScrapeJobs(ScrapeJob{Name: "payments", Match: map[string]string{"namespaceName": "payments"}}))
+	target := func(namespace string) endpoints.Target {
+		u, err := url.Parse(ts.URL + "/metrics?target=" + namespace)
+		require.NoError(t, err)
+		return endpoints.New(namespace, *u, endpoints.Object{Name: namespace, Kind: "pod", Labels: labels.Set{"namespaceName": namespace}})
+	}
+	jobs := map[string]string{}
+	for pair := range fetcher.Fetch([]endpoints.Target{target("payments"), target("other")}) {
+		jobs[pair.Target.Name] = pair.Job
+	}
+	assert.Equal(t, map[string]string{"payments": "payments", "other": defaultScrapeJob}, jobs)
+}
+
+func TestRuleProcessor_DroppedMetrics(t *testing.T) {
+	pairs := make(chan TargetMetrics, 1)
+	pairs <- TargetMetrics{
+		Job: "drops-rules",
+		Metrics: []Metric{
+			{name: "go_goroutines", metricType: metricType_GAUGE, attributes: labels.Set{}},
+			{name: "go_threads", metricType: metricType_GAUGE, attributes: labels.Set{}},
+			{name: "up", metricType: metricType_GAUGE, attributes: labels.Set{}},
+		},
+	}
+	close(pairs)
+	rules := []ProcessingRule{{IgnoreMetrics: []IgnoreRule{{Prefixes: []string{"go_"}}}}}
+	processed := <-RuleProcessor(rules, queueLength)(pairs)
+
+	assert.Len(t, processed.Metrics, 1)
+	assert.Equal(t, float64(2), droppedMetrics("drops-rules", "", dropReasonRule))
+}
+
+func TestCountEmitDropped(t *testing.T) {
+	pair := &TargetMetrics{Job: "drops-emit", Metrics: make([]Metric, 3)}
+	emitter := &recordingEmitter{}
+
+	countEmitDropped(pair, emitter, nil)
+	countEmitDropped(pair, emitter, fmt.Errorf("emitting: %w", &conversionError{err: errors.New("invalid percentile"), metrics: 1}))
+	countEmitDropped(pair, emitter, errors.New("connection refused"))
+
+	assert.Equal(t, float64(1), droppedMetrics("drops-emit", "recording", dropReasonConvert))
+	assert.Equal(t, float64(3), droppedMetrics("drops-emit", "recording", dropReasonEmit))
+	assert.Zero(t, droppedMetrics("drops-emit", "recording", dropReasonLimit))
+
+	before := droppedMetrics(defaultScrapeJob, "recording", dropReasonEmit)
+	countEmitDropped(&TargetMetrics{}, emitter, errors.New("connection refused"))
+	assert.Equal(t, before, droppedMetrics(defaultScrapeJob, "recording", dropReasonEmit), "there were no metrics to drop")
+}
+
+func TestTelemetryEmitter_ConversionError(t *testing.T) {
+	e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+		},
+	})
+	require.NoError(t, err)
+
+	err = e.Emit([]Metric{
+		{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{}},
+		{name: "latency", metricType: metricType_SUMMARY, attributes: labels.Set{}},
+		{name: "sizes", metricType: metricType_HISTOGRAM, attributes: labels.Set{}},
+	})
+	var convErr *conversionError
+	require.True(t, errors.As(err, &convErr))
+	assert.Equal(t, 2, convErr.metrics)
+}
+
+func TestTelemetryEmitter_PayloadTooLarge(t *testing.T) {
+	e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		Name: "drops-too-large",
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			TelemetryHarvesterWithHarvestPeriod(0),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return emptyResponse(http.StatusRequestEntityTooLarge), nil
+				})
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	pair := &TargetMetrics{Job: "drops-too-large", Metrics: []Metric{
+		{name: "a", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{}},
+		{name: "b", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{}},
+	}}
+	require.NoError(t, e.Emit(pair.Metrics))
+	e.harvester.HarvestNow(context.Background())
+
+	countEmitDropped(pair, e, nil)
+	assert.Equal(t, float64(2), droppedMetrics("drops-too-large", "drops-too-large", dropReasonLimit))
+}
+
+func TestCountEmitDropped_ByEmitter(t *testing.T) {
+	pair := &TargetMetrics{Job: "drops-emitters", Metrics: make([]Metric, 2)}
+	countEmitDropped(pair, &recordingEmitter{}, errors.New("connection refused"))
+	countEmitDropped(pair, &failingEmitter{name: "failing"}, errors.New("disk full"))
+
+	assert.Equal(t, float64(2), droppedMetrics("drops-emitters", "recording", dropReasonEmit))
+	assert.Equal(t, float64(2), droppedMetrics("drops-emitters", "failing", dropReasonEmit))
+}
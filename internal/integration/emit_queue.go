@@ -0,0 +1,89 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import "fmt"
+
+// QueuePolicy is the behavior of the emit queue when it is full.
+type QueuePolicy string
+
+const (
+	// QueueBlock stops the scraping until the emitters catch up.
+	QueueBlock QueuePolicy = "block"
+	// QueueDropOldest discards the oldest queued target metrics to make room
+	// for the new ones.
+	QueueDropOldest QueuePolicy = "drop_oldest"
+	// QueueDropNewest discards the new target metrics.
+	QueueDropNewest QueuePolicy = "drop_newest"
+)
+
+// ParseQueuePolicy returns the QueuePolicy with the given name.
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	switch p := QueuePolicy(name); p {
+	case QueueBlock, QueueDropOldest, QueueDropNewest:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid emit queue policy %q, must be one of %s, %s or %s",
+		name, QueueBlock, QueueDropOldest, QueueDropNewest)
+}
+
+// WithEmitQueue bounds to size the target metrics waiting to be emitted,
+// applying policy when the queue is full, so slow emitters don't cause an
+// unbounded memory growth.
+func WithEmitQueue(size int, policy QueuePolicy) ExecuteOption {
+	return func(e *execution) {
+		e.emitQueueSize = size
+		e.emitQueuePolicy = policy
+	}
+}
+
+// emitQueue forwards the target metrics of in to the returned channel,
+// keeping up to size of them while the receiver is busy. When the queue is
+// full, the policy determines if in stops being read or which target metrics
+// are dropped.
+func emitQueue(in <-chan TargetMetrics, size int, policy QueuePolicy) <-chan TargetMetrics {
+	out := make(chan TargetMetrics)
+	go func() {
+		defer close(out)
+		var queue []TargetMetrics
+		for in != nil || len(queue) > 0 {
+			var send chan<- TargetMetrics
+			var next TargetMetrics
+			if len(queue) > 0 {
+				send = out
+				next = queue[0]
+			}
+			recv := in
+			if len(queue) >= size && policy == QueueBlock {
+				recv = nil
+			}
+
+			select {
+			case pair, ok := <-recv:
+				if !ok {
+					in = nil
+					continue
+				}
+				if len(queue) < size {
+					queue = append(queue, pair)
+					break
+				}
+				if policy == QueueDropOldest {
+					dropped := queue[0]
+					queue[0] = TargetMetrics{}
+					queue = append(queue[1:], pair)
+					pair = dropped
+				}
+				ilog.WithField("target", pair.Target.Name).Debug("emit queue full, dropping target metrics")
+				emitQueueDroppedMetric.WithLabelValues(pair.Target.Name).Inc()
+				countDropped(pair.job(), dropReasonLimit, len(pair.Metrics))
+			case send <- next:
+				queue[0] = TargetMetrics{}
+				queue = queue[1:]
+			}
+			emitQueueLengthMetric.Set(float64(len(queue)))
+		}
+	}()
+	return out
+}
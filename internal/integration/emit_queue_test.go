@@ -0,0 +1,68 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// fillQueue sends n target metrics to a queue that is not read until all of
+// them are sent or the queue blocks, and returns the names of the received
+// targets and how many were sent.
+func fillQueue(n, size int, policy QueuePolicy) (received []string, sent int) {
+	in := make(chan TargetMetrics)
+	out := emitQueue(in, size, policy)
+
+	for ; sent < n; sent++ {
+		select {
+		case in <- TargetMetrics{Target: endpoints.Target{Name: fmt.Sprint(sent)}}:
+		case <-time.After(100 * time.Millisecond):
+			go func() {
+				// Unblock the sender after reading the queue.
+				for i := sent; i < n; i++ {
+					in <- TargetMetrics{Target: endpoints.Target{Name: fmt.Sprint(i)}}
+				}
+				close(in)
+			}()
+			for pair := range out {
+				received = append(received, pair.Target.Name)
+			}
+			return received, sent
+		}
+	}
+	close(in)
+	for pair := range out {
+		received = append(received, pair.Target.Name)
+	}
+	return received, sent
+}
+
+func TestEmitQueue(t *testing.T) {
+	received, sent := fillQueue(5, 2, QueueBlock)
+	assert.Equal(t, 2, sent, "scraping must block when the queue is full")
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, received)
+
+	received, sent = fillQueue(5, 2, QueueDropNewest)
+	assert.Equal(t, 5, sent)
+	assert.Equal(t, []string{"0", "1"}, received)
+
+	received, sent = fillQueue(5, 2, QueueDropOldest)
+	assert.Equal(t, 5, sent)
+	assert.Equal(t, []string{"3", "4"}, received)
+}
+
+func TestParseQueuePolicy(t *testing.T) {
+	p, err := ParseQueuePolicy("drop_oldest")
+	require.NoError(t, err)
+	assert.Equal(t, QueueDropOldest, p)
+
+	_, err = ParseQueuePolicy("drop_all")
+	assert.Error(t, err)
+}
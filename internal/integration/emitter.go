@@ -4,25 +4,36 @@
 package integration
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/newrelic/newrelic-telemetry-sdk-go/cumulative"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
 	"github.com/newrelic/nri-prometheus/internal/histogram"
 	"github.com/pkg/errors"
-	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	defaultDeltaExpirationAge           = 5 * time.Minute
 	defaultDeltaExpirationCheckInterval = 5 * time.Minute
+	// deltaExpirationScrapeIntervals is the number of scrape intervals a
+	// counter can go without being scraped before its delta entry expires.
+	deltaExpirationScrapeIntervals = 3
+	// staleHarvestTimeout is the time the metrics recorded into a recreated
+	// harvester have to be sent.
+	staleHarvestTimeout = 30 * time.Second
 )
 
 // Emitter is an interface representing the ability to emit metrics.
@@ -33,15 +44,89 @@ type Emitter interface {
 
 // TelemetryEmitter emits metrics using the go-telemetry-sdk.
 type TelemetryEmitter struct {
+	// recorded counts the metrics recorded since the last check of the
+	// harvester, and requests the requests sent by the harvester. They are
+	// first, so they're aligned for the atomic operations.
+	recorded uint64
+	requests *uint64
+	// rejectedMetrics counts the metrics of the payloads rejected as too
+	// large since they were last accounted to a job.
+	rejectedMetrics *uint64
+	// shedMetrics counts the metrics shed in degraded mode since they were
+	// last accounted to their job.
+	shedMetrics uint64
+
 	name            string
 	percentiles     []float64
-	harvester       *telemetry.Harvester
 	deltaCalculator *cumulative.DeltaCalculator
+
+	// harvesterMu protects the harvester, which is recreated when it stalls,
+	// with the same harvesterOpts, and stopHarvests, which stops its harvest
+	// routine. stalled is the number of consecutive checks it recorded
+	// metrics without sending any request.
+	harvesterMu   sync.RWMutex
+	harvester     *telemetry.Harvester
+	stopHarvests  context.CancelFunc
+	harvesterOpts []TelemetryHarvesterOpt
+	stalled       int
+
+	// encoder and encodedDeltaCalculator are used instead of the
+	// deltaCalculator when the attributes are pre-encoded. mu protects them
+	// and the mode of the current emission.
+	mu                     sync.Mutex
+	encoder                *attributesEncoder
+	encodedDeltaCalculator *encodedDeltaCalculator
+
+	// shedder is nil unless the load shedding is enabled. degraded and
+	// sampleGauges are the mode of the current emission.
+	shedder      *loadShedder
+	degraded     bool
+	sampleGauges bool
+	// shedCurrent is true if samples of the metric being emitted were shed.
+	shedCurrent bool
+	// cumulativeCounterPrefixes are the prefixes of the counters sent as
+	// gauges with their cumulative values.
+	cumulativeCounterPrefixes []string
+	// integerGaugePrefixes are the prefixes of the gauges sent with integer
+	// values.
+	integerGaugePrefixes []string
+
+	// disablePercentiles and disableBuckets skip those disabled stages.
+	disablePercentiles bool
+	disableBuckets     bool
+	percentileFormat   PercentileFormat
+	// counterRates sends the rates of the counters instead of their deltas.
+	counterRates bool
+	// counterCumulative sends the cumulative values of the counters,
+	// including the counts, sums and buckets of the histograms and
+	// summaries, as gauges instead of their deltas.
+	counterCumulative bool
+	// summaryCountAndSum sends the count and sum of the summaries besides
+	// their percentiles.
+	summaryCountAndSum bool
+	// histogramModes choose what is sent of the histograms, by name.
+	histogramModes []HistogramModeRule
+	// percentileEstimator estimates the percentiles of the histograms, with
+	// the relative accuracy of the DDSketch estimator.
+	percentileEstimator PercentileEstimator
+	percentileAccuracy  float64
+	// harvestFailing is 1 while the last request of the harvester failed.
+	// It's only tracked if the harvest errors are reported.
+	harvestFailing *int32
+	// rejections logs the reasons of the rejected requests, if enabled.
+	rejections *rejectionReporter
+	// deltaStateFile is where the delta state of the counters is persisted,
+	// if enabled. The values older than deltaStateMaxAge aren't restored.
+	deltaStateFile   string
+	deltaStateMaxAge time.Duration
 }
 
 // TelemetryEmitterConfig is the configuration required for the
 // `TelemetryEmitter`
 type TelemetryEmitterConfig struct {
+	// Name of the emitter, which labels its metrics. Defaults to telemetry.
+	Name string
+
 	// Percentile values to calculate for every Prometheus metrics of histogram type.
 	Percentiles []float64
 
@@ -50,11 +135,92 @@ type TelemetryEmitterConfig struct {
 
 	// DeltaExpirationAge sets the cumulative DeltaCalculator expiration age
 	// which determines how old an entry must be before it is considered for
-	// expiration. Defaults to 30s.
+	// expiration. Defaults to 5m, or 3 scrape intervals if longer.
 	DeltaExpirationAge time.Duration
 	// DeltaExpirationCheckInternval sets the cumulative DeltaCalculator
-	// duration between checking for expirations. Defaults to 30s.
+	// duration between checking for expirations. Defaults to 5m.
 	DeltaExpirationCheckInternval time.Duration
+	// ScrapeInterval is the largest interval between the scrapes of a
+	// target, the delta expiration age is extended to, so the counters of
+	// slow targets aren't expired between their scrapes.
+	ScrapeInterval time.Duration
+
+	// CommonAttributes are sent once per harvest, applying to all the
+	// metrics, instead of on every metric. The attributes of a metric take
+	// precedence over them.
+	CommonAttributes map[string]interface{}
+
+	// PreEncodeAttributes encodes the attributes of the metrics to JSON when
+	// they are emitted, with a faster encoder than the one of the harvester.
+	// The encoding is done once for the metrics derived from the same
+	// histogram or summary, and reused to calculate the deltas of counters.
+	PreEncodeAttributes bool
+
+	// LoadSheddingFailures is the number of consecutive failed requests to
+	// New Relic after which the emitter degrades: counters only keep their
+	// delta state and gauges are recorded for 1 in LoadSheddingGaugeSampleRate
+	// emissions, so metrics that can't be sent aren't buffered. The emitter
+	// recovers with the first successful request. Disabled if 0.
+	LoadSheddingFailures        int
+	LoadSheddingGaugeSampleRate int
+
+	// SuccessRatios records the result of the harvest requests, if set.
+	SuccessRatios *SuccessRatios
+
+	// CumulativeCounterPrefixes are the prefixes of the counters sent with
+	// their cumulative values, as gauges, instead of their deltas. They
+	// bypass the DeltaCalculator, so they don't keep any state. An empty
+	// prefix matches all the counters.
+	CumulativeCounterPrefixes []string
+	// IntegerGaugePrefixes are the prefixes of the gauges, including the
+	// cumulative counters, whose integer values are sent without decimals
+	// nor exponent and flagged with an integer attribute set to true.
+	IntegerGaugePrefixes []string
+	// DisablePercentiles skips the percentiles of histograms and summaries,
+	// and DisableBuckets the bucket counts of histograms.
+	DisablePercentiles bool
+	DisableBuckets     bool
+	// PercentileFormat is the type of the percentile attribute, numeric by
+	// default.
+	PercentileFormat PercentileFormat
+	// ReportHarvestErrors makes Emit return an error, after recording the
+	// metrics, while the last request of the harvester failed, so a
+	// FailoverEmitter falls back from it during Metric API outages. The
+	// metrics are still recorded, so the harvester keeps probing the API.
+	ReportHarvestErrors bool
+	// Spool writes the requests that fail to disk, to replay them once the
+	// emission succeeds again, if its directory is set.
+	Spool SpoolConfig
+	// RejectionDetails parses the error responses of the Metric API, counting
+	// them by reason and logging the reasons, with samples of the rejected
+	// metrics and attributes, at the end of every harvest.
+	RejectionDetails bool
+	// DeltaStateDir persists the last values of the counters to a file of
+	// the emitter in the directory, after every harvest, and restores them
+	// on creation, so their deltas aren't lost on restarts. It implies
+	// PreEncodeAttributes. Disabled if empty.
+	DeltaStateDir string
+	// DeltaStateMaxAge is the age of the oldest values restored, as the
+	// deltas of the older ones would span the whole downtime. Defaults to
+	// 10 minutes.
+	DeltaStateMaxAge time.Duration
+	// CounterOutput is how the counters are sent, as deltas by default. The
+	// cumulative output sends them all as CumulativeCounterPrefixes would,
+	// and also the counts, sums and buckets of the histograms and summaries.
+	CounterOutput CounterOutput
+	// SummaryCountAndSum sends the count and the sum of the summaries as
+	// the <name>.count and <name>.sum counters, besides their percentiles,
+	// so their averages can be calculated as for the histograms.
+	SummaryCountAndSum bool
+	// HistogramModes choose whether the buckets, the percentiles, both, only
+	// the count and sum, or nothing is sent of the histograms, by the first
+	// rule matching their name. Both are sent if no rule matches.
+	HistogramModes []HistogramModeRule
+	// PercentileEstimator estimates the percentiles of the histograms,
+	// linear by default. PercentileRelativeAccuracy is the one of the
+	// DDSketch estimator, 1% if 0.
+	PercentileEstimator        PercentileEstimator
+	PercentileRelativeAccuracy float64
 }
 
 // TelemetryHarvesterOpt sets configuration options for the
@@ -142,41 +308,153 @@ func TelemetryHarvesterWithProxy(proxyURL *url.URL) TelemetryHarvesterOpt {
 	}
 }
 
+// deltaExpiration returns the expiration age and check interval of the
+// delta entries of the counters. Unless configured, the age is the default
+// one, extended for the scrape intervals too long for it, so a counter is
+// only expired after missing a few scrapes.
+func deltaExpiration(cfg TelemetryEmitterConfig) (age, checkInterval time.Duration) {
+	age, checkInterval = defaultDeltaExpirationAge, defaultDeltaExpirationCheckInterval
+	if scrapes := deltaExpirationScrapeIntervals * cfg.ScrapeInterval; scrapes > age {
+		age = scrapes
+	}
+	if cfg.DeltaExpirationAge != 0 {
+		age = cfg.DeltaExpirationAge
+	}
+	if cfg.DeltaExpirationCheckInternval != 0 {
+		checkInterval = cfg.DeltaExpirationCheckInternval
+	}
+	return age, checkInterval
+}
+
 // NewTelemetryEmitter returns a new TelemetryEmitter.
 func NewTelemetryEmitter(cfg TelemetryEmitterConfig) (*TelemetryEmitter, error) {
 	dc := cumulative.NewDeltaCalculator()
 
-	deltaExpirationAge := defaultDeltaExpirationAge
-	if cfg.DeltaExpirationAge != 0 {
-		deltaExpirationAge = cfg.DeltaExpirationAge
-	}
+	deltaExpirationAge, deltaExpirationCheckInterval := deltaExpiration(cfg)
 	dc.SetExpirationAge(deltaExpirationAge)
 	logrus.Debugf(
 		"telemetry emitter configured with delta counter expiration age: %s",
 		deltaExpirationAge,
 	)
 
-	deltaExpirationCheckInterval := defaultDeltaExpirationCheckInterval
-	if cfg.DeltaExpirationCheckInternval != 0 {
-		deltaExpirationCheckInterval = cfg.DeltaExpirationCheckInternval
-	}
 	dc.SetExpirationCheckInterval(deltaExpirationCheckInterval)
 	logrus.Debugf(
 		"telemetry emitter configured with delta counter expiration check interval: %s",
 		deltaExpirationCheckInterval,
 	)
 
-	harvester, err := telemetry.NewHarvester(cfg.HarvesterOpts...)
+	name := "telemetry"
+	if cfg.Name != "" {
+		name = cfg.Name
+	}
+
+	harvesterOpts := cfg.HarvesterOpts[:len(cfg.HarvesterOpts):len(cfg.HarvesterOpts)]
+	if len(cfg.CommonAttributes) > 0 {
+		harvesterOpts = append(harvesterOpts, telemetry.ConfigCommonAttributes(cfg.CommonAttributes))
+	}
+	var shedder *loadShedder
+	if cfg.LoadSheddingFailures > 0 {
+		shedder = newLoadShedder(name, cfg.LoadSheddingFailures, cfg.LoadSheddingGaugeSampleRate)
+		harvesterOpts = append(harvesterOpts, shedder.harvesterOpt())
+	}
+	if cfg.SuccessRatios != nil {
+		harvesterOpts = append(harvesterOpts, cfg.SuccessRatios.harvesterOpt())
+	}
+	if len(cfg.IntegerGaugePrefixes) > 0 {
+		harvesterOpts = append(harvesterOpts, integerValuesHarvesterOpt())
+	}
+	var harvestFailing *int32
+	if cfg.ReportHarvestErrors {
+		harvestFailing = new(int32)
+		harvesterOpts = append(harvesterOpts, trackHarvesterRequests(func(failed bool) {
+			var v int32
+			if failed {
+				v = 1
+			}
+			atomic.StoreInt32(harvestFailing, v)
+		}))
+	}
+	harvesterOpts = append(harvesterOpts, countSentBytes(name))
+	rejectedMetrics := new(uint64)
+	harvesterOpts = append(harvesterOpts, countRejectedMetrics(rejectedMetrics))
+	requests := new(uint64)
+	harvesterOpts = append(harvesterOpts, trackHarvesterRequests(func(failed bool) {
+		atomic.AddUint64(requests, 1)
+		countRequest(name, failed)
+	}))
+	var rejections *rejectionReporter
+	if cfg.RejectionDetails {
+		rejections = newRejectionReporter(name)
+		harvesterOpts = append(harvesterOpts, rejections.harvesterOpt())
+	}
+	if cfg.Spool.Dir != "" {
+		spool, err := newSpool(name, cfg.Spool)
+		if err != nil {
+			return nil, err
+		}
+		// Last, so the request trackers see the failed requests.
+		harvesterOpts = append(harvesterOpts, spool.harvesterOpt())
+	}
+	harvester, stopHarvests, err := newHarvester(harvesterOpts)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create new Harvester")
 	}
 
-	return &TelemetryEmitter{
-		name:            "telemetry",
+	te := &TelemetryEmitter{
+		requests:        requests,
+		name:            name,
 		harvester:       harvester,
+		stopHarvests:    stopHarvests,
+		harvesterOpts:   harvesterOpts,
 		percentiles:     cfg.Percentiles,
 		deltaCalculator: dc,
-	}, nil
+		shedder:         shedder,
+		sampleGauges:    true,
+
+		cumulativeCounterPrefixes: cfg.CumulativeCounterPrefixes,
+		integerGaugePrefixes:      cfg.IntegerGaugePrefixes,
+		disablePercentiles:        cfg.DisablePercentiles,
+		percentileFormat:          cfg.PercentileFormat,
+		counterRates:              cfg.CounterOutput == CounterOutputRate,
+		counterCumulative:         cfg.CounterOutput == CounterOutputCumulative,
+		summaryCountAndSum:        cfg.SummaryCountAndSum,
+		histogramModes:            cfg.HistogramModes,
+		percentileEstimator:       cfg.PercentileEstimator,
+		percentileAccuracy:        cfg.PercentileRelativeAccuracy,
+		disableBuckets:            cfg.DisableBuckets,
+		harvestFailing:            harvestFailing,
+		rejections:                rejections,
+		rejectedMetrics:           rejectedMetrics,
+	}
+	if cfg.CounterOutput == CounterOutputCumulative {
+		te.cumulativeCounterPrefixes = []string{""}
+	}
+	if cfg.PreEncodeAttributes || cfg.DeltaStateDir != "" {
+		te.encoder = &attributesEncoder{}
+		te.encodedDeltaCalculator = newEncodedDeltaCalculator(deltaExpirationAge, deltaExpirationCheckInterval)
+	}
+	if cfg.DeltaStateDir != "" {
+		te.deltaStateFile = deltaStateFile(cfg.DeltaStateDir, name)
+		te.deltaStateMaxAge = cfg.DeltaStateMaxAge
+		if te.deltaStateMaxAge == 0 {
+			te.deltaStateMaxAge = defaultDeltaStateMaxAge
+		}
+		te.restoreDeltaState()
+	}
+	return te, nil
+}
+
+// endHarvest logs the requests rejected since the last harvest, and saves
+// the delta state of the counters, if enabled.
+func (te *TelemetryEmitter) endHarvest() {
+	if te.rejections != nil {
+		te.rejections.flush()
+	}
+	if te.deltaStateFile != "" {
+		// Saved every harvest, so the deltas recorded since the last save
+		// aren't sent again after a crash.
+		te.writeDeltaState(time.Now())
+	}
 }
 
 // Name returns the emitter name.
@@ -189,30 +467,40 @@ func (te *TelemetryEmitter) Name() string {
 func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 	var results error
 
+	if te.encoder != nil || te.shedder != nil {
+		te.mu.Lock()
+		defer te.mu.Unlock()
+	}
+	if te.shedder != nil {
+		te.degraded, te.sampleGauges = te.shedder.startEmit()
+	}
+
 	// Record metrics at a uniform time so processing is not reflected in
 	// the measurement that already took place.
 	now := time.Now()
+	var failed int
+	var shed uint64
 	for _, metric := range metrics {
+		if te.shedCurrent {
+			shed++
+			te.shedCurrent = false
+		}
+		timestamp := now
+		if !metric.timestamp.IsZero() {
+			timestamp = metric.timestamp
+		}
 		switch metric.metricType {
 		case metricType_GAUGE:
-			te.harvester.RecordMetric(telemetry.Gauge{
-				Name:       metric.name,
-				Attributes: metric.attributes,
-				Value:      metric.value.(float64),
-				Timestamp:  now,
-			})
+			te.recordGauge(metric.name, te.gaugeAttributes(metric.name, metric.attributes, metric.value), "", 0, metric.value, timestamp)
 		case metricType_COUNTER:
-			m, ok := te.deltaCalculator.CountMetric(
-				metric.name,
-				metric.attributes,
-				metric.value.(float64),
-				now,
-			)
-			if ok {
-				te.harvester.RecordMetric(m)
+			if te.isCumulative(metric.name) {
+				te.recordGauge(metric.name, te.gaugeAttributes(metric.name, metric.attributes, metric.value), "", 0, metric.value, timestamp)
+				continue
 			}
+			te.recordCount(metric.name, metric.attributes, "", 0, metric.value, timestamp)
 		case metricType_SUMMARY:
-			if err := te.emitSummary(metric, now); err != nil {
+			if err := te.emitSummary(metric, timestamp); err != nil {
+				failed++
 				if results == nil {
 					results = err
 				} else {
@@ -220,7 +508,8 @@ func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 				}
 			}
 		case metricType_HISTOGRAM:
-			if err := te.emitHistogram(metric, now); err != nil {
+			if err := te.emitHistogram(metric, timestamp); err != nil {
+				failed++
 				if results == nil {
 					results = err
 				} else {
@@ -229,6 +518,7 @@ func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 			}
 		default:
 			if err := fmt.Errorf("unknown metric type %q", metric.metricType); err != nil {
+				failed++
 				if results == nil {
 					results = err
 				} else {
@@ -237,17 +527,37 @@ func (te *TelemetryEmitter) Emit(metrics []Metric) error {
 			}
 		}
 	}
-	return results
+	if te.shedCurrent {
+		shed++
+		te.shedCurrent = false
+	}
+	atomic.AddUint64(&te.shedMetrics, shed)
+	if results != nil {
+		return &conversionError{err: results, metrics: failed}
+	}
+	if te.harvestFailing != nil && atomic.LoadInt32(te.harvestFailing) == 1 {
+		return errHarvestFailing
+	}
+	return nil
 }
 
-// emitSummary sends all quantiles included with the summary as percentiles to New Relic.
+// emitSummary sends all quantiles included with the summary as percentiles to New Relic,
+// and its count and sum as delta counters if enabled.
 //
 // Related specification:
 // https://github.com/newrelic/newrelic-exporter-specs/blob/master/Guidelines.md#percentiles
 func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) error {
-	summary, ok := metric.value.(*dto.Summary)
-	if !ok {
-		return fmt.Errorf("unknown summary metric type for %q: %T", metric.name, metric.value)
+	summary := metric.summary
+	if summary == nil {
+		return fmt.Errorf("missing summary value for %q", metric.name)
+	}
+
+	if te.summaryCountAndSum {
+		te.recordCount(metric.name+".count", metric.attributes, "", 0, float64(summary.GetSampleCount()), timestamp)
+		te.recordCount(metric.name+".sum", metric.attributes, "", 0, summary.GetSampleSum(), timestamp)
+	}
+	if te.disablePercentiles {
+		return nil
 	}
 
 	var results error
@@ -266,43 +576,42 @@ func (te *TelemetryEmitter) emitSummary(metric Metric, timestamp time.Time) erro
 			continue
 		}
 
-		percentileAttrs := copyAttrs(metric.attributes)
-		percentileAttrs["percentile"] = p
-		te.harvester.RecordMetric(telemetry.Gauge{
-			Name:       metricName,
-			Attributes: percentileAttrs,
-			Value:      q.GetValue(),
-			Timestamp:  timestamp,
-		})
+		te.recordPercentile(metricName, metric.attributes, p, q.GetValue(), timestamp)
 	}
 	return results
 }
 
-// emitHistogram sends histogram data and curated percentiles to New Relic.
+// emitHistogram sends histogram data and curated percentiles to New Relic, as
+// chosen by the histogram mode of the metric.
 //
 // Related specification:
 // https://github.com/newrelic/newrelic-exporter-specs/blob/master/Guidelines.md#histograms
 func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) error {
-	hist, ok := metric.value.(*dto.Histogram)
-	if !ok {
-		return fmt.Errorf("unknown histogram metric type for %q: %T", metric.name, metric.value)
+	hist := metric.histogram
+	if hist == nil {
+		return fmt.Errorf("missing histogram value for %q", metric.name)
 	}
 
-	if m, ok := te.deltaCalculator.CountMetric(metric.name+".sum", metric.attributes, hist.GetSampleSum(), timestamp); ok {
-		te.harvester.RecordMetric(m)
+	mode := te.histogramMode(metric.name)
+	if mode == HistogramModeDrop {
+		return nil
+	}
+	te.recordCount(metric.name+".sum", metric.attributes, "", 0, hist.GetSampleSum(), timestamp)
+	if mode == HistogramModePercentiles || mode == HistogramModeSummary {
+		te.recordCount(metric.name+".count", metric.attributes, "", 0, float64(hist.GetSampleCount()), timestamp)
+	}
+	if mode == HistogramModeSummary {
+		return nil
 	}
 
+	sendBuckets := !te.disableBuckets && mode != HistogramModePercentiles
 	metricName := metric.name + ".buckets"
 	buckets := make(histogram.Buckets, 0, len(hist.Bucket))
 	for _, b := range hist.GetBucket() {
 		upperBound := b.GetUpperBound()
 		count := float64(b.GetCumulativeCount())
-		if !math.IsInf(upperBound, 1) {
-			bucketAttrs := copyAttrs(metric.attributes)
-			bucketAttrs["histogram.bucket.upperBound"] = upperBound
-			if m, ok := te.deltaCalculator.CountMetric(metricName, bucketAttrs, count, timestamp); ok {
-				te.harvester.RecordMetric(m)
-			}
+		if !math.IsInf(upperBound, 1) && sendBuckets {
+			te.recordCount(metricName, metric.attributes, "histogram.bucket.upperBound", upperBound, count, timestamp)
 		}
 		buckets = append(
 			buckets,
@@ -313,10 +622,15 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 		)
 	}
 
+	if te.disablePercentiles || mode == HistogramModeBuckets {
+		return nil
+	}
+
+	estimate := te.percentileEstimates(buckets)
 	var results error
 	metricName = metric.name + ".percentiles"
 	for _, p := range te.percentiles {
-		v, err := histogram.Percentile(p, buckets)
+		v, err := estimate(p)
 		if err != nil {
 			if results == nil {
 				results = err
@@ -326,19 +640,177 @@ func (te *TelemetryEmitter) emitHistogram(metric Metric, timestamp time.Time) er
 			continue
 		}
 
-		percentileAttrs := copyAttrs(metric.attributes)
-		percentileAttrs["percentile"] = p
-		te.harvester.RecordMetric(telemetry.Gauge{
-			Name:       metricName,
-			Attributes: percentileAttrs,
-			Value:      v,
-			Timestamp:  timestamp,
-		})
+		te.recordPercentile(metricName, metric.attributes, p, v, timestamp)
 	}
 
 	return results
 }
 
+// isCumulative returns true if the counter is sent with its cumulative
+// value.
+func (te *TelemetryEmitter) isCumulative(name string) bool {
+	for _, prefix := range te.cumulativeCounterPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordGauge records a gauge with the attributes, plus extraKey set to
+// extraValue if extraKey is not empty.
+func (te *TelemetryEmitter) recordGauge(name string, attrs map[string]interface{}, extraKey string, extraValue, value float64, timestamp time.Time) {
+	if !te.sampleGauges {
+		te.shedder.shed(metricType_GAUGE)
+		te.shedCurrent = true
+		return
+	}
+	gauge := telemetry.Gauge{
+		Name:      name,
+		Value:     value,
+		Timestamp: timestamp,
+	}
+	if te.encoder != nil {
+		gauge.AttributesJSON = te.encoder.encode(attrs, extraKey, extraValue)
+	} else {
+		gauge.Attributes = withExtraAttribute(attrs, extraKey, extraValue)
+	}
+	te.recordMetric(gauge)
+}
+
+// recordCount records the delta of the cumulative value with the attributes,
+// plus extraKey set to extraValue if extraKey is not empty. With the
+// cumulative counter output, the cumulative value is recorded as a gauge.
+func (te *TelemetryEmitter) recordCount(name string, attrs map[string]interface{}, extraKey string, extraValue, value float64, timestamp time.Time) {
+	if te.counterCumulative {
+		te.recordGauge(name, attrs, extraKey, extraValue, value, timestamp)
+		return
+	}
+	var m telemetry.Count
+	var ok bool
+	if te.encoder != nil {
+		attributesJSON := te.encoder.encode(attrs, extraKey, extraValue)
+		m, ok = te.encodedDeltaCalculator.countMetric(name, attributesJSON, value, timestamp)
+	} else {
+		m, ok = te.deltaCalculator.CountMetric(name, withExtraAttribute(attrs, extraKey, extraValue), value, timestamp)
+	}
+	if te.degraded {
+		te.shedder.shed(metricType_COUNTER)
+		te.shedCurrent = true
+		return
+	}
+	switch {
+	case ok && te.counterRates:
+		te.recordMetric(rateGauge(m))
+	case ok:
+		te.recordMetric(m)
+	}
+}
+
+// recordMetric records the metric into the current harvester.
+func (te *TelemetryEmitter) recordMetric(m telemetry.Metric) {
+	atomic.AddUint64(&te.recorded, 1)
+	te.harvesterMu.RLock()
+	te.harvester.RecordMetric(m)
+	te.harvesterMu.RUnlock()
+}
+
+// stalledHarvests checks whether the harvester sent any request since the
+// last check, returning the number of consecutive checks it recorded
+// metrics without sending any. The checks without recorded metrics don't
+// count.
+func (te *TelemetryEmitter) stalledHarvests() int {
+	recorded := atomic.SwapUint64(&te.recorded, 0)
+	requests := atomic.SwapUint64(te.requests, 0)
+	switch {
+	case requests > 0:
+		te.stalled = 0
+	case recorded > 0:
+		te.stalled++
+	}
+	return te.stalled
+}
+
+// recreateHarvester replaces the harvester with a new one, and stops the
+// harvest routine of the old one. The metrics recorded into the old one are
+// harvested once more in the background.
+func (te *TelemetryEmitter) recreateHarvester() error {
+	harvester, stopHarvests, err := newHarvester(te.harvesterOpts)
+	if err != nil {
+		return errors.Wrap(err, "could not create new Harvester")
+	}
+	te.harvesterMu.Lock()
+	old, stopOld := te.harvester, te.stopHarvests
+	te.harvester, te.stopHarvests = harvester, stopHarvests
+	te.harvesterMu.Unlock()
+	stopOld()
+	te.stalled = 0
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), staleHarvestTimeout)
+		defer cancel()
+		old.HarvestNow(ctx)
+	}()
+	return nil
+}
+
+// newHarvester returns a harvester of the options whose harvests are sent by
+// a routine stopped by the returned function, unlike the routine of the
+// harvester itself, which runs forever.
+func newHarvester(opts []TelemetryHarvesterOpt) (*telemetry.Harvester, context.CancelFunc, error) {
+	var period time.Duration
+	opts = append(opts[:len(opts):len(opts)], func(cfg *telemetry.Config) {
+		// The harvester doesn't start its routine without a period.
+		period, cfg.HarvestPeriod = cfg.HarvestPeriod, 0
+	})
+	harvester, err := telemetry.NewHarvester(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if period > 0 {
+		go harvestRoutine(ctx, harvester, period)
+	}
+	return harvester, cancel, nil
+}
+
+// harvestRoutine harvests the harvester every period until the context is
+// done, after a random delay of up to 3 seconds, so the harvests of the
+// harvesters started at once are spread, like the routine of the harvester.
+// The harvests in progress when it's done aren't canceled.
+func harvestRoutine(ctx context.Context, harvester *telemetry.Harvester, period time.Duration) {
+	jitter := period
+	if jitter > 3*time.Second {
+		jitter = 3 * time.Second
+	}
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+	}
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			go harvester.HarvestNow(context.Background())
+		}
+	}
+}
+
+// withExtraAttribute returns the attributes, or a copy of them with extraKey
+// set to extraValue if extraKey is not empty.
+func withExtraAttribute(attrs map[string]interface{}, extraKey string, extraValue float64) map[string]interface{} {
+	if extraKey == "" {
+		return attrs
+	}
+	attrs = copyAttrs(attrs)
+	attrs[extraKey] = extraValue
+	return attrs
+}
+
 // copyAttrs returns a (shallow) copy of the passed attrs.
 func copyAttrs(attrs map[string]interface{}) map[string]interface{} {
 	duplicate := make(map[string]interface{}, len(attrs))
@@ -350,27 +822,49 @@ func copyAttrs(attrs map[string]interface{}) map[string]interface{} {
 
 // StdoutEmitter emits metrics to stdout.
 type StdoutEmitter struct {
-	name string
+	name   string
+	format string
+	now    func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
 }
 
-// NewStdoutEmitter returns a NewStdoutEmitter.
+// NewStdoutEmitter returns a NewStdoutEmitter writing the json format.
 func NewStdoutEmitter() *StdoutEmitter {
 	return &StdoutEmitter{
-		name: "stdout",
+		name:   "stdout",
+		format: StdoutFormatJSON,
+		now:    time.Now,
+		w:      os.Stdout,
 	}
 }
 
+// NewStdoutEmitterWithFormat returns a StdoutEmitter writing the format:
+// json, ndjson, pretty or prom-text. Defaults to json.
+func NewStdoutEmitterWithFormat(format string) (*StdoutEmitter, error) {
+	if err := ValidateStdoutFormat(format); err != nil {
+		return nil, err
+	}
+	se := NewStdoutEmitter()
+	if format != "" {
+		se.format = format
+	}
+	return se, nil
+}
+
 // Name is the StdoutEmitter name.
 func (se *StdoutEmitter) Name() string {
 	return se.name
 }
 
-// Emit prints the metrics into stdout.
+// Emit prints the metrics into stdout. The emissions are written whole, so
+// concurrent ones don't interleave their lines.
 func (se *StdoutEmitter) Emit(metrics []Metric) error {
-	b, err := json.Marshal(metrics)
-	if err != nil {
-		return err
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if se.format == StdoutFormatPromText {
+		return writePromText(se.w, metrics)
 	}
-	fmt.Println(string(b))
-	return nil
+	return writeRecords(se.w, metrics, se.now(), se.format)
 }
@@ -17,6 +17,7 @@ import (
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	dto "github.com/prometheus/client_model/go"
@@ -31,6 +32,15 @@ import (
 )
 
 func BenchmarkTelemetrySDKEmitter(b *testing.B) {
+	b.Run("attributes", func(b *testing.B) {
+		benchmarkTelemetrySDKEmitter(b, false)
+	})
+	b.Run("pre-encoded attributes", func(b *testing.B) {
+		benchmarkTelemetrySDKEmitter(b, true)
+	})
+}
+
+func benchmarkTelemetrySDKEmitter(b *testing.B, preEncodeAttributes bool) {
 	contents, err := ioutil.ReadFile("test/cadvisor.txt")
 	cachedFile := bytes.NewBuffer(contents)
 	assert.NoError(b, err)
@@ -41,7 +51,7 @@ func BenchmarkTelemetrySDKEmitter(b *testing.B) {
 	assert.NoError(b, err)
 	assert.NotNil(b, mfByName)
 
-	cachedMetrics := convertPromMetrics(nil, "fakeTarget", *mfByName)
+	cachedMetrics := convertPromMetrics(nil, "fakeTarget", *mfByName, 0)
 	b.Logf("Number of metrics in sample: %d", len(cachedMetrics))
 
 	multiplyFactor := 20
@@ -63,6 +73,7 @@ func BenchmarkTelemetrySDKEmitter(b *testing.B) {
 			TelemetryHarvesterWithMetricsURL("nilapiurl"),
 			telemetry.ConfigBasicErrorLogger(os.Stdout),
 		},
+		PreEncodeAttributes: preEncodeAttributes,
 	}
 
 	b.ReportAllocs()
@@ -118,6 +129,15 @@ func decodePromMetrics(src io.Reader) (*prometheus.MetricFamiliesByName, error)
 }
 
 func TestTelemetryEmitterEmit(t *testing.T) {
+	t.Run("attributes", func(t *testing.T) {
+		testTelemetryEmitterEmit(t, false)
+	})
+	t.Run("pre-encoded attributes", func(t *testing.T) {
+		testTelemetryEmitterEmit(t, true)
+	})
+}
+
+func testTelemetryEmitterEmit(t *testing.T, preEncodeAttributes bool) {
 	hist, err := newHistogram([]int64{0, 0, 0})
 	if err != nil {
 		t.Fatal(err)
@@ -165,7 +185,7 @@ func TestTelemetryEmitterEmit(t *testing.T) {
 		{
 			name:       "histogram-1",
 			metricType: metricType_HISTOGRAM,
-			value:      hist,
+			histogram:  hist,
 			attributes: labels.Set{
 				"name":           "histogram-1",
 				"targetName":     "target-d",
@@ -176,7 +196,7 @@ func TestTelemetryEmitterEmit(t *testing.T) {
 		{
 			name:       "summary-1",
 			metricType: metricType_SUMMARY,
-			value:      summary,
+			summary:    summary,
 			attributes: labels.Set{},
 		},
 	}
@@ -216,7 +236,8 @@ func TestTelemetryEmitterEmit(t *testing.T) {
 			},
 			telemetry.ConfigBasicErrorLogger(os.Stdout),
 		},
-		Percentiles: []float64{50.0},
+		Percentiles:         []float64{50.0},
+		PreEncodeAttributes: preEncodeAttributes,
 	}
 
 	e, err := NewTelemetryEmitter(c)
@@ -414,6 +435,44 @@ func purgeTimestamps(metrics []interface{}) {
 	}
 }
 
+func TestTelemetryEmitterCommonAttributes(t *testing.T) {
+	var payload []map[string]interface{}
+	c := TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					reader, err := gzip.NewReader(req.Body)
+					require.NoError(t, err)
+					require.NoError(t, json.NewDecoder(reader).Decode(&payload))
+					return emptyResponse(200), nil
+				})
+			},
+		},
+		CommonAttributes: map[string]interface{}{"clusterName": "cluster-a"},
+	}
+	e, err := NewTelemetryEmitter(c)
+	require.NoError(t, err)
+
+	require.NoError(t, e.Emit([]Metric{{
+		name:       "gauge-1",
+		metricType: metricType_GAUGE,
+		value:      float64(1),
+		attributes: labels.Set{"targetName": "target-a"},
+	}}))
+	e.harvester.HarvestNow(context.Background())
+
+	require.Len(t, payload, 1)
+	common, ok := payload[0]["common"].(map[string]interface{})
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"clusterName": "cluster-a"}, common["attributes"])
+	metrics, ok := payload[0]["metrics"].([]interface{})
+	require.True(t, ok)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, map[string]interface{}{"targetName": "target-a"}, metrics[0].(map[string]interface{})["attributes"])
+}
+
 func TestTelemetryHarvesterWithTLSConfig(t *testing.T) {
 	tlsConfig := &tls.Config{InsecureSkipVerify: true}
 	cfg := &telemetry.Config{Client: &http.Client{}}
@@ -442,3 +501,55 @@ func TestTelemetryHarvesterWithProxy(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, proxyURL, actualProxyURL)
 }
+
+func TestDeltaExpiration(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           TelemetryEmitterConfig
+		age, interval time.Duration
+	}{
+		{"defaults", TelemetryEmitterConfig{}, defaultDeltaExpirationAge, defaultDeltaExpirationCheckInterval},
+		{"default scrape interval", TelemetryEmitterConfig{ScrapeInterval: 30 * time.Second}, 5 * time.Minute, 5 * time.Minute},
+		{"extended for the scrape interval", TelemetryEmitterConfig{ScrapeInterval: 10 * time.Minute}, 30 * time.Minute, 5 * time.Minute},
+		{"overridden", TelemetryEmitterConfig{ScrapeInterval: 10 * time.Minute, DeltaExpirationAge: time.Hour}, time.Hour, 5 * time.Minute},
+		{"both overridden", TelemetryEmitterConfig{ScrapeInterval: time.Minute, DeltaExpirationAge: time.Hour, DeltaExpirationCheckInternval: time.Second}, time.Hour, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			age, interval := deltaExpiration(tt.cfg)
+			assert.Equal(t, tt.age, age)
+			assert.Equal(t, tt.interval, interval)
+		})
+	}
+}
+
+func TestTelemetryEmitter_SummaryCountAndSum(t *testing.T) {
+	var sent []map[string]interface{}
+	e := counterOutputEmitter(t, CounterOutputDelta, &sent)
+	e.summaryCountAndSum = true
+	e.disablePercentiles = true
+
+	summary := func(count uint64, sum float64, timestamp time.Time) []Metric {
+		s, err := newSummary(count, sum, []*quantile{{0.5, 10}})
+		require.NoError(t, err)
+		return []Metric{{
+			name:       "latency",
+			metricType: metricType_SUMMARY,
+			summary:    s,
+			attributes: labels.Set{"path": "/"},
+			timestamp:  timestamp,
+		}}
+	}
+
+	start := time.Now().Add(-time.Minute)
+	require.NoError(t, e.Emit(summary(3, 10, start)))
+	require.NoError(t, e.Emit(summary(5, 16, start.Add(30*time.Second))))
+	e.harvester.HarvestNow(context.Background())
+
+	values := map[string]interface{}{}
+	for _, m := range sent {
+		assert.Equal(t, "count", m["type"])
+		values[m["name"].(string)] = m["value"]
+	}
+	assert.Equal(t, map[string]interface{}{"latency.count": 2.0, "latency.sum": 6.0}, values)
+}
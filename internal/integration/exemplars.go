@@ -0,0 +1,102 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// exemplarRetention is how long an exemplar is remembered after it was last
+// scraped.
+const exemplarRetention = 10 * time.Minute
+
+// exemplarTracker remembers the exemplars scraped from every target, so
+// each exemplar is only emitted once. The targets expose the last exemplar
+// of a sample until a new one is recorded, so it would otherwise be
+// emitted again by every scrape.
+type exemplarTracker struct {
+	mu sync.Mutex
+	// seen is when the exemplars were last scraped, by target and
+	// exemplar, and swept when the ones past the retention were last
+	// forgotten.
+	seen  map[string]map[string]time.Time
+	swept time.Time
+}
+
+func newExemplarTracker() *exemplarTracker {
+	return &exemplarTracker{seen: map[string]map[string]time.Time{}}
+}
+
+// dropSeen removes the exemplars already scraped from the target from the
+// exemplar families. The families left without exemplars are removed.
+func (et *exemplarTracker) dropSeen(target string, mfs prometheus.MetricFamiliesByName, now time.Time) {
+	if et == nil {
+		return
+	}
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	seen, ok := et.seen[target]
+	if !ok {
+		seen = map[string]time.Time{}
+		et.seen[target] = seen
+	}
+	for name, mf := range mfs {
+		if mf.GetHelp() != prometheus.ExemplarHelp {
+			continue
+		}
+		fresh := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			key := exemplarKey(name, m)
+			if _, ok := seen[key]; !ok {
+				fresh = append(fresh, m)
+			}
+			seen[key] = now
+		}
+		if len(fresh) == 0 {
+			delete(mfs, name)
+			continue
+		}
+		mf.Metric = fresh
+		mfs[name] = mf
+	}
+	if now.Sub(et.swept) > exemplarRetention {
+		et.sweep(now)
+	}
+}
+
+// sweep forgets the exemplars not scraped within the retention, including
+// the ones of the targets no longer scraped. It's called with the lock held.
+func (et *exemplarTracker) sweep(now time.Time) {
+	for target, seen := range et.seen {
+		for key, at := range seen {
+			if now.Sub(at) > exemplarRetention {
+				delete(seen, key)
+			}
+		}
+		if len(seen) == 0 {
+			delete(et.seen, target)
+		}
+	}
+	et.swept = now
+}
+
+// exemplarKey identifies an exemplar by its series, its value and its
+// timestamp.
+func exemplarKey(name string, m *io_prometheus_client.Metric) string {
+	pairs := make([]string, 0, len(m.GetLabel()))
+	for _, l := range m.GetLabel() {
+		pairs = append(pairs, l.GetName()+"="+strconv.Quote(l.GetValue()))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}" +
+		strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64) + "@" + strconv.FormatInt(m.GetTimestampMs(), 10)
+}
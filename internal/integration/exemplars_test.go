@@ -0,0 +1,64 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func TestExemplarTracker_DropSeen(t *testing.T) {
+	exemplar := func(bucket, traceID string, value float64, timestamp int64) *dto.Metric {
+		labelPair := func(name, value string) *dto.LabelPair { return &dto.LabelPair{Name: &name, Value: &value} }
+		return &dto.Metric{
+			Label:       []*dto.LabelPair{labelPair("le", bucket), labelPair("trace_id", traceID)},
+			Gauge:       &dto.Gauge{Value: &value},
+			TimestampMs: &timestamp,
+		}
+	}
+	scrape := func(exemplars ...*dto.Metric) prometheus.MetricFamiliesByName {
+		help, gauge := prometheus.ExemplarHelp, dto.MetricType_GAUGE
+		counterHelp, counter := "Requests", dto.MetricType_COUNTER
+		return prometheus.MetricFamiliesByName{
+			"duration_bucket_exemplar": dto.MetricFamily{Help: &help, Type: &gauge, Metric: exemplars},
+			"requests_total":           dto.MetricFamily{Help: &counterHelp, Type: &counter, Metric: []*dto.Metric{{}}},
+		}
+	}
+	traces := func(mfs prometheus.MetricFamiliesByName) []string {
+		var ids []string
+		mf := mfs["duration_bucket_exemplar"]
+		for _, m := range mf.Metric {
+			ids = append(ids, m.Label[1].GetValue())
+		}
+		return ids
+	}
+
+	et := newExemplarTracker()
+	now := time.Unix(1600000000, 0)
+	mfs := scrape(exemplar("0.1", "a", 0.05, 1000), exemplar("1", "b", 0.5, 1000))
+	et.dropSeen("target", mfs, now)
+	assert.Equal(t, []string{"a", "b"}, traces(mfs))
+
+	mfs = scrape(exemplar("0.1", "c", 0.07, 2000), exemplar("1", "b", 0.5, 1000))
+	et.dropSeen("target", mfs, now.Add(time.Minute))
+	assert.Equal(t, []string{"c"}, traces(mfs), "only the new exemplars are kept")
+	assert.Contains(t, mfs, "requests_total", "the other families are kept as is")
+
+	mfs = scrape(exemplar("0.1", "c", 0.07, 2000), exemplar("1", "b", 0.5, 1000))
+	et.dropSeen("target", mfs, now.Add(2*time.Minute))
+	assert.NotContains(t, mfs, "duration_bucket_exemplar", "the families without new exemplars are removed")
+
+	mfs = scrape(exemplar("0.1", "c", 0.07, 2000))
+	et.dropSeen("other", mfs, now.Add(2*time.Minute))
+	assert.Equal(t, []string{"c"}, traces(mfs), "the exemplars are tracked by target")
+
+	et.dropSeen("other", scrape(), now.Add(time.Hour))
+	assert.NotContains(t, et.seen, "target", "the exemplars past the retention are forgotten")
+	var nilTracker *exemplarTracker
+	nilTracker.dropSeen("target", mfs, now)
+}
@@ -0,0 +1,209 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFailoverFailures         = 3
+	defaultFailoverFailbackInterval = 5 * time.Minute
+)
+
+// errHarvestFailing is returned by the telemetry emitter while the requests
+// of its harvester fail, if it reports them.
+var errHarvestFailing = errors.New("the last request of the harvester failed")
+
+// harvestEnder is implemented by the emitters that need to know when all the
+// metrics of a harvest were emitted.
+type harvestEnder interface {
+	endHarvest()
+}
+
+// endHarvest notifies the emitters that the harvest ended.
+func endHarvest(emitters []Emitter) {
+	for _, e := range emitters {
+		if he, ok := e.(harvestEnder); ok {
+			he.endHarvest()
+		}
+	}
+}
+
+// FailoverEmitter emits the metrics to a primary emitter, and falls back to a
+// secondary one when the primary fails. The metrics the primary fails to emit
+// are always emitted to the secondary, and each batch to only one of them:
+// while the harvester of a telemetry primary fails, the metrics go to the
+// secondary, as the primary would queue them. After failures consecutive
+// harvests with errors, the primary is skipped, and only retried after the
+// failback interval: if a harvest then succeeds, the primary is used again,
+// and otherwise it's skipped for another interval.
+type FailoverEmitter struct {
+	primary          Emitter
+	secondary        Emitter
+	failures         int
+	failbackInterval time.Duration
+	now              func() time.Time
+
+	mu sync.Mutex
+	// harvestFailed is whether the primary failed in the current harvest.
+	harvestFailed bool
+	consecutive   int
+	failedOver    bool
+	failedOverAt  time.Time
+	// probing is whether the primary is being retried after a failover.
+	probing bool
+}
+
+// NewFailoverEmitter returns a FailoverEmitter of the emitters. The failures
+// default to 3 and the failback interval to 5m if 0.
+func NewFailoverEmitter(primary, secondary Emitter, failures int, failbackInterval time.Duration) *FailoverEmitter {
+	if failures <= 0 {
+		failures = defaultFailoverFailures
+	}
+	if failbackInterval <= 0 {
+		failbackInterval = defaultFailoverFailbackInterval
+	}
+	emitterFailedOverMetric.WithLabelValues(primary.Name()).Set(0)
+	return &FailoverEmitter{
+		primary:          primary,
+		secondary:        secondary,
+		failures:         failures,
+		failbackInterval: failbackInterval,
+		now:              time.Now,
+	}
+}
+
+// harvesters returns the telemetry emitters of the primary reporting the
+// failures of their harvester. They are looked up every time, as a harvester
+// pool creates the emitters of its keys as they are emitted.
+func (fe *FailoverEmitter) harvesters() []*TelemetryEmitter {
+	var harvesters []*TelemetryEmitter
+	for _, te := range telemetryEmitters([]Emitter{fe.primary}) {
+		if te.harvestFailing != nil {
+			harvesters = append(harvesters, te)
+		}
+	}
+	return harvesters
+}
+
+// harvestFailing returns true if the harvester of a telemetry primary is
+// failing.
+func (fe *FailoverEmitter) harvestFailing() bool {
+	for _, te := range fe.harvesters() {
+		if atomic.LoadInt32(te.harvestFailing) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// resetHarvestFailing forgets the failures of the harvesters of the primary
+// before it's retried, as they make no requests while failed over.
+func (fe *FailoverEmitter) resetHarvestFailing() {
+	for _, te := range fe.harvesters() {
+		atomic.StoreInt32(te.harvestFailing, 0)
+	}
+}
+
+// Name returns the name of the primary emitter, so the filters and the
+// metrics of the primary apply to the whole chain.
+func (fe *FailoverEmitter) Name() string {
+	return fe.primary.Name()
+}
+
+// Emit emits the metrics to the primary emitter, unless it failed over, and
+// to the secondary when the primary fails.
+func (fe *FailoverEmitter) Emit(metrics []Metric) error {
+	fe.mu.Lock()
+	failedOver := fe.failedOver
+	fe.mu.Unlock()
+	if failedOver {
+		return fe.secondary.Emit(metrics)
+	}
+
+	if fe.harvestFailing() {
+		fe.primaryFailed(errHarvestFailing)
+		return fe.secondary.Emit(metrics)
+	}
+
+	err := fe.primary.Emit(metrics)
+	var convErr *conversionError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &convErr):
+		// The metrics that could be converted were emitted by the primary.
+		return err
+	case errors.Is(err, errHarvestFailing):
+		// The harvester started failing during the emit, but the primary
+		// queued the metrics, so they aren't emitted to the secondary too.
+		fe.mu.Lock()
+		fe.harvestFailed = true
+		fe.mu.Unlock()
+		return nil
+	}
+	fe.primaryFailed(err)
+	return fe.secondary.Emit(metrics)
+}
+
+// primaryFailed records the failure of the primary in the harvest, whose
+// metrics are emitted to the secondary.
+func (fe *FailoverEmitter) primaryFailed(err error) {
+	fe.mu.Lock()
+	fe.harvestFailed = true
+	fe.mu.Unlock()
+	ilog.WithError(err).WithFields(logrus.Fields{
+		"emitter":   fe.primary.Name(),
+		"secondary": fe.secondary.Name(),
+	}).Debug("primary emitter failed, emitting to the secondary")
+}
+
+// wrappedEmitters returns the primary and the secondary emitters.
+func (fe *FailoverEmitter) wrappedEmitters() []Emitter {
+	return []Emitter{fe.primary, fe.secondary}
+}
+
+// endHarvest fails over after the configured consecutive failed harvests,
+// and retries the primary once the failback interval elapsed.
+func (fe *FailoverEmitter) endHarvest() {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	log := ilog.WithFields(logrus.Fields{"emitter": fe.primary.Name(), "secondary": fe.secondary.Name()})
+	switch {
+	case fe.failedOver:
+		if fe.now().Sub(fe.failedOverAt) >= fe.failbackInterval {
+			log.Info("retrying the primary emitter")
+			fe.failedOver = false
+			fe.probing = true
+			fe.resetHarvestFailing()
+		}
+	case fe.harvestFailed:
+		fe.consecutive++
+		if fe.probing || fe.consecutive >= fe.failures {
+			log.Warnf("primary emitter failed in %d consecutive harvests, failing over to the secondary for %s",
+				fe.consecutive, fe.failbackInterval)
+			fe.failedOver = true
+			fe.failedOverAt = fe.now()
+			fe.consecutive = 0
+			fe.probing = false
+			emitterFailedOverMetric.WithLabelValues(fe.primary.Name()).Set(1)
+		}
+	default:
+		fe.consecutive = 0
+		if fe.probing {
+			log.Info("primary emitter recovered")
+			fe.probing = false
+			emitterFailedOverMetric.WithLabelValues(fe.primary.Name()).Set(0)
+		}
+	}
+	fe.harvestFailed = false
+
+	endHarvest([]Emitter{fe.primary, fe.secondary})
+}
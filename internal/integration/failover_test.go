@@ -0,0 +1,220 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// failingEmitter records the metrics it emits, failing while err is set.
+type failingEmitter struct {
+	recordingEmitter
+	name string
+	err  error
+}
+
+func (f *failingEmitter) Name() string {
+	return f.name
+}
+
+func (f *failingEmitter) Emit(metrics []Metric) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.recordingEmitter.Emit(metrics)
+}
+
+func TestFailoverEmitter(t *testing.T) {
+	primary := &failingEmitter{name: "test-failover-primary"}
+	secondary := &failingEmitter{name: "file"}
+	fe := NewFailoverEmitter(primary, secondary, 2, time.Minute)
+	now := time.Unix(1600000000, 0)
+	fe.now = func() time.Time { return now }
+	assert.Equal(t, "test-failover-primary", fe.Name())
+
+	harvest := func(name string) {
+		require.NoError(t, fe.Emit([]Metric{{name: name}}))
+		fe.endHarvest()
+	}
+	emitted := func(e *failingEmitter) []string {
+		var names []string
+		for _, m := range e.metrics {
+			names = append(names, m.name)
+		}
+		e.metrics = nil
+		return names
+	}
+
+	harvest("a")
+	assert.Equal(t, []string{"a"}, emitted(primary))
+	assert.Empty(t, emitted(secondary))
+
+	// The metrics the primary fails to emit go to the secondary, and it
+	// fails over after 2 consecutive failed harvests.
+	primary.err = errors.New("outage")
+	harvest("b")
+	assert.Equal(t, []string{"b"}, emitted(secondary))
+	assert.False(t, fe.failedOver)
+	harvest("c")
+	assert.Equal(t, []string{"c"}, emitted(secondary))
+	assert.True(t, fe.failedOver)
+	assert.Equal(t, float64(1), testutil.ToFloat64(emitterFailedOverMetric.WithLabelValues("test-failover-primary")))
+
+	// Failed over, the primary isn't tried until the failback interval.
+	primary.err = nil
+	harvest("d")
+	assert.Empty(t, emitted(primary))
+	assert.Equal(t, []string{"d"}, emitted(secondary))
+
+	// A failed retry fails over again right away.
+	primary.err = errors.New("outage")
+	now = now.Add(time.Minute)
+	harvest("e")
+	assert.Equal(t, []string{"e"}, emitted(secondary))
+	assert.False(t, fe.failedOver, "the primary is retried in the next harvest")
+	harvest("f")
+	assert.Equal(t, []string{"f"}, emitted(secondary))
+	assert.True(t, fe.failedOver)
+
+	// A successful retry fails back.
+	primary.err = nil
+	now = now.Add(time.Minute)
+	harvest("g")
+	harvest("h")
+	assert.Equal(t, []string{"h"}, emitted(primary))
+	assert.Equal(t, []string{"g"}, emitted(secondary))
+	assert.False(t, fe.failedOver)
+	assert.Equal(t, float64(0), testutil.ToFloat64(emitterFailedOverMetric.WithLabelValues("test-failover-primary")))
+
+	// Errors of the secondary are returned.
+	primary.err = errors.New("outage")
+	secondary.err = errors.New("disk full")
+	assert.EqualError(t, fe.Emit([]Metric{{name: "i"}}), "disk full")
+}
+
+func TestTelemetryEmitter_ReportHarvestErrors(t *testing.T) {
+	status := http.StatusForbidden
+	e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return emptyResponse(status), nil
+				})
+			},
+		},
+		ReportHarvestErrors: true,
+	})
+	require.NoError(t, err)
+	gauge := []Metric{{name: "gauge", metricType: metricType_GAUGE, value: 1}}
+
+	require.NoError(t, e.Emit(gauge))
+	e.harvester.HarvestNow(context.Background())
+	assert.Equal(t, errHarvestFailing, e.Emit(gauge))
+
+	status = http.StatusAccepted
+	e.harvester.HarvestNow(context.Background())
+	assert.NoError(t, e.Emit(gauge))
+}
+
+// While the harvester of a telemetry primary fails, the metrics are only
+// emitted to the secondary, and the failures are forgotten when the primary
+// is retried, as it makes no requests while failed over.
+func TestFailoverEmitter_HarvestFailing(t *testing.T) {
+	status := http.StatusForbidden
+	var requests int
+	primary, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		Name: "test-failover-harvest",
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.HarvestPeriod = 0
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					requests++
+					return emptyResponse(status), nil
+				})
+			},
+		},
+		ReportHarvestErrors: true,
+	})
+	require.NoError(t, err)
+	secondary := &failingEmitter{name: "file"}
+	fe := NewFailoverEmitter(primary, secondary, 1, time.Minute)
+	now := time.Unix(1600000000, 0)
+	fe.now = func() time.Time { return now }
+	gauge := func(name string) []Metric {
+		return []Metric{{name: name, metricType: metricType_GAUGE, value: 1}}
+	}
+
+	require.NoError(t, fe.Emit(gauge("a")))
+	primary.harvester.HarvestNow(context.Background())
+	assert.Equal(t, 1, requests)
+	assert.Empty(t, secondary.metrics)
+
+	require.NoError(t, fe.Emit(gauge("b")))
+	require.Len(t, secondary.metrics, 1)
+	assert.Equal(t, "b", secondary.metrics[0].name)
+	primary.harvester.HarvestNow(context.Background())
+	assert.Equal(t, 1, requests, "the metrics of the secondary aren't queued by the primary")
+
+	fe.endHarvest()
+	assert.True(t, fe.failedOver)
+	status = http.StatusAccepted
+	now = now.Add(time.Minute)
+	fe.endHarvest()
+	require.False(t, fe.failedOver)
+
+	secondary.metrics = nil
+	require.NoError(t, fe.Emit(gauge("c")))
+	assert.Empty(t, secondary.metrics, "the probe isn't failed by the failures before the failover")
+	primary.harvester.HarvestNow(context.Background())
+	assert.Equal(t, 2, requests)
+	fe.endHarvest()
+	assert.False(t, fe.failedOver)
+	assert.False(t, fe.probing)
+}
+
+// The emitters of the keys of a telemetry pool primary, created after the
+// failover emitter, are also checked for harvest failures.
+func TestFailoverEmitter_HarvestFailingPool(t *testing.T) {
+	primary, err := NewTelemetryEmitterPool(TelemetryEmitterConfig{
+		Name: "test-failover-pool",
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.HarvestPeriod = 0
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return emptyResponse(http.StatusForbidden), nil
+				})
+			},
+		},
+		ReportHarvestErrors: true,
+	}, HarvesterPoolConfig{Key: "namespaceName"})
+	require.NoError(t, err)
+	secondary := &failingEmitter{name: "file"}
+	fe := NewFailoverEmitter(primary, secondary, 1, time.Minute)
+
+	require.NoError(t, fe.Emit([]Metric{{name: "a", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"namespaceName": "ns"}}}))
+	assert.Empty(t, secondary.metrics)
+	for _, te := range telemetryEmitters([]Emitter{primary}) {
+		te.harvester.HarvestNow(context.Background())
+	}
+
+	require.NoError(t, fe.Emit([]Metric{{name: "b", metricType: metricType_GAUGE, value: 1}}))
+	require.Len(t, secondary.metrics, 1, "the failing harvester of the key is found")
+	assert.Equal(t, "b", secondary.metrics[0].name)
+}
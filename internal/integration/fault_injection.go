@@ -0,0 +1,170 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// The faults injected, as reported by the fault_injections_total metric.
+const (
+	faultScrapeFailure  = "scrape_failure"
+	faultCorruptPayload = "corrupt_payload"
+	faultEmitDelay      = "emit_delay"
+)
+
+// errInjectedScrapeFailure is the error of the scrapes failed on purpose.
+var errInjectedScrapeFailure = errors.New("injected scrape failure")
+
+// corruptPayload replaces the payloads corrupted on purpose, so they fail
+// to be parsed as any of the exposition formats.
+var corruptPayload = []byte("# TYPE injected_corrupt_payload gauge\ninjected_corrupt_payload{ 1\x00\xff\n")
+
+// FaultInjectionConfig injects faults into the scrapes and the emits at the
+// configured rates, between 0 and 1, so the alerting on the integration can
+// be validated before a real incident. It's meant for testing environments
+// only, so the faults are only injected when Enabled, which is set with the
+// --fault-injection flag.
+type FaultInjectionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// ScrapeFailureRate fails the scrapes without requesting the targets.
+	ScrapeFailureRate float64 `mapstructure:"scrape_failure_rate"`
+	// CorruptPayloadRate replaces the scraped payloads with ones that fail
+	// to be parsed.
+	CorruptPayloadRate float64 `mapstructure:"corrupt_payload_rate"`
+	// EmitDelayRate delays the emits by the EmitDelay.
+	EmitDelayRate float64       `mapstructure:"emit_delay_rate"`
+	EmitDelay     time.Duration `mapstructure:"emit_delay"`
+}
+
+// IsEmpty returns true if no fault is injected.
+func (c FaultInjectionConfig) IsEmpty() bool {
+	return !c.Enabled || (c.ScrapeFailureRate == 0 && c.CorruptPayloadRate == 0 && c.EmitDelayRate == 0)
+}
+
+// Validate returns an error if a rate isn't between 0 and 1, or the emits
+// are delayed without a delay.
+func (c FaultInjectionConfig) Validate() error {
+	rates := map[string]float64{
+		"scrape_failure_rate":  c.ScrapeFailureRate,
+		"corrupt_payload_rate": c.CorruptPayloadRate,
+		"emit_delay_rate":      c.EmitDelayRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault_injection %s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+	if c.EmitDelayRate > 0 && c.EmitDelay <= 0 {
+		return fmt.Errorf("fault_injection emit_delay_rate requires a positive emit_delay")
+	}
+	return nil
+}
+
+// faultInjector decides at random which scrapes and emits fail.
+type faultInjector struct {
+	cfg FaultInjectionConfig
+	// random returns a number in [0, 1). Its usual value is rand.Float64,
+	// which is safe for concurrent use.
+	random func() float64
+}
+
+func newFaultInjector(cfg FaultInjectionConfig) *faultInjector {
+	if cfg.IsEmpty() {
+		return nil
+	}
+	return &faultInjector{cfg: cfg, random: rand.Float64}
+}
+
+// inject returns true if the fault of the rate is injected, counting it.
+func (fi *faultInjector) inject(fault string, rate float64) bool {
+	if rate <= 0 || fi.random() >= rate {
+		return false
+	}
+	faultInjectionsMetric.WithLabelValues(fault).Inc()
+	return true
+}
+
+// WithFaultInjection injects the scrape failures and corrupted payloads of
+// the configuration into the scrapes.
+func WithFaultInjection(cfg FaultInjectionConfig) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.faults = newFaultInjector(cfg)
+	}
+}
+
+// doer wraps the client of the scrapes with the fault injection, if enabled.
+func (fi *faultInjector) doer(client prometheus.HTTPDoer) prometheus.HTTPDoer {
+	if fi == nil || (fi.cfg.ScrapeFailureRate == 0 && fi.cfg.CorruptPayloadRate == 0) {
+		return client
+	}
+	return &faultInjectingDoer{client: client, faults: fi}
+}
+
+// faultInjectingDoer fails the scrapes, or corrupts their payloads, at the
+// configured rates.
+type faultInjectingDoer struct {
+	client prometheus.HTTPDoer
+	faults *faultInjector
+}
+
+func (d *faultInjectingDoer) Do(req *http.Request) (*http.Response, error) {
+	if d.faults.inject(faultScrapeFailure, d.faults.cfg.ScrapeFailureRate) {
+		return nil, errInjectedScrapeFailure
+	}
+	resp, err := d.client.Do(req)
+	if err != nil || resp.StatusCode/100 != 2 {
+		return resp, err
+	}
+	if d.faults.inject(faultCorruptPayload, d.faults.cfg.CorruptPayloadRate) {
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(corruptPayload))
+		resp.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		resp.Header.Del("Content-Encoding")
+		resp.ContentLength = int64(len(corruptPayload))
+	}
+	return resp, nil
+}
+
+// faultInjectingEmitter delays the emits at the configured rate.
+type faultInjectingEmitter struct {
+	Emitter
+	faults *faultInjector
+}
+
+// FaultInjectingEmitter wraps the emitter so its emits are delayed as
+// configured. The emitter isn't wrapped if no emit is delayed.
+func FaultInjectingEmitter(emitter Emitter, cfg FaultInjectionConfig) Emitter {
+	faults := newFaultInjector(cfg)
+	if faults == nil || cfg.EmitDelayRate == 0 {
+		return emitter
+	}
+	return &faultInjectingEmitter{Emitter: emitter, faults: faults}
+}
+
+// Emit emits the metrics, after the delay if injected.
+func (fe *faultInjectingEmitter) Emit(metrics []Metric) error {
+	if fe.faults.inject(faultEmitDelay, fe.faults.cfg.EmitDelayRate) {
+		time.Sleep(fe.faults.cfg.EmitDelay)
+	}
+	return fe.Emitter.Emit(metrics)
+}
+
+// wrappedEmitters returns the wrapped emitter.
+func (fe *faultInjectingEmitter) wrappedEmitters() []Emitter {
+	return []Emitter{fe.Emitter}
+}
+
+// endHarvest notifies the wrapped emitter that the harvest ended.
+func (fe *faultInjectingEmitter) endHarvest() {
+	endHarvest([]Emitter{fe.Emitter})
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func TestFaultInjectionConfig_Validate(t *testing.T) {
+	assert.NoError(t, FaultInjectionConfig{}.Validate())
+	assert.NoError(t, FaultInjectionConfig{ScrapeFailureRate: 1, EmitDelayRate: 0.5, EmitDelay: time.Second}.Validate())
+	assert.Error(t, FaultInjectionConfig{CorruptPayloadRate: 1.5}.Validate())
+	assert.Error(t, FaultInjectionConfig{ScrapeFailureRate: -0.1}.Validate())
+	assert.Error(t, FaultInjectionConfig{EmitDelayRate: 0.5}.Validate(), "the emits are delayed without a delay")
+}
+
+func TestFaultInjector_Scrapes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# TYPE up gauge\nup 1")
+	}))
+	defer srv.Close()
+
+	assert.Nil(t, newFaultInjector(FaultInjectionConfig{ScrapeFailureRate: 1}), "the faults require the flag")
+	doer := newFaultInjector(FaultInjectionConfig{Enabled: true}).doer(http.DefaultClient)
+	assert.Equal(t, http.DefaultClient, doer, "no fault is injected")
+
+	faults := newFaultInjector(FaultInjectionConfig{Enabled: true, ScrapeFailureRate: 0.5, CorruptPayloadRate: 0.5})
+	random := 0.0
+	faults.random = func() float64 { return random }
+	doer = faults.doer(http.DefaultClient)
+
+	_, err := prometheus.Get(doer, srv.URL)
+	assert.Contains(t, err.Error(), errInjectedScrapeFailure.Error())
+
+	random = 0.7
+	mfs, err := prometheus.Get(doer, srv.URL)
+	require.NoError(t, err, "the faults aren't injected above their rates")
+	assert.Contains(t, mfs, "up")
+
+	faults.cfg.ScrapeFailureRate = 0
+	random = 0.2
+	_, err = prometheus.Get(doer, srv.URL)
+	assert.Error(t, err, "the payload is corrupted")
+}
+
+func TestFaultInjectingEmitter(t *testing.T) {
+	recorder := &recordingEmitter{}
+	assert.Equal(t, Emitter(recorder), FaultInjectingEmitter(recorder, FaultInjectionConfig{EmitDelayRate: 1, EmitDelay: time.Second}),
+		"the faults require the flag")
+
+	emitter := FaultInjectingEmitter(recorder, FaultInjectionConfig{Enabled: true, EmitDelayRate: 1, EmitDelay: 20 * time.Millisecond})
+	start := time.Now()
+	require.NoError(t, emitter.Emit([]Metric{{name: "delayed"}}))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	require.Len(t, recorder.metrics, 1)
+	assert.Equal(t, "recording", emitter.Name())
+}
@@ -0,0 +1,64 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	promcli "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// WithScrapeChunkSize scrapes the targets in chunks: their metric families
+// are converted as they are decoded, and sent to the processing once they
+// have at least series series, so the whole payloads of huge targets, like
+// kube-state-metrics, aren't kept in memory. A family is never split
+// between chunks. The targets with several auth methods are scraped whole.
+func WithScrapeChunkSize(series int) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.chunkSize = series
+	}
+}
+
+// fetchChunks scrapes the target in chunks, sending them to the results as
+// they are decoded. A failed scrape is only retried if no chunk was sent
+// yet. If it fails after that, the chunks already sent aren't recalled, and
+// the last chunk, the only one that isn't Partial, is not sent.
+func (pf *prometheusFetcher) fetchChunks(t endpoints.Target, results chan<- TargetMetrics) {
+	pf.log.WithField("target", t.Name).Debug("fetching URL in chunks: ", t.URL)
+	url := pf.scrapeURL(&t)
+	httpClient := pf.targetClient(&t)
+	timeout := pf.clientTimeout(httpClient)
+	httpClient = pf.debugCapture.doer(pf.hostLimiter.doer(pf.timeouts.doer(pf.faults.doer(httpClient))), t.Name, url)
+
+	var chunk prometheus.MetricFamiliesByName
+	var series, sent int
+	send := func(partial bool) {
+		tm := pf.targetMetrics(t, chunk)
+		tm.Partial = partial
+		results <- tm
+		sent++
+		chunk, series = prometheus.MetricFamiliesByName{}, 0
+	}
+	handle := func(mf *dto.MetricFamily) error {
+		chunk.Add(mf)
+		series += len(mf.Metric)
+		if series >= pf.chunkSize {
+			send(true)
+		}
+		return nil
+	}
+
+	timer := promcli.NewTimer(promcli.ObserverFunc(fetchTargetDurationMetric.WithLabelValues(t.Name).Set))
+	err := pf.retryScrape(t.Name, timeout, func() error {
+		chunk, series = prometheus.MetricFamiliesByName{}, 0
+		return pf.streamMetrics(httpClient, url, handle)
+	}, func() bool { return sent == 0 })
+	timer.ObserveDuration()
+	pf.fetched(&t, err)
+	if err == nil {
+		send(false)
+	}
+}
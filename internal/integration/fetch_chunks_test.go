@@ -0,0 +1,101 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// streamGauges streams the gauge families of the given number of series.
+func streamGauges(err error, series ...int) func(prometheus.HTTPDoer, string, func(*dto.MetricFamily) error) error {
+	return func(_ prometheus.HTTPDoer, _ string, handle func(*dto.MetricFamily) error) error {
+		gauge := dto.MetricType_GAUGE
+		for i, n := range series {
+			name := fmt.Sprintf("gauge_%d", i)
+			mf := &dto.MetricFamily{Name: &name, Type: &gauge}
+			for j := 0; j < n; j++ {
+				value := float64(j)
+				mf.Metric = append(mf.Metric, &dto.Metric{Gauge: &dto.Gauge{Value: &value}})
+			}
+			if err := handle(mf); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+}
+
+func TestFetcher_ScrapeChunkSize(t *testing.T) {
+	fetcher := NewFetcher(time.Millisecond, fetchTimeout, maxConnections, "", "", true, queueLength, WithScrapeChunkSize(3))
+	fetcher.(*prometheusFetcher).getMetrics = func(prometheus.HTTPDoer, string) (prometheus.MetricFamiliesByName, error) {
+		t.Fatal("the target is scraped whole")
+		return nil, nil
+	}
+	fetcher.(*prometheusFetcher).streamMetrics = streamGauges(nil, 2, 2, 1, 4, 1)
+
+	addr := url.URL{Scheme: "http", Path: "hello/metrics"}
+	var chunks []int
+	var partial []bool
+	for tm := range fetcher.Fetch([]endpoints.Target{endpoints.New("hello", addr, endpoints.Object{})}) {
+		chunks = append(chunks, len(tm.Metrics))
+		partial = append(partial, tm.Partial)
+	}
+	assert.Equal(t, []int{4, 5, 1}, chunks, "the families aren't split")
+	assert.Equal(t, []bool{true, true, false}, partial)
+}
+
+func TestFetcher_ScrapeChunkSize_RepeatedFamily(t *testing.T) {
+	fetcher := NewFetcher(time.Millisecond, fetchTimeout, maxConnections, "", "", true, queueLength, WithScrapeChunkSize(10))
+	fetcher.(*prometheusFetcher).streamMetrics = func(_ prometheus.HTTPDoer, _ string, handle func(*dto.MetricFamily) error) error {
+		gauge := dto.MetricType_GAUGE
+		for _, name := range []string{"a", "b", "a"} {
+			name, value := name, 1.0
+			mf := &dto.MetricFamily{Name: &name, Type: &gauge, Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: &value}}}}
+			if err := handle(mf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	addr := url.URL{Scheme: "http", Path: "hello/metrics"}
+	var metrics int
+	for tm := range fetcher.Fetch([]endpoints.Target{endpoints.New("hello", addr, endpoints.Object{})}) {
+		metrics += len(tm.Metrics)
+	}
+	assert.Equal(t, 3, metrics, "the metrics of a repeated family are all kept")
+}
+
+func TestFetcher_ScrapeChunkSize_Error(t *testing.T) {
+	fetcher := NewFetcher(time.Minute, fetchTimeout, maxConnections, "", "", true, queueLength,
+		WithScrapeChunkSize(3), WithScrapeRetries(2, time.Millisecond))
+	resetErr := &url.Error{Op: "Get", URL: "http://hello/metrics", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}
+	var calls int
+	stream := streamGauges(resetErr, 4, 1)
+	fetcher.(*prometheusFetcher).streamMetrics = func(c prometheus.HTTPDoer, u string, handle func(*dto.MetricFamily) error) error {
+		calls++
+		return stream(c, u, handle)
+	}
+
+	addr := url.URL{Scheme: "http", Path: "hello/metrics"}
+	var chunks []TargetMetrics
+	for tm := range fetcher.Fetch([]endpoints.Target{endpoints.New("hello", addr, endpoints.Object{})}) {
+		chunks = append(chunks, tm)
+	}
+	assert.Equal(t, 1, calls, "the scrape isn't retried once a chunk is sent")
+	if assert.Len(t, chunks, 1, "the last chunk isn't sent") {
+		assert.True(t, chunks[0].Partial)
+		assert.Len(t, chunks[0].Metrics, 4)
+	}
+}
@@ -0,0 +1,112 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+	"github.com/newrelic/nri-prometheus/internal/retry"
+)
+
+// WithScrapeRetries retries up to retries times the scrapes that fail with a
+// transient error, like a connection reset or a DNS failure, before counting
+// the target as down. The delay between retries starts at backoff and grows
+// exponentially. Retries never go beyond the scrape interval.
+func WithScrapeRetries(retries int, backoff time.Duration) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.retries = retries
+		pf.retryBackoff = backoff
+	}
+}
+
+// isTransientError returns true if the scrape error is likely to go away
+// when retried. Timeouts are not retried, as they already consumed most of
+// the scrape interval, nor the authentication errors, like the TLS alerts
+// sent by the targets, which are network errors too.
+func isTransientError(err error) bool {
+	if isAuthError(err) {
+		return false
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return false
+		}
+		err = urlErr.Err
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+// getMetricsWithRetries gets the metrics of the URL, retrying the transient
+// errors as configured.
+func (pf *prometheusFetcher) getMetricsWithRetries(httpClient prometheus.HTTPDoer, targetName, url string) (prometheus.MetricFamiliesByName, error) {
+	timeout := pf.clientTimeout(httpClient)
+	httpClient = pf.debugCapture.doer(pf.hostLimiter.doer(pf.timeouts.doer(pf.faults.doer(httpClient))), targetName, url)
+	var mfs prometheus.MetricFamiliesByName
+	err := pf.retryScrape(targetName, timeout, func() (err error) {
+		mfs, err = pf.getMetrics(httpClient, url)
+		return err
+	}, nil)
+	return mfs, err
+}
+
+// retryScrape calls scrape, retrying it while it fails with a transient
+// error, as configured, and a new scrape of the given timeout still fits in
+// the scrape interval. If canRetry is set, the scrape is only retried while
+// it returns true.
+func (pf *prometheusFetcher) retryScrape(targetName string, timeout time.Duration, scrape func() error, canRetry func() bool) error {
+	start := time.Now()
+	backoff := retry.Backoff{Min: pf.retryBackoff, Max: pf.duration}
+	for attempt := 0; ; attempt++ {
+		err := scrape()
+		if err == nil || attempt >= pf.retries || !isTransientError(err) || (canRetry != nil && !canRetry()) {
+			return err
+		}
+		delay := backoff.Next()
+		if time.Since(start)+delay+timeout > pf.duration {
+			return err
+		}
+		pf.log.WithError(err).WithField("target", targetName).Debugf("transient scrape error, retrying in %s", delay)
+		fetchRetriesTotalMetric.WithLabelValues(targetName).Inc()
+		time.Sleep(delay)
+	}
+}
+
+// clientTimeout returns the timeout of the scrapes of the HTTP client.
+func (pf *prometheusFetcher) clientTimeout(httpClient prometheus.HTTPDoer) time.Duration {
+	if c, ok := httpClient.(*http.Client); ok && c.Timeout > 0 {
+		return c.Timeout
+	}
+	return pf.fetchTimeout
+}
+
+// withScrapeTimeout returns a copy of the HTTP client with the scrape
+// timeout of the target, if it has one. The copy shares the transport, and
+// so the connections, of the client.
+func withScrapeTimeout(httpClient prometheus.HTTPDoer, t *endpoints.Target) prometheus.HTTPDoer {
+	c, ok := httpClient.(*http.Client)
+	if !ok || t.ScrapeTimeout <= 0 || c.Timeout == t.ScrapeTimeout {
+		return httpClient
+	}
+	withTimeout := *c
+	withTimeout.Timeout = t.ScrapeTimeout
+	return &withTimeout
+}
@@ -4,11 +4,14 @@
 package integration
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -19,8 +22,10 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/gateway"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+	"github.com/newrelic/nri-prometheus/internal/pkg/resolver"
 )
 
 // Fetcher provides fetching functionality to a set of Prometheus endpoints
@@ -34,20 +39,33 @@ type Fetcher interface {
 type TargetMetrics struct {
 	Metrics []Metric
 	Target  endpoints.Target
+	// Job is the scrape job of the target.
+	Job string
+	// Partial is true for the chunks of a target scraped in chunks, but
+	// the last one.
+	Partial bool
 }
 
 // NewTLSConfig creates a TLS configuration. If a CA cert is provided it is
 // read and used to validate the scrape target's certificate properly.
-func NewTLSConfig(CAFile string, InsecureSkipVerify bool) (*tls.Config, error) {
+// The certificates of the additional CA files are trusted as well.
+func NewTLSConfig(CAFile string, InsecureSkipVerify bool, additionalCAFiles ...string) (*tls.Config, error) {
 	tlsConfig := &tls.Config{InsecureSkipVerify: InsecureSkipVerify}
 
+	var caFiles []string
 	if len(CAFile) > 0 {
+		caFiles = append(caFiles, CAFile)
+	}
+	caFiles = append(caFiles, additionalCAFiles...)
+	if len(caFiles) > 0 {
 		caCertPool := x509.NewCertPool()
-		caCert, err := ioutil.ReadFile(CAFile)
-		if err != nil {
-			return nil, fmt.Errorf("unable to use specified CA cert %s: %s", CAFile, err)
+		for _, f := range caFiles {
+			caCert, err := ioutil.ReadFile(f)
+			if err != nil {
+				return nil, fmt.Errorf("unable to use specified CA cert %s: %s", f, err)
+			}
+			caCertPool.AppendCertsFromPEM(caCert)
 		}
-		caCertPool.AppendCertsFromPEM(caCert)
 		tlsConfig.RootCAs = caCertPool
 	}
 	return tlsConfig, nil
@@ -60,11 +78,15 @@ func NewRoundTripper(BearerTokenFile string, CaFile string, InsecureSkipVerify b
 	if err != nil {
 		return nil, err
 	}
+	return newRoundTripper(BearerTokenFile, tlsConfig), nil
+}
+
+func newRoundTripper(BearerTokenFile string, tlsConfig *tls.Config) http.RoundTripper {
 	rt := newDefaultRoundTripper(tlsConfig)
 	if BearerTokenFile != "" {
 		rt = NewBearerAuthFileRoundTripper(BearerTokenFile, rt)
 	}
-	return rt, nil
+	return rt
 }
 
 func newDefaultRoundTripper(tlsConfig *tls.Config) http.RoundTripper {
@@ -107,6 +129,82 @@ func (rt *bearerAuthFileRoundTripper) RoundTrip(req *http.Request) (*http.Respon
 	return rt.rt.RoundTrip(req)
 }
 
+// NewBearerAuthEnvRoundTripper adds the bearer token of the environment
+// variable to a request unless the authorization header has already been
+// set. It fails if the variable is not set.
+func NewBearerAuthEnvRoundTripper(variable string, rt http.RoundTripper) http.RoundTripper {
+	return &bearerAuthEnvRoundTripper{variable, rt}
+}
+
+type bearerAuthEnvRoundTripper struct {
+	variable string
+	rt       http.RoundTripper
+}
+
+func (rt *bearerAuthEnvRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) == 0 {
+		bearerToken := strings.TrimSpace(os.Getenv(rt.variable))
+		if bearerToken == "" {
+			return nil, fmt.Errorf("bearer token environment variable %s is not set", rt.variable)
+		}
+
+		req = cloneRequest(req)
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	return rt.rt.RoundTrip(req)
+}
+
+// NewBearerAuthRoundTripper adds the bearer token to a request unless the
+// authorization header has already been set.
+func NewBearerAuthRoundTripper(token string, rt http.RoundTripper) http.RoundTripper {
+	return &bearerAuthRoundTripper{token, rt}
+}
+
+type bearerAuthRoundTripper struct {
+	token string
+	rt    http.RoundTripper
+}
+
+func (rt *bearerAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) == 0 {
+		req = cloneRequest(req)
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(rt.token))
+	}
+
+	return rt.rt.RoundTrip(req)
+}
+
+// NewBasicAuthRoundTripper adds the basic auth credentials to a request
+// unless the authorization header has already been set. The password file,
+// if any, is read for every request.
+func NewBasicAuthRoundTripper(cfg endpoints.BasicAuthConfig, rt http.RoundTripper) http.RoundTripper {
+	return &basicAuthRoundTripper{cfg, rt}
+}
+
+type basicAuthRoundTripper struct {
+	cfg endpoints.BasicAuthConfig
+	rt  http.RoundTripper
+}
+
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) == 0 {
+		password := string(rt.cfg.Password)
+		if rt.cfg.PasswordFile != "" {
+			b, err := ioutil.ReadFile(rt.cfg.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read basic auth password file %s: %s", rt.cfg.PasswordFile, err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+
+		req = cloneRequest(req)
+		req.SetBasicAuth(rt.cfg.Username, password)
+	}
+
+	return rt.rt.RoundTrip(req)
+}
+
 // cloneRequest returns a clone of the provided *http.Request.
 // The clone is a shallow copy of the struct and its Header map.
 func cloneRequest(r *http.Request) *http.Request {
@@ -121,33 +219,133 @@ func cloneRequest(r *http.Request) *http.Request {
 	return r2
 }
 
-// NewFetcher returns the default Fetcher implementation
-func NewFetcher(fetchDuration time.Duration, fetchTimeout time.Duration, maxConnections int, BearerTokenFile string, CaFile string, InsecureSkipVerify bool, queueLength int) Fetcher {
-	tr, _ := NewRoundTripper(BearerTokenFile, CaFile, InsecureSkipVerify)
-	client := &http.Client{
-		Transport: tr,
-		Timeout:   fetchTimeout,
+// FetcherOption configures optional behavior of the Fetcher.
+type FetcherOption func(*prometheusFetcher)
+
+// WithAdditionalCAFiles trusts the certificates of the given CA files, in
+// addition to the main CA file, when verifying the targets certificates.
+func WithAdditionalCAFiles(caFiles ...string) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.additionalCAFiles = append(pf.additionalCAFiles, caFiles...)
+	}
+}
+
+// WithStrictContentType rejects the payloads without a Prometheus or
+// OpenMetrics text content type, which usually come from targets pointing
+// at HTML pages.
+func WithStrictContentType() FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.getOptions.StrictContentType = true
+	}
+}
+
+// WithExemplars requests the OpenMetrics format to the targets and scrapes
+// the exemplars of their counters and histogram buckets, as the gauges of
+// the <sample>_exemplar metrics, with their trace.id and span.id attributes.
+// Only the exemplars not seen in the previous scrapes are emitted.
+func WithExemplars() FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.getOptions.Exemplars = true
+		pf.exemplars = newExemplarTracker()
 	}
-	return &prometheusFetcher{
+}
+
+// WithProtobuf requests the protocol buffer format to the targets, which is
+// faster to decode than the text ones. The targets rejecting it are
+// requested again in a text format.
+func WithProtobuf() FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.getOptions.Protobuf = true
+	}
+}
+
+// WithNativeHistograms requests the protocol buffer format to the targets,
+// to scrape their native histograms as histograms with the bounds of their
+// native buckets. Their resolution is reduced until they have at most
+// maxBuckets buckets, if greater than 0.
+func WithNativeHistograms(maxBuckets int) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.getOptions.NativeHistograms = true
+		pf.getOptions.NativeHistogramMaxBuckets = maxBuckets
+	}
+}
+
+// NewFetcher returns the default Fetcher implementation
+func NewFetcher(fetchDuration time.Duration, fetchTimeout time.Duration, maxConnections int, BearerTokenFile string, CaFile string, InsecureSkipVerify bool, queueLength int, opts ...FetcherOption) Fetcher {
+	pf := &prometheusFetcher{
 		maxConnections: maxConnections,
 		queueLength:    queueLength,
-		httpClient:     client,
 		duration:       fetchDuration,
 		fetchTimeout:   fetchTimeout,
 		getMetrics:     prometheus.Get,
 		log:            logrus.WithField("component", "Fetcher"),
 	}
+	for _, opt := range opts {
+		opt(pf)
+	}
+	getOptions := pf.getOptions
+	if getOptions != (prometheus.GetOptions{}) {
+		pf.getMetrics = func(httpClient prometheus.HTTPDoer, url string) (prometheus.MetricFamiliesByName, error) {
+			return prometheus.GetWithOptions(httpClient, url, getOptions)
+		}
+	}
+	pf.streamMetrics = func(httpClient prometheus.HTTPDoer, url string, handle func(*io_prometheus_client.MetricFamily) error) error {
+		return prometheus.Stream(httpClient, url, getOptions, handle)
+	}
+
+	pf.newJobClients(CaFile, BearerTokenFile, InsecureSkipVerify)
+	return pf
 }
 
 type prometheusFetcher struct {
-	maxConnections int
-	queueLength    int
-	duration       time.Duration
-	fetchTimeout   time.Duration
-	httpClient     prometheus.HTTPDoer
+	maxConnections    int
+	queueLength       int
+	duration          time.Duration
+	fetchTimeout      time.Duration
+	additionalCAFiles []string
+	parseFailures     *ParseFailures
+	getOptions        prometheus.GetOptions
+	retries           int
+	retryBackoff      time.Duration
+	targetParams      []TargetParamsRule
+	samplesPolicy     SamplesPolicy
+	honorTimestamps   bool
+	successRatios     *SuccessRatios
+	debugCapture      *DebugCapture
+	hostLimiter       *hostLimiter
+	timeouts          ScrapeTimeouts
+	// jitter spreads the scrapes with the offsets of the targets, hashed
+	// with the jitterSeed of the instance, if not 0.
+	jitter     time.Duration
+	jitterSeed uint64
+	scrapeJobs []ScrapeJob
+	// jobClients are the HTTP clients of the jobs, by job name.
+	jobClients map[string]*jobClient
+	// dialingClients are the HTTP clients of the targets with a custom DNS
+	// or gateway configuration, by configuration.
+	dialingClients sync.Map
+	// authClients are the HTTP clients of the authentication methods, and
+	// authMethods the index of the method that worked last, by target URL.
+	authClients sync.Map
+	authMethods sync.Map
+	// schemes holds the scheme that worked last, by target URL, for the
+	// targets with a scheme fallback policy.
+	schemes sync.Map
+	// exemplars are the exemplars already scraped, if they are scraped.
+	exemplars *exemplarTracker
+	// chunkSize is the minimum number of series of the chunks of the
+	// targets scraped in chunks, or 0 if they are scraped whole.
+	chunkSize int
+	// quirks are the exporter workarounds applied to the scrapes.
+	quirks []Quirk
+	// faults injects failures into the scrapes, if enabled.
+	faults *faultInjector
 	// Provides IoC for better testability. Its usual value is 'prometheus.Get'.
 	getMetrics func(httpClient prometheus.HTTPDoer, url string) (prometheus.MetricFamiliesByName, error)
-	log        *logrus.Entry
+	// streamMetrics decodes the payloads of the targets scraped in chunks.
+	// Its usual value is 'prometheus.Stream'.
+	streamMetrics func(httpClient prometheus.HTTPDoer, url string, handle func(*io_prometheus_client.MetricFamily) error) error
+	log           *logrus.Entry
 }
 
 // Fetch implementation runs the connections to many targets in parallel, limited by the maxTargetConnections constant,
@@ -158,10 +356,10 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 	finishedTasks.Add(len(targets))
 	prometheus.ResetTotalScrapedPayload()
 
-	targetChan := make(chan endpoints.Target, len(targets))
+	scheduler := newJobScheduler(pf.scrapeJobs)
 	pf.log.WithField("component", "fetcher").Debug("Starting fetch process...")
 	for i := 0; i < pf.maxConnections; i++ {
-		go pf.work(targetChan, &finishedTasks, results)
+		go pf.work(scheduler, &finishedTasks, results)
 	}
 
 	go func() {
@@ -175,10 +373,14 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 				Info("Target list for fetching metrics is empty")
 			return
 		}
+		if pf.jitter > 0 {
+			pf.pushJittered(scheduler, targets)
+			return
+		}
 		ticker := time.NewTicker(pf.duration / time.Duration(nTargets))
 		defer ticker.Stop()
 		for _, target := range targets {
-			targetChan <- target
+			scheduler.push(target)
 			<-ticker.C
 		}
 	}()
@@ -188,89 +390,265 @@ func (pf *prometheusFetcher) Fetch(targets []endpoints.Target) <-chan TargetMetr
 		// reading from it.
 		finishedTasks.Wait()
 		pf.log.WithField("component", "fetcher").Debug("Finished fetch process.")
-		close(targetChan)
+		scheduler.close()
 		close(results)
 	}()
 	return results
 }
 
 // work fetch the metrics of targets, pushing results to a channel and marking work as done.
-func (pf *prometheusFetcher) work(targets <-chan endpoints.Target, wg *sync.WaitGroup, results chan<- TargetMetrics) {
-	for target := range targets {
-		if mfs, err := pf.fetch(target); err == nil {
-			results <- TargetMetrics{
-				Metrics: convertPromMetrics(pf.log, target.Name, mfs),
-				Target:  target,
-			}
+func (pf *prometheusFetcher) work(scheduler *jobScheduler, wg *sync.WaitGroup, results chan<- TargetMetrics) {
+	for {
+		target, ok := scheduler.next()
+		if !ok {
+			return
+		}
+		if job := pf.jobClient(&target); !job.passthrough.IsEmpty() {
+			pf.forwardRaw(target, job)
+		} else if pf.chunkSize > 0 && len(target.Auth) == 0 && target.SchemeFallback.Fallback(target.URL.Scheme) == "" {
+			pf.fetchChunks(target, results)
+		} else if mfs, err := pf.fetch(target); err == nil {
+			results <- pf.targetMetrics(target, mfs)
 		}
 		wg.Done()
 	}
 }
 
+// targetMetrics converts the metric families of the target to its metrics.
+func (pf *prometheusFetcher) targetMetrics(target endpoints.Target, mfs prometheus.MetricFamiliesByName) TargetMetrics {
+	job := pf.jobClient(&target).name
+	if len(pf.quirks) > 0 {
+		applied, dropped := applyQuirks(mfs, pf.quirks)
+		if len(applied) > 0 {
+			pf.log.WithField("target", target.Name).Debugf("applied exporter quirks: %s", strings.Join(applied, ", "))
+		}
+		countDropped(job, dropReasonQuirk, dropped)
+	}
+	reduceSamples(mfs, pf.samplesPolicy, pf.honorTimestamps)
+	pf.exemplars.dropSeen(target.Name, mfs, time.Now())
+	// The target metadata and the cluster attributes are added to
+	// every metric.
+	extraAttrs := len(target.Metadata())
+	if target.ClusterName != "" {
+		extraAttrs += 2
+	}
+	metrics := convertPromMetrics(pf.log, target.Name, mfs, extraAttrs)
+	addClusterAttributes(metrics, target.ClusterName)
+	for _, mf := range mfs {
+		if _, ok := supportedMetricTypes[mf.GetType()]; !ok {
+			countDropped(job, dropReasonConvert, len(mf.Metric))
+		}
+	}
+	return TargetMetrics{
+		Metrics: metrics,
+		Target:  target,
+		Job:     job,
+	}
+}
+
+// addClusterAttributes sets the cluster the target was discovered in to its
+// metrics, so it takes precedence over the cluster name added by the default
+// processing rules.
+func addClusterAttributes(metrics []Metric, clusterName string) {
+	if clusterName == "" {
+		return
+	}
+	clusterAttrs := labels.Set{
+		"k8s.cluster.name": clusterName,
+		"clusterName":      clusterName,
+	}
+	for i := range metrics {
+		labels.Accumulate(metrics[i].attributes, clusterAttrs)
+	}
+}
+
 func (pf *prometheusFetcher) fetch(t endpoints.Target) (prometheus.MetricFamiliesByName, error) {
 	pf.log.WithField("target", t.Name).Debug("fetching URL: ", t.URL)
 	timer := promcli.NewTimer(promcli.ObserverFunc(fetchTargetDurationMetric.WithLabelValues(t.Name).Set))
-	httpClient := pf.httpClient
+	mfs, err := pf.fetchTarget(&t)
+	timer.ObserveDuration()
+	pf.fetched(&t, err)
+	return mfs, err
+}
 
-	if isMutualTLSTarget(t) {
-		rt, err := NewMutualTLSRoundTripper(t.TLSConfig)
+// fetched records the result of the scrape of the target.
+func (pf *prometheusFetcher) fetched(t *endpoints.Target, err error) {
+	if err != nil {
+		log := pf.log.WithError(err)
+		if phase := timeoutPhase(err); phase != "" {
+			log = log.WithField("timeoutPhase", phase)
+			fetchTimeoutsMetric.WithLabelValues(t.Name, phase).Inc()
+		}
+		log.Warnf("fetching Prometheus: %s (%s)", t.URL.String(), t.Object.Name)
+		fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
+		if pf.parseFailures != nil {
+			pf.parseFailures.add(t, err)
+		}
+	}
+	fetchesTotalMetric.WithLabelValues(t.Name).Set(1)
+	if pf.successRatios != nil {
+		pf.successRatios.observeScrape(err == nil)
+	}
+}
+
+// fetchTarget gets the metrics of the target with the HTTP client of its
+// configuration, falling back to the other scheme as configured.
+func (pf *prometheusFetcher) fetchTarget(t *endpoints.Target) (prometheus.MetricFamiliesByName, error) {
+	if fallback := t.SchemeFallback.Fallback(t.URL.Scheme); fallback != "" {
+		return pf.fetchWithSchemeFallback(t, fallback)
+	}
+	return pf.scrapeTarget(t)
+}
+
+// scrapeTarget gets the metrics of the target with its authentication
+// methods, or the HTTP client of its configuration.
+func (pf *prometheusFetcher) scrapeTarget(t *endpoints.Target) (prometheus.MetricFamiliesByName, error) {
+	if len(t.Auth) > 0 {
+		return pf.fetchWithAuth(t)
+	}
+	return pf.getMetricsWithRetries(pf.targetClient(t), t.Name, pf.scrapeURL(t))
+}
+
+// targetClient returns the HTTP client of the job, TLS, DNS, gateway and
+// scrape timeout configuration of the target.
+func (pf *prometheusFetcher) targetClient(t *endpoints.Target) prometheus.HTTPDoer {
+	job := pf.jobClient(t)
+	var httpClient prometheus.HTTPDoer = job.httpClient
+	if isMutualTLSTarget(*t) || !t.DNS.IsEmpty() || t.Gateway.IsConnect() {
+		client, err := pf.dialingClient(job, *t)
 		if err != nil {
-			pf.log.WithError(err).Warnf("Error reading mTLS certs for %s (%s) ", t.Name, t.URL.String())
+			pf.log.WithError(err).Warnf("Error creating the HTTP client of %s (%s) ", t.Name, t.URL.String())
 			fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
-		}
-		httpClient = &http.Client{
-			Transport: rt,
-			Timeout:   pf.fetchTimeout,
+			// The global credentials are not sent to the targets with
+			// their own TLS configuration.
+			if isMutualTLSTarget(*t) {
+				httpClient = &http.Client{Timeout: pf.fetchTimeout}
+			}
+		} else {
+			httpClient = client
 		}
 	}
+	return withScrapeTimeout(httpClient, t)
+}
 
-	mfs, err := pf.getMetrics(httpClient, t.URL.String())
-	timer.ObserveDuration()
+// dialingClient returns the HTTP client of the job with the TLS
+// configuration of the target, that resolves its host with its DNS
+// configuration, or connects to it through its gateway. Clients are shared
+// by the targets of the job with the same DNS, gateway and TLS
+// configuration, so are the connections and the cached resolutions.
+func (pf *prometheusFetcher) dialingClient(job *jobClient, t endpoints.Target) (prometheus.HTTPDoer, error) {
+	key := job.clientKey(fmt.Sprintf("%v|%v|%v", t.DNS, t.Gateway, t.TLSConfig))
+	if client, ok := pf.dialingClients.Load(key); ok {
+		return client.(prometheus.HTTPDoer), nil
+	}
+
+	tlsConfig := job.tlsConfig
+	if isMutualTLSTarget(t) {
+		var err error
+		if tlsConfig, err = newMutualTLSConfig(t.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
+	transport := job.newTransport(tlsConfig, !t.Gateway.IsConnect())
+	dial, err := dialContext(t.DNS, t.Gateway)
 	if err != nil {
-		pf.log.WithError(err).Warnf("fetching Prometheus: %s (%s)", t.URL.String(), t.Object.Name)
-		fetchErrorsTotalMetric.WithLabelValues(t.Name).Set(1)
+		return nil, err
 	}
-	fetchesTotalMetric.WithLabelValues(t.Name).Set(1)
-	return mfs, err
+	transport.DialContext = job.timeouts.dial(dial)
+	var rt http.RoundTripper = transport
+	// The global bearer token is not sent to the targets with their own TLS
+	// configuration, as they may be outside of the cluster. They use their
+	// own auth methods instead.
+	if !isMutualTLSTarget(t) && job.bearerTokenFile != "" {
+		rt = NewBearerAuthFileRoundTripper(job.bearerTokenFile, rt)
+	}
+
+	client, _ := pf.dialingClients.LoadOrStore(key, &http.Client{
+		Transport: rt,
+		Timeout:   pf.fetchTimeout,
+	})
+	return client.(prometheus.HTTPDoer), nil
+}
+
+// dialContext returns the function connecting to the targets with the DNS
+// or the gateway configuration, or nil for the default one. The gateway
+// resolves the hosts of the targets it connects to, so the DNS configuration
+// is not used with a CONNECT gateway.
+func dialContext(dns resolver.Config, gw gateway.Config) (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	if gw.IsConnect() {
+		d, err := gateway.NewDialer(gw)
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext, nil
+	}
+	if !dns.IsEmpty() {
+		return resolver.New(dns).DialContext, nil
+	}
+	return nil, nil
 }
 
 func isMutualTLSTarget(t endpoints.Target) bool {
-	// If any of these is present it means we're looking at an mTLS-enabled target.
-	// These targets need their own HTTP client because of very unique and different TLS
-	// configuration.
+	// If any of these is present it means we're looking at a target with its
+	// own CA or client certificate. These targets need their own HTTP client
+	// because of very unique and different TLS configuration.
 	return t.TLSConfig != endpoints.TLSConfig{}
 }
 
 // NewMutualTLSRoundTripper creates a new roundtripper with the specified Mutual TLS
 // configuration.
 func NewMutualTLSRoundTripper(cfg endpoints.TLSConfig) (http.RoundTripper, error) {
-	// Load our TLS key pair to use for authentication
-	cert, err := tls.LoadX509KeyPair(cfg.CertFilePath, cfg.KeyFilePath)
-	if err != nil {
-		return nil, err
-	}
-
-	// Load our CA certificate
-	clientCACert, err := ioutil.ReadFile(cfg.CaFilePath)
+	tlsConfig, err := newMutualTLSConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
+	rt := newDefaultRoundTripper(tlsConfig)
+	return rt, nil
+}
 
-	clientCertPool := x509.NewCertPool()
-	clientCertPool.AppendCertsFromPEM(clientCACert)
-
+// newMutualTLSConfig creates the TLS configuration of a target. The CA
+// replaces the system roots when set, so the targets signed by an internal
+// CA are verified, and the client certificate is sent when set. The client
+// certificate is read again on every new connection, so it can be renewed
+// in place.
+func newMutualTLSConfig(cfg endpoints.TLSConfig) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            clientCertPool,
+		ServerName:         cfg.ServerName,
 		InsecureSkipVerify: cfg.InsecureSkipVerify,
 	}
-	tlsConfig.BuildNameToCertificate()
 
-	rt := newDefaultRoundTripper(tlsConfig)
-	return rt, nil
+	if cfg.CertFilePath != "" || cfg.KeyFilePath != "" {
+		if cfg.CertFilePath == "" || cfg.KeyFilePath == "" {
+			return nil, fmt.Errorf("the client certificate requires both a cert_file_path and a key_file_path")
+		}
+		// The key pair is loaded once so a bad one fails the client
+		// creation instead of every handshake.
+		if _, err := tls.LoadX509KeyPair(cfg.CertFilePath, cfg.KeyFilePath); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFilePath, cfg.KeyFilePath)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		}
+	}
+
+	if cfg.CaFilePath != "" {
+		caCert, err := ioutil.ReadFile(cfg.CaFilePath)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificate found in the CA file %s", cfg.CaFilePath)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	return tlsConfig, nil
 }
 
-type metricValue interface{}
 type metricType string
 
 //nolint:golint
@@ -283,11 +661,20 @@ const (
 
 // Metric represents a Prometheus metric.
 // https://prometheus.io/docs/concepts/data_model/
+//
+// Gauges and counters keep their value unboxed in value, while summaries and
+// histograms keep their whole distribution in summary and histogram.
 type Metric struct {
 	name       string
-	value      metricValue
+	value      float64
+	summary    *io_prometheus_client.Summary
+	histogram  *io_prometheus_client.Histogram
 	metricType metricType
 	attributes labels.Set
+	// timestamp is the time of the sample when it's exposed with one and
+	// the timestamps are honored. Otherwise it's zero and the metric is
+	// emitted at the scrape time.
+	timestamp time.Time
 }
 
 var supportedMetricTypes = map[io_prometheus_client.MetricType]string{
@@ -298,7 +685,19 @@ var supportedMetricTypes = map[io_prometheus_client.MetricType]string{
 	io_prometheus_client.MetricType_UNTYPED:   "untyped",
 }
 
-func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.MetricFamiliesByName) []Metric {
+// exemplarAttributes are the New Relic names of the usual trace labels of
+// the exemplars, so the exemplar metrics can be linked to their traces.
+var exemplarAttributes = map[string]string{
+	"trace_id": "trace.id",
+	"traceID":  "trace.id",
+	"span_id":  "span.id",
+	"spanID":   "span.id",
+}
+
+// convertPromMetrics converts the metric families to metrics of the target.
+// extraAttrs is the number of attributes expected to be added to each metric
+// by the processing, so their attributes are allocated only once.
+func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.MetricFamiliesByName, extraAttrs int) []Metric {
 	var metricsCap int
 	for _, mf := range mfs {
 		mtype, ok := supportedMetricTypes[mf.GetType()]
@@ -312,6 +711,10 @@ func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.Met
 	}
 	totalTimeseriesMetric.Add(float64(metricsCap))
 
+	// Strings are boxed only once per target, as storing them in the
+	// attributes otherwise allocates for every metric.
+	var boxedTargetName interface{} = targetName
+	boxedValues := map[string]interface{}{}
 	metrics := make([]Metric, 0, metricsCap)
 	for mname, mf := range mfs {
 		ntype := mf.GetType()
@@ -319,47 +722,53 @@ func convertPromMetrics(log *logrus.Entry, targetName string, mfs prometheus.Met
 		if !ok {
 			continue
 		}
+		exemplar := mf.GetHelp() == prometheus.ExemplarHelp
 		for _, m := range mf.GetMetric() {
-			var value interface{}
-			var nrType metricType
+			metric := Metric{name: mname, timestamp: sampleTime(m)}
 			switch ntype {
 			case io_prometheus_client.MetricType_UNTYPED:
-				value = m.GetUntyped().GetValue()
-				nrType = metricType_GAUGE
+				metric.value = m.GetUntyped().GetValue()
+				metric.metricType = metricType_GAUGE
 			case io_prometheus_client.MetricType_COUNTER:
-				value = m.GetCounter().GetValue()
-				nrType = metricType_COUNTER
+				metric.value = m.GetCounter().GetValue()
+				metric.metricType = metricType_COUNTER
 			case io_prometheus_client.MetricType_GAUGE:
-				value = m.GetGauge().GetValue()
-				nrType = metricType_GAUGE
+				metric.value = m.GetGauge().GetValue()
+				metric.metricType = metricType_GAUGE
 			case io_prometheus_client.MetricType_SUMMARY:
-				value = m.GetSummary()
-				nrType = metricType_SUMMARY
+				metric.summary = m.GetSummary()
+				metric.metricType = metricType_SUMMARY
 			case io_prometheus_client.MetricType_HISTOGRAM:
-				value = m.GetHistogram()
-				nrType = metricType_HISTOGRAM
+				metric.histogram = m.GetHistogram()
+				metric.metricType = metricType_HISTOGRAM
 			default:
 				if log.Level <= logrus.DebugLevel {
 					log.WithField("target", targetName).Debugf("metric type not supported: %s", mtype)
 				}
 				continue
 			}
-			attrs := map[string]interface{}{}
-			attrs["targetName"] = targetName
+			// Sized for the labels, the 3 attributes below and the ones
+			// added by the processing, so the map never grows.
+			attrs := make(labels.Set, len(m.GetLabel())+3+extraAttrs)
+			attrs["targetName"] = boxedTargetName
 			for _, l := range m.GetLabel() {
-				attrs[l.GetName()] = l.GetValue()
+				value, ok := boxedValues[l.GetValue()]
+				if !ok {
+					value = l.GetValue()
+					boxedValues[l.GetValue()] = value
+				}
+				name := l.GetName()
+				if exemplar {
+					if renamed, ok := exemplarAttributes[name]; ok {
+						name = renamed
+					}
+				}
+				attrs[name] = value
 			}
-			attrs["nrMetricType"] = string(nrType)
+			attrs["nrMetricType"] = string(metric.metricType)
 			attrs["promMetricType"] = mtype
-			metrics = append(
-				metrics,
-				Metric{
-					name:       mname,
-					metricType: nrType,
-					value:      value,
-					attributes: attrs,
-				},
-			)
+			metric.attributes = attrs
+			metrics = append(metrics, metric)
 		}
 	}
 	return metrics
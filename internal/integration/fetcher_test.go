@@ -3,10 +3,18 @@
 package integration
 
 import (
+	"bytes"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -274,7 +282,7 @@ func TestConvertPromMetrics(t *testing.T) {
 				{
 					name:       "histogram_example",
 					metricType: metricType_HISTOGRAM,
-					value: &dto.Histogram{
+					histogram: &dto.Histogram{
 						// use anonymous struct to return *float64 literal.
 						SampleCount: &(&struct{ x uint64 }{10}).x,
 						SampleSum:   &(&struct{ x float64 }{42}).x,
@@ -299,7 +307,7 @@ func TestConvertPromMetrics(t *testing.T) {
 				{
 					name:       "summary_example",
 					metricType: metricType_SUMMARY,
-					value: &dto.Summary{
+					summary: &dto.Summary{
 						// use anonymous struct to return *float64 literal.
 						SampleCount: &(&struct{ x uint64 }{10}).x,
 						SampleSum:   &(&struct{ x float64 }{42}).x,
@@ -446,7 +454,7 @@ func TestConvertPromMetrics(t *testing.T) {
 				{
 					name:       "histogram_example",
 					metricType: metricType_HISTOGRAM,
-					value: &dto.Histogram{
+					histogram: &dto.Histogram{
 						// use anonymous struct to return *float64 literal.
 						SampleCount: &(&struct{ x uint64 }{20}).x,
 						SampleSum:   &(&struct{ x float64 }{52}).x,
@@ -471,7 +479,7 @@ func TestConvertPromMetrics(t *testing.T) {
 				{
 					name:       "summary_example",
 					metricType: metricType_SUMMARY,
-					value: &dto.Summary{
+					summary: &dto.Summary{
 						// use anonymous struct to return *float64 and *unint64 literal.
 						SampleCount: &(&struct{ x uint64 }{20}).x,
 						SampleSum:   &(&struct{ x float64 }{52}).x,
@@ -498,7 +506,7 @@ func TestConvertPromMetrics(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		assert.ElementsMatch(t, test.want, convertPromMetrics(nil, test.target, test.mfs))
+		assert.ElementsMatch(t, test.want, convertPromMetrics(nil, test.target, test.mfs, 0))
 	}
 }
 
@@ -526,16 +534,16 @@ func TestConvertPromMetricsMultiTargetCollisions(t *testing.T) {
 	}
 
 	// Process metric scraped from `target-a`.
-	convertPromMetrics(nil, "target-a", mfbn)
+	convertPromMetrics(nil, "target-a", mfbn, 0)
 
 	// Process similarly named and labeled metric scrapped from `target-b` but with a different value.
 	metric.Counter.Value = &(&struct{ x float64 }{100}).x
-	convertPromMetrics(nil, "target-b", mfbn)
+	convertPromMetrics(nil, "target-b", mfbn, 0)
 
 	// Again process metric scraped from `target-a`.
 	// The value of the accumulated count has increased by 1.
 	metric.Counter.Value = &(&struct{ x float64 }{138}).x
-	nrMetrics := convertPromMetrics(nil, "target-a", mfbn)
+	nrMetrics := convertPromMetrics(nil, "target-a", mfbn, 0)
 
 	if len(nrMetrics) != 1 {
 		t.Errorf("expected a single metric got %d", len(nrMetrics))
@@ -556,3 +564,161 @@ func TestConvertPromMetricsMultiTargetCollisions(t *testing.T) {
 	}
 	assert.Equal(t, nrMetrics[0], want)
 }
+
+func TestAddClusterAttributes(t *testing.T) {
+	metrics := []Metric{
+		{name: "a", attributes: labels.Set{}},
+		{name: "b", attributes: labels.Set{"clusterName": "scraped"}},
+	}
+
+	addClusterAttributes(metrics, "edge-1")
+
+	assert.Equal(t, "edge-1", metrics[0].attributes["clusterName"])
+	assert.Equal(t, "edge-1", metrics[0].attributes["k8s.cluster.name"])
+	assert.Equal(t, "scraped", metrics[1].attributes["clusterName"])
+}
+
+func TestFetcher_ScrapeRetries(t *testing.T) {
+	resetErr := &url.Error{Op: "Get", URL: "http://hello/metrics", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}
+	cases := []struct {
+		name          string
+		retries       int
+		errs          []error
+		expectedCalls int32
+		expectedOK    bool
+	}{
+		{
+			name:          "transient error recovered",
+			retries:       2,
+			errs:          []error{resetErr},
+			expectedCalls: 2,
+			expectedOK:    true,
+		},
+		{
+			name:          "retries exhausted",
+			retries:       1,
+			errs:          []error{resetErr, resetErr, resetErr},
+			expectedCalls: 2,
+		},
+		{
+			name:          "parse errors are not retried",
+			retries:       2,
+			errs:          []error{&prometheus.ParseError{Err: errors.New("bad")}},
+			expectedCalls: 1,
+		},
+		{
+			name:          "disabled",
+			errs:          []error{resetErr},
+			expectedCalls: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fetcher := NewFetcher(time.Minute, fetchTimeout, maxConnections, "", "", true, queueLength, WithScrapeRetries(c.retries, time.Millisecond))
+			var calls int32
+			fetcher.(*prometheusFetcher).getMetrics = func(client prometheus.HTTPDoer, url string) (prometheus.MetricFamiliesByName, error) {
+				call := atomic.AddInt32(&calls, 1)
+				if int(call) <= len(c.errs) {
+					return nil, c.errs[call-1]
+				}
+				return prometheus.MetricFamiliesByName{"some-name": dto.MetricFamily{}}, nil
+			}
+
+			addr := url.URL{Scheme: "http", Path: "hello/metrics"}
+			var fetched int
+			for range fetcher.Fetch([]endpoints.Target{endpoints.New("hello", addr, endpoints.Object{})}) {
+				fetched++
+			}
+			assert.Equal(t, c.expectedCalls, atomic.LoadInt32(&calls))
+			assert.Equal(t, c.expectedOK, fetched == 1)
+		})
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	assert.True(t, isTransientError(&url.Error{Op: "Get", Err: &net.DNSError{Err: "no such host", Name: "exporter"}}))
+	assert.True(t, isTransientError(&url.Error{Op: "Get", Err: io.EOF}))
+	assert.False(t, isTransientError(&url.Error{Op: "Get", Err: timeoutError{}}))
+	assert.False(t, isTransientError(&url.Error{Op: "Get", Err: &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}}))
+	assert.False(t, isTransientError(&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}}))
+	assert.False(t, isTransientError(&prometheus.ContentTypeError{ContentType: "text/html"}))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func BenchmarkConvertAndProcess(b *testing.B) {
+	contents, err := ioutil.ReadFile("test/cadvisor.txt")
+	require.NoError(b, err)
+	mfByName, err := decodePromMetrics(bytes.NewBuffer(contents))
+	require.NoError(b, err)
+	target := endpoints.New("fakeTarget", url.URL{Scheme: "http", Host: "10.0.0.1:8080", Path: "/metrics"}, endpoints.Object{Name: "fakeTarget", Kind: "pod"})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pair := TargetMetrics{
+			Metrics: convertPromMetrics(nil, target.Name, *mfByName, len(target.Metadata())),
+			Target:  target,
+		}
+		Filter(&pair, nil)
+		AddAttributes(&pair, nil)
+		Decorate(&pair, nil)
+		Rename(&pair, nil)
+	}
+}
+
+func TestConvertPromMetrics_Exemplars(t *testing.T) {
+	help := prometheus.ExemplarHelp
+	gauge := dto.MetricType_GAUGE
+	name := func(s string) *string { return &s }
+	value := 0.05
+	mfs := prometheus.MetricFamiliesByName{
+		"duration_bucket_exemplar": dto.MetricFamily{
+			Help: &help,
+			Type: &gauge,
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: name("le"), Value: name("0.1")},
+					{Name: name("spanID"), Value: name("00f067aa")},
+					{Name: name("trace_id"), Value: name("4bf92f35")},
+				},
+				Gauge: &dto.Gauge{Value: &value},
+			}},
+		},
+	}
+
+	metrics := convertPromMetrics(nil, "target", mfs, 0)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 0.05, metrics[0].value)
+	assert.Equal(t, "4bf92f35", metrics[0].attributes["trace.id"])
+	assert.Equal(t, "00f067aa", metrics[0].attributes["span.id"])
+	assert.Equal(t, "0.1", metrics[0].attributes["le"])
+	assert.NotContains(t, metrics[0].attributes, "trace_id")
+}
+
+func TestFetcher_TargetScrapeTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("federated_metric 1\n"))
+	}))
+	defer ts.Close()
+	addr, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	fetcher := NewFetcher(time.Millisecond, 50*time.Millisecond, maxConnections, "", "", true, queueLength)
+	slow := endpoints.New("slow", *addr, endpoints.Object{})
+	slow.ScrapeTimeout = time.Second
+	fast := endpoints.New("fast", *addr, endpoints.Object{})
+
+	var fetched []string
+	for tm := range fetcher.Fetch([]endpoints.Target{slow, fast}) {
+		fetched = append(fetched, tm.Target.Name)
+	}
+	assert.Equal(t, []string{"slow"}, fetched, "only the target with a longer timeout is scraped")
+	assert.Equal(t, 50*time.Millisecond, fetcher.(*prometheusFetcher).jobClients[defaultScrapeJob].httpClient.Timeout,
+		"the client of the other targets is not modified")
+}
@@ -0,0 +1,270 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFileMaxSizeMB = 100
+	// backupTimeFormat is the format of the time of the rotated files, which
+	// sorts them chronologically.
+	backupTimeFormat = "20060102T150405.000"
+)
+
+var flog = logrus.WithField("component", "FileEmitter")
+
+// FileEmitterConfig configures the FileEmitter.
+type FileEmitterConfig struct {
+	// Path of the file the metrics are written to.
+	Path string `mapstructure:"path"`
+	// MaxSizeMB is the size in megabytes after which the file is rotated.
+	// Defaults to 100.
+	MaxSizeMB int `mapstructure:"max_size_mb"`
+	// RotateInterval is the age after which the file is rotated. The file
+	// is only rotated by size if 0.
+	RotateInterval time.Duration `mapstructure:"rotate_interval"`
+	// MaxBackups is the number of rotated files kept. All of them are kept
+	// if 0.
+	MaxBackups int `mapstructure:"max_backups"`
+	// Compress gzips the rotated files.
+	Compress bool `mapstructure:"compress"`
+}
+
+// Validate returns an error if the path is not set.
+func (c FileEmitterConfig) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("the file emitter requires a file.path")
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 || c.RotateInterval < 0 {
+		return fmt.Errorf("the file emitter max_size_mb, max_backups and rotate_interval can't be negative")
+	}
+	return nil
+}
+
+// FileEmitter writes the metrics to a local file as newline delimited JSON,
+// one metric per line, for environments where the metrics are shipped out
+// of band. The file is rotated by size and age, and the rotated files are
+// named after the rotation time, like metrics-20200102T150405.000.ndjson.
+type FileEmitter struct {
+	name       string
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	compress   bool
+	now        func() time.Time
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	// mill compresses and removes the rotated files in the background, one
+	// rotation at a time.
+	mill sync.Mutex
+	wg   sync.WaitGroup
+}
+
+// NewFileEmitter returns a FileEmitter of the configuration. The directory of
+// the file is created if it doesn't exist.
+func NewFileEmitter(cfg FileEmitterConfig) (*FileEmitter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, fmt.Errorf("creating the directory of the file emitter: %w", err)
+	}
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultFileMaxSizeMB
+	}
+	return &FileEmitter{
+		name:       "file",
+		path:       cfg.Path,
+		maxSize:    int64(maxSizeMB) << 20,
+		interval:   cfg.RotateInterval,
+		maxBackups: cfg.MaxBackups,
+		compress:   cfg.Compress,
+		now:        time.Now,
+	}, nil
+}
+
+// Name is the FileEmitter name.
+func (fe *FileEmitter) Name() string {
+	return fe.name
+}
+
+// Emit appends the metrics to the file, rotating it first if it's too big or
+// too old.
+func (fe *FileEmitter) Emit(metrics []Metric) error {
+	now := fe.now()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range metrics {
+		timestamp := now
+		if !m.timestamp.IsZero() {
+			timestamp = m.timestamp
+		}
+		if err := enc.Encode(newMetricRecord(m, timestamp)); err != nil {
+			return err
+		}
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	if fe.file == nil {
+		if err := fe.open(now); err != nil {
+			return err
+		}
+	}
+	tooBig := fe.size+int64(buf.Len()) > fe.maxSize
+	tooOld := fe.interval > 0 && now.Sub(fe.opened) >= fe.interval
+	if fe.size > 0 && (tooBig || tooOld) {
+		if err := fe.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := fe.file.Write(buf.Bytes())
+	fe.size += int64(n)
+	return err
+}
+
+// open opens the file for appending.
+func (fe *FileEmitter) open(now time.Time) error {
+	f, err := os.OpenFile(fe.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening the file emitter file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	fe.file = f
+	fe.size = info.Size()
+	fe.opened = now
+	return nil
+}
+
+// rotate renames the file after the rotation time and opens a new one. The
+// rotated file is compressed and the old ones removed in the background.
+func (fe *FileEmitter) rotate(now time.Time) error {
+	if err := fe.file.Close(); err != nil {
+		return err
+	}
+	fe.file = nil
+	ext := filepath.Ext(fe.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(fe.path, ext), now.UTC().Format(backupTimeFormat), ext)
+	if err := os.Rename(fe.path, backup); err != nil {
+		return fmt.Errorf("rotating the file emitter file: %w", err)
+	}
+	if err := fe.open(now); err != nil {
+		return err
+	}
+
+	fe.wg.Add(1)
+	go func() {
+		defer fe.wg.Done()
+		fe.mill.Lock()
+		defer fe.mill.Unlock()
+		if fe.compress {
+			if err := compressFile(backup); err != nil {
+				flog.WithError(err).WithField("file", backup).Warn("compressing rotated file")
+			}
+		}
+		fe.removeOldBackups()
+	}()
+	return nil
+}
+
+// backups returns the rotated files, from the oldest to the newest.
+func (fe *FileEmitter) backups() ([]string, error) {
+	ext := filepath.Ext(fe.path)
+	pattern := strings.TrimSuffix(fe.path, ext) + "-*" + ext
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := filepath.Glob(pattern + ".gz")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, compressed...)
+	sort.Strings(files)
+	return files, nil
+}
+
+// removeOldBackups removes the oldest rotated files beyond the maximum.
+func (fe *FileEmitter) removeOldBackups() {
+	if fe.maxBackups == 0 {
+		return
+	}
+	files, err := fe.backups()
+	if err != nil {
+		flog.WithError(err).Warn("listing rotated files")
+		return
+	}
+	for len(files) > fe.maxBackups {
+		if err := os.Remove(files[0]); err != nil {
+			flog.WithError(err).WithField("file", files[0]).Warn("removing rotated file")
+		}
+		files = files[1:]
+	}
+}
+
+// compressFile gzips the file into file.gz and removes it.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Close closes the file, after the compression of the rotated files.
+func (fe *FileEmitter) Close() error {
+	fe.wg.Wait()
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	if fe.file == nil {
+		return nil
+	}
+	err := fe.file.Close()
+	fe.file = nil
+	return err
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func readRecords(t *testing.T, name string) []metricRecord {
+	t.Helper()
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	var records []metricRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r metricRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func newTestFileEmitter(t *testing.T, cfg FileEmitterConfig) (*FileEmitter, *time.Time) {
+	t.Helper()
+	fe, err := NewFileEmitter(cfg)
+	require.NoError(t, err)
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	fe.now = func() time.Time { return now }
+	return fe, &now
+}
+
+func TestFileEmitter_NDJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-emitter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out", "metrics.ndjson")
+	fe, now := newTestFileEmitter(t, FileEmitterConfig{Path: path})
+
+	require.NoError(t, fe.Emit([]Metric{
+		{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"targetName": "a"}},
+		{name: "requests_total", metricType: metricType_COUNTER, value: 7, attributes: labels.Set{"targetName": "a"}},
+	}))
+	require.NoError(t, fe.Emit([]Metric{
+		{name: "up", metricType: metricType_GAUGE, value: 0, attributes: labels.Set{"targetName": "b"}},
+	}))
+	require.NoError(t, fe.Close())
+
+	records := readRecords(t, path)
+	require.Len(t, records, 3)
+	assert.Equal(t, "up", records[0].Name)
+	assert.Equal(t, metricType_GAUGE, records[0].Type)
+	assert.Equal(t, "a", records[0].Attributes["targetName"])
+	assert.True(t, now.Equal(*records[0].Timestamp))
+	assert.Equal(t, "requests_total", records[1].Name)
+	assert.Equal(t, "b", records[2].Attributes["targetName"])
+}
+
+func TestFileEmitter_RotatesBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-emitter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.ndjson")
+	fe, now := newTestFileEmitter(t, FileEmitterConfig{Path: path, MaxBackups: 2})
+	fe.maxSize = 10
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: float64(i)}}))
+		*now = now.Add(time.Second)
+	}
+	require.NoError(t, fe.Close())
+
+	records := readRecords(t, path)
+	require.Len(t, records, 1, "a batch bigger than the max size is still written")
+	assert.Equal(t, 3.0, records[0].Value)
+
+	backups, err := fe.backups()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "metrics-20200102T150407.000.ndjson"),
+		filepath.Join(dir, "metrics-20200102T150408.000.ndjson"),
+	}, backups, "only the newest backups are kept")
+	assert.Equal(t, 1.0, readRecords(t, backups[0])[0].Value)
+}
+
+func TestFileEmitter_RotatesByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-emitter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.ndjson")
+	fe, now := newTestFileEmitter(t, FileEmitterConfig{Path: path, RotateInterval: time.Hour})
+
+	emit := func() {
+		require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1}}))
+	}
+	emit()
+	*now = now.Add(30 * time.Minute)
+	emit()
+	*now = now.Add(30 * time.Minute)
+	emit()
+	require.NoError(t, fe.Close())
+
+	assert.Len(t, readRecords(t, path), 1)
+	backups, err := fe.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Len(t, readRecords(t, backups[0]), 2)
+}
+
+func TestFileEmitter_Compress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-emitter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.ndjson")
+	fe, now := newTestFileEmitter(t, FileEmitterConfig{Path: path, RotateInterval: time.Minute, Compress: true})
+
+	require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1}}))
+	*now = now.Add(time.Minute)
+	require.NoError(t, fe.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 2}}))
+	require.NoError(t, fe.Close())
+
+	backups, err := fe.backups()
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "metrics-20200102T150505.000.ndjson.gz")}, backups)
+
+	f, err := os.Open(backups[0])
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	var r metricRecord
+	require.NoError(t, json.NewDecoder(gz).Decode(&r))
+	assert.Equal(t, 1.0, r.Value)
+}
+
+func TestFileEmitterConfig_Validate(t *testing.T) {
+	assert.Error(t, FileEmitterConfig{}.Validate())
+	assert.Error(t, FileEmitterConfig{Path: "m.ndjson", MaxSizeMB: -1}.Validate())
+	assert.NoError(t, FileEmitterConfig{Path: "m.ndjson"}.Validate())
+}
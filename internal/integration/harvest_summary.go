@@ -0,0 +1,217 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// sentBytes is the number of bytes of the requests accepted by the Metric
+// API and remote_write endpoints.
+var sentBytes uint64
+
+// recordSentBytes counts the bytes of a request accepted by the endpoint of
+// the emitter.
+func recordSentBytes(emitter string, n int64) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&sentBytes, uint64(n))
+	emitterSentBytesMetric.WithLabelValues(emitter).Add(float64(n))
+}
+
+// countRequest counts a request of the harvester of the emitter by result.
+func countRequest(emitter string, failed bool) {
+	result := "success"
+	if failed {
+		result = "failure"
+	}
+	emitterRequestsMetric.WithLabelValues(emitter, result).Inc()
+}
+
+// countSentBytes counts the bytes of the requests of the harvester accepted
+// by the Metric API.
+func countSentBytes(emitter string) TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		rt := cfg.Client.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = sentBytesRoundTripper{emitter: emitter, rt: rt}
+	}
+}
+
+// sentBytesRoundTripper counts the bytes of the accepted requests.
+type sentBytesRoundTripper struct {
+	emitter string
+	rt      http.RoundTripper
+}
+
+// RoundTrip sends the request, counting its bytes if it's accepted.
+func (t sentBytesRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err == nil && resp.StatusCode/100 == 2 {
+		recordSentBytes(t.emitter, req.ContentLength)
+	}
+	return resp, err
+}
+
+// HarvestReport summarizes a run of the integration loop.
+type HarvestReport struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	// Targets are the discovered targets, and TargetsScraped the ones whose
+	// metrics were retrieved.
+	Targets        int `json:"targets"`
+	TargetsScraped int `json:"targets_scraped"`
+	// SeriesEmitted are the metrics passed to the emitters.
+	SeriesEmitted int `json:"series_emitted"`
+	// BytesSent are the bytes of the requests accepted by the Metric API
+	// and remote_write endpoints during the run. The telemetry emitters
+	// send their metrics in the background, so they may be counted in the
+	// next run.
+	BytesSent       uint64 `json:"bytes_sent"`
+	DiscoveryErrors int    `json:"discovery_errors"`
+	ScrapeErrors    int    `json:"scrape_errors"`
+	EmitErrors      int    `json:"emit_errors"`
+}
+
+// HarvestSummary keeps the report of the last run of the integration loop,
+// served as JSON, and persists it in a file if configured, so it's still
+// available after a restart until the next run finishes.
+type HarvestSummary struct {
+	file string
+
+	mu   sync.Mutex
+	last *HarvestReport
+}
+
+// NewHarvestSummary returns a HarvestSummary persisting the report to the
+// given file, if not empty, reading the one persisted previously.
+func NewHarvestSummary(file string) *HarvestSummary {
+	s := &HarvestSummary{file: file}
+	if file == "" {
+		return s
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s
+	}
+	var report HarvestReport
+	if err == nil {
+		err = json.Unmarshal(b, &report)
+	}
+	if err != nil {
+		ilog.WithError(err).WithField("file", file).Warn("couldn't read the last harvest summary")
+		return s
+	}
+	s.last = &report
+	return s
+}
+
+// WithHarvestSummary reports every run of the integration loop to the
+// summary.
+func WithHarvestSummary(s *HarvestSummary) ExecuteOption {
+	return func(e *execution) {
+		e.summary = s
+	}
+}
+
+// Last returns the report of the last run, or nil if there is none.
+func (s *HarvestSummary) Last() *HarvestReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// record keeps the report of a run, persisting it if configured.
+func (s *HarvestSummary) record(report HarvestReport) {
+	s.mu.Lock()
+	s.last = &report
+	s.mu.Unlock()
+	if s.file == "" {
+		return
+	}
+	if err := s.persist(report); err != nil {
+		ilog.WithError(err).WithField("file", s.file).Warn("couldn't persist the last harvest summary")
+	}
+}
+
+// persist writes the report to the file. The file is replaced atomically.
+func (s *HarvestSummary) persist(report HarvestReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// ServeHTTP serves the report of the last run as JSON, or a 503 response if
+// no run has finished yet.
+func (s *HarvestSummary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	last := s.Last()
+	if last == nil {
+		http.Error(w, "no harvest has finished yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(last)
+}
+
+// harvestRun accumulates the report of a run of the integration loop.
+type harvestRun struct {
+	report    HarvestReport
+	sentBytes uint64
+}
+
+func newHarvestRun() *harvestRun {
+	return &harvestRun{
+		report:    HarvestReport{Start: time.Now()},
+		sentBytes: atomic.LoadUint64(&sentBytes),
+	}
+}
+
+// finish completes the report and records it to the summary.
+func (h *harvestRun) finish(s *HarvestSummary) {
+	h.report.End = time.Now()
+	h.report.DurationSeconds = h.report.End.Sub(h.report.Start).Seconds()
+	h.report.BytesSent = atomic.LoadUint64(&sentBytes) - h.sentBytes
+	if h.report.Targets > h.report.TargetsScraped {
+		h.report.ScrapeErrors = h.report.Targets - h.report.TargetsScraped
+	}
+	s.record(h.report)
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func TestHarvestSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harvest-summary")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state", "last-harvest.json")
+
+	summary := NewHarvestSummary(file)
+	rec := httptest.NewRecorder()
+	summary.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/last-harvest", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "no harvest finished yet")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("up 1\nrequests_total 3\n"))
+	}))
+	defer server.Close()
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{server.URL, "http://127.0.0.1:1/metrics"}})
+	require.NoError(t, err)
+	require.NoError(t, retriever.Watch())
+
+	fetcher := NewFetcher(time.Millisecond, time.Second, 4, "", "", false, 4)
+	processor := Processor(func(pairs <-chan TargetMetrics) <-chan TargetMetrics { return pairs })
+	failing := &failingEmitter{name: "failing", err: errors.New("rejected")}
+	sender := &recordingEmitter{}
+	emitter := &sendingEmitter{Emitter: sender}
+	process([]endpoints.TargetRetriever{retriever}, fetcher, processor, []Emitter{emitter, failing},
+		newExecution(WithHarvestSummary(summary)))
+
+	last := summary.Last()
+	require.NotNil(t, last)
+	assert.Equal(t, 2, last.Targets)
+	assert.Equal(t, 1, last.TargetsScraped)
+	assert.Equal(t, 1, last.ScrapeErrors)
+	assert.Equal(t, 2, last.SeriesEmitted)
+	assert.Equal(t, 1, last.EmitErrors)
+	assert.Equal(t, uint64(100), last.BytesSent)
+	assert.False(t, last.End.Before(last.Start))
+
+	rec = httptest.NewRecorder()
+	summary.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/last-harvest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var served HarvestReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	assert.Equal(t, 2, served.SeriesEmitted)
+
+	restored := NewHarvestSummary(file).Last()
+	require.NotNil(t, restored, "the summary is persisted")
+	assert.Equal(t, last.Targets, restored.Targets)
+	assert.Equal(t, last.BytesSent, restored.BytesSent)
+
+	rec = httptest.NewRecorder()
+	summary.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/last-harvest", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+// sendingEmitter counts 100 sent bytes on every emission.
+type sendingEmitter struct {
+	Emitter
+}
+
+func (e *sendingEmitter) Emit(metrics []Metric) error {
+	recordSentBytes("sending", 100)
+	return e.Emitter.Emit(metrics)
+}
+
+func TestSentBytesRoundTripper(t *testing.T) {
+	status := http.StatusAccepted
+	rt := sentBytesRoundTripper{emitter: "telemetry", rt: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return emptyResponse(status), nil
+	})}
+	send := func() uint64 {
+		before := sentBytes
+		req, err := http.NewRequest(http.MethodPost, "https://metric-api.newrelic.com/metric/v1", bytes.NewReader(make([]byte, 42)))
+		require.NoError(t, err)
+		_, err = rt.RoundTrip(req)
+		require.NoError(t, err)
+		return sentBytes - before
+	}
+	assert.Equal(t, uint64(42), send())
+	status = http.StatusRequestEntityTooLarge
+	assert.Equal(t, uint64(0), send(), "the rejected requests aren't counted")
+}
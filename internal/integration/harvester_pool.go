@@ -0,0 +1,198 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultHarvesterPoolMaxKeys = 100
+
+// HarvesterPoolConfig splits the harvester of a telemetry emitter into a
+// pool of harvesters keyed by the value of an attribute of the metrics, like
+// the namespace or the job, so the payloads of a key rejected or throttled by
+// the Metric API don't delay the metrics of the other keys.
+type HarvesterPoolConfig struct {
+	// Key is the attribute the metrics are split by. The pool is disabled
+	// if empty.
+	Key string `mapstructure:"key"`
+	// MaxKeys is the number of keys with their own harvester. The metrics
+	// of the keys beyond it, and the ones without the attribute, share the
+	// default harvester. Defaults to 100.
+	MaxKeys int `mapstructure:"max_keys"`
+}
+
+// Validate returns an error if the max keys are negative.
+func (c HarvesterPoolConfig) Validate() error {
+	if c.MaxKeys < 0 {
+		return fmt.Errorf("the harvester pool max_keys can't be negative")
+	}
+	return nil
+}
+
+// keyNameReplacer replaces the path separators of the keys in the names of
+// their emitters, which are also the directories of their spools.
+var keyNameReplacer = strings.NewReplacer("/", "_", `\`, "_")
+
+// TelemetryEmitterPool emits the metrics of every key of its harvester pool
+// to their own telemetry emitter, with its own harvester, created the first
+// time the key is emitted. The emitter of a key is named after the pool and
+// the key, like telemetry:kube-system, so their self-metrics, like the sent
+// bytes and the requests, are reported by key.
+type TelemetryEmitterPool struct {
+	cfg     TelemetryEmitterConfig
+	key     string
+	maxKeys int
+	// def is the emitter of the metrics without key, or beyond the max
+	// keys.
+	def *TelemetryEmitter
+
+	mu    sync.RWMutex
+	byKey map[string]*TelemetryEmitter
+}
+
+// NewTelemetryEmitterPool returns a TelemetryEmitterPool of the telemetry
+// emitters of the configuration, keyed as configured by the pool.
+func NewTelemetryEmitterPool(cfg TelemetryEmitterConfig, pool HarvesterPoolConfig) (*TelemetryEmitterPool, error) {
+	if cfg.Name == "" {
+		cfg.Name = "telemetry"
+	}
+	maxKeys := pool.MaxKeys
+	if maxKeys == 0 {
+		maxKeys = defaultHarvesterPoolMaxKeys
+	}
+	if cfg.Spool.Dir != "" {
+		cfg.Spool.maxBytes = spoolShare(cfg.Spool, maxKeys)
+	}
+	def, err := NewTelemetryEmitter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TelemetryEmitterPool{
+		cfg:     cfg,
+		key:     pool.Key,
+		maxKeys: maxKeys,
+		def:     def,
+		byKey:   map[string]*TelemetryEmitter{},
+	}, nil
+}
+
+// spoolShare returns the size of the spool of every emitter of the pool, the
+// default one and the ones of the max keys, so all of them together don't
+// exceed the size of the configured spool.
+func spoolShare(cfg SpoolConfig, maxKeys int) int64 {
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultSpoolMaxSizeMB
+	}
+	return (int64(maxSizeMB) << 20) / int64(maxKeys+1)
+}
+
+// Name returns the name of the pool, so the filters and the failover chains
+// apply to all its emitters.
+func (p *TelemetryEmitterPool) Name() string {
+	return p.cfg.Name
+}
+
+// Emit emits the metrics of every key to its emitter. The conversion errors
+// of the emitters are returned as a single one.
+func (p *TelemetryEmitterPool) Emit(metrics []Metric) error {
+	batches := map[*TelemetryEmitter][]Metric{}
+	var order []*TelemetryEmitter
+	for _, m := range metrics {
+		e := p.emitter(m)
+		if _, ok := batches[e]; !ok {
+			order = append(order, e)
+		}
+		batches[e] = append(batches[e], m)
+	}
+
+	var results error
+	var converted int
+	failed := false
+	for _, e := range order {
+		err := e.Emit(batches[e])
+		if err == nil {
+			continue
+		}
+		var convErr *conversionError
+		if errors.As(err, &convErr) {
+			converted += convErr.metrics
+		} else {
+			failed = true
+		}
+		if results == nil {
+			results = err
+		} else {
+			results = fmt.Errorf("%v: %w", err, results)
+		}
+	}
+	if results != nil && !failed {
+		return &conversionError{err: results, metrics: converted}
+	}
+	return results
+}
+
+// emitter returns the emitter of the key of the metric, creating it if it's
+// the first time the key is emitted. The default emitter is returned if the
+// key can't have its own one.
+func (p *TelemetryEmitterPool) emitter(m Metric) *TelemetryEmitter {
+	value, ok := m.attributes[p.key]
+	if !ok {
+		return p.def
+	}
+	key := fmt.Sprint(value)
+	if key == "" {
+		return p.def
+	}
+
+	p.mu.RLock()
+	e, ok := p.byKey[key]
+	p.mu.RUnlock()
+	if ok {
+		return e
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.byKey[key]; ok {
+		return e
+	}
+	if len(p.byKey) >= p.maxKeys {
+		return p.def
+	}
+	cfg := p.cfg
+	cfg.Name = p.cfg.Name + ":" + keyNameReplacer.Replace(key)
+	e, err := NewTelemetryEmitter(cfg)
+	if err != nil {
+		ilog.WithError(err).WithField("emitter", cfg.Name).Warn("can't create the emitter of the harvester pool key, using the default one")
+		return p.def
+	}
+	p.byKey[key] = e
+	return e
+}
+
+// wrappedEmitters returns the default emitter and the emitters of the keys,
+// sorted by name.
+func (p *TelemetryEmitterPool) wrappedEmitters() []Emitter {
+	p.mu.RLock()
+	emitters := make([]Emitter, 0, len(p.byKey)+1)
+	for _, e := range p.byKey {
+		emitters = append(emitters, e)
+	}
+	p.mu.RUnlock()
+	sort.Slice(emitters, func(i, j int) bool {
+		return emitters[i].Name() < emitters[j].Name()
+	})
+	return append([]Emitter{p.def}, emitters...)
+}
+
+// endHarvest notifies the emitters of the pool that the harvest ended.
+func (p *TelemetryEmitterPool) endHarvest() {
+	endHarvest(p.wrappedEmitters())
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestTelemetryEmitterPool(t *testing.T) {
+	var mu sync.Mutex
+	var requests [][]string
+	pool, err := NewTelemetryEmitterPool(TelemetryEmitterConfig{
+		Name: "pool",
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					var payload []map[string]interface{}
+					reader, err := gzip.NewReader(req.Body)
+					require.NoError(t, err)
+					require.NoError(t, json.NewDecoder(reader).Decode(&payload))
+					var namespaces []string
+					for _, m := range payload[0]["metrics"].([]interface{}) {
+						attrs := m.(map[string]interface{})["attributes"].(map[string]interface{})
+						namespace, _ := attrs["namespaceName"].(string)
+						namespaces = append(namespaces, namespace)
+					}
+					mu.Lock()
+					requests = append(requests, namespaces)
+					mu.Unlock()
+					if namespaces[0] == "noisy" {
+						return emptyResponse(http.StatusBadRequest), nil
+					}
+					return emptyResponse(http.StatusAccepted), nil
+				})
+			},
+		},
+	}, HarvesterPoolConfig{Key: "namespaceName", MaxKeys: 2})
+	require.NoError(t, err)
+	assert.Equal(t, "pool", pool.Name())
+
+	gauge := func(namespace string) Metric {
+		attrs := labels.Set{}
+		if namespace != "" {
+			attrs["namespaceName"] = namespace
+		}
+		return Metric{name: "up", metricType: metricType_GAUGE, value: 1, attributes: attrs}
+	}
+	require.NoError(t, pool.Emit([]Metric{
+		gauge("noisy"),
+		gauge("quiet"),
+		gauge("noisy"),
+		gauge("overflow"),
+		gauge(""),
+	}))
+
+	var names []string
+	for _, e := range telemetryEmitters([]Emitter{pool}) {
+		names = append(names, e.Name())
+		e.harvester.HarvestNow(context.Background())
+	}
+	assert.Equal(t, []string{"pool", "pool:noisy", "pool:quiet"}, names)
+	assert.ElementsMatch(t, [][]string{
+		{"overflow", ""},
+		{"noisy", "noisy"},
+		{"quiet"},
+	}, requests, "every key is sent in its own requests")
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(emitterRequestsMetric.WithLabelValues("pool:noisy", "failure")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(emitterRequestsMetric.WithLabelValues("pool:quiet", "success")))
+}
+
+func TestTelemetryEmitterPool_ConversionErrors(t *testing.T) {
+	pool, err := NewTelemetryEmitterPool(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+		},
+	}, HarvesterPoolConfig{Key: "namespaceName"})
+	require.NoError(t, err)
+
+	err = pool.Emit([]Metric{
+		{name: "a", metricType: "unknown", attributes: labels.Set{"namespaceName": "a"}},
+		{name: "b", metricType: "unknown", attributes: labels.Set{"namespaceName": "b"}},
+		{name: "up", metricType: metricType_GAUGE, attributes: labels.Set{"namespaceName": "b"}},
+	})
+	var convErr *conversionError
+	require.True(t, errors.As(err, &convErr))
+	assert.Equal(t, 2, convErr.metrics)
+}
+
+func TestSpoolShare(t *testing.T) {
+	assert.Equal(t, int64(1<<20), spoolShare(SpoolConfig{MaxSizeMB: 3}, 2))
+	share := spoolShare(SpoolConfig{}, defaultHarvesterPoolMaxKeys)
+	assert.True(t, share*(defaultHarvesterPoolMaxKeys+1) <= defaultSpoolMaxSizeMB<<20,
+		"the spools of the pool don't exceed the default size together")
+
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := newSpool("pool", SpoolConfig{Dir: dir, maxBytes: share})
+	require.NoError(t, err)
+	assert.Equal(t, share, s.maxBytes)
+}
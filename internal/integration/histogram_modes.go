@@ -0,0 +1,59 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import "fmt"
+
+// HistogramMode is what the telemetry emitter sends of a histogram. The
+// <name>.sum counter is sent in all the modes except drop.
+type HistogramMode string
+
+const (
+	// HistogramModeBoth sends the buckets and the percentiles.
+	HistogramModeBoth HistogramMode = "both"
+	// HistogramModeBuckets sends the buckets only.
+	HistogramModeBuckets HistogramMode = "buckets"
+	// HistogramModePercentiles sends the percentiles, and the <name>.count
+	// counter as the count isn't sent with the buckets.
+	HistogramModePercentiles HistogramMode = "percentiles"
+	// HistogramModeSummary sends the <name>.count counter only, enough to
+	// calculate the averages.
+	HistogramModeSummary HistogramMode = "summary"
+	// HistogramModeDrop sends nothing.
+	HistogramModeDrop HistogramMode = "drop"
+)
+
+// HistogramModeRule sets the mode of the histograms whose name starts with
+// any of the Prefixes.
+type HistogramModeRule struct {
+	Prefixes []string      `mapstructure:"prefixes"`
+	Mode     HistogramMode `mapstructure:"mode"`
+}
+
+// ValidateHistogramModes returns an error if a rule has no prefixes or an
+// unknown mode.
+func ValidateHistogramModes(rules []HistogramModeRule) error {
+	for i, r := range rules {
+		if len(r.Prefixes) == 0 {
+			return fmt.Errorf("histogram_modes[%d] has no prefixes", i)
+		}
+		switch r.Mode {
+		case HistogramModeBoth, HistogramModeBuckets, HistogramModePercentiles, HistogramModeSummary, HistogramModeDrop:
+		default:
+			return fmt.Errorf("histogram_modes[%d] has an unknown mode %q, expected both, buckets, percentiles, summary or drop", i, r.Mode)
+		}
+	}
+	return nil
+}
+
+// histogramMode returns the mode of the first rule matching the name of the
+// histogram, or both if none does.
+func (te *TelemetryEmitter) histogramMode(name string) HistogramMode {
+	for _, r := range te.histogramModes {
+		if hasAnyPrefix(name, r.Prefixes) {
+			return r.Mode
+		}
+	}
+	return HistogramModeBoth
+}
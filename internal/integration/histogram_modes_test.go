@@ -0,0 +1,71 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestValidateHistogramModes(t *testing.T) {
+	assert.NoError(t, ValidateHistogramModes([]HistogramModeRule{{Prefixes: []string{"http_"}, Mode: HistogramModeSummary}}))
+	assert.Error(t, ValidateHistogramModes([]HistogramModeRule{{Mode: HistogramModeDrop}}))
+	assert.Error(t, ValidateHistogramModes([]HistogramModeRule{{Prefixes: []string{"http_"}, Mode: "quantiles"}}))
+}
+
+func TestTelemetryEmitter_HistogramModes(t *testing.T) {
+	testCases := []struct {
+		mode  HistogramMode
+		names []string
+	}{
+		{mode: HistogramModeBoth, names: []string{"latency.buckets", "latency.percentiles", "latency.sum"}},
+		{mode: HistogramModeBuckets, names: []string{"latency.buckets", "latency.sum"}},
+		{mode: HistogramModePercentiles, names: []string{"latency.count", "latency.percentiles", "latency.sum"}},
+		{mode: HistogramModeSummary, names: []string{"latency.count", "latency.sum"}},
+		{mode: HistogramModeDrop, names: nil},
+	}
+
+	for _, tt := range testCases {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			var sent []map[string]interface{}
+			e := counterOutputEmitter(t, CounterOutputDelta, &sent)
+			e.percentiles = []float64{50}
+			e.histogramModes = []HistogramModeRule{
+				{Prefixes: []string{"other"}, Mode: HistogramModeDrop},
+				{Prefixes: []string{"lat"}, Mode: tt.mode},
+			}
+
+			start := time.Now().Add(-time.Minute)
+			for i, buckets := range [][]int64{{1, 2, 3}, {2, 4, 6}} {
+				hist, err := newHistogram(buckets)
+				require.NoError(t, err)
+				require.NoError(t, e.Emit([]Metric{{
+					name:       "latency",
+					metricType: metricType_HISTOGRAM,
+					histogram:  hist,
+					attributes: labels.Set{"path": "/"},
+					timestamp:  start.Add(time.Duration(i) * 30 * time.Second),
+				}}))
+			}
+			e.harvester.HarvestNow(context.Background())
+
+			names := map[string]bool{}
+			for _, m := range sent {
+				names[m["name"].(string)] = true
+			}
+			var sorted []string
+			for name := range names {
+				sorted = append(sorted, name)
+			}
+			sort.Strings(sorted)
+			assert.Equal(t, tt.names, sorted)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// WithMaxConcurrencyPerHost limits the scrapes running at once against the
+// same host and port, so the many targets behind a shared ingress or gateway
+// don't overload it. The scrapes over the limit wait for a slot, up to the
+// fetch timeout.
+func WithMaxConcurrencyPerHost(limit int) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		if limit > 0 {
+			pf.hostLimiter = newHostLimiter(limit, pf.fetchTimeout)
+		}
+	}
+}
+
+// hostLimiter holds a semaphore of every scraped host.
+type hostLimiter struct {
+	limit int
+	// timeout is how long a scrape waits for a slot. It waits forever if 0.
+	timeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(limit int, timeout time.Duration) *hostLimiter {
+	return &hostLimiter{limit: limit, timeout: timeout, hosts: map[string]chan struct{}{}}
+}
+
+// doer returns the client limiting the concurrent requests by host. It
+// returns the client itself if the limiter is nil.
+func (hl *hostLimiter) doer(client prometheus.HTTPDoer) prometheus.HTTPDoer {
+	if hl == nil {
+		return client
+	}
+	return &limitingDoer{client: client, limiter: hl}
+}
+
+func (hl *hostLimiter) semaphore(host string) chan struct{} {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	sem, ok := hl.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, hl.limit)
+		hl.hosts[host] = sem
+	}
+	return sem
+}
+
+// acquire takes a slot of the host, waiting up to the timeout, and returns
+// the function releasing it.
+func (hl *hostLimiter) acquire(host string) (func(), error) {
+	sem := hl.semaphore(host)
+	select {
+	case sem <- struct{}{}:
+	default:
+		hostThrottledMetric.WithLabelValues(host).Inc()
+		var timeout <-chan time.Time
+		if hl.timeout > 0 {
+			timer := time.NewTimer(hl.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for one of the %d concurrent scrapes allowed to host %s", hl.limit, host)
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-sem })
+	}, nil
+}
+
+// limitingDoer holds a slot of the host of every request until its response
+// body is closed.
+type limitingDoer struct {
+	client  prometheus.HTTPDoer
+	limiter *hostLimiter
+}
+
+func (d *limitingDoer) Do(req *http.Request) (*http.Response, error) {
+	release, err := d.limiter.acquire(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody releases the slot of the host when it's closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type doerFunc func(req *http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHostLimiter(t *testing.T) {
+	var running, maxRunning int32
+	client := doerFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("up 1\n"))}, nil
+	})
+	doer := newHostLimiter(2, 0).doer(client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "http://gateway:8080/metrics", nil)
+			resp, err := doer.Do(req)
+			require.NoError(t, err)
+			// The slot is held until the body is closed.
+			atomic.AddInt32(&running, -1)
+			_ = resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+}
+
+func TestHostLimiter_Timeout(t *testing.T) {
+	hl := newHostLimiter(1, 10*time.Millisecond)
+	release, err := hl.acquire("gateway:8080")
+	require.NoError(t, err)
+
+	_, err = hl.acquire("gateway:8080")
+	assert.Error(t, err, "the host has no slot left")
+	other, err := hl.acquire("other:8080")
+	require.NoError(t, err, "hosts are limited separately")
+	other()
+
+	release()
+	release()
+	release, err = hl.acquire("gateway:8080")
+	require.NoError(t, err, "the slot is released once")
+	release()
+}
@@ -0,0 +1,168 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// integerAttribute flags the gauges sent with an integer value.
+const integerAttribute = "integer"
+
+// maxExactInteger is the largest integer every smaller one can be
+// represented exactly as a float64.
+const maxExactInteger = 1 << 53
+
+// isInteger returns true if the gauge is sent with an integer value.
+func (te *TelemetryEmitter) isInteger(name string, value float64) bool {
+	if math.Trunc(value) != value || math.Abs(value) > maxExactInteger {
+		return false
+	}
+	for _, prefix := range te.integerGaugePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// gaugeAttributes returns the attributes of the gauge, flagged as an integer
+// if it is sent with an integer value.
+func (te *TelemetryEmitter) gaugeAttributes(name string, attrs map[string]interface{}, value float64) map[string]interface{} {
+	if !te.isInteger(name, value) {
+		return attrs
+	}
+	attrs = copyAttrs(attrs)
+	attrs[integerAttribute] = true
+	return attrs
+}
+
+// integerValuesHarvesterOpt rewrites the values of the gauges flagged as
+// integers in the payloads of the harvester, which encodes all the values as
+// floats, with an exponent from 1e6 on.
+func integerValuesHarvesterOpt() TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		rt := cfg.Client.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = integerValuesRoundTripper{rt: rt}
+	}
+}
+
+// integerValuesRoundTripper writes the values of the metrics flagged as
+// integers without decimals nor exponent.
+type integerValuesRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t integerValuesRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		return t.rt.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	gzipped := req.Header.Get("Content-Encoding") == "gzip"
+	if rewritten, err := rewriteIntegerValues(body, gzipped); err == nil {
+		body = rewritten
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// rewriteIntegerValues rewrites the values of the metrics flagged as
+// integers in the payload. The payload is returned as is if no metric is
+// flagged.
+func rewriteIntegerValues(body []byte, gzipped bool) ([]byte, error) {
+	decoded := body
+	if gzipped {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if decoded, err = ioutil.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+
+	var payloads []map[string]json.RawMessage
+	if err := json.Unmarshal(decoded, &payloads); err != nil {
+		return nil, err
+	}
+	rewritten := false
+	for _, payload := range payloads {
+		var metrics []map[string]json.RawMessage
+		if err := json.Unmarshal(payload["metrics"], &metrics); err != nil {
+			return nil, err
+		}
+		changed := false
+		for _, m := range metrics {
+			if value, ok := integerValue(m); ok {
+				m["value"] = value
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		b, err := json.Marshal(metrics)
+		if err != nil {
+			return nil, err
+		}
+		payload["metrics"] = b
+		rewritten = true
+	}
+	if !rewritten {
+		return body, nil
+	}
+
+	encoded, err := json.Marshal(payloads)
+	if err != nil || !gzipped {
+		return encoded, err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(encoded); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// integerValue returns the value of the metric as an integer literal, if
+// the metric is flagged as an integer.
+func integerValue(m map[string]json.RawMessage) (json.RawMessage, bool) {
+	var attrs struct {
+		Integer bool `json:"integer"`
+	}
+	if json.Unmarshal(m["attributes"], &attrs) != nil || !attrs.Integer {
+		return nil, false
+	}
+	value, err := strconv.ParseFloat(string(m["value"]), 64)
+	if err != nil || math.Trunc(value) != value {
+		return nil, false
+	}
+	return json.RawMessage(strconv.FormatFloat(value, 'f', -1, 64)), true
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestTelemetryEmitterIntegerGauges(t *testing.T) {
+	payloads := make(chan []byte, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+		payloads <- b
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	te, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL(api.URL),
+			TelemetryHarvesterWithHarvestPeriod(0),
+		},
+		IntegerGaugePrefixes: []string{"kube_"},
+	})
+	require.NoError(t, err)
+
+	attrs := labels.Set{"namespace": "default"}
+	require.NoError(t, te.Emit([]Metric{
+		{name: "kube_pod_count", metricType: metricType_GAUGE, value: 1234567, attributes: attrs},
+		{name: "kube_cpu_ratio", metricType: metricType_GAUGE, value: 0.5, attributes: attrs},
+		{name: "node_memory_bytes", metricType: metricType_GAUGE, value: 1234567, attributes: attrs},
+	}))
+	te.harvester.HarvestNow(context.Background())
+	payload := <-payloads
+
+	var decoded []struct {
+		Metrics []struct {
+			Name       string                 `json:"name"`
+			Value      json.RawMessage        `json:"value"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"metrics"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &decoded))
+	require.Len(t, decoded, 1)
+	values := map[string]string{}
+	for _, m := range decoded[0].Metrics {
+		values[m.Name] = string(m.Value)
+		if m.Name == "kube_pod_count" {
+			assert.Equal(t, true, m.Attributes["integer"])
+		} else {
+			assert.NotContains(t, m.Attributes, "integer")
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"kube_pod_count":    "1234567",
+		"kube_cpu_ratio":    "0.5",
+		"node_memory_bytes": "1.234567e+06",
+	}, values)
+	assert.NotContains(t, attrs, "integer", "the attributes of the metric are not modified")
+}
@@ -24,6 +24,42 @@ var (
 
 var ilog = logrus.WithField("component", "integration.Execute")
 
+// ExecuteOption configures the integration loop.
+type ExecuteOption func(*execution)
+
+// execution holds the state kept by the integration loop between runs.
+type execution struct {
+	changes *targetChanges
+	// series is nil unless the series tracking is enabled.
+	series *seriesTracker
+	// emitQueueSize is the size of the queue between the processing and the
+	// emitters. It is not used if 0.
+	emitQueueSize   int
+	emitQueuePolicy QueuePolicy
+	// static is nil unless static metrics are configured.
+	static *StaticMetrics
+	// summary is nil unless the runs are reported to a harvest summary.
+	summary *HarvestSummary
+	// onChange is nil unless gauges are reported on change.
+	onChange *changeReporter
+	// stale is nil unless the series that disappear are emitted as stale.
+	stale *staleTracker
+	// sampler is nil unless a sample of the emitted metrics is logged.
+	sampler *metricSampler
+	// coercions is nil unless the type coercions are reported.
+	coercions *TypeCoercions
+	// watchdog is nil unless an alarm is enabled.
+	watchdog *watchdog
+}
+
+func newExecution(opts ...ExecuteOption) *execution {
+	e := &execution{changes: newTargetChanges()}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
 // Execute the integration loop. It sets the retrievers to start watching for
 // new targets and starts the processing pipeline. The pipeline fetches
 // metrics from the registered targets, transforms them according to a set
@@ -37,7 +73,9 @@ func Execute(
 	fetcher Fetcher,
 	processor Processor,
 	emitters []Emitter,
+	opts ...ExecuteOption,
 ) {
+	exec := newExecution(opts...)
 	for _, retriever := range retrievers {
 		err := retriever.Watch()
 		if err != nil {
@@ -52,7 +90,7 @@ func Execute(
 		totalTimeseriesByTypeMetric.Reset()
 
 		startTime := time.Now()
-		process(retrievers, fetcher, processor, emitters)
+		process(retrievers, fetcher, processor, emitters, exec)
 		totalExecutionsMetric.Inc()
 		if duration := time.Since(startTime); duration < scrapeDuration {
 			time.Sleep(scrapeDuration - duration)
@@ -61,6 +99,24 @@ func Execute(
 	}
 }
 
+// ExecuteOnce runs a single iteration of the integration loop: it gets the
+// initial list of targets of the retrievers, fetches their metrics,
+// processes them and passes them to the emitters.
+func ExecuteOnce(
+	retrievers []endpoints.TargetRetriever,
+	fetcher Fetcher,
+	processor Processor,
+	emitters []Emitter,
+) {
+	for _, retriever := range retrievers {
+		err := retriever.Watch()
+		if err != nil {
+			ilog.WithError(err).WithField("retriever", retriever.Name()).Error("while getting the initial list of targets")
+		}
+	}
+	process(retrievers, fetcher, processor, emitters, nil)
+}
+
 // processWithoutTelemetry processes a target retriever without doing any
 // kind of telemetry calculation.
 func processWithoutTelemetry(
@@ -86,38 +142,124 @@ func processWithoutTelemetry(
 	}
 }
 
-func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor Processor, emitters []Emitter) {
+// process scrapes the targets of the retrievers, reporting the changes of the
+// targets and series between runs if exec is not nil.
+func process(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor Processor, emitters []Emitter, exec *execution) {
 	ptimer := prometheus.NewTimer(prometheus.ObserverFunc(processDurationMetric.Set))
+	var run *harvestRun
+	if exec != nil && exec.summary != nil {
+		run = newHarvestRun()
+		defer run.finish(exec.summary)
+	}
 
 	targets := make([]endpoints.Target, 0)
+	discovered := map[string]int{}
+	var changeMetrics []Metric
 	for _, retriever := range retrievers {
 		totalDiscoveriesMetric.WithLabelValues(retriever.Name()).Set(1)
 		t, err := retriever.GetTargets()
 		if err != nil {
 			ilog.WithError(err).Error("error getting targets")
 			totalErrorsDiscoveryMetric.WithLabelValues(retriever.Name()).Set(1)
+			if run != nil {
+				run.report.DiscoveryErrors++
+			}
 			return
 		}
 		totalTargetsMetric.WithLabelValues(retriever.Name()).Set(float64(len(t)))
 		targets = append(targets, t...)
+		discovered[retriever.Name()] += len(t)
+		if exec != nil {
+			changeMetrics = append(changeMetrics, exec.changes.update(retriever.Name(), t)...)
+		}
+	}
+	emitStats(emitters, changeMetrics, "target change")
+	if exec != nil && exec.static != nil {
+		emitStats(emitters, exec.static.harvest(), "static")
+	}
+	if run != nil {
+		run.report.Targets = len(targets)
 	}
 	pairs := fetcher.Fetch(targets) // fetch metrics from /metrics endpoints
 	processed := processor(pairs)   // apply processing
+	if exec != nil && exec.emitQueueSize > 0 {
+		processed = emitQueue(processed, exec.emitQueueSize, exec.emitQueuePolicy)
+	}
 
 	timers := map[string]*prometheus.Timer{}
 	for _, e := range emitters {
 		timers[e.Name()] = prometheus.NewTimer(prometheus.ObserverFunc(emitTotalDurationMetric.WithLabelValues(e.Name()).Set))
 	}
 	for pair := range processed {
+		if exec != nil && exec.series != nil {
+			exec.series.observe(pair.Target.Name, pair.Metrics)
+		}
+		var stale []Metric
+		if exec != nil && exec.stale != nil {
+			stale = exec.stale.observe(pair.Target.Name, pair.Metrics, pair.Partial)
+		}
+		if exec != nil && exec.coercions != nil {
+			exec.coercions.observe(pair.Metrics)
+		}
+		if exec != nil && exec.onChange != nil {
+			pair.Metrics = exec.onChange.filter(pair.Target.Name, pair.Metrics)
+		}
+		pair.Metrics = append(pair.Metrics, stale...)
+		if exec != nil && exec.sampler != nil {
+			exec.sampler.observe(pair.Metrics)
+		}
+		if run != nil {
+			if !pair.Partial {
+				run.report.TargetsScraped++
+			}
+			run.report.SeriesEmitted += len(pair.Metrics)
+		}
 		for _, e := range emitters {
 			err := e.Emit(pair.Metrics)
+			countEmitDropped(&pair, e, err)
 			if err != nil {
 				ilog.WithField("emitter", e.Name()).WithError(err).Warn("error emitting metrics")
+				if run != nil {
+					run.report.EmitErrors++
+				}
 			}
 		}
 	}
+	if exec != nil && exec.series != nil {
+		emitStats(emitters, exec.series.harvest(), "series growth")
+	}
+	if exec != nil && exec.onChange != nil {
+		exec.onChange.endRun()
+	}
+	if exec != nil && exec.stale != nil {
+		exec.stale.endRun(targets)
+	}
+	if exec != nil && exec.sampler != nil {
+		exec.sampler.flush()
+	}
+	if exec != nil && exec.coercions != nil {
+		exec.coercions.endRun()
+	}
+	if exec != nil && exec.watchdog != nil {
+		emitStats(emitters, exec.watchdog.check(retrievers, discovered, emitters), "watchdog")
+	}
+	endHarvest(emitters)
 	for _, t := range timers {
 		t.ObserveDuration()
 	}
 	ptimer.ObserveDuration()
 }
+
+// emitStats emits the metrics generated by the integration itself, if any.
+func emitStats(emitters []Emitter, metrics []Metric, kind string) {
+	if len(metrics) == 0 {
+		return
+	}
+	for _, e := range emitters {
+		if err := e.Emit(metrics); err != nil {
+			ilog.WithField("emitter", e.Name()).WithError(err).Warnf("error emitting %s metrics", kind)
+		}
+		// The integration metrics aren't accounted to any job.
+		takeShedMetrics(e)
+	}
+}
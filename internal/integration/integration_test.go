@@ -59,5 +59,6 @@ func do(b *testing.B, retrievers []endpoints.TargetRetriever) {
 		NewFetcher(30*time.Second, 5000000000, 4, "", "", false, queueLength),
 		RuleProcessor([]ProcessingRule{}, queueLength),
 		[]Emitter{&nilEmit{}},
+		nil,
 	)
 }
@@ -0,0 +1,153 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// JobTransport replaces the global TLS, proxy and connection settings for
+// the scrapes of the targets of a job.
+type JobTransport struct {
+	// CaFile and BearerTokenFile replace the global ca_file and
+	// bearer_token_file when set, and InsecureSkipVerify the global
+	// insecure_skip_verify when not nil.
+	CaFile             string `mapstructure:"ca_file"`
+	InsecureSkipVerify *bool  `mapstructure:"insecure_skip_verify"`
+	BearerTokenFile    string `mapstructure:"bearer_token_file"`
+	// ProxyURL is the HTTP proxy the scrapes go through. The targets with a
+	// gateway don't use it.
+	ProxyURL string `mapstructure:"proxy_url"`
+	// MaxIdleConnsPerHost defaults to 1000, and MaxConnsPerHost to 0, which
+	// doesn't limit them.
+	MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int `mapstructure:"max_conns_per_host"`
+}
+
+// Validate returns an error if the proxy URL is not valid, or a limit is
+// negative.
+func (t JobTransport) Validate() error {
+	if t.ProxyURL != "" {
+		u, err := url.Parse(t.ProxyURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid proxy_url %q", t.ProxyURL)
+		}
+	}
+	if t.MaxIdleConnsPerHost < 0 || t.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max_idle_conns_per_host and max_conns_per_host can't be negative")
+	}
+	return nil
+}
+
+// jobClient is the HTTP client of the scrapes of a job, with the settings
+// the other clients of the job, like the ones of the targets with mutual
+// TLS or a gateway, are built with. Every job has its own clients, so no
+// connection or setting is shared between jobs.
+type jobClient struct {
+	name            string
+	httpClient      *http.Client
+	tlsConfig       *tls.Config
+	bearerTokenFile string
+	proxy           func(*http.Request) (*url.URL, error)
+	transport       JobTransport
+	timeouts        ScrapeTimeouts
+	// passthrough forwards the raw payloads of the job with the
+	// forwardClient, if not empty.
+	passthrough   RawPassthrough
+	forwardClient *http.Client
+}
+
+// newJobClient creates the client of a job from the global settings
+// replaced by the ones of its transport. An invalid CA file is logged and
+// the default TLS configuration is used, as for the global one.
+func (pf *prometheusFetcher) newJobClient(name string, transport JobTransport, caFile, bearerTokenFile string, insecureSkipVerify bool) *jobClient {
+	if transport.CaFile != "" {
+		caFile = transport.CaFile
+	}
+	if transport.InsecureSkipVerify != nil {
+		insecureSkipVerify = *transport.InsecureSkipVerify
+	}
+	if transport.BearerTokenFile != "" {
+		bearerTokenFile = transport.BearerTokenFile
+	}
+	c := &jobClient{name: name, bearerTokenFile: bearerTokenFile, transport: transport, timeouts: pf.timeouts}
+	if transport.ProxyURL != "" {
+		if u, err := url.Parse(transport.ProxyURL); err == nil {
+			c.proxy = http.ProxyURL(u)
+		}
+	}
+
+	var rt http.RoundTripper
+	tlsConfig, err := NewTLSConfig(caFile, insecureSkipVerify, pf.additionalCAFiles...)
+	if err != nil {
+		pf.log.WithError(err).WithField("job", name).Error("invalid TLS configuration, using the default one")
+	} else {
+		rt = c.newTransport(tlsConfig, true)
+		if bearerTokenFile != "" {
+			rt = NewBearerAuthFileRoundTripper(bearerTokenFile, rt)
+		}
+	}
+	c.tlsConfig = tlsConfig
+	c.httpClient = &http.Client{
+		Transport: rt,
+		Timeout:   pf.fetchTimeout,
+	}
+	return c
+}
+
+// newTransport returns a transport of the job with the TLS configuration
+// and the scrape timeouts, using its proxy if proxied.
+func (c *jobClient) newTransport(tlsConfig *tls.Config, proxied bool) *http.Transport {
+	transport := newDefaultRoundTripper(tlsConfig).(*http.Transport)
+	if proxied {
+		transport.Proxy = c.proxy
+	}
+	if c.transport.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.transport.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = c.transport.MaxConnsPerHost
+	c.timeouts.apply(transport)
+	return transport
+}
+
+// jobClient returns the client of the job of the target, the first one it
+// matches, or the one of the default job.
+func (pf *prometheusFetcher) jobClient(t *endpoints.Target) *jobClient {
+	for _, job := range pf.scrapeJobs {
+		if matchesMetadata(t, job.Match) {
+			if c, ok := pf.jobClients[job.Name]; ok {
+				return c
+			}
+			break
+		}
+	}
+	return pf.jobClients[defaultScrapeJob]
+}
+
+// newJobClients creates the clients of the jobs, and the one of the default
+// job with the global settings.
+func (pf *prometheusFetcher) newJobClients(caFile, bearerTokenFile string, insecureSkipVerify bool) {
+	pf.jobClients = map[string]*jobClient{
+		defaultScrapeJob: pf.newJobClient(defaultScrapeJob, JobTransport{}, caFile, bearerTokenFile, insecureSkipVerify),
+	}
+	for _, job := range pf.scrapeJobs {
+		c := pf.newJobClient(job.Name, job.Transport, caFile, bearerTokenFile, insecureSkipVerify)
+		if !job.RawPassthrough.IsEmpty() {
+			c.passthrough = job.RawPassthrough
+			c.forwardClient = &http.Client{Timeout: pf.fetchTimeout}
+		}
+		pf.jobClients[job.Name] = c
+	}
+}
+
+// clientKey prefixes the key of a shared client with the job, so clients
+// are never shared between jobs.
+func (c *jobClient) clientKey(key string) string {
+	return c.name + "|" + key
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestJobTransport_Validate(t *testing.T) {
+	assert.NoError(t, JobTransport{}.Validate())
+	assert.NoError(t, JobTransport{ProxyURL: "http://proxy:3128", MaxConnsPerHost: 10}.Validate())
+	assert.Error(t, JobTransport{ProxyURL: "proxy"}.Validate())
+	assert.Error(t, JobTransport{MaxIdleConnsPerHost: -1}.Validate())
+	assert.Error(t, ValidateScrapeJobs([]ScrapeJob{{Name: "a", Transport: JobTransport{MaxConnsPerHost: -1}}}))
+}
+
+func TestFetcher_JobClients(t *testing.T) {
+	var mu sync.Mutex
+	authorizations := map[string]string{}
+	var proxied []string
+	handler := func(proxy bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			if proxy {
+				proxied = append(proxied, r.URL.Query().Get("target"))
+			}
+			authorizations[r.URL.Query().Get("target")] = r.Header.Get("Authorization")
+			mu.Unlock()
+			_, _ = w.Write([]byte("up 1\n"))
+		}
+	}
+	ts := httptest.NewServer(handler(false))
+	defer ts.Close()
+	proxy := httptest.NewServer(handler(true))
+	defer proxy.Close()
+
+	dir, err := ioutil.TempDir("", "jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	token := func(name, value string) string {
+		file := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(file, []byte(value), 0600))
+		return file
+	}
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, token("global", "global-token"), "", false, queueLength,
+		WithScrapeJobs(
+			ScrapeJob{Name: "payments", Match: map[string]string{"namespaceName": "payments"}, Transport: JobTransport{BearerTokenFile: token("payments", "payments-token")}},
+			ScrapeJob{Name: "edge", Match: map[string]string{"namespaceName": "edge"}, Transport: JobTransport{ProxyURL: proxy.URL}},
+		))
+
+	target := func(namespace string) endpoints.Target {
+		u, err := url.Parse(ts.URL + "/metrics?target=" + namespace)
+		require.NoError(t, err)
+		return endpoints.New(namespace, *u, endpoints.Object{Name: namespace, Kind: "pod", Labels: labels.Set{"namespaceName": namespace}})
+	}
+	var fetched int
+	for range fetcher.Fetch([]endpoints.Target{target("payments"), target("edge"), target("other")}) {
+		fetched++
+	}
+	assert.Equal(t, 3, fetched)
+
+	assert.Equal(t, map[string]string{
+		"payments": "Bearer payments-token",
+		"edge":     "Bearer global-token",
+		"other":    "Bearer global-token",
+	}, authorizations)
+	assert.Equal(t, []string{"edge"}, proxied, "only the edge job goes through the proxy")
+
+	jobClients := fetcher.(*prometheusFetcher).jobClients
+	assert.NotSame(t, jobClients["payments"].httpClient.Transport, jobClients[defaultScrapeJob].httpClient.Transport)
+}
@@ -0,0 +1,294 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/remotewrite"
+)
+
+// Kafka message formats.
+const (
+	// KafkaFormatJSON encodes the metrics as a JSON array of objects with
+	// their name, type, value, attributes and timestamp.
+	KafkaFormatJSON = "json"
+	// KafkaFormatProtobuf encodes the metrics as a Prometheus remote write
+	// WriteRequest, not compressed.
+	KafkaFormatProtobuf = "protobuf"
+)
+
+// Kafka SASL mechanisms.
+const (
+	KafkaSASLPlain       = "plain"
+	KafkaSASLScramSHA256 = "scram-sha-256"
+	KafkaSASLScramSHA512 = "scram-sha-512"
+)
+
+const (
+	defaultKafkaPartitionKey = "targetName"
+	defaultKafkaTimeout      = 10 * time.Second
+	// kafkaMaxMetricsPerMessage bounds the size of the messages, as the
+	// brokers reject the ones bigger than 1MB by default.
+	kafkaMaxMetricsPerMessage = 1000
+	// kafkaBatchTimeout is how long the writer waits for more messages
+	// before sending a batch.
+	kafkaBatchTimeout = 100 * time.Millisecond
+)
+
+// KafkaConfig configures the KafkaEmitter.
+type KafkaConfig struct {
+	// Brokers used to discover the partitions of the topic.
+	Brokers []string `mapstructure:"brokers"`
+	// Topic the metrics are produced to.
+	Topic string `mapstructure:"topic"`
+	// Format of the messages, json or protobuf. Defaults to json.
+	Format string `mapstructure:"format"`
+	// PartitionKey is the attribute whose value is the key of the messages,
+	// so the metrics with the same value go to the same partition. Defaults
+	// to targetName.
+	PartitionKey string `mapstructure:"partition_key"`
+	// Timeout of the writes of every emission. Defaults to 10s.
+	Timeout time.Duration   `mapstructure:"timeout"`
+	TLS     KafkaTLSConfig  `mapstructure:"tls"`
+	SASL    KafkaSASLConfig `mapstructure:"sasl"`
+}
+
+// KafkaTLSConfig configures the TLS connections to the brokers.
+type KafkaTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// KafkaSASLConfig configures the SASL authentication to the brokers.
+type KafkaSASLConfig struct {
+	// Mechanism is plain, scram-sha-256 or scram-sha-512. SASL is disabled
+	// if empty.
+	Mechanism string `mapstructure:"mechanism"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+}
+
+// Validate returns an error if the configuration is not complete.
+func (c KafkaConfig) Validate() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("the kafka emitter requires kafka.brokers")
+	}
+	if c.Topic == "" {
+		return fmt.Errorf("the kafka emitter requires a kafka.topic")
+	}
+	switch c.Format {
+	case "", KafkaFormatJSON, KafkaFormatProtobuf:
+	default:
+		return fmt.Errorf("invalid kafka format %q, must be %s or %s", c.Format, KafkaFormatJSON, KafkaFormatProtobuf)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("the kafka TLS cert_file and key_file must be set together")
+	}
+	if _, err := c.SASL.mechanism(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// mechanism returns the SASL mechanism of the configuration, or nil if SASL
+// is disabled.
+func (c KafkaSASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch c.Mechanism {
+	case "":
+		return nil, nil
+	case KafkaSASLPlain:
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case KafkaSASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case KafkaSASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	default:
+		return nil, fmt.Errorf("invalid kafka SASL mechanism %q, must be %s, %s or %s", c.Mechanism, KafkaSASLPlain, KafkaSASLScramSHA256, KafkaSASLScramSHA512)
+	}
+}
+
+// tlsConfig returns the TLS configuration of the connections, or nil if TLS
+// is disabled.
+func (c KafkaTLSConfig) tlsConfig() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	tlsConfig, err := NewTLSConfig(c.CAFile, c.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading kafka client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// messageWriter writes messages to a Kafka topic.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaEmitter produces the metrics to a Kafka topic, decoupling the scrapes
+// from the ingestion, so the metrics can be replayed, e.g. after an outage
+// of the Metric API. The metrics of every emission are grouped in messages
+// by the value of their partition key attribute.
+type KafkaEmitter struct {
+	name         string
+	writer       messageWriter
+	format       string
+	contentType  string
+	partitionKey string
+	timeout      time.Duration
+	now          func() time.Time
+}
+
+// NewKafkaEmitter returns a KafkaEmitter of the configuration.
+func NewKafkaEmitter(cfg KafkaConfig) (*KafkaEmitter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := cfg.SASL.mechanism()
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultKafkaTimeout
+	}
+	writer := kafka.NewWriter(kafka.WriterConfig{
+		Brokers: cfg.Brokers,
+		Topic:   cfg.Topic,
+		Dialer: &kafka.Dialer{
+			Timeout:       timeout,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: kafkaBatchTimeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	})
+	return newKafkaEmitter(cfg, writer), nil
+}
+
+func newKafkaEmitter(cfg KafkaConfig, writer messageWriter) *KafkaEmitter {
+	ke := &KafkaEmitter{
+		name:         "kafka",
+		writer:       writer,
+		format:       cfg.Format,
+		contentType:  "application/json",
+		partitionKey: cfg.PartitionKey,
+		timeout:      cfg.Timeout,
+		now:          time.Now,
+	}
+	if ke.format == "" {
+		ke.format = KafkaFormatJSON
+	}
+	if ke.format == KafkaFormatProtobuf {
+		ke.contentType = "application/x-protobuf"
+	}
+	if ke.partitionKey == "" {
+		ke.partitionKey = defaultKafkaPartitionKey
+	}
+	if ke.timeout == 0 {
+		ke.timeout = defaultKafkaTimeout
+	}
+	return ke
+}
+
+// Name is the KafkaEmitter name.
+func (ke *KafkaEmitter) Name() string {
+	return ke.name
+}
+
+// Emit writes the metrics to the topic, in messages of up to 1000 metrics
+// with the same partition key.
+func (ke *KafkaEmitter) Emit(metrics []Metric) error {
+	now := ke.now()
+	var keys []string
+	byKey := map[string][]Metric{}
+	for _, m := range metrics {
+		key := ""
+		if v, ok := m.attributes[ke.partitionKey]; ok {
+			key = fmt.Sprint(v)
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], m)
+	}
+
+	var msgs []kafka.Message
+	for _, key := range keys {
+		keyed := byKey[key]
+		for len(keyed) > 0 {
+			chunk := keyed
+			if len(chunk) > kafkaMaxMetricsPerMessage {
+				chunk = chunk[:kafkaMaxMetricsPerMessage]
+			}
+			value, err := ke.encode(chunk, now)
+			if err != nil {
+				return err
+			}
+			msg := kafka.Message{
+				Value:   value,
+				Headers: []kafka.Header{{Key: "content-type", Value: []byte(ke.contentType)}},
+				Time:    now,
+			}
+			if key != "" {
+				msg.Key = []byte(key)
+			}
+			msgs = append(msgs, msg)
+			keyed = keyed[len(chunk):]
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ke.timeout)
+	defer cancel()
+	if err := ke.writer.WriteMessages(ctx, msgs...); err != nil {
+		return fmt.Errorf("writing metrics to kafka: %w", err)
+	}
+	return nil
+}
+
+// encode returns the value of the message of the metrics. The metrics
+// without timestamp are encoded with the given time.
+func (ke *KafkaEmitter) encode(metrics []Metric, now time.Time) ([]byte, error) {
+	if ke.format == KafkaFormatProtobuf {
+		req := &remotewrite.WriteRequest{Timeseries: remoteWriteSeries(metrics, now)}
+		return req.Marshal(), nil
+	}
+	records := make([]metricRecord, 0, len(metrics))
+	for _, m := range metrics {
+		timestamp := now
+		if !m.timestamp.IsZero() {
+			timestamp = m.timestamp
+		}
+		records = append(records, newMetricRecord(m, timestamp))
+	}
+	return json.Marshal(records)
+}
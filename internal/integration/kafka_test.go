@@ -0,0 +1,115 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/remotewrite"
+)
+
+type fakeMessageWriter struct {
+	msgs []kafka.Message
+	err  error
+}
+
+func (f *fakeMessageWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	f.msgs = append(f.msgs, msgs...)
+	return f.err
+}
+
+func (f *fakeMessageWriter) Close() error {
+	return nil
+}
+
+func TestKafkaEmitter_JSON(t *testing.T) {
+	writer := &fakeMessageWriter{}
+	ke := newKafkaEmitter(KafkaConfig{}, writer)
+	now := time.Unix(1600000000, 0).UTC()
+	ke.now = func() time.Time { return now }
+
+	require.NoError(t, ke.Emit([]Metric{
+		{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"targetName": "a"}},
+		{name: "up", metricType: metricType_GAUGE, value: 0, attributes: labels.Set{"targetName": "b"}},
+		{name: "requests_total", metricType: metricType_COUNTER, value: 7, attributes: labels.Set{"targetName": "a"}},
+	}))
+
+	require.Len(t, writer.msgs, 2, "a message by partition key")
+	assert.Equal(t, "a", string(writer.msgs[0].Key))
+	assert.Equal(t, "b", string(writer.msgs[1].Key))
+	assert.Equal(t, []kafka.Header{{Key: "content-type", Value: []byte("application/json")}}, writer.msgs[0].Headers)
+
+	var records []metricRecord
+	require.NoError(t, json.Unmarshal(writer.msgs[0].Value, &records))
+	require.Len(t, records, 2)
+	assert.Equal(t, "up", records[0].Name)
+	assert.Equal(t, metricType_GAUGE, records[0].Type)
+	assert.Equal(t, 1.0, records[0].Value)
+	assert.Equal(t, "a", records[0].Attributes["targetName"])
+	assert.True(t, now.Equal(*records[0].Timestamp))
+	assert.Equal(t, "requests_total", records[1].Name)
+}
+
+func TestKafkaEmitter_Protobuf(t *testing.T) {
+	writer := &fakeMessageWriter{}
+	ke := newKafkaEmitter(KafkaConfig{Format: KafkaFormatProtobuf, PartitionKey: "namespace"}, writer)
+
+	require.NoError(t, ke.Emit([]Metric{
+		{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"namespace": "shop"}},
+	}))
+
+	require.Len(t, writer.msgs, 1)
+	assert.Equal(t, "shop", string(writer.msgs[0].Key))
+	req, err := remotewrite.Unmarshal(writer.msgs[0].Value)
+	require.NoError(t, err)
+	require.Len(t, req.Timeseries, 1)
+	assert.Equal(t, []remotewrite.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "shop"}}, req.Timeseries[0].Labels)
+}
+
+func TestKafkaEmitter_Chunks(t *testing.T) {
+	writer := &fakeMessageWriter{}
+	ke := newKafkaEmitter(KafkaConfig{}, writer)
+	metrics := make([]Metric, 2500)
+	for i := range metrics {
+		metrics[i] = Metric{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{}}
+	}
+
+	require.NoError(t, ke.Emit(metrics))
+	require.Len(t, writer.msgs, 3)
+	assert.Nil(t, writer.msgs[0].Key, "metrics without partition key have no key")
+}
+
+func TestKafkaEmitter_Error(t *testing.T) {
+	ke := newKafkaEmitter(KafkaConfig{}, &fakeMessageWriter{err: errors.New("broker down")})
+	err := ke.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broker down")
+}
+
+func TestKafkaConfig_Validate(t *testing.T) {
+	valid := KafkaConfig{Brokers: []string{"kafka:9092"}, Topic: "metrics"}
+	assert.NoError(t, valid.Validate())
+	assert.Error(t, KafkaConfig{Topic: "metrics"}.Validate())
+	assert.Error(t, KafkaConfig{Brokers: []string{"kafka:9092"}}.Validate())
+
+	c := valid
+	c.Format = "avro"
+	assert.Error(t, c.Validate())
+	c = valid
+	c.SASL = KafkaSASLConfig{Mechanism: KafkaSASLScramSHA512, Username: "scraper", Password: "secret"}
+	assert.NoError(t, c.Validate())
+	c.SASL.Mechanism = "gssapi"
+	assert.Error(t, c.Validate())
+	c = valid
+	c.TLS = KafkaTLSConfig{Enabled: true, CertFile: "client.pem"}
+	assert.Error(t, c.Validate())
+}
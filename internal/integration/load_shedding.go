@@ -0,0 +1,131 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+// loadShedder tracks the result of the requests sent by the harvester and
+// switches to a degraded mode after a number of consecutive failures. In
+// degraded mode only a sample of the gauges are recorded, while the counters
+// only update the delta calculator, so the harvester doesn't buffer metrics
+// that can't be sent and the deltas are right once the emission recovers.
+//
+// The harvester doesn't send empty batches, so the emissions may record
+// nothing in degraded mode, and no request would succeed to recover. An
+// emission is recorded in full every loadSheddingProbeInterval to probe the
+// recovery.
+type loadShedder struct {
+	emitter string
+	// failuresThreshold is the number of consecutive failed requests that
+	// trigger the degraded mode.
+	failuresThreshold int
+	// gaugeSampleRate is the fraction of Emit calls, as 1 in gaugeSampleRate,
+	// whose gauges are recorded in degraded mode.
+	gaugeSampleRate int
+
+	mu        sync.Mutex
+	failures  int
+	degraded  bool
+	emits     int
+	lastProbe time.Time
+	now       func() time.Time
+}
+
+// loadSheddingProbeInterval is how often an emission is recorded in full in
+// degraded mode.
+const loadSheddingProbeInterval = time.Minute
+
+func newLoadShedder(emitter string, failuresThreshold, gaugeSampleRate int) *loadShedder {
+	if gaugeSampleRate < 1 {
+		gaugeSampleRate = 1
+	}
+	return &loadShedder{
+		emitter:           emitter,
+		failuresThreshold: failuresThreshold,
+		gaugeSampleRate:   gaugeSampleRate,
+		now:               time.Now,
+	}
+}
+
+// observe records the result of a request sent by the harvester.
+func (ls *loadShedder) observe(failed bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if !failed {
+		ls.failures = 0
+		if ls.degraded {
+			ls.degraded = false
+			emitterDegradedMetric.WithLabelValues(ls.emitter).Set(0)
+			ilog.WithField("emitter", ls.emitter).Info("emission recovered, leaving the degraded mode")
+		}
+		return
+	}
+	ls.failures++
+	if !ls.degraded && ls.failures >= ls.failuresThreshold {
+		ls.degraded = true
+		ls.lastProbe = ls.now()
+		emitterDegradedMetric.WithLabelValues(ls.emitter).Set(1)
+		ilog.WithField("emitter", ls.emitter).Warnf("%d consecutive emission failures, entering the degraded mode", ls.failures)
+	}
+}
+
+// startEmit returns whether the emission is degraded and, if so, whether the
+// gauges of this Emit call are sampled. The probes of the recovery aren't
+// degraded.
+func (ls *loadShedder) startEmit() (degraded, sampleGauges bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if !ls.degraded {
+		return false, true
+	}
+	if now := ls.now(); now.Sub(ls.lastProbe) >= loadSheddingProbeInterval {
+		ls.lastProbe = now
+		return false, true
+	}
+	ls.emits++
+	return true, ls.emits%ls.gaugeSampleRate == 0
+}
+
+// shed counts the metrics not recorded because of the degraded mode.
+func (ls *loadShedder) shed(mtype metricType) {
+	emitterShedMetricsMetric.WithLabelValues(ls.emitter, string(mtype)).Inc()
+}
+
+// harvesterOpt wraps the harvester client transport to track its requests.
+// It must be the last option, to see the results of the whole chain.
+func (ls *loadShedder) harvesterOpt() TelemetryHarvesterOpt {
+	return trackHarvesterRequests(ls.observe)
+}
+
+// trackHarvesterRequests returns a harvester option that wraps the client
+// transport to report whether every request failed. Requests fail with an
+// error or a status code other than 2xx.
+func trackHarvesterRequests(observe func(failed bool)) TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		rt := cfg.Client.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = failureTrackingRoundTripper{observe: observe, rt: rt}
+	}
+}
+
+// failureTrackingRoundTripper reports the result of every request.
+type failureTrackingRoundTripper struct {
+	observe func(failed bool)
+	rt      http.RoundTripper
+}
+
+// RoundTrip sends the request, recording whether it failed.
+func (t failureTrackingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	t.observe(err != nil || resp.StatusCode >= http.StatusMultipleChoices)
+	return resp, err
+}
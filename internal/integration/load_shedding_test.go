@@ -0,0 +1,165 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestLoadShedderObserve(t *testing.T) {
+	ls := newLoadShedder("test-observe", 3, 2)
+
+	ls.observe(true)
+	ls.observe(true)
+	ls.observe(false)
+	ls.observe(true)
+	ls.observe(true)
+	degraded, _ := ls.startEmit()
+	assert.False(t, degraded, "failures must be consecutive")
+
+	ls.observe(true)
+	degraded, sampleGauges := ls.startEmit()
+	assert.True(t, degraded)
+	assert.False(t, sampleGauges)
+	degraded, sampleGauges = ls.startEmit()
+	assert.True(t, degraded)
+	assert.True(t, sampleGauges)
+	assert.Equal(t, float64(1), testutil.ToFloat64(emitterDegradedMetric.WithLabelValues("test-observe")))
+
+	ls.observe(false)
+	degraded, sampleGauges = ls.startEmit()
+	assert.False(t, degraded)
+	assert.True(t, sampleGauges)
+	assert.Equal(t, float64(0), testutil.ToFloat64(emitterDegradedMetric.WithLabelValues("test-observe")))
+}
+
+func TestLoadShedderProbe(t *testing.T) {
+	now := time.Now()
+	ls := newLoadShedder("test-probe", 1, 1000)
+	ls.now = func() time.Time { return now }
+
+	// Nothing is recorded in degraded mode, so no request is sent.
+	ls.observe(true)
+	degraded, sampleGauges := ls.startEmit()
+	assert.True(t, degraded)
+	assert.False(t, sampleGauges)
+
+	now = now.Add(loadSheddingProbeInterval)
+	degraded, _ = ls.startEmit()
+	assert.False(t, degraded, "the probe must be recorded in full")
+	degraded, _ = ls.startEmit()
+	assert.True(t, degraded, "only one emission is a probe")
+
+	// The request of the probe succeeds.
+	ls.observe(false)
+	degraded, _ = ls.startEmit()
+	assert.False(t, degraded)
+}
+
+func TestTelemetryEmitterLoadShedding(t *testing.T) {
+	for _, preEncode := range []bool{false, true} {
+		t.Run(map[bool]string{false: "default", true: "pre-encoded"}[preEncode], func(t *testing.T) {
+			testTelemetryEmitterLoadShedding(t, preEncode)
+		})
+	}
+}
+
+func testTelemetryEmitterLoadShedding(t *testing.T, preEncode bool) {
+	status := http.StatusRequestEntityTooLarge
+	var sent []map[string]interface{}
+	c := TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					var payload []map[string]interface{}
+					reader, err := gzip.NewReader(req.Body)
+					require.NoError(t, err)
+					require.NoError(t, json.NewDecoder(reader).Decode(&payload))
+					require.Len(t, payload, 1)
+					metrics, ok := payload[0]["metrics"].([]interface{})
+					require.True(t, ok)
+					sent = nil
+					for _, m := range metrics {
+						sent = append(sent, m.(map[string]interface{}))
+					}
+					return emptyResponse(status), nil
+				})
+			},
+		},
+		PreEncodeAttributes:         preEncode,
+		LoadSheddingFailures:        2,
+		LoadSheddingGaugeSampleRate: 2,
+	}
+	e, err := NewTelemetryEmitter(c)
+	require.NoError(t, err)
+
+	counter := float64(0)
+	emit := func() {
+		counter += 10
+		require.NoError(t, e.Emit([]Metric{
+			{
+				name:       "gauge",
+				metricType: metricType_GAUGE,
+				value:      1,
+				attributes: labels.Set{"targetName": "target-a"},
+			},
+			{
+				name:       "counter",
+				metricType: metricType_COUNTER,
+				value:      counter,
+				attributes: labels.Set{"targetName": "target-a"},
+			},
+		}))
+		sent = nil
+		e.harvester.HarvestNow(context.Background())
+	}
+	names := func() []string {
+		var names []string
+		for _, m := range sent {
+			names = append(names, m["name"].(string))
+		}
+		return names
+	}
+
+	// The first counter value only initializes its delta.
+	emit()
+	assert.Equal(t, []string{"gauge"}, names())
+	emit()
+	assert.ElementsMatch(t, []string{"gauge", "counter"}, names())
+	assert.True(t, e.shedder.degraded)
+
+	assert.Equal(t, 3, takeShedMetrics(e), "the metrics of the payloads rejected as too large")
+
+	// Degraded: the counters are shed and the gauges sampled.
+	emit()
+	assert.Empty(t, names())
+	assert.Equal(t, 2, takeShedMetrics(e))
+	status = http.StatusAccepted
+	emit()
+	assert.Equal(t, []string{"gauge"}, names())
+	assert.False(t, e.shedder.degraded)
+	assert.Equal(t, 1, takeShedMetrics(e))
+
+	// Recovered: the counter delta spans the degraded emissions.
+	emit()
+	require.ElementsMatch(t, []string{"gauge", "counter"}, names())
+	for _, m := range sent {
+		if m["name"] == "counter" {
+			assert.Equal(t, float64(10), m["value"])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import "strings"
+
+// EmitterFilter selects the metrics sent to an emitter.
+type EmitterFilter struct {
+	// MetricPrefixes keeps only the metrics whose name starts with any of
+	// them, if not empty.
+	MetricPrefixes []string `mapstructure:"metric_prefixes"`
+	// Match keeps only the metrics with all these attribute values.
+	Match map[string]string `mapstructure:"match"`
+}
+
+// IsEmpty returns true if the filter keeps all the metrics.
+func (f EmitterFilter) IsEmpty() bool {
+	return len(f.MetricPrefixes) == 0 && len(f.Match) == 0
+}
+
+// matchingEmitter emits only the metrics selected by the filter.
+type matchingEmitter struct {
+	Emitter
+	filter EmitterFilter
+}
+
+// MatchingEmitter wraps the emitter so it only emits the metrics with all
+// the attribute values of match, routing them to it.
+func MatchingEmitter(emitter Emitter, match map[string]string) Emitter {
+	return FilteredEmitter(emitter, EmitterFilter{Match: match})
+}
+
+// FilteredEmitter wraps the emitter so it only emits the metrics selected by
+// the filter, e.g. to send a subset of the metrics to stdout for debugging.
+func FilteredEmitter(emitter Emitter, filter EmitterFilter) Emitter {
+	return &matchingEmitter{Emitter: emitter, filter: filter}
+}
+
+// UnmatchedEmitter wraps the emitter so it doesn't emit the metrics with all
+// the attribute values of any of the routed matches, which are emitted by
+// the emitters they are routed to.
+func UnmatchedEmitter(emitter Emitter, routed []map[string]string) Emitter {
+	return &unmatchedEmitter{Emitter: emitter, routed: routed}
+}
+
+// Emit emits the matching metrics.
+func (me *matchingEmitter) Emit(metrics []Metric) error {
+	matching := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if me.matches(m) {
+			matching = append(matching, m)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	return me.Emitter.Emit(matching)
+}
+
+// wrappedEmitters returns the wrapped emitter.
+func (me *matchingEmitter) wrappedEmitters() []Emitter {
+	return []Emitter{me.Emitter}
+}
+
+// endHarvest notifies the wrapped emitter that the harvest ended.
+func (me *matchingEmitter) endHarvest() {
+	endHarvest([]Emitter{me.Emitter})
+}
+
+func (me *matchingEmitter) matches(m Metric) bool {
+	if len(me.filter.MetricPrefixes) > 0 && !hasAnyPrefix(m.name, me.filter.MetricPrefixes) {
+		return false
+	}
+	return matchesAttributes(m, me.filter.Match)
+}
+
+// matchesAttributes returns true if the metric has all the attribute values
+// of the match.
+func matchesAttributes(m Metric, match map[string]string) bool {
+	for k, v := range match {
+		if value, ok := m.attributes[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// unmatchedEmitter emits only the metrics not matching any of the routed
+// matches.
+type unmatchedEmitter struct {
+	Emitter
+	routed []map[string]string
+}
+
+// Emit emits the metrics not routed to other emitters.
+func (ue *unmatchedEmitter) Emit(metrics []Metric) error {
+	unmatched := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if !ue.isRouted(m) {
+			unmatched = append(unmatched, m)
+		}
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+	return ue.Emitter.Emit(unmatched)
+}
+
+func (ue *unmatchedEmitter) isRouted(m Metric) bool {
+	for _, match := range ue.routed {
+		if matchesAttributes(m, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrappedEmitters returns the wrapped emitter.
+func (ue *unmatchedEmitter) wrappedEmitters() []Emitter {
+	return []Emitter{ue.Emitter}
+}
+
+// endHarvest notifies the wrapped emitter that the harvest ended.
+func (ue *unmatchedEmitter) endHarvest() {
+	endHarvest([]Emitter{ue.Emitter})
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
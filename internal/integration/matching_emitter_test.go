@@ -0,0 +1,80 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+type recordingEmitter struct {
+	metrics []Metric
+}
+
+func (*recordingEmitter) Name() string {
+	return "recording"
+}
+
+func (re *recordingEmitter) Emit(metrics []Metric) error {
+	re.metrics = append(re.metrics, metrics...)
+	return nil
+}
+
+func TestMatchingEmitter(t *testing.T) {
+	recorder := &recordingEmitter{}
+	emitter := MatchingEmitter(recorder, map[string]string{"namespaceName": "shop", "label.team": "payments"})
+	assert.Equal(t, "recording", emitter.Name())
+
+	require.NoError(t, emitter.Emit([]Metric{
+		{name: "matching", attributes: labels.Set{"namespaceName": "shop", "label.team": "payments", "code": "200"}},
+		{name: "other_namespace", attributes: labels.Set{"namespaceName": "infra", "label.team": "payments"}},
+		{name: "missing_label", attributes: labels.Set{"namespaceName": "shop"}},
+		{name: "not_a_string", attributes: labels.Set{"namespaceName": "shop", "label.team": 1.0}},
+	}))
+
+	require.Len(t, recorder.metrics, 1)
+	assert.Equal(t, "matching", recorder.metrics[0].name)
+}
+
+func TestFilteredEmitter(t *testing.T) {
+	recorder := &recordingEmitter{}
+	emitter := FilteredEmitter(recorder, EmitterFilter{
+		MetricPrefixes: []string{"http_", "grpc_"},
+		Match:          map[string]string{"namespaceName": "shop"},
+	})
+
+	require.NoError(t, emitter.Emit([]Metric{
+		{name: "http_requests_total", attributes: labels.Set{"namespaceName": "shop"}},
+		{name: "grpc_calls_total", attributes: labels.Set{"namespaceName": "shop"}},
+		{name: "http_requests_total", attributes: labels.Set{"namespaceName": "infra"}},
+		{name: "go_goroutines", attributes: labels.Set{"namespaceName": "shop"}},
+	}))
+
+	require.Len(t, recorder.metrics, 2)
+	assert.Equal(t, "http_requests_total", recorder.metrics[0].name)
+	assert.Equal(t, "grpc_calls_total", recorder.metrics[1].name)
+}
+
+func TestUnmatchedEmitter(t *testing.T) {
+	recorder := &recordingEmitter{}
+	emitter := UnmatchedEmitter(recorder, []map[string]string{
+		{"namespaceName": "shop"},
+		{"namespaceName": "infra", "label.team": "platform"},
+	})
+	assert.Equal(t, "recording", emitter.Name())
+
+	require.NoError(t, emitter.Emit([]Metric{
+		{name: "routed", attributes: labels.Set{"namespaceName": "shop"}},
+		{name: "routed_all_values", attributes: labels.Set{"namespaceName": "infra", "label.team": "platform"}},
+		{name: "partial_match", attributes: labels.Set{"namespaceName": "infra", "label.team": "payments"}},
+		{name: "no_match", attributes: labels.Set{"namespaceName": "default"}},
+	}))
+
+	require.Len(t, recorder.metrics, 2, "the routed metrics are emitted once, by their emitter")
+	assert.Equal(t, "partial_match", recorder.metrics[0].name)
+	assert.Equal(t, "no_match", recorder.metrics[1].name)
+}
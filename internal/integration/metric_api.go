@@ -0,0 +1,82 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"time"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// NewGaugeMetric returns a gauge with the attributes, for the emitters and
+// the processors outside of the integration.
+func NewGaugeMetric(name string, value float64, attributes map[string]interface{}) Metric {
+	return newValueMetric(name, metricType_GAUGE, value, attributes)
+}
+
+// NewCounterMetric returns a counter with its cumulative value and the
+// attributes, for the emitters and the processors outside of the
+// integration.
+func NewCounterMetric(name string, value float64, attributes map[string]interface{}) Metric {
+	return newValueMetric(name, metricType_COUNTER, value, attributes)
+}
+
+// NewMetric returns a metric of the type, count, gauge, summary or
+// histogram, for the adapters of the public API. The summaries and the
+// histograms have their distribution instead of a value, and the metrics
+// with a zero timestamp are emitted at the scrape time.
+func NewMetric(name, typ string, value float64, summary *io_prometheus_client.Summary, histogram *io_prometheus_client.Histogram, attributes map[string]interface{}, timestamp time.Time) Metric {
+	m := newValueMetric(name, metricType(typ), value, attributes)
+	m.summary = summary
+	m.histogram = histogram
+	m.timestamp = timestamp
+	return m
+}
+
+func newValueMetric(name string, mtype metricType, value float64, attributes map[string]interface{}) Metric {
+	if attributes == nil {
+		attributes = labels.Set{}
+	}
+	return Metric{name: name, metricType: mtype, value: value, attributes: attributes}
+}
+
+// Name returns the name of the metric.
+func (m Metric) Name() string {
+	return m.name
+}
+
+// Type returns the type of the metric: count, gauge, summary or histogram.
+func (m Metric) Type() string {
+	return string(m.metricType)
+}
+
+// Value returns the value of the gauges and counters, the cumulative one
+// for the counters.
+func (m Metric) Value() float64 {
+	return m.value
+}
+
+// Summary returns the quantiles of the summaries, or nil.
+func (m Metric) Summary() *io_prometheus_client.Summary {
+	return m.summary
+}
+
+// Histogram returns the buckets of the histograms, or nil.
+func (m Metric) Histogram() *io_prometheus_client.Histogram {
+	return m.histogram
+}
+
+// Attributes returns the attributes of the metric. They're shared with the
+// metric, so they must not be modified.
+func (m Metric) Attributes() map[string]interface{} {
+	return m.attributes
+}
+
+// Timestamp returns the time of the sample, or the zero time if the metric
+// is emitted at the scrape time.
+func (m Metric) Timestamp() time.Time {
+	return m.timestamp
+}
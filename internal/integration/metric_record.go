@@ -0,0 +1,198 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// metricRecord is the JSON representation of a metric, used to export the
+// metrics outside of the New Relic telemetry.
+type metricRecord struct {
+	Name       string                          `json:"name"`
+	Type       metricType                      `json:"type"`
+	Value      float64                         `json:"value"`
+	Summary    *io_prometheus_client.Summary   `json:"summary,omitempty"`
+	Histogram  *io_prometheus_client.Histogram `json:"histogram,omitempty"`
+	Attributes map[string]interface{}          `json:"attributes"`
+	Timestamp  *time.Time                      `json:"timestamp,omitempty"`
+}
+
+// newMetricRecord returns the record of the metric, with the given
+// timestamp unless it's zero.
+func newMetricRecord(m Metric, timestamp time.Time) metricRecord {
+	r := metricRecord{
+		Name:       m.name,
+		Type:       m.metricType,
+		Value:      m.value,
+		Summary:    m.summary,
+		Histogram:  m.histogram,
+		Attributes: m.attributes,
+	}
+	if !timestamp.IsZero() {
+		r.Timestamp = &timestamp
+	}
+	return r
+}
+
+// MarshalJSON encodes the record. The non-finite values, which JSON can't
+// represent, like the NaN quantiles of the summaries without observations,
+// are encoded as the "NaN", "+Inf" and "-Inf" strings of the Prometheus
+// formats.
+func (r metricRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodedRecord{
+		recordFields: recordFields(r),
+		Value:        jsonValue(r.Value),
+		Summary:      newSummaryRecord(r.Summary),
+		Histogram:    newHistogramRecord(r.Histogram),
+	})
+}
+
+// UnmarshalJSON decodes the record, as encoded by MarshalJSON.
+func (r *metricRecord) UnmarshalJSON(b []byte) error {
+	var e encodedRecord
+	if err := json.Unmarshal(b, &e); err != nil {
+		return err
+	}
+	*r = metricRecord(e.recordFields)
+	r.Value = float64(e.Value)
+	r.Summary = e.Summary.summary()
+	r.Histogram = e.Histogram.histogram()
+	return nil
+}
+
+// recordFields has the fields of metricRecord without its methods.
+type recordFields metricRecord
+
+// encodedRecord is the JSON encoding of a metricRecord, whose values are
+// replaced by the ones of jsonValue.
+type encodedRecord struct {
+	recordFields
+	Value     jsonValue        `json:"value"`
+	Summary   *summaryRecord   `json:"summary,omitempty"`
+	Histogram *histogramRecord `json:"histogram,omitempty"`
+}
+
+// jsonValue is a float64 encoded as a string when it's not finite.
+type jsonValue float64
+
+func (v jsonValue) MarshalJSON() ([]byte, error) {
+	switch f := float64(v); {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, +1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	default:
+		return json.Marshal(f)
+	}
+}
+
+func (v *jsonValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) != nil {
+		return json.Unmarshal(b, (*float64)(v))
+	}
+	switch s {
+	case "NaN":
+		*v = jsonValue(math.NaN())
+	case "+Inf":
+		*v = jsonValue(math.Inf(+1))
+	case "-Inf":
+		*v = jsonValue(math.Inf(-1))
+	default:
+		return fmt.Errorf("invalid value %q", s)
+	}
+	return nil
+}
+
+func newJSONValue(f *float64) *jsonValue {
+	if f == nil {
+		return nil
+	}
+	v := jsonValue(*f)
+	return &v
+}
+
+func (v *jsonValue) float64() *float64 {
+	if v == nil {
+		return nil
+	}
+	f := float64(*v)
+	return &f
+}
+
+// summaryRecord and histogramRecord are encoded as their Prometheus types,
+// with jsonValue values.
+type summaryRecord struct {
+	SampleCount *uint64          `json:"sample_count,omitempty"`
+	SampleSum   *jsonValue       `json:"sample_sum,omitempty"`
+	Quantile    []quantileRecord `json:"quantile,omitempty"`
+}
+
+type quantileRecord struct {
+	Quantile *jsonValue `json:"quantile,omitempty"`
+	Value    *jsonValue `json:"value,omitempty"`
+}
+
+type histogramRecord struct {
+	SampleCount *uint64        `json:"sample_count,omitempty"`
+	SampleSum   *jsonValue     `json:"sample_sum,omitempty"`
+	Bucket      []bucketRecord `json:"bucket,omitempty"`
+}
+
+type bucketRecord struct {
+	CumulativeCount *uint64    `json:"cumulative_count,omitempty"`
+	UpperBound      *jsonValue `json:"upper_bound,omitempty"`
+}
+
+func newSummaryRecord(s *io_prometheus_client.Summary) *summaryRecord {
+	if s == nil {
+		return nil
+	}
+	r := &summaryRecord{SampleCount: s.SampleCount, SampleSum: newJSONValue(s.SampleSum)}
+	for _, q := range s.Quantile {
+		r.Quantile = append(r.Quantile, quantileRecord{Quantile: newJSONValue(q.Quantile), Value: newJSONValue(q.Value)})
+	}
+	return r
+}
+
+func newHistogramRecord(h *io_prometheus_client.Histogram) *histogramRecord {
+	if h == nil {
+		return nil
+	}
+	r := &histogramRecord{SampleCount: h.SampleCount, SampleSum: newJSONValue(h.SampleSum)}
+	for _, b := range h.Bucket {
+		r.Bucket = append(r.Bucket, bucketRecord{CumulativeCount: b.CumulativeCount, UpperBound: newJSONValue(b.UpperBound)})
+	}
+	return r
+}
+
+func (r *summaryRecord) summary() *io_prometheus_client.Summary {
+	if r == nil {
+		return nil
+	}
+	s := &io_prometheus_client.Summary{SampleCount: r.SampleCount, SampleSum: r.SampleSum.float64()}
+	for _, q := range r.Quantile {
+		s.Quantile = append(s.Quantile, &io_prometheus_client.Quantile{Quantile: q.Quantile.float64(), Value: q.Value.float64()})
+	}
+	return s
+}
+
+func (r *histogramRecord) histogram() *io_prometheus_client.Histogram {
+	if r == nil {
+		return nil
+	}
+	h := &io_prometheus_client.Histogram{SampleCount: r.SampleCount, SampleSum: r.SampleSum.float64()}
+	for _, b := range r.Bucket {
+		h.Bucket = append(h.Bucket, &io_prometheus_client.Bucket{CumulativeCount: b.CumulativeCount, UpperBound: b.UpperBound.float64()})
+	}
+	return h
+}
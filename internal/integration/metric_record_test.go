@@ -0,0 +1,112 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func uint64Value(v uint64) *uint64 {
+	return &v
+}
+
+func float64Value(v float64) *float64 {
+	return &v
+}
+
+func TestMetricRecord_NonFiniteValues(t *testing.T) {
+	metrics := []Metric{
+		{name: "nan", metricType: metricType_GAUGE, value: math.NaN(), attributes: labels.Set{}},
+		{name: "inf", metricType: metricType_GAUGE, value: math.Inf(+1), attributes: labels.Set{}},
+		{name: "negative_inf", metricType: metricType_GAUGE, value: math.Inf(-1), attributes: labels.Set{}},
+		{
+			name:       "empty_summary",
+			metricType: metricType_SUMMARY,
+			summary: &dto.Summary{
+				SampleCount: uint64Value(0),
+				SampleSum:   float64Value(0),
+				Quantile:    []*dto.Quantile{{Quantile: float64Value(0.99), Value: float64Value(math.NaN())}},
+			},
+			attributes: labels.Set{},
+		},
+		{
+			name:       "histogram",
+			metricType: metricType_HISTOGRAM,
+			histogram: &dto.Histogram{
+				SampleCount: uint64Value(2),
+				SampleSum:   float64Value(1.5),
+				Bucket: []*dto.Bucket{
+					{CumulativeCount: uint64Value(1), UpperBound: float64Value(0.5)},
+					{CumulativeCount: uint64Value(2), UpperBound: float64Value(math.Inf(+1))},
+				},
+			},
+			attributes: labels.Set{},
+		},
+	}
+
+	var records []map[string]interface{}
+	for _, m := range metrics {
+		b, err := json.Marshal(newMetricRecord(m, time.Time{}))
+		require.NoError(t, err, m.name)
+		var r map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &r))
+		records = append(records, r)
+	}
+
+	assert.Equal(t, "NaN", records[0]["value"])
+	assert.Equal(t, "+Inf", records[1]["value"])
+	assert.Equal(t, "-Inf", records[2]["value"])
+	assert.Equal(t, map[string]interface{}{
+		"sample_count": 0.0,
+		"sample_sum":   0.0,
+		"quantile":     []interface{}{map[string]interface{}{"quantile": 0.99, "value": "NaN"}},
+	}, records[3]["summary"])
+	assert.Equal(t, map[string]interface{}{
+		"sample_count": 2.0,
+		"sample_sum":   1.5,
+		"bucket": []interface{}{
+			map[string]interface{}{"cumulative_count": 1.0, "upper_bound": 0.5},
+			map[string]interface{}{"cumulative_count": 2.0, "upper_bound": "+Inf"},
+		},
+	}, records[4]["histogram"])
+
+	for _, m := range metrics {
+		b, err := json.Marshal(newMetricRecord(m, time.Time{}))
+		require.NoError(t, err)
+		var r metricRecord
+		require.NoError(t, json.Unmarshal(b, &r), "the records decode back, as by the diff command")
+		if m.summary != nil {
+			assert.True(t, math.IsNaN(r.Summary.Quantile[0].GetValue()))
+		} else if m.histogram != nil {
+			assert.True(t, math.IsInf(r.Histogram.Bucket[1].GetUpperBound(), +1))
+		} else {
+			assert.Equal(t, math.IsNaN(m.value), math.IsNaN(r.Value))
+			if !math.IsNaN(m.value) {
+				assert.Equal(t, m.value, r.Value)
+			}
+		}
+	}
+}
+
+// The finite values are encoded as before, so the records decode into
+// metricRecord.
+func TestMetricRecord_FiniteValues(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := Metric{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"job": "node"}}
+	b, err := json.Marshal(newMetricRecord(m, ts))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name":"up","type":"gauge","value":1,"attributes":{"job":"node"},"timestamp":"2020-01-02T03:04:05Z"}`, string(b))
+
+	var r metricRecord
+	require.NoError(t, json.Unmarshal(b, &r))
+	assert.Equal(t, 1.0, r.Value)
+}
@@ -51,6 +51,72 @@ var (
 			"target",
 		},
 	)
+	fetchRetriesTotalMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_retries_total",
+		Help:      "Fetches retried after a transient error",
+	},
+		[]string{
+			"target",
+		},
+	)
+	fetchJobQueuedMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_job_queued_targets",
+		Help:      "Targets of the scrape job waiting for a fetch worker",
+	},
+		[]string{
+			"job",
+		},
+	)
+	rawPassthroughMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_raw_passthrough_total",
+		Help:      "Raw payloads of the scrape job forwarded, by result: success, scrape_error or forward_error",
+	},
+		[]string{
+			"job",
+			"result",
+		},
+	)
+	hostThrottledMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_host_throttled_total",
+		Help:      "Fetches that waited because the host had the maximum concurrent scrapes",
+	},
+		[]string{
+			"host",
+		},
+	)
+	fetchAuthMethodMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_auth_method",
+		Help:      "Index of the auth method that last authenticated the target",
+	},
+		[]string{
+			"target",
+		},
+	)
+	fetchTimeoutsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_timeouts_total",
+		Help:      "Scrapes of the target that timed out, by the phase that timed out",
+	},
+		[]string{
+			"target",
+			"phase",
+		},
+	)
+	fetchSchemeMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Name:      "fetch_scheme_total",
+		Help:      "Scrapes of the targets with a scheme fallback policy, by the scheme that worked",
+	},
+		[]string{
+			"target",
+			"scheme",
+		},
+	)
 	totalTimeseriesByTargetAndTypeMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "nr_stats",
 		Subsystem: "metrics",
@@ -87,6 +153,33 @@ var (
 		[]string{
 			"target",
 		})
+	seriesCreatedMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "series",
+		Name:      "created",
+		Help:      "Number of timeseries seen for the first time in the last harvest, by target",
+	},
+		[]string{
+			"target",
+		})
+	seriesExpiredMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "series",
+		Name:      "expired",
+		Help:      "Number of timeseries not seen for longer than the TTL in the last harvest, by target",
+	},
+		[]string{
+			"target",
+		})
+	seriesActiveMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "series",
+		Name:      "active",
+		Help:      "Number of tracked timeseries, by target",
+	},
+		[]string{
+			"target",
+		})
 	fetchTargetDurationMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "nr_stats",
 		Subsystem: "integration",
@@ -107,6 +200,176 @@ var (
 			"emitter",
 		},
 	)
+	emitQueueLengthMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emit_queue_length",
+		Help:      "Number of target metrics waiting to be emitted",
+	})
+	emitQueueDroppedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emit_queue_dropped_total",
+		Help:      "Target metrics dropped because the emit queue was full",
+	},
+		[]string{
+			"target",
+		},
+	)
+	reportOnChangeSuppressedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "report_on_change_suppressed_total",
+		Help:      "Gauges not emitted because their value didn't change",
+	})
+	emitterDegradedMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_degraded",
+		Help:      "1 when the emitter is shedding load because of persistent emission failures",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	emitterFailedOverMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_failed_over",
+		Help:      "1 when the emitter failed over to its secondary emitter",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	spoolSpooledMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_spooled_requests_total",
+		Help:      "Failed requests of the emitter written to the disk spool",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	spoolReplayedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_spool_replayed_requests_total",
+		Help:      "Spooled requests of the emitter replayed successfully",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	spoolDroppedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_spool_dropped_requests_total",
+		Help:      "Spooled requests of the emitter dropped, by reason: age, size or rejected",
+	},
+		[]string{
+			"emitter",
+			"reason",
+		},
+	)
+	spoolPendingMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_spool_pending_requests",
+		Help:      "Requests of the emitter waiting in the disk spool to be replayed",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	emitterRejectionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_rejections_total",
+		Help:      "Errors of the Metric API responses to the emitter requests, by status and reason: auth, attributes, payload_too_large, rate_limited, invalid_payload, server_error or other",
+	},
+		[]string{
+			"emitter",
+			"status",
+			"reason",
+		},
+	)
+	emitterSentBytesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_sent_bytes_total",
+		Help:      "Bytes of the requests accepted by the emitter endpoint",
+	},
+		[]string{
+			"emitter",
+		},
+	)
+	emitterRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_requests_total",
+		Help:      "Requests sent by the harvester of the emitter, by result: success or failure",
+	},
+		[]string{
+			"emitter",
+			"result",
+		},
+	)
+	faultInjectionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "fault_injections_total",
+		Help:      "Faults injected on purpose, by fault: scrape_failure, corrupt_payload or emit_delay",
+	},
+		[]string{
+			"fault",
+		},
+	)
+	emitterShedMetricsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "emitter_shed_metrics_total",
+		Help:      "Metrics not recorded by the emitter while degraded",
+	},
+		[]string{
+			"emitter",
+			"type",
+		},
+	)
+	droppedAttributesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "dropped_attributes_total",
+		Help:      "Attributes dropped from the metrics of the target beyond the attribute limit",
+	},
+		[]string{
+			"target",
+		},
+	)
+	droppedMetricsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "dropped_metrics_total",
+		Help:      "Metrics of the scrape job dropped by the rules, the limits, the conversion errors or the emission errors of the emitter",
+	},
+		[]string{
+			"job",
+			"emitter",
+			"reason",
+		},
+	)
+	watchdogRecoveriesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "watchdog_recoveries_total",
+		Help:      "Recoveries of the watchdog from the raised alarms, by alarm and result",
+	},
+		[]string{
+			"alarm",
+			"result",
+		},
+	)
 	processDurationMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "nr_stats",
 		Subsystem: "integration",
@@ -128,11 +391,38 @@ func init() {
 	prometheus.MustRegister(fetchesTotalMetric)
 	prometheus.MustRegister(totalTimeseriesByTypeMetric)
 	prometheus.MustRegister(fetchErrorsTotalMetric)
+	prometheus.MustRegister(fetchRetriesTotalMetric)
+	prometheus.MustRegister(hostThrottledMetric)
+	prometheus.MustRegister(fetchJobQueuedMetric)
+	prometheus.MustRegister(rawPassthroughMetric)
+	prometheus.MustRegister(emitterSentBytesMetric)
+	prometheus.MustRegister(emitterRequestsMetric)
+	prometheus.MustRegister(faultInjectionsMetric)
+	prometheus.MustRegister(fetchAuthMethodMetric)
+	prometheus.MustRegister(fetchSchemeMetric)
+	prometheus.MustRegister(fetchTimeoutsMetric)
 	prometheus.MustRegister(totalTimeseriesByTargetAndTypeMetric)
 	prometheus.MustRegister(totalTimeseriesMetric)
 	prometheus.MustRegister(totalTimeseriesByTargetMetric)
+	prometheus.MustRegister(seriesCreatedMetric)
+	prometheus.MustRegister(seriesExpiredMetric)
+	prometheus.MustRegister(seriesActiveMetric)
 	prometheus.MustRegister(fetchTargetDurationMetric)
 	prometheus.MustRegister(emitTotalDurationMetric)
+	prometheus.MustRegister(emitQueueLengthMetric)
+	prometheus.MustRegister(emitQueueDroppedMetric)
+	prometheus.MustRegister(reportOnChangeSuppressedMetric)
+	prometheus.MustRegister(emitterDegradedMetric)
+	prometheus.MustRegister(emitterShedMetricsMetric)
+	prometheus.MustRegister(emitterFailedOverMetric)
+	prometheus.MustRegister(spoolSpooledMetric)
+	prometheus.MustRegister(spoolReplayedMetric)
+	prometheus.MustRegister(spoolDroppedMetric)
+	prometheus.MustRegister(spoolPendingMetric)
+	prometheus.MustRegister(emitterRejectionsMetric)
+	prometheus.MustRegister(droppedAttributesMetric)
+	prometheus.MustRegister(droppedMetricsMetric)
+	prometheus.MustRegister(watchdogRecoveriesMetric)
 	prometheus.MustRegister(processDurationMetric)
 	prometheus.MustRegister(totalExecutionsMetric)
 }
@@ -0,0 +1,261 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Attribute key cases.
+const (
+	// CaseSnake converts the attribute keys from camelCase to snake_case.
+	CaseSnake = "snake"
+	// CaseCamel converts the attribute keys from snake_case to camelCase.
+	CaseCamel = "camel"
+)
+
+// SemanticAttributeNames maps the well-known Prometheus labels to the New
+// Relic semantic attribute names, used if SemanticNames is set.
+var SemanticAttributeNames = map[string]string{
+	"pod":         "k8s.podName",
+	"pod_name":    "k8s.podName",
+	"namespace":   "k8s.namespaceName",
+	"container":   "k8s.containerName",
+	"node":        "k8s.nodeName",
+	"deployment":  "k8s.deploymentName",
+	"daemonset":   "k8s.daemonsetName",
+	"statefulset": "k8s.statefulsetName",
+	"service":     "k8s.serviceName",
+}
+
+// OpenTelemetryAttributeNames maps the common Prometheus labels, and the
+// attributes added from the targets metadata, to the OpenTelemetry semantic
+// conventions, used if OpenTelemetry is set.
+var OpenTelemetryAttributeNames = map[string]string{
+	"namespace":      "k8s.namespace.name",
+	"namespaceName":  "k8s.namespace.name",
+	"pod":            "k8s.pod.name",
+	"pod_name":       "k8s.pod.name",
+	"podName":        "k8s.pod.name",
+	"container":      "k8s.container.name",
+	"container_name": "k8s.container.name",
+	"node":           "k8s.node.name",
+	"nodeName":       "k8s.node.name",
+	"deployment":     "k8s.deployment.name",
+	"deploymentName": "k8s.deployment.name",
+	"daemonset":      "k8s.daemonset.name",
+	"statefulset":    "k8s.statefulset.name",
+	"cronjob":        "k8s.cronjob.name",
+	"clusterName":    "k8s.cluster.name",
+	"job":            "service.name",
+	"instance":       "service.instance.id",
+	"method":         "http.request.method",
+	"code":           "http.response.status_code",
+	"status_code":    "http.response.status_code",
+	"handler":        "http.route",
+	"route":          "http.route",
+}
+
+// OpenTelemetryMetricNames maps the common Prometheus metrics to the
+// OpenTelemetry semantic conventions, used if OpenTelemetry is set. Only the
+// metrics with the same unit and meaning are mapped.
+var OpenTelemetryMetricNames = map[string]string{
+	"http_request_duration_seconds":        "http.server.request.duration",
+	"http_server_request_duration_seconds": "http.server.request.duration",
+	"http_client_request_duration_seconds": "http.client.request.duration",
+	"process_cpu_seconds_total":            "process.cpu.time",
+	"process_resident_memory_bytes":        "process.memory.usage",
+	"process_virtual_memory_bytes":         "process.memory.virtual",
+	"process_open_fds":                     "process.open_file_descriptor.count",
+	"go_goroutines":                        "go.goroutine.count",
+	"container_cpu_usage_seconds_total":    "container.cpu.time",
+}
+
+// internalAttributes are read by the emitters and the reports after the
+// normalization, like the type of the metrics or the target the Kafka
+// messages are partitioned by, so their keys are never normalized.
+var internalAttributes = map[string]bool{
+	"nrMetricType":   true,
+	"promMetricType": true,
+	"targetName":     true,
+}
+
+// NormalizationConfig configures the normalization of the attribute keys,
+// applied to the metrics of all the emitters after the processing rules.
+// Keys in Names, or in SemanticAttributeNames if SemanticNames is set, are
+// replaced by their mapping as is. The rest are converted to Case, if set,
+// and then lowercased if Lowercase is set. OpenTelemetry maps the attributes
+// and the metrics to the OpenTelemetry semantic conventions instead of the
+// New Relic ones. The nrMetricType, promMetricType and targetName attributes
+// are never normalized.
+type NormalizationConfig struct {
+	Lowercase     bool              `mapstructure:"lowercase"`
+	Case          string            `mapstructure:"case"`
+	SemanticNames bool              `mapstructure:"semantic_names"`
+	OpenTelemetry bool              `mapstructure:"opentelemetry"`
+	Names         map[string]string `mapstructure:"names"`
+}
+
+// AttributeNormalizer normalizes the attribute keys, and the names, of the
+// metrics.
+type AttributeNormalizer struct {
+	lowercase bool
+	keyCase   string
+	names     map[string]string
+	// mapped are the keys the names are mapped to, which are kept as is.
+	mapped      map[string]bool
+	metricNames map[string]string
+}
+
+// NewAttributeNormalizer returns the normalizer of the configuration, or nil
+// if it doesn't change any key.
+func NewAttributeNormalizer(cfg NormalizationConfig) (*AttributeNormalizer, error) {
+	switch cfg.Case {
+	case "", CaseSnake:
+	case CaseCamel:
+		if cfg.Lowercase {
+			return nil, fmt.Errorf("attribute normalization can't lowercase camelCase keys")
+		}
+	default:
+		return nil, fmt.Errorf("invalid attribute normalization case %q, must be %s or %s", cfg.Case, CaseSnake, CaseCamel)
+	}
+
+	if cfg.SemanticNames && cfg.OpenTelemetry {
+		return nil, fmt.Errorf("attribute normalization can't use both the New Relic and the OpenTelemetry semantic names")
+	}
+
+	n := &AttributeNormalizer{lowercase: cfg.Lowercase, keyCase: cfg.Case, names: map[string]string{}}
+	if cfg.SemanticNames {
+		for k, v := range SemanticAttributeNames {
+			n.names[k] = v
+		}
+	}
+	if cfg.OpenTelemetry {
+		for k, v := range OpenTelemetryAttributeNames {
+			n.names[k] = v
+		}
+		n.metricNames = OpenTelemetryMetricNames
+	}
+	// The configured names take precedence over the semantic ones.
+	for k, v := range cfg.Names {
+		n.names[k] = v
+	}
+	if !n.lowercase && n.keyCase == "" && len(n.names) == 0 && len(n.metricNames) == 0 {
+		return nil, nil
+	}
+	n.mapped = make(map[string]bool, len(n.names))
+	for _, v := range n.names {
+		n.mapped[v] = true
+	}
+	return n, nil
+}
+
+// Key returns the normalized attribute key. The internal attributes are kept
+// as is.
+func (n *AttributeNormalizer) Key(key string) string {
+	if internalAttributes[key] {
+		return key
+	}
+	if name, ok := n.names[key]; ok {
+		return name
+	}
+	if n.mapped[key] {
+		return key
+	}
+	switch n.keyCase {
+	case CaseSnake:
+		key = toSnakeCase(key)
+	case CaseCamel:
+		key = toCamelCase(key)
+	}
+	if n.lowercase {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// MetricName returns the normalized metric name.
+func (n *AttributeNormalizer) MetricName(name string) string {
+	if mapped, ok := n.metricNames[name]; ok {
+		return mapped
+	}
+	return name
+}
+
+// Attributes returns the attributes with their keys normalized. If several
+// keys normalize to the same one, the attribute whose key was already
+// normalized is kept.
+func (n *AttributeNormalizer) Attributes(attributes map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(attributes))
+	var renamed []string
+	for k, v := range attributes {
+		if n.Key(k) == k {
+			normalized[k] = v
+		} else {
+			renamed = append(renamed, k)
+		}
+	}
+	for _, k := range renamed {
+		nk := n.Key(k)
+		if _, ok := normalized[nk]; !ok {
+			normalized[nk] = attributes[k]
+		}
+	}
+	return normalized
+}
+
+// normalizeMetrics normalizes the names and the attribute keys of the
+// metrics.
+func normalizeMetrics(targetMetrics *TargetMetrics, n *AttributeNormalizer) {
+	if n == nil {
+		return
+	}
+	for mi := range targetMetrics.Metrics {
+		targetMetrics.Metrics[mi].name = n.MetricName(targetMetrics.Metrics[mi].name)
+		targetMetrics.Metrics[mi].attributes = n.Attributes(targetMetrics.Metrics[mi].attributes)
+	}
+}
+
+// toSnakeCase converts a camelCase key to snake_case. Runs of uppercase
+// letters are kept together, so scrapedTargetURL becomes
+// scraped_target_url.
+func toSnakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// toCamelCase converts a snake_case key to camelCase. Leading underscores
+// are kept.
+func toCamelCase(s string) string {
+	trimmed := strings.TrimLeft(s, "_")
+	var b strings.Builder
+	b.WriteString(s[:len(s)-len(trimmed)])
+	upper := false
+	for _, r := range trimmed {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
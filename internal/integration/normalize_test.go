@@ -0,0 +1,179 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestAttributeNormalizer_Key(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  NormalizationConfig
+		keys map[string]string
+	}{
+		{
+			name: "lowercase",
+			cfg:  NormalizationConfig{Lowercase: true},
+			keys: map[string]string{
+				"podName":   "podname",
+				"HTTP_Code": "http_code",
+				"version":   "version",
+			},
+		},
+		{
+			name: "snake case",
+			cfg:  NormalizationConfig{Case: CaseSnake},
+			keys: map[string]string{
+				"podName":          "pod_name",
+				"scrapedTargetURL": "scraped_target_url",
+				"HTTPStatusCode":   "http_status_code",
+				"k8s.cluster.name": "k8s.cluster.name",
+				"label.appName":    "label.app_name",
+				"build_date":       "build_date",
+			},
+		},
+		{
+			name: "camel case",
+			cfg:  NormalizationConfig{Case: CaseCamel},
+			keys: map[string]string{
+				"pod_name":    "podName",
+				"__name__":    "__name",
+				"http_status": "httpStatus",
+				"podName":     "podName",
+			},
+		},
+		{
+			name: "semantic names",
+			cfg:  NormalizationConfig{SemanticNames: true, Case: CaseSnake, Names: map[string]string{"node": "hostname"}},
+			keys: map[string]string{
+				"pod":           "k8s.podName",
+				"namespace":     "k8s.namespaceName",
+				"k8s.podName":   "k8s.podName",
+				"node":          "hostname",
+				"namespaceName": "namespace_name",
+			},
+		},
+		{
+			name: "internal attributes",
+			cfg:  NormalizationConfig{Case: CaseSnake, Lowercase: true, Names: map[string]string{"targetName": "target"}},
+			keys: map[string]string{
+				"nrMetricType":   "nrMetricType",
+				"promMetricType": "promMetricType",
+				"targetName":     "targetName",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := NewAttributeNormalizer(tt.cfg)
+			require.NoError(t, err)
+			for key, expected := range tt.keys {
+				assert.Equal(t, expected, n.Key(key), key)
+			}
+		})
+	}
+}
+
+func TestNewAttributeNormalizer(t *testing.T) {
+	n, err := NewAttributeNormalizer(NormalizationConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, n, "an empty configuration doesn't normalize")
+
+	_, err = NewAttributeNormalizer(NormalizationConfig{Case: "kebab"})
+	assert.Error(t, err)
+
+	_, err = NewAttributeNormalizer(NormalizationConfig{Case: CaseCamel, Lowercase: true})
+	assert.Error(t, err)
+
+	_, err = NewAttributeNormalizer(NormalizationConfig{SemanticNames: true, OpenTelemetry: true})
+	assert.Error(t, err)
+}
+
+func TestNormalizeMetrics_OpenTelemetry(t *testing.T) {
+	n, err := NewAttributeNormalizer(NormalizationConfig{
+		OpenTelemetry: true,
+		Names:         map[string]string{"instance": "host.name"},
+	})
+	require.NoError(t, err)
+
+	targetMetrics := TargetMetrics{Metrics: []Metric{
+		{
+			name: "http_request_duration_seconds",
+			attributes: labels.Set{
+				"namespaceName": "shop",
+				"pod":           "web-1",
+				"method":        "GET",
+				"code":          "200",
+				"instance":      "10.0.0.1:8080",
+				"le":            "0.5",
+			},
+		},
+		{
+			name:       "shop_orders_total",
+			attributes: labels.Set{"job": "shop"},
+		},
+	}}
+	normalizeMetrics(&targetMetrics, n)
+
+	assert.Equal(t, "http.server.request.duration", targetMetrics.Metrics[0].name)
+	assert.Equal(t, labels.Set{
+		"k8s.namespace.name":        "shop",
+		"k8s.pod.name":              "web-1",
+		"http.request.method":       "GET",
+		"http.response.status_code": "200",
+		"host.name":                 "10.0.0.1:8080",
+		"le":                        "0.5",
+	}, targetMetrics.Metrics[0].attributes)
+	assert.Equal(t, "shop_orders_total", targetMetrics.Metrics[1].name, "unknown metrics keep their names")
+	assert.Equal(t, labels.Set{"service.name": "shop"}, targetMetrics.Metrics[1].attributes)
+}
+
+func TestNormalizeMetrics(t *testing.T) {
+	n, err := NewAttributeNormalizer(NormalizationConfig{Lowercase: true, SemanticNames: true})
+	require.NoError(t, err)
+
+	targetMetrics := TargetMetrics{Metrics: []Metric{{
+		name: "http_requests_total",
+		attributes: map[string]interface{}{
+			"Code":        "200",
+			"code":        "500",
+			"pod":         "web-1",
+			"k8s.podName": "web-2",
+			"Method":      "GET",
+		},
+	}}}
+	normalizeMetrics(&targetMetrics, n)
+
+	assert.Equal(t, labels.Set{
+		"code":        "500",
+		"k8s.podName": "web-2",
+		"method":      "GET",
+	}, targetMetrics.Metrics[0].attributes, "already normalized keys are kept on collisions")
+}
+
+func TestRuleProcessor_Normalization(t *testing.T) {
+	n, err := NewAttributeNormalizer(NormalizationConfig{Case: CaseSnake})
+	require.NoError(t, err)
+
+	input := make(chan TargetMetrics, 1)
+	input <- TargetMetrics{Metrics: []Metric{{
+		name:       "up",
+		attributes: map[string]interface{}{"jobName": "node"},
+	}}}
+	close(input)
+
+	rules := []ProcessingRule{{
+		AddAttributes: []AddAttributesRule{{Attributes: map[string]interface{}{"clusterName": "test"}}},
+	}}
+	output := RuleProcessor(rules, 1, WithAttributeNormalizer(n))(input)
+	pair := <-output
+	assert.Equal(t, "node", pair.Metrics[0].attributes["job_name"])
+	assert.Equal(t, "test", pair.Metrics[0].attributes["cluster_name"], "added attributes are normalized")
+	assert.NotContains(t, pair.Metrics[0].attributes, "jobName")
+}
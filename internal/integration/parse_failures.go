@@ -0,0 +1,83 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// ParseFailure is the payload of a target that couldn't be parsed.
+type ParseFailure struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	URL    string    `json:"url"`
+	Error  string    `json:"error"`
+	// Body is the beginning of the payload.
+	Body string `json:"body"`
+}
+
+// ParseFailures is a bounded buffer of the last payloads that couldn't be
+// parsed, so bugs of the exporters can be reported with evidence.
+type ParseFailures struct {
+	size     int
+	mu       sync.Mutex
+	failures []ParseFailure
+}
+
+// NewParseFailures returns a ParseFailures keeping the last size failures.
+func NewParseFailures(size int) *ParseFailures {
+	return &ParseFailures{size: size}
+}
+
+// add records the failure of the target if err is a parse error, dropping
+// the oldest one when the buffer is full.
+func (pf *ParseFailures) add(t *endpoints.Target, err error) {
+	var parseErr *prometheus.ParseError
+	if pf.size <= 0 || !errors.As(err, &parseErr) {
+		return
+	}
+	url, _ := t.Metadata()["scrapedTargetURL"].(string)
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if len(pf.failures) >= pf.size {
+		pf.failures = pf.failures[1:]
+	}
+	pf.failures = append(pf.failures, ParseFailure{
+		Time:   time.Now(),
+		Target: t.Name,
+		URL:    url,
+		Error:  parseErr.Err.Error(),
+		Body:   string(parseErr.Body),
+	})
+}
+
+// List returns the recorded failures, from the oldest to the newest.
+func (pf *ParseFailures) List() []ParseFailure {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	return append([]ParseFailure{}, pf.failures...)
+}
+
+// ServeHTTP writes the recorded failures as JSON.
+func (pf *ParseFailures) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(pf.List())
+}
+
+// WithParseFailureCapture records in failures up to captureLimit bytes of
+// the payloads of the targets that couldn't be parsed.
+func WithParseFailureCapture(failures *ParseFailures, captureLimit int) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.parseFailures = failures
+		pf.getOptions.CaptureLimit = captureLimit
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func TestParseFailures(t *testing.T) {
+	failures := NewParseFailures(2)
+	for _, name := range []string{"a", "b", "c"} {
+		target := newTestTarget(name, "10.0.0.1:8080")
+		failures.add(&target, &prometheus.ParseError{Err: errors.New("bad"), Body: []byte("<html>" + name)})
+	}
+	// Other errors are not recorded.
+	target := newTestTarget("d", "10.0.0.1:8080")
+	failures.add(&target, errors.New("connection refused"))
+
+	list := failures.List()
+	require.Len(t, list, 2)
+	assert.Equal(t, "b", list[0].Target)
+	assert.Equal(t, "c", list[1].Target)
+	assert.Equal(t, "<html>c", list[1].Body)
+	assert.Equal(t, "bad", list[1].Error)
+	assert.Equal(t, "http://10.0.0.1:8080/metrics", list[1].URL)
+
+	rec := httptest.NewRecorder()
+	failures.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/parse-failures", nil))
+	var served []ParseFailure
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+	assert.Len(t, served, 2)
+}
+
+func TestFetcher_ParseFailureCapture(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>not metrics</html>"))
+	}))
+	defer ts.Close()
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{ts.URL}})
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+
+	failures := NewParseFailures(10)
+	fetcher := NewFetcher(time.Millisecond, time.Second, 1, "", "", true, queueLength, WithParseFailureCapture(failures, 6))
+	for range fetcher.Fetch(targets) {
+	}
+
+	list := failures.List()
+	require.Len(t, list, 1)
+	assert.Equal(t, "<html>", list[0].Body)
+}
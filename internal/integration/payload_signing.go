@@ -0,0 +1,209 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+)
+
+const (
+	// defaultSignatureHeader is the header of the HMAC signature of the
+	// payloads.
+	defaultSignatureHeader = "X-Payload-Signature"
+	// signatureTimestampHeader is the header of the time the payload was
+	// signed at, in Unix seconds, which is part of the signed message so
+	// the gateway can reject replayed payloads.
+	signatureTimestampHeader = "X-Payload-Timestamp"
+)
+
+// PayloadSigningConfig configures how the emitters authenticate to an
+// internal telemetry gateway: the payloads are signed with an HMAC key, the
+// connections use a client certificate, or both. With OmitLicenseKey, the
+// license key is not sent, so it's only known by the gateway.
+type PayloadSigningConfig struct {
+	// HMACKeyFile is the file of the key the payloads are signed with.
+	HMACKeyFile string `mapstructure:"hmac_key_file"`
+	// HMACHeader is the header of the signature. Defaults to
+	// X-Payload-Signature.
+	HMACHeader string `mapstructure:"hmac_header"`
+	// CertFile and KeyFile are the client certificate and key of the
+	// connections to the gateway.
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// OmitLicenseKey doesn't send the license key to the Metric API
+	// endpoint, for gateways adding it.
+	OmitLicenseKey bool `mapstructure:"omit_license_key"`
+}
+
+// IsEmpty returns true if the payloads aren't signed.
+func (c PayloadSigningConfig) IsEmpty() bool {
+	return c.HMACKeyFile == "" && c.CertFile == "" && c.KeyFile == ""
+}
+
+// Validate returns an error if the key or the certificate can't be read,
+// or only one of the certificate and its key is set.
+func (c PayloadSigningConfig) Validate() error {
+	if c.OmitLicenseKey && c.IsEmpty() {
+		return fmt.Errorf("emitter_signing omit_license_key requires an hmac_key_file or a cert_file")
+	}
+	if c.HMACKeyFile != "" {
+		if _, err := NewHMACSigner(c.HMACKeyFile, c.HMACHeader); err != nil {
+			return err
+		}
+	}
+	if _, err := c.Certificates(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Certificates returns the client certificate of the connections, if any.
+func (c PayloadSigningConfig) Certificates() ([]tls.Certificate, error) {
+	if c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("emitter_signing requires both a cert_file and a key_file")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the emitter_signing client certificate: %w", err)
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+// Signer returns the signer of the payloads, or nil if they aren't signed
+// with an HMAC key.
+func (c PayloadSigningConfig) Signer() (PayloadSigner, error) {
+	if c.HMACKeyFile == "" {
+		return nil, nil
+	}
+	return NewHMACSigner(c.HMACKeyFile, c.HMACHeader)
+}
+
+// PayloadSigner signs the outbound requests of the emitters, given their
+// body, by setting their headers.
+type PayloadSigner interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// HMACSigner signs the payloads with an HMAC-SHA256 key. The signature is
+// of the timestamp header value, a dot and the body, and is sent hex
+// encoded, prefixed with sha256=.
+type HMACSigner struct {
+	key    []byte
+	header string
+	now    func() time.Time
+}
+
+// NewHMACSigner returns an HMACSigner of the key of the file, sending the
+// signature in the header, or in X-Payload-Signature if it's empty.
+func NewHMACSigner(keyFile, header string) (*HMACSigner, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the HMAC key file %s: %w", keyFile, err)
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("the HMAC key file %s is empty", keyFile)
+	}
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	return &HMACSigner{key: key, header: header, now: time.Now}, nil
+}
+
+// Sign sets the timestamp and the signature headers of the request.
+func (s *HMACSigner) Sign(req *http.Request, body []byte) error {
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req.Header.Set(signatureTimestampHeader, timestamp)
+	req.Header.Set(s.header, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// signingRoundTripper signs the requests before sending them.
+type signingRoundTripper struct {
+	signer PayloadSigner
+	rt     http.RoundTripper
+}
+
+// NewSigningRoundTripper wraps the given http.RoundTripper to sign the
+// requests with the signer.
+func NewSigningRoundTripper(signer PayloadSigner, rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return signingRoundTripper{signer: signer, rt: rt}
+}
+
+// RoundTrip reads the body of the request to sign it, and sends a copy of
+// the request with the signature.
+func (t signingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading the payload to sign: %w", err)
+		}
+	}
+	req = cloneRequest(req)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	if err := t.signer.Sign(req, body); err != nil {
+		return nil, fmt.Errorf("signing the payload: %w", err)
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// TelemetryHarvesterWithSigner signs the requests of the harvester.
+func TelemetryHarvesterWithSigner(signer PayloadSigner) TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		cfg.Client.Transport = NewSigningRoundTripper(signer, cfg.Client.Transport)
+	}
+}
+
+// TelemetryHarvesterWithoutLicenseKey removes the license key from the
+// requests of the harvester, for gateways adding it.
+func TelemetryHarvesterWithoutLicenseKey() TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		rt := cfg.Client.Transport
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = noLicenseKeyRoundTripper{rt: rt}
+	}
+}
+
+// noLicenseKeyRoundTripper removes the license key headers of the
+// requests.
+type noLicenseKeyRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t noLicenseKeyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.Header.Del("Api-Key")
+	req.Header.Del("X-License-Key")
+	return t.rt.RoundTrip(req)
+}
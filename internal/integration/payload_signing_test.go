@@ -0,0 +1,111 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, dir, key string) string {
+	file, err := ioutil.TempFile(dir, "hmac.key")
+	require.NoError(t, err)
+	_, err = file.WriteString(key)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	return file.Name()
+}
+
+func signingDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "signing")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestSigningRoundTripper(t *testing.T) {
+	dir := signingDir(t)
+	defer os.RemoveAll(dir)
+	signer, err := NewHMACSigner(writeKeyFile(t, dir, "secret\n"), "")
+	require.NoError(t, err)
+	signer.now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	var headers http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: NewSigningRoundTripper(signer, nil)}
+	resp, err := client.Post(ts.URL, "application/json", strings.NewReader(`{"metrics":[]}`))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(`1600000000.{"metrics":[]}`))
+	assert.Equal(t, `{"metrics":[]}`, string(body), "the body is still sent")
+	assert.Equal(t, "1600000000", headers.Get("X-Payload-Timestamp"))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), headers.Get("X-Payload-Signature"))
+}
+
+func TestRemoteWriteEmitter_Signer(t *testing.T) {
+	dir := signingDir(t)
+	defer os.RemoveAll(dir)
+	signer, err := NewHMACSigner(writeKeyFile(t, dir, "secret"), "X-Signature")
+	require.NoError(t, err)
+
+	signatures := make(chan string, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatures <- r.Header.Get("X-Signature")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	re, err := NewRemoteWriteEmitter(RemoteWriteConfig{URL: endpoint.URL, Signer: signer})
+	require.NoError(t, err)
+	require.NoError(t, re.Emit([]Metric{{name: "up", value: 1, metricType: metricType_GAUGE}}))
+	assert.True(t, strings.HasPrefix(<-signatures, "sha256="))
+}
+
+func TestNoLicenseKeyRoundTripper(t *testing.T) {
+	var headers http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Api-Key", "key")
+	req.Header.Set("X-License-Key", "key")
+	resp, err := noLicenseKeyRoundTripper{rt: http.DefaultTransport}.RoundTrip(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Empty(t, headers.Get("Api-Key"))
+	assert.Empty(t, headers.Get("X-License-Key"))
+	assert.Equal(t, "key", req.Header.Get("Api-Key"), "the request is not modified")
+}
+
+func TestPayloadSigningConfig_Validate(t *testing.T) {
+	dir := signingDir(t)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, PayloadSigningConfig{}.Validate())
+	assert.NoError(t, PayloadSigningConfig{HMACKeyFile: writeKeyFile(t, dir, "secret"), OmitLicenseKey: true}.Validate())
+	assert.Error(t, PayloadSigningConfig{OmitLicenseKey: true}.Validate(), "the license key is omitted without authentication")
+	assert.Error(t, PayloadSigningConfig{HMACKeyFile: writeKeyFile(t, dir, " \n")}.Validate(), "the key is empty")
+	assert.Error(t, PayloadSigningConfig{HMACKeyFile: "/nonexistent/hmac.key"}.Validate())
+	assert.Error(t, PayloadSigningConfig{CertFile: "client.pem"}.Validate(), "the key of the certificate is missing")
+}
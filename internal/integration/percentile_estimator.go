@@ -0,0 +1,75 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+
+	"github.com/newrelic/nri-prometheus/internal/histogram"
+)
+
+// PercentileEstimator is how the percentiles of the histograms are estimated
+// from their buckets.
+type PercentileEstimator string
+
+const (
+	// PercentileLinear interpolates the percentiles linearly within their
+	// bucket, the default.
+	PercentileLinear PercentileEstimator = "linear"
+	// PercentileDDSketch estimates the percentiles with a DDSketch built
+	// from the buckets, interpolating them in the logarithmic scale within
+	// their bucket, which is more accurate for the wide buckets of the
+	// latencies.
+	PercentileDDSketch PercentileEstimator = "ddsketch"
+)
+
+// defaultPercentileRelativeAccuracy is the relative accuracy of the
+// DDSketch estimator if not configured.
+const defaultPercentileRelativeAccuracy = 0.01
+
+// ParsePercentileEstimator returns the PercentileEstimator with the given
+// name, or the linear one if empty.
+func ParsePercentileEstimator(name string) (PercentileEstimator, error) {
+	switch e := PercentileEstimator(name); e {
+	case "":
+		return PercentileLinear, nil
+	case PercentileLinear, PercentileDDSketch:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid percentile estimator %q, must be one of %s or %s",
+		name, PercentileLinear, PercentileDDSketch)
+}
+
+// ValidatePercentileRelativeAccuracy returns an error if the relative
+// accuracy of the DDSketch estimator isn't between 0 and 1. 0 is the
+// default accuracy.
+func ValidatePercentileRelativeAccuracy(accuracy float64) error {
+	if accuracy < 0 || accuracy >= 1 {
+		return fmt.Errorf("percentile_relative_accuracy must be between 0 and 1, got %v", accuracy)
+	}
+	return nil
+}
+
+// percentileEstimates returns the function estimating the percentiles of the
+// buckets with the estimator of the emitter. The DDSketch estimator falls
+// back to the linear one for the buckets it can't be built from, like the
+// ones needing too many bins for the accuracy.
+func (te *TelemetryEmitter) percentileEstimates(buckets histogram.Buckets) func(p float64) (float64, error) {
+	linear := func(p float64) (float64, error) {
+		return histogram.Percentile(p, buckets)
+	}
+	if te.percentileEstimator != PercentileDDSketch {
+		return linear
+	}
+	accuracy := te.percentileAccuracy
+	if accuracy == 0 {
+		accuracy = defaultPercentileRelativeAccuracy
+	}
+	sketch, err := histogram.NewSketch(buckets, accuracy)
+	if err != nil {
+		ilog.WithError(err).Debug("estimating the percentiles linearly")
+		return linear
+	}
+	return sketch.Percentile
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/histogram"
+)
+
+func TestParsePercentileEstimator(t *testing.T) {
+	e, err := ParsePercentileEstimator("")
+	require.NoError(t, err)
+	assert.Equal(t, PercentileLinear, e)
+	e, err = ParsePercentileEstimator("ddsketch")
+	require.NoError(t, err)
+	assert.Equal(t, PercentileDDSketch, e)
+	_, err = ParsePercentileEstimator("tdigest")
+	assert.Error(t, err)
+
+	assert.NoError(t, ValidatePercentileRelativeAccuracy(0))
+	assert.NoError(t, ValidatePercentileRelativeAccuracy(0.005))
+	assert.Error(t, ValidatePercentileRelativeAccuracy(1))
+}
+
+func TestTelemetryEmitter_PercentileEstimates(t *testing.T) {
+	buckets := func() histogram.Buckets {
+		return histogram.Buckets{
+			{UpperBound: 0.01, Count: 0},
+			{UpperBound: 0.1, Count: 50},
+			{UpperBound: 1, Count: 100},
+			{UpperBound: math.Inf(1), Count: 100},
+		}
+	}
+	median := math.Pow(10, -1.5)
+
+	linear := (&TelemetryEmitter{}).percentileEstimates(buckets())
+	v, err := linear(25)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.055, v, 1e-9)
+
+	sketch := (&TelemetryEmitter{percentileEstimator: PercentileDDSketch}).percentileEstimates(buckets())
+	v, err = sketch(25)
+	require.NoError(t, err)
+	assert.InEpsilon(t, median, v, defaultPercentileRelativeAccuracy)
+
+	tooManyBins := (&TelemetryEmitter{percentileEstimator: PercentileDDSketch, percentileAccuracy: 0.0001}).percentileEstimates(buckets())
+	v, err = tooManyBins(25)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.055, v, 1e-9, "the percentiles are estimated linearly if the sketch needs too many bins")
+}
@@ -0,0 +1,61 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// PercentileFormat is the type of the percentile attribute of the
+// percentiles of the histograms and summaries.
+type PercentileFormat string
+
+const (
+	// PercentileNumeric sends the percentile as a number, like 99.9, the
+	// default.
+	PercentileNumeric PercentileFormat = "numeric"
+	// PercentileString sends the percentile as a string, like "99.9", so
+	// it can be faceted by in NRQL.
+	PercentileString PercentileFormat = "string"
+	// PercentileBoth sends the percentile as a number, and as a string in
+	// the percentileStringAttribute, so the queries of either form work.
+	PercentileBoth PercentileFormat = "both"
+)
+
+// percentileStringAttribute is the percentile as a string, when both
+// formats are sent.
+const percentileStringAttribute = "percentileString"
+
+// ParsePercentileFormat returns the PercentileFormat with the given name,
+// or the numeric one if empty.
+func ParsePercentileFormat(name string) (PercentileFormat, error) {
+	switch f := PercentileFormat(name); f {
+	case "":
+		return PercentileNumeric, nil
+	case PercentileNumeric, PercentileString, PercentileBoth:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid percentile format %q, must be one of %s, %s or %s",
+		name, PercentileNumeric, PercentileString, PercentileBoth)
+}
+
+// recordPercentile records the percentile p of a histogram or a summary,
+// with the percentile attribute in the configured format.
+func (te *TelemetryEmitter) recordPercentile(name string, attrs map[string]interface{}, p, value float64, timestamp time.Time) {
+	if te.percentileFormat != PercentileString && te.percentileFormat != PercentileBoth {
+		te.recordGauge(name, attrs, "percentile", p, value, timestamp)
+		return
+	}
+	attrs = copyAttrs(attrs)
+	label := strconv.FormatFloat(p, 'f', -1, 64)
+	if te.percentileFormat == PercentileString {
+		attrs["percentile"] = label
+	} else {
+		attrs["percentile"] = p
+		attrs[percentileStringAttribute] = label
+	}
+	te.recordGauge(name, attrs, "", 0, value, timestamp)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestParsePercentileFormat(t *testing.T) {
+	format, err := ParsePercentileFormat("")
+	require.NoError(t, err)
+	assert.Equal(t, PercentileNumeric, format)
+	format, err = ParsePercentileFormat("both")
+	require.NoError(t, err)
+	assert.Equal(t, PercentileBoth, format)
+	_, err = ParsePercentileFormat("text")
+	assert.Error(t, err)
+}
+
+func TestTelemetryEmitter_PercentileFormat(t *testing.T) {
+	cases := []struct {
+		format   PercentileFormat
+		expected map[string]interface{}
+	}{
+		{PercentileNumeric, map[string]interface{}{"percentile": 99.9}},
+		{PercentileString, map[string]interface{}{"percentile": "99.9"}},
+		{PercentileBoth, map[string]interface{}{"percentile": 99.9, percentileStringAttribute: "99.9"}},
+	}
+	for _, c := range cases {
+		for _, preEncode := range []bool{false, true} {
+			t.Run(string(c.format)+map[bool]string{false: "", true: "/pre-encoded"}[preEncode], func(t *testing.T) {
+				var sent []map[string]interface{}
+				e, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+					HarvesterOpts: []TelemetryHarvesterOpt{
+						telemetry.ConfigAPIKey("api key"),
+						TelemetryHarvesterWithMetricsURL("nilapiurl"),
+						func(cfg *telemetry.Config) {
+							cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+								var payload []map[string]interface{}
+								reader, err := gzip.NewReader(req.Body)
+								require.NoError(t, err)
+								require.NoError(t, json.NewDecoder(reader).Decode(&payload))
+								for _, m := range payload[0]["metrics"].([]interface{}) {
+									sent = append(sent, m.(map[string]interface{}))
+								}
+								return emptyResponse(http.StatusAccepted), nil
+							})
+						},
+					},
+					PreEncodeAttributes: preEncode,
+					PercentileFormat:    c.format,
+				})
+				require.NoError(t, err)
+
+				quantile, value := 0.999, 1.5
+				require.NoError(t, e.Emit([]Metric{{
+					name:       "latency",
+					metricType: metricType_SUMMARY,
+					attributes: labels.Set{"targetName": "target-a"},
+					summary: &dto.Summary{Quantile: []*dto.Quantile{
+						{Quantile: &quantile, Value: &value},
+					}},
+				}}))
+				e.harvester.HarvestNow(context.Background())
+
+				require.Len(t, sent, 1)
+				attrs := sent[0]["attributes"].(map[string]interface{})
+				for k, v := range c.expected {
+					if f, ok := v.(float64); ok {
+						assert.InDelta(t, f, attrs[k], 1e-9, k)
+					} else {
+						assert.Equal(t, v, attrs[k], k)
+					}
+				}
+				if c.format == PercentileNumeric {
+					assert.NotContains(t, attrs, percentileStringAttribute)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// maxReportedMetrics is the number of metric names listed per finding of the
+// PII audit report.
+const maxReportedMetrics = 5
+
+// PIIPattern flags the attributes likely containing personal data: the ones
+// whose name match AttributeName as a whole, or whose value contains a match
+// of ValuePattern.
+type PIIPattern struct {
+	Name          string `mapstructure:"name"`
+	AttributeName string `mapstructure:"attribute_name"`
+	ValuePattern  string `mapstructure:"value_pattern"`
+}
+
+// DefaultPIIPatterns are used by the PII audit when no pattern is
+// configured.
+var DefaultPIIPatterns = []PIIPattern{
+	{Name: "email", ValuePattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	{Name: "ipv4", ValuePattern: `\b(?:\d{1,3}\.){3}\d{1,3}\b`},
+	{Name: "phone", ValuePattern: `\+\d{1,3}[ -]?\d{6,14}\b`},
+	{Name: "payment_card", ValuePattern: `\b\d{4}[ -]\d{4}[ -]\d{4}[ -]\d{1,4}\b`},
+	{Name: "jwt", ValuePattern: `eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`},
+	{Name: "personal_attribute", AttributeName: `(?i).*(e_?mail|user_?name|user_?id|phone|ssn|first_?name|last_?name).*`},
+}
+
+type piiPattern struct {
+	name          string
+	attributeName *regexp.Regexp
+	valuePattern  *regexp.Regexp
+}
+
+func (p PIIPattern) compile() (*piiPattern, error) {
+	if p.Name == "" {
+		return nil, fmt.Errorf("PII pattern needs a name")
+	}
+	if p.AttributeName == "" && p.ValuePattern == "" {
+		return nil, fmt.Errorf("PII pattern %q needs an attribute_name or a value_pattern", p.Name)
+	}
+	cp := &piiPattern{name: p.Name}
+	var err error
+	if p.AttributeName != "" {
+		if cp.attributeName, err = regexp.Compile("^(?:" + p.AttributeName + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid attribute_name of PII pattern %q: %w", p.Name, err)
+		}
+	}
+	if p.ValuePattern != "" {
+		if cp.valuePattern, err = regexp.Compile(p.ValuePattern); err != nil {
+			return nil, fmt.Errorf("invalid value_pattern of PII pattern %q: %w", p.Name, err)
+		}
+	}
+	return cp, nil
+}
+
+func (p *piiPattern) matches(name string, value interface{}) bool {
+	if p.attributeName != nil && p.attributeName.MatchString(name) {
+		return true
+	}
+	if p.valuePattern == nil {
+		return false
+	}
+	s, ok := value.(string)
+	return ok && p.valuePattern.MatchString(s)
+}
+
+// PIIFinding is an attribute matching a PII pattern.
+type PIIFinding struct {
+	Attribute string
+	Pattern   string
+	// Series is the number of series with a matching attribute.
+	Series int
+	// Metrics are the sorted names of the metrics with a matching attribute.
+	Metrics []string
+}
+
+type piiFindingKey struct {
+	attribute string
+	pattern   string
+}
+
+// PIIAudit is an Emitter that, instead of emitting the metrics, scans their
+// attributes for personal data.
+type PIIAudit struct {
+	patterns []*piiPattern
+
+	mu       sync.Mutex
+	series   int
+	findings map[piiFindingKey]*PIIFinding
+	metrics  map[piiFindingKey]map[string]bool
+}
+
+// NewPIIAudit returns a PIIAudit scanning for the patterns.
+func NewPIIAudit(patterns ...PIIPattern) (*PIIAudit, error) {
+	audit := &PIIAudit{
+		findings: map[piiFindingKey]*PIIFinding{},
+		metrics:  map[piiFindingKey]map[string]bool{},
+	}
+	for _, p := range patterns {
+		cp, err := p.compile()
+		if err != nil {
+			return nil, err
+		}
+		audit.patterns = append(audit.patterns, cp)
+	}
+	return audit, nil
+}
+
+// Name is the name of the audit.
+func (a *PIIAudit) Name() string {
+	return "pii_audit"
+}
+
+// Emit scans the attributes of the metrics.
+func (a *PIIAudit) Emit(metrics []Metric) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, m := range metrics {
+		a.series++
+		for name, value := range m.attributes {
+			for _, p := range a.patterns {
+				if !p.matches(name, value) {
+					continue
+				}
+				key := piiFindingKey{attribute: name, pattern: p.name}
+				f, ok := a.findings[key]
+				if !ok {
+					f = &PIIFinding{Attribute: name, Pattern: p.name}
+					a.findings[key] = f
+					a.metrics[key] = map[string]bool{}
+				}
+				f.Series++
+				a.metrics[key][m.name] = true
+			}
+		}
+	}
+	return nil
+}
+
+// Findings returns the attributes matching any pattern, sorted by attribute
+// and pattern.
+func (a *PIIAudit) Findings() []PIIFinding {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	findings := make([]PIIFinding, 0, len(a.findings))
+	for key, f := range a.findings {
+		finding := *f
+		finding.Metrics = make([]string, 0, len(a.metrics[key]))
+		for name := range a.metrics[key] {
+			finding.Metrics = append(finding.Metrics, name)
+		}
+		sort.Strings(finding.Metrics)
+		findings = append(findings, finding)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Attribute != findings[j].Attribute {
+			return findings[i].Attribute < findings[j].Attribute
+		}
+		return findings[i].Pattern < findings[j].Pattern
+	})
+	return findings
+}
+
+// WriteReport writes the findings as a table. The values of the attributes
+// aren't included, so the report can be shared.
+func (a *PIIAudit) WriteReport(w io.Writer) error {
+	findings := a.Findings()
+	a.mu.Lock()
+	series := a.series
+	a.mu.Unlock()
+
+	if len(findings) == 0 {
+		_, err := fmt.Fprintf(w, "No attributes likely containing personal data found in %d series.\n", series)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ATTRIBUTE\tPATTERN\tSERIES\tMETRICS")
+	for _, f := range findings {
+		metrics := f.Metrics
+		more := ""
+		if len(metrics) > maxReportedMetrics {
+			more = fmt.Sprintf(" (+%d more)", len(metrics)-maxReportedMetrics)
+			metrics = metrics[:maxReportedMetrics]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s%s\n", f.Attribute, f.Pattern, f.Series, strings.Join(metrics, ","), more)
+	}
+	fmt.Fprintf(tw, "\n%d attributes likely containing personal data found in %d series.\n", len(findings), series)
+	return tw.Flush()
+}
+
+// Audit scrapes the targets of the retrievers once and processes their
+// metrics as the integration loop does, scanning them with the audit instead
+// of emitting them. The audit covers the attributes as they would be
+// emitted, after the processing rules.
+func Audit(retrievers []endpoints.TargetRetriever, fetcher Fetcher, processor Processor, audit *PIIAudit) {
+	ExecuteOnce(retrievers, fetcher, processor, []Emitter{audit})
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+const piiInput = `# TYPE logins_total counter
+logins_total{email="jane@example.com",result="ok"} 3
+logins_total{email="john@example.com",result="failed"} 1
+# TYPE sessions gauge
+sessions{user_id="42",client="10.1.2.3"} 2
+# TYPE up gauge
+up 1
+`
+
+func TestAudit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, piiInput)
+	}))
+	defer server.Close()
+
+	fr, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: []string{server.URL}})
+	require.NoError(t, err)
+	audit, err := NewPIIAudit(DefaultPIIPatterns...)
+	require.NoError(t, err)
+
+	Audit(
+		[]endpoints.TargetRetriever{fr},
+		NewFetcher(30*time.Second, 5*time.Second, 4, "", "", false, queueLength),
+		RuleProcessor([]ProcessingRule{{
+			RedactAttributes: []RedactRule{{AttributeName: "client"}},
+		}}, queueLength),
+		audit,
+	)
+
+	findings := audit.Findings()
+	byKey := map[string]PIIFinding{}
+	for _, f := range findings {
+		byKey[f.Attribute+"/"+f.Pattern] = f
+	}
+	assert.Equal(t, PIIFinding{Attribute: "email", Pattern: "email", Series: 2, Metrics: []string{"logins_total"}}, byKey["email/email"])
+	assert.Equal(t, PIIFinding{Attribute: "email", Pattern: "personal_attribute", Series: 2, Metrics: []string{"logins_total"}}, byKey["email/personal_attribute"])
+	assert.Equal(t, PIIFinding{Attribute: "user_id", Pattern: "personal_attribute", Series: 1, Metrics: []string{"sessions"}}, byKey["user_id/personal_attribute"])
+	assert.NotContains(t, byKey, "client/ipv4", "redacted attributes aren't reported")
+	assert.NotContains(t, byKey, "result/personal_attribute")
+
+	var report bytes.Buffer
+	require.NoError(t, audit.WriteReport(&report))
+	assert.Contains(t, report.String(), "ATTRIBUTE")
+	assert.NotContains(t, report.String(), "jane@example.com", "values aren't reported")
+}
+
+func TestPIIAudit_WriteReport(t *testing.T) {
+	audit, err := NewPIIAudit(PIIPattern{Name: "email", ValuePattern: `\S+@\S+`})
+	require.NoError(t, err)
+
+	var empty bytes.Buffer
+	require.NoError(t, audit.Emit([]Metric{{name: "up", attributes: map[string]interface{}{"job": "node"}}}))
+	require.NoError(t, audit.WriteReport(&empty))
+	assert.Equal(t, "No attributes likely containing personal data found in 1 series.\n", empty.String())
+
+	var metrics []Metric
+	for i := 0; i < 7; i++ {
+		metrics = append(metrics, Metric{
+			name:       fmt.Sprintf("metric_%d", i),
+			attributes: map[string]interface{}{"owner": "jane@example.com"},
+		})
+	}
+	require.NoError(t, audit.Emit(metrics))
+
+	var report bytes.Buffer
+	require.NoError(t, audit.WriteReport(&report))
+	assert.Equal(t, `ATTRIBUTE  PATTERN  SERIES  METRICS
+owner      email    7       metric_0,metric_1,metric_2,metric_3,metric_4 (+2 more)
+
+1 attributes likely containing personal data found in 8 series.
+`, report.String())
+}
+
+func TestNewPIIAudit_InvalidPatterns(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern PIIPattern
+	}{
+		{"no name", PIIPattern{ValuePattern: "x"}},
+		{"no attribute or pattern", PIIPattern{Name: "x"}},
+		{"invalid attribute name", PIIPattern{Name: "x", AttributeName: "("}},
+		{"invalid value pattern", PIIPattern{Name: "x", ValuePattern: "[a-"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPIIAudit(tt.pattern)
+			assert.Error(t, err)
+		})
+	}
+}
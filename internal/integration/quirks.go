@@ -0,0 +1,170 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// Quirk is a workaround of a known issue of an exporter, applied to the
+// scrapes of the targets detected as running it.
+type Quirk struct {
+	// Name identifies the quirk in the logs.
+	Name string `mapstructure:"name"`
+	// DetectMetrics detects the exporter by the prefixes of the names of
+	// the metrics it exposes.
+	DetectMetrics []string `mapstructure:"detect_metrics"`
+	// DropTimestamps ignores the timestamps of the samples, e.g. the stale
+	// ones of old cAdvisor versions.
+	DropTimestamps bool `mapstructure:"drop_timestamps"`
+	// DropDuplicateSeries keeps only the first sample of the series exposed
+	// more than once with the same labels, e.g. by HAProxy.
+	DropDuplicateSeries bool `mapstructure:"drop_duplicate_series"`
+	// DropNaN drops the gauges, counters and untyped samples with a NaN
+	// value, e.g. the ones of the JMX exporter for unavailable attributes.
+	DropNaN bool `mapstructure:"drop_nan"`
+}
+
+// builtinQuirks are the workarounds of the known issues of popular
+// exporters.
+var builtinQuirks = []Quirk{
+	{Name: "cadvisor", DetectMetrics: []string{"cadvisor_version_info"}, DropTimestamps: true},
+	{Name: "haproxy", DetectMetrics: []string{"haproxy_"}, DropDuplicateSeries: true},
+	{Name: "jmx", DetectMetrics: []string{"jmx_scrape_", "jmx_exporter_"}, DropNaN: true},
+}
+
+// QuirksConfig configures the exporter quirks applied to the scrapes.
+type QuirksConfig struct {
+	// DisableBuiltin disables the built-in quirks, of cAdvisor, HAProxy
+	// and the JMX exporter.
+	DisableBuiltin bool `mapstructure:"disable_builtin"`
+	// Custom quirks, applied besides the built-in ones.
+	Custom []Quirk `mapstructure:"custom"`
+}
+
+// Validate returns an error if a custom quirk has no name, can't be
+// detected or doesn't apply any workaround.
+func (c QuirksConfig) Validate() error {
+	for _, q := range c.Custom {
+		if q.Name == "" {
+			return fmt.Errorf("the quirks must have a name")
+		}
+		if len(q.DetectMetrics) == 0 {
+			return fmt.Errorf("quirk %q must have detect_metrics", q.Name)
+		}
+		if !q.DropTimestamps && !q.DropDuplicateSeries && !q.DropNaN {
+			return fmt.Errorf("quirk %q doesn't apply any workaround", q.Name)
+		}
+	}
+	return nil
+}
+
+// Quirks returns the built-in quirks, unless disabled, and the custom ones.
+func (c QuirksConfig) Quirks() []Quirk {
+	var quirks []Quirk
+	if !c.DisableBuiltin {
+		quirks = append(quirks, builtinQuirks...)
+	}
+	return append(quirks, c.Custom...)
+}
+
+// WithQuirks applies the quirks to the scrapes of the targets whose exporter
+// they detect.
+func WithQuirks(quirks []Quirk) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.quirks = quirks
+	}
+}
+
+// detects returns true if the metric families are of the exporter of the
+// quirk.
+func (q *Quirk) detects(mfs prometheus.MetricFamiliesByName) bool {
+	for name := range mfs {
+		for _, prefix := range q.DetectMetrics {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyQuirks applies the quirks detected in the metric families to them,
+// returning the names of the applied quirks and the number of samples they
+// dropped.
+func applyQuirks(mfs prometheus.MetricFamiliesByName, quirks []Quirk) (applied []string, dropped int) {
+	for i := range quirks {
+		q := &quirks[i]
+		if !q.detects(mfs) {
+			continue
+		}
+		applied = append(applied, q.Name)
+		for name, mf := range mfs {
+			if q.DropTimestamps {
+				for _, m := range mf.Metric {
+					m.TimestampMs = nil
+				}
+			}
+			before := len(mf.Metric)
+			if q.DropNaN {
+				mf.Metric = dropNaNSamples(mf.GetType(), mf.Metric)
+			}
+			if q.DropDuplicateSeries {
+				mf.Metric = dropDuplicateSeries(mf.Metric)
+			}
+			dropped += before - len(mf.Metric)
+			mfs[name] = mf
+		}
+	}
+	return applied, dropped
+}
+
+// dropNaNSamples removes the samples with a NaN value, in place.
+func dropNaNSamples(mtype dto.MetricType, metrics []*dto.Metric) []*dto.Metric {
+	kept := metrics[:0]
+	for _, m := range metrics {
+		value := gaugeValue(mtype, m)
+		if mtype == dto.MetricType_COUNTER {
+			value = m.GetCounter().GetValue()
+		}
+		if !math.IsNaN(value) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// dropDuplicateSeries keeps the first sample of every series, in place. The
+// samples with different timestamps aren't duplicates.
+func dropDuplicateSeries(metrics []*dto.Metric) []*dto.Metric {
+	type sample struct {
+		fp        model.Fingerprint
+		timestamp int64
+	}
+	seen := make(map[sample]bool, len(metrics))
+	kept := metrics[:0]
+	lbls := map[string]string{}
+	for _, m := range metrics {
+		for k := range lbls {
+			delete(lbls, k)
+		}
+		for _, l := range m.GetLabel() {
+			lbls[l.GetName()] = l.GetValue()
+		}
+		key := sample{fp: model.Fingerprint(model.LabelsToSignature(lbls)), timestamp: m.GetTimestampMs()}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, m)
+	}
+	return kept
+}
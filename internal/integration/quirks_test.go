@@ -0,0 +1,51 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const quirkySamples = `# TYPE haproxy_backend_up gauge
+haproxy_backend_up{backend="api"} 1
+haproxy_backend_up{backend="api"} 0
+haproxy_backend_up{backend="web"} 1
+# TYPE jmx_scrape_duration_seconds gauge
+jmx_scrape_duration_seconds 0.1
+# TYPE java_lang_memory_used gauge
+java_lang_memory_used{area="heap"} NaN
+java_lang_memory_used{area="nonheap"} 10
+# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{id="/"} 5 1000
+`
+
+func TestApplyQuirks(t *testing.T) {
+	mfs, err := decodePromMetrics(strings.NewReader(quirkySamples))
+	require.NoError(t, err)
+
+	applied, dropped := applyQuirks(*mfs, QuirksConfig{}.Quirks())
+	assert.Equal(t, []string{"haproxy", "jmx"}, applied, "only the quirks of the detected exporters are applied")
+	assert.Equal(t, 2, dropped)
+	assert.Len(t, (*mfs)["haproxy_backend_up"].Metric, 2)
+	assert.Equal(t, 1.0, (*mfs)["haproxy_backend_up"].Metric[0].GetGauge().GetValue(), "the first sample of a series is kept")
+	assert.Len(t, (*mfs)["java_lang_memory_used"].Metric, 1)
+	assert.NotNil(t, (*mfs)["container_cpu_usage_seconds_total"].Metric[0].TimestampMs)
+
+	applied, _ = applyQuirks(*mfs, QuirksConfig{
+		DisableBuiltin: true,
+		Custom:         []Quirk{{Name: "old-cadvisor", DetectMetrics: []string{"container_"}, DropTimestamps: true}},
+	}.Quirks())
+	assert.Equal(t, []string{"old-cadvisor"}, applied)
+	assert.Nil(t, (*mfs)["container_cpu_usage_seconds_total"].Metric[0].TimestampMs)
+}
+
+func TestQuirksConfig_Validate(t *testing.T) {
+	assert.NoError(t, QuirksConfig{}.Validate())
+	assert.Error(t, QuirksConfig{Custom: []Quirk{{DetectMetrics: []string{"app_"}, DropNaN: true}}}.Validate())
+	assert.Error(t, QuirksConfig{Custom: []Quirk{{Name: "app", DropNaN: true}}}.Validate())
+	assert.Error(t, QuirksConfig{Custom: []Quirk{{Name: "app", DetectMetrics: []string{"app_"}}}}.Validate())
+}
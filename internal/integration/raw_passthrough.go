@@ -0,0 +1,136 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	promcli "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// Headers of the forwarded payloads identifying their target.
+const (
+	rawPassthroughTargetHeader = "X-Scrape-Target"
+	rawPassthroughURLHeader    = "X-Scrape-Target-Url"
+)
+
+// RawPassthrough forwards the payloads scraped from the targets of a job as
+// they are exposed to an HTTP endpoint, like an internal Prometheus during a
+// migration, instead of processing them and emitting their metrics.
+type RawPassthrough struct {
+	// URL the payloads are POSTed to, with the content type of the scrape
+	// and the target name and URL in the X-Scrape-Target and
+	// X-Scrape-Target-Url headers. The passthrough is disabled if empty.
+	URL string `mapstructure:"url"`
+	// Headers added to the forwarded requests, like their credentials.
+	Headers map[string]string `mapstructure:"headers"`
+}
+
+// IsEmpty returns true if the payloads aren't forwarded.
+func (p RawPassthrough) IsEmpty() bool {
+	return p.URL == ""
+}
+
+// Validate returns an error if the URL isn't an absolute HTTP one.
+func (p RawPassthrough) Validate() error {
+	if p.IsEmpty() {
+		return nil
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("invalid raw_passthrough url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("the raw_passthrough url must be http or https, got %q", p.URL)
+	}
+	return nil
+}
+
+// forwardRaw scrapes the target and forwards its payload to the passthrough
+// endpoint of its job.
+func (pf *prometheusFetcher) forwardRaw(t endpoints.Target, job *jobClient) {
+	timer := promcli.NewTimer(promcli.ObserverFunc(fetchTargetDurationMetric.WithLabelValues(t.Name).Set))
+	resp, err := pf.scrapeRaw(&t)
+	timer.ObserveDuration()
+	pf.fetched(&t, err)
+	if err != nil {
+		rawPassthroughMetric.WithLabelValues(job.name, "scrape_error").Inc()
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := job.forward(&t, resp); err != nil {
+		pf.log.WithError(err).WithField("target", t.Name).Warn("forwarding the raw payload")
+		rawPassthroughMetric.WithLabelValues(job.name, "forward_error").Inc()
+		return
+	}
+	rawPassthroughMetric.WithLabelValues(job.name, "success").Inc()
+}
+
+// scrapeRaw requests the payload of the target with the HTTP client of its
+// configuration, through the same limits, timeouts, fault injection and
+// debug capture as the processed scrapes, retrying the transient errors.
+func (pf *prometheusFetcher) scrapeRaw(t *endpoints.Target) (*http.Response, error) {
+	url := pf.scrapeURL(t)
+	httpClient := pf.targetClient(t)
+	timeout := pf.clientTimeout(httpClient)
+	httpClient = pf.debugCapture.doer(pf.hostLimiter.doer(pf.timeouts.doer(pf.faults.doer(httpClient))), t.Name, url)
+	var resp *http.Response
+	err := pf.retryScrape(t.Name, timeout, func() (err error) {
+		resp, err = getRaw(httpClient, url)
+		return err
+	}, nil)
+	return resp, err
+}
+
+// getRaw requests the URL, returning the response if it succeeded.
+func getRaw(httpClient prometheus.HTTPDoer, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("target returned status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// forward POSTs the scraped payload of the target to the passthrough
+// endpoint of the job, streaming it. The credentials of the target URL aren't
+// forwarded.
+func (c *jobClient) forward(t *endpoints.Target, scraped *http.Response) error {
+	req, err := http.NewRequest("POST", c.passthrough.URL, scraped.Body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", scraped.Header.Get("Content-Type"))
+	req.Header.Set(rawPassthroughTargetHeader, t.Name)
+	req.Header.Set(rawPassthroughURLHeader, endpoints.RedactedURL(t.URL))
+	for k, v := range c.passthrough.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the raw passthrough endpoint returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
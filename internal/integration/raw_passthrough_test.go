@@ -0,0 +1,127 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestFetcher_RawPassthrough(t *testing.T) {
+	const payload = "# TYPE up gauge\nup{instance=\"a\"} 1\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var forwarded []*http.Request
+	var bodies []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		mu.Lock()
+		forwarded = append(forwarded, r)
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength,
+		WithScrapeJobs(ScrapeJob{
+			Name:  "migration",
+			Match: map[string]string{"namespaceName": "legacy"},
+			RawPassthrough: RawPassthrough{
+				URL:     receiver.URL + "/ingest",
+				Headers: map[string]string{"Authorization": "Bearer secret"},
+			},
+		}))
+
+	target := func(namespace string) endpoints.Target {
+		u, err := url.Parse(ts.URL + "/metrics")
+		require.NoError(t, err)
+		return endpoints.New(namespace, *u, endpoints.Object{Name: namespace, Kind: "pod", Labels: labels.Set{"namespaceName": namespace}})
+	}
+	var fetched []string
+	for pair := range fetcher.Fetch([]endpoints.Target{target("legacy"), target("other")}) {
+		fetched = append(fetched, pair.Target.Name)
+	}
+	assert.Equal(t, []string{"other"}, fetched, "the metrics of the passthrough targets aren't processed")
+
+	require.Len(t, forwarded, 1)
+	assert.Equal(t, payload, bodies[0], "the payload is forwarded as is")
+	assert.Equal(t, "POST", forwarded[0].Method)
+	assert.Equal(t, "/ingest", forwarded[0].URL.Path)
+	assert.Equal(t, "text/plain; version=0.0.4", forwarded[0].Header.Get("Content-Type"))
+	assert.Equal(t, "legacy", forwarded[0].Header.Get(rawPassthroughTargetHeader))
+	assert.Equal(t, ts.URL+"/metrics", forwarded[0].Header.Get(rawPassthroughURLHeader))
+	assert.Equal(t, "Bearer secret", forwarded[0].Header.Get("Authorization"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(rawPassthroughMetric.WithLabelValues("migration", "success")))
+}
+
+func TestFetcher_RawPassthroughRetriesAndRedactsURL(t *testing.T) {
+	var scrapes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&scrapes, 1) == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var forwardedURL string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		forwardedURL = r.Header.Get(rawPassthroughURLHeader)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	fetcher := NewFetcher(time.Minute, fetchTimeout, maxConnections, "", "", false, queueLength,
+		WithScrapeRetries(1, time.Millisecond),
+		WithScrapeJobs(ScrapeJob{
+			Name:           "retried",
+			Match:          map[string]string{"namespaceName": "legacy"},
+			RawPassthrough: RawPassthrough{URL: receiver.URL},
+		}))
+	u, err := url.Parse(ts.URL + "/metrics")
+	require.NoError(t, err)
+	u.User = url.UserPassword("user", "secret")
+	target := endpoints.New("legacy", *u, endpoints.Object{Name: "legacy", Kind: "pod", Labels: labels.Set{"namespaceName": "legacy"}})
+	for range fetcher.Fetch([]endpoints.Target{target}) {
+	}
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&scrapes), "the transient errors are retried")
+	assert.Equal(t, 1.0, testutil.ToFloat64(rawPassthroughMetric.WithLabelValues("retried", "success")))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.NotContains(t, forwardedURL, "secret")
+	assert.Equal(t, endpoints.RedactedURL(*u), forwardedURL)
+}
+
+func TestRawPassthrough_Validate(t *testing.T) {
+	assert.NoError(t, RawPassthrough{}.Validate())
+	assert.NoError(t, RawPassthrough{URL: "https://prometheus.internal/ingest"}.Validate())
+	assert.Error(t, RawPassthrough{URL: "prometheus.internal/ingest"}.Validate())
+	assert.Error(t, ValidateScrapeJobs([]ScrapeJob{{Name: "migration", RawPassthrough: RawPassthrough{URL: ":"}}}))
+}
@@ -0,0 +1,147 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Redaction actions.
+const (
+	// RedactMask replaces the redacted values with RedactedValue.
+	RedactMask = "mask"
+	// RedactHash replaces the redacted values with a hash of them, so they
+	// can still be told apart and grouped by.
+	RedactHash = "hash"
+)
+
+// RedactedValue replaces the masked values.
+const RedactedValue = "****"
+
+// hashLength is the number of hex characters kept of the value hashes.
+const hashLength = 16
+
+// RedactRule redacts the values of the attributes of the metrics that match
+// MetricPrefix. If AttributeName is set, only the attributes whose name
+// match it are redacted. If ValuePattern is set, only the parts of the values
+// matching it are redacted, and the whole values otherwise. Action is either
+// mask (the default) or hash, which replaces values with a salted SHA-256.
+type RedactRule struct {
+	MetricPrefix  string `mapstructure:"metric_prefix"`
+	AttributeName string `mapstructure:"attribute_name"`
+	ValuePattern  string `mapstructure:"value_pattern"`
+	Action        string `mapstructure:"action"`
+	Salt          string `mapstructure:"salt"`
+}
+
+// Validate returns an error if the patterns or the action of the rule are
+// not valid.
+func (r RedactRule) Validate() error {
+	_, err := r.compile()
+	return err
+}
+
+// redactor is a compiled RedactRule.
+type redactor struct {
+	metricPrefix  string
+	attributeName *regexp.Regexp
+	valuePattern  *regexp.Regexp
+	hash          bool
+	salt          string
+}
+
+func (r RedactRule) compile() (*redactor, error) {
+	rd := &redactor{metricPrefix: r.MetricPrefix, salt: r.Salt}
+	if r.AttributeName == "" && r.ValuePattern == "" {
+		return nil, fmt.Errorf("redaction rule needs an attribute_name or a value_pattern")
+	}
+	var err error
+	if r.AttributeName != "" {
+		// The attribute name has to match as a whole.
+		if rd.attributeName, err = regexp.Compile("^(?:" + r.AttributeName + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid redaction attribute_name: %w", err)
+		}
+	}
+	if r.ValuePattern != "" {
+		if rd.valuePattern, err = regexp.Compile(r.ValuePattern); err != nil {
+			return nil, fmt.Errorf("invalid redaction value_pattern: %w", err)
+		}
+	}
+	switch r.Action {
+	case "", RedactMask:
+	case RedactHash:
+		rd.hash = true
+	default:
+		return nil, fmt.Errorf("invalid redaction action %q, must be %s or %s", r.Action, RedactMask, RedactHash)
+	}
+	return rd, nil
+}
+
+// replacement returns the value the redacted string is replaced with.
+func (rd *redactor) replacement(s string) string {
+	if !rd.hash {
+		return RedactedValue
+	}
+	sum := sha256.Sum256([]byte(rd.salt + s))
+	return hex.EncodeToString(sum[:])[:hashLength]
+}
+
+// redact returns the redacted value, and whether it changed.
+func (rd *redactor) redact(value string) (string, bool) {
+	if rd.valuePattern == nil {
+		return rd.replacement(value), true
+	}
+	if !rd.valuePattern.MatchString(value) {
+		return value, false
+	}
+	return rd.valuePattern.ReplaceAllStringFunc(value, rd.replacement), true
+}
+
+// redactAttributes applies the redactors to the string attributes of the
+// metrics.
+func redactAttributes(targetMetrics *TargetMetrics, redactors []*redactor) {
+	if len(redactors) == 0 {
+		return
+	}
+	for mi := range targetMetrics.Metrics {
+		m := &targetMetrics.Metrics[mi]
+		for _, rd := range redactors {
+			if !strings.HasPrefix(m.name, rd.metricPrefix) {
+				continue
+			}
+			for name, value := range m.attributes {
+				s, ok := value.(string)
+				if !ok {
+					continue
+				}
+				if rd.attributeName != nil && !rd.attributeName.MatchString(name) {
+					continue
+				}
+				if redacted, changed := rd.redact(s); changed {
+					m.attributes[name] = redacted
+				}
+			}
+		}
+	}
+}
+
+// compileRedactRules returns the redactors of the valid rules. Invalid rules
+// are logged and skipped, as they are expected to be validated with the
+// configuration.
+func compileRedactRules(rules []RedactRule) []*redactor {
+	var redactors []*redactor
+	for _, r := range rules {
+		rd, err := r.compile()
+		if err != nil {
+			ilog.WithError(err).Error("skipping redaction rule")
+			continue
+		}
+		redactors = append(redactors, rd)
+	}
+	return redactors
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestRedactAttributes(t *testing.T) {
+	newMetrics := func() TargetMetrics {
+		return TargetMetrics{Metrics: []Metric{
+			{
+				name: "http_requests_total",
+				attributes: labels.Set{
+					"user":     "jane@example.com",
+					"path":     "/users/jane@example.com/orders",
+					"client":   "10.1.2.3",
+					"token_id": "abc123",
+					"code":     "200",
+					"count":    float64(3),
+				},
+			},
+			{
+				name: "process_open_fds",
+				attributes: labels.Set{
+					"user": "jane@example.com",
+				},
+			},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		rules    []RedactRule
+		expected labels.Set
+		other    labels.Set
+	}{
+		{
+			name:  "mask attribute by name",
+			rules: []RedactRule{{AttributeName: "user|token_.*"}},
+			expected: labels.Set{
+				"user":     RedactedValue,
+				"path":     "/users/jane@example.com/orders",
+				"client":   "10.1.2.3",
+				"token_id": RedactedValue,
+				"code":     "200",
+				"count":    float64(3),
+			},
+			other: labels.Set{"user": RedactedValue},
+		},
+		{
+			name:  "attribute name matches as a whole",
+			rules: []RedactRule{{AttributeName: "token"}},
+			expected: labels.Set{
+				"user":     "jane@example.com",
+				"path":     "/users/jane@example.com/orders",
+				"client":   "10.1.2.3",
+				"token_id": "abc123",
+				"code":     "200",
+				"count":    float64(3),
+			},
+			other: labels.Set{"user": "jane@example.com"},
+		},
+		{
+			name: "mask value pattern in any attribute",
+			rules: []RedactRule{
+				{ValuePattern: `[^@/\s]+@[^@/\s]+`},
+				{ValuePattern: `\d+\.\d+\.\d+\.\d+`},
+			},
+			expected: labels.Set{
+				"user":     RedactedValue,
+				"path":     "/users/" + RedactedValue + "/orders",
+				"client":   RedactedValue,
+				"token_id": "abc123",
+				"code":     "200",
+				"count":    float64(3),
+			},
+			other: labels.Set{"user": RedactedValue},
+		},
+		{
+			name: "hash by metric prefix",
+			rules: []RedactRule{
+				{MetricPrefix: "http_", AttributeName: "user", Action: RedactHash, Salt: "pepper"},
+			},
+			expected: labels.Set{
+				"user":     "2daebb07b6fe2686",
+				"path":     "/users/jane@example.com/orders",
+				"client":   "10.1.2.3",
+				"token_id": "abc123",
+				"code":     "200",
+				"count":    float64(3),
+			},
+			other: labels.Set{"user": "jane@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range tt.rules {
+				require.NoError(t, r.Validate())
+			}
+			metrics := newMetrics()
+			redactAttributes(&metrics, compileRedactRules(tt.rules))
+			assert.Equal(t, tt.expected, metrics.Metrics[0].attributes)
+			assert.Equal(t, tt.other, metrics.Metrics[1].attributes)
+		})
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	rd, err := RedactRule{AttributeName: "user", Action: RedactHash, Salt: "pepper"}.compile()
+	require.NoError(t, err)
+
+	a, _ := rd.redact("jane@example.com")
+	b, _ := rd.redact("jane@example.com")
+	c, _ := rd.redact("john@example.com")
+	assert.Len(t, a, hashLength)
+	assert.Equal(t, a, b, "equal values keep equal hashes")
+	assert.NotEqual(t, a, c)
+
+	unsalted, err := RedactRule{AttributeName: "user", Action: RedactHash}.compile()
+	require.NoError(t, err)
+	d, _ := unsalted.redact("jane@example.com")
+	assert.NotEqual(t, a, d)
+}
+
+func TestRedactRule_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RedactRule
+	}{
+		{"no attribute or pattern", RedactRule{MetricPrefix: "http_"}},
+		{"invalid attribute name", RedactRule{AttributeName: "user("}},
+		{"invalid value pattern", RedactRule{ValuePattern: "[a-"}},
+		{"invalid action", RedactRule{AttributeName: "user", Action: "drop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, tt.rule.Validate())
+		})
+	}
+
+	assert.Empty(t, compileRedactRules([]RedactRule{{ValuePattern: "[a-"}}), "invalid rules are skipped")
+}
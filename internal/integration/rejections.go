@@ -0,0 +1,265 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRejectionBodySize is the part of the error responses parsed.
+	maxRejectionBodySize = 64 << 10
+	// maxRejectionReasonLength truncates the logged reasons.
+	maxRejectionReasonLength = 120
+	// maxRejectionSamples is the number of rejected metrics and attributes
+	// logged for every reason.
+	maxRejectionSamples = 5
+)
+
+// The reasons of the rejection metric. They are a fixed set, so the
+// cardinality of the metric is bounded whatever the Metric API responds, and
+// the reasons of the responses are only logged.
+const (
+	rejectionAuth            = "auth"
+	rejectionAttributes      = "attributes"
+	rejectionPayloadTooLarge = "payload_too_large"
+	rejectionRateLimited     = "rate_limited"
+	rejectionInvalidPayload  = "invalid_payload"
+	rejectionServerError     = "server_error"
+	rejectionOther           = "other"
+)
+
+var rlog = logrus.WithField("component", "Rejections")
+
+// rejection is a reason the Metric API gave to reject a request, with the
+// metric and attribute it applies to, if any.
+type rejection struct {
+	reason    string
+	metric    string
+	attribute string
+}
+
+// rejectionDetail is an error of the Metric API responses. The API either
+// responds with a single error, as a string or an object, or a list of them.
+type rejectionDetail struct {
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+	Metric    string `json:"metric"`
+	Name      string `json:"name"`
+	Attribute string `json:"attribute"`
+}
+
+// rejectionResponse is the body of the Metric API error responses.
+type rejectionResponse struct {
+	Error   json.RawMessage   `json:"error"`
+	Errors  []rejectionDetail `json:"errors"`
+	Message string            `json:"message"`
+}
+
+// parseRejections returns the reasons of the error response body. Bodies
+// that aren't JSON are used as the reason. Without any reason in the body,
+// the status is the reason.
+func parseRejections(status int, body []byte) []rejection {
+	var resp rejectionResponse
+	var rejections []rejection
+	if err := json.Unmarshal(body, &resp); err == nil {
+		for _, d := range resp.Errors {
+			rejections = append(rejections, d.rejection())
+		}
+		if len(resp.Error) > 0 {
+			var message string
+			var detail rejectionDetail
+			if json.Unmarshal(resp.Error, &message) == nil {
+				rejections = append(rejections, rejection{reason: message})
+			} else if json.Unmarshal(resp.Error, &detail) == nil {
+				rejections = append(rejections, detail.rejection())
+			}
+		}
+		if len(rejections) == 0 && resp.Message != "" {
+			rejections = append(rejections, rejection{reason: resp.Message})
+		}
+	} else if line := strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0]); line != "" {
+		rejections = append(rejections, rejection{reason: line})
+	}
+
+	for i := range rejections {
+		rejections[i].reason = truncateReason(rejections[i].reason)
+		if rejections[i].reason == "" {
+			rejections[i].reason = http.StatusText(status)
+		}
+	}
+	if len(rejections) == 0 {
+		rejections = append(rejections, rejection{reason: http.StatusText(status)})
+	}
+	return rejections
+}
+
+func (d rejectionDetail) rejection() rejection {
+	reason := d.Message
+	if reason == "" {
+		reason = d.Type
+	}
+	metric := d.Metric
+	if metric == "" {
+		metric = d.Name
+	}
+	return rejection{reason: reason, metric: metric, attribute: d.Attribute}
+}
+
+// rejectionCategory returns the reason of the rejection metric of the
+// response status and reason.
+func rejectionCategory(status int, reason string) string {
+	reason = strings.ToLower(reason)
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return rejectionAuth
+	case status == http.StatusRequestEntityTooLarge:
+		return rejectionPayloadTooLarge
+	case status == http.StatusTooManyRequests:
+		return rejectionRateLimited
+	case status >= http.StatusInternalServerError:
+		return rejectionServerError
+	case strings.Contains(reason, "attribute"):
+		return rejectionAttributes
+	case strings.Contains(reason, "license") || strings.Contains(reason, "api key"):
+		return rejectionAuth
+	case strings.Contains(reason, "too large"):
+		return rejectionPayloadTooLarge
+	case status == http.StatusBadRequest:
+		return rejectionInvalidPayload
+	}
+	return rejectionOther
+}
+
+func truncateReason(reason string) string {
+	reason = strings.TrimSpace(reason)
+	if len(reason) > maxRejectionReasonLength {
+		reason = reason[:maxRejectionReasonLength]
+	}
+	return reason
+}
+
+// rejectionSummary aggregates the rejections of a reason.
+type rejectionSummary struct {
+	status     int
+	count      int
+	metrics    []string
+	attributes []string
+}
+
+// rejectionReporter parses the error responses of the Metric API, counts
+// them by reason and logs the rejections of every harvest.
+type rejectionReporter struct {
+	emitter string
+	rt      http.RoundTripper
+
+	mu      sync.Mutex
+	reasons map[string]*rejectionSummary
+}
+
+func newRejectionReporter(emitter string) *rejectionReporter {
+	return &rejectionReporter{emitter: emitter, reasons: map[string]*rejectionSummary{}}
+}
+
+// harvesterOpt wraps the harvester client transport with the reporter.
+func (r *rejectionReporter) harvesterOpt() TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		r.rt = cfg.Client.Transport
+		if r.rt == nil {
+			r.rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = r
+	}
+}
+
+// RoundTrip sends the request, recording the reasons of the error
+// responses. Their body is left unread for the harvester.
+func (r *rejectionReporter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.rt.RoundTrip(req)
+	if err != nil || resp.StatusCode < http.StatusBadRequest {
+		return resp, err
+	}
+	body, rerr := ioutil.ReadAll(io.LimitReader(resp.Body, maxRejectionBodySize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if rerr != nil {
+		rlog.WithError(rerr).WithField("emitter", r.emitter).Debug("reading error response")
+	}
+	r.record(resp.StatusCode, parseRejections(resp.StatusCode, body))
+	return resp, err
+}
+
+// record counts the rejections of a response.
+func (r *rejectionReporter) record(status int, rejections []rejection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rej := range rejections {
+		emitterRejectionsMetric.WithLabelValues(r.emitter, strconv.Itoa(status), rejectionCategory(status, rej.reason)).Inc()
+		s, ok := r.reasons[rej.reason]
+		if !ok {
+			s = &rejectionSummary{status: status}
+			r.reasons[rej.reason] = s
+		}
+		s.count++
+		s.metrics = appendSample(s.metrics, rej.metric)
+		s.attributes = appendSample(s.attributes, rej.attribute)
+	}
+}
+
+// appendSample appends the value if not empty, not already sampled and there
+// is room for it.
+func appendSample(samples []string, value string) []string {
+	if value == "" || len(samples) >= maxRejectionSamples {
+		return samples
+	}
+	for _, s := range samples {
+		if s == value {
+			return samples
+		}
+	}
+	return append(samples, value)
+}
+
+// flush logs the rejections since the last flush, by reason.
+func (r *rejectionReporter) flush() {
+	r.mu.Lock()
+	reasons := r.reasons
+	r.reasons = map[string]*rejectionSummary{}
+	r.mu.Unlock()
+
+	sorted := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		sorted = append(sorted, reason)
+	}
+	sort.Strings(sorted)
+	for _, reason := range sorted {
+		s := reasons[reason]
+		entry := rlog.WithFields(logrus.Fields{
+			"emitter": r.emitter,
+			"status":  s.status,
+			"reason":  reason,
+			"count":   s.count,
+		})
+		if len(s.metrics) > 0 {
+			entry = entry.WithField("metrics", strings.Join(s.metrics, ","))
+		}
+		if len(s.attributes) > 0 {
+			entry = entry.WithField("attributes", strings.Join(s.attributes, ","))
+		}
+		entry.Warn("the Metric API rejected payloads")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRejections(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected []rejection
+	}{
+		{
+			name:     "error string",
+			status:   http.StatusBadRequest,
+			body:     `{"requestId":"abc","error":"invalid JSON"}`,
+			expected: []rejection{{reason: "invalid JSON"}},
+		},
+		{
+			name:     "error object",
+			status:   http.StatusForbidden,
+			body:     `{"error":{"type":"Forbidden","message":"invalid license key"}}`,
+			expected: []rejection{{reason: "invalid license key"}},
+		},
+		{
+			name:   "error list",
+			status: http.StatusBadRequest,
+			body:   `{"errors":[{"message":"too many attributes","metric":"http_requests"},{"type":"AttributeTooLong","attribute":"path"}]}`,
+			expected: []rejection{
+				{reason: "too many attributes", metric: "http_requests"},
+				{reason: "AttributeTooLong", attribute: "path"},
+			},
+		},
+		{
+			name:     "message",
+			status:   http.StatusRequestEntityTooLarge,
+			body:     `{"message":"payload too large"}`,
+			expected: []rejection{{reason: "payload too large"}},
+		},
+		{
+			name:     "plain text",
+			status:   http.StatusBadGateway,
+			body:     "upstream unavailable\n<html>",
+			expected: []rejection{{reason: "upstream unavailable"}},
+		},
+		{
+			name:     "empty",
+			status:   http.StatusTooManyRequests,
+			expected: []rejection{{reason: "Too Many Requests"}},
+		},
+		{
+			name:     "long reason",
+			status:   http.StatusBadRequest,
+			body:     `{"error":"` + strings.Repeat("x", 200) + `"}`,
+			expected: []rejection{{reason: strings.Repeat("x", maxRejectionReasonLength)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseRejections(tt.status, []byte(tt.body)))
+		})
+	}
+}
+
+func TestRejectionCategory(t *testing.T) {
+	tests := []struct {
+		status   int
+		reason   string
+		expected string
+	}{
+		{http.StatusForbidden, "invalid license key", rejectionAuth},
+		{http.StatusBadRequest, "Invalid license key", rejectionAuth},
+		{http.StatusRequestEntityTooLarge, "payload too large", rejectionPayloadTooLarge},
+		{http.StatusBadRequest, "request too large", rejectionPayloadTooLarge},
+		{http.StatusTooManyRequests, "Too Many Requests", rejectionRateLimited},
+		{http.StatusBadGateway, "upstream unavailable", rejectionServerError},
+		{http.StatusBadRequest, "AttributeTooLong", rejectionAttributes},
+		{http.StatusBadRequest, "too many attributes", rejectionAttributes},
+		{http.StatusBadRequest, "invalid JSON", rejectionInvalidPayload},
+		{http.StatusConflict, "user " + strings.Repeat("x", 100), rejectionOther},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, rejectionCategory(tt.status, tt.reason), tt.reason)
+	}
+}
+
+func TestRejectionReporter(t *testing.T) {
+	body := `{"errors":[{"message":"too many attributes","metric":"a"},{"message":"too many attributes","metric":"b"}]}`
+	r := newRejectionReporter("test-rejections")
+	cfg := &telemetry.Config{}
+	cfg.Client = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/ok" {
+			return emptyResponse(http.StatusAccepted), nil
+		}
+		resp := emptyResponse(http.StatusBadRequest)
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+		return resp, nil
+	})}
+	r.harvesterOpt()(cfg)
+
+	req, err := http.NewRequest(http.MethodPost, "http://metric-api/metric/v1", nil)
+	require.NoError(t, err)
+	resp, err := cfg.Client.Do(req)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(read), "the body is left for the harvester")
+
+	req, err = http.NewRequest(http.MethodPost, "http://metric-api/ok", nil)
+	require.NoError(t, err)
+	_, err = cfg.Client.Do(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(emitterRejectionsMetric.WithLabelValues("test-rejections", "400", rejectionAttributes)))
+	require.Len(t, r.reasons, 1)
+	assert.Equal(t, &rejectionSummary{status: 400, count: 2, metrics: []string{"a", "b"}}, r.reasons["too many attributes"])
+	r.flush()
+	assert.Empty(t, r.reasons)
+}
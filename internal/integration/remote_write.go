@@ -0,0 +1,322 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/remotewrite"
+	"github.com/newrelic/nri-prometheus/internal/retry"
+)
+
+const (
+	defaultRemoteWriteTimeout = 30 * time.Second
+	// remoteWriteMaxSeries is the maximum number of series sent in a single
+	// request.
+	remoteWriteMaxSeries = 5000
+	// remoteWriteMinBackoff and remoteWriteMaxBackoff bound the delays
+	// between the retries of the failed requests.
+	remoteWriteMinBackoff = 500 * time.Millisecond
+	remoteWriteMaxBackoff = 10 * time.Second
+	// remoteWriteErrorBodySize is the size of the response body included in
+	// the errors.
+	remoteWriteErrorBodySize = 512
+)
+
+// remoteWriteSkippedAttributes are the attributes describing the New Relic
+// metric types, which aren't sent as labels.
+var remoteWriteSkippedAttributes = map[string]bool{
+	"nrMetricType":   true,
+	"promMetricType": true,
+}
+
+// RemoteWriteConfig configures the RemoteWriteEmitter.
+type RemoteWriteConfig struct {
+	// URL of the remote write endpoint, like
+	// http://mimir:9009/api/v1/push.
+	URL string `mapstructure:"url"`
+	// BearerTokenFile is read for every request, and its token sent in the
+	// Authorization header.
+	BearerTokenFile string `mapstructure:"bearer_token_file"`
+	// Headers added to the requests, like X-Scope-OrgID for the tenant of
+	// multi-tenant backends.
+	Headers map[string]string `mapstructure:"headers"`
+	// Timeout of every request. Defaults to 30s.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Retries of the requests that fail with a network error, a 5xx or a
+	// 429 response. The requests aren't retried if 0.
+	Retries int `mapstructure:"retries"`
+
+	// Transport of the requests. Defaults to the http.DefaultTransport.
+	Transport http.RoundTripper `mapstructure:"-"`
+	// Signer of the requests, if any.
+	Signer PayloadSigner `mapstructure:"-"`
+}
+
+// Validate returns an error if the URL of the endpoint is not valid.
+func (c RemoteWriteConfig) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("the remote_write emitter requires a remote_write.url")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid remote_write URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid remote_write URL %q, it must be an http or https URL", c.URL)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("remote_write retries must be greater than or equal to 0, got %d", c.Retries)
+	}
+	return nil
+}
+
+// RemoteWriteEmitter sends the metrics to a Prometheus remote write
+// endpoint, like the ones of Thanos, Cortex or Mimir. The attributes of the
+// metrics are sent as labels, summaries as their quantile, _sum and _count
+// series, and histograms as their _bucket, _sum and _count series.
+type RemoteWriteEmitter struct {
+	name    string
+	url     string
+	headers map[string]string
+	retries int
+	client  *http.Client
+	now     func() time.Time
+	sleep   func(time.Duration)
+}
+
+// NewRemoteWriteEmitter returns a RemoteWriteEmitter of the configuration.
+func NewRemoteWriteEmitter(cfg RemoteWriteConfig) (*RemoteWriteEmitter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	rt := cfg.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if cfg.BearerTokenFile != "" {
+		rt = NewBearerAuthFileRoundTripper(cfg.BearerTokenFile, rt)
+	}
+	if cfg.Signer != nil {
+		rt = NewSigningRoundTripper(cfg.Signer, rt)
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultRemoteWriteTimeout
+	}
+	return &RemoteWriteEmitter{
+		name:    "remote_write",
+		url:     cfg.URL,
+		headers: cfg.Headers,
+		retries: cfg.Retries,
+		client:  &http.Client{Transport: rt, Timeout: timeout},
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}, nil
+}
+
+// Name is the RemoteWriteEmitter name.
+func (re *RemoteWriteEmitter) Name() string {
+	return re.name
+}
+
+// Emit sends the metrics to the remote write endpoint, in requests of up to
+// 5000 series.
+func (re *RemoteWriteEmitter) Emit(metrics []Metric) error {
+	series := remoteWriteSeries(metrics, re.now())
+	for len(series) > 0 {
+		batch := series
+		if len(batch) > remoteWriteMaxSeries {
+			batch = batch[:remoteWriteMaxSeries]
+		}
+		if err := re.send(&remotewrite.WriteRequest{Timeseries: batch}); err != nil {
+			return err
+		}
+		series = series[len(batch):]
+	}
+	return nil
+}
+
+// send posts the request, retrying it if it fails with a network error, a
+// 5xx or a 429 response.
+func (re *RemoteWriteEmitter) send(req *remotewrite.WriteRequest) error {
+	body := remotewrite.Encode(req)
+	backoff := retry.Backoff{Min: remoteWriteMinBackoff, Max: remoteWriteMaxBackoff}
+	for attempt := 0; ; attempt++ {
+		retryable, err := re.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= re.retries {
+			return err
+		}
+		re.sleep(backoff.Next())
+	}
+}
+
+// post sends the body to the endpoint. The returned error is retryable if
+// the request failed or the endpoint responded a 5xx or a 429.
+func (re *RemoteWriteEmitter) post(body []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, re.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range re.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := re.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("sending metrics to remote_write endpoint: %w", err)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode/100 == 2 {
+		recordSentBytes(re.Name(), int64(len(body)))
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, remoteWriteErrorBodySize))
+	err = fmt.Errorf("remote_write endpoint responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// remoteWriteSeries returns the series of the metrics. The metrics without
+// timestamp are sent at the given time.
+func remoteWriteSeries(metrics []Metric, now time.Time) []remotewrite.TimeSeries {
+	var series []remotewrite.TimeSeries
+	add := func(name string, lbls []remotewrite.Label, value float64, timestamp int64, extra ...remotewrite.Label) {
+		l := make([]remotewrite.Label, 0, len(lbls)+len(extra)+1)
+		l = append(l, remotewrite.Label{Name: "__name__", Value: sanitizeMetricName(name)})
+		l = append(l, lbls...)
+		l = append(l, extra...)
+		sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+		series = append(series, remotewrite.TimeSeries{
+			Labels:  l,
+			Samples: []remotewrite.Sample{{Value: value, Timestamp: timestamp}},
+		})
+	}
+
+	for _, metric := range metrics {
+		ts := now
+		if !metric.timestamp.IsZero() {
+			ts = metric.timestamp
+		}
+		timestamp := ts.UnixNano() / int64(time.Millisecond)
+		lbls := remoteWriteLabels(metric.attributes)
+
+		switch metric.metricType {
+		case metricType_GAUGE, metricType_COUNTER:
+			add(metric.name, lbls, metric.value, timestamp)
+		case metricType_SUMMARY:
+			if metric.summary == nil {
+				continue
+			}
+			for _, q := range metric.summary.GetQuantile() {
+				add(metric.name, lbls, q.GetValue(), timestamp,
+					remotewrite.Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+			}
+			add(metric.name+"_sum", lbls, metric.summary.GetSampleSum(), timestamp)
+			add(metric.name+"_count", lbls, float64(metric.summary.GetSampleCount()), timestamp)
+		case metricType_HISTOGRAM:
+			if metric.histogram == nil {
+				continue
+			}
+			hasInf := false
+			for _, b := range metric.histogram.GetBucket() {
+				hasInf = hasInf || math.IsInf(b.GetUpperBound(), 1)
+				add(metric.name+"_bucket", lbls, float64(b.GetCumulativeCount()), timestamp,
+					remotewrite.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+			}
+			if !hasInf {
+				add(metric.name+"_bucket", lbls, float64(metric.histogram.GetSampleCount()), timestamp,
+					remotewrite.Label{Name: "le", Value: "+Inf"})
+			}
+			add(metric.name+"_sum", lbls, metric.histogram.GetSampleSum(), timestamp)
+			add(metric.name+"_count", lbls, float64(metric.histogram.GetSampleCount()), timestamp)
+		}
+	}
+	return series
+}
+
+// remoteWriteLabels returns the attributes as labels, with their names
+// sanitized to valid Prometheus label names. When several attributes have
+// the same sanitized name, the first one in alphabetical order is kept.
+func remoteWriteLabels(attrs labels.Set) []remotewrite.Label {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		if !remoteWriteSkippedAttributes[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	seen := make(map[string]bool, len(keys))
+	lbls := make([]remotewrite.Label, 0, len(keys))
+	for _, k := range keys {
+		name := sanitizeLabelName(k)
+		if seen[name] || name == "__name__" {
+			continue
+		}
+		seen[name] = true
+		lbls = append(lbls, remotewrite.Label{Name: name, Value: fmt.Sprint(attrs[k])})
+	}
+	return lbls
+}
+
+// sanitizeLabelName replaces the characters not allowed in Prometheus label
+// names, like the dots, with underscores, and prefixes the names starting
+// with a digit with an underscore.
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+// sanitizeMetricName sanitizes the metric name as sanitizeLabelName, but
+// keeps the colons, which are valid in metric names, so the names with dots
+// of the OpenTelemetry mappings aren't rejected by the backends validating
+// the legacy names.
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+func sanitizeName(name string, colons bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || (colons && c == ':')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || (b[0] >= '0' && b[0] <= '9') {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// formatFloat formats the value of the quantile and le labels as Prometheus
+// does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
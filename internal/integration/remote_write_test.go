@@ -0,0 +1,175 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/remotewrite"
+)
+
+func TestRemoteWriteEmitter(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests <- r
+		bodies <- b
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	re, err := NewRemoteWriteEmitter(RemoteWriteConfig{
+		URL:     endpoint.URL + "/api/v1/push",
+		Headers: map[string]string{"X-Scope-OrgID": "team-a"},
+	})
+	require.NoError(t, err)
+	now := time.Unix(1600000000, 0)
+	re.now = func() time.Time { return now }
+
+	attrs := labels.Set{"targetName": "node-exporter", "k8s.namespace": "default", "nrMetricType": "gauge"}
+	require.NoError(t, re.Emit([]Metric{
+		{name: "temperature", metricType: metricType_GAUGE, value: 21.5, attributes: attrs},
+		{name: "requests_total", metricType: metricType_COUNTER, value: 1027, attributes: attrs, timestamp: now.Add(-time.Second)},
+		{
+			name:       "latency",
+			metricType: metricType_SUMMARY,
+			attributes: attrs,
+			summary: &dto.Summary{
+				SampleCount: &(&struct{ x uint64 }{10}).x,
+				SampleSum:   &(&struct{ x float64 }{4.2}).x,
+				Quantile: []*dto.Quantile{{
+					Quantile: &(&struct{ x float64 }{0.99}).x,
+					Value:    &(&struct{ x float64 }{0.8}).x,
+				}},
+			},
+		},
+		{
+			name:       "size",
+			metricType: metricType_HISTOGRAM,
+			attributes: attrs,
+			histogram: &dto.Histogram{
+				SampleCount: &(&struct{ x uint64 }{3}).x,
+				SampleSum:   &(&struct{ x float64 }{150}).x,
+				Bucket: []*dto.Bucket{{
+					CumulativeCount: &(&struct{ x uint64 }{2}).x,
+					UpperBound:      &(&struct{ x float64 }{100}).x,
+				}},
+			},
+		},
+	}))
+
+	r := <-requests
+	assert.Equal(t, "/api/v1/push", r.URL.Path)
+	assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+	assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	assert.Equal(t, "0.1.0", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+	assert.Equal(t, "team-a", r.Header.Get("X-Scope-OrgID"))
+
+	req, err := remotewrite.Decode(<-bodies)
+	require.NoError(t, err)
+	ms := now.UnixNano() / int64(time.Millisecond)
+	series := func(name string, value float64, timestamp int64, extra ...remotewrite.Label) remotewrite.TimeSeries {
+		l := []remotewrite.Label{{Name: "__name__", Value: name}, {Name: "k8s_namespace", Value: "default"}}
+		l = append(l, extra...)
+		l = append(l, remotewrite.Label{Name: "targetName", Value: "node-exporter"})
+		return remotewrite.TimeSeries{Labels: l, Samples: []remotewrite.Sample{{Value: value, Timestamp: timestamp}}}
+	}
+	assert.Equal(t, []remotewrite.TimeSeries{
+		series("temperature", 21.5, ms),
+		series("requests_total", 1027, ms-1000),
+		series("latency", 0.8, ms, remotewrite.Label{Name: "quantile", Value: "0.99"}),
+		series("latency_sum", 4.2, ms),
+		series("latency_count", 10, ms),
+		series("size_bucket", 2, ms, remotewrite.Label{Name: "le", Value: "100"}),
+		series("size_bucket", 3, ms, remotewrite.Label{Name: "le", Value: "+Inf"}),
+		series("size_sum", 150, ms),
+		series("size_count", 3, ms),
+	}, req.Timeseries)
+}
+
+func TestRemoteWriteEmitter_Retries(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	calls := 0
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[calls])
+		calls++
+	}))
+	defer endpoint.Close()
+
+	re, err := NewRemoteWriteEmitter(RemoteWriteConfig{URL: endpoint.URL, Retries: 2})
+	require.NoError(t, err)
+	re.sleep = func(time.Duration) {}
+
+	metrics := []Metric{{name: "up", metricType: metricType_GAUGE, value: 1}}
+	require.NoError(t, re.Emit(metrics))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	re.retries = 1
+	err = re.Emit(metrics)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "429")
+	assert.Equal(t, 2, calls)
+}
+
+func TestRemoteWriteEmitter_NoRetryOnClientErrors(t *testing.T) {
+	calls := 0
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer endpoint.Close()
+
+	re, err := NewRemoteWriteEmitter(RemoteWriteConfig{URL: endpoint.URL, Retries: 3})
+	require.NoError(t, err)
+	re.sleep = func(time.Duration) {}
+
+	err = re.Emit([]Metric{{name: "up", metricType: metricType_GAUGE, value: 1}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "out of order sample")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRemoteWriteLabels(t *testing.T) {
+	assert.Equal(t, []remotewrite.Label{
+		{Name: "_1st", Value: "x"},
+		{Name: "a_b", Value: "2"},
+		{Name: "enabled", Value: "true"},
+	}, remoteWriteLabels(labels.Set{
+		"1st":            "x",
+		"a.b":            1,
+		"a-b":            2,
+		"enabled":        true,
+		"promMetricType": "counter",
+		"__name__":       "overridden",
+	}))
+}
+
+func TestRemoteWriteSeries_MetricNames(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	series := remoteWriteSeries([]Metric{
+		{name: "http.server.request.duration", metricType: metricType_GAUGE, value: 1},
+		{name: "job:requests:rate5m", metricType: metricType_GAUGE, value: 2},
+	}, now)
+	require.Len(t, series, 2)
+	assert.Equal(t, remotewrite.Label{Name: "__name__", Value: "http_server_request_duration"}, series[0].Labels[0])
+	assert.Equal(t, remotewrite.Label{Name: "__name__", Value: "job:requests:rate5m"}, series[1].Labels[0], "the colons are valid in metric names")
+}
+
+func TestRemoteWriteConfig_Validate(t *testing.T) {
+	assert.NoError(t, RemoteWriteConfig{URL: "http://mimir:9009/api/v1/push"}.Validate())
+	assert.Error(t, RemoteWriteConfig{}.Validate())
+	assert.Error(t, RemoteWriteConfig{URL: "mimir:9009"}.Validate())
+	assert.Error(t, RemoteWriteConfig{URL: "http://mimir", Retries: -1}.Validate())
+}
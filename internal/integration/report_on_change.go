@@ -0,0 +1,135 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// defaultKeepAliveIntervals is the number of intervals an unchanged gauge
+// is emitted every, when not configured.
+const defaultKeepAliveIntervals = 10
+
+// ReportOnChangeConfig selects the gauges that are only emitted when their
+// value changes, like the config-like gauges that rarely do. An unchanged
+// gauge is still emitted every KeepAliveIntervals scrape intervals, so its
+// series doesn't look stale.
+type ReportOnChangeConfig struct {
+	MetricPrefixes []string `mapstructure:"metric_prefixes"`
+	// KeepAliveIntervals defaults to 10.
+	KeepAliveIntervals int `mapstructure:"keep_alive_intervals"`
+}
+
+// IsEmpty returns true if no gauge is reported on change.
+func (c ReportOnChangeConfig) IsEmpty() bool {
+	return len(c.MetricPrefixes) == 0
+}
+
+// Validate returns an error if the keep-alive is negative.
+func (c ReportOnChangeConfig) Validate() error {
+	if c.KeepAliveIntervals < 0 {
+		return fmt.Errorf("report_on_change keep_alive_intervals can't be negative, got %d", c.KeepAliveIntervals)
+	}
+	return nil
+}
+
+// WithReportOnChange only emits the gauges of the configuration when their
+// value changes, or every keep-alive intervals.
+func WithReportOnChange(cfg ReportOnChangeConfig) ExecuteOption {
+	return func(e *execution) {
+		if !cfg.IsEmpty() {
+			e.onChange = newChangeReporter(cfg)
+		}
+	}
+}
+
+// reportedGauge is the last emitted value of a series, and the number of
+// runs it was suppressed since.
+type reportedGauge struct {
+	bits       uint64
+	suppressed int
+	run        uint64
+}
+
+// changeReporter suppresses the unchanged gauges between runs.
+type changeReporter struct {
+	prefixes  []string
+	keepAlive int
+	run       uint64
+	gauges    map[string]*reportedGauge
+}
+
+func newChangeReporter(cfg ReportOnChangeConfig) *changeReporter {
+	keepAlive := cfg.KeepAliveIntervals
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAliveIntervals
+	}
+	return &changeReporter{
+		prefixes:  cfg.MetricPrefixes,
+		keepAlive: keepAlive,
+		run:       1,
+		gauges:    map[string]*reportedGauge{},
+	}
+}
+
+// reported returns true if the gauge is of a reported prefix.
+func (r *changeReporter) reported(m *Metric) bool {
+	if m.metricType != metricType_GAUGE {
+		return false
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(m.name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter removes the gauges of the target whose value didn't change since
+// they were last emitted, unless they were suppressed for keep-alive
+// intervals. The metrics are filtered in place.
+func (r *changeReporter) filter(target string, metrics []Metric) []Metric {
+	kept := metrics[:0]
+	var suppressed int
+	for i := range metrics {
+		m := &metrics[i]
+		if !r.reported(m) {
+			kept = append(kept, *m)
+			continue
+		}
+		// The bits are compared so NaN values are equal.
+		bits := math.Float64bits(m.value)
+		key := target + "|" + seriesKey(m)
+		g, ok := r.gauges[key]
+		if !ok {
+			g = &reportedGauge{}
+			r.gauges[key] = g
+		}
+		g.run = r.run
+		if ok && g.bits == bits && g.suppressed+1 < r.keepAlive {
+			g.suppressed++
+			suppressed++
+			continue
+		}
+		g.bits, g.suppressed = bits, 0
+		kept = append(kept, *m)
+	}
+	if suppressed > 0 {
+		reportOnChangeSuppressedMetric.Add(float64(suppressed))
+	}
+	return kept
+}
+
+// endRun forgets the series not scraped in the run, so they are emitted
+// when they come back.
+func (r *changeReporter) endRun() {
+	for key, g := range r.gauges {
+		if g.run != r.run {
+			delete(r.gauges, key)
+		}
+	}
+	r.run++
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func onChangeMetrics(replicas, temperature float64) []Metric {
+	return []Metric{
+		{name: "kube_deployment_spec_replicas", value: replicas, metricType: metricType_GAUGE, attributes: labels.Set{"deployment": "api"}},
+		{name: "node_temperature", value: temperature, metricType: metricType_GAUGE, attributes: labels.Set{}},
+		{name: "kube_deployment_spec_updates_total", value: 1, metricType: metricType_COUNTER, attributes: labels.Set{}},
+	}
+}
+
+func names(metrics []Metric) []string {
+	var names []string
+	for _, m := range metrics {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+func TestChangeReporter(t *testing.T) {
+	r := newChangeReporter(ReportOnChangeConfig{MetricPrefixes: []string{"kube_deployment_spec_"}, KeepAliveIntervals: 3})
+	all := []string{"kube_deployment_spec_replicas", "node_temperature", "kube_deployment_spec_updates_total"}
+	unreported := []string{"node_temperature", "kube_deployment_spec_updates_total"}
+
+	run := func(replicas float64) []string {
+		defer r.endRun()
+		return names(r.filter("target", onChangeMetrics(replicas, 20)))
+	}
+	assert.Equal(t, all, run(3), "new gauges are emitted")
+	assert.Equal(t, unreported, run(3), "unchanged gauges are suppressed")
+	assert.Equal(t, unreported, run(3))
+	assert.Equal(t, all, run(3), "the keep-alive emits them every 3 intervals")
+	assert.Equal(t, unreported, run(3))
+	assert.Equal(t, all, run(4), "changed gauges are emitted")
+	assert.Equal(t, unreported, run(4))
+
+	assert.Equal(t, all, run(math.NaN()))
+	assert.Equal(t, unreported, run(math.NaN()), "NaN values are equal")
+
+	r.endRun()
+	assert.Equal(t, all, run(math.NaN()), "series not scraped in a run are forgotten")
+	assert.Equal(t, all, names(r.filter("other", onChangeMetrics(math.NaN(), 20))), "the series are kept by target")
+}
+
+func TestReportOnChangeConfig(t *testing.T) {
+	assert.True(t, ReportOnChangeConfig{KeepAliveIntervals: 3}.IsEmpty())
+	assert.NoError(t, ReportOnChangeConfig{MetricPrefixes: []string{"app_"}}.Validate())
+	assert.Error(t, ReportOnChangeConfig{MetricPrefixes: []string{"app_"}, KeepAliveIntervals: -1}.Validate())
+	assert.Equal(t, defaultKeepAliveIntervals, newChangeReporter(ReportOnChangeConfig{}).keepAlive)
+}
@@ -17,6 +17,12 @@ type ProcessingRule struct {
 	RenameAttributes []RenameRule         `mapstructure:"rename_attributes"`
 	IgnoreMetrics    []IgnoreRule         `mapstructure:"ignore_metrics"`
 	CopyAttributes   []CopyAttributesRule `mapstructure:"copy_attributes"`
+	// TemplateAttributes are applied after the decoration and the renames,
+	// so their templates can use the attributes of the target.
+	TemplateAttributes []TemplateAttributesRule `mapstructure:"template_attributes"`
+	// RedactAttributes are applied after the other rules, so they also
+	// cover the attributes they add.
+	RedactAttributes []RedactRule `mapstructure:"redact_attributes"`
 }
 
 // RenameRule is a rule for changing the name of attributes of metrics that
@@ -263,29 +269,73 @@ func (rules ignoreRules) shouldIgnore(name string) bool {
 	return exceptRulesLen > 0
 }
 
-// Filter removes the metrics whose name matches the prefixes in the given ignore rules
+// Filter removes the metrics whose name matches the prefixes in the given ignore rules.
+// The metrics are filtered in place.
 func Filter(targetMetrics *TargetMetrics, rules ignoreRules) {
-	copied := make([]Metric, 0, len(targetMetrics.Metrics))
+	if len(rules) == 0 {
+		return
+	}
+	kept := targetMetrics.Metrics[:0]
 	for _, m := range targetMetrics.Metrics {
 		if !rules.shouldIgnore(m.name) {
-			copied = append(copied, m)
+			kept = append(kept, m)
 		}
 	}
-	targetMetrics.Metrics = copied
+	// Release the attributes of the dropped metrics.
+	for i := len(kept); i < len(targetMetrics.Metrics); i++ {
+		targetMetrics.Metrics[i] = Metric{}
+	}
+	targetMetrics.Metrics = kept
 }
 
 // A Processor is something that transform the metrics of a target that are received by a channel, and submits them
 // by another channel
 type Processor func(pairs <-chan TargetMetrics) <-chan TargetMetrics
 
+// ProcessorOption configures the RuleProcessor.
+type ProcessorOption func(*processorOptions)
+
+type processorOptions struct {
+	// normalizer is nil unless the attribute keys are normalized.
+	normalizer     *AttributeNormalizer
+	skipDecoration bool
+	// limiter is nil unless the attributes are limited.
+	limiter *AttributeLimiter
+}
+
+// WithAttributeNormalizer normalizes the attribute keys and the metric names
+// after applying the processing rules. A nil normalizer doesn't change them.
+func WithAttributeNormalizer(n *AttributeNormalizer) ProcessorOption {
+	return func(o *processorOptions) {
+		o.normalizer = n
+	}
+}
+
+// WithAttributeLimiter drops the lowest priority attributes of the metrics
+// with too many of them, once normalized. A nil limiter doesn't drop any.
+func WithAttributeLimiter(l *AttributeLimiter) ProcessorOption {
+	return func(o *processorOptions) {
+		o.limiter = l
+	}
+}
+
 // RuleProcessor process apply the Rename, Decorate and Filter metrics
 // processing and returns them through a channel.
-func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor {
+func RuleProcessor(processingRules []ProcessingRule, queueLength int, opts ...ProcessorOption) Processor {
+	var options processorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	var renameRules []RenameRule
 	var ignoreRules []IgnoreRule
 	var decorateRules []DecorateRule
 	var addAttributesRules []AddAttributesRule
+	var redactRules []RedactRule
+	var templateRules []TemplateAttributesRule
 	for _, pr := range processingRules {
+		redactRules = append(redactRules, pr.RedactAttributes...)
+		templateRules = append(templateRules, pr.TemplateAttributes...)
 		renameRules = append(renameRules, pr.RenameAttributes...)
 		ignoreRules = append(ignoreRules, pr.IgnoreMetrics...)
 		addAttributesRules = append(addAttributesRules, pr.AddAttributes...)
@@ -307,6 +357,9 @@ func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor
 		}
 	}
 
+	redactors := compileRedactRules(redactRules)
+	templaters := compileTemplateRules(templateRules)
+
 	return func(targetMetrics <-chan TargetMetrics) <-chan TargetMetrics {
 		processedPairs := make(chan TargetMetrics, queueLength)
 
@@ -317,10 +370,22 @@ func RuleProcessor(processingRules []ProcessingRule, queueLength int) Processor
 			defer close(processedPairs)
 
 			for pair := range targetMetrics {
+				scraped := len(pair.Metrics)
 				Filter(&pair, ignoreRules)
+				if !pair.Target.MetricFilter.IsEmpty() {
+					Filter(&pair, []IgnoreRule{IgnoreRule(pair.Target.MetricFilter)})
+				}
+				countDropped(pair.job(), dropReasonRule, scraped-len(pair.Metrics))
 				AddAttributes(&pair, addAttributesRules)
-				Decorate(&pair, decorateRules)
+				if !options.skipDecoration {
+					Decorate(&pair, decorateRules)
+				}
 				Rename(&pair, renameRules)
+				templateAttributes(&pair, templaters)
+				redactAttributes(&pair, redactors)
+				normalizeMetrics(&pair, options.normalizer)
+				limitAttributes(&pair, options.limiter)
+				setAccount(&pair)
 
 				processedPairs <- pair
 			}
@@ -567,3 +567,18 @@ func TestIgnoreRules_IgnoreAllExceptExceptions(t *testing.T) {
 	assert.Contains(t, actual, "redis_exporter_build_info")
 	assert.Contains(t, actual, "redis_instance_info")
 }
+
+func TestRuleProcessor_TargetMetricFilter(t *testing.T) {
+	entity := scrapeString(t, prometheusInput)
+	entity.Target.MetricFilter = endpoints.MetricFilter{Except: []string{"redis_instance"}}
+
+	pairs := make(chan TargetMetrics, 1)
+	pairs <- entity
+	close(pairs)
+	processed := <-RuleProcessor([]ProcessingRule{}, queueLength)(pairs)
+
+	require.NotEmpty(t, processed.Metrics)
+	for _, metric := range processed.Metrics {
+		assert.Equal(t, "redis_instance_info", metric.name)
+	}
+}
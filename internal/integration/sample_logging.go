@@ -0,0 +1,83 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithSampleLogging logs k metrics chosen at random among the ones emitted
+// in every run, with their name, type, attributes and value, as a cheap
+// sanity check of what is sent without enabling the debug logs.
+func WithSampleLogging(k int) ExecuteOption {
+	return func(e *execution) {
+		if k > 0 {
+			e.sampler = newMetricSampler(k)
+		}
+	}
+}
+
+// metricSampler keeps a uniform random sample of k of the metrics observed
+// in a run, with reservoir sampling, so the sample costs the same whatever
+// the number of metrics.
+type metricSampler struct {
+	k       int
+	seen    int
+	samples []Metric
+	rand    *rand.Rand
+	log     func(fields logrus.Fields)
+}
+
+func newMetricSampler(k int) *metricSampler {
+	return &metricSampler{
+		k:       k,
+		samples: make([]Metric, 0, k),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		log: func(fields logrus.Fields) {
+			ilog.WithFields(fields).Info("sampled emitted metric")
+		},
+	}
+}
+
+// observe adds the metrics to the sample.
+func (s *metricSampler) observe(metrics []Metric) {
+	for _, m := range metrics {
+		s.seen++
+		if len(s.samples) < s.k {
+			s.samples = append(s.samples, m)
+			continue
+		}
+		if i := s.rand.Intn(s.seen); i < s.k {
+			s.samples[i] = m
+		}
+	}
+}
+
+// flush logs the sampled metrics of the run, and starts a new sample.
+func (s *metricSampler) flush() {
+	for _, m := range s.samples {
+		fields := logrus.Fields{
+			"metric":     m.name,
+			"type":       string(m.metricType),
+			"attributes": m.attributes,
+			"sampledOf":  s.seen,
+		}
+		switch {
+		case m.summary != nil:
+			fields["count"] = m.summary.GetSampleCount()
+			fields["sum"] = m.summary.GetSampleSum()
+		case m.histogram != nil:
+			fields["count"] = m.histogram.GetSampleCount()
+			fields["sum"] = m.histogram.GetSampleSum()
+		default:
+			fields["value"] = m.value
+		}
+		s.log(fields)
+	}
+	s.seen = 0
+	s.samples = s.samples[:0]
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestMetricSampler(t *testing.T) {
+	s := newMetricSampler(2)
+	var logged []logrus.Fields
+	s.log = func(fields logrus.Fields) {
+		logged = append(logged, fields)
+	}
+
+	s.flush()
+	assert.Empty(t, logged, "nothing is logged without metrics")
+
+	var metrics []Metric
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, Metric{name: "up", value: float64(i), metricType: metricType_GAUGE, attributes: labels.Set{}})
+	}
+	s.observe(metrics[:50])
+	s.observe(metrics[50:])
+	s.flush()
+	require.Len(t, logged, 2, "only k metrics are logged")
+	assert.NotEqual(t, logged[0]["value"], logged[1]["value"])
+	assert.Equal(t, 100, logged[0]["sampledOf"])
+
+	logged = nil
+	count, sum := uint64(3), 1.5
+	s.observe([]Metric{{
+		name:       "latency",
+		metricType: metricType_SUMMARY,
+		summary:    &dto.Summary{SampleCount: &count, SampleSum: &sum},
+	}})
+	s.flush()
+	require.Len(t, logged, 1, "the sample is reset every run")
+	assert.Equal(t, uint64(3), logged[0]["count"])
+	assert.Equal(t, 1.5, logged[0]["sum"])
+}
@@ -0,0 +1,166 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// SamplesPolicy is how the series with more than one timestamped sample in a
+// scrape, like the ones of federation endpoints with a lookback, are handled.
+type SamplesPolicy string
+
+const (
+	// SamplesLatest keeps the sample with the latest timestamp.
+	SamplesLatest SamplesPolicy = "latest"
+	// SamplesAll keeps all the samples, emitted with their timestamps.
+	SamplesAll SamplesPolicy = "all"
+	// SamplesAverage keeps the average of the gauge samples. The latest
+	// sample is kept for the other types, which can't be averaged.
+	SamplesAverage SamplesPolicy = "average"
+)
+
+// ParseSamplesPolicy returns the SamplesPolicy with the given name.
+func ParseSamplesPolicy(name string) (SamplesPolicy, error) {
+	switch p := SamplesPolicy(name); p {
+	case SamplesLatest, SamplesAll, SamplesAverage:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid samples policy %q, must be one of %s, %s or %s",
+		name, SamplesLatest, SamplesAll, SamplesAverage)
+}
+
+// WithSamplesPolicy sets how the series with more than one timestamped
+// sample in a scrape are handled. SamplesLatest is used by default.
+func WithSamplesPolicy(policy SamplesPolicy) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.samplesPolicy = policy
+	}
+}
+
+// WithHonorTimestamps emits the samples exposed with a timestamp, like the
+// ones of the push gateways, at their timestamp instead of the scrape time.
+// The samples kept by the SamplesAll policy are always emitted at their
+// timestamps.
+func WithHonorTimestamps() FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.honorTimestamps = true
+	}
+}
+
+// reduceSamples applies the policy to the metric families with timestamped
+// samples. Their timestamps are removed unless the policy is SamplesAll or
+// they're honored, so the samples are emitted at the scrape time as the
+// untimestamped ones.
+func reduceSamples(mfs prometheus.MetricFamiliesByName, policy SamplesPolicy, honorTimestamps bool) {
+	for name, mf := range mfs {
+		if !hasTimestamps(mf.Metric) {
+			continue
+		}
+		if policy == SamplesAll {
+			// Samples are emitted in order, so the counter deltas are
+			// calculated between consecutive samples.
+			sort.SliceStable(mf.Metric, func(i, j int) bool {
+				return mf.Metric[i].GetTimestampMs() < mf.Metric[j].GetTimestampMs()
+			})
+			continue
+		}
+		mf.Metric = reduceSeriesSamples(mf.GetType(), mf.Metric, policy, honorTimestamps)
+		mfs[name] = mf
+	}
+}
+
+func hasTimestamps(metrics []*dto.Metric) bool {
+	for _, m := range metrics {
+		if m.TimestampMs != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// reduceSeriesSamples returns one sample per series, in the order the series
+// were first exposed. The averages have the timestamp of the latest sample
+// when the timestamps are honored.
+func reduceSeriesSamples(mtype dto.MetricType, metrics []*dto.Metric, policy SamplesPolicy, honorTimestamps bool) []*dto.Metric {
+	type series struct {
+		latest *dto.Metric
+		sum    float64
+		count  int
+	}
+	var order []model.Fingerprint
+	bySeries := make(map[model.Fingerprint]*series, len(metrics))
+	lbls := map[string]string{}
+	for _, m := range metrics {
+		for k := range lbls {
+			delete(lbls, k)
+		}
+		for _, l := range m.GetLabel() {
+			lbls[l.GetName()] = l.GetValue()
+		}
+		fp := model.Fingerprint(model.LabelsToSignature(lbls))
+		s, ok := bySeries[fp]
+		if !ok {
+			s = &series{}
+			bySeries[fp] = s
+			order = append(order, fp)
+		}
+		if s.latest == nil || m.GetTimestampMs() >= s.latest.GetTimestampMs() {
+			s.latest = m
+		}
+		s.sum += gaugeValue(mtype, m)
+		s.count++
+	}
+
+	reduced := metrics[:0]
+	for _, fp := range order {
+		s := bySeries[fp]
+		m := s.latest
+		if !honorTimestamps {
+			m.TimestampMs = nil
+		}
+		if policy == SamplesAverage && s.count > 1 {
+			avg := s.sum / float64(s.count)
+			switch mtype {
+			case dto.MetricType_GAUGE:
+				m.Gauge = &dto.Gauge{Value: &avg}
+			case dto.MetricType_UNTYPED:
+				m.Untyped = &dto.Untyped{Value: &avg}
+			}
+		}
+		reduced = append(reduced, m)
+	}
+	for i := len(reduced); i < len(metrics); i++ {
+		metrics[i] = nil
+	}
+	return reduced
+}
+
+// gaugeValue returns the value of the gauge or untyped sample, or 0 for the
+// other types.
+func gaugeValue(mtype dto.MetricType, m *dto.Metric) float64 {
+	switch mtype {
+	case dto.MetricType_GAUGE:
+		return m.GetGauge().GetValue()
+	case dto.MetricType_UNTYPED:
+		return m.GetUntyped().GetValue()
+	}
+	return 0
+}
+
+// sampleTime returns the time of the timestamped sample, or the zero time.
+func sampleTime(m *dto.Metric) time.Time {
+	if m.TimestampMs == nil {
+		return time.Time{}
+	}
+	ms := m.GetTimestampMs()
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const federatedSamples = `# TYPE temperature gauge
+temperature{room="a"} 20 1000
+temperature{room="b"} 10 1000
+temperature{room="a"} 22 3000
+temperature{room="a"} 21 2000
+# TYPE requests_total counter
+requests_total{code="200"} 5 2000
+requests_total{code="200"} 3 1000
+# TYPE up gauge
+up 1
+`
+
+type sample struct {
+	name      string
+	labels    string
+	value     float64
+	timestamp time.Time
+}
+
+func reducedSamples(t *testing.T, policy SamplesPolicy, honorTimestamps bool) []sample {
+	mfs, err := decodePromMetrics(strings.NewReader(federatedSamples))
+	require.NoError(t, err)
+	reduceSamples(*mfs, policy, honorTimestamps)
+
+	var samples []sample
+	for _, m := range convertPromMetrics(logrus.NewEntry(logrus.New()), "target", *mfs, 0) {
+		room, _ := m.attributes["room"].(string)
+		code, _ := m.attributes["code"].(string)
+		samples = append(samples, sample{m.name, room + code, m.value, m.timestamp})
+	}
+	return samples
+}
+
+func TestReduceSamples(t *testing.T) {
+	ms := func(ms int64) time.Time { return time.Unix(0, ms*int64(time.Millisecond)) }
+
+	assert.ElementsMatch(t, []sample{
+		{"temperature", "a", 22, time.Time{}},
+		{"temperature", "b", 10, time.Time{}},
+		{"requests_total", "200", 5, time.Time{}},
+		{"up", "", 1, time.Time{}},
+	}, reducedSamples(t, SamplesLatest, false))
+
+	assert.ElementsMatch(t, []sample{
+		{"temperature", "a", 22, ms(3000)},
+		{"temperature", "b", 10, ms(1000)},
+		{"requests_total", "200", 5, ms(2000)},
+		{"up", "", 1, time.Time{}},
+	}, reducedSamples(t, SamplesLatest, true), "the timestamps are honored")
+
+	assert.ElementsMatch(t, []sample{
+		{"temperature", "a", 21, time.Time{}},
+		{"temperature", "b", 10, time.Time{}},
+		{"requests_total", "200", 5, time.Time{}},
+		{"up", "", 1, time.Time{}},
+	}, reducedSamples(t, SamplesAverage, false))
+
+	all := reducedSamples(t, SamplesAll, false)
+	assert.ElementsMatch(t, []sample{
+		{"temperature", "a", 20, ms(1000)},
+		{"temperature", "b", 10, ms(1000)},
+		{"temperature", "a", 21, ms(2000)},
+		{"temperature", "a", 22, ms(3000)},
+		{"requests_total", "200", 3, ms(1000)},
+		{"requests_total", "200", 5, ms(2000)},
+		{"up", "", 1, time.Time{}},
+	}, all)
+	// Samples of the same series are sorted by their timestamp.
+	var roomA, requests []float64
+	for _, s := range all {
+		switch {
+		case s.name == "temperature" && s.labels == "a":
+			roomA = append(roomA, s.value)
+		case s.name == "requests_total":
+			requests = append(requests, s.value)
+		}
+	}
+	assert.Equal(t, []float64{20, 21, 22}, roomA)
+	assert.Equal(t, []float64{3, 5}, requests)
+}
+
+func TestParseSamplesPolicy(t *testing.T) {
+	for _, name := range []string{"latest", "all", "average"} {
+		policy, err := ParseSamplesPolicy(name)
+		assert.NoError(t, err)
+		assert.Equal(t, SamplesPolicy(name), policy)
+	}
+	_, err := ParseSamplesPolicy("first")
+	assert.Error(t, err)
+}
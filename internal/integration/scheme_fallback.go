@@ -0,0 +1,90 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// fetchWithSchemeFallback gets the metrics of a target with a scheme
+// fallback policy, starting with the scheme that worked last, so the scrapes
+// don't flap between schemes. The other scheme is only tried if the scrape
+// fails with an error the scheme may cause.
+func (pf *prometheusFetcher) fetchWithSchemeFallback(t *endpoints.Target, fallback string) (prometheus.MetricFamiliesByName, error) {
+	key := t.URL.String()
+	schemes := []string{t.URL.Scheme, fallback}
+	last := t.URL.Scheme
+	if scheme, ok := pf.schemes.Load(key); ok {
+		last = scheme.(string)
+	}
+	if last == fallback {
+		schemes[0], schemes[1] = fallback, t.URL.Scheme
+	}
+
+	var err error
+	for i, scheme := range schemes {
+		target := *t
+		target.URL.Scheme = scheme
+		var mfs prometheus.MetricFamiliesByName
+		if t.URL.Scheme == "https" && scheme == "http" {
+			mfs, err = pf.scrapeDowngraded(&target)
+		} else {
+			mfs, err = pf.scrapeTarget(&target)
+		}
+		if err == nil {
+			if scheme != last {
+				pf.log.WithFields(logrus.Fields{"target": t.Name, "url": t.URL.String()}).Infof("scraped with %s instead of %s", scheme, last)
+			}
+			pf.schemes.Store(key, scheme)
+			fetchSchemeMetric.WithLabelValues(t.Name, scheme).Inc()
+			return mfs, nil
+		}
+		if i == 0 && !isSchemeError(err) {
+			return nil, err
+		}
+		pf.log.WithError(err).WithField("target", t.Name).Debugf("scrape with %s failed", scheme)
+	}
+	return nil, err
+}
+
+// scrapeDowngraded scrapes a https target over http without any of its
+// credentials, nor the global bearer token, as they would be sent in clear.
+func (pf *prometheusFetcher) scrapeDowngraded(t *endpoints.Target) (prometheus.MetricFamiliesByName, error) {
+	t.Auth = nil
+	t.URL.User = nil
+	job := *pf.jobClient(t)
+	job.name += "|downgraded"
+	job.bearerTokenFile = ""
+	client, err := pf.dialingClient(&job, *t)
+	if err != nil {
+		return nil, err
+	}
+	return pf.getMetricsWithRetries(withScrapeTimeout(client, t), t.Name, pf.scrapeURL(t))
+}
+
+// schemeErrors are the messages of the errors of a TLS handshake with an
+// http server, the only ones that tell the scrape failed because of its
+// scheme.
+var schemeErrors = []string{
+	"server gave HTTP response to HTTPS client",
+	"first record does not look like a TLS handshake",
+}
+
+// isSchemeError returns true if the scrape failed because of its scheme.
+// Any other error, like a refused connection, a timeout or an invalid
+// payload, doesn't make the other scheme worth trying, and a downgrade
+// would be an opportunity for whoever answers the plain http requests.
+func isSchemeError(err error) bool {
+	for _, msg := range schemeErrors {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
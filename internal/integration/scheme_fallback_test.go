@@ -0,0 +1,104 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+func TestFetcher_SchemeFallback(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("up 1\n"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	fetch := func(fetcher Fetcher, tc endpoints.TargetConfig) int {
+		targets, err := endpoints.EndpointToTarget(tc)
+		require.NoError(t, err)
+		var fetched int
+		for range fetcher.Fetch(targets) {
+			fetched++
+		}
+		return fetched
+	}
+
+	t.Run("downgrade", func(t *testing.T) {
+		fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength)
+		url := "https://" + plain.Listener.Addr().String()
+		assert.Equal(t, 0, fetch(fetcher, endpoints.TargetConfig{URLs: []string{url}}), "the target only serves http")
+
+		tc := endpoints.TargetConfig{URLs: []string{url}, SchemeFallback: endpoints.SchemeFallbackDowngrade}
+		assert.Equal(t, 1, fetch(fetcher, tc))
+		assert.Equal(t, 1, fetch(fetcher, tc))
+		scheme, _ := fetcher.(*prometheusFetcher).schemes.Load(url + "/metrics")
+		assert.Equal(t, "http", scheme, "the scheme that worked is tried first")
+		assert.Equal(t, float64(2), testutil.ToFloat64(fetchSchemeMetric.WithLabelValues(plain.Listener.Addr().String(), "http")))
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength)
+		tc := endpoints.TargetConfig{
+			URLs:           []string{"http://" + secure.Listener.Addr().String()},
+			TLSConfig:      endpoints.TLSConfig{InsecureSkipVerify: true},
+			SchemeFallback: endpoints.SchemeFallbackUpgrade,
+		}
+		assert.Equal(t, 0, fetch(fetcher, tc), "the error page of the https server isn't a scheme error")
+	})
+
+	t.Run("downgrade without credentials", func(t *testing.T) {
+		var authorizations []string
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorizations = append(authorizations, r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte("up 1\n"))
+		}))
+		defer plain.Close()
+		tokenFile, err := ioutil.TempFile("", "token")
+		require.NoError(t, err)
+		defer os.Remove(tokenFile.Name())
+		_, err = tokenFile.WriteString("global-token")
+		require.NoError(t, err)
+		require.NoError(t, tokenFile.Close())
+
+		fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, tokenFile.Name(), "", false, queueLength)
+		tc := endpoints.TargetConfig{
+			URLs:           []string{"https://user:pass@" + plain.Listener.Addr().String()},
+			Auth:           []endpoints.AuthConfig{{BearerToken: "target-token"}},
+			SchemeFallback: endpoints.SchemeFallbackDowngrade,
+		}
+		assert.Equal(t, 1, fetch(fetcher, tc))
+		assert.Equal(t, []string{""}, authorizations, "no credentials are sent over http")
+	})
+}
+
+func TestIsSchemeError(t *testing.T) {
+	assert.True(t, isSchemeError(errors.New("http: server gave HTTP response to HTTPS client")))
+	assert.True(t, isSchemeError(errors.New("tls: first record does not look like a TLS handshake")))
+	assert.False(t, isSchemeError(&prometheus.ParseError{Err: errors.New("invalid metric name")}))
+	assert.False(t, isSchemeError(errors.New("dial tcp 127.0.0.1:1: connect: connection refused")))
+	assert.False(t, isSchemeError(fmt.Errorf("scrape: %w", &prometheus.AuthError{StatusCode: http.StatusUnauthorized})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:1/metrics", nil)
+	require.NoError(t, err)
+	_, err = http.DefaultClient.Do(req.WithContext(ctx))
+	require.Error(t, err)
+	assert.False(t, isSchemeError(err), "timeouts don't depend on the scheme")
+}
@@ -0,0 +1,57 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// WithScrapeJitter delays the scrape of every target by its own offset
+// within jitter, on top of its slot in the even spacing of the targets over
+// the scrape duration. The offset of a target is the same on every
+// interval, so it's still scraped once per interval, but it's different on
+// every instance of the integration, so they don't scrape nor emit in
+// unison. A jitter of 0 disables it.
+func WithScrapeJitter(jitter time.Duration) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.jitter = jitter
+		pf.jitterSeed = rand.New(rand.NewSource(time.Now().UnixNano())).Uint64()
+	}
+}
+
+// jitterOffset returns the offset of the scrape of the target from the
+// start of the interval.
+func (pf *prometheusFetcher) jitterOffset(t *endpoints.Target) time.Duration {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(t.URL.String()))
+	return time.Duration((h.Sum64() ^ pf.jitterSeed) % uint64(pf.jitter))
+}
+
+// pushJittered queues every target for a worker at its slot in the even
+// spacing of the targets over the scrape duration, delayed by its jitter
+// offset.
+func (pf *prometheusFetcher) pushJittered(scheduler *jobScheduler, targets []endpoints.Target) {
+	spacing := pf.duration / time.Duration(len(targets))
+	at := make([]time.Duration, len(targets))
+	order := make([]int, len(targets))
+	for i := range targets {
+		at[i] = time.Duration(i)*spacing + pf.jitterOffset(&targets[i])
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return at[order[a]] < at[order[b]]
+	})
+	start := time.Now()
+	for _, i := range order {
+		if wait := at[i] - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+		scheduler.push(targets[i])
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func TestJitterOffset(t *testing.T) {
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{URLs: []string{"exporter-a:9100", "exporter-b:9100"}})
+	require.NoError(t, err)
+
+	jitter := 10 * time.Second
+	a := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength, WithScrapeJitter(jitter)).(*prometheusFetcher)
+	b := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength, WithScrapeJitter(jitter)).(*prometheusFetcher)
+	for _, target := range targets {
+		offset := a.jitterOffset(&target)
+		assert.True(t, offset >= 0 && offset < jitter)
+		assert.Equal(t, offset, a.jitterOffset(&target), "the offset is stable between the intervals")
+	}
+	assert.NotEqual(t, a.jitterOffset(&targets[0]), a.jitterOffset(&targets[1]))
+	assert.NotEqual(t, a.jitterOffset(&targets[0]), b.jitterOffset(&targets[0]), "the offsets are different on every instance")
+}
+
+func TestFetcher_ScrapeJitter(t *testing.T) {
+	var mu sync.Mutex
+	var scraped []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		scraped = append(scraped, r.URL.Path)
+		mu.Unlock()
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer ts.Close()
+
+	duration := 400 * time.Millisecond
+	jitter := 50 * time.Millisecond
+	fetcher := NewFetcher(duration, fetchTimeout, 1, "", "", false, queueLength, WithScrapeJitter(jitter)).(*prometheusFetcher)
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{URLs: []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/c", ts.URL + "/d"}})
+	require.NoError(t, err)
+
+	start := time.Now()
+	var fetched int
+	for range fetcher.Fetch(targets) {
+		fetched++
+	}
+	elapsed := time.Since(start)
+	assert.Equal(t, 4, fetched)
+	last := 3*duration/4 + fetcher.jitterOffset(&targets[3])
+	assert.True(t, elapsed >= last, "the last target is scraped at its slot delayed by its offset, after %s", elapsed)
+	assert.True(t, elapsed < duration+jitter+fetchTimeout, "the scrapes are spread over the scrape duration, took %s", elapsed)
+	assert.Equal(t, []string{"/a", "/b", "/c", "/d"}, scraped, "the jitter within the spacing keeps the order of the targets")
+}
@@ -0,0 +1,169 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// defaultScrapeJob is the job of the targets not matching any scrape job.
+const defaultScrapeJob = "default"
+
+// ScrapeJob groups the targets whose metadata (like label.app or
+// namespaceName) has all the Match values, so the scrape workers are shared
+// fairly between the jobs: when targets of several jobs are waiting for a
+// worker, every job gets a share of the workers proportional to its Weight.
+// The targets not matching any job are in the default job, of weight 1.
+type ScrapeJob struct {
+	Name  string            `mapstructure:"name"`
+	Match map[string]string `mapstructure:"match"`
+	// Weight is the share of the workers of the job relative to the other
+	// jobs. Defaults to 1.
+	Weight int `mapstructure:"weight"`
+	// Transport replaces the global TLS, proxy and connection settings of
+	// the scrapes of the job. Every job has its own HTTP clients either way.
+	Transport JobTransport `mapstructure:"transport"`
+	// RawPassthrough forwards the payloads of the targets of the job as
+	// they are scraped, instead of emitting their metrics.
+	RawPassthrough RawPassthrough `mapstructure:"raw_passthrough"`
+}
+
+// ValidateScrapeJobs returns an error if a job has no name, a duplicated
+// one, a negative weight or an invalid transport.
+func ValidateScrapeJobs(jobs []ScrapeJob) error {
+	names := map[string]bool{defaultScrapeJob: true}
+	for i, job := range jobs {
+		if job.Name == "" {
+			return fmt.Errorf("scrape job %d has no name", i)
+		}
+		if names[job.Name] {
+			return fmt.Errorf("scrape job %q is defined more than once, or is the default job", job.Name)
+		}
+		names[job.Name] = true
+		if job.Weight < 0 {
+			return fmt.Errorf("scrape job %q has a negative weight %d", job.Name, job.Weight)
+		}
+		if err := job.Transport.Validate(); err != nil {
+			return fmt.Errorf("scrape job %q: %w", job.Name, err)
+		}
+		if err := job.RawPassthrough.Validate(); err != nil {
+			return fmt.Errorf("scrape job %q: %w", job.Name, err)
+		}
+	}
+	return nil
+}
+
+// WithScrapeJobs shares the scrape workers fairly between the targets of
+// the jobs. A target is in the first job it matches.
+func WithScrapeJobs(jobs ...ScrapeJob) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.scrapeJobs = append(pf.scrapeJobs, jobs...)
+	}
+}
+
+// jobQueue are the targets of a job waiting for a worker.
+type jobQueue struct {
+	name string
+	// stride is how much the pass of the job advances on every scrape, the
+	// inverse of its weight, and pass the virtual time of its next scrape.
+	stride  float64
+	pass    float64
+	targets []endpoints.Target
+}
+
+// jobScheduler hands the targets to the workers by stride scheduling: the
+// next target is the one of the waiting job with the lowest pass, so the
+// jobs get the workers in proportion to their weight, whatever their number
+// of targets. The virtual time is the highest pass scraped so far, and a job
+// that had no waiting target starts a stride after it, so it can't claim the
+// workers it didn't use.
+type jobScheduler struct {
+	jobs   []ScrapeJob
+	queues []*jobQueue
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	vtime   float64
+	waiting int
+	closed  bool
+}
+
+func newJobScheduler(jobs []ScrapeJob) *jobScheduler {
+	s := &jobScheduler{jobs: jobs}
+	s.cond = sync.NewCond(&s.mu)
+	for _, job := range jobs {
+		weight := job.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		s.queues = append(s.queues, &jobQueue{name: job.Name, stride: 1 / float64(weight)})
+	}
+	s.queues = append(s.queues, &jobQueue{name: defaultScrapeJob, stride: 1})
+	return s
+}
+
+// queue returns the queue of the first job the target matches.
+func (s *jobScheduler) queue(t *endpoints.Target) *jobQueue {
+	for i, job := range s.jobs {
+		if matchesMetadata(t, job.Match) {
+			return s.queues[i]
+		}
+	}
+	return s.queues[len(s.queues)-1]
+}
+
+// push queues the target for a worker.
+func (s *jobScheduler) push(t endpoints.Target) {
+	q := s.queue(&t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if start := s.vtime + q.stride; len(q.targets) == 0 && q.pass < start {
+		q.pass = start
+	}
+	q.targets = append(q.targets, t)
+	s.waiting++
+	fetchJobQueuedMetric.WithLabelValues(q.name).Set(float64(len(q.targets)))
+	s.cond.Signal()
+}
+
+// next returns the next target to scrape, waiting for one to be queued. It
+// returns false once the scheduler is closed.
+func (s *jobScheduler) next() (endpoints.Target, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.waiting == 0 {
+		if s.closed {
+			return endpoints.Target{}, false
+		}
+		s.cond.Wait()
+	}
+
+	var q *jobQueue
+	for _, candidate := range s.queues {
+		if len(candidate.targets) > 0 && (q == nil || candidate.pass < q.pass) {
+			q = candidate
+		}
+	}
+	t := q.targets[0]
+	q.targets[0] = endpoints.Target{}
+	q.targets = q.targets[1:]
+	s.waiting--
+	if q.pass > s.vtime {
+		s.vtime = q.pass
+	}
+	q.pass += q.stride
+	fetchJobQueuedMetric.WithLabelValues(q.name).Set(float64(len(q.targets)))
+	return t, true
+}
+
+// close makes the workers return once the queued targets are scraped.
+func (s *jobScheduler) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestValidateScrapeJobs(t *testing.T) {
+	assert.NoError(t, ValidateScrapeJobs(nil))
+	assert.NoError(t, ValidateScrapeJobs([]ScrapeJob{{Name: "a", Weight: 2}, {Name: "b"}}))
+	assert.Error(t, ValidateScrapeJobs([]ScrapeJob{{Weight: 2}}))
+	assert.Error(t, ValidateScrapeJobs([]ScrapeJob{{Name: "a"}, {Name: "a"}}))
+	assert.Error(t, ValidateScrapeJobs([]ScrapeJob{{Name: defaultScrapeJob}}))
+	assert.Error(t, ValidateScrapeJobs([]ScrapeJob{{Name: "a", Weight: -1}}))
+}
+
+func TestJobScheduler(t *testing.T) {
+	target := func(name, namespace string) endpoints.Target {
+		u, err := url.Parse("http://10.0.0.1:9100/metrics")
+		require.NoError(t, err)
+		return endpoints.New(name, *u, endpoints.Object{Name: name, Kind: "pod", Labels: labels.Set{"namespaceName": namespace}})
+	}
+
+	s := newJobScheduler([]ScrapeJob{
+		{Name: "critical", Match: map[string]string{"namespaceName": "payments"}, Weight: 2},
+		{Name: "bulk", Match: map[string]string{"namespaceName": "nodes"}},
+	})
+	for i := 0; i < 6; i++ {
+		s.push(target("bulk", "nodes"))
+	}
+	for i := 0; i < 3; i++ {
+		s.push(target("critical", "payments"))
+	}
+	s.push(target("other", "default"))
+
+	var order []string
+	for i := 0; i < 7; i++ {
+		next, ok := s.next()
+		require.True(t, ok)
+		order = append(order, next.Name)
+	}
+	assert.Equal(t, []string{"critical", "critical", "bulk", "other", "critical", "bulk", "bulk"}, order,
+		"the critical job gets twice the share of the other ones, although it was queued last")
+
+	s.next()
+	s.next()
+	s.next()
+	s.close()
+	_, ok := s.next()
+	assert.False(t, ok)
+}
+
+func TestJobScheduler_IdleJobHasNoCredit(t *testing.T) {
+	target := func(namespace string) endpoints.Target {
+		u, err := url.Parse("http://10.0.0.1:9100/metrics")
+		require.NoError(t, err)
+		return endpoints.New(namespace, *u, endpoints.Object{Name: namespace, Kind: "pod", Labels: labels.Set{"namespaceName": namespace}})
+	}
+
+	s := newJobScheduler([]ScrapeJob{{Name: "late", Match: map[string]string{"namespaceName": "late"}}})
+	for i := 0; i < 10; i++ {
+		s.push(target("early"))
+		s.next()
+	}
+	for i := 0; i < 3; i++ {
+		s.push(target("late"))
+		s.push(target("early"))
+	}
+	var order []string
+	for i := 0; i < 4; i++ {
+		next, _ := s.next()
+		order = append(order, next.Name)
+	}
+	assert.Equal(t, []string{"late", "early", "late", "early"}, order,
+		"the job that was idle doesn't get the workers it didn't use")
+}
@@ -0,0 +1,191 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
+)
+
+// The phases of a scrape, the timeouts are classified by.
+const (
+	phaseConnect        = "connect"
+	phaseTLSHandshake   = "tls_handshake"
+	phaseResponseHeader = "response_header"
+	phaseBodyRead       = "body_read"
+	// phaseTotal is the scrape timeout, limiting the whole scrape.
+	phaseTotal = "total"
+)
+
+// ScrapeTimeouts limit the phases of the scrapes, on top of the scrape
+// timeout limiting the whole scrape, so a slow resolution or a slow first
+// byte can be told apart and tuned. A phase isn't limited if its timeout is
+// 0.
+type ScrapeTimeouts struct {
+	// Connect limits the resolution of the host and the connection to it,
+	// or to the gateway.
+	Connect      time.Duration `mapstructure:"connect"`
+	TLSHandshake time.Duration `mapstructure:"tls_handshake"`
+	// ResponseHeader limits the wait for the response headers once the
+	// request is sent, like for the targets slow to render their metrics.
+	ResponseHeader time.Duration `mapstructure:"response_header"`
+	// BodyRead limits the read of the response body, once the headers are
+	// received.
+	BodyRead time.Duration `mapstructure:"body_read"`
+}
+
+// IsEmpty returns true if no phase is limited.
+func (c ScrapeTimeouts) IsEmpty() bool {
+	return c == ScrapeTimeouts{}
+}
+
+// Validate returns an error if a timeout is negative.
+func (c ScrapeTimeouts) Validate() error {
+	if c.Connect < 0 || c.TLSHandshake < 0 || c.ResponseHeader < 0 || c.BodyRead < 0 {
+		return fmt.Errorf("scrape_timeouts can't be negative")
+	}
+	return nil
+}
+
+// WithScrapeTimeouts limits the phases of the scrapes.
+func WithScrapeTimeouts(timeouts ScrapeTimeouts) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.timeouts = timeouts
+	}
+}
+
+// PhaseTimeoutError is returned when a phase of a scrape times out.
+type PhaseTimeoutError struct {
+	Phase string
+	Limit time.Duration
+	Err   error
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout after %s: %v", e.Phase, e.Limit, e.Err)
+}
+
+func (e *PhaseTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true, so the error is a timeout like the ones it wraps.
+func (e *PhaseTimeoutError) Timeout() bool {
+	return true
+}
+
+// apply sets the TLS handshake and response header timeouts of the
+// transport, and the connect timeout of its dial function.
+func (c ScrapeTimeouts) apply(transport *http.Transport) {
+	transport.TLSHandshakeTimeout = c.TLSHandshake
+	transport.ResponseHeaderTimeout = c.ResponseHeader
+	transport.DialContext = c.dial(transport.DialContext)
+}
+
+// dial returns the dial function limited by the connect timeout, using the
+// default one if dial is nil. It returns dial itself if the connections
+// aren't limited.
+func (c ScrapeTimeouts) dial(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if c.Connect == 0 {
+		return dial
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, c.Connect)
+		defer cancel()
+		conn, err := dial(ctx, network, address)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return nil, &PhaseTimeoutError{Phase: phaseConnect, Limit: c.Connect, Err: err}
+		}
+		return conn, err
+	}
+}
+
+// doer returns the client limiting the read of the response bodies, or the
+// client itself if they aren't limited.
+func (c ScrapeTimeouts) doer(client prometheus.HTTPDoer) prometheus.HTTPDoer {
+	if c.BodyRead == 0 {
+		return client
+	}
+	return &bodyTimeoutDoer{client: client, timeout: c.BodyRead}
+}
+
+// bodyTimeoutDoer cancels the requests whose response body isn't read and
+// closed before the timeout.
+type bodyTimeoutDoer struct {
+	client  prometheus.HTTPDoer
+	timeout time.Duration
+}
+
+func (d *bodyTimeoutDoer) Do(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &timeoutBody{ReadCloser: resp.Body, cancel: cancel, timeout: d.timeout}
+	body.timer = time.AfterFunc(d.timeout, func() {
+		atomic.StoreInt32(&body.timedOut, 1)
+		cancel()
+	})
+	resp.Body = body
+	return resp, nil
+}
+
+// timeoutBody is a response body whose request is canceled at the timeout.
+type timeoutBody struct {
+	io.ReadCloser
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timeout  time.Duration
+	timedOut int32
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		err = &PhaseTimeoutError{Phase: phaseBodyRead, Limit: b.timeout, Err: err}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// timeoutPhase returns the phase of the scrape that timed out, or an empty
+// string if the error is not a timeout.
+func timeoutPhase(err error) string {
+	var phaseErr *PhaseTimeoutError
+	if errors.As(err, &phaseErr) {
+		return phaseErr.Phase
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return ""
+	}
+	// The transport timeouts have no exported type.
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return phaseTLSHandshake
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return phaseResponseHeader
+	}
+	return phaseTotal
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func TestFetcher_ScrapeTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		path     string
+		timeouts ScrapeTimeouts
+		phase    string
+	}{
+		{"/slow-headers", ScrapeTimeouts{ResponseHeader: 50 * time.Millisecond}, phaseResponseHeader},
+		{"/slow-body", ScrapeTimeouts{ResponseHeader: time.Second, BodyRead: 50 * time.Millisecond}, phaseBodyRead},
+	}
+	for _, c := range cases {
+		t.Run(c.phase, func(t *testing.T) {
+			fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength, WithScrapeTimeouts(c.timeouts))
+			targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{URLs: []string{srv.URL + c.path}})
+			require.NoError(t, err)
+			before := testutil.ToFloat64(fetchTimeoutsMetric.WithLabelValues(targets[0].Name, c.phase))
+
+			start := time.Now()
+			for range fetcher.Fetch(targets) {
+				t.Fatal("the scrape must time out")
+			}
+			assert.True(t, time.Since(start) < fetchTimeout, "the phase timeout comes before the scrape timeout")
+			assert.Equal(t, before+1, testutil.ToFloat64(fetchTimeoutsMetric.WithLabelValues(targets[0].Name, c.phase)))
+		})
+	}
+}
+
+func TestScrapeTimeouts_Dial(t *testing.T) {
+	assert.Nil(t, ScrapeTimeouts{}.dial(nil), "the transport dials by default")
+
+	blocked := func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	_, err := ScrapeTimeouts{Connect: 10 * time.Millisecond}.dial(blocked)(context.Background(), "tcp", "exporter:9100")
+	require.Error(t, err)
+	assert.Equal(t, phaseConnect, timeoutPhase(err))
+
+	refused := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	_, err = ScrapeTimeouts{Connect: time.Second}.dial(refused)(context.Background(), "tcp", "exporter:9100")
+	require.Error(t, err)
+	assert.Empty(t, timeoutPhase(err))
+}
+
+func TestTimeoutPhase(t *testing.T) {
+	assert.Empty(t, timeoutPhase(errors.New("connection refused")))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	_, err := client.Get(srv.URL)
+	require.Error(t, err)
+	assert.Equal(t, phaseTotal, timeoutPhase(err))
+
+	// A listener that never completes the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client = &http.Client{Transport: &http.Transport{TLSHandshakeTimeout: 10 * time.Millisecond}}
+	_, err = client.Get("https://" + ln.Addr().String())
+	require.Error(t, err)
+	assert.Equal(t, phaseTLSHandshake, timeoutPhase(err))
+}
+
+func TestScrapeTimeoutsValidate(t *testing.T) {
+	assert.NoError(t, ScrapeTimeouts{}.Validate())
+	assert.NoError(t, ScrapeTimeouts{Connect: time.Second, BodyRead: time.Minute}.Validate())
+	assert.Error(t, ScrapeTimeouts{TLSHandshake: -time.Second}.Validate())
+}
@@ -0,0 +1,164 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// seriesGrowthMetricName is the name of the metric emitted when the number of
+// series of a target grows beyond the configured threshold.
+const seriesGrowthMetricName = "nr_stats_series_growth"
+
+// WithSeriesTracking tracks when every series was first and last seen, so
+// the number of series created and expired in each harvest is reported. The
+// series not seen for longer than ttl are expired. If growthThreshold is
+// greater than 0, a metric is emitted when the number of series scraped from
+// a target grows by more than growthThreshold percent between harvests, to
+// detect cardinality leaks.
+func WithSeriesTracking(ttl time.Duration, growthThreshold float64) ExecuteOption {
+	return func(e *execution) {
+		e.series = newSeriesTracker(ttl, growthThreshold)
+	}
+}
+
+type seriesTimes struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// seriesTracker keeps the first and last time every series of every target
+// was seen.
+type seriesTracker struct {
+	ttl             time.Duration
+	growthThreshold float64
+	now             func() time.Time
+
+	// series holds the times of the series of each target, by their key.
+	series map[string]map[string]*seriesTimes
+	// scraped and created count the series of each target in the current
+	// harvest.
+	scraped map[string]int
+	created map[string]int
+	// previous holds the number of series scraped from each target in the
+	// last harvest.
+	previous map[string]int
+}
+
+func newSeriesTracker(ttl time.Duration, growthThreshold float64) *seriesTracker {
+	return &seriesTracker{
+		ttl:             ttl,
+		growthThreshold: growthThreshold,
+		now:             time.Now,
+		series:          map[string]map[string]*seriesTimes{},
+		scraped:         map[string]int{},
+		created:         map[string]int{},
+		previous:        map[string]int{},
+	}
+}
+
+// seriesKey identifies a series by its name and attributes.
+func seriesKey(m *Metric) string {
+	attrs := make([]string, 0, len(m.attributes))
+	for k, v := range m.attributes {
+		if s, ok := v.(string); ok {
+			attrs = append(attrs, k+"="+s)
+		}
+	}
+	sort.Strings(attrs)
+	return m.name + "{" + strings.Join(attrs, ",") + "}"
+}
+
+// observe records the series of the metrics scraped from the target.
+func (st *seriesTracker) observe(target string, metrics []Metric) {
+	now := st.now()
+	series, ok := st.series[target]
+	if !ok {
+		series = map[string]*seriesTimes{}
+		st.series[target] = series
+	}
+	for i := range metrics {
+		key := seriesKey(&metrics[i])
+		times, ok := series[key]
+		if !ok {
+			times = &seriesTimes{firstSeen: now}
+			series[key] = times
+			st.created[target]++
+		}
+		times.lastSeen = now
+	}
+	st.scraped[target] += len(metrics)
+}
+
+// harvest expires the series not seen for longer than the TTL, reports the
+// series created and expired since the last harvest, and returns the growth
+// metrics of the targets whose number of series grew beyond the threshold.
+func (st *seriesTracker) harvest() []Metric {
+	now := st.now()
+	seriesCreatedMetric.Reset()
+	seriesExpiredMetric.Reset()
+	seriesActiveMetric.Reset()
+
+	for target, series := range st.series {
+		expired := 0
+		for key, times := range series {
+			if now.Sub(times.lastSeen) <= st.ttl {
+				continue
+			}
+			ilog.WithFields(logrus.Fields{
+				"target":    target,
+				"firstSeen": times.firstSeen,
+				"lastSeen":  times.lastSeen,
+			}).Debugf("series expired: %s", key)
+			delete(series, key)
+			expired++
+		}
+		if len(series) == 0 {
+			delete(st.series, target)
+		}
+		seriesCreatedMetric.WithLabelValues(target).Set(float64(st.created[target]))
+		seriesExpiredMetric.WithLabelValues(target).Set(float64(expired))
+		seriesActiveMetric.WithLabelValues(target).Set(float64(len(series)))
+	}
+
+	var metrics []Metric
+	for target, count := range st.scraped {
+		previous, ok := st.previous[target]
+		if !ok || previous == 0 || st.growthThreshold <= 0 {
+			continue
+		}
+		growth := float64(count-previous) * 100 / float64(previous)
+		if growth <= st.growthThreshold {
+			continue
+		}
+		ilog.WithFields(logrus.Fields{
+			"target":   target,
+			"previous": previous,
+			"current":  count,
+		}).Warnf("number of series grew by %.1f%%", growth)
+		metrics = append(metrics, Metric{
+			name:       seriesGrowthMetricName,
+			value:      growth,
+			metricType: metricType_GAUGE,
+			attributes: labels.Set{
+				"targetName":      target,
+				"previousSeries":  previous,
+				"currentSeries":   count,
+				"nrMetricType":    string(metricType_GAUGE),
+				"growthThreshold": st.growthThreshold,
+			},
+		})
+	}
+
+	st.previous = st.scraped
+	st.scraped = map[string]int{}
+	st.created = map[string]int{}
+	return metrics
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func testSeries(n int) []Metric {
+	metrics := make([]Metric, 0, n)
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, Metric{
+			name:       "http_requests_total",
+			value:      float64(1),
+			metricType: metricType_COUNTER,
+			attributes: labels.Set{"path": fmt.Sprintf("/%d", i)},
+		})
+	}
+	return metrics
+}
+
+func TestSeriesTracker_CreatedAndExpired(t *testing.T) {
+	now := time.Now()
+	st := newSeriesTracker(time.Minute, 0)
+	st.now = func() time.Time { return now }
+
+	st.observe("a", testSeries(3))
+	assert.Empty(t, st.harvest())
+	assert.Equal(t, float64(3), testutil.ToFloat64(seriesCreatedMetric.WithLabelValues("a")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(seriesExpiredMetric.WithLabelValues("a")))
+
+	now = now.Add(30 * time.Second)
+	st.observe("a", testSeries(2))
+	st.harvest()
+	assert.Equal(t, float64(0), testutil.ToFloat64(seriesCreatedMetric.WithLabelValues("a")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(seriesActiveMetric.WithLabelValues("a")))
+
+	now = now.Add(45 * time.Second)
+	st.observe("a", testSeries(2))
+	st.harvest()
+	assert.Equal(t, float64(1), testutil.ToFloat64(seriesExpiredMetric.WithLabelValues("a")), "the series not seen for the TTL must expire")
+	assert.Equal(t, float64(2), testutil.ToFloat64(seriesActiveMetric.WithLabelValues("a")))
+
+	times := st.series["a"][seriesKey(&testSeries(1)[0])]
+	require.NotNil(t, times)
+	assert.Equal(t, now.Add(-75*time.Second), times.firstSeen)
+	assert.Equal(t, now, times.lastSeen)
+}
+
+func TestSeriesTracker_Growth(t *testing.T) {
+	st := newSeriesTracker(time.Minute, 50)
+
+	st.observe("a", testSeries(10))
+	st.observe("b", testSeries(10))
+	assert.Empty(t, st.harvest(), "the first harvest has nothing to compare with")
+
+	st.observe("a", testSeries(15))
+	st.observe("b", testSeries(16))
+	metrics := st.harvest()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, seriesGrowthMetricName, metrics[0].name)
+	assert.Equal(t, float64(60), metrics[0].value)
+	assert.Equal(t, "b", metrics[0].attributes["targetName"])
+	assert.Equal(t, 10, metrics[0].attributes["previousSeries"])
+	assert.Equal(t, 16, metrics[0].attributes["currentSeries"])
+
+	st = newSeriesTracker(time.Minute, 0)
+	st.observe("a", testSeries(1))
+	st.harvest()
+	st.observe("a", testSeries(10))
+	assert.Empty(t, st.harvest(), "the growth is not checked without threshold")
+}
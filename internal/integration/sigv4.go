@@ -0,0 +1,173 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+const (
+	// defaultSigV4Service is the service of Amazon Managed Service for
+	// Prometheus.
+	defaultSigV4Service = "aps"
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	amzDateFormat       = "20060102T150405Z"
+)
+
+// NewSigV4RoundTripper signs the requests with AWS Signature Version 4
+// unless the authorization header has already been set.
+func NewSigV4RoundTripper(cfg endpoints.SigV4Config, rt http.RoundTripper) http.RoundTripper {
+	if cfg.Service == "" {
+		cfg.Service = defaultSigV4Service
+	}
+	return &sigV4RoundTripper{cfg: cfg, rt: rt, now: time.Now, source: newAWSCredentialSource(cfg.Region)}
+}
+
+type sigV4RoundTripper struct {
+	cfg    endpoints.SigV4Config
+	rt     http.RoundTripper
+	now    func() time.Time
+	source *awsCredentialSource
+}
+
+// sigV4Credentials are the credentials the requests are signed with.
+type sigV4Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// credentials returns the configured credentials, or the ones of the
+// default credential chain.
+func (rt *sigV4RoundTripper) credentials() (sigV4Credentials, error) {
+	if rt.cfg.AccessKey != "" {
+		return sigV4Credentials{accessKey: rt.cfg.AccessKey, secretKey: string(rt.cfg.SecretKey)}, nil
+	}
+	return rt.source.credentials()
+}
+
+func (rt *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) > 0 {
+		return rt.rt.RoundTrip(req)
+	}
+	creds, err := rt.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := []byte{}
+	if req.Body != nil {
+		if payload, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, fmt.Errorf("unable to sign the request with sigv4: %w", err)
+		}
+		_ = req.Body.Close()
+	}
+	req = cloneRequest(req)
+	if req.Body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	}
+	rt.sign(req, creds, payload, rt.now().UTC())
+	return rt.rt.RoundTrip(req)
+}
+
+// sign adds the date, the session token, if any, and the signature of the
+// request to its headers.
+func (rt *sigV4RoundTripper) sign(req *http.Request, creds sigV4Credentials, payload []byte, now time.Time) {
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	for _, values := range query {
+		sort.Strings(values)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigV4EscapePath(req.URL.EscapedPath()),
+		strings.Replace(query.Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(payload),
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, rt.cfg.Region, rt.cfg.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	for _, part := range []string{rt.cfg.Region, rt.cfg.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.accessKey, scope, signedHeaders, signature))
+}
+
+// sigV4EscapePath escapes the path of the canonical request: all the bytes
+// but the unreserved characters and the slashes. The path is already
+// escaped, since the services other than S3 escape it twice.
+func sigV4EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
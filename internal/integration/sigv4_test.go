@@ -0,0 +1,217 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// recordingRoundTripper returns the round tripper recording the requests
+// into req.
+func recordingRoundTripper(req **http.Request) roundTripperFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		*req = r
+		return emptyResponse(http.StatusOK), nil
+	}
+}
+
+func TestSigV4RoundTripper(t *testing.T) {
+	// The requests and signatures of the AWS Signature Version 4 test suite.
+	cases := []struct {
+		name      string
+		url       string
+		signature string
+	}{
+		{
+			name:      "get-vanilla",
+			url:       "https://example.amazonaws.com/",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:      "get-vanilla-query-order-key-case",
+			url:       "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sent *http.Request
+			rt := NewSigV4RoundTripper(endpoints.SigV4Config{
+				Region:    "us-east-1",
+				Service:   "service",
+				AccessKey: "AKIDEXAMPLE",
+				SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+			}, recordingRoundTripper(&sent)).(*sigV4RoundTripper)
+			rt.now = func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) }
+
+			req, err := http.NewRequest(http.MethodGet, c.url, nil)
+			require.NoError(t, err)
+			_, err = rt.RoundTrip(req)
+			require.NoError(t, err)
+
+			assert.Equal(t, "20150830T123600Z", sent.Header.Get("X-Amz-Date"))
+			assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+				"SignedHeaders=host;x-amz-date, Signature="+c.signature, sent.Header.Get("Authorization"))
+			assert.Empty(t, req.Header.Get("Authorization"), "the original request isn't modified")
+		})
+	}
+}
+
+// unsetAWSEnvironment unsets the environment variables of the AWS
+// credential chain, returning the function restoring them.
+func unsetAWSEnvironment(t *testing.T) func() {
+	envs := []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME", "AWS_REGION", "AWS_DEFAULT_REGION",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+	}
+	values := map[string]string{}
+	for _, env := range envs {
+		if value, ok := os.LookupEnv(env); ok {
+			values[env] = value
+			require.NoError(t, os.Unsetenv(env))
+		}
+	}
+	return func() {
+		for _, env := range envs {
+			_ = os.Unsetenv(env)
+		}
+		for env, value := range values {
+			_ = os.Setenv(env, value)
+		}
+	}
+}
+
+func TestSigV4RoundTripper_EnvironmentCredentials(t *testing.T) {
+	var sent *http.Request
+	rt := NewSigV4RoundTripper(endpoints.SigV4Config{Region: "eu-west-1"}, recordingRoundTripper(&sent))
+	req, err := http.NewRequest(http.MethodGet, "https://aps-workspaces.eu-west-1.amazonaws.com/workspaces/ws-1/api/v1/query", nil)
+	require.NoError(t, err)
+
+	defer unsetAWSEnvironment(t)()
+	defer os.Setenv("AWS_EC2_METADATA_DISABLED", os.Getenv("AWS_EC2_METADATA_DISABLED"))
+	require.NoError(t, os.Setenv("AWS_EC2_METADATA_DISABLED", "true"))
+	_, err = rt.RoundTrip(req)
+	assert.Error(t, err, "there are no credentials")
+
+	require.NoError(t, os.Setenv("AWS_ACCESS_KEY_ID", "AKID"))
+	require.NoError(t, os.Setenv("AWS_SECRET_ACCESS_KEY", "secret"))
+	require.NoError(t, os.Setenv("AWS_SESSION_TOKEN", "token"))
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "token", sent.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, sent.Header.Get("Authorization"), "Credential=AKID/")
+	assert.Contains(t, sent.Header.Get("Authorization"), "/eu-west-1/aps/aws4_request")
+	assert.Contains(t, sent.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+
+	req.Header.Set("Authorization", "Bearer token")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer token", sent.Header.Get("Authorization"), "the authorization header isn't replaced")
+}
+
+func TestAWSCredentialSource_WebIdentity(t *testing.T) {
+	defer unsetAWSEnvironment(t)()
+	var form url.Values
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAWEB</AccessKeyId>
+      <SecretAccessKey>web-secret</SecretAccessKey>
+      <SessionToken>web-session</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+	defer func(u string) { awsSTSURL = u }(awsSTSURL)
+	awsSTSURL = sts.URL + "/%s"
+
+	dir, err := ioutil.TempDir("", "aws")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("web-identity-token\n"), 0600))
+	require.NoError(t, os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile))
+	require.NoError(t, os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/nri-prometheus"))
+
+	source := newAWSCredentialSource("eu-west-1")
+	creds, err := source.credentials()
+	require.NoError(t, err)
+	assert.Equal(t, sigV4Credentials{accessKey: "ASIAWEB", secretKey: "web-secret", sessionToken: "web-session"}, creds)
+	assert.Equal(t, "AssumeRoleWithWebIdentity", form.Get("Action"))
+	assert.Equal(t, "arn:aws:iam::123456789012:role/nri-prometheus", form.Get("RoleArn"))
+	assert.Equal(t, "web-identity-token", form.Get("WebIdentityToken"))
+
+	form = nil
+	_, err = source.credentials()
+	require.NoError(t, err)
+	assert.Nil(t, form, "the credentials are cached until they're about to expire")
+}
+
+func TestAWSCredentialSource_Container(t *testing.T) {
+	defer unsetAWSEnvironment(t)()
+	var authorization string
+	ecs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		assert.Equal(t, "/v2/credentials/task", r.URL.Path)
+		_, _ = w.Write([]byte(`{"AccessKeyId":"ASIAECS","SecretAccessKey":"ecs-secret","Token":"ecs-session","Expiration":"2030-01-01T00:00:00Z"}`))
+	}))
+	defer ecs.Close()
+	defer func(u string) { awsContainerCredentials = u }(awsContainerCredentials)
+	awsContainerCredentials = ecs.URL
+	require.NoError(t, os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "/v2/credentials/task"))
+	require.NoError(t, os.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "container-token"))
+
+	creds, err := newAWSCredentialSource("eu-west-1").credentials()
+	require.NoError(t, err)
+	assert.Equal(t, sigV4Credentials{accessKey: "ASIAECS", secretKey: "ecs-secret", sessionToken: "ecs-session"}, creds)
+	assert.Equal(t, "container-token", authorization)
+}
+
+func TestAWSCredentialSource_InstanceMetadata(t *testing.T) {
+	defer unsetAWSEnvironment(t)()
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			assert.Equal(t, http.MethodPut, r.Method)
+			_, _ = w.Write([]byte("imds-token"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			_, _ = w.Write([]byte("node-role\n"))
+		case "/latest/meta-data/iam/security-credentials/node-role":
+			_, _ = w.Write([]byte(`{"Code":"Success","AccessKeyId":"ASIAEC2","SecretAccessKey":"ec2-secret","Token":"ec2-session","Expiration":"2030-01-01T00:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer imds.Close()
+	defer func(u string) { awsInstanceMetadataURL = u }(awsInstanceMetadataURL)
+	awsInstanceMetadataURL = imds.URL
+
+	creds, err := newAWSCredentialSource("eu-west-1").credentials()
+	require.NoError(t, err)
+	assert.Equal(t, sigV4Credentials{accessKey: "ASIAEC2", secretKey: "ec2-secret", sessionToken: "ec2-session"}, creds)
+}
@@ -0,0 +1,294 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// SnapshotSeries are the values of the series of a snapshot, by their name
+// and labels in the Prometheus text format.
+type SnapshotSeries map[string]float64
+
+// ReadSnapshot reads the series of a recorded scrape or emission: metric
+// records as a JSON array or one per line, like the ones written by the
+// file and stdout emitters, a debug capture bundle, whose emitted metrics
+// are read, or a scrape in the Prometheus text format. Gzipped snapshots are
+// decompressed. Summaries and histograms are read as their quantile,
+// bucket, sum and count series. When a series is recorded several times,
+// its last value is kept. The ignored labels are removed from the series,
+// e.g. to compare the scrapes of different targets.
+func ReadSnapshot(r io.Reader, ignoredLabels ...string) (SnapshotSeries, error) {
+	ignored := make(map[string]bool, len(ignoredLabels))
+	for _, l := range ignoredLabels {
+		ignored[l] = true
+	}
+	series := SnapshotSeries{}
+	if err := series.read(r, ignored); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// read adds the series of the snapshot, detecting its format.
+func (s SnapshotSeries) read(r io.Reader, ignored map[string]bool) error {
+	br := bufio.NewReaderSize(r, 1024)
+	head, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("reading gzipped snapshot: %w", err)
+		}
+		defer gz.Close()
+		return s.read(gz, ignored)
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return s.readBundle(br, ignored)
+	}
+	trimmed := bytes.TrimSpace(head)
+	if len(trimmed) > 0 && (trimmed[0] == '[' || trimmed[0] == '{') {
+		return s.readRecords(br, ignored)
+	}
+	return s.readPromText(br, ignored)
+}
+
+// readBundle adds the emitted metrics of a debug capture bundle.
+func (s SnapshotSeries) readBundle(r io.Reader, ignored map[string]bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading snapshot bundle: %w", err)
+		}
+		if matched, _ := path.Match("metrics/*.json", hdr.Name); !matched {
+			continue
+		}
+		if err := s.readRecords(tr, ignored); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// readRecords adds the metric records of JSON arrays or objects.
+func (s SnapshotSeries) readRecords(r io.Reader, ignored map[string]bool) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding metric records: %w", err)
+		}
+		var records []metricRecord
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			if err := json.Unmarshal(raw, &records); err != nil {
+				return fmt.Errorf("decoding metric records: %w", err)
+			}
+		} else {
+			var record metricRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return fmt.Errorf("decoding metric record: %w", err)
+			}
+			records = append(records, record)
+		}
+		for _, r := range records {
+			s.add(Metric{
+				name:       r.Name,
+				metricType: r.Type,
+				value:      r.Value,
+				summary:    r.Summary,
+				histogram:  r.Histogram,
+				attributes: r.Attributes,
+			}, ignored)
+		}
+	}
+}
+
+// readPromText adds the metrics of a scrape in the Prometheus text format.
+func (s SnapshotSeries) readPromText(r io.Reader, ignored map[string]bool) error {
+	d := expfmt.NewDecoder(r, expfmt.FmtText)
+	for {
+		var mf io_prometheus_client.MetricFamily
+		if err := d.Decode(&mf); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("decoding Prometheus text snapshot: %w", err)
+		}
+		for _, m := range mf.GetMetric() {
+			metric := Metric{name: mf.GetName(), attributes: labels.Set{}}
+			for _, l := range m.GetLabel() {
+				metric.attributes[l.GetName()] = l.GetValue()
+			}
+			switch mf.GetType() {
+			case io_prometheus_client.MetricType_COUNTER:
+				metric.metricType, metric.value = metricType_COUNTER, m.GetCounter().GetValue()
+			case io_prometheus_client.MetricType_GAUGE:
+				metric.metricType, metric.value = metricType_GAUGE, m.GetGauge().GetValue()
+			case io_prometheus_client.MetricType_UNTYPED:
+				metric.metricType, metric.value = metricType_GAUGE, m.GetUntyped().GetValue()
+			case io_prometheus_client.MetricType_SUMMARY:
+				metric.metricType, metric.summary = metricType_SUMMARY, m.GetSummary()
+			case io_prometheus_client.MetricType_HISTOGRAM:
+				metric.metricType, metric.histogram = metricType_HISTOGRAM, m.GetHistogram()
+			default:
+				continue
+			}
+			s.add(metric, ignored)
+		}
+	}
+}
+
+// add adds the series of the metric, without the ignored labels.
+func (s SnapshotSeries) add(m Metric, ignored map[string]bool) {
+	if len(ignored) > 0 {
+		attrs := make(labels.Set, len(m.attributes))
+		for k, v := range m.attributes {
+			if !ignored[k] {
+				attrs[k] = v
+			}
+		}
+		m.attributes = attrs
+	}
+	for _, ts := range remoteWriteSeries([]Metric{m}, time.Time{}) {
+		var name string
+		var lbls []string
+		for _, l := range ts.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+				continue
+			}
+			if ignored[l.Name] {
+				continue
+			}
+			lbls = append(lbls, l.Name+`="`+escapeLabelValue(l.Value)+`"`)
+		}
+		if len(lbls) > 0 {
+			name += "{" + strings.Join(lbls, ",") + "}"
+		}
+		s[name] = ts.Samples[0].Value
+	}
+}
+
+// SeriesChange is a series whose value changed between two snapshots.
+type SeriesChange struct {
+	Series string
+	Old    float64
+	New    float64
+}
+
+// SnapshotDiff are the differences between two snapshots.
+type SnapshotDiff struct {
+	// Added are the series only in the second snapshot, and Removed the
+	// ones only in the first one.
+	Added   []string
+	Removed []string
+	Changed []SeriesChange
+	// Unchanged is the number of series in both snapshots with the same
+	// value, or a change below the minimum.
+	Unchanged int
+	old, new  SnapshotSeries
+}
+
+// DiffSnapshots compares the series of two snapshots. Value changes smaller
+// than minChange, relative to the old value, are not reported.
+func DiffSnapshots(old, new SnapshotSeries, minChange float64) SnapshotDiff {
+	diff := SnapshotDiff{old: old, new: new}
+	for series, oldValue := range old {
+		newValue, ok := new[series]
+		if !ok {
+			diff.Removed = append(diff.Removed, series)
+			continue
+		}
+		if valueChanged(oldValue, newValue, minChange) {
+			diff.Changed = append(diff.Changed, SeriesChange{Series: series, Old: oldValue, New: newValue})
+		} else {
+			diff.Unchanged++
+		}
+	}
+	for series := range new {
+		if _, ok := old[series]; !ok {
+			diff.Added = append(diff.Added, series)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Series < diff.Changed[j].Series })
+	return diff
+}
+
+// valueChanged returns whether the value changed by at least minChange,
+// relative to the old value. NaN values are equal.
+func valueChanged(old, new, minChange float64) bool {
+	if math.IsNaN(old) && math.IsNaN(new) || old == new {
+		return false
+	}
+	if minChange <= 0 || old == 0 || math.IsNaN(old) || math.IsNaN(new) {
+		return true
+	}
+	return math.Abs((new-old)/old) >= minChange
+}
+
+// IsEmpty returns true if the snapshots have the same series and values.
+func (d SnapshotDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Write writes the report of the differences: the added, removed and
+// changed series, with the value deltas, followed by a summary.
+func (d SnapshotDiff) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if len(d.Added) > 0 {
+		fmt.Fprintf(bw, "Added series (%d):\n", len(d.Added))
+		for _, s := range d.Added {
+			fmt.Fprintf(bw, "+ %s %s\n", s, formatFloat(d.new[s]))
+		}
+	}
+	if len(d.Removed) > 0 {
+		fmt.Fprintf(bw, "Removed series (%d):\n", len(d.Removed))
+		for _, s := range d.Removed {
+			fmt.Fprintf(bw, "- %s %s\n", s, formatFloat(d.old[s]))
+		}
+	}
+	if len(d.Changed) > 0 {
+		fmt.Fprintf(bw, "Changed series (%d):\n", len(d.Changed))
+		for _, c := range d.Changed {
+			delta := c.New - c.Old
+			fmt.Fprintf(bw, "~ %s %s -> %s (%s%s", c.Series, formatFloat(c.Old), formatFloat(c.New), signed(delta), formatFloat(delta))
+			if c.Old != 0 && !math.IsNaN(delta) && !math.IsInf(delta, 0) {
+				pct := delta / math.Abs(c.Old) * 100
+				fmt.Fprintf(bw, ", %s%.2f%%", signed(pct), pct)
+			}
+			fmt.Fprintln(bw, ")")
+		}
+	}
+	fmt.Fprintf(bw, "%d added, %d removed, %d changed, %d unchanged\n", len(d.Added), len(d.Removed), len(d.Changed), d.Unchanged)
+	return bw.Flush()
+}
+
+// signed returns the plus sign of the positive numbers.
+func signed(f float64) string {
+	if f > 0 {
+		return "+"
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const snapshotText = `# TYPE http_requests_total counter
+http_requests_total{code="200",instance="a"} 10
+http_requests_total{code="500",instance="a"} 1
+# TYPE latency summary
+latency{quantile="0.5"} 2
+latency_sum 6
+latency_count 3
+`
+
+func TestReadSnapshot(t *testing.T) {
+	expected := SnapshotSeries{
+		`http_requests_total{code="200",instance="a"}`: 10,
+		`http_requests_total{code="500",instance="a"}`: 1,
+		`latency{quantile="0.5"}`:                      2,
+		`latency_sum`:                                  6,
+		`latency_count`:                                3,
+	}
+	series, err := ReadSnapshot(strings.NewReader(snapshotText))
+	require.NoError(t, err)
+	assert.Equal(t, expected, series)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write([]byte(snapshotText))
+	require.NoError(t, w.Close())
+	series, err = ReadSnapshot(&gz, "instance")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, series[`http_requests_total{code="500"}`], "the ignored labels are removed")
+
+	var ndjson bytes.Buffer
+	se := NewStdoutEmitter()
+	se.w = &ndjson
+	se.format = StdoutFormatNDJSON
+	require.NoError(t, se.Emit(stdoutTestMetrics(t)))
+	series, err = ReadSnapshot(&ndjson)
+	require.NoError(t, err)
+	assert.Equal(t, SnapshotSeries{
+		`up{job="node"}`:                   1,
+		`up{job="api",path="C:\\\"tmp\""}`: 0,
+		`http_requests`:                    5,
+		`latency{quantile="0.5"}`:          2,
+		`latency_sum`:                      6,
+		`latency_count`:                    3,
+	}, series)
+
+	_, err = ReadSnapshot(strings.NewReader(`[{"name": 1}]`))
+	assert.Error(t, err)
+}
+
+func TestReadSnapshot_Bundle(t *testing.T) {
+	c := &capture{target: "a", start: time.Now(), end: time.Now(), files: []captureFile{
+		{name: "scrapes/0001-request.txt", body: []byte("GET /metrics")},
+		{name: "metrics/0001.json", body: []byte(`[{"name": "up", "type": "gauge", "value": 0, "attributes": {"job": "a"}}]`)},
+		{name: "metrics/0002.json", body: []byte(`[{"name": "up", "type": "gauge", "value": 1, "attributes": {"job": "a"}}]`)},
+	}}
+	var bundle bytes.Buffer
+	require.NoError(t, c.writeBundle(&bundle))
+
+	series, err := ReadSnapshot(&bundle)
+	require.NoError(t, err)
+	assert.Equal(t, SnapshotSeries{`up{job="a"}`: 1}, series, "the last value is kept")
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	old := SnapshotSeries{"a": 1, "b": 100, "c": 3, "d": 0}
+	new := SnapshotSeries{"a": 1, "b": 102, "c": 6, "e": 5}
+
+	d := DiffSnapshots(old, new, 0.05)
+	assert.Equal(t, []string{"e"}, d.Added)
+	assert.Equal(t, []string{"d"}, d.Removed)
+	assert.Equal(t, []SeriesChange{{Series: "c", Old: 3, New: 6}}, d.Changed)
+	assert.Equal(t, 2, d.Unchanged, "b changed less than the minimum")
+	assert.False(t, d.IsEmpty())
+
+	var out bytes.Buffer
+	require.NoError(t, d.Write(&out))
+	assert.Equal(t, `Added series (1):
++ e 5
+Removed series (1):
+- d 0
+Changed series (1):
+~ c 3 -> 6 (+3, +100.00%)
+1 added, 1 removed, 1 changed, 2 unchanged
+`, out.String())
+
+	assert.True(t, DiffSnapshots(old, old, 0).IsEmpty())
+}
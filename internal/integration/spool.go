@@ -0,0 +1,387 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSpoolMaxSizeMB = 100
+	defaultSpoolMaxAge    = 24 * time.Hour
+	// spoolReplayTimeout is the timeout of every replayed request.
+	spoolReplayTimeout = 30 * time.Second
+	spoolExt           = ".spool"
+)
+
+// spoolCredentialHeaders are not written to disk. The replayed requests get
+// them from the request whose success started the replay.
+var spoolCredentialHeaders = []string{"Api-Key", "X-Insert-Key", "X-License-Key", "Authorization"}
+
+var slog = logrus.WithField("component", "Spool")
+
+// SpoolConfig configures the disk spool of the requests of the telemetry
+// emitter that fail with a network error, a 5xx or a 429.
+type SpoolConfig struct {
+	// Dir where the failed requests are written. The spool is disabled if
+	// empty.
+	Dir string `mapstructure:"dir"`
+	// MaxSizeMB is the disk usage of the spool, beyond which the oldest
+	// requests are dropped. Defaults to 100.
+	MaxSizeMB int `mapstructure:"max_size_mb"`
+	// MaxAge is how long the requests are kept before they are dropped.
+	// Defaults to 24h.
+	MaxAge time.Duration `mapstructure:"max_age"`
+
+	// maxBytes overrides MaxSizeMB, so a harvester pool splits the size
+	// between the spools of its emitters.
+	maxBytes int64
+}
+
+// Validate returns an error if the limits are negative.
+func (c SpoolConfig) Validate() error {
+	if c.MaxSizeMB < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("the spool max_size_mb and max_age can't be negative")
+	}
+	return nil
+}
+
+// spoolEntry is the header of the spooled requests, followed by their body.
+type spoolEntry struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+}
+
+// spool is a write ahead log of the harvester requests. The requests that
+// fail are written to disk and reported to the harvester as accepted, so it
+// doesn't drop them, and are replayed in order once a request succeeds.
+type spool struct {
+	emitter  string
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	now      func() time.Time
+	// rt sends the requests, live and replayed.
+	rt http.RoundTripper
+
+	mu          sync.Mutex
+	seq         int
+	credentials http.Header
+	replaying   bool
+	// replayed is closed when the current replay ends. Used by the tests.
+	replayed chan struct{}
+}
+
+// newSpool returns the spool of the emitter, creating its directory.
+func newSpool(emitter string, cfg SpoolConfig) (*spool, error) {
+	dir := filepath.Join(cfg.Dir, emitter)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating the spool directory: %w", err)
+	}
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB == 0 {
+		maxSizeMB = defaultSpoolMaxSizeMB
+	}
+	maxBytes := int64(maxSizeMB) << 20
+	if cfg.maxBytes > 0 {
+		maxBytes = cfg.maxBytes
+	}
+	maxAge := cfg.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultSpoolMaxAge
+	}
+	s := &spool{
+		emitter:  emitter,
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		now:      time.Now,
+	}
+	if files, _, err := s.files(); err == nil && len(files) > 0 {
+		slog.WithField("emitter", emitter).Infof("%d spooled requests will be replayed once the emission succeeds", len(files))
+	}
+	return s, nil
+}
+
+// harvesterOpt wraps the harvester client transport with the spool. It must
+// be the last option, so the other options see the failed requests.
+func (s *spool) harvesterOpt() TelemetryHarvesterOpt {
+	return func(cfg *telemetry.Config) {
+		s.rt = cfg.Client.Transport
+		if s.rt == nil {
+			s.rt = http.DefaultTransport
+		}
+		cfg.Client.Transport = s
+	}
+}
+
+// spoolable returns whether the request should be retried later.
+func spoolable(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// RoundTrip sends the request, spooling it if it fails, and starts the replay
+// of the spooled requests when it succeeds.
+func (s *spool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := s.rt.RoundTrip(req)
+	if !spoolable(resp, err) {
+		if resp.StatusCode < http.StatusMultipleChoices {
+			s.replay(req.Header)
+		}
+		return resp, err
+	}
+	if werr := s.write(req, body); werr != nil {
+		slog.WithError(werr).WithField("emitter", s.emitter).Warn("spooling failed request")
+		return resp, err
+	}
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	return &http.Response{
+		Status:     "202 Accepted",
+		StatusCode: http.StatusAccepted,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// write persists the request, then drops the oldest requests beyond the
+// limits. The file is renamed into place once written, so the replay never
+// reads partial requests.
+func (s *spool) write(req *http.Request, body []byte) error {
+	header := req.Header.Clone()
+	for _, h := range spoolCredentialHeaders {
+		header.Del(h)
+	}
+	line, err := json.Marshal(spoolEntry{Method: req.Method, URL: req.URL.String(), Header: header})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", s.now().UnixNano(), s.seq%1000000, spoolExt)
+	s.mu.Unlock()
+
+	tmp := filepath.Join(s.dir, "."+name)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, _ = w.Write(line)
+	_ = w.WriteByte('\n')
+	_, _ = w.Write(body)
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	spoolSpooledMetric.WithLabelValues(s.emitter).Inc()
+	s.enforceLimits()
+	return nil
+}
+
+// files returns the spooled requests, from the oldest to the newest, and
+// their total size.
+func (s *spool) files() ([]os.FileInfo, int64, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []os.FileInfo
+	var size int64
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || filepath.Ext(info.Name()) != spoolExt {
+			continue
+		}
+		files = append(files, info)
+		size += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, size, nil
+}
+
+// spooledAt returns the time the request was spooled, from its file name.
+func spooledAt(name string) time.Time {
+	nanos, _ := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+	return time.Unix(0, nanos)
+}
+
+// enforceLimits drops the requests older than the max age, and the oldest
+// ones while the spool is bigger than its max size.
+func (s *spool) enforceLimits() {
+	files, size, err := s.files()
+	if err != nil {
+		slog.WithError(err).WithField("emitter", s.emitter).Warn("listing spooled requests")
+		return
+	}
+	now := s.now()
+	for _, f := range files {
+		reason := ""
+		switch {
+		case now.Sub(spooledAt(f.Name())) > s.maxAge:
+			reason = "age"
+		case size > s.maxBytes:
+			reason = "size"
+		default:
+			spoolPendingMetric.WithLabelValues(s.emitter).Set(float64(len(files)))
+			return
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			slog.WithError(err).WithField("emitter", s.emitter).Warn("dropping spooled request")
+			return
+		}
+		size -= f.Size()
+		files = files[1:]
+		spoolDroppedMetric.WithLabelValues(s.emitter, reason).Inc()
+	}
+	spoolPendingMetric.WithLabelValues(s.emitter).Set(0)
+}
+
+// replay starts replaying the spooled requests in the background, unless
+// it's already replaying, with the credentials of the successful request.
+func (s *spool) replay(header http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials = http.Header{}
+	for _, h := range spoolCredentialHeaders {
+		if v, ok := header[http.CanonicalHeaderKey(h)]; ok {
+			s.credentials[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+	if s.replaying {
+		return
+	}
+	files, _, err := s.files()
+	if err != nil || len(files) == 0 {
+		return
+	}
+	s.replaying = true
+	s.replayed = make(chan struct{})
+	go s.replayAll(s.replayed)
+}
+
+// replayAll sends the spooled requests in order. It stops at the first
+// request failing again, which is kept for the next replay. Requests rejected
+// for good, like a 400, are dropped.
+func (s *spool) replayAll(done chan struct{}) {
+	defer func() {
+		s.mu.Lock()
+		s.replaying = false
+		s.mu.Unlock()
+		close(done)
+	}()
+	log := slog.WithField("emitter", s.emitter)
+	s.enforceLimits()
+	files, _, err := s.files()
+	if err != nil {
+		log.WithError(err).Warn("listing spooled requests")
+		return
+	}
+	log.Infof("replaying %d spooled requests", len(files))
+	for _, f := range files {
+		name := filepath.Join(s.dir, f.Name())
+		resp, err := s.send(name)
+		if spoolable(resp, err) {
+			if err == nil {
+				err = fmt.Errorf("unexpected response %s", resp.Status)
+			}
+			log.WithError(err).Warn("replaying spooled request, retrying on the next successful emission")
+			s.enforceLimits()
+			return
+		}
+		if resp.StatusCode >= http.StatusMultipleChoices {
+			log.Warnf("spooled request rejected with %s, dropping it", resp.Status)
+			spoolDroppedMetric.WithLabelValues(s.emitter, "rejected").Inc()
+		} else {
+			spoolReplayedMetric.WithLabelValues(s.emitter).Inc()
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Warn("removing replayed request")
+			return
+		}
+	}
+	s.enforceLimits()
+}
+
+// send replays the spooled request of the file.
+func (s *spool) send(name string) (*http.Response, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var entry spoolEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spoolReplayTimeout)
+	defer cancel()
+	req, err := http.NewRequest(entry.Method, entry.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = entry.Header
+	s.mu.Lock()
+	for k, v := range s.credentials {
+		req.Header[k] = v
+	}
+	s.mu.Unlock()
+	resp, err := s.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp, nil
+}
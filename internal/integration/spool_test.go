@@ -0,0 +1,159 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPI records the bodies of the requests it accepts, failing while down.
+type fakeAPI struct {
+	mu       sync.Mutex
+	down     bool
+	status   int
+	accepted []string
+	keys     []string
+}
+
+func (f *fakeAPI) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	status := http.StatusAccepted
+	if f.status != 0 {
+		status = f.status
+	}
+	if status == http.StatusAccepted {
+		f.accepted = append(f.accepted, string(body))
+		f.keys = append(f.keys, req.Header.Get("Api-Key"))
+	}
+	return emptyResponse(status), nil
+}
+
+func newTestSpool(t *testing.T, cfg SpoolConfig) (*spool, *fakeAPI, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	cfg.Dir = dir
+	s, err := newSpool("test-spool", cfg)
+	require.NoError(t, err)
+	api := &fakeAPI{}
+	var tc telemetry.Config
+	tc.Client = &http.Client{Transport: api}
+	s.harvesterOpt()(&tc)
+	return s, api, func() { _ = os.RemoveAll(dir) }
+}
+
+func post(t *testing.T, s *spool, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "https://metric-api.newrelic.com/metric/v1", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Api-Key", "secret")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := s.RoundTrip(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func waitReplay(s *spool) {
+	s.mu.Lock()
+	done := s.replayed
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+func TestSpool_ReplaysInOrder(t *testing.T) {
+	s, api, cleanup := newTestSpool(t, SpoolConfig{})
+	defer cleanup()
+
+	api.down = true
+	assert.Equal(t, http.StatusAccepted, post(t, s, "a").StatusCode, "the harvester doesn't retry spooled requests")
+	post(t, s, "b")
+	files, _, err := s.files()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	content, err := ioutil.ReadFile(s.dir + "/" + files[0].Name())
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "secret", "credentials are not written to disk")
+	assert.Contains(t, string(content), "gzip")
+
+	api.down = false
+	post(t, s, "c")
+	waitReplay(s)
+	assert.Equal(t, []string{"c", "a", "b"}, api.accepted)
+	assert.Equal(t, []string{"secret", "secret", "secret"}, api.keys, "replays use the live credentials")
+	files, _, err = s.files()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpool_KeepsFailedReplays(t *testing.T) {
+	s, api, cleanup := newTestSpool(t, SpoolConfig{})
+	defer cleanup()
+
+	api.status = http.StatusServiceUnavailable
+	post(t, s, "a")
+	s.replay(http.Header{})
+	waitReplay(s)
+
+	files, _, err := s.files()
+	require.NoError(t, err)
+	assert.Len(t, files, 1, "the request is kept for the next replay")
+
+	api.mu.Lock()
+	api.status = http.StatusBadRequest
+	api.mu.Unlock()
+	s.replay(http.Header{})
+	waitReplay(s)
+	files, _, err = s.files()
+	require.NoError(t, err)
+	assert.Empty(t, files, "rejected requests are dropped")
+}
+
+func TestSpool_Limits(t *testing.T) {
+	s, api, cleanup := newTestSpool(t, SpoolConfig{MaxAge: time.Hour})
+	defer cleanup()
+	now := time.Unix(1600000000, 0)
+	s.now = func() time.Time { return now }
+	s.maxBytes = 250
+
+	api.down = true
+	post(t, s, "old")
+	now = now.Add(2 * time.Hour)
+	post(t, s, strings.Repeat("a", 100))
+	files, _, err := s.files()
+	require.NoError(t, err)
+	require.Len(t, files, 1, "the requests older than the max age are dropped")
+
+	post(t, s, strings.Repeat("b", 100))
+	files, size, err := s.files()
+	require.NoError(t, err)
+	require.Len(t, files, 1, "the oldest requests beyond the max size are dropped")
+	assert.True(t, size <= s.maxBytes)
+
+	api.down = false
+	post(t, s, "c")
+	waitReplay(s)
+	assert.Equal(t, []string{"c", strings.Repeat("b", 100)}, api.accepted)
+}
+
+func TestSpoolConfig_Validate(t *testing.T) {
+	assert.NoError(t, SpoolConfig{Dir: "/var/spool"}.Validate())
+	assert.Error(t, SpoolConfig{MaxAge: -time.Second}.Validate())
+}
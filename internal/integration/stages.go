@@ -0,0 +1,83 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Pipeline stages that can be disabled.
+const (
+	// StageRules skips the processing rules, except the redaction ones.
+	StageRules = "rules"
+	// StageDecoration skips copying attributes between metrics and adding
+	// the target metadata to them.
+	StageDecoration = "decoration"
+	// StagePercentiles skips the percentiles of histograms and summaries.
+	StagePercentiles = "percentiles"
+	// StageBuckets skips the bucket counts of histograms.
+	StageBuckets = "buckets"
+)
+
+// DisabledStages are the pipeline stages that are skipped, a quick
+// mitigation for incidents without editing the configuration of the
+// stages.
+type DisabledStages struct {
+	Rules       bool
+	Decoration  bool
+	Percentiles bool
+	Buckets     bool
+}
+
+// ParseDisabledStages parses the names of the disabled stages. Values can
+// also be comma separated lists of names.
+func ParseDisabledStages(values []string) (DisabledStages, error) {
+	var d DisabledStages
+	for _, value := range values {
+		for _, stage := range strings.Split(value, ",") {
+			switch strings.TrimSpace(stage) {
+			case "":
+			case StageRules:
+				d.Rules = true
+			case StageDecoration:
+				d.Decoration = true
+			case StagePercentiles:
+				d.Percentiles = true
+			case StageBuckets:
+				d.Buckets = true
+			default:
+				return DisabledStages{}, fmt.Errorf("unknown pipeline stage %q, must be one of %s, %s, %s or %s",
+					stage, StageRules, StageDecoration, StagePercentiles, StageBuckets)
+			}
+		}
+	}
+	return d, nil
+}
+
+// String returns the comma separated names of the disabled stages.
+func (d DisabledStages) String() string {
+	var stages []string
+	for _, s := range []struct {
+		disabled bool
+		name     string
+	}{
+		{d.Rules, StageRules},
+		{d.Decoration, StageDecoration},
+		{d.Percentiles, StagePercentiles},
+		{d.Buckets, StageBuckets},
+	} {
+		if s.disabled {
+			stages = append(stages, s.name)
+		}
+	}
+	return strings.Join(stages, ",")
+}
+
+// WithoutDecoration skips the decoration stage of the processor.
+func WithoutDecoration() ProcessorOption {
+	return func(o *processorOptions) {
+		o.skipDecoration = true
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/metricapitest"
+)
+
+func TestParseDisabledStages(t *testing.T) {
+	d, err := ParseDisabledStages([]string{"percentiles,buckets", " rules "})
+	require.NoError(t, err)
+	assert.Equal(t, DisabledStages{Rules: true, Percentiles: true, Buckets: true}, d)
+	assert.Equal(t, "rules,percentiles,buckets", d.String())
+
+	d, err = ParseDisabledStages(nil)
+	require.NoError(t, err)
+	assert.Equal(t, DisabledStages{}, d)
+
+	_, err = ParseDisabledStages([]string{"percentiles,bucket"})
+	assert.Error(t, err)
+}
+
+func TestRuleProcessor_WithoutDecoration(t *testing.T) {
+	u, err := url.Parse("http://10.0.0.1:9100/metrics")
+	require.NoError(t, err)
+	target := endpoints.New("pod", *u, endpoints.Object{Name: "pod", Kind: "pod", Labels: labels.Set{"namespaceName": "shop"}})
+
+	for _, skip := range []bool{false, true} {
+		input := make(chan TargetMetrics, 1)
+		input <- TargetMetrics{Target: target, Metrics: []Metric{{name: "up", attributes: labels.Set{"job": "node"}}}}
+		close(input)
+
+		var opts []ProcessorOption
+		if skip {
+			opts = append(opts, WithoutDecoration())
+		}
+		pair := <-RuleProcessor(nil, 1, opts...)(input)
+		if skip {
+			assert.Equal(t, labels.Set{"job": "node"}, pair.Metrics[0].attributes)
+		} else {
+			assert.Equal(t, "shop", pair.Metrics[0].attributes["namespaceName"])
+		}
+	}
+}
+
+func TestTelemetryEmitter_DisabledStages(t *testing.T) {
+	hist, err := newHistogram([]int64{1, 2, 3})
+	require.NoError(t, err)
+	summary, err := newSummary(3, 6, []*quantile{{0.5, 2}, {0.99, 3}})
+	require.NoError(t, err)
+	metrics := []Metric{
+		{name: "histogram", metricType: metricType_HISTOGRAM, histogram: hist, attributes: labels.Set{}},
+		{name: "summary", metricType: metricType_SUMMARY, summary: summary, attributes: labels.Set{}},
+	}
+
+	tests := []struct {
+		name     string
+		disabled DisabledStages
+		expected []string
+	}{
+		{"none", DisabledStages{}, []string{"histogram.buckets", "histogram.percentiles", "histogram.sum", "summary.percentiles"}},
+		{"percentiles", DisabledStages{Percentiles: true}, []string{"histogram.buckets", "histogram.sum"}},
+		{"buckets", DisabledStages{Buckets: true}, []string{"histogram.percentiles", "histogram.sum", "summary.percentiles"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := metricapitest.NewServer()
+			defer api.Close()
+			te, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+				HarvesterOpts: []TelemetryHarvesterOpt{
+					telemetry.ConfigAPIKey("api key"),
+					TelemetryHarvesterWithMetricsURL(api.URL),
+					TelemetryHarvesterWithHarvestPeriod(0),
+				},
+				Percentiles:        []float64{50},
+				DisablePercentiles: tt.disabled.Percentiles,
+				DisableBuckets:     tt.disabled.Buckets,
+			})
+			require.NoError(t, err)
+
+			// Counts are sent from the second emission.
+			require.NoError(t, te.Emit(metrics))
+			require.NoError(t, te.Emit(metrics))
+			te.harvester.HarvestNow(context.Background())
+
+			names := map[string]bool{}
+			for _, m := range api.Metrics() {
+				names[m.Name] = true
+			}
+			var sent []string
+			for name := range names {
+				sent = append(sent, name)
+			}
+			assert.ElementsMatch(t, tt.expected, sent)
+		})
+	}
+}
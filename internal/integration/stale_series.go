@@ -0,0 +1,132 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// staleSeriesMetricName is the name of the metric emitted for every series
+// that disappeared, with the marker policy.
+const staleSeriesMetricName = "nr_stats_series_stale"
+
+// StaleSeriesPolicy is what is emitted for the series of a target that
+// disappeared since its previous scrape, so the dashboards don't show their
+// last values flat-lined.
+type StaleSeriesPolicy string
+
+const (
+	// StaleSeriesZero emits the gauges that disappeared once more with a 0
+	// value. The other types of series aren't marked.
+	StaleSeriesZero StaleSeriesPolicy = "zero"
+	// StaleSeriesMarker emits the nr_stats_series_stale gauge, with a 1
+	// value, for every series that disappeared, with its attributes and its
+	// name as the metricName attribute.
+	StaleSeriesMarker StaleSeriesPolicy = "marker"
+)
+
+// ParseStaleSeriesPolicy returns the policy of the name.
+func ParseStaleSeriesPolicy(name string) (StaleSeriesPolicy, error) {
+	switch policy := StaleSeriesPolicy(name); policy {
+	case StaleSeriesZero, StaleSeriesMarker:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown stale series policy %q, expected zero or marker", name)
+	}
+}
+
+// WithStaleSeries emits the series that disappeared from a target with the
+// policy. A series disappears when the target is successfully scraped
+// without it. The failed scrapes, including the ones that failed after some
+// of their chunks, don't mark any series stale, and the series of the
+// targets that are gone are forgotten.
+func WithStaleSeries(policy StaleSeriesPolicy) ExecuteOption {
+	return func(e *execution) {
+		e.stale = newStaleTracker(policy)
+	}
+}
+
+// staleTracker keeps the series of the last scrape of every target.
+type staleTracker struct {
+	policy StaleSeriesPolicy
+	// last are the series of the last complete scrape of the targets, by
+	// series key, and current the ones of the scrape of the current run.
+	last    map[string]map[string]Metric
+	current map[string]map[string]Metric
+}
+
+func newStaleTracker(policy StaleSeriesPolicy) *staleTracker {
+	return &staleTracker{
+		policy:  policy,
+		last:    map[string]map[string]Metric{},
+		current: map[string]map[string]Metric{},
+	}
+}
+
+// observe records the series of the metrics scraped from the target. Once
+// the scrape is complete, i.e. the metrics aren't a partial chunk, it
+// returns the stale metrics of the series of the previous scrape that
+// disappeared.
+func (st *staleTracker) observe(target string, metrics []Metric, partial bool) []Metric {
+	series, ok := st.current[target]
+	if !ok {
+		series = make(map[string]Metric, len(metrics))
+		st.current[target] = series
+	}
+	for i := range metrics {
+		m := &metrics[i]
+		series[seriesKey(m)] = Metric{name: m.name, metricType: m.metricType, attributes: m.attributes}
+	}
+	if partial {
+		return nil
+	}
+	stale := st.staleMetrics(st.last[target], series)
+	st.last[target] = series
+	delete(st.current, target)
+	return stale
+}
+
+// endRun discards the series of the scrapes that didn't complete in the run,
+// keeping the last ones of their targets, so their next successful scrape is
+// compared to them, and forgets the series of the targets that are gone.
+func (st *staleTracker) endRun(targets []endpoints.Target) {
+	discovered := make(map[string]bool, len(targets))
+	for i := range targets {
+		discovered[targets[i].Name] = true
+	}
+	for target := range st.last {
+		if !discovered[target] {
+			delete(st.last, target)
+		}
+	}
+	st.current = map[string]map[string]Metric{}
+}
+
+// staleMetrics returns the stale metrics of the last series missing from the
+// current ones.
+func (st *staleTracker) staleMetrics(last, current map[string]Metric) []Metric {
+	var stale []Metric
+	for key, m := range last {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		switch st.policy {
+		case StaleSeriesZero:
+			if m.metricType != metricType_GAUGE {
+				continue
+			}
+			stale = append(stale, Metric{name: m.name, metricType: metricType_GAUGE, attributes: m.attributes})
+		case StaleSeriesMarker:
+			attrs := make(labels.Set, len(m.attributes)+2)
+			labels.Accumulate(attrs, m.attributes)
+			attrs["metricName"] = m.name
+			attrs["nrMetricType"] = string(metricType_GAUGE)
+			stale = append(stale, Metric{name: staleSeriesMetricName, value: 1, metricType: metricType_GAUGE, attributes: attrs})
+		}
+	}
+	return stale
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func staleMetrics(pods ...string) []Metric {
+	metrics := []Metric{
+		{name: "requests_total", value: 10, metricType: metricType_COUNTER, attributes: labels.Set{"path": "/"}},
+	}
+	for _, pod := range pods {
+		metrics = append(metrics, Metric{name: "pod_ready", value: 1, metricType: metricType_GAUGE, attributes: labels.Set{"pod": pod}})
+	}
+	return metrics
+}
+
+func TestParseStaleSeriesPolicy(t *testing.T) {
+	policy, err := ParseStaleSeriesPolicy("marker")
+	require.NoError(t, err)
+	assert.Equal(t, StaleSeriesMarker, policy)
+	_, err = ParseStaleSeriesPolicy("nan")
+	assert.Error(t, err)
+}
+
+func staleTargets(names ...string) []endpoints.Target {
+	targets := make([]endpoints.Target, len(names))
+	for i, name := range names {
+		targets[i] = endpoints.Target{Name: name}
+	}
+	return targets
+}
+
+func TestStaleTracker_Zero(t *testing.T) {
+	st := newStaleTracker(StaleSeriesZero)
+
+	assert.Empty(t, st.observe("target", staleMetrics("a", "b"), false), "there's no previous scrape")
+	st.endRun(staleTargets("target"))
+
+	stale := st.observe("target", staleMetrics("a", "c"), false)
+	require.Len(t, stale, 1, "the counters aren't marked")
+	assert.Equal(t, Metric{name: "pod_ready", metricType: metricType_GAUGE, attributes: labels.Set{"pod": "b"}}, stale[0])
+	assert.Empty(t, st.observe("other", staleMetrics(), false), "the series are kept by target")
+	st.endRun(staleTargets("target", "other"))
+
+	st.endRun(staleTargets("target"))
+	assert.NotContains(t, st.last, "other", "the series of the targets that are gone are forgotten")
+	assert.Contains(t, st.last, "target")
+}
+
+func TestStaleTracker_FailedScrape(t *testing.T) {
+	st := newStaleTracker(StaleSeriesZero)
+	st.observe("target", staleMetrics("a", "b"), false)
+	st.endRun(staleTargets("target"))
+
+	// The scrape failed: the target isn't scraped in the run.
+	st.endRun(staleTargets("target"))
+	// The scrape failed after its first chunk.
+	assert.Empty(t, st.observe("target", staleMetrics("a")[:1], true))
+	st.endRun(staleTargets("target"))
+
+	stale := st.observe("target", staleMetrics("a"), false)
+	require.Len(t, stale, 1, "only the next successful scrape marks the series stale")
+	assert.Equal(t, labels.Set{"pod": "b"}, stale[0].attributes)
+}
+
+func TestStaleTracker_Marker(t *testing.T) {
+	st := newStaleTracker(StaleSeriesMarker)
+
+	st.observe("target", staleMetrics("a", "b"), false)
+	st.endRun(staleTargets("target"))
+
+	assert.Empty(t, st.observe("target", staleMetrics("a"), true), "the series of the chunks are accumulated")
+	stale := st.observe("target", []Metric{}, false)
+	require.Len(t, stale, 1)
+	assert.Equal(t, Metric{
+		name:       staleSeriesMetricName,
+		value:      1,
+		metricType: metricType_GAUGE,
+		attributes: labels.Set{"pod": "b", "metricName": "pod_ready", "nrMetricType": "gauge"},
+	}, stale[0])
+	st.endRun(staleTargets("target"))
+
+	stale = st.observe("target", staleMetrics(), false)
+	assert.ElementsMatch(t, []string{"pod_ready"}, metricNames(stale))
+}
+
+func metricNames(metrics []Metric) []string {
+	var names []string
+	for _, m := range metrics {
+		names = append(names, m.attributes["metricName"].(string))
+	}
+	return names
+}
@@ -0,0 +1,343 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// StaticMetric is a gauge declared in the configuration, emitted every
+// harvest, like a deployment marker or a feature flag.
+type StaticMetric struct {
+	// Name of the metric.
+	Name string `mapstructure:"name"`
+	// Value of the metric, unless an expression is set.
+	Value float64 `mapstructure:"value"`
+	// Expression evaluated every harvest for the value of the metric. It
+	// supports numbers, +, -, *, /, parentheses and the functions now(),
+	// the current Unix time in seconds, start_time(), the Unix time the
+	// integration started, and env("NAME"), the numeric value of an
+	// environment variable.
+	Expression string `mapstructure:"expression"`
+	// Attributes of the metric.
+	Attributes map[string]interface{} `mapstructure:"attributes"`
+}
+
+// staticMetric is a StaticMetric with its expression parsed.
+type staticMetric struct {
+	name  string
+	value expression
+	attrs labels.Set
+}
+
+// StaticMetrics emits the static metrics of the configuration.
+type StaticMetrics struct {
+	metrics []staticMetric
+	start   time.Time
+	now     func() time.Time
+	getenv  func(string) string
+}
+
+// NewStaticMetrics parses the static metrics of the configuration. It fails
+// if a metric has no name or its expression is invalid.
+func NewStaticMetrics(cfg []StaticMetric) (*StaticMetrics, error) {
+	sm := &StaticMetrics{
+		start:  time.Now(),
+		now:    time.Now,
+		getenv: os.Getenv,
+	}
+	for _, m := range cfg {
+		if m.Name == "" {
+			return nil, fmt.Errorf("static metrics require a name")
+		}
+		value := constant(m.Value)
+		if m.Expression != "" {
+			var err error
+			value, err = parseExpression(m.Expression)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expression of static metric %s: %w", m.Name, err)
+			}
+		}
+		attrs := labels.Set{"nrMetricType": string(metricType_GAUGE)}
+		labels.Accumulate(attrs, m.Attributes)
+		sm.metrics = append(sm.metrics, staticMetric{name: m.Name, value: value, attrs: attrs})
+	}
+	return sm, nil
+}
+
+// WithStaticMetrics emits the static metrics every harvest.
+func WithStaticMetrics(sm *StaticMetrics) ExecuteOption {
+	return func(e *execution) {
+		e.static = sm
+	}
+}
+
+// harvest returns the static metrics with their expressions evaluated. The
+// metrics whose expression fails, like an unset environment variable, are
+// skipped.
+func (sm *StaticMetrics) harvest() []Metric {
+	ctx := evalContext{now: sm.now(), start: sm.start, getenv: sm.getenv}
+	metrics := make([]Metric, 0, len(sm.metrics))
+	for _, m := range sm.metrics {
+		value, err := m.value(ctx)
+		if err != nil {
+			ilog.WithError(err).WithField("metric", m.name).Warn("evaluating static metric")
+			continue
+		}
+		attrs := make(labels.Set, len(m.attrs))
+		labels.Accumulate(attrs, m.attrs)
+		metrics = append(metrics, Metric{
+			name:       m.name,
+			value:      value,
+			metricType: metricType_GAUGE,
+			attributes: attrs,
+		})
+	}
+	return metrics
+}
+
+// evalContext holds the values of the functions of the expressions.
+type evalContext struct {
+	now    time.Time
+	start  time.Time
+	getenv func(string) string
+}
+
+// expression is a parsed static metric expression.
+type expression func(ctx evalContext) (float64, error)
+
+func constant(v float64) expression {
+	return func(evalContext) (float64, error) {
+		return v, nil
+	}
+}
+
+// exprParser is a recursive descent parser of the expressions:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | "(" expr ")" | ident "(" [ string ] ")"
+type exprParser struct {
+	src string
+	pos int
+}
+
+func parseExpression(src string) (expression, error) {
+	p := &exprParser{src: src}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes the next character if it's c.
+func (p *exprParser) accept(c byte) bool {
+	p.skipSpaces()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(c byte) error {
+	if !p.accept(c) {
+		return fmt.Errorf("expected %q at position %d", c, p.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) expr() (expression, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('+'):
+			op = '+'
+		case p.accept('-'):
+			op = '-'
+		default:
+			return left, nil
+		}
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binary(op, left, right)
+	}
+}
+
+func (p *exprParser) term() (expression, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('*'):
+			op = '*'
+		case p.accept('/'):
+			op = '/'
+		default:
+			return left, nil
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binary(op, left, right)
+	}
+}
+
+func (p *exprParser) unary() (expression, error) {
+	if p.accept('-') {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx evalContext) (float64, error) {
+			v, err := operand(ctx)
+			return -v, err
+		}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (expression, error) {
+	if p.accept('(') {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(')')
+	}
+	p.skipSpaces()
+	start := p.pos
+	if p.pos < len(p.src) && (isDigit(p.src[p.pos]) || p.src[p.pos] == '.') {
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			exponentSign := (c == '+' || c == '-') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')
+			if !isDigit(c) && c != '.' && c != 'e' && c != 'E' && !exponentSign {
+				break
+			}
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+		}
+		return constant(v), nil
+	}
+	for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos]))) {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.src) {
+			return nil, fmt.Errorf("unexpected end of expression")
+		}
+		return nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos], p.pos)
+	}
+	return p.call(p.src[start:p.pos])
+}
+
+// call parses the arguments of the function.
+func (p *exprParser) call(name string) (expression, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	switch name {
+	case "now":
+		return func(ctx evalContext) (float64, error) {
+			return float64(ctx.now.UnixNano()) / float64(time.Second), nil
+		}, p.expect(')')
+	case "start_time":
+		return func(ctx evalContext) (float64, error) {
+			return float64(ctx.start.UnixNano()) / float64(time.Second), nil
+		}, p.expect(')')
+	case "env":
+		variable, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx evalContext) (float64, error) {
+			value := strings.TrimSpace(ctx.getenv(variable))
+			if value == "" {
+				return 0, fmt.Errorf("environment variable %s is not set", variable)
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, fmt.Errorf("environment variable %s is not a number: %q", variable, value)
+			}
+			return v, nil
+		}, p.expect(')')
+	default:
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+}
+
+// string parses a double quoted string without escapes.
+func (p *exprParser) string() (string, error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+	end := strings.IndexByte(p.src[p.pos:], '"')
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string at position %d", p.pos)
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
+
+func binary(op byte, left, right expression) expression {
+	return func(ctx evalContext) (float64, error) {
+		l, err := left(ctx)
+		if err != nil {
+			return 0, err
+		}
+		r, err := right(ctx)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '+':
+			return l + r, nil
+		case '-':
+			return l - r, nil
+		case '*':
+			return l * r, nil
+		default:
+			if r == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		}
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestParseExpression(t *testing.T) {
+	ctx := evalContext{
+		now:   time.Unix(1600000100, 0),
+		start: time.Unix(1600000000, 0),
+		getenv: func(name string) string {
+			return map[string]string{"REPLICAS": "3", "NAME": "shop"}[name]
+		},
+	}
+	for expr, expected := range map[string]float64{
+		"42":                     42,
+		"1.5e3":                  1500,
+		"-2 + 3 * 4":             10,
+		"(1 + 2) * 3":            9,
+		"10 / 4 - 1":             1.5,
+		"--1":                    1,
+		"now() - start_time()":   100,
+		`env("REPLICAS") * 2`:    6,
+		` env( "REPLICAS" ) / 3`: 1,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			e, err := parseExpression(expr)
+			require.NoError(t, err)
+			v, err := e(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, expected, v)
+		})
+	}
+
+	for _, expr := range []string{"", "1 +", "(1", "1 2", "foo()", "now(", `env(NAME)`, `env("NAME`, "1..2", "*"} {
+		_, err := parseExpression(expr)
+		assert.Error(t, err, expr)
+	}
+
+	for _, expr := range []string{`env("NAME")`, `env("UNSET")`, "1 / (now() - now())"} {
+		e, err := parseExpression(expr)
+		require.NoError(t, err)
+		_, err = e(ctx)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestStaticMetrics(t *testing.T) {
+	_, err := NewStaticMetrics([]StaticMetric{{Value: 1}})
+	assert.Error(t, err, "static metrics require a name")
+	_, err = NewStaticMetrics([]StaticMetric{{Name: "a", Expression: "1 +"}})
+	assert.Error(t, err)
+
+	sm, err := NewStaticMetrics([]StaticMetric{
+		{Name: "deployment_info", Value: 1, Attributes: map[string]interface{}{"release": "2020.10.1"}},
+		{Name: "feature_flag", Expression: `env("FLAG")`},
+		{Name: "uptime_seconds", Expression: "now() - start_time()"},
+	})
+	require.NoError(t, err)
+	sm.start = time.Unix(1600000000, 0)
+	sm.now = func() time.Time { return time.Unix(1600000060, 0) }
+	sm.getenv = func(string) string { return "" }
+
+	metrics := sm.harvest()
+	require.Len(t, metrics, 2, "the metrics whose expression fails are skipped")
+	assert.Equal(t, Metric{
+		name:       "deployment_info",
+		value:      1.0,
+		metricType: metricType_GAUGE,
+		attributes: labels.Set{"release": "2020.10.1", "nrMetricType": "gauge"},
+	}, metrics[0])
+	assert.Equal(t, "uptime_seconds", metrics[1].name)
+	assert.Equal(t, 60.0, metrics[1].value)
+
+	sm.getenv = func(string) string { return "1" }
+	metrics = sm.harvest()
+	require.Len(t, metrics, 3)
+	assert.Equal(t, 1.0, metrics[1].value)
+}
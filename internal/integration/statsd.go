@@ -0,0 +1,338 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsdUnixPrefix = "unix://"
+	// defaultStatsdUDPPacketSize fits the datagrams in the usual MTU.
+	defaultStatsdUDPPacketSize  = 1432
+	defaultStatsdUnixPacketSize = 8192
+	statsdWriteTimeout          = time.Second
+	// statsdStateExpiration is how long the last values of the counters and
+	// histograms not emitted anymore are kept.
+	statsdStateExpiration = 10 * time.Minute
+)
+
+// statsdReplacer replaces the characters of the DogStatsD protocol in the
+// metric names and tags.
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_")
+
+// StatsdConfig configures the StatsdEmitter.
+type StatsdConfig struct {
+	// Address of the DogStatsD server, host:port for UDP or
+	// unix:///path/to/socket for a Unix domain socket.
+	Address string `mapstructure:"address"`
+	// Prefix of the metric names, separated by a dot.
+	Prefix string `mapstructure:"prefix"`
+	// TagMapping maps attribute keys to tag names. The attributes not mapped
+	// are sent with their key as tag name, unless OnlyMappedTags is set.
+	TagMapping     map[string]string `mapstructure:"tag_mapping"`
+	OnlyMappedTags bool              `mapstructure:"only_mapped_tags"`
+	// ConstantTags are added to all the metrics, like env:prod.
+	ConstantTags []string `mapstructure:"constant_tags"`
+	// Distributions sends the histograms as distributions, aggregated by
+	// Datadog, instead of histograms aggregated by the agent.
+	Distributions bool `mapstructure:"distributions"`
+	// MaxPacketSize of the datagrams. Defaults to 1432 bytes over UDP and
+	// 8192 over a Unix domain socket.
+	MaxPacketSize int `mapstructure:"max_packet_size"`
+}
+
+// network returns the network and the address of the server.
+func (c StatsdConfig) network() (string, string) {
+	if strings.HasPrefix(c.Address, statsdUnixPrefix) {
+		return "unixgram", strings.TrimPrefix(c.Address, statsdUnixPrefix)
+	}
+	return "udp", c.Address
+}
+
+// Validate returns an error if the address is not valid.
+func (c StatsdConfig) Validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("the statsd emitter requires a statsd.address")
+	}
+	network, address := c.network()
+	if network == "unixgram" && address == "" {
+		return fmt.Errorf("invalid statsd address %q, the socket path is missing", c.Address)
+	}
+	if network == "udp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("invalid statsd address %q: %w", c.Address, err)
+		}
+	}
+	if c.MaxPacketSize < 0 {
+		return fmt.Errorf("the statsd max_packet_size can't be negative")
+	}
+	return nil
+}
+
+// statsdState is the last value of a counter, or the cumulative bucket
+// counts of a histogram.
+type statsdState struct {
+	values []float64
+	seen   time.Time
+}
+
+// StatsdEmitter sends the metrics to a DogStatsD server, like the Datadog
+// agent or a local statsd aggregator. Gauges are sent as gauges, counters as
+// counts of their increase since the last emission, and the samples of the
+// histogram buckets since the last emission as histogram or distribution
+// values, with the bucket upper bound as value and the number of samples as
+// sample rate. The quantiles of the summaries are sent as gauges with a
+// quantile tag. The attributes are sent as tags.
+type StatsdEmitter struct {
+	name           string
+	network        string
+	address        string
+	prefix         string
+	tagMapping     map[string]string
+	onlyMappedTags bool
+	constantTags   []string
+	histogramType  string
+	maxPacketSize  int
+	now            func() time.Time
+
+	mu    sync.Mutex
+	conn  net.Conn
+	state map[string]*statsdState
+}
+
+// NewStatsdEmitter returns a StatsdEmitter of the configuration. The server
+// doesn't need to be up, the connection is retried on every emission.
+func NewStatsdEmitter(cfg StatsdConfig) (*StatsdEmitter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	network, address := cfg.network()
+	se := &StatsdEmitter{
+		name:           "statsd",
+		network:        network,
+		address:        address,
+		prefix:         cfg.Prefix,
+		tagMapping:     cfg.TagMapping,
+		onlyMappedTags: cfg.OnlyMappedTags,
+		constantTags:   cfg.ConstantTags,
+		histogramType:  "h",
+		maxPacketSize:  cfg.MaxPacketSize,
+		now:            time.Now,
+		state:          map[string]*statsdState{},
+	}
+	if se.prefix != "" && !strings.HasSuffix(se.prefix, ".") {
+		se.prefix += "."
+	}
+	if cfg.Distributions {
+		se.histogramType = "d"
+	}
+	if se.maxPacketSize == 0 {
+		se.maxPacketSize = defaultStatsdUDPPacketSize
+		if network == "unixgram" {
+			se.maxPacketSize = defaultStatsdUnixPacketSize
+		}
+	}
+	return se, nil
+}
+
+// Name is the StatsdEmitter name.
+func (se *StatsdEmitter) Name() string {
+	return se.name
+}
+
+// Emit sends the metrics in datagrams of up to the maximum packet size.
+func (se *StatsdEmitter) Emit(metrics []Metric) error {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	now := se.now()
+	var lines []string
+	for _, m := range metrics {
+		lines = se.appendLines(lines, m, now)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if se.conn == nil {
+		conn, err := net.DialTimeout(se.network, se.address, statsdWriteTimeout)
+		if err != nil {
+			return fmt.Errorf("connecting to statsd: %w", err)
+		}
+		se.conn = conn
+	}
+	_ = se.conn.SetWriteDeadline(now.Add(statsdWriteTimeout))
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > se.maxPacketSize {
+			if err := se.write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return se.write(packet.Bytes())
+}
+
+// write sends a datagram, closing the connection if it fails so the next
+// emission reconnects, e.g. to a recreated socket.
+func (se *StatsdEmitter) write(packet []byte) error {
+	if _, err := se.conn.Write(packet); err != nil {
+		_ = se.conn.Close()
+		se.conn = nil
+		return fmt.Errorf("writing metrics to statsd: %w", err)
+	}
+	return nil
+}
+
+// endHarvest forgets the values of the counters and histograms not emitted
+// for a while.
+func (se *StatsdEmitter) endHarvest() {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	expired := se.now().Add(-statsdStateExpiration)
+	for key, s := range se.state {
+		if s.seen.Before(expired) {
+			delete(se.state, key)
+		}
+	}
+}
+
+// appendLines appends the lines of the metric.
+func (se *StatsdEmitter) appendLines(lines []string, m Metric, now time.Time) []string {
+	name := se.prefix + statsdReplacer.Replace(m.name)
+	tags := se.tags(m.attributes)
+
+	switch m.metricType {
+	case metricType_GAUGE:
+		lines = appendStatsdLine(lines, name, m.value, "g", 1, tags)
+	case metricType_COUNTER:
+		if deltas := se.deltas(name, tags, now, []float64{m.value}); deltas != nil {
+			lines = appendStatsdLine(lines, name, deltas[0], "c", 1, tags)
+		}
+	case metricType_SUMMARY:
+		if m.summary == nil {
+			return lines
+		}
+		for _, q := range m.summary.GetQuantile() {
+			lines = appendStatsdLine(lines, name, q.GetValue(), "g", 1,
+				append(tags[:len(tags):len(tags)], "quantile:"+formatFloat(q.GetQuantile())))
+		}
+	case metricType_HISTOGRAM:
+		if m.histogram == nil {
+			return lines
+		}
+		buckets := m.histogram.GetBucket()
+		counts := make([]float64, 0, len(buckets)+1)
+		bounds := make([]float64, 0, len(buckets)+1)
+		for _, b := range buckets {
+			counts = append(counts, float64(b.GetCumulativeCount()))
+			bounds = append(bounds, b.GetUpperBound())
+		}
+		if len(bounds) == 0 || !math.IsInf(bounds[len(bounds)-1], 1) {
+			counts = append(counts, float64(m.histogram.GetSampleCount()))
+			bounds = append(bounds, math.Inf(1))
+		}
+		deltas := se.deltas(name, tags, now, counts)
+		var previous float64
+		for i, cumulative := range deltas {
+			samples := cumulative - previous
+			previous = cumulative
+			if samples <= 0 {
+				continue
+			}
+			value := bounds[i]
+			if math.IsInf(value, 1) {
+				// The samples above the last bound are sent as the
+				// last bound.
+				if i == 0 {
+					continue
+				}
+				value = bounds[i-1]
+			}
+			lines = appendStatsdLine(lines, name, value, se.histogramType, 1/samples, tags)
+		}
+	}
+	return lines
+}
+
+// deltas returns the increase of the values since the last emission of the
+// series, or nil the first time it's seen. If any value decreased, the
+// series was reset and the values are returned as is.
+func (se *StatsdEmitter) deltas(name string, tags []string, now time.Time, values []float64) []float64 {
+	key := name + "|" + strings.Join(tags, ",")
+	s, ok := se.state[key]
+	if !ok || len(s.values) != len(values) {
+		se.state[key] = &statsdState{values: values, seen: now}
+		return nil
+	}
+	deltas := make([]float64, len(values))
+	for i, v := range values {
+		if v < s.values[i] {
+			deltas = values
+			break
+		}
+		deltas[i] = v - s.values[i]
+	}
+	s.values = values
+	s.seen = now
+	return deltas
+}
+
+// tags returns the tags of the attributes, sorted, followed by the constant
+// tags.
+func (se *StatsdEmitter) tags(attrs map[string]interface{}) []string {
+	tags := make([]string, 0, len(attrs)+len(se.constantTags))
+	for k, v := range attrs {
+		if remoteWriteSkippedAttributes[k] {
+			continue
+		}
+		tag, ok := se.tagMapping[k]
+		if !ok {
+			if se.onlyMappedTags {
+				continue
+			}
+			tag = k
+		}
+		tags = append(tags, statsdReplacer.Replace(tag)+":"+statsdReplacer.Replace(fmt.Sprint(v)))
+	}
+	sort.Strings(tags)
+	return append(tags, se.constantTags...)
+}
+
+// appendStatsdLine appends the DogStatsD line of the value, unless it's not a
+// number.
+func appendStatsdLine(lines []string, name string, value float64, metricType string, rate float64, tags []string) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return lines
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(metricType)
+	if rate < 1 {
+		b.WriteString("|@")
+		b.WriteString(strconv.FormatFloat(rate, 'g', -1, 64))
+	}
+	if len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(tags, ","))
+	}
+	return append(lines, b.String())
+}
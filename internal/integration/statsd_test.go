@@ -0,0 +1,110 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mpb "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestStatsdConfig_Validate(t *testing.T) {
+	assert.NoError(t, StatsdConfig{Address: "127.0.0.1:8125"}.Validate())
+	assert.NoError(t, StatsdConfig{Address: "unix:///var/run/datadog/dsd.socket"}.Validate())
+	assert.Error(t, StatsdConfig{}.Validate())
+	assert.Error(t, StatsdConfig{Address: "localhost"}.Validate())
+	assert.Error(t, StatsdConfig{Address: "unix://"}.Validate())
+	assert.Error(t, StatsdConfig{Address: "127.0.0.1:8125", MaxPacketSize: -1}.Validate())
+}
+
+// statsdHistogram returns a histogram with buckets of upper bounds 1, 2, ...
+// and the given cumulative counts.
+func statsdHistogram(count uint64, cumulative ...uint64) *mpb.Histogram {
+	h := &mpb.Histogram{SampleCount: &count}
+	for i := range cumulative {
+		bound := float64(i + 1)
+		h.Bucket = append(h.Bucket, &mpb.Bucket{CumulativeCount: &cumulative[i], UpperBound: &bound})
+	}
+	return h
+}
+
+func TestStatsdEmitter(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	se, err := NewStatsdEmitter(StatsdConfig{
+		Address:      server.LocalAddr().String(),
+		Prefix:       "prom",
+		TagMapping:   map[string]string{"namespaceName": "kube_namespace"},
+		ConstantTags: []string{"env:test"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "statsd", se.Name())
+
+	summary, err := newSummary(3, 6, []*quantile{{0.5, 2}})
+	require.NoError(t, err)
+	attrs := labels.Set{"namespaceName": "shop", "nrMetricType": "gauge", "path": "/a,b"}
+	emit := func(counter float64, histogram *mpb.Histogram) []string {
+		require.NoError(t, se.Emit([]Metric{
+			{name: "temperature", metricType: metricType_GAUGE, value: 21.5, attributes: attrs},
+			{name: "requests_total", metricType: metricType_COUNTER, value: counter, attributes: attrs},
+			{name: "latency", metricType: metricType_SUMMARY, summary: summary, attributes: labels.Set{}},
+			{name: "duration", metricType: metricType_HISTOGRAM, histogram: histogram, attributes: labels.Set{}},
+		}))
+		buf := make([]byte, 65536)
+		require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := server.ReadFrom(buf)
+		require.NoError(t, err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	assert.Equal(t, []string{
+		"prom.temperature:21.5|g|#kube_namespace:shop,path:/a_b,env:test",
+		"prom.latency:2|g|#env:test,quantile:0.5",
+	}, emit(10, statsdHistogram(4, 1, 3)), "counters and histograms start on the second emission")
+
+	assert.Equal(t, []string{
+		"prom.temperature:21.5|g|#kube_namespace:shop,path:/a_b,env:test",
+		"prom.requests_total:5|c|#kube_namespace:shop,path:/a_b,env:test",
+		"prom.latency:2|g|#env:test,quantile:0.5",
+		"prom.duration:2|h|@0.5|#env:test",
+		"prom.duration:2|h|#env:test",
+	}, emit(15, statsdHistogram(7, 1, 5)), "the samples above the last bound are sent as the last bound")
+
+	assert.Contains(t, emit(3, statsdHistogram(7, 1, 5)),
+		"prom.requests_total:3|c|#kube_namespace:shop,path:/a_b,env:test", "the counter was reset")
+
+	se.now = func() time.Time { return time.Now().Add(statsdStateExpiration + time.Minute) }
+	se.endHarvest()
+	assert.Empty(t, se.state)
+}
+
+func TestStatsdEmitter_Packets(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	se, err := NewStatsdEmitter(StatsdConfig{Address: server.LocalAddr().String(), MaxPacketSize: 16, OnlyMappedTags: true})
+	require.NoError(t, err)
+	var metrics []Metric
+	for i := 0; i < 3; i++ {
+		metrics = append(metrics, Metric{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"job": "node"}})
+	}
+	require.NoError(t, se.Emit(metrics))
+
+	buf := make([]byte, 1024)
+	for _, expected := range []string{"up:1|g\nup:1|g", "up:1|g"} {
+		require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := server.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+	}
+}
@@ -0,0 +1,140 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stdout emitter formats.
+const (
+	// StdoutFormatJSON writes the metrics of every emission as a JSON array.
+	StdoutFormatJSON = "json"
+	// StdoutFormatNDJSON writes a JSON object per metric and line, for
+	// streaming consumers.
+	StdoutFormatNDJSON = "ndjson"
+	// StdoutFormatPretty writes the metrics of every emission as an
+	// indented JSON array.
+	StdoutFormatPretty = "pretty"
+	// StdoutFormatPromText writes the metrics in the Prometheus text
+	// exposition format, so they can be re-scraped.
+	StdoutFormatPromText = "prom-text"
+)
+
+// ValidateStdoutFormat returns an error if the format is not one of the
+// stdout emitter formats. An empty format is json.
+func ValidateStdoutFormat(format string) error {
+	switch format {
+	case "", StdoutFormatJSON, StdoutFormatNDJSON, StdoutFormatPretty, StdoutFormatPromText:
+		return nil
+	default:
+		return fmt.Errorf("invalid stdout format %q, must be %s, %s, %s or %s",
+			format, StdoutFormatJSON, StdoutFormatNDJSON, StdoutFormatPretty, StdoutFormatPromText)
+	}
+}
+
+// writeRecords writes the records of the metrics as JSON, with the given
+// timestamp for the metrics without one.
+func writeRecords(w io.Writer, metrics []Metric, now time.Time, format string) error {
+	records := make([]metricRecord, 0, len(metrics))
+	for _, m := range metrics {
+		timestamp := now
+		if !m.timestamp.IsZero() {
+			timestamp = m.timestamp
+		}
+		records = append(records, newMetricRecord(m, timestamp))
+	}
+
+	switch format {
+	case StdoutFormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case StdoutFormatPretty:
+		b, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	default:
+		b, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+}
+
+// writePromText writes the metrics in the Prometheus text format, preceded
+// by a TYPE line the first time every metric name is written in the call.
+// Summaries and histograms are written as their quantile, bucket, sum and
+// count series. Only the metrics with their own timestamp are written with
+// it.
+func writePromText(w io.Writer, metrics []Metric) error {
+	bw := bufio.NewWriter(w)
+	typed := map[string]bool{}
+	for _, m := range metrics {
+		name := sanitizeLabelName(m.name)
+		if !typed[name] {
+			typed[name] = true
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, promTextType(m.metricType))
+		}
+		timestamp := ""
+		if !m.timestamp.IsZero() {
+			timestamp = " " + strconv.FormatInt(m.timestamp.UnixNano()/int64(time.Millisecond), 10)
+		}
+		m.name = name
+		for _, s := range remoteWriteSeries([]Metric{m}, time.Time{}) {
+			var labels []string
+			seriesName := ""
+			for _, l := range s.Labels {
+				if l.Name == "__name__" {
+					seriesName = l.Value
+					continue
+				}
+				labels = append(labels, l.Name+`="`+escapeLabelValue(l.Value)+`"`)
+			}
+			bw.WriteString(seriesName)
+			if len(labels) > 0 {
+				bw.WriteString("{" + strings.Join(labels, ",") + "}")
+			}
+			fmt.Fprintf(bw, " %s%s\n", formatFloat(s.Samples[0].Value), timestamp)
+		}
+	}
+	return bw.Flush()
+}
+
+// promTextType returns the Prometheus type of the metric type.
+func promTextType(t metricType) string {
+	switch t {
+	case metricType_COUNTER:
+		return "counter"
+	case metricType_SUMMARY:
+		return "summary"
+	case metricType_HISTOGRAM:
+		return "histogram"
+	default:
+		return "gauge"
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue escapes the backslashes, double quotes and line feeds of
+// the label values.
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
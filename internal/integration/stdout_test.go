@@ -0,0 +1,76 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func stdoutTestMetrics(t *testing.T) []Metric {
+	summary, err := newSummary(3, 6, []*quantile{{0.5, 2}})
+	require.NoError(t, err)
+	return []Metric{
+		{name: "up", metricType: metricType_GAUGE, value: 1, attributes: labels.Set{"job": "node", "nrMetricType": "gauge"}},
+		{name: "up", metricType: metricType_GAUGE, value: 0, attributes: labels.Set{"job": "api", "path": `C:\"tmp"`}},
+		{name: "http.requests", metricType: metricType_COUNTER, value: 5, attributes: labels.Set{},
+			timestamp: time.Unix(1600000000, 0)},
+		{name: "latency", metricType: metricType_SUMMARY, summary: summary, attributes: labels.Set{}},
+	}
+}
+
+func TestStdoutEmitter_Formats(t *testing.T) {
+	_, err := NewStdoutEmitterWithFormat("yaml")
+	assert.Error(t, err)
+
+	now := time.Unix(1700000000, 0).UTC()
+	emit := func(format string) string {
+		se, err := NewStdoutEmitterWithFormat(format)
+		require.NoError(t, err)
+		var out bytes.Buffer
+		se.w = &out
+		se.now = func() time.Time { return now }
+		require.NoError(t, se.Emit(stdoutTestMetrics(t)))
+		return out.String()
+	}
+
+	var records []metricRecord
+	out := emit("")
+	require.NoError(t, json.Unmarshal([]byte(out), &records))
+	require.Len(t, records, 4)
+	assert.Equal(t, "up", records[0].Name)
+	assert.Equal(t, "node", records[0].Attributes["job"])
+	assert.Equal(t, now, records[0].Timestamp.UTC())
+	assert.Equal(t, 1, strings.Count(out, "\n"))
+
+	pretty := emit(StdoutFormatPretty)
+	assert.Greater(t, strings.Count(pretty, "\n"), 4)
+	require.NoError(t, json.Unmarshal([]byte(pretty), &records))
+	assert.Len(t, records, 4)
+
+	lines := strings.Split(strings.TrimSpace(emit(StdoutFormatNDJSON)), "\n")
+	require.Len(t, lines, 4, "a line per metric")
+	var record metricRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &record))
+	assert.Equal(t, "http.requests", record.Name)
+	assert.Equal(t, time.Unix(1600000000, 0), record.Timestamp.Local())
+
+	assert.Equal(t, `# TYPE up gauge
+up{job="node"} 1
+up{job="api",path="C:\\\"tmp\""} 0
+# TYPE http_requests counter
+http_requests 5 1600000000000
+# TYPE latency summary
+latency{quantile="0.5"} 2
+latency_sum 6
+latency_count 3
+`, emit(StdoutFormatPromText))
+}
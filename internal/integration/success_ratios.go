@@ -0,0 +1,155 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ratioBuckets is the number of buckets the shortest window is split in. The
+// ratios move forward one bucket at a time.
+const ratioBuckets = 60
+
+var (
+	scrapeSuccessRatioDesc = prometheus.NewDesc(
+		"nr_stats_integration_scrape_success_ratio",
+		"Fraction of the scheduled scrapes that completed successfully within the window",
+		[]string{"window"}, nil,
+	)
+	harvestSuccessRatioDesc = prometheus.NewDesc(
+		"nr_stats_integration_harvest_success_ratio",
+		"Fraction of the harvest requests to New Relic delivered within the window",
+		[]string{"window"}, nil,
+	)
+)
+
+// SuccessRatios tracks the fraction of successful scrapes and harvest
+// requests over rolling windows, the indicators of an SLO on the metrics
+// pipeline. It is a prometheus.Collector exposing them as
+// nr_stats_integration_scrape_success_ratio and
+// nr_stats_integration_harvest_success_ratio, labelled by window. No ratio
+// is exposed for a window without any scrape or harvest.
+type SuccessRatios struct {
+	windows  []time.Duration
+	scrapes  *rollingRatio
+	harvests *rollingRatio
+	now      func() time.Time
+}
+
+// NewSuccessRatios returns the SuccessRatios for the given windows.
+func NewSuccessRatios(windows ...time.Duration) *SuccessRatios {
+	var shortest, longest time.Duration
+	for _, w := range windows {
+		if shortest == 0 || w < shortest {
+			shortest = w
+		}
+		if w > longest {
+			longest = w
+		}
+	}
+	resolution := shortest / ratioBuckets
+	if resolution < time.Second {
+		resolution = time.Second
+	}
+	return &SuccessRatios{
+		windows:  windows,
+		scrapes:  &rollingRatio{resolution: resolution, retention: longest},
+		harvests: &rollingRatio{resolution: resolution, retention: longest},
+		now:      time.Now,
+	}
+}
+
+// WithSuccessRatios records the result of every scrape in the ratios.
+func WithSuccessRatios(ratios *SuccessRatios) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.successRatios = ratios
+	}
+}
+
+// observeScrape records the result of a scheduled scrape.
+func (sr *SuccessRatios) observeScrape(ok bool) {
+	sr.scrapes.observe(sr.now(), ok)
+}
+
+// harvesterOpt records the result of every harvest request. It must be the
+// last option, to see the results of the whole chain.
+func (sr *SuccessRatios) harvesterOpt() TelemetryHarvesterOpt {
+	return trackHarvesterRequests(func(failed bool) {
+		sr.harvests.observe(sr.now(), !failed)
+	})
+}
+
+// Describe implements prometheus.Collector.
+func (sr *SuccessRatios) Describe(ch chan<- *prometheus.Desc) {
+	ch <- scrapeSuccessRatioDesc
+	ch <- harvestSuccessRatioDesc
+}
+
+// Collect implements prometheus.Collector.
+func (sr *SuccessRatios) Collect(ch chan<- prometheus.Metric) {
+	now := sr.now()
+	for _, w := range sr.windows {
+		if ratio, ok := sr.scrapes.ratio(now, w); ok {
+			ch <- prometheus.MustNewConstMetric(scrapeSuccessRatioDesc, prometheus.GaugeValue, ratio, w.String())
+		}
+		if ratio, ok := sr.harvests.ratio(now, w); ok {
+			ch <- prometheus.MustNewConstMetric(harvestSuccessRatioDesc, prometheus.GaugeValue, ratio, w.String())
+		}
+	}
+}
+
+type ratioBucket struct {
+	start     time.Time
+	successes int
+	total     int
+}
+
+// rollingRatio counts the successes and the total of the events in buckets
+// of resolution, kept for retention.
+type rollingRatio struct {
+	resolution time.Duration
+	retention  time.Duration
+
+	mu      sync.Mutex
+	buckets []ratioBucket
+}
+
+func (r *rollingRatio) observe(now time.Time, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if n := len(r.buckets); n == 0 || now.Sub(r.buckets[n-1].start) >= r.resolution {
+		expired := 0
+		for expired < len(r.buckets) && now.Sub(r.buckets[expired].start) > r.retention {
+			expired++
+		}
+		r.buckets = append(r.buckets[:0], r.buckets[expired:]...)
+		r.buckets = append(r.buckets, ratioBucket{start: now.Truncate(r.resolution)})
+	}
+	b := &r.buckets[len(r.buckets)-1]
+	b.total++
+	if ok {
+		b.successes++
+	}
+}
+
+// ratio returns the fraction of successes within the window, and false if
+// there were no events.
+func (r *rollingRatio) ratio(now time.Time, window time.Duration) (float64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var successes, total int
+	for i := len(r.buckets) - 1; i >= 0 && now.Sub(r.buckets[i].start) < window; i-- {
+		successes += r.buckets[i].successes
+		total += r.buckets[i].total
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(successes) / float64(total), true
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectRatios returns the ratios collected, by metric name and window.
+func collectRatios(t *testing.T, sr *SuccessRatios) map[string]float64 {
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(sr))
+	mfs, err := registry.Gather()
+	require.NoError(t, err)
+
+	ratios := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			ratios[mf.GetName()+"/"+m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	return ratios
+}
+
+func TestSuccessRatios(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	sr := NewSuccessRatios(time.Minute, 10*time.Minute)
+	sr.now = func() time.Time { return now }
+
+	assert.Empty(t, collectRatios(t, sr), "no ratios without events")
+
+	// 4 failed scrapes 5 minutes ago, and 3 successful and 1 failed ones now.
+	sr.now = func() time.Time { return now.Add(-5 * time.Minute) }
+	for i := 0; i < 4; i++ {
+		sr.observeScrape(false)
+	}
+	sr.now = func() time.Time { return now }
+	sr.observeScrape(true)
+	sr.observeScrape(true)
+	sr.observeScrape(true)
+	sr.observeScrape(false)
+
+	assert.Equal(t, map[string]float64{
+		"nr_stats_integration_scrape_success_ratio/1m0s":  0.75,
+		"nr_stats_integration_scrape_success_ratio/10m0s": 0.375,
+	}, collectRatios(t, sr))
+
+	// Events older than the longest window are forgotten.
+	now = now.Add(11 * time.Minute)
+	sr.observeScrape(true)
+	assert.Equal(t, map[string]float64{
+		"nr_stats_integration_scrape_success_ratio/1m0s":  1,
+		"nr_stats_integration_scrape_success_ratio/10m0s": 1,
+	}, collectRatios(t, sr))
+	assert.Len(t, sr.scrapes.buckets, 1)
+}
+
+func TestSuccessRatiosHarvests(t *testing.T) {
+	sr := NewSuccessRatios(time.Minute)
+	status := http.StatusAccepted
+	cfg := telemetry.Config{Client: &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return emptyResponse(status), nil
+		}),
+	}}
+	sr.harvesterOpt()(&cfg)
+
+	req, err := http.NewRequest("POST", "http://localhost/metric/v1", nil)
+	require.NoError(t, err)
+	for _, s := range []int{http.StatusAccepted, http.StatusServiceUnavailable, http.StatusAccepted, http.StatusAccepted} {
+		status = s
+		_, err := cfg.Client.Transport.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	ratios := collectRatios(t, sr)
+	assert.Equal(t, 0.75, ratios["nr_stats_integration_harvest_success_ratio/1m0s"])
+}
@@ -0,0 +1,72 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// TargetParamsRule adds query parameters to the scrape URL of the targets
+// whose metadata (like label.app or namespaceName) has all the Match values,
+// for exporters that filter their metrics server-side, like node_exporter
+// collect[] parameters.
+type TargetParamsRule struct {
+	Match  map[string]string   `mapstructure:"match"`
+	Params map[string][]string `mapstructure:"params"`
+}
+
+// matches returns true if the target metadata has all the values of the
+// rule.
+func (r TargetParamsRule) matches(t *endpoints.Target) bool {
+	return matchesMetadata(t, r.Match)
+}
+
+// matchesMetadata returns true if the target metadata has all the values.
+func matchesMetadata(t *endpoints.Target, match map[string]string) bool {
+	metadata := t.Metadata()
+	for k, want := range match {
+		v, ok := metadata[k]
+		if !ok || fmt.Sprint(v) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// WithTargetParams adds the query parameters of the matching rules to the
+// scrape URL of the targets. Parameters override the ones with the same name
+// in the target URL, and the ones of previous rules.
+func WithTargetParams(rules ...TargetParamsRule) FetcherOption {
+	return func(pf *prometheusFetcher) {
+		pf.targetParams = append(pf.targetParams, rules...)
+	}
+}
+
+// scrapeURL returns the URL the target is scraped from.
+func (pf *prometheusFetcher) scrapeURL(t *endpoints.Target) string {
+	u := t.URL
+	var query url.Values
+	for _, rule := range pf.targetParams {
+		if !rule.matches(t) {
+			continue
+		}
+		if query == nil {
+			query = u.Query()
+		}
+		for k, v := range rule.Params {
+			query[k] = v
+		}
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	if t.Gateway.IsPath() {
+		// The gateway configuration is validated with the target.
+		u, _ = t.Gateway.RewriteURL(u)
+	}
+	return u.String()
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/gateway"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestScrapeURL(t *testing.T) {
+	pf := &prometheusFetcher{}
+	WithTargetParams(
+		TargetParamsRule{
+			Match:  map[string]string{"label.app": "node-exporter"},
+			Params: map[string][]string{"collect[]": {"cpu", "meminfo"}},
+		},
+		TargetParamsRule{
+			Match:  map[string]string{"label.app": "node-exporter", "namespaceName": "infra"},
+			Params: map[string][]string{"collect[]": {"cpu"}, "format": {"text"}},
+		},
+	)(pf)
+
+	target := func(rawURL string, lbls labels.Set) endpoints.Target {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		return endpoints.New("target", *u, endpoints.Object{Name: "pod", Kind: "pod", Labels: lbls})
+	}
+
+	tests := []struct {
+		name   string
+		target endpoints.Target
+		url    string
+	}{
+		{
+			"no match",
+			target("http://10.0.0.1:9100/metrics", labels.Set{"label.app": "other"}),
+			"http://10.0.0.1:9100/metrics",
+		},
+		{
+			"one match",
+			target("http://10.0.0.1:9100/metrics?debug=1", labels.Set{"label.app": "node-exporter", "namespaceName": "default"}),
+			"http://10.0.0.1:9100/metrics?collect%5B%5D=cpu&collect%5B%5D=meminfo&debug=1",
+		},
+		{
+			"last match overrides",
+			target("http://10.0.0.1:9100/metrics", labels.Set{"label.app": "node-exporter", "namespaceName": "infra"}),
+			"http://10.0.0.1:9100/metrics?collect%5B%5D=cpu&format=text",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.url, pf.scrapeURL(&tt.target))
+			assert.NotContains(t, tt.target.URL.String(), "collect", "the target URL is not modified")
+		})
+	}
+}
+
+func TestScrapeURL_PathGateway(t *testing.T) {
+	pf := &prometheusFetcher{}
+	WithTargetParams(TargetParamsRule{Params: map[string][]string{"collect[]": {"cpu"}}})(pf)
+
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{
+		URLs:    []string{"10.1.2.3:9100"},
+		Gateway: gateway.Config{URL: "https://bastion.example.com/proxy", Mode: gateway.ModePath},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://bastion.example.com/proxy/10.1.2.3:9100/metrics?collect%5B%5D=cpu", pf.scrapeURL(&targets[0]))
+	assert.Equal(t, "10.1.2.3:9100", targets[0].Name, "the target keeps its name")
+}
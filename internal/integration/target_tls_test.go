@@ -0,0 +1,154 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// writeClientCert writes a self-signed client certificate and its key into
+// the directory, returning their paths.
+func writeClientCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nri-prometheus"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestFetcher_TargetTLSConfig(t *testing.T) {
+	var clientCerts int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			atomic.AddInt32(&clientCerts, 1)
+		}
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600))
+	certFile, keyFile := writeClientCert(t, dir)
+
+	targets := func(tlsConfig endpoints.TLSConfig) []endpoints.Target {
+		targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{URLs: []string{ts.URL}, TLSConfig: tlsConfig})
+		require.NoError(t, err)
+		return targets
+	}
+	fetch := func(fetcher Fetcher, targets []endpoints.Target) int {
+		var fetched int
+		for range fetcher.Fetch(targets) {
+			fetched++
+		}
+		return fetched
+	}
+
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength)
+	assert.Equal(t, 0, fetch(fetcher, targets(endpoints.TLSConfig{})), "the target is signed by an unknown CA")
+	assert.Equal(t, 1, fetch(fetcher, targets(endpoints.TLSConfig{CaFilePath: caFile})), "the CA of the target verifies it")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&clientCerts))
+
+	mtls := targets(endpoints.TLSConfig{CaFilePath: caFile, CertFilePath: certFile, KeyFilePath: keyFile})
+	assert.Equal(t, 1, fetch(fetcher, mtls))
+	assert.Equal(t, 1, fetch(fetcher, mtls))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&clientCerts))
+
+	var clients int
+	fetcher.(*prometheusFetcher).dialingClients.Range(func(_, _ interface{}) bool {
+		clients++
+		return true
+	})
+	assert.Equal(t, 2, clients, "the clients are shared by the scrapes of the same configuration")
+}
+
+func TestFetcher_TargetTLSConfigBearerToken(t *testing.T) {
+	var authorization atomic.Value
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600))
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("cluster-token"), 0600))
+
+	targets, err := endpoints.EndpointToTarget(endpoints.TargetConfig{URLs: []string{ts.URL}, TLSConfig: endpoints.TLSConfig{CaFilePath: caFile}})
+	require.NoError(t, err)
+	fetcher := NewFetcher(fetchDuration, fetchTimeout, maxConnections, tokenFile, "", false, queueLength)
+	var fetched int
+	for range fetcher.Fetch(targets) {
+		fetched++
+	}
+	require.Equal(t, 1, fetched)
+	assert.Equal(t, "", authorization.Load(), "the global bearer token is not sent to the targets with their own CA")
+}
+
+func TestNewMutualTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeClientCert(t, dir)
+	emptyCA := filepath.Join(dir, "empty.crt")
+	require.NoError(t, ioutil.WriteFile(emptyCA, []byte("not a certificate"), 0600))
+
+	tlsConfig, err := newMutualTLSConfig(endpoints.TLSConfig{ServerName: "exporter.internal"})
+	require.NoError(t, err)
+	assert.Equal(t, "exporter.internal", tlsConfig.ServerName)
+	assert.Nil(t, tlsConfig.RootCAs, "the system roots are used without a CA")
+	assert.Nil(t, tlsConfig.GetClientCertificate)
+
+	tlsConfig, err = newMutualTLSConfig(endpoints.TLSConfig{CertFilePath: certFile, KeyFilePath: keyFile})
+	require.NoError(t, err)
+	cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, cert.Certificate)
+
+	_, err = newMutualTLSConfig(endpoints.TLSConfig{CertFilePath: certFile})
+	assert.Error(t, err, "the key is missing")
+	_, err = newMutualTLSConfig(endpoints.TLSConfig{CaFilePath: emptyCA})
+	assert.Error(t, err, "the CA file has no certificate")
+}
@@ -0,0 +1,123 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// targetChangeMetricName is the name of the metric emitted for every added or
+// removed target, when enabled.
+const targetChangeMetricName = "nr_stats_target_change"
+
+// WithTargetChangeMetrics emits a metric for every target added or removed
+// by the retrievers, so data gaps can be correlated with discovery changes.
+func WithTargetChangeMetrics() ExecuteOption {
+	return func(e *execution) {
+		e.changes.emit = true
+	}
+}
+
+// targetChanges tracks the targets returned by each retriever in order to
+// report the differences between runs.
+type targetChanges struct {
+	emit bool
+	// previous holds the targets of the last run of each retriever, by
+	// their key.
+	previous map[string]map[string]endpoints.Target
+}
+
+func newTargetChanges() *targetChanges {
+	return &targetChanges{previous: map[string]map[string]endpoints.Target{}}
+}
+
+func targetKey(t *endpoints.Target) string {
+	return t.Name + " " + t.URL.String()
+}
+
+// diff returns the targets added and removed from the previous run of the
+// retriever. The first run of a retriever reports no changes.
+func (tc *targetChanges) diff(retriever string, targets []endpoints.Target) (added, removed []endpoints.Target) {
+	current := make(map[string]endpoints.Target, len(targets))
+	for _, t := range targets {
+		current[targetKey(&t)] = t
+	}
+	previous, seen := tc.previous[retriever]
+	tc.previous[retriever] = current
+	if !seen {
+		return nil, nil
+	}
+
+	for k, t := range current {
+		if _, ok := previous[k]; !ok {
+			added = append(added, t)
+		}
+	}
+	for k, t := range previous {
+		if _, ok := current[k]; !ok {
+			removed = append(removed, t)
+		}
+	}
+	return added, removed
+}
+
+// update logs the targets added and removed from the previous run of the
+// retriever, and returns the change metrics if they are enabled.
+func (tc *targetChanges) update(retriever string, targets []endpoints.Target) []Metric {
+	added, removed := tc.diff(retriever, targets)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	ilog.WithFields(logrus.Fields{
+		"retriever": retriever,
+		"added":     describeTargets(added),
+		"removed":   describeTargets(removed),
+	}).Infof("targets changed: %d added, %d removed", len(added), len(removed))
+
+	if !tc.emit {
+		return nil
+	}
+	metrics := make([]Metric, 0, len(added)+len(removed))
+	metrics = append(metrics, targetChangeMetrics(retriever, "added", added)...)
+	metrics = append(metrics, targetChangeMetrics(retriever, "removed", removed)...)
+	return metrics
+}
+
+// describeTargets returns a concise, sorted description of the targets.
+func describeTargets(targets []endpoints.Target) string {
+	descriptions := make([]string, 0, len(targets))
+	for i := range targets {
+		url, _ := targets[i].Metadata()["scrapedTargetURL"].(string)
+		descriptions = append(descriptions, targets[i].Name+"("+url+")")
+	}
+	sort.Strings(descriptions)
+	return strings.Join(descriptions, ", ")
+}
+
+func targetChangeMetrics(retriever, action string, targets []endpoints.Target) []Metric {
+	metrics := make([]Metric, 0, len(targets))
+	for i := range targets {
+		attrs := labels.Set{
+			"action":       action,
+			"retriever":    retriever,
+			"targetName":   targets[i].Name,
+			"nrMetricType": string(metricType_GAUGE),
+		}
+		labels.Accumulate(attrs, targets[i].Metadata())
+		metrics = append(metrics, Metric{
+			name:       targetChangeMetricName,
+			value:      float64(1),
+			metricType: metricType_GAUGE,
+			attributes: attrs,
+		})
+	}
+	return metrics
+}
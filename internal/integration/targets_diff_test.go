@@ -0,0 +1,62 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+func newTestTarget(name, host string) endpoints.Target {
+	return endpoints.New(name, url.URL{Scheme: "http", Host: host, Path: "/metrics"}, endpoints.Object{Name: name, Kind: "pod"})
+}
+
+func TestTargetChanges(t *testing.T) {
+	tc := newTargetChanges()
+	a := newTestTarget("a", "10.0.0.1:8080")
+	b := newTestTarget("b", "10.0.0.2:8080")
+	c := newTestTarget("c", "10.0.0.3:8080")
+
+	added, removed := tc.diff("kubernetes", []endpoints.Target{a, b})
+	assert.Empty(t, added, "the first run must not report changes")
+	assert.Empty(t, removed)
+
+	added, removed = tc.diff("kubernetes", []endpoints.Target{b, c})
+	assert.Equal(t, []endpoints.Target{c}, added)
+	assert.Equal(t, []endpoints.Target{a}, removed)
+
+	added, removed = tc.diff("kubernetes", []endpoints.Target{b, c})
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+
+	// Retrievers are tracked independently.
+	added, removed = tc.diff("fixed", []endpoints.Target{a})
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
+
+func TestTargetChanges_Metrics(t *testing.T) {
+	a := newTestTarget("a", "10.0.0.1:8080")
+	b := newTestTarget("b", "10.0.0.2:8080")
+
+	tc := newTargetChanges()
+	tc.update("kubernetes", []endpoints.Target{a})
+	assert.Empty(t, tc.update("kubernetes", []endpoints.Target{b}), "metrics are only emitted when enabled")
+
+	tc = newExecution(WithTargetChangeMetrics()).changes
+	tc.update("kubernetes", []endpoints.Target{a})
+	metrics := tc.update("kubernetes", []endpoints.Target{b})
+	require.Len(t, metrics, 2)
+	assert.Equal(t, targetChangeMetricName, metrics[0].name)
+	assert.Equal(t, "added", metrics[0].attributes["action"])
+	assert.Equal(t, "b", metrics[0].attributes["targetName"])
+	assert.Equal(t, "kubernetes", metrics[0].attributes["retriever"])
+	assert.Equal(t, "http://10.0.0.2:8080/metrics", metrics[0].attributes["scrapedTargetURL"])
+	assert.Equal(t, "removed", metrics[1].attributes["action"])
+	assert.Equal(t, "a", metrics[1].attributes["targetName"])
+}
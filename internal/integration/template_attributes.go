@@ -0,0 +1,106 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TemplateAttributesRule sets the Attributes of the metrics that match
+// MetricPrefix to Go templates of their other attributes, like
+// "{{.namespaceName}}/{{.podName}}", to build composite identifiers to
+// group by. Attributes whose names aren't identifiers are referred to with
+// index, like {{index . "label.app"}}. An attribute is not set if its
+// template refers to an attribute the metric doesn't have, or renders an
+// empty value.
+type TemplateAttributesRule struct {
+	MetricPrefix string            `mapstructure:"metric_prefix"`
+	Attributes   map[string]string `mapstructure:"attributes"`
+}
+
+// Validate returns an error if any of the templates is not valid.
+func (r TemplateAttributesRule) Validate() error {
+	_, err := r.compile()
+	return err
+}
+
+// templater is a compiled TemplateAttributesRule.
+type templater struct {
+	metricPrefix string
+	names        []string
+	templates    []*template.Template
+}
+
+func (r TemplateAttributesRule) compile() (*templater, error) {
+	if len(r.Attributes) == 0 {
+		return nil, fmt.Errorf("template attributes rule needs attributes")
+	}
+	t := &templater{metricPrefix: r.MetricPrefix}
+	// Sorted, so the templates are always evaluated in the same order.
+	for name := range r.Attributes {
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+	for _, name := range t.names {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(r.Attributes[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of attribute %s: %w", name, err)
+		}
+		t.templates = append(t.templates, tmpl)
+	}
+	return t, nil
+}
+
+// templateAttributes sets the attributes of the templaters to the metrics.
+// The templates of a metric are all evaluated with its attributes before
+// setting any of them, so they don't depend on each other.
+func templateAttributes(targetMetrics *TargetMetrics, templaters []*templater) {
+	if len(templaters) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	var values []string
+	for mi := range targetMetrics.Metrics {
+		m := &targetMetrics.Metrics[mi]
+		for _, t := range templaters {
+			if !strings.HasPrefix(m.name, t.metricPrefix) {
+				continue
+			}
+			values = values[:0]
+			for _, tmpl := range t.templates {
+				buf.Reset()
+				if err := tmpl.Execute(&buf, map[string]interface{}(m.attributes)); err != nil {
+					// Missing attributes leave the attribute unset.
+					buf.Reset()
+				}
+				values = append(values, buf.String())
+			}
+			for i, value := range values {
+				if value != "" {
+					m.attributes[t.names[i]] = value
+				}
+			}
+		}
+	}
+}
+
+// compileTemplateRules returns the templaters of the valid rules. Invalid
+// rules are logged and skipped, as they are expected to be validated with
+// the configuration.
+func compileTemplateRules(rules []TemplateAttributesRule) []*templater {
+	var templaters []*templater
+	for _, r := range rules {
+		t, err := r.compile()
+		if err != nil {
+			ilog.WithError(err).Error("skipping template attributes rule")
+			continue
+		}
+		templaters = append(templaters, t)
+	}
+	return templaters
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestTemplateAttributes(t *testing.T) {
+	pair := TargetMetrics{Metrics: []Metric{
+		{
+			name:       "http_requests_total",
+			attributes: labels.Set{"namespace": "shop", "pod": "cart-0", "label.app": "cart", "code": float64(200)},
+		},
+		{
+			name:       "http_request_duration_seconds",
+			attributes: labels.Set{"namespace": "shop"},
+		},
+		{
+			name:       "process_open_fds",
+			attributes: labels.Set{"namespace": "shop", "pod": "cart-0"},
+		},
+	}}
+	rules := []TemplateAttributesRule{{
+		MetricPrefix: "http_",
+		Attributes: map[string]string{
+			"service_instance": "{{.namespace}}/{{.pod}}",
+			"app":              `{{index . "label.app"}}-{{.code}}`,
+			// The templates see the attributes before any of them is set.
+			"namespace": "ns-{{.namespace}}",
+			"copy":      "{{.namespace}}",
+		},
+	}}
+
+	templateAttributes(&pair, compileTemplateRules(rules))
+
+	assert.Equal(t, labels.Set{
+		"namespace":        "ns-shop",
+		"copy":             "shop",
+		"pod":              "cart-0",
+		"label.app":        "cart",
+		"code":             float64(200),
+		"service_instance": "shop/cart-0",
+		"app":              "cart-200",
+	}, pair.Metrics[0].attributes)
+	assert.Equal(t, labels.Set{"namespace": "ns-shop", "copy": "shop"}, pair.Metrics[1].attributes,
+		"attributes with missing attributes in their templates are not set")
+	assert.Equal(t, labels.Set{"namespace": "shop", "pod": "cart-0"}, pair.Metrics[2].attributes)
+}
+
+func TestTemplateAttributesRule_Validate(t *testing.T) {
+	assert.NoError(t, TemplateAttributesRule{Attributes: map[string]string{"a": "{{.b}}"}}.Validate())
+	assert.Error(t, TemplateAttributesRule{}.Validate())
+	assert.Error(t, TemplateAttributesRule{Attributes: map[string]string{"a": "{{.b"}}.Validate())
+}
@@ -0,0 +1,153 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTypeCoercions bounds the metrics listed by the type coercion report.
+const maxTypeCoercions = 10000
+
+// The reasons the metrics are emitted with another type than their
+// Prometheus one.
+const (
+	coercionUntyped       = "untyped"
+	coercionCumulative    = "emitter_cumulative_counter_prefixes"
+	coercionCounterOutput = "counter_output"
+	coercionOverride      = "override"
+)
+
+// nrMetricTypes are the types the Prometheus types are emitted with when
+// they aren't coerced.
+var nrMetricTypes = map[string]metricType{
+	"counter":   metricType_COUNTER,
+	"gauge":     metricType_GAUGE,
+	"summary":   metricType_SUMMARY,
+	"histogram": metricType_HISTOGRAM,
+}
+
+// TypeCoercion is a metric emitted with another type than its Prometheus
+// one.
+type TypeCoercion struct {
+	Metric    string `json:"metric"`
+	PromType  string `json:"promType"`
+	EmittedAs string `json:"emittedAs"`
+	Reason    string `json:"reason"`
+	// Series is the number of series of the metric in the last run.
+	Series int `json:"series"`
+}
+
+// TypeCoercions reports the metrics whose Prometheus type disagrees with
+// the type they're emitted with, like the untyped metrics sent as gauges or
+// the counters sent as gauges by the emitter options, to audit the effect
+// of the type handling configuration.
+type TypeCoercions struct {
+	cumulativePrefixes []string
+	counterOutput      CounterOutput
+
+	// current are the coercions of the ongoing run, and last the ones of
+	// the last completed run, by metric name.
+	current map[string]*TypeCoercion
+	mu      sync.Mutex
+	last    []TypeCoercion
+	lastRun time.Time
+}
+
+// NewTypeCoercions returns a report of the coercions of the emitters with
+// the cumulative counter prefixes and the counter output.
+func NewTypeCoercions(cumulativePrefixes []string, counterOutput CounterOutput) *TypeCoercions {
+	return &TypeCoercions{
+		cumulativePrefixes: cumulativePrefixes,
+		counterOutput:      counterOutput,
+		current:            map[string]*TypeCoercion{},
+	}
+}
+
+// WithTypeCoercionReport records the metrics emitted with another type than
+// their Prometheus one in the report.
+func WithTypeCoercionReport(report *TypeCoercions) ExecuteOption {
+	return func(e *execution) {
+		e.coercions = report
+	}
+}
+
+// coercion returns the type the metric is emitted with and why, or false if
+// it's the one of its Prometheus type.
+func (tc *TypeCoercions) coercion(m *Metric) (emittedAs metricType, reason string, coerced bool) {
+	promType, _ := m.attributes["promMetricType"].(string)
+	switch {
+	case promType == "":
+		return "", "", false
+	case promType == "untyped":
+		return m.metricType, coercionUntyped, true
+	case m.metricType != nrMetricTypes[promType]:
+		return m.metricType, coercionOverride, true
+	case m.metricType != metricType_COUNTER:
+		return "", "", false
+	case hasAnyPrefix(m.name, tc.cumulativePrefixes):
+		return metricType_GAUGE, coercionCumulative, true
+	case tc.counterOutput == CounterOutputRate, tc.counterOutput == CounterOutputCumulative:
+		return metricType_GAUGE, coercionCounterOutput, true
+	}
+	return "", "", false
+}
+
+// observe records the coercions of the metrics of the ongoing run.
+func (tc *TypeCoercions) observe(metrics []Metric) {
+	for i := range metrics {
+		emittedAs, reason, coerced := tc.coercion(&metrics[i])
+		if !coerced {
+			continue
+		}
+		c, ok := tc.current[metrics[i].name]
+		if !ok {
+			if len(tc.current) >= maxTypeCoercions {
+				continue
+			}
+			promType, _ := metrics[i].attributes["promMetricType"].(string)
+			c = &TypeCoercion{Metric: metrics[i].name, PromType: promType, EmittedAs: string(emittedAs), Reason: reason}
+			tc.current[metrics[i].name] = c
+		}
+		c.Series++
+	}
+}
+
+// endRun completes the report of the run, and starts the one of the next.
+func (tc *TypeCoercions) endRun() {
+	coercions := make([]TypeCoercion, 0, len(tc.current))
+	for _, c := range tc.current {
+		coercions = append(coercions, *c)
+	}
+	sort.Slice(coercions, func(i, j int) bool { return coercions[i].Metric < coercions[j].Metric })
+	tc.current = make(map[string]*TypeCoercion, len(tc.current))
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.last = coercions
+	tc.lastRun = time.Now()
+}
+
+// List returns the coercions of the last completed run, by metric name.
+func (tc *TypeCoercions) List() []TypeCoercion {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return append([]TypeCoercion{}, tc.last...)
+}
+
+// ServeHTTP writes the coercions of the last completed run as JSON.
+func (tc *TypeCoercions) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	tc.mu.Lock()
+	report := struct {
+		Run       time.Time      `json:"run"`
+		Coercions []TypeCoercion `json:"coercions"`
+	}{Run: tc.lastRun, Coercions: append([]TypeCoercion{}, tc.last...)}
+	tc.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
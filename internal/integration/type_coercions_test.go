@@ -0,0 +1,67 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestTypeCoercions(t *testing.T) {
+	mfs, err := decodePromMetrics(strings.NewReader(`# TYPE temperature untyped
+temperature{room="a"} 20
+temperature{room="b"} 21
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 10
+# TYPE http_requests_total counter
+http_requests_total 5
+# TYPE up gauge
+up 1
+`))
+	require.NoError(t, err)
+	metrics := convertPromMetrics(logrus.NewEntry(logrus.New()), "target", *mfs, 0)
+
+	report := NewTypeCoercions([]string{"process_"}, CounterOutputDelta)
+	report.observe(metrics)
+	assert.Empty(t, report.List(), "the report is of the completed runs")
+	report.endRun()
+	assert.Equal(t, []TypeCoercion{
+		{Metric: "process_cpu_seconds_total", PromType: "counter", EmittedAs: "gauge", Reason: coercionCumulative, Series: 1},
+		{Metric: "temperature", PromType: "untyped", EmittedAs: "gauge", Reason: coercionUntyped, Series: 2},
+	}, report.List())
+
+	report = NewTypeCoercions(nil, CounterOutputRate)
+	report.observe(metrics)
+	report.endRun()
+	rec := httptest.NewRecorder()
+	report.ServeHTTP(rec, httptest.NewRequest("GET", "/-/type-coercions", nil))
+	var body struct {
+		Coercions []TypeCoercion `json:"coercions"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	require.Len(t, body.Coercions, 3, "all the counters are sent as rates")
+	assert.Equal(t, coercionCounterOutput, body.Coercions[0].Reason)
+
+	report.endRun()
+	assert.Empty(t, report.List(), "every run is reported on its own")
+}
+
+func TestTypeCoercions_Override(t *testing.T) {
+	report := NewTypeCoercions(nil, CounterOutputDelta)
+	report.observe([]Metric{{
+		name:       "queue_size",
+		metricType: metricType_GAUGE,
+		attributes: labels.Set{"promMetricType": "counter"},
+	}})
+	report.endRun()
+	require.Len(t, report.List(), 1)
+	assert.Equal(t, coercionOverride, report.List()[0].Reason)
+}
@@ -0,0 +1,210 @@
+// Package integration ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// watchdogEventMetricName is the name of the metric emitted for every
+// recovery of the watchdog, describing what happened.
+const watchdogEventMetricName = "nr_stats_watchdog_recovery"
+
+const (
+	// alarmTargetsLost is raised when a retriever that discovered targets
+	// discovers none, while its discovery succeeds.
+	alarmTargetsLost = "targets_lost"
+	// alarmHarvesterStalled is raised when the harvester of a telemetry
+	// emitter records metrics but doesn't send any request.
+	alarmHarvesterStalled = "harvester_stalled"
+)
+
+// WatchdogConfig configures the alarms on the internal state of the
+// integration loop, and the recoveries they trigger. An alarm is disabled
+// if its number of harvests is 0.
+type WatchdogConfig struct {
+	// TargetsLostHarvests is the number of consecutive harvests a retriever
+	// that discovered targets must discover none for its resources to be
+	// listed again, like after a watch that silently stopped. It's only
+	// raised for the retrievers that can be refreshed, like the Kubernetes
+	// ones, and retried on every harvest while the list fails, since the
+	// API isn't reachable then.
+	TargetsLostHarvests int `mapstructure:"targets_lost_harvests"`
+	// HarvesterStalledHarvests is the number of consecutive harvests a
+	// telemetry emitter must record metrics without its harvester sending
+	// any request for the harvester to be recreated. The harvests must
+	// span more than the harvest period of the emitter.
+	HarvesterStalledHarvests int `mapstructure:"harvester_stalled_harvests"`
+}
+
+// IsEmpty returns true if no alarm is enabled.
+func (c WatchdogConfig) IsEmpty() bool {
+	return c.TargetsLostHarvests == 0 && c.HarvesterStalledHarvests == 0
+}
+
+// Validate returns an error if a number of harvests is negative.
+func (c WatchdogConfig) Validate() error {
+	if c.TargetsLostHarvests < 0 || c.HarvesterStalledHarvests < 0 {
+		return fmt.Errorf("watchdog targets_lost_harvests and harvester_stalled_harvests can't be negative")
+	}
+	return nil
+}
+
+// WithWatchdog checks the alarms of the configuration at the end of every
+// harvest, recovering from the raised ones and emitting a metric describing
+// every recovery.
+func WithWatchdog(cfg WatchdogConfig) ExecuteOption {
+	return func(e *execution) {
+		if !cfg.IsEmpty() {
+			e.watchdog = newWatchdog(cfg)
+		}
+	}
+}
+
+// watchdog tracks the state of the alarms between harvests.
+type watchdog struct {
+	cfg WatchdogConfig
+	// discovered holds, by retriever, the targets discovered the last time
+	// it had any. Retrievers are removed from it once recovered.
+	discovered map[string]int
+	// lost holds, by retriever, the consecutive harvests without targets.
+	lost map[string]int
+}
+
+func newWatchdog(cfg WatchdogConfig) *watchdog {
+	return &watchdog{
+		cfg:        cfg,
+		discovered: map[string]int{},
+		lost:       map[string]int{},
+	}
+}
+
+// check observes the targets discovered by the retrievers in the harvest,
+// recovering from the raised alarms. It returns the metrics describing the
+// recoveries.
+func (w *watchdog) check(retrievers []endpoints.TargetRetriever, targets map[string]int, emitters []Emitter) []Metric {
+	var events []Metric
+	if w.cfg.TargetsLostHarvests > 0 {
+		for _, r := range retrievers {
+			if event, ok := w.checkTargets(r, targets[r.Name()]); ok {
+				events = append(events, event)
+			}
+		}
+	}
+	if w.cfg.HarvesterStalledHarvests > 0 {
+		for _, te := range telemetryEmitters(emitters) {
+			if event, ok := w.checkHarvester(te); ok {
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
+
+// checkTargets lists the resources of the retriever again once it
+// discovered no targets for the configured harvests.
+func (w *watchdog) checkTargets(r endpoints.TargetRetriever, targets int) (Metric, bool) {
+	refresher, ok := r.(endpoints.Refresher)
+	if !ok {
+		return Metric{}, false
+	}
+	name := r.Name()
+	if targets > 0 {
+		w.discovered[name] = targets
+		delete(w.lost, name)
+		return Metric{}, false
+	}
+	before, ok := w.discovered[name]
+	if !ok {
+		return Metric{}, false
+	}
+	w.lost[name]++
+	if w.lost[name] < w.cfg.TargetsLostHarvests {
+		return Metric{}, false
+	}
+
+	log := ilog.WithFields(logrus.Fields{"alarm": alarmTargetsLost, "retriever": name})
+	if err := refresher.Refresh(); err != nil {
+		log.WithError(err).Debug("couldn't list the targets again, retrying in the next harvest")
+		return Metric{}, false
+	}
+	delete(w.discovered, name)
+	delete(w.lost, name)
+	listed, err := r.GetTargets()
+	if err != nil {
+		listed = nil
+	}
+	description := fmt.Sprintf("%s discovered no targets for %d harvests after discovering %d, listed %d targets again",
+		name, w.cfg.TargetsLostHarvests, before, len(listed))
+	log.Warn(description)
+	return watchdogEvent(alarmTargetsLost, "relist_discovery", "retriever", name, description, nil), true
+}
+
+// checkHarvester recreates the harvester of the emitter once it recorded
+// metrics without sending any request for the configured harvests.
+func (w *watchdog) checkHarvester(te *TelemetryEmitter) (Metric, bool) {
+	if te.stalledHarvests() < w.cfg.HarvesterStalledHarvests {
+		return Metric{}, false
+	}
+	log := ilog.WithFields(logrus.Fields{"alarm": alarmHarvesterStalled, "emitter": te.Name()})
+	err := te.recreateHarvester()
+	description := fmt.Sprintf("the harvester of %s sent no request for %d harvests with recorded metrics",
+		te.Name(), w.cfg.HarvesterStalledHarvests)
+	if err != nil {
+		description += fmt.Sprintf(", couldn't recreate it: %v", err)
+		log.WithError(err).Error(description)
+	} else {
+		description += ", recreated it"
+		log.Warn(description)
+	}
+	return watchdogEvent(alarmHarvesterStalled, "recreate_harvester", "emitter", te.Name(), description, err), true
+}
+
+// watchdogEvent returns the metric describing a recovery, whose subject is
+// the retriever or the emitter it was applied to.
+func watchdogEvent(alarm, action, subjectKey, subject, description string, err error) Metric {
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	watchdogRecoveriesMetric.WithLabelValues(alarm, result).Inc()
+	return Metric{
+		name:       watchdogEventMetricName,
+		value:      float64(1),
+		metricType: metricType_GAUGE,
+		attributes: labels.Set{
+			"alarm":        alarm,
+			"action":       action,
+			"result":       result,
+			subjectKey:     subject,
+			"description":  description,
+			"nrMetricType": string(metricType_GAUGE),
+		},
+	}
+}
+
+// emitterWrapper is implemented by the emitters wrapping other emitters.
+type emitterWrapper interface {
+	wrappedEmitters() []Emitter
+}
+
+// telemetryEmitters returns the telemetry emitters of the list, including
+// the ones wrapped by other emitters.
+func telemetryEmitters(emitters []Emitter) []*TelemetryEmitter {
+	var found []*TelemetryEmitter
+	for _, e := range emitters {
+		switch e := e.(type) {
+		case *TelemetryEmitter:
+			found = append(found, e)
+		case emitterWrapper:
+			found = append(found, telemetryEmitters(e.wrappedEmitters())...)
+		}
+	}
+	return found
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package integration
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// refreshingRetriever returns its targets, replaced by the listed ones when
+// refreshed.
+type refreshingRetriever struct {
+	targets    []endpoints.Target
+	listed     []endpoints.Target
+	refreshErr error
+	refreshes  int
+}
+
+func (r *refreshingRetriever) GetTargets() ([]endpoints.Target, error) { return r.targets, nil }
+func (r *refreshingRetriever) Watch() error                            { return nil }
+func (r *refreshingRetriever) Name() string                            { return "kubernetes" }
+
+func (r *refreshingRetriever) Refresh() error {
+	r.refreshes++
+	if r.refreshErr != nil {
+		return r.refreshErr
+	}
+	r.targets = r.listed
+	return nil
+}
+
+func TestWatchdog_TargetsLost(t *testing.T) {
+	target := endpoints.New("pod", url.URL{Scheme: "http", Host: "pod:8080"}, endpoints.Object{})
+	r := &refreshingRetriever{listed: []endpoints.Target{target}}
+	w := newWatchdog(WatchdogConfig{TargetsLostHarvests: 2})
+	check := func(targets int) []Metric {
+		return w.check([]endpoints.TargetRetriever{r}, map[string]int{r.Name(): targets}, nil)
+	}
+
+	assert.Empty(t, check(0), "the retriever never discovered targets")
+	assert.Empty(t, check(3))
+	assert.Empty(t, check(0))
+	assert.Equal(t, 0, r.refreshes)
+
+	r.refreshErr = errors.New("connection refused")
+	assert.Empty(t, check(0), "the API isn't reachable")
+	assert.Equal(t, 1, r.refreshes)
+
+	r.refreshErr = nil
+	events := check(0)
+	require.Len(t, events, 1)
+	assert.Equal(t, 2, r.refreshes)
+	assert.Equal(t, watchdogEventMetricName, events[0].name)
+	assert.Equal(t, alarmTargetsLost, events[0].attributes["alarm"])
+	assert.Equal(t, "relist_discovery", events[0].attributes["action"])
+	assert.Equal(t, "succeeded", events[0].attributes["result"])
+	assert.Equal(t, "kubernetes", events[0].attributes["retriever"])
+	assert.Equal(t, "kubernetes discovered no targets for 2 harvests after discovering 3, listed 1 targets again", events[0].attributes["description"])
+
+	assert.Empty(t, check(0), "the alarm is only raised again after discovering targets")
+	assert.Empty(t, check(0))
+	assert.Equal(t, 2, r.refreshes)
+}
+
+func TestWatchdog_TargetsLostWithoutRefresher(t *testing.T) {
+	r, err := endpoints.FixedRetriever()
+	require.NoError(t, err)
+	w := newWatchdog(WatchdogConfig{TargetsLostHarvests: 1})
+
+	assert.Empty(t, w.check([]endpoints.TargetRetriever{r}, map[string]int{r.Name(): 1}, nil))
+	assert.Empty(t, w.check([]endpoints.TargetRetriever{r}, map[string]int{r.Name(): 0}, nil))
+}
+
+func TestWatchdog_HarvesterStalled(t *testing.T) {
+	var requests int32
+	te, err := NewTelemetryEmitter(TelemetryEmitterConfig{
+		HarvesterOpts: []TelemetryHarvesterOpt{
+			telemetry.ConfigAPIKey("api key"),
+			TelemetryHarvesterWithMetricsURL("nilapiurl"),
+			TelemetryHarvesterWithHarvestPeriod(0),
+			func(cfg *telemetry.Config) {
+				cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					atomic.AddInt32(&requests, 1)
+					return emptyResponse(http.StatusAccepted), nil
+				})
+			},
+		},
+	})
+	require.NoError(t, err)
+	emitters := []Emitter{FilteredEmitter(te, EmitterFilter{})}
+	gauge := []Metric{{name: "gauge", metricType: metricType_GAUGE, value: 1}}
+	w := newWatchdog(WatchdogConfig{HarvesterStalledHarvests: 2})
+
+	assert.Empty(t, w.check(nil, nil, emitters), "nothing was recorded")
+	require.NoError(t, te.Emit(gauge))
+	assert.Empty(t, w.check(nil, nil, emitters))
+
+	require.NoError(t, te.Emit(gauge))
+	stalled := te.harvester
+	events := w.check(nil, nil, emitters)
+	require.Len(t, events, 1)
+	assert.Equal(t, alarmHarvesterStalled, events[0].attributes["alarm"])
+	assert.Equal(t, "recreate_harvester", events[0].attributes["action"])
+	assert.Equal(t, "succeeded", events[0].attributes["result"])
+	assert.Equal(t, "telemetry", events[0].attributes["emitter"])
+	assert.NotSame(t, stalled, te.harvester)
+
+	require.NoError(t, te.Emit(gauge))
+	te.harvester.HarvestNow(context.Background())
+	assert.Empty(t, w.check(nil, nil, emitters))
+	require.NoError(t, te.Emit(gauge))
+	assert.Empty(t, w.check(nil, nil, emitters))
+	assert.Equal(t, 1, te.stalled, "the stall is counted again from the last request")
+}
+
+func TestNewHarvester_StopHarvests(t *testing.T) {
+	var requests int32
+	harvester, stopHarvests, err := newHarvester([]TelemetryHarvesterOpt{
+		telemetry.ConfigAPIKey("api key"),
+		TelemetryHarvesterWithMetricsURL("nilapiurl"),
+		TelemetryHarvesterWithHarvestPeriod(10 * time.Millisecond),
+		func(cfg *telemetry.Config) {
+			cfg.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&requests, 1)
+				return emptyResponse(http.StatusAccepted), nil
+			})
+		},
+	})
+	require.NoError(t, err)
+	gauge := telemetry.Gauge{Name: "gauge", Value: 1, Timestamp: time.Now()}
+
+	harvester.RecordMetric(gauge)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&requests) > 0 }, 5*time.Second, 10*time.Millisecond)
+
+	stopHarvests()
+	time.Sleep(50 * time.Millisecond)
+	sent := atomic.LoadInt32(&requests)
+	harvester.RecordMetric(gauge)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, sent, atomic.LoadInt32(&requests), "the stopped routine doesn't harvest anymore")
+}
@@ -0,0 +1,190 @@
+// Package clustername detects the name of the Kubernetes cluster the
+// integration runs in.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package clustername
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConfigMapKey is the key of the ConfigMap data holding the cluster name.
+const ConfigMapKey = "cluster_name"
+
+const (
+	defaultGCEMetadataURL   = "http://metadata.google.internal"
+	defaultAWSMetadataURL   = "http://169.254.169.254"
+	defaultAzureMetadataURL = "http://169.254.169.254"
+	metadataTimeout         = 2 * time.Second
+)
+
+var dlog = logrus.WithField("component", "ClusterNameDetector")
+
+// Detector detects the cluster name, trying the following sources in order:
+// 1. The `cluster_name` key of the configured ConfigMap.
+// 2. The cloud provider instance metadata (GKE, EKS and AKS).
+// 3. The UID of the kube-system namespace.
+type Detector struct {
+	client     kubernetes.Interface
+	httpClient *http.Client
+	// configMap is the ConfigMap holding the cluster name, in the
+	// `namespace/name` format. It's not used if empty.
+	configMap string
+
+	gceMetadataURL   string
+	awsMetadataURL   string
+	azureMetadataURL string
+}
+
+// NewDetector returns a Detector that uses the given client to query the
+// Kubernetes API. The configMap is optional.
+func NewDetector(client kubernetes.Interface, configMap string) *Detector {
+	return &Detector{
+		client:           client,
+		httpClient:       &http.Client{Timeout: metadataTimeout},
+		configMap:        configMap,
+		gceMetadataURL:   defaultGCEMetadataURL,
+		awsMetadataURL:   defaultAWSMetadataURL,
+		azureMetadataURL: defaultAzureMetadataURL,
+	}
+}
+
+type source struct {
+	name   string
+	detect func() (string, error)
+}
+
+// Detect returns the detected cluster name and the source it was detected
+// from.
+func (d *Detector) Detect() (string, string, error) {
+	sources := []source{
+		{"configmap", d.fromConfigMap},
+		{"gke", d.fromGCE},
+		{"eks", d.fromAWS},
+		{"aks", d.fromAzure},
+		{"kube-system-uid", d.fromKubeSystemUID},
+	}
+	for _, s := range sources {
+		name, err := s.detect()
+		if err != nil {
+			dlog.WithError(err).WithField("source", s.name).Debug("couldn't detect cluster name")
+			continue
+		}
+		if name != "" {
+			return name, s.name, nil
+		}
+	}
+	return "", "", errors.New("couldn't detect the cluster name from any source")
+}
+
+func (d *Detector) fromConfigMap() (string, error) {
+	if d.configMap == "" {
+		return "", nil
+	}
+	parts := strings.SplitN(d.configMap, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid ConfigMap %q, expected namespace/name", d.configMap)
+	}
+	cm, err := d.client.CoreV1().ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(cm.Data[ConfigMapKey]), nil
+}
+
+func (d *Detector) fromKubeSystemUID() (string, error) {
+	ns, err := d.client.CoreV1().Namespaces().Get("kube-system", metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return string(ns.UID), nil
+}
+
+func (d *Detector) fromGCE() (string, error) {
+	req, err := http.NewRequest("GET", d.gceMetadataURL+"/computeMetadata/v1/instance/attributes/cluster-name", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return d.metadata(req)
+}
+
+func (d *Detector) fromAWS() (string, error) {
+	// IMDSv2 requires a session token for every metadata request.
+	req, err := http.NewRequest("PUT", d.awsMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := d.metadata(req)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequest("GET", d.awsMetadataURL+"/latest/meta-data/tags/instance/eks:cluster-name", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return d.metadata(req)
+}
+
+// azureClusterNameTag is the tag AKS sets on the virtual machines of the
+// nodes with the name of their cluster.
+const azureClusterNameTag = "aks-managed-cluster-name"
+
+// fromAzure reads the cluster name from the tags AKS sets on the nodes, as
+// the names of the node resource groups can be customized and the cluster
+// names can hold underscores.
+func (d *Detector) fromAzure() (string, error) {
+	req, err := http.NewRequest("GET", d.azureMetadataURL+"/metadata/instance/compute/tagsList?api-version=2021-02-01", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	body, err := d.metadata(req)
+	if err != nil {
+		return "", err
+	}
+	var tags []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(body), &tags); err != nil {
+		return "", fmt.Errorf("decoding the tags of the instance: %w", err)
+	}
+	for _, tag := range tags {
+		if tag.Name == azureClusterNameTag {
+			return tag.Value, nil
+		}
+	}
+	return "", fmt.Errorf("the instance has no %s tag, it's not an AKS node", azureClusterNameTag)
+}
+
+func (d *Detector) metadata(req *http.Request) (string, error) {
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata request %s returned status %d", req.URL, resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
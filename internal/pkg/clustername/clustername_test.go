@@ -0,0 +1,104 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package clustername
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestDetector(ts *httptest.Server, configMap string) *Detector {
+	client := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: types.UID("1234-abcd")}},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster-info", Namespace: "default"},
+			Data:       map[string]string{ConfigMapKey: "from-configmap"},
+		},
+	)
+	d := NewDetector(client, configMap)
+	d.gceMetadataURL = ts.URL + "/gce"
+	d.awsMetadataURL = ts.URL + "/aws"
+	d.azureMetadataURL = ts.URL + "/azure"
+	return d
+}
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		name       string
+		configMap  string
+		metadata   map[string]string
+		wantName   string
+		wantSource string
+	}{
+		{
+			name:       "configmap",
+			configMap:  "default/cluster-info",
+			metadata:   map[string]string{"/gce/computeMetadata/v1/instance/attributes/cluster-name": "gke-cluster"},
+			wantName:   "from-configmap",
+			wantSource: "configmap",
+		},
+		{
+			name:       "gke",
+			metadata:   map[string]string{"/gce/computeMetadata/v1/instance/attributes/cluster-name": "gke-cluster"},
+			wantName:   "gke-cluster",
+			wantSource: "gke",
+		},
+		{
+			name: "eks",
+			metadata: map[string]string{
+				"/aws/latest/api/token":                                "token",
+				"/aws/latest/meta-data/tags/instance/eks:cluster-name": "eks-cluster",
+			},
+			wantName:   "eks-cluster",
+			wantSource: "eks",
+		},
+		{
+			name:       "aks",
+			metadata:   map[string]string{"/azure/metadata/instance/compute/tagsList": `[{"name":"aks-managed-poolName","value":"nodepool1"},{"name":"aks-managed-cluster-name","value":"aks_cluster"}]`},
+			wantName:   "aks_cluster",
+			wantSource: "aks",
+		},
+		{
+			name:       "azure without aks tags",
+			metadata:   map[string]string{"/azure/metadata/instance/compute/tagsList": `[{"name":"env","value":"prod"}]`},
+			wantName:   "1234-abcd",
+			wantSource: "kube-system-uid",
+		},
+		{
+			name:       "kube-system uid",
+			wantName:   "1234-abcd",
+			wantSource: "kube-system-uid",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				v, ok := c.metadata[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if r.URL.Path == "/aws/latest/meta-data/tags/instance/eks:cluster-name" && r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				_, _ = w.Write([]byte(v))
+			}))
+			defer ts.Close()
+			d := newTestDetector(ts, c.configMap)
+
+			name, source, err := d.Detect()
+			require.NoError(t, err)
+			assert.Equal(t, c.wantName, name)
+			assert.Equal(t, c.wantSource, source)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Package cpuquota detects the CPU limit of the container the integration
+// runs in, from the CFS quota of its cgroup.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package cpuquota
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// cgroupV1Dirs are the directories where the cpu controller can be mounted
+// in cgroup v1.
+var cgroupV1Dirs = []string{"cpu", "cpu,cpuacct", "cpuacct,cpu"}
+
+// Limit returns the number of CPUs the container is limited to. It returns
+// false if the container has no CPU limit or it can't be determined. The
+// cgroup of the container is expected to be mounted at /sys/fs/cgroup, as
+// it is in containers with their own cgroup namespace.
+func Limit() (float64, bool, error) {
+	return limit(defaultCgroupRoot)
+}
+
+func limit(root string) (float64, bool, error) {
+	// cgroup v2 exposes the quota and the period in a single file.
+	content, err := ioutil.ReadFile(filepath.Join(root, "cpu.max"))
+	if err == nil {
+		fields := strings.Fields(string(content))
+		if len(fields) != 2 {
+			return 0, false, fmt.Errorf("unexpected cpu.max format: %q", content)
+		}
+		return quota(fields[0], fields[1])
+	}
+	if !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	for _, dir := range cgroupV1Dirs {
+		quotaContent, err := ioutil.ReadFile(filepath.Join(root, dir, "cpu.cfs_quota_us"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		periodContent, err := ioutil.ReadFile(filepath.Join(root, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			return 0, false, err
+		}
+		return quota(strings.TrimSpace(string(quotaContent)), strings.TrimSpace(string(periodContent)))
+	}
+	return 0, false, nil
+}
+
+// quota returns the CPUs of the CFS quota and period. A quota of "max" or -1
+// means no limit.
+func quota(quotaValue, periodValue string) (float64, bool, error) {
+	if quotaValue == "max" || quotaValue == "-1" {
+		return 0, false, nil
+	}
+	q, err := strconv.ParseFloat(quotaValue, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid CPU quota %q: %w", quotaValue, err)
+	}
+	p, err := strconv.ParseFloat(periodValue, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid CPU period %q: %w", periodValue, err)
+	}
+	if q <= 0 || p <= 0 {
+		return 0, false, nil
+	}
+	return q / p, true, nil
+}
+
+// GOMAXPROCS returns the GOMAXPROCS value for the CPU limit: the whole CPUs
+// of the limit, and never less than 1.
+func GOMAXPROCS(cpus float64) int {
+	procs := int(math.Floor(cpus))
+	if procs < 1 {
+		return 1
+	}
+	return procs
+}
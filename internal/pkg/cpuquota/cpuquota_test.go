@@ -0,0 +1,62 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package cpuquota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "cgroup")
+	require.NoError(t, err)
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
+
+func TestLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		cpus    float64
+		limited bool
+	}{
+		{"v2 limited", map[string]string{"cpu.max": "50000 100000\n"}, 0.5, true},
+		{"v2 unlimited", map[string]string{"cpu.max": "max 100000\n"}, 0, false},
+		{"v1 limited", map[string]string{
+			"cpu,cpuacct/cpu.cfs_quota_us":  "250000\n",
+			"cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+		}, 2.5, true},
+		{"v1 unlimited", map[string]string{
+			"cpu/cpu.cfs_quota_us":  "-1\n",
+			"cpu/cpu.cfs_period_us": "100000\n",
+		}, 0, false},
+		{"no cgroup", map[string]string{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeFiles(t, tt.files)
+			defer os.RemoveAll(root)
+
+			cpus, limited, err := limit(root)
+			require.NoError(t, err)
+			assert.Equal(t, tt.limited, limited)
+			assert.Equal(t, tt.cpus, cpus)
+		})
+	}
+}
+
+func TestGOMAXPROCS(t *testing.T) {
+	assert.Equal(t, 1, GOMAXPROCS(0.5))
+	assert.Equal(t, 2, GOMAXPROCS(2.5))
+	assert.Equal(t, 4, GOMAXPROCS(4))
+}
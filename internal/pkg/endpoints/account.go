@@ -0,0 +1,65 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+const (
+	// accountLabel routes the metrics of the targets of the object to the
+	// telemetry emitters of the account it names, e.g. of the team owning
+	// the object in a shared cluster. It's only honored for the accounts
+	// allowed to the namespace of the object by WithAccountNamespaces.
+	accountLabel = "newrelic.io/account"
+
+	// AccountLabel is the label set on the targets of the objects annotated
+	// with an account, which holds its name.
+	AccountLabel = "newrelicAccount"
+)
+
+// WithAccountNamespaces sets the accounts the objects of each namespace can
+// route their metrics to with the accountLabel. Any namespace could
+// otherwise send its metrics to the account of another team, so the label
+// of the objects of the namespaces without the account is ignored.
+func WithAccountNamespaces(accounts map[string][]string) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.accountNamespaces = accounts
+		return nil
+	}
+}
+
+// accountAllowed returns true if the objects of the namespace of the object
+// can route their metrics to the account.
+func (k *KubernetesTargetRetriever) accountAllowed(o metav1.Object, account string) bool {
+	for _, allowed := range k.accountNamespaces[o.GetNamespace()] {
+		if allowed == account {
+			return true
+		}
+	}
+	return false
+}
+
+// setAccount sets the account of the annotation or the label of the object
+// on its targets, if any and allowed to its namespace.
+func (k *KubernetesTargetRetriever) setAccount(o metav1.Object, targets []Target) {
+	account := objectLabel(o, accountLabel)
+	if account == "" {
+		return
+	}
+	if !k.accountAllowed(o, account) {
+		klog.WithFields(logrus.Fields{"object": o.GetName(), "namespace": o.GetNamespace(), "account": account}).
+			Warnf("ignoring %s, the account isn't allowed to the namespace by kubernetes_account_namespaces", accountLabel)
+		return
+	}
+	for i := range targets {
+		if targets[i].Object.Labels == nil {
+			targets[i].Object.Labels = labels.Set{}
+		}
+		targets[i].Object.Labels[AccountLabel] = account
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestObjectTargetsAccount(t *testing.T) {
+	ktr := newFakeKubernetesTargetRetriever(nil)
+	require.NoError(t, WithAccountNamespaces(map[string][]string{"test-ns": {"team-a"}})(ktr))
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-service",
+			Namespace:   "test-ns",
+			Annotations: map[string]string{"newrelic.io/account": "team-a"},
+		},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 8080}, {Port: 9090}}},
+	}
+
+	targets := ktr.objectTargets(svc)
+	require.Len(t, targets, 2)
+	for _, target := range targets {
+		assert.Equal(t, "team-a", target.Metadata()[AccountLabel])
+	}
+
+	svc.Annotations = nil
+	targets = ktr.objectTargets(svc)
+	require.Len(t, targets, 2)
+	assert.NotContains(t, targets[0].Metadata(), AccountLabel)
+}
+
+func TestObjectTargetsAccount_NotAllowed(t *testing.T) {
+	ktr := newFakeKubernetesTargetRetriever(nil)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-service",
+			Namespace:   "test-ns",
+			Annotations: map[string]string{"newrelic.io/account": "team-b"},
+		},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 8080}}},
+	}
+
+	targets := ktr.objectTargets(svc)
+	require.Len(t, targets, 1)
+	assert.NotContains(t, targets[0].Metadata(), AccountLabel, "the annotation is ignored without kubernetes_account_namespaces")
+
+	require.NoError(t, WithAccountNamespaces(map[string][]string{
+		"test-ns":  {"team-a"},
+		"other-ns": {"team-b"},
+	})(ktr))
+	targets = ktr.objectTargets(svc)
+	require.Len(t, targets, 1)
+	assert.NotContains(t, targets[0].Metadata(), AccountLabel, "the account isn't allowed to the namespace")
+}
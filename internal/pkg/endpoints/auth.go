@@ -0,0 +1,212 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const maskedSecret = "****"
+
+const (
+	// bearerTokenLabel is the bearer token the targets of the object are
+	// scraped with.
+	bearerTokenLabel = "prometheus.io/bearer-token"
+	// bearerTokenFileLabel is the file of the bearer token, relative to the
+	// credentials directory.
+	bearerTokenFileLabel = "prometheus.io/bearer-token-file"
+	// basicAuthUsernameLabel, basicAuthPasswordLabel and
+	// basicAuthPasswordFileLabel are the basic auth credentials the targets
+	// of the object are scraped with. The password file is relative to the
+	// credentials directory.
+	basicAuthUsernameLabel     = "prometheus.io/basic-auth-username"
+	basicAuthPasswordLabel     = "prometheus.io/basic-auth-password"
+	basicAuthPasswordFileLabel = "prometheus.io/basic-auth-password-file"
+)
+
+// Secret is a credential that is masked when printed using standard
+// formatters, so it's not logged with the configuration.
+type Secret string
+
+// String ensures that the Secret will be masked in functions like fmt.Println(secret)
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return maskedSecret
+}
+
+// GoString ensures that the Secret will be masked in functions like fmt.Printf("%#v", secret)
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// BasicAuthConfig are the basic auth credentials of a target. The
+// PasswordFile is read for every request, and takes precedence over the
+// Password.
+type BasicAuthConfig struct {
+	Username     string `mapstructure:"username"`
+	Password     Secret `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"`
+}
+
+// IsEmpty returns true if no basic auth credentials are sent.
+func (c BasicAuthConfig) IsEmpty() bool {
+	return c.Username == ""
+}
+
+// Validate returns an error if a password is set without a username.
+func (c BasicAuthConfig) Validate() error {
+	if c.Username == "" && (c.Password != "" || c.PasswordFile != "") {
+		return errors.New("basic_auth requires a username")
+	}
+	return nil
+}
+
+// SigV4Config signs the requests with AWS Signature Version 4, like the
+// ones to Amazon Managed Service for Prometheus or to the exporters behind
+// an ALB with IAM authentication. Without AccessKey, the credentials are
+// the ones of the default AWS credential chain: the environment variables,
+// the web identity token of the IAM role of the service account, the
+// container credentials and the role of the EC2 instance.
+type SigV4Config struct {
+	Region string `mapstructure:"region"`
+	// Service defaults to aps, the one of Amazon Managed Service for
+	// Prometheus.
+	Service   string `mapstructure:"service"`
+	AccessKey string `mapstructure:"access_key"`
+	SecretKey Secret `mapstructure:"secret_key"`
+}
+
+// IsEmpty returns true if the requests aren't signed.
+func (c SigV4Config) IsEmpty() bool {
+	return c == SigV4Config{}
+}
+
+// Validate returns an error if the region is missing, or only one of the
+// access and secret keys is set.
+func (c SigV4Config) Validate() error {
+	if c.IsEmpty() {
+		return nil
+	}
+	if c.Region == "" {
+		return errors.New("sigv4 requires a region")
+	}
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return errors.New("sigv4 access_key and secret_key must be set together")
+	}
+	return nil
+}
+
+// AzureADConfig requests Azure AD tokens for the scrapes, sent as bearer
+// tokens, like for the targets behind App Service authentication or an
+// ingress protected by Azure AD. The tokens are requested with the client
+// credentials if TenantID is set, or else with the managed identity of the
+// host, the user-assigned one of ClientID if set. They're cached until they
+// are about to expire.
+type AzureADConfig struct {
+	// Resource is the application ID URI of the target, like
+	// api://exporter, the tokens are requested for.
+	Resource string `mapstructure:"resource"`
+	ClientID string `mapstructure:"client_id"`
+	TenantID string `mapstructure:"tenant_id"`
+	// ClientSecretFile is read for every token request, and takes
+	// precedence over the ClientSecret.
+	ClientSecret     Secret `mapstructure:"client_secret"`
+	ClientSecretFile string `mapstructure:"client_secret_file"`
+	// AuthorityHost defaults to https://login.microsoftonline.com, and is
+	// replaced for the national clouds.
+	AuthorityHost string `mapstructure:"authority_host"`
+}
+
+// IsEmpty returns true if no Azure AD token is requested.
+func (c AzureADConfig) IsEmpty() bool {
+	return c == AzureADConfig{}
+}
+
+// Validate returns an error if the resource is missing, or the client
+// credentials are incomplete.
+func (c AzureADConfig) Validate() error {
+	if c.IsEmpty() {
+		return nil
+	}
+	if c.Resource == "" {
+		return errors.New("azure_ad requires a resource")
+	}
+	hasSecret := c.ClientSecret != "" || c.ClientSecretFile != ""
+	if c.TenantID != "" && (c.ClientID == "" || !hasSecret) {
+		return errors.New("azure_ad client credentials require a client_id and a client_secret or client_secret_file")
+	}
+	if c.TenantID == "" && hasSecret {
+		return errors.New("azure_ad client credentials require a tenant_id")
+	}
+	return nil
+}
+
+// WithCredentialsDir sets the directory the credential files of the
+// annotations of the objects are relative to, like the mount of a secret.
+// The files of the objects of a namespace are in its <namespace>
+// subdirectory, so the annotations can't reference the files of other
+// namespaces, nor files outside of the directory. Their file references
+// are ignored without it.
+func WithCredentialsDir(dir string) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.credentialsDir = dir
+		return nil
+	}
+}
+
+// objectAuth returns the authentication method of the annotations or the
+// labels of the object, if any. Annotations take precedence over labels, and
+// the service account auth, of the objects it's allowed for, over the
+// credentials.
+func (k *KubernetesTargetRetriever) objectAuth(o metav1.Object) (AuthConfig, bool) {
+	if objectLabel(o, serviceAccountAuthLabel) == trueStr {
+		if k.serviceAccountAuthAllowed(o) {
+			return ServiceAccountAuth(), true
+		}
+		klog.WithFields(logrus.Fields{"object": o.GetName(), "namespace": o.GetNamespace()}).
+			Warnf("ignoring %s, the object isn't allowed by kubernetes_service_account_auth", serviceAccountAuthLabel)
+	}
+	auth := AuthConfig{
+		BearerTokenFile: k.credentialsFile(o, bearerTokenFileLabel),
+		BearerToken:     Secret(objectLabel(o, bearerTokenLabel)),
+		BasicAuth: BasicAuthConfig{
+			Username:     objectLabel(o, basicAuthUsernameLabel),
+			Password:     Secret(objectLabel(o, basicAuthPasswordLabel)),
+			PasswordFile: k.credentialsFile(o, basicAuthPasswordFileLabel),
+		},
+	}
+	if err := auth.Validate(); err != nil {
+		klog.WithError(err).WithField("object", o.GetName()).Warn("ignoring the credentials of the object")
+		return AuthConfig{}, false
+	}
+	return auth, auth.BearerTokenFile != "" || auth.BearerToken != "" || !auth.BasicAuth.IsEmpty()
+}
+
+// credentialsFile returns the path of the credential file of the label of
+// the object in the directory of its namespace in the credentials
+// directory, or an empty string if it has no such label or there's no
+// credentials directory. The files of the cluster scoped objects, which
+// only the cluster administrators annotate, are in the credentials
+// directory itself.
+func (k *KubernetesTargetRetriever) credentialsFile(o metav1.Object, label string) string {
+	name := objectLabel(o, label)
+	if name == "" {
+		return ""
+	}
+	if k.credentialsDir == "" {
+		klog.WithField("object", o.GetName()).Warnf("ignoring %s, kubernetes_credentials_dir is not configured", label)
+		return ""
+	}
+	// Cleaning the name as an absolute path removes the parent references,
+	// so it's always in the directory of the namespace, whose name can't
+	// have any.
+	return filepath.Join(k.credentialsDir, o.GetNamespace(), filepath.Clean("/"+name))
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSecret(t *testing.T) {
+	auth := AuthConfig{BearerToken: "token", BasicAuth: BasicAuthConfig{Username: "user", Password: "password"}}
+	for _, format := range []string{"%v", "%+v", "%#v"} {
+		printed := fmt.Sprintf(format, auth)
+		assert.NotContains(t, printed, "token")
+		assert.NotContains(t, printed, "password")
+		assert.Contains(t, printed, maskedSecret)
+	}
+	assert.Equal(t, "", Secret("").String())
+}
+
+func TestEndpointToTargetAuthValidation(t *testing.T) {
+	_, err := EndpointToTarget(TargetConfig{
+		URLs: []string{"exporter:9100"},
+		Auth: []AuthConfig{{BasicAuth: BasicAuthConfig{Password: "password"}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestEndpointToTargetServiceAccountAuth(t *testing.T) {
+	targets, err := EndpointToTarget(TargetConfig{
+		URLs:               []string{"https://kubelet:10250/metrics/cadvisor"},
+		ServiceAccountAuth: true,
+		Auth:               []AuthConfig{{BearerTokenFile: "/etc/kubelet/token"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, []AuthConfig{ServiceAccountAuth(), {BearerTokenFile: "/etc/kubelet/token"}}, targets[0].Auth,
+		"the service account is tried first")
+}
+
+func TestSigV4ConfigValidate(t *testing.T) {
+	assert.NoError(t, SigV4Config{}.Validate())
+	assert.NoError(t, SigV4Config{Region: "us-east-1"}.Validate())
+	assert.NoError(t, SigV4Config{Region: "us-east-1", AccessKey: "AKID", SecretKey: "secret"}.Validate())
+	assert.Error(t, SigV4Config{Service: "execute-api"}.Validate(), "the region is missing")
+	assert.Error(t, SigV4Config{Region: "us-east-1", AccessKey: "AKID"}.Validate(), "the secret key is missing")
+}
+
+func TestAzureADConfigValidate(t *testing.T) {
+	assert.NoError(t, AzureADConfig{}.Validate())
+	assert.NoError(t, AzureADConfig{Resource: "api://exporter"}.Validate())
+	assert.NoError(t, AzureADConfig{Resource: "api://exporter", ClientID: "identity"}.Validate())
+	assert.NoError(t, AzureADConfig{Resource: "api://exporter", TenantID: "tenant", ClientID: "app", ClientSecretFile: "/etc/secret"}.Validate())
+	assert.Error(t, AzureADConfig{ClientID: "identity"}.Validate(), "the resource is missing")
+	assert.Error(t, AzureADConfig{Resource: "api://exporter", TenantID: "tenant", ClientID: "app"}.Validate(), "the secret is missing")
+	assert.Error(t, AzureADConfig{Resource: "api://exporter", ClientID: "app", ClientSecret: "secret"}.Validate(), "the tenant is missing")
+}
+
+func TestObjectAuth(t *testing.T) {
+	pod := func(annotations map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "shop", Annotations: annotations}}
+	}
+	cases := []struct {
+		name           string
+		credentialsDir string
+		annotations    map[string]string
+		expected       AuthConfig
+		ok             bool
+	}{
+		{
+			name: "no credentials",
+		},
+		{
+			name:        "inline bearer token",
+			annotations: map[string]string{"prometheus.io/bearer-token": "token"},
+			expected:    AuthConfig{BearerToken: "token"},
+			ok:          true,
+		},
+		{
+			name:           "token file in the credentials dir",
+			credentialsDir: "/etc/credentials",
+			annotations:    map[string]string{"prometheus.io/bearer-token-file": "../../etc/passwd"},
+			expected:       AuthConfig{BearerTokenFile: "/etc/credentials/shop/etc/passwd"},
+			ok:             true,
+		},
+		{
+			name:        "token file without credentials dir",
+			annotations: map[string]string{"prometheus.io/bearer-token-file": "token"},
+		},
+		{
+			name:           "basic auth",
+			credentialsDir: "/etc/credentials",
+			annotations: map[string]string{
+				"prometheus.io/basic-auth-username":      "prometheus",
+				"prometheus.io/basic-auth-password-file": "app/password",
+			},
+			expected: AuthConfig{BasicAuth: BasicAuthConfig{Username: "prometheus", PasswordFile: "/etc/credentials/shop/app/password"}},
+			ok:       true,
+		},
+		{
+			name:        "basic auth without username",
+			annotations: map[string]string{"prometheus.io/basic-auth-password": "password"},
+		},
+		{
+			name: "service account",
+			annotations: map[string]string{
+				"prometheus.io/service-account-auth": "true",
+				"prometheus.io/bearer-token":         "token",
+			},
+			expected: AuthConfig{
+				TLSConfig:       TLSConfig{CaFilePath: "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"},
+				BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			},
+			ok: true,
+		},
+		{
+			name:        "service account disabled",
+			annotations: map[string]string{"prometheus.io/service-account-auth": "false"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ktr := newFakeKubernetesTargetRetriever(nil)
+			require.NoError(t, WithCredentialsDir(c.credentialsDir)(ktr))
+			require.NoError(t, WithServiceAccountAuth(ServiceAccountAuthConfig{Namespaces: []string{"shop"}})(ktr))
+			auth, ok := ktr.objectAuth(pod(c.annotations))
+			assert.Equal(t, c.ok, ok)
+			assert.Equal(t, c.expected, auth)
+		})
+	}
+}
+
+func TestObjectTargetsAuth(t *testing.T) {
+	ktr := newFakeKubernetesTargetRetriever(nil)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-service",
+			Namespace:   "test-ns",
+			Annotations: map[string]string{"prometheus.io/bearer-token": "token"},
+		},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 8080}}},
+	}
+
+	targets := ktr.objectTargets(svc)
+	require.Len(t, targets, 1)
+	assert.Equal(t, []AuthConfig{{BearerToken: "token"}}, targets[0].Auth)
+}
+
+func TestObjectAuth_ServiceAccountAllowed(t *testing.T) {
+	pod := func(namespace string, labels map[string]string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pod",
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: map[string]string{"prometheus.io/service-account-auth": "true", "prometheus.io/bearer-token": "token"},
+		}}
+	}
+	ktr := newFakeKubernetesTargetRetriever(nil)
+
+	auth, ok := ktr.objectAuth(pod("kube-system", nil))
+	assert.True(t, ok)
+	assert.Equal(t, AuthConfig{BearerToken: "token"}, auth, "the annotation is ignored without an allowlist")
+
+	require.NoError(t, WithServiceAccountAuth(ServiceAccountAuthConfig{Namespaces: []string{"kube-system"}, Selector: "app=metrics-server"})(ktr))
+	auth, _ = ktr.objectAuth(pod("kube-system", nil))
+	assert.Equal(t, ServiceAccountAuth(), auth, "the namespace is allowed")
+	auth, _ = ktr.objectAuth(pod("monitoring", map[string]string{"app": "metrics-server"}))
+	assert.Equal(t, ServiceAccountAuth(), auth, "the labels match the selector")
+	auth, _ = ktr.objectAuth(pod("shop", map[string]string{"app": "cart"}))
+	assert.Equal(t, AuthConfig{BearerToken: "token"}, auth)
+
+	assert.Error(t, WithServiceAccountAuth(ServiceAccountAuthConfig{Selector: "app in ("})(ktr))
+}
@@ -0,0 +1,254 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var clog = logrus.WithField("component", "TargetCache")
+
+// cachedTarget is the on-disk representation of a Target. The credentials of
+// the URL and the inline secrets of the auth methods aren't persisted, only
+// the files and environment variables they're read from: the targets that
+// need them are Redacted, and aren't served from the cache.
+type cachedTarget struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Object      Object    `json:"object"`
+	TLSConfig   TLSConfig `json:"tls_config"`
+	ClusterName string    `json:"cluster_name,omitempty"`
+	// ScrapeTimeout is in nanoseconds.
+	ScrapeTimeout  time.Duration  `json:"scrape_timeout,omitempty"`
+	SchemeFallback SchemeFallback `json:"scheme_fallback,omitempty"`
+	Auth           []AuthConfig   `json:"auth,omitempty"`
+	MetricFilter   *MetricFilter  `json:"metric_filter,omitempty"`
+	Redacted       bool           `json:"redacted,omitempty"`
+}
+
+// cachedRetriever wraps a TargetRetriever and persists the last known list of
+// targets to disk. On start, the persisted targets are served while the
+// wrapped retriever warms up, so scraping can begin even if the discovery
+// backend is degraded.
+type cachedRetriever struct {
+	retriever     TargetRetriever
+	file          string
+	warmupTimeout time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	warm    bool
+	cached  []Target
+	written []byte
+}
+
+// CachedRetriever returns a TargetRetriever that persists the targets returned
+// by the given retriever into cacheFile. Until the wrapped retriever returns
+// targets for the first time, or the warmupTimeout elapses, the targets
+// loaded from cacheFile are returned instead.
+func CachedRetriever(retriever TargetRetriever, cacheFile string, warmupTimeout time.Duration) TargetRetriever {
+	return &cachedRetriever{
+		retriever:     retriever,
+		file:          cacheFile,
+		warmupTimeout: warmupTimeout,
+	}
+}
+
+// Watch loads the persisted targets and starts the wrapped retriever. When
+// persisted targets are available the wrapped retriever is started in
+// background so its initial discovery doesn't delay the first scrape.
+func (c *cachedRetriever) Watch() error {
+	c.mu.Lock()
+	c.start = time.Now()
+	cached, err := readTargetCache(c.file)
+	if err != nil {
+		clog.WithError(err).WithField("file", c.file).Warn("couldn't load cached targets, ignoring")
+	}
+	c.cached = cached
+	c.mu.Unlock()
+
+	if len(cached) == 0 {
+		return c.retriever.Watch()
+	}
+
+	clog.WithField("retriever", c.retriever.Name()).Infof("loaded %d cached targets, starting discovery in background", len(cached))
+	go func() {
+		if err := c.retriever.Watch(); err != nil {
+			clog.WithError(err).WithField("retriever", c.retriever.Name()).Error("while getting the initial list of targets")
+		}
+	}()
+	return nil
+}
+
+// Name returns the name of the wrapped retriever.
+func (c *cachedRetriever) Name() string {
+	return c.retriever.Name()
+}
+
+// GetTargets returns the targets of the wrapped retriever, persisting them
+// whenever they change. Cached targets are returned while warming up.
+func (c *cachedRetriever) GetTargets() ([]Target, error) {
+	targets, err := c.retriever.GetTargets()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.warm {
+		if (err == nil && len(targets) > 0) || time.Since(c.start) >= c.warmupTimeout {
+			c.warm = true
+		} else if len(c.cached) > 0 {
+			clog.WithField("retriever", c.retriever.Name()).Debugf("discovery warming up, using %d cached targets", len(c.cached))
+			return c.cached, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.persist(targets); err != nil {
+		clog.WithError(err).WithField("file", c.file).Warn("couldn't persist targets")
+	}
+	c.cached = targets
+	return targets, nil
+}
+
+// persist writes the targets to the cache file if they differ from the ones
+// written last time. The file is replaced atomically.
+func (c *cachedRetriever) persist(targets []Target) error {
+	b, err := encodeTargetCache(targets)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, c.written) {
+		return nil
+	}
+
+	dir := filepath.Dir(c.file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(c.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.file); err != nil {
+		return err
+	}
+	c.written = b
+	return nil
+}
+
+// encodeTargetCache serializes the targets sorted by name and URL, so the
+// same set of targets always produces the same output.
+func encodeTargetCache(targets []Target) ([]byte, error) {
+	cts := make([]cachedTarget, 0, len(targets))
+	for _, t := range targets {
+		u := t.URL
+		redacted := u.User != nil
+		u.User = nil
+		auth, redactedAuth := redactedAuth(t.Auth)
+		ct := cachedTarget{
+			Name:           t.Name,
+			URL:            u.String(),
+			Object:         t.Object,
+			TLSConfig:      t.TLSConfig,
+			ClusterName:    t.ClusterName,
+			ScrapeTimeout:  t.ScrapeTimeout,
+			SchemeFallback: t.SchemeFallback,
+			Auth:           auth,
+			Redacted:       redacted || redactedAuth,
+		}
+		if !t.MetricFilter.IsEmpty() {
+			filter := t.MetricFilter
+			ct.MetricFilter = &filter
+		}
+		cts = append(cts, ct)
+	}
+	sort.Slice(cts, func(i, j int) bool {
+		if cts[i].Name != cts[j].Name {
+			return cts[i].Name < cts[j].Name
+		}
+		return cts[i].URL < cts[j].URL
+	})
+	return json.Marshal(cts)
+}
+
+// readTargetCache reads the targets persisted in the given file. A missing
+// file is not considered an error.
+func readTargetCache(file string) ([]Target, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cts []cachedTarget
+	if err := json.Unmarshal(b, &cts); err != nil {
+		return nil, fmt.Errorf("decoding target cache: %w", err)
+	}
+	targets := make([]Target, 0, len(cts))
+	for _, ct := range cts {
+		if ct.Redacted {
+			clog.WithField("target", ct.Name).Debug("skipping cached target without its credentials")
+			continue
+		}
+		u, err := url.Parse(ct.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cached target URL %q: %w", ct.URL, err)
+		}
+		target := Target{
+			Name:           ct.Name,
+			Object:         ct.Object,
+			URL:            *u,
+			TLSConfig:      ct.TLSConfig,
+			ClusterName:    ct.ClusterName,
+			ScrapeTimeout:  ct.ScrapeTimeout,
+			SchemeFallback: ct.SchemeFallback,
+			Auth:           ct.Auth,
+		}
+		if ct.MetricFilter != nil {
+			target.MetricFilter = *ct.MetricFilter
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// redactedAuth returns the auth methods without their inline secrets, and
+// whether any was removed.
+func redactedAuth(auth []AuthConfig) ([]AuthConfig, bool) {
+	var redacted bool
+	methods := make([]AuthConfig, 0, len(auth))
+	for _, a := range auth {
+		if a.BearerToken != "" || a.BasicAuth.Password != "" || a.SigV4.SecretKey != "" || a.AzureAD.ClientSecret != "" {
+			redacted = true
+		}
+		a.BearerToken, a.BasicAuth.Password, a.SigV4.SecretKey, a.AzureAD.ClientSecret = "", "", "", ""
+		methods = append(methods, a)
+	}
+	return methods, redacted
+}
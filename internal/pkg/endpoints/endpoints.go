@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/newrelic/nri-prometheus/internal/pkg/gateway"
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+	"github.com/newrelic/nri-prometheus/internal/pkg/resolver"
 )
 
 // TargetRetriever is implemented by any type that can return the URL of a set of Prometheus metrics providers
@@ -32,6 +35,37 @@ type Target struct {
 	URL       url.URL
 	metadata  labels.Set
 	TLSConfig TLSConfig
+	// ClusterName is the name of the cluster the target was discovered in,
+	// when it's different from the one the integration is configured with.
+	ClusterName string
+	// MetricFilter drops metrics of this target only, on top of the
+	// configured processing rules.
+	MetricFilter MetricFilter
+	// DNS is the custom DNS configuration used to resolve the target host.
+	DNS resolver.Config
+	// Auth are the authentication methods tried in order, if any.
+	Auth []AuthConfig
+	// Gateway is the host the target is reached through, if any.
+	Gateway gateway.Config
+	// ScrapeTimeout replaces the global scrape timeout for this target, if
+	// greater than 0.
+	ScrapeTimeout time.Duration
+	// SchemeFallback is the policy of the fallback between https and http
+	// of the scrapes of the target.
+	SchemeFallback SchemeFallback
+}
+
+// MetricFilter skips the metrics that match any of the Prefixes. Metrics that
+// match any of the Except are never skipped. If Prefixes is empty and Except
+// is not, then all metrics that do not match Except are skipped.
+type MetricFilter struct {
+	Prefixes []string
+	Except   []string
+}
+
+// IsEmpty returns true if the filter doesn't skip any metric.
+func (f MetricFilter) IsEmpty() bool {
+	return len(f.Prefixes) == 0 && len(f.Except) == 0
 }
 
 // Metadata returns the Target's metadata, if the current metadata is nil,
@@ -68,6 +102,16 @@ func redactedURLString(u *url.URL) string {
 	return ru.String()
 }
 
+// RedactedURL returns the string representation of the URL with its user
+// info, which may hold credentials, redacted, for the URLs shown out of the
+// scrapes.
+func RedactedURL(u url.URL) string {
+	if u.User != nil {
+		u.User = url.User("xxxxx")
+	}
+	return u.String()
+}
+
 // New returns a Target from the discovered information
 func New(name string, addr url.URL, object Object) Target {
 	return Target{
@@ -83,12 +127,42 @@ func New(name string, addr url.URL, object Object) Target {
 // - if no path is provided, it assumes /metrics
 // For example, hostname:8080 will be interpreted as http://hostname:8080/metrics
 func EndpointToTarget(tc TargetConfig) ([]Target, error) {
+	if err := tc.Gateway.Validate(); err != nil {
+		return nil, err
+	}
+	if err := tc.SchemeFallback.Validate(); err != nil {
+		return nil, err
+	}
+	for _, auth := range tc.Auth {
+		if err := auth.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	auth := tc.Auth
+	if tc.ServiceAccountAuth {
+		auth = append([]AuthConfig{ServiceAccountAuth()}, auth...)
+	}
 	targets := make([]Target, 0, len(tc.URLs))
 	for _, URL := range tc.URLs {
 		t, err := urlToTarget(URL, tc.TLSConfig)
 		if err != nil {
 			return nil, err
 		}
+		t.DNS = tc.DNS
+		t.Auth = auth
+		t.Gateway = tc.Gateway
+		t.ScrapeTimeout = tc.ScrapeTimeout
+		t.SchemeFallback = tc.SchemeFallback
+		if len(tc.Params) > 0 {
+			query := t.URL.Query()
+			for k, v := range tc.Params {
+				query[k] = v
+			}
+			t.URL.RawQuery = query.Encode()
+		}
+		if err := applyPreset(&t, tc.Preset); err != nil {
+			return nil, err
+		}
 		targets = append(targets, t)
 	}
 	return targets, nil
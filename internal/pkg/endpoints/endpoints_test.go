@@ -4,6 +4,7 @@ package endpoints
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -62,3 +63,23 @@ func TestFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestEndpointToTargetParams(t *testing.T) {
+	targets, err := EndpointToTarget(TargetConfig{
+		URLs:   []string{"somehost:9100", "otherhost:9100/metrics?debug=1"},
+		Params: map[string][]string{"collect[]": {"cpu", "meminfo"}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, targets, 2)
+	assert.Equal(t, "http://somehost:9100/metrics?collect%5B%5D=cpu&collect%5B%5D=meminfo", targets[0].URL.String())
+	assert.Equal(t, "http://otherhost:9100/metrics?collect%5B%5D=cpu&collect%5B%5D=meminfo&debug=1", targets[1].URL.String())
+}
+
+func TestEndpointToTargetScrapeTimeout(t *testing.T) {
+	targets, err := EndpointToTarget(TargetConfig{
+		URLs:          []string{"federate:9090/federate"},
+		ScrapeTimeout: time.Minute,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, targets[0].ScrapeTimeout)
+}
@@ -0,0 +1,307 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+const (
+	// cmdbHostPlaceholder is replaced by the target host in the CMDB URL.
+	cmdbHostPlaceholder = "{host}"
+	// reverseDNSAttribute is set to the name the target IP resolves to.
+	reverseDNSAttribute = "targetHostname"
+	// enrichmentConcurrency is the number of hosts looked up in parallel.
+	enrichmentConcurrency = 10
+	// enrichmentRetryTTL is how long a failed lookup is cached.
+	enrichmentRetryTTL = time.Minute
+
+	defaultEnrichmentTTL     = time.Hour
+	defaultEnrichmentTimeout = 5 * time.Second
+)
+
+var elog = logrus.WithField("component", "TargetEnrichment")
+
+// EnrichmentConfig configures the attributes added to the targets from
+// lookups of their hosts.
+type EnrichmentConfig struct {
+	// ReverseDNS sets the targetHostname attribute to the name the IP of
+	// the target resolves to.
+	ReverseDNS bool `mapstructure:"reverse_dns"`
+	// CMDBURL is requested for every host, with {host} replaced by the
+	// host of the target. Its response is a JSON object, whose string,
+	// number and boolean values are added as attributes.
+	CMDBURL string `mapstructure:"cmdb_url"`
+	// CMDBAttributes keeps only these attributes of the CMDB responses, if
+	// not empty.
+	CMDBAttributes []string `mapstructure:"cmdb_attributes"`
+	// CacheTTL is how long the attributes of a host are cached. Defaults
+	// to 1h.
+	CacheTTL time.Duration `mapstructure:"cache_ttl"`
+	// Timeout of every lookup. Defaults to 5s.
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// IsEmpty returns true if no lookup is enabled.
+func (c EnrichmentConfig) IsEmpty() bool {
+	return !c.ReverseDNS && c.CMDBURL == ""
+}
+
+// Validate returns an error if the CMDB URL is not valid.
+func (c EnrichmentConfig) Validate() error {
+	if c.CMDBURL == "" {
+		return nil
+	}
+	if !strings.Contains(c.CMDBURL, cmdbHostPlaceholder) {
+		return fmt.Errorf("the CMDB URL must contain the %s placeholder", cmdbHostPlaceholder)
+	}
+	u, err := url.Parse(strings.Replace(c.CMDBURL, cmdbHostPlaceholder, "host", -1))
+	if err != nil {
+		return fmt.Errorf("invalid CMDB URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid CMDB URL %q, it must be an http or https URL", c.CMDBURL)
+	}
+	return nil
+}
+
+// Enricher looks up the attributes of a host.
+type Enricher interface {
+	Enrich(ctx context.Context, host string) (labels.Set, error)
+}
+
+// EnricherFunc is an Enricher function.
+type EnricherFunc func(ctx context.Context, host string) (labels.Set, error)
+
+// Enrich calls the function.
+func (f EnricherFunc) Enrich(ctx context.Context, host string) (labels.Set, error) {
+	return f(ctx, host)
+}
+
+// ReverseDNSEnricher sets the targetHostname attribute of the IP hosts to
+// the first name they resolve to. Hostnames are not looked up.
+func ReverseDNSEnricher() Enricher {
+	return EnricherFunc(func(ctx context.Context, host string) (labels.Set, error) {
+		if net.ParseIP(host) == nil {
+			return nil, nil
+		}
+		names, err := net.DefaultResolver.LookupAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, nil
+		}
+		return labels.Set{reverseDNSAttribute: strings.TrimSuffix(names[0], ".")}, nil
+	})
+}
+
+// CMDBEnricher requests the attributes of the hosts to a CMDB endpoint. The
+// host replaces the {host} placeholder of the URL. If attributes is not
+// empty, only those are kept.
+func CMDBEnricher(client *http.Client, cmdbURL string, attributes []string) Enricher {
+	keep := make(map[string]bool, len(attributes))
+	for _, a := range attributes {
+		keep[a] = true
+	}
+	return EnricherFunc(func(ctx context.Context, host string) (labels.Set, error) {
+		u := strings.Replace(cmdbURL, cmdbHostPlaceholder, url.PathEscape(host), -1)
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("CMDB responded %s", resp.Status)
+		}
+
+		var values map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+			return nil, fmt.Errorf("decoding CMDB response: %w", err)
+		}
+		attrs := labels.Set{}
+		for k, v := range values {
+			if len(keep) > 0 && !keep[k] {
+				continue
+			}
+			switch v.(type) {
+			case string, float64, bool:
+				attrs[k] = v
+			}
+		}
+		return attrs, nil
+	})
+}
+
+// NewEnrichers returns the enrichers of the configuration.
+func NewEnrichers(cfg EnrichmentConfig) []Enricher {
+	var enrichers []Enricher
+	if cfg.ReverseDNS {
+		enrichers = append(enrichers, ReverseDNSEnricher())
+	}
+	if cfg.CMDBURL != "" {
+		enrichers = append(enrichers, CMDBEnricher(&http.Client{}, cfg.CMDBURL, cfg.CMDBAttributes))
+	}
+	return enrichers
+}
+
+type enrichment struct {
+	attrs   labels.Set
+	expires time.Time
+}
+
+// enrichedRetriever wraps a TargetRetriever, adding the attributes looked up
+// by the enrichers to the labels of its targets.
+type enrichedRetriever struct {
+	retriever TargetRetriever
+	enrichers []Enricher
+	ttl       time.Duration
+	timeout   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]enrichment
+	now   func() time.Time
+}
+
+// EnrichedRetriever returns a TargetRetriever adding to the targets of the
+// given retriever the attributes of their hosts looked up by the enrichers.
+// The attributes of every host are cached for the ttl, 1h if 0, and every
+// lookup times out after the timeout, 5s if 0. When a lookup fails,
+// the previous attributes of the host are kept and the lookup is retried a
+// minute later. The attributes of the targets take precedence, and the
+// ones of the first enrichers take precedence over the later ones.
+func EnrichedRetriever(retriever TargetRetriever, ttl, timeout time.Duration, enrichers ...Enricher) TargetRetriever {
+	if ttl == 0 {
+		ttl = defaultEnrichmentTTL
+	}
+	if timeout == 0 {
+		timeout = defaultEnrichmentTimeout
+	}
+	return &enrichedRetriever{
+		retriever: retriever,
+		enrichers: enrichers,
+		ttl:       ttl,
+		timeout:   timeout,
+		cache:     map[string]enrichment{},
+		now:       time.Now,
+	}
+}
+
+// Watch starts the wrapped retriever.
+func (e *enrichedRetriever) Watch() error {
+	return e.retriever.Watch()
+}
+
+// Name returns the name of the wrapped retriever.
+func (e *enrichedRetriever) Name() string {
+	return e.retriever.Name()
+}
+
+// GetTargets returns the targets of the wrapped retriever with the
+// attributes of their hosts. The hosts not cached are looked up in
+// parallel.
+func (e *enrichedRetriever) GetTargets() ([]Target, error) {
+	targets, err := e.retriever.GetTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := map[string]bool{}
+	for _, t := range targets {
+		hosts[t.URL.Hostname()] = true
+	}
+	e.refresh(hosts)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enriched := make([]Target, len(targets))
+	for i, t := range targets {
+		if attrs := e.cache[t.URL.Hostname()].attrs; len(attrs) > 0 {
+			lbls := make(labels.Set, len(t.Object.Labels)+len(attrs))
+			labels.Accumulate(lbls, t.Object.Labels)
+			labels.Accumulate(lbls, attrs)
+			t.Object.Labels = lbls
+			t.metadata = nil
+		}
+		enriched[i] = t
+	}
+	return enriched, nil
+}
+
+// refresh looks up the hosts whose attributes are not cached or expired.
+func (e *enrichedRetriever) refresh(hosts map[string]bool) {
+	now := e.now()
+	var expired []string
+	e.mu.Lock()
+	for host := range hosts {
+		if entry, ok := e.cache[host]; !ok || !now.Before(entry.expires) {
+			expired = append(expired, host)
+		}
+	}
+	e.mu.Unlock()
+
+	sem := make(chan struct{}, enrichmentConcurrency)
+	var wg sync.WaitGroup
+	for _, host := range expired {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(host string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			attrs, err := e.lookup(host)
+
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			if err != nil {
+				elog.WithError(err).WithField("host", host).Warn("looking up target attributes, retrying in a minute")
+				entry := e.cache[host]
+				entry.expires = now.Add(enrichmentRetryTTL)
+				e.cache[host] = entry
+				return
+			}
+			e.cache[host] = enrichment{attrs: attrs, expires: now.Add(e.ttl)}
+		}(host)
+	}
+	wg.Wait()
+}
+
+// lookup returns the attributes of the host of all the enrichers. It fails
+// if any of them fails.
+func (e *enrichedRetriever) lookup(host string) (labels.Set, error) {
+	attrs := labels.Set{}
+	for _, enricher := range e.enrichers {
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		enricherAttrs, err := enricher.Enrich(ctx, host)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		labels.Accumulate(attrs, enricherAttrs)
+	}
+	return attrs, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+func TestEnrichedRetriever(t *testing.T) {
+	targets, err := EndpointToTarget(TargetConfig{URLs: []string{"10.0.0.1:9100", "10.0.0.1:9200", "10.0.0.2:9100"}})
+	require.NoError(t, err)
+	targets[0].Object.Labels["rack"] = "own"
+
+	var lookups int32
+	fail := false
+	first := EnricherFunc(func(ctx context.Context, host string) (labels.Set, error) {
+		atomic.AddInt32(&lookups, 1)
+		if fail {
+			return nil, errors.New("CMDB down")
+		}
+		return labels.Set{"datacenter": "dc-" + host, "rack": "r1"}, nil
+	})
+	second := EnricherFunc(func(ctx context.Context, host string) (labels.Set, error) {
+		return labels.Set{"datacenter": "ignored", "owner": "team-a"}, nil
+	})
+
+	now := time.Now()
+	retriever := EnrichedRetriever(&fakeRetriever{targets: targets}, time.Hour, time.Second, first, second).(*enrichedRetriever)
+	retriever.now = func() time.Time { return now }
+
+	enriched, err := retriever.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, enriched, 3)
+	assert.Equal(t, labels.Set{"datacenter": "dc-10.0.0.1", "rack": "own", "owner": "team-a"}, enriched[0].Object.Labels,
+		"the labels of the targets and of the first enrichers take precedence")
+	assert.Equal(t, "dc-10.0.0.1", enriched[1].Metadata()["datacenter"])
+	assert.Equal(t, "dc-10.0.0.2", enriched[2].Metadata()["datacenter"])
+	assert.Equal(t, labels.Set{"rack": "own"}, targets[0].Object.Labels, "the wrapped targets are not modified")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lookups), "hosts are looked up once")
+
+	_, err = retriever.GetTargets()
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&lookups), "attributes are cached")
+
+	fail = true
+	now = now.Add(time.Hour)
+	enriched, err = retriever.GetTargets()
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&lookups), "expired attributes are looked up again")
+	assert.Equal(t, "dc-10.0.0.2", enriched[2].Metadata()["datacenter"], "attributes are kept when the lookup fails")
+
+	fail = false
+	now = now.Add(time.Minute)
+	_, err = retriever.GetTargets()
+	require.NoError(t, err)
+	assert.Equal(t, int32(6), atomic.LoadInt32(&lookups), "failed lookups are retried a minute later")
+}
+
+func TestCMDBEnricher(t *testing.T) {
+	cmdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosts/10.0.0.1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"datacenter": "eu-1", "rack": 12, "owner": "team-a", "tags": ["a"]}`))
+	}))
+	defer cmdb.Close()
+
+	enricher := CMDBEnricher(http.DefaultClient, cmdb.URL+"/hosts/{host}", nil)
+	attrs, err := enricher.Enrich(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, labels.Set{"datacenter": "eu-1", "rack": float64(12), "owner": "team-a"}, attrs)
+
+	attrs, err = enricher.Enrich(context.Background(), "10.0.0.2")
+	require.NoError(t, err)
+	assert.Empty(t, attrs, "unknown hosts have no attributes")
+
+	attrs, err = CMDBEnricher(http.DefaultClient, cmdb.URL+"/hosts/{host}", []string{"owner"}).Enrich(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, labels.Set{"owner": "team-a"}, attrs)
+}
+
+func TestEnrichmentConfig_Validate(t *testing.T) {
+	assert.NoError(t, EnrichmentConfig{ReverseDNS: true}.Validate())
+	assert.NoError(t, EnrichmentConfig{CMDBURL: "https://cmdb/api/hosts/{host}"}.Validate())
+	assert.Error(t, EnrichmentConfig{CMDBURL: "https://cmdb/api/hosts"}.Validate())
+	assert.Error(t, EnrichmentConfig{CMDBURL: "cmdb/{host}"}.Validate())
+}
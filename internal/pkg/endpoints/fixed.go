@@ -3,10 +3,26 @@
 // SPDX-License-Identifier: Apache-2.0
 package endpoints
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/gateway"
+	"github.com/newrelic/nri-prometheus/internal/pkg/resolver"
+	"github.com/sirupsen/logrus"
+)
 
 type fixedRetriever struct {
 	targets []Target
+	// hostsFiles are the configurations of the targets listed in a hosts
+	// file, which is read again every time the targets are retrieved.
+	hostsFiles []TargetConfig
+	// hostsFileTargets are the last targets read from every hosts file,
+	// used when the file can't be read. They're guarded by mu, as the
+	// retrievers can be queried concurrently.
+	mu               sync.Mutex
+	hostsFileTargets [][]Target
 }
 
 // TargetConfig is used to parse endpoints from the configuration file.
@@ -14,38 +30,136 @@ type TargetConfig struct {
 	Description string
 	URLs        []string  `mapstructure:"urls"`
 	TLSConfig   TLSConfig `mapstructure:"tls_config"`
+	// DNS configures how the hostnames of the URLs are resolved, for
+	// split-horizon setups where the default resolver can't resolve them.
+	DNS resolver.Config `mapstructure:"dns"`
+	// Preset sets the defaults of a well-known exporter, like its port and
+	// a filter keeping its recommended metrics.
+	Preset string `mapstructure:"preset"`
+	// HostsFile is a file listing more hosts to scrape, one per line, as
+	// exported from a directory domain or OU. It's read again every time the
+	// targets are retrieved.
+	HostsFile string `mapstructure:"hosts_file"`
+	// Params are added to the query of the URLs, for exporters that filter
+	// their metrics server-side.
+	Params map[string][]string `mapstructure:"params"`
+	// Auth are the authentication methods tried in order until one is
+	// accepted, replacing the TLSConfig and the global bearer token. The
+	// method that worked is used first on the next scrapes.
+	Auth []AuthConfig `mapstructure:"auth"`
+	// Gateway is the host the scrapes go through, for targets that aren't
+	// directly reachable.
+	Gateway gateway.Config `mapstructure:"gateway"`
+	// ScrapeTimeout replaces the global scrape_timeout for these targets,
+	// like a longer one for slow federation endpoints.
+	ScrapeTimeout time.Duration `mapstructure:"scrape_timeout"`
+	// SchemeFallback is the policy of the fallback between https and http
+	// of these targets, like downgrade, for targets migrating between them.
+	SchemeFallback SchemeFallback `mapstructure:"scheme_fallback"`
+	// ServiceAccountAuth scrapes these targets with the service account
+	// token of the integration and the CA of the cluster, like the kubelets.
+	// It's tried before the Auth methods.
+	ServiceAccountAuth bool `mapstructure:"service_account_auth"`
 }
 
 // TLSConfig is used to store all the configuration required to use Mutual TLS authentication.
+// The CA verifies the certificates of the targets, replacing the global one,
+// and the client certificate, if any, authenticates the scrapes. ServerName
+// is the name their certificates are verified for, when it's not the host
+// of their URL, like targets scraped by IP.
 type TLSConfig struct {
 	CaFilePath         string `mapstructure:"ca_file_path"`
 	CertFilePath       string `mapstructure:"cert_file_path"`
 	KeyFilePath        string `mapstructure:"key_file_path"`
+	ServerName         string `mapstructure:"server_name"`
 	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
 }
 
+// AuthConfig is an authentication method of a target: mutual TLS if the
+// TLSConfig is set, and a bearer token if the BearerTokenFile, the
+// BearerTokenEnv or the BearerToken is, in that order of precedence. The
+// BearerTokenEnv is the environment variable with the token, like the ones
+// passed through by the infrastructure agent. Without a bearer token, the
+// BasicAuth credentials are sent if set, or else the requests are signed
+// with SigV4, or sent with an Azure AD token, if configured. A method with
+// none scrapes without credentials.
+type AuthConfig struct {
+	TLSConfig       TLSConfig       `mapstructure:"tls_config"`
+	BearerTokenFile string          `mapstructure:"bearer_token_file"`
+	BearerTokenEnv  string          `mapstructure:"bearer_token_env"`
+	BearerToken     Secret          `mapstructure:"bearer_token"`
+	BasicAuth       BasicAuthConfig `mapstructure:"basic_auth"`
+	SigV4           SigV4Config     `mapstructure:"sigv4"`
+	AzureAD         AzureADConfig   `mapstructure:"azure_ad"`
+}
+
+// Validate returns an error if the basic auth, the SigV4 or the Azure AD
+// credentials are incomplete.
+func (c AuthConfig) Validate() error {
+	if err := c.BasicAuth.Validate(); err != nil {
+		return err
+	}
+	if err := c.SigV4.Validate(); err != nil {
+		return err
+	}
+	return c.AzureAD.Validate()
+}
+
 // FixedRetriever creates a TargetRetriver that returns the targets belonging to the URLs passed as arguments
 func FixedRetriever(targetCfgs ...TargetConfig) (TargetRetriever, error) {
-	fixed := make([]Target, 0, len(targetCfgs))
+	f := &fixedRetriever{targets: make([]Target, 0, len(targetCfgs))}
 	for _, targetCfg := range targetCfgs {
 		targets, err := EndpointToTarget(targetCfg)
 		if err != nil {
 			return nil, fmt.Errorf("parsing target %v: %v", targetCfg, err.Error())
 		}
-		fixed = append(fixed, targets...)
+		f.targets = append(f.targets, targets...)
+		if err := checkPreset(targetCfg.Preset); err != nil {
+			return nil, err
+		}
+		if targetCfg.HostsFile != "" {
+			f.hostsFiles = append(f.hostsFiles, targetCfg)
+			f.hostsFileTargets = append(f.hostsFileTargets, nil)
+		}
+	}
+	return f, nil
+}
+
+func (f *fixedRetriever) GetTargets() ([]Target, error) {
+	if len(f.hostsFiles) == 0 {
+		return f.targets, nil
 	}
-	return &fixedRetriever{targets: fixed}, nil
+	targets := append([]Target(nil), f.targets...)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, cfg := range f.hostsFiles {
+		hostsTargets, err := hostsFileTargets(cfg)
+		if err != nil {
+			logrus.WithError(err).WithField("file", cfg.HostsFile).Warn("reading hosts file, using its previous targets")
+		} else {
+			f.hostsFileTargets[i] = hostsTargets
+		}
+		targets = append(targets, f.hostsFileTargets[i]...)
+	}
+	return targets, nil
 }
 
-func (f fixedRetriever) GetTargets() ([]Target, error) {
-	return f.targets, nil
+// hostsFileTargets returns the targets of the hosts listed in the hosts file
+// of the configuration.
+func hostsFileTargets(cfg TargetConfig) ([]Target, error) {
+	hosts, err := readHostsFile(cfg.HostsFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.URLs = hosts
+	return EndpointToTarget(cfg)
 }
 
-func (f fixedRetriever) Watch() error {
+func (f *fixedRetriever) Watch() error {
 	// NOOP
 	return nil
 }
 
-func (f fixedRetriever) Name() string {
+func (f *fixedRetriever) Name() string {
 	return "fixed"
 }
@@ -0,0 +1,289 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+const (
+	// scrapeSchemeLabel sets the scheme of the targets of an Ingress or an
+	// HTTPRoute, http or https.
+	scrapeSchemeLabel = "prometheus.io/scheme"
+	// scrapeHostsLabel lists, comma separated, the hosts the wildcard hosts
+	// of an Ingress or an HTTPRoute are expanded to, like a,b for
+	// *.example.com. Wildcard hosts are skipped without it.
+	scrapeHostsLabel = "prometheus.io/scrape-hosts"
+	// scrapeAuthLabel uses the authentication methods of the edge
+	// configuration for the targets of an Ingress or an HTTPRoute.
+	scrapeAuthLabel = "prometheus.io/scrape-auth"
+)
+
+// ingressResource identifies the Kubernetes Ingress resource.
+var ingressResource = schema.GroupVersionResource{
+	Group:    "networking.k8s.io",
+	Version:  "v1",
+	Resource: "ingresses",
+}
+
+// httpRouteResource identifies the Gateway API HTTPRoute resource.
+var httpRouteResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1",
+	Resource: "httproutes",
+}
+
+// EdgeConfig configures the discovery of targets from the annotated
+// Ingresses and Gateway API HTTPRoutes, which are scraped through their
+// external hosts when the pod network isn't reachable.
+type EdgeConfig struct {
+	Ingresses  bool `mapstructure:"ingresses"`
+	HTTPRoutes bool `mapstructure:"http_routes"`
+	// TLSConfig is used for the https targets, like the CA of the edge.
+	TLSConfig TLSConfig `mapstructure:"tls_config"`
+	// Auth are the authentication methods of the targets annotated with
+	// prometheus.io/scrape-auth: "true".
+	Auth []AuthConfig `mapstructure:"auth"`
+	// AuthHosts and AuthNamespaces are the only targets the Auth is used
+	// for: the ones with one of the AuthHosts, where *.example.com matches
+	// the subdomains of example.com, or of the objects in one of the
+	// AuthNamespaces, so an annotation can't send the credentials to any
+	// host.
+	AuthHosts      []string `mapstructure:"auth_hosts"`
+	AuthNamespaces []string `mapstructure:"auth_namespaces"`
+}
+
+// IsEmpty returns true if no edge resource is discovered.
+func (c EdgeConfig) IsEmpty() bool {
+	return !c.Ingresses && !c.HTTPRoutes
+}
+
+// Validate returns an error if the Auth isn't restricted to any host or
+// namespace.
+func (c EdgeConfig) Validate() error {
+	if len(c.Auth) > 0 && len(c.AuthHosts) == 0 && len(c.AuthNamespaces) == 0 {
+		return errors.New("kubernetes_edge auth requires auth_hosts or auth_namespaces")
+	}
+	return nil
+}
+
+// authAllowed returns true if the Auth can be used for the host of the
+// namespace.
+func (c EdgeConfig) authAllowed(namespace, host string) bool {
+	for _, ns := range c.AuthNamespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range c.AuthHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithEdgeResources enables the discovery of targets from the annotated
+// Ingresses and HTTPRoutes of the configuration.
+func WithEdgeResources(cfg EdgeConfig) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.edge = cfg
+		return nil
+	}
+}
+
+// listIngresses gets the scrapable ingresses that are currently available
+func (k *KubernetesTargetRetriever) listIngresses() error {
+	return k.listUnstructured(ingressResource)
+}
+
+// listHTTPRoutes gets the scrapable HTTPRoutes that are currently available
+func (k *KubernetesTargetRetriever) listHTTPRoutes() error {
+	return k.listUnstructured(httpRouteResource)
+}
+
+func (k *KubernetesTargetRetriever) listUnstructured(resource schema.GroupVersionResource) error {
+	objects, err := k.dynamicClient.Resource(resource).Namespace("").List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range objects.Items {
+		o := &objects.Items[i]
+		if isObjectScrapable(o, k.scrapeEnabledLabel) {
+			k.targets.Store(string(o.GetUID()), k.objectTargets(o))
+		}
+	}
+	return nil
+}
+
+func (k *KubernetesTargetRetriever) edgeWatchableResources() []watchableResource {
+	var resources []watchableResource
+	if k.edge.Ingresses {
+		resources = append(resources, watchableResource{
+			name:                      "ingress",
+			listFunction:              k.listIngresses,
+			requireScrapeEnabledLabel: true,
+			watchFunction: func() (watch.Interface, error) {
+				return k.dynamicClient.Resource(ingressResource).Namespace("").Watch(metav1.ListOptions{})
+			},
+		})
+	}
+	if k.edge.HTTPRoutes {
+		resources = append(resources, watchableResource{
+			name:                      "httproute",
+			listFunction:              k.listHTTPRoutes,
+			requireScrapeEnabledLabel: true,
+			watchFunction: func() (watch.Interface, error) {
+				return k.dynamicClient.Resource(httpRouteResource).Namespace("").Watch(metav1.ListOptions{})
+			},
+		})
+	}
+	return resources
+}
+
+// edgeTargets applies the TLS configuration of the edge to the https
+// targets, and its authentication methods to the allowed targets of the
+// objects annotated with scrapeAuthLabel.
+func (k *KubernetesTargetRetriever) edgeTargets(o metav1.Object, targets []Target) []Target {
+	auth := objectLabel(o, scrapeAuthLabel) == trueStr && len(k.edge.Auth) > 0
+	for i := range targets {
+		if targets[i].URL.Scheme == "https" {
+			targets[i].TLSConfig = k.edge.TLSConfig
+		}
+		if auth && k.edge.authAllowed(o.GetNamespace(), targets[i].URL.Hostname()) {
+			targets[i].Auth = k.edge.Auth
+		}
+	}
+	return targets
+}
+
+// objectLabel returns the value of the annotation of the object, or of
+// its label if it has no such annotation.
+func objectLabel(o metav1.Object, name string) string {
+	if value, ok := o.GetAnnotations()[name]; ok {
+		return value
+	}
+	return o.GetLabels()[name]
+}
+
+// ingressTargets returns a target per host of the rules of an Ingress,
+// using https for the hosts of its TLS section.
+func ingressTargets(ing *unstructured.Unstructured) []Target {
+	tlsHosts := map[string]bool{}
+	tls, _, _ := unstructured.NestedSlice(ing.Object, "spec", "tls")
+	for _, t := range tls {
+		entry, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hosts, _, _ := unstructured.NestedStringSlice(entry, "hosts")
+		for _, h := range hosts {
+			tlsHosts[h] = true
+		}
+	}
+
+	var hosts []string
+	rules, _, _ := unstructured.NestedSlice(ing.Object, "spec", "rules")
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if host, _, _ := unstructured.NestedString(rule, "host"); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hostTargets(ing, "ingress", "ingressName", hosts, func(host string) string {
+		if tlsHosts[host] {
+			return "https"
+		}
+		return "http"
+	})
+}
+
+// httpRouteTargets returns a target per hostname of a Gateway API
+// HTTPRoute. The scheme depends on the listener of the gateway, so it's
+// http unless the route has a scrapeSchemeLabel.
+func httpRouteTargets(route *unstructured.Unstructured) []Target {
+	hosts, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	return hostTargets(route, "httproute", "httpRouteName", hosts, func(string) string {
+		return "http"
+	})
+}
+
+// hostTargets returns the targets of the hosts of an edge object, expanding
+// its wildcard hosts to the ones of the scrapeHostsLabel. The scheme of a
+// host is the one of the scrapeSchemeLabel of the object, if any.
+func hostTargets(o *unstructured.Unstructured, kind, nameLabel string, hosts []string, scheme func(host string) string) []Target {
+	path := objectLabel(o, defaultScrapePathLabel)
+	if path == "" {
+		path = defaultScrapePath
+	}
+	if path[0] != '/' {
+		path = "/" + path
+	}
+
+	var targets []Target
+	seen := map[string]bool{}
+	for _, pattern := range hosts {
+		for _, host := range expandHost(o, pattern) {
+			if seen[host] {
+				continue
+			}
+			seen[host] = true
+
+			s := objectLabel(o, scrapeSchemeLabel)
+			if s == "" {
+				s = scheme(pattern)
+			}
+			addr, err := url.Parse(fmt.Sprintf("%s://%s%s", s, host, path))
+			if err != nil {
+				klog.WithError(err).WithField(kind, o.GetName()).Errorf("couldn't parse %s url, skipping", kind)
+				continue
+			}
+			lbls := labels.Set{}
+			for lk, lv := range o.GetLabels() {
+				lbls["label."+lk] = lv
+			}
+			lbls[nameLabel] = o.GetName()
+			lbls["namespaceName"] = o.GetNamespace()
+			targets = append(targets, New(host, *addr, Object{Name: o.GetName(), Kind: kind, Labels: lbls}))
+		}
+	}
+	return targets
+}
+
+// expandHost returns the hosts of the scrapeHostsLabel of the object
+// matching the wildcard host, like a.example.com for a and *.example.com,
+// or the host itself if it's not a wildcard.
+func expandHost(o metav1.Object, host string) []string {
+	if !strings.HasPrefix(host, "*.") {
+		return []string{host}
+	}
+	var hosts []string
+	for _, h := range strings.Split(objectLabel(o, scrapeHostsLabel), ",") {
+		h = strings.TrimSpace(h)
+		if h == "" || strings.Contains(h, ".") {
+			continue
+		}
+		hosts = append(hosts, h+host[1:])
+	}
+	if len(hosts) == 0 {
+		klog.WithField("object", o.GetName()).Debugf("skipping the wildcard host %s without %s", host, scrapeHostsLabel)
+	}
+	return hosts
+}
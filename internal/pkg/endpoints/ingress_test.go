@@ -0,0 +1,172 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func newEdgeObject(kind, name string, spec map[string]interface{}, annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"kind": kind,
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   "test-ns",
+			"uid":         name,
+			"annotations": annotations,
+			"labels":      map[string]interface{}{"app": name},
+		},
+		"spec": spec,
+	}}
+}
+
+func targetURLs(targets []Target) []string {
+	var urls []string
+	for _, t := range targets {
+		urls = append(urls, t.URL.String())
+	}
+	return urls
+}
+
+func TestIngressTargets(t *testing.T) {
+	spec := map[string]interface{}{
+		"tls": []interface{}{
+			map[string]interface{}{"hosts": []interface{}{"secure.example.com", "*.apps.example.com"}},
+		},
+		"rules": []interface{}{
+			map[string]interface{}{"host": "plain.example.com"},
+			map[string]interface{}{"host": "secure.example.com"},
+			map[string]interface{}{"host": "secure.example.com"},
+			map[string]interface{}{"host": "*.apps.example.com"},
+			map[string]interface{}{},
+		},
+	}
+
+	t.Run("wildcard hosts skipped", func(t *testing.T) {
+		targets := ingressTargets(newEdgeObject("Ingress", "my-ingress", spec, nil))
+		assert.Equal(t, []string{
+			"http://plain.example.com/metrics",
+			"https://secure.example.com/metrics",
+		}, targetURLs(targets))
+		assert.Equal(t, "ingress", targets[0].Object.Kind)
+		assert.Equal(t, "plain.example.com", targets[0].Name)
+		assert.Equal(t, "my-ingress", targets[0].Object.Labels["ingressName"])
+		assert.Equal(t, "test-ns", targets[0].Object.Labels["namespaceName"])
+		assert.Equal(t, "my-ingress", targets[0].Object.Labels["label.app"])
+	})
+
+	t.Run("wildcard hosts expanded", func(t *testing.T) {
+		targets := ingressTargets(newEdgeObject("Ingress", "my-ingress", spec, map[string]interface{}{
+			"prometheus.io/scrape-hosts": "tenant-a, tenant-b,invalid.name",
+			"prometheus.io/path":         "custom/metrics",
+		}))
+		assert.Equal(t, []string{
+			"http://plain.example.com/custom/metrics",
+			"https://secure.example.com/custom/metrics",
+			"https://tenant-a.apps.example.com/custom/metrics",
+			"https://tenant-b.apps.example.com/custom/metrics",
+		}, targetURLs(targets))
+	})
+
+	t.Run("scheme annotation", func(t *testing.T) {
+		targets := ingressTargets(newEdgeObject("Ingress", "my-ingress", spec, map[string]interface{}{
+			"prometheus.io/scheme": "https",
+		}))
+		assert.Equal(t, []string{
+			"https://plain.example.com/metrics",
+			"https://secure.example.com/metrics",
+		}, targetURLs(targets))
+	})
+}
+
+func TestHTTPRouteTargets(t *testing.T) {
+	route := newEdgeObject("HTTPRoute", "my-route", map[string]interface{}{
+		"hostnames": []interface{}{"app.example.com", "*.example.com"},
+	}, map[string]interface{}{"prometheus.io/scrape-hosts": "other"})
+
+	targets := httpRouteTargets(route)
+	assert.Equal(t, []string{
+		"http://app.example.com/metrics",
+		"http://other.example.com/metrics",
+	}, targetURLs(targets))
+	assert.Equal(t, "httproute", targets[0].Object.Kind)
+	assert.Equal(t, "my-route", targets[0].Object.Labels["httpRouteName"])
+
+	assert.Empty(t, httpRouteTargets(newEdgeObject("HTTPRoute", "no-hosts", map[string]interface{}{}, nil)))
+}
+
+func TestProcessEvent_Edge(t *testing.T) {
+	retriever := newFakeKubernetesTargetRetriever(nil)
+	auth := []AuthConfig{{BearerTokenFile: "/etc/edge/token"}}
+	tlsConfig := TLSConfig{CaFilePath: "/etc/edge/ca.crt"}
+	require.NoError(t, WithEdgeResources(EdgeConfig{
+		Ingresses:  true,
+		HTTPRoutes: true,
+		TLSConfig:  tlsConfig,
+		Auth:       auth,
+		AuthHosts:  []string{"*.example.com"},
+	})(retriever))
+
+	ingress := newEdgeObject("Ingress", "my-ingress", map[string]interface{}{
+		"tls":   []interface{}{map[string]interface{}{"hosts": []interface{}{"secure.example.com", "secure.attacker.io"}}},
+		"rules": []interface{}{map[string]interface{}{"host": "secure.example.com"}, map[string]interface{}{"host": "secure.attacker.io"}},
+	}, map[string]interface{}{"prometheus.io/scrape": "true", "prometheus.io/scrape-auth": "true"})
+	route := newEdgeObject("HTTPRoute", "my-route", map[string]interface{}{
+		"hostnames": []interface{}{"app.example.com"},
+	}, map[string]interface{}{"prometheus.io/scrape": "true"})
+
+	retriever.processEvent(watch.Event{Type: watch.Added, Object: ingress}, true)
+	retriever.processEvent(watch.Event{Type: watch.Added, Object: route}, true)
+
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+	byURL := map[string]Target{}
+	for _, target := range targets {
+		byURL[target.URL.String()] = target
+	}
+
+	secure := byURL["https://secure.example.com/metrics"]
+	assert.Equal(t, tlsConfig, secure.TLSConfig)
+	assert.Equal(t, auth, secure.Auth)
+	assert.Empty(t, byURL["https://secure.attacker.io/metrics"].Auth, "the auth is only used for the allowed hosts")
+
+	plain := byURL["http://app.example.com/metrics"]
+	assert.Equal(t, TLSConfig{}, plain.TLSConfig)
+	assert.Empty(t, plain.Auth)
+}
+
+func TestEdgeConfig_AuthAllowed(t *testing.T) {
+	cfg := EdgeConfig{
+		Auth:           []AuthConfig{{BearerTokenFile: "/etc/edge/token"}},
+		AuthHosts:      []string{"metrics.example.com", "*.apps.example.com"},
+		AuthNamespaces: []string{"monitoring"},
+	}
+	require.NoError(t, cfg.Validate())
+	assert.True(t, cfg.authAllowed("default", "metrics.example.com"))
+	assert.True(t, cfg.authAllowed("default", "a.apps.Example.com"))
+	assert.False(t, cfg.authAllowed("default", "apps.example.com"))
+	assert.False(t, cfg.authAllowed("default", "evil-apps.example.com"))
+	assert.True(t, cfg.authAllowed("monitoring", "anything.io"))
+
+	assert.Error(t, EdgeConfig{Auth: cfg.Auth}.Validate(), "the auth must be restricted")
+	assert.NoError(t, EdgeConfig{}.Validate())
+}
+
+func TestMissingPermissions_Edge(t *testing.T) {
+	ktr := newFakeKubernetesTargetRetriever(nil)
+	require.NoError(t, WithEdgeResources(EdgeConfig{Ingresses: true})(ktr))
+
+	var names []string
+	for _, p := range ktr.requiredPermissions() {
+		if p.Group != "" {
+			names = append(names, p.String())
+		}
+	}
+	assert.Equal(t, []string{"list ingresses.networking.k8s.io", "watch ingresses.networking.k8s.io"}, names)
+}
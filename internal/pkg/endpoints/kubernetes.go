@@ -4,12 +4,16 @@
 package endpoints
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,7 +21,10 @@ import (
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	klabels "k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -28,8 +35,64 @@ import (
 
 const trueStr = "true"
 
+// hostNetworkLabel is set on the targets of pods running in the host network.
+const hostNetworkLabel = "hostNetwork"
+
+// inClusterAPIServerHost is the host used to reach the API server from within
+// the cluster.
+const inClusterAPIServerHost = "kubernetes.default.svc"
+
 var klog = logrus.WithField("component", "KubernetesAPI")
 
+// ClusterConfig is used to parse the clusters to discover targets from.
+type ClusterConfig struct {
+	ClusterName string `mapstructure:"cluster_name"`
+	// InCluster uses the configuration of the cluster the integration runs in.
+	InCluster bool `mapstructure:"in_cluster"`
+	// KubeConfig is the path of the kubeconfig file used for external
+	// clusters, and Context the context to use from it.
+	KubeConfig string `mapstructure:"kubeconfig"`
+	Context    string `mapstructure:"context"`
+	// RefreshInterval overrides the refresh interval of the cluster.
+	RefreshInterval *time.Duration `mapstructure:"refresh_interval"`
+	// NodeAuth are the credentials the nodes and the pods of the external
+	// clusters are scraped with through their API server, verified with the
+	// CA of its tls_config. Without them the nodes and pods of the cluster
+	// aren't scraped, so the credentials of the cluster the integration runs
+	// in are never sent to another one.
+	NodeAuth AuthConfig `mapstructure:"node_auth"`
+}
+
+// Option returns the Option that configures the KubernetesTargetRetriever
+// to connect to the cluster.
+func (c ClusterConfig) Option() (Option, error) {
+	if c.ClusterName == "" {
+		return nil, errors.New("cluster_name is required for every kubernetes cluster")
+	}
+	if c.InCluster == (c.KubeConfig != "") {
+		return nil, fmt.Errorf("cluster %s: exactly one of in_cluster or kubeconfig must be set", c.ClusterName)
+	}
+	if c.InCluster {
+		return WithInClusterConfig(), nil
+	}
+	if c.NodeAuth != (AuthConfig{}) {
+		if c.NodeAuth.TLSConfig.CaFilePath == "" {
+			return nil, fmt.Errorf("cluster %s: node_auth requires the ca_file_path of the API server", c.ClusterName)
+		}
+		if err := c.NodeAuth.Validate(); err != nil {
+			return nil, fmt.Errorf("cluster %s: node_auth: %w", c.ClusterName, err)
+		}
+	}
+	kubeConfig := WithKubeConfigContext(c.KubeConfig, c.Context)
+	return func(ktr *KubernetesTargetRetriever) error {
+		if err := kubeConfig(ktr); err != nil {
+			return err
+		}
+		ktr.nodeAuth = c.NodeAuth
+		return nil
+	}, nil
+}
+
 // COPIED FROM Prometheus code
 const (
 	NodeLegacyHostIP          = "LegacyHostIP"
@@ -37,6 +100,20 @@ const (
 	defaultScrapePortLabel    = "prometheus.io/port"
 	defaultScrapePathLabel    = "prometheus.io/path"
 	defaultScrapePath         = "/metrics"
+	// scrapeNotReadyLabel overrides, per pod, whether it's scraped while
+	// it's not ready.
+	scrapeNotReadyLabel = "prometheus.io/scrape-not-ready"
+	// scrapeTerminatingLabel overrides, per pod, whether it's scraped while
+	// it's being terminated.
+	scrapeTerminatingLabel = "prometheus.io/scrape-terminating"
+	// scrapeTimeoutLabel replaces the global scrape timeout for the targets
+	// of the object, like 60s or 5s.
+	scrapeTimeoutLabel = "prometheus.io/scrape-timeout"
+)
+
+const (
+	defaultBackoffMin = time.Second
+	defaultBackoffMax = 2 * time.Minute
 )
 
 // watchableResource identifies a k8s resource that implement the k8s watchable
@@ -107,12 +184,12 @@ func (k *KubernetesTargetRetriever) listNodes() error {
 func nodeTargets(n *apiv1.Node) ([]Target, error) {
 	nodeURL := url.URL{
 		Scheme: "https",
-		Host:   "kubernetes.default.svc",
+		Host:   inClusterAPIServerHost,
 		Path:   fmt.Sprintf("/api/v1/nodes/%s/proxy/metrics", n.Name),
 	}
 	cadvisorURL := url.URL{
 		Scheme: "https",
-		Host:   "kubernetes.default.svc",
+		Host:   inClusterAPIServerHost,
 		Path:   fmt.Sprintf("/api/v1/nodes/%s/proxy/metrics/cadvisor", n.Name),
 	}
 
@@ -159,6 +236,21 @@ func isObjectScrapable(o metav1.Object, label string) bool {
 }
 
 func objectTargets(object metav1.Object) []Target {
+	targets := kindTargets(object)
+	if timeout := objectScrapeTimeout(object); timeout > 0 {
+		for i := range targets {
+			targets[i].ScrapeTimeout = timeout
+		}
+	}
+	if policy := objectSchemeFallback(object); policy != "" {
+		for i := range targets {
+			targets[i].SchemeFallback = policy
+		}
+	}
+	return targets
+}
+
+func kindTargets(object metav1.Object) []Target {
 	switch obj := object.(type) {
 	case *apiv1.Service:
 		return serviceTargets(obj)
@@ -171,10 +263,38 @@ func objectTargets(object metav1.Object) []Target {
 			return nil
 		}
 		return targets
+	case *unstructured.Unstructured:
+		switch obj.GetKind() {
+		case "Route":
+			return routeTargets(obj)
+		case "Ingress":
+			return ingressTargets(obj)
+		case "HTTPRoute":
+			return httpRouteTargets(obj)
+		}
 	}
 	return nil
 }
 
+// objectScrapeTimeout returns the scrape timeout of the scrapeTimeoutLabel
+// of the object, or 0 if it has none or it's not a valid duration.
+// Annotations take precedence over labels.
+func objectScrapeTimeout(object metav1.Object) time.Duration {
+	value, ok := object.GetAnnotations()[scrapeTimeoutLabel]
+	if !ok {
+		value, ok = object.GetLabels()[scrapeTimeoutLabel]
+	}
+	if !ok {
+		return 0
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		klog.WithField("object", object.GetName()).Warnf("invalid %s %q, using the global scrape timeout", scrapeTimeoutLabel, value)
+		return 0
+	}
+	return timeout
+}
+
 func serviceTarget(s *apiv1.Service, port, path string) *Target {
 	lbls := labels.Set{}
 	hostname := fmt.Sprintf("%s.%s.svc", s.Name, s.Namespace)
@@ -194,6 +314,70 @@ func serviceTarget(s *apiv1.Service, port, path string) *Target {
 	return &target
 }
 
+// objectTargets returns the targets of the object, skipping the pods that
+// are not ready or terminating, when configured to, and adapting the ones of
+// pods to the configured service mesh. The credentials of the object replace
+// the authentication methods of its targets, and its account is set on them.
+func (k *KubernetesTargetRetriever) objectTargets(object metav1.Object) []Target {
+	p, isPod := object.(*apiv1.Pod)
+	if isPod && k.skipPod(p) {
+		return nil
+	}
+	targets := objectTargets(object)
+	if isPod && k.serviceMesh != "" {
+		targets = meshPodTargets(p, targets, k.serviceMesh, k.splitMeshProxyMetrics)
+	}
+	if _, ok := object.(*unstructured.Unstructured); ok && !k.edge.IsEmpty() {
+		targets = k.edgeTargets(object, targets)
+	}
+	if auth, ok := k.objectAuth(object); ok {
+		for i := range targets {
+			targets[i].Auth = []AuthConfig{auth}
+		}
+	}
+	k.setAccount(object, targets)
+	return targets
+}
+
+// skipPod returns true if the pod is not scraped because it's being
+// terminated or it's not ready. The scrapeTerminatingLabel and the
+// scrapeNotReadyLabel of the pod override the configured behavior for
+// terminating and not ready pods.
+func (k *KubernetesTargetRetriever) skipPod(p *apiv1.Pod) bool {
+	skipTerminating := k.skipTerminatingPods
+	if v, ok := p.Annotations[scrapeTerminatingLabel]; ok {
+		skipTerminating = v != trueStr
+	}
+	if skipTerminating && p.DeletionTimestamp != nil {
+		return true
+	}
+	skipNotReady := k.skipNotReadyPods
+	if v, ok := p.Annotations[scrapeNotReadyLabel]; ok {
+		skipNotReady = v != trueStr
+	}
+	return skipNotReady && !isPodReady(p)
+}
+
+func isPodReady(p *apiv1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == apiv1.PodReady {
+			return c.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// WithPodReadiness configures whether pods that are not ready, or are being
+// terminated, are skipped. Skipping them avoids scrape failures during
+// rollouts.
+func WithPodReadiness(skipNotReady, skipTerminating bool) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.skipNotReadyPods = skipNotReady
+		ktr.skipTerminatingPods = skipTerminating
+		return nil
+	}
+}
+
 // returns all the possible targets for a service (1 target per port)
 func serviceTargets(s *apiv1.Service) []Target {
 	// Annotations take precedence over labels.
@@ -240,7 +424,7 @@ func (k *KubernetesTargetRetriever) listPods() error {
 	}
 	for _, p := range pods.Items {
 		if isObjectScrapable(&p, k.scrapeEnabledLabel) {
-			k.targets.Store(string(p.UID), podTargets(&p))
+			k.targets.Store(string(p.UID), k.objectTargets(&p))
 		}
 	}
 	return nil
@@ -258,9 +442,18 @@ func getPodDeployment(p *apiv1.Pod) string {
 	return deploymentName
 }
 
+// podIP returns the IP the pod is reachable at. Pods in the host network
+// are reached through the IP of their node.
+func podIP(p *apiv1.Pod) string {
+	if p.Spec.HostNetwork && p.Status.HostIP != "" {
+		return p.Status.HostIP
+	}
+	return p.Status.PodIP
+}
+
 func podTarget(p *apiv1.Pod, port, path string) *Target {
 	lbls := labels.Set{}
-	hostAndPort := net.JoinHostPort(p.Status.PodIP, port)
+	hostAndPort := net.JoinHostPort(podIP(p), port)
 	fullPodURL := fmt.Sprintf("http://%s%s", hostAndPort, path)
 	addr, err := url.Parse(fullPodURL)
 	if err != nil {
@@ -274,6 +467,9 @@ func podTarget(p *apiv1.Pod, port, path string) *Target {
 	lbls["namespaceName"] = p.Namespace
 	lbls["nodeName"] = p.Spec.NodeName
 	lbls["deploymentName"] = getPodDeployment(p)
+	if p.Spec.HostNetwork {
+		lbls[hostNetworkLabel] = trueStr
+	}
 	target := New(p.Name, *addr, Object{Name: p.Name, Kind: "pod", Labels: lbls})
 	return &target
 }
@@ -281,7 +477,7 @@ func podTarget(p *apiv1.Pod, port, path string) *Target {
 func podTargets(p *apiv1.Pod) []Target {
 	//if the Pod has not yet been allocated to a Node, or Kubelet/CNI has not yet assigned an ipAddress,
 	// the pod is not yet scrapable.
-	if p.Status.PodIP == "" {
+	if podIP(p) == "" {
 		return nil
 	}
 
@@ -305,24 +501,64 @@ func podTargets(p *apiv1.Pod) []Target {
 
 	// Only return a target for the specified port.
 	if ok {
-		target := podTarget(p, port, path)
+		target := podTarget(p, resolvePodPort(p, port), path)
 		if target != nil {
 			return []Target{*target}
 		}
 		return []Target{}
 	}
 
-	// No port specified so return a target for each ContainerPort defined for the pod.
-	targets := make([]Target, 0, len(p.Spec.Containers))
+	// No port specified so return a target for each metrics port declared by
+	// the containers, or for each ContainerPort if none is named as such.
+	ports := podMetricsPorts(p)
+	targets := make([]Target, 0, len(ports))
+	for _, port := range ports {
+		target := podTarget(p, strconv.FormatInt(int64(port), 10), path)
+		if target != nil {
+			targets = append(targets, *target)
+		}
+	}
+	return targets
+}
+
+// isMetricsPortName returns true if the name of a container port identifies
+// it as serving metrics, like `metrics` or `http-metrics`.
+func isMetricsPortName(name string) bool {
+	return name == "metrics" || strings.HasSuffix(name, "-metrics")
+}
+
+// podMetricsPorts returns the container ports named as metrics ports. If
+// there are none, all the container ports are returned.
+func podMetricsPorts(p *apiv1.Pod) []int32 {
+	var all, metrics []int32
 	for _, c := range p.Spec.Containers {
 		for _, port := range c.Ports {
-			target := podTarget(p, strconv.FormatInt(int64(port.ContainerPort), 10), path)
-			if target != nil {
-				targets = append(targets, *target)
+			all = append(all, port.ContainerPort)
+			if isMetricsPortName(port.Name) {
+				metrics = append(metrics, port.ContainerPort)
 			}
 		}
 	}
-	return targets
+	if len(metrics) > 0 {
+		return metrics
+	}
+	return all
+}
+
+// resolvePodPort returns the number of the given port, which can be either
+// a number or the name of a container port.
+func resolvePodPort(p *apiv1.Pod, port string) string {
+	if _, err := strconv.Atoi(port); err == nil {
+		return port
+	}
+	for _, c := range p.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Name == port {
+				return strconv.FormatInt(int64(cp.ContainerPort), 10)
+			}
+		}
+	}
+	return port
 }
 
 // Option is implemented by functions that configure the KubernetesTargetRetriever
@@ -337,12 +573,41 @@ func WithKubeConfig(kubeConfigFile string) Option {
 			return fmt.Errorf("could not read kubeconfig file: %w", err)
 		}
 
-		client, err := kubernetes.NewForConfig(config)
+		ktr.restConfig = config
+		return nil
+	}
+}
+
+// WithKubeConfigContext configures the KubernetesTargetRetriever to load the
+// Kubernetes configuration of the given context from a kubeconfig file. If
+// the context is empty, the current context of the file is used.
+func WithKubeConfigContext(kubeConfigFile, context string) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeConfigFile},
+			&clientcmd.ConfigOverrides{CurrentContext: context},
+		).ClientConfig()
 		if err != nil {
-			return fmt.Errorf("could create kubernetes client: %w", err)
+			return fmt.Errorf("could not read context %q from kubeconfig file: %w", context, err)
+		}
+		apiURL, err := url.Parse(config.Host)
+		if err != nil {
+			return fmt.Errorf("could not parse API server host %q: %w", config.Host, err)
 		}
 
-		ktr.client = client
+		ktr.restConfig = config
+		ktr.apiServerHost = apiURL.Host
+		return nil
+	}
+}
+
+// WithClusterName sets the name of the cluster the KubernetesTargetRetriever
+// discovers targets from. The name is attached to every returned Target and
+// is part of the retriever name, allowing many clusters to be scraped from a
+// single instance.
+func WithClusterName(clusterName string) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.clusterName = clusterName
 		return nil
 	}
 }
@@ -356,22 +621,140 @@ func WithInClusterConfig() Option {
 			return fmt.Errorf("could not read inclusterconfig: %w", err)
 		}
 
-		client, err := kubernetes.NewForConfig(config)
-		if err != nil {
-			return fmt.Errorf("could create kubernetes client: %w", err)
-		}
+		ktr.restConfig = config
+		return nil
+	}
+}
 
-		ktr.client = client
+// WithAPIRequestBudget limits the rate of the requests made to the Kubernetes
+// API to qps, allowing bursts of up to burst requests, and sets the timeout
+// of every non-watch request. Zero values keep the client defaults.
+func WithAPIRequestBudget(qps float32, burst int, timeout time.Duration) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.qps = qps
+		ktr.burst = burst
+		ktr.timeout = timeout
 		return nil
 	}
 }
 
+// WithBackoff sets the minimum and maximum delay to wait before retrying a
+// failed list or watch request. Delays grow exponentially and are jittered.
+// Zero values keep the defaults.
+func WithBackoff(min, max time.Duration) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		if min == 0 {
+			min = defaultBackoffMin
+		}
+		if max == 0 {
+			max = defaultBackoffMax
+		}
+		if min < 0 || max < min {
+			return fmt.Errorf("invalid backoff: min (%s) must be positive and lower than max (%s)", min, max)
+		}
+		ktr.backoffMin = min
+		ktr.backoffMax = max
+		return nil
+	}
+}
+
+// newClient creates the Kubernetes client from the rest configuration,
+// applying the configured request budget.
+func (k *KubernetesTargetRetriever) newClient() (kubernetes.Interface, error) {
+	config := rest.CopyConfig(k.restConfig)
+	if k.qps > 0 {
+		config.QPS = k.qps
+	}
+	if k.burst > 0 {
+		config.Burst = k.burst
+	}
+	if k.timeout > 0 {
+		// config.Timeout would also end the watches, which are expected to
+		// last until the server closes them.
+		timeout := k.timeout
+		config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &nonWatchTimeoutRoundTripper{next: rt, timeout: timeout}
+		})
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("could create kubernetes client: %w", err)
+	}
+	return client, nil
+}
+
+// nonWatchTimeoutRoundTripper limits the duration of the Kubernetes API
+// requests, including the read of their bodies, except for the watches.
+type nonWatchTimeoutRoundTripper struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (rt *nonWatchTimeoutRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isWatch(req) {
+		return rt.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), rt.timeout)
+	resp, err := rt.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// isWatch returns true if the request is a watch, either with the watch
+// query parameter or the legacy /watch/ paths.
+func isWatch(req *http.Request) bool {
+	if watch, err := strconv.ParseBool(req.URL.Query().Get("watch")); err == nil && watch {
+		return true
+	}
+	return strings.Contains(req.URL.Path, "/watch/")
+}
+
+// cancelOnCloseBody releases the context of the request once its body is
+// closed.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
 // KubernetesTargetRetriever sets the watchers for the different Targets
 // and listens for the arrival of new data from them.
 type KubernetesTargetRetriever struct {
 	watching                          bool
 	client                            kubernetes.Interface
+	restConfig                        *rest.Config
+	dynamicClient                     dynamic.Interface
+	openShiftRoutes                   bool
+	edge                              EdgeConfig
+	credentialsDir                    string
+	serviceAccountAuthNamespaces      []string
+	serviceAccountAuthSelector        klabels.Selector
+	accountNamespaces                 map[string][]string
+	serviceMesh                       string
+	splitMeshProxyMetrics             bool
+	skipNotReadyPods                  bool
+	skipTerminatingPods               bool
+	refreshInterval                   time.Duration
+	clusterName                       string
+	apiServerHost                     string
+	nodeAuth                          AuthConfig
+	qps                               float32
+	burst                             int
+	timeout                           time.Duration
+	backoffMin                        time.Duration
+	backoffMax                        time.Duration
 	targets                           *sync.Map
+	events                            *sync.Mutex
 	scrapeEnabledLabel                string
 	requireScrapeEnabledLabelForNodes bool
 }
@@ -386,8 +769,11 @@ func NewKubernetesTargetRetriever(scrapeEnabledLabel string, requireScrapeEnable
 
 	ktr := &KubernetesTargetRetriever{
 		targets:                           new(sync.Map),
+		events:                            new(sync.Mutex),
 		scrapeEnabledLabel:                scrapeEnabledLabel,
 		requireScrapeEnabledLabelForNodes: requireScrapeEnabledLabelForNodes,
+		backoffMin:                        defaultBackoffMin,
+		backoffMax:                        defaultBackoffMax,
 	}
 
 	for _, opt := range options {
@@ -396,6 +782,22 @@ func NewKubernetesTargetRetriever(scrapeEnabledLabel string, requireScrapeEnable
 		}
 	}
 
+	if ktr.client == nil && ktr.restConfig != nil {
+		client, err := ktr.newClient()
+		if err != nil {
+			return nil, err
+		}
+		ktr.client = client
+	}
+
+	if (ktr.openShiftRoutes || !ktr.edge.IsEmpty()) && ktr.dynamicClient == nil && ktr.restConfig != nil {
+		client, err := ktr.newDynamicClient()
+		if err != nil {
+			return nil, err
+		}
+		ktr.dynamicClient = client
+	}
+
 	if ktr.client == nil {
 		return nil, errors.New("newKubernetesTargetRetriever requires a valid Kubernetes configuration option, none are given")
 	}
@@ -416,6 +818,9 @@ func (k *KubernetesTargetRetriever) Watch() error {
 	k.listTargets()
 
 	k.watchTargets()
+	if k.refreshInterval > 0 {
+		go k.refreshPeriodically()
+	}
 
 	k.watching = true
 
@@ -424,6 +829,9 @@ func (k *KubernetesTargetRetriever) Watch() error {
 
 // Name returns the identifying name of the KubernetesTargetRetriever.
 func (k *KubernetesTargetRetriever) Name() string {
+	if k.clusterName != "" {
+		return "kubernetes-" + k.clusterName
+	}
 	return "kubernetes"
 }
 
@@ -439,13 +847,84 @@ func (k *KubernetesTargetRetriever) GetTargets() ([]Target, error) {
 		targets = append(targets, y.([]Target)...)
 		return true
 	})
-	return targets, nil
+	targets = dedupHostNetworkTargets(targets)
+	kept := targets[:0]
+	for _, t := range targets {
+		t.ClusterName = k.clusterName
+		// Nodes and pods of external clusters are scraped through their own
+		// API server, with the credentials configured for it only. The pod
+		// network of another cluster is usually unreachable, and can overlap
+		// the local one, so the pods are never scraped at their IP.
+		if k.apiServerHost != "" && (t.URL.Host == inClusterAPIServerHost || t.Object.Kind == "pod") {
+			if k.nodeAuth == (AuthConfig{}) {
+				klog.WithField("target", t.Name).Debug("skipping the target of an external cluster without node_auth")
+				continue
+			}
+			if t.URL.Host == inClusterAPIServerHost {
+				t.URL.Host = k.apiServerHost
+			} else {
+				t.URL = podProxyURL(k.apiServerHost, t)
+			}
+			t.Auth = []AuthConfig{k.nodeAuth}
+		}
+		kept = append(kept, t)
+	}
+	return kept, nil
+}
+
+// podProxyURL returns the URL of the target of a pod through the proxy of
+// the API server at host.
+func podProxyURL(host string, t Target) url.URL {
+	pod := t.Object.Name + ":" + t.URL.Port()
+	if t.URL.Scheme == "https" {
+		pod = "https:" + pod
+	}
+	return url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/proxy%s", t.Object.Labels["namespaceName"], pod, t.URL.Path),
+		RawQuery: t.URL.RawQuery,
+	}
+}
+
+// dedupHostNetworkTargets removes the targets of host network pods sharing
+// the node IP and port with another one, like the old and new pods of a
+// DaemonSet during a rollout. The target of the pod with the lowest name is
+// kept, so the same one is scraped on every run.
+func dedupHostNetworkTargets(targets []Target) []Target {
+	kept := map[string]int{}
+	deduped := targets[:0]
+	for _, t := range targets {
+		if t.Object.Labels[hostNetworkLabel] != trueStr {
+			deduped = append(deduped, t)
+			continue
+		}
+		addr := t.URL.String()
+		if i, ok := kept[addr]; ok {
+			if t.Object.Name < deduped[i].Object.Name {
+				deduped[i] = t
+			}
+			continue
+		}
+		kept[addr] = len(deduped)
+		deduped = append(deduped, t)
+	}
+	return deduped
 }
 
 func (k *KubernetesTargetRetriever) listTargets() {
 	_ = k.listPods()
 	_ = k.listServices()
 	_ = k.listNodes()
+	if k.openShiftRoutes {
+		_ = k.listRoutes()
+	}
+	if k.edge.Ingresses {
+		_ = k.listIngresses()
+	}
+	if k.edge.HTTPRoutes {
+		_ = k.listHTTPRoutes()
+	}
 }
 
 func (k *KubernetesTargetRetriever) watchTargets() {
@@ -455,7 +934,7 @@ func (k *KubernetesTargetRetriever) watchTargets() {
 }
 
 func (k *KubernetesTargetRetriever) getWatchableResources() []watchableResource {
-	return []watchableResource{{
+	resources := []watchableResource{{
 		name:                      "pod",
 		listFunction:              k.listPods,
 		requireScrapeEnabledLabel: true,
@@ -477,9 +956,18 @@ func (k *KubernetesTargetRetriever) getWatchableResources() []watchableResource
 			return k.client.CoreV1().Services("").Watch(metav1.ListOptions{})
 		},
 	}}
+	if k.openShiftRoutes {
+		resources = append(resources, k.routeWatchableResource())
+	}
+	resources = append(resources, k.edgeWatchableResources()...)
+	return resources
 }
 
 func (k *KubernetesTargetRetriever) processEvent(event watch.Event, requireLabel bool) {
+	// The events are serialized with the refreshes, so a refresh doesn't
+	// restore the targets deleted while it lists the resources.
+	k.events.Lock()
+	defer k.events.Unlock()
 	object := event.Object.(metav1.Object)
 	var seen, scrapable bool
 	_, seen = k.targets.Load(string(object.GetUID()))
@@ -517,6 +1005,12 @@ func (k *KubernetesTargetRetriever) processEvent(event watch.Event, requireLabel
 				k.addTarget(object, event.Type)
 				return
 			}
+			// If the object is scrapable and we've seen it before, update its
+			// targets, which are gone if a pod is not ready anymore.
+			if scrapable && seen {
+				k.updateTarget(object, event.Type)
+				return
+			}
 			// If the object is not scrapable and we've seen it before, we remove it.
 			if !scrapable && seen {
 				k.targets.Delete(string(object.GetUID()))
@@ -532,7 +1026,7 @@ func (k *KubernetesTargetRetriever) processEvent(event watch.Event, requireLabel
 			// If the doesn't doesn't require label and we already have it, update its data.
 			// Things like the IP could be changing.
 			if seen {
-				k.targets.Store(string(object.GetUID()), objectTargets(object))
+				k.targets.Store(string(object.GetUID()), k.objectTargets(object))
 				debugLogEvent(klog, event.Type, "modified", object)
 				return
 			}
@@ -546,7 +1040,7 @@ func (k *KubernetesTargetRetriever) processEvent(event watch.Event, requireLabel
 // addTarget adds the target to the cache
 func (k *KubernetesTargetRetriever) addTarget(object metav1.Object, event watch.EventType) {
 
-	targets := objectTargets(object)
+	targets := k.objectTargets(object)
 	// zero targets could be for pods that just have been scheduled, but no ipAddress assigned yet
 	if len(targets) == 0 {
 		debugLogEvent(klog, event, "ignored", object)
@@ -557,6 +1051,20 @@ func (k *KubernetesTargetRetriever) addTarget(object metav1.Object, event watch.
 	debugLogEvent(klog, event, "added", object)
 }
 
+// updateTarget updates the targets of an already seen object, removing it
+// from the cache if it doesn't have targets anymore.
+func (k *KubernetesTargetRetriever) updateTarget(object metav1.Object, event watch.EventType) {
+	targets := k.objectTargets(object)
+	if len(targets) == 0 {
+		k.targets.Delete(string(object.GetUID()))
+		debugLogEvent(klog, event, "deleted", object)
+		return
+	}
+
+	k.targets.Store(string(object.GetUID()), targets)
+	debugLogEvent(klog, event, "modified", object)
+}
+
 func debugLogEvent(log *logrus.Entry, event watch.EventType, action string, object metav1.Object) {
 	log.WithFields(logrus.Fields{
 		"action": action,
@@ -569,7 +1077,11 @@ func debugLogEvent(log *logrus.Entry, event watch.EventType, action string, obje
 // watchResource retrieves the scrapable resources and watches for changes
 // on such resources. If the watch connection is terminated, the process is
 // started again to ensure no updates are lost between watch restarts.
+//
+// Failed list and watch requests are retried after a jittered exponential
+// backoff, to avoid hammering an API server that is already struggling.
 func (k *KubernetesTargetRetriever) watchResource(resource watchableResource) {
+	backoff := retry.Backoff{Min: k.backoffMin, Max: k.backoffMax}
 	for {
 		timer := prometheus.NewTimer(
 			prometheus.ObserverFunc(
@@ -579,18 +1091,24 @@ func (k *KubernetesTargetRetriever) watchResource(resource watchableResource) {
 		err := retry.Do(resource.listFunction)
 		timer.ObserveDuration()
 		if err != nil {
-			klog.WithError(err).Warnf("couldn't list %s resource, retrying", resource.name)
+			delay := backoff.Next()
+			klog.WithError(err).Warnf("couldn't list %s resource, retrying in %s", resource.name, delay)
+			time.Sleep(delay)
 			continue
 		}
 
 		watches, err := resource.watchFunction()
 		if err != nil {
+			delay := backoff.Next()
 			klog.WithError(err).Warnf(
-				"couldn't subscribe for %s resource watch, retrying",
+				"couldn't subscribe for %s resource watch, retrying in %s",
 				resource.name,
+				delay,
 			)
+			time.Sleep(delay)
 			continue
 		}
+		backoff.Reset()
 		for w := range watches.ResultChan() {
 			k.processEvent(w, resource.requireScrapeEnabledLabel)
 		}
@@ -3,8 +3,11 @@
 package endpoints
 
 import (
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,6 +21,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
 	"github.com/newrelic/nri-prometheus/internal/retry"
@@ -268,6 +272,7 @@ func newFakeKubernetesTargetRetriever(client *fake.Clientset) *KubernetesTargetR
 	return &KubernetesTargetRetriever{
 		client:             client,
 		targets:            new(sync.Map),
+		events:             new(sync.Mutex),
 		scrapeEnabledLabel: "prometheus.io/scrape",
 	}
 }
@@ -630,24 +635,6 @@ func TestPodTargetsNoPort(t *testing.T) {
 			},
 		}),
 		[]Target{
-			{
-				Name: "my-pod",
-				Object: Object{
-					Name: "my-pod",
-					Kind: "pod",
-					Labels: labels.Set{
-						"podName":        "my-pod",
-						"namespaceName":  "test-ns",
-						"deploymentName": "",
-						"nodeName":       "node-a",
-					},
-				},
-				URL: url.URL{
-					Scheme: "http",
-					Host:   "10.0.0.1:80",
-					Path:   "/metrics",
-				},
-			},
 			{
 				Name: "my-pod",
 				Object: Object{
@@ -670,6 +657,62 @@ func TestPodTargetsNoPort(t *testing.T) {
 	)
 }
 
+func TestPodTargetsNoPort_PortDetection(t *testing.T) {
+	cases := []struct {
+		name          string
+		annotatedPort string
+		ports         []apiv1.ContainerPort
+		expectedHosts []string
+	}{
+		{
+			name: "no metrics ports",
+			ports: []apiv1.ContainerPort{
+				{Name: "http", ContainerPort: 80},
+				{ContainerPort: 9000},
+			},
+			expectedHosts: []string{"10.0.0.1:80", "10.0.0.1:9000"},
+		},
+		{
+			name: "multiple metrics ports",
+			ports: []apiv1.ContainerPort{
+				{Name: "http", ContainerPort: 80},
+				{Name: "metrics", ContainerPort: 9090},
+				{Name: "envoy-metrics", ContainerPort: 9091},
+			},
+			expectedHosts: []string{"10.0.0.1:9090", "10.0.0.1:9091"},
+		},
+		{
+			name:          "named port annotation",
+			annotatedPort: "metrics",
+			ports: []apiv1.ContainerPort{
+				{Name: "http", ContainerPort: 80},
+				{Name: "metrics", ContainerPort: 9090},
+			},
+			expectedHosts: []string{"10.0.0.1:9090"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := &apiv1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Namespace: "test-ns"},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{{Name: "app", Ports: c.ports}},
+				},
+				Status: apiv1.PodStatus{PodIP: "10.0.0.1"},
+			}
+			if c.annotatedPort != "" {
+				pod.Annotations = map[string]string{"prometheus.io/port": c.annotatedPort}
+			}
+
+			var hosts []string
+			for _, target := range podTargets(pod) {
+				hosts = append(hosts, target.URL.Host)
+			}
+			assert.Equal(t, c.expectedHosts, hosts)
+		})
+	}
+}
+
 func TestPodTargetsPortAnnotation(t *testing.T) {
 	assert.ElementsMatch(
 		t,
@@ -1474,3 +1517,310 @@ func TestServiceTargetsPathLabel(t *testing.T) {
 		},
 	)
 }
+
+func TestNewKubernetesTargetRetriever_RequestBudget(t *testing.T) {
+	withRestConfig := func(ktr *KubernetesTargetRetriever) error {
+		ktr.restConfig = &rest.Config{Host: "http://localhost:1"}
+		return nil
+	}
+
+	ktr, err := NewKubernetesTargetRetriever(
+		"",
+		false,
+		withRestConfig,
+		WithAPIRequestBudget(1, 2, time.Second),
+		WithBackoff(0, 0),
+	)
+	require.NoError(t, err)
+	assert.NotNil(t, ktr.client)
+	assert.Equal(t, float32(1), ktr.qps)
+	assert.Equal(t, 2, ktr.burst)
+	assert.Equal(t, time.Second, ktr.timeout)
+	assert.Equal(t, defaultBackoffMin, ktr.backoffMin)
+	assert.Equal(t, defaultBackoffMax, ktr.backoffMax)
+
+	_, err = NewKubernetesTargetRetriever("", false, withRestConfig, WithBackoff(time.Minute, time.Second))
+	assert.Error(t, err)
+}
+
+type deadlineRoundTripper map[string]bool
+
+func (rt deadlineRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, rt[req.URL.String()] = req.Context().Deadline()
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestNonWatchTimeoutRoundTripper(t *testing.T) {
+	deadlines := deadlineRoundTripper{}
+	rt := &nonWatchTimeoutRoundTripper{next: deadlines, timeout: time.Second}
+
+	for _, u := range []string{
+		"https://api/api/v1/pods",
+		"https://api/api/v1/pods?watch=true",
+		"https://api/api/v1/watch/pods",
+	} {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	assert.True(t, deadlines["https://api/api/v1/pods"])
+	assert.False(t, deadlines["https://api/api/v1/pods?watch=true"])
+	assert.False(t, deadlines["https://api/api/v1/watch/pods"])
+}
+
+func TestGetTargets_ClusterName(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	retriever := newFakeKubernetesTargetRetriever(client)
+	retriever.clusterName = "edge-1"
+	retriever.apiServerHost = "edge-1.example.com:6443"
+	retriever.nodeAuth = AuthConfig{TLSConfig: TLSConfig{CaFilePath: "/edge-1/ca.crt"}, BearerTokenFile: "/edge-1/token"}
+	retriever.targets.Store("my-node", []Target{
+		New("my-node", url.URL{Scheme: "https", Host: inClusterAPIServerHost, Path: "/api/v1/nodes/my-node/proxy/metrics"}, Object{}),
+		New("my-pod", url.URL{Scheme: "http", Host: "10.10.10.1:8080", Path: "/metrics"},
+			Object{Name: "my-pod", Kind: "pod", Labels: labels.Set{"namespaceName": "shop"}}),
+		New("my-service", url.URL{Scheme: "http", Host: "my-service.shop.svc:8080", Path: "/metrics"}, Object{Kind: "service"}),
+	})
+
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+	urls := []string{}
+	for _, target := range targets {
+		assert.Equal(t, "edge-1", target.ClusterName)
+		urls = append(urls, target.URL.String())
+	}
+	assert.ElementsMatch(t, []string{
+		"https://edge-1.example.com:6443/api/v1/nodes/my-node/proxy/metrics",
+		"https://edge-1.example.com:6443/api/v1/namespaces/shop/pods/my-pod:8080/proxy/metrics",
+		"http://my-service.shop.svc:8080/metrics",
+	}, urls, "the pods are scraped through the API server")
+	assert.Equal(t, "kubernetes-edge-1", retriever.Name())
+	for _, target := range targets {
+		if target.Name != "my-service" {
+			assert.Equal(t, []AuthConfig{retriever.nodeAuth}, target.Auth)
+		} else {
+			assert.Empty(t, target.Auth)
+		}
+	}
+
+	// Without credentials of their own, the nodes and pods of the external
+	// cluster aren't scraped.
+	retriever.nodeAuth = AuthConfig{}
+	targets, err = retriever.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, "my-service", targets[0].Name)
+}
+
+func TestClusterConfigOption(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     ClusterConfig
+		wantErr bool
+	}{
+		{"in cluster", ClusterConfig{ClusterName: "a", InCluster: true}, false},
+		{"kubeconfig", ClusterConfig{ClusterName: "a", KubeConfig: "/kubeconfig", Context: "a"}, false},
+		{"missing cluster name", ClusterConfig{InCluster: true}, true},
+		{"missing connection", ClusterConfig{ClusterName: "a"}, true},
+		{"both connections", ClusterConfig{ClusterName: "a", InCluster: true, KubeConfig: "/kubeconfig"}, true},
+		{"node auth", ClusterConfig{ClusterName: "a", KubeConfig: "/kubeconfig", NodeAuth: AuthConfig{TLSConfig: TLSConfig{CaFilePath: "/ca.crt"}, BearerTokenFile: "/token"}}, false},
+		{"node auth without CA", ClusterConfig{ClusterName: "a", KubeConfig: "/kubeconfig", NodeAuth: AuthConfig{BearerTokenFile: "/token"}}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := c.cfg.Option()
+			if c.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestGetTargets_HostNetworkPods(t *testing.T) {
+	hostNetworkPod := func(name, node, hostIP string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "monitoring",
+				UID:       types.UID(name),
+				Labels:    map[string]string{"prometheus.io/scrape": "true", "prometheus.io/port": "9100"},
+			},
+			Spec:   v1.PodSpec{HostNetwork: true, NodeName: node},
+			Status: v1.PodStatus{PodIP: hostIP, HostIP: hostIP},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		hostNetworkPod("node-exporter-b", "node-a", "10.0.0.1"),
+		hostNetworkPod("node-exporter-a", "node-a", "10.0.0.1"),
+		hostNetworkPod("node-exporter-c", "node-b", "10.0.0.2"),
+	)
+	ktr := newFakeKubernetesTargetRetriever(client)
+	require.NoError(t, ktr.listPods())
+
+	targets, err := ktr.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 2)
+
+	byHost := map[string]Target{}
+	for _, target := range targets {
+		byHost[target.URL.Host] = target
+	}
+	assert.Equal(t, "node-exporter-a", byHost["10.0.0.1:9100"].Object.Name)
+	assert.Equal(t, "node-a", byHost["10.0.0.1:9100"].Object.Labels["nodeName"])
+	assert.Equal(t, "true", byHost["10.0.0.1:9100"].Object.Labels["hostNetwork"])
+	assert.Equal(t, "node-exporter-c", byHost["10.0.0.2:9100"].Object.Name)
+}
+
+func TestProcessEvent_PodReadiness(t *testing.T) {
+	retriever := newFakeKubernetesTargetRetriever(fake.NewSimpleClientset())
+	require.NoError(t, WithPodReadiness(true, true)(retriever))
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			UID:    types.UID("rollout"),
+			Name:   "test-pod",
+			Labels: map[string]string{"prometheus.io/scrape": "true", "prometheus.io/port": "8080"},
+		},
+		Status: v1.PodStatus{PodIP: "10.10.10.10"},
+	}
+	loaded := func() interface{} {
+		actual, _ := retriever.targets.Load(string(pod.GetUID()))
+		return actual
+	}
+
+	// Not ready pods are skipped.
+	retriever.processEvent(watch.Event{Type: watch.Added, Object: pod}, true)
+	assert.Nil(t, loaded())
+
+	// They are added once ready.
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	retriever.processEvent(watch.Event{Type: watch.Modified, Object: pod}, true)
+	assert.Equal(t, podTargets(pod), loaded())
+
+	// And removed when they are being terminated.
+	now := metav1.Now()
+	pod.DeletionTimestamp = &now
+	retriever.processEvent(watch.Event{Type: watch.Modified, Object: pod}, true)
+	assert.Nil(t, loaded())
+}
+
+func TestSkipPod(t *testing.T) {
+	now := metav1.Now()
+	ready := []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	cases := []struct {
+		name            string
+		skipNotReady    bool
+		skipTerminating bool
+		pod             v1.Pod
+		expected        bool
+	}{
+		{
+			name:     "not ready pods are scraped by default",
+			expected: false,
+		},
+		{
+			name:         "not ready",
+			skipNotReady: true,
+			expected:     true,
+		},
+		{
+			name:         "ready",
+			skipNotReady: true,
+			pod:          v1.Pod{Status: v1.PodStatus{Conditions: ready}},
+			expected:     false,
+		},
+		{
+			name:         "not ready with annotation override",
+			skipNotReady: true,
+			pod: v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{"prometheus.io/scrape-not-ready": "true"},
+			}},
+			expected: false,
+		},
+		{
+			name: "annotation skipping not ready",
+			pod: v1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{"prometheus.io/scrape-not-ready": "false"},
+			}},
+			expected: true,
+		},
+		{
+			name:            "terminating",
+			skipTerminating: true,
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &now},
+				Status:     v1.PodStatus{Conditions: ready},
+			},
+			expected: true,
+		},
+		{
+			name:            "terminating with annotation override",
+			skipTerminating: true,
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					DeletionTimestamp: &now,
+					Annotations:       map[string]string{"prometheus.io/scrape-terminating": "true"},
+				},
+				Status: v1.PodStatus{Conditions: ready},
+			},
+			expected: false,
+		},
+		{
+			name: "annotation skipping terminating",
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					DeletionTimestamp: &now,
+					Annotations:       map[string]string{"prometheus.io/scrape-terminating": "false"},
+				},
+				Status: v1.PodStatus{Conditions: ready},
+			},
+			expected: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			retriever := newFakeKubernetesTargetRetriever(fake.NewSimpleClientset())
+			require.NoError(t, WithPodReadiness(c.skipNotReady, c.skipTerminating)(retriever))
+			assert.Equal(t, c.expected, retriever.skipPod(&c.pod))
+		})
+	}
+}
+
+func TestObjectTargetsScrapeTimeout(t *testing.T) {
+	pod := func(annotations, lbls map[string]string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Annotations: annotations, Labels: lbls},
+			Spec: apiv1.PodSpec{Containers: []apiv1.Container{{
+				Ports: []apiv1.ContainerPort{{Name: "metrics", ContainerPort: 8080}, {Name: "http-metrics", ContainerPort: 9090}},
+			}}},
+			Status: apiv1.PodStatus{PodIP: "10.0.0.1"},
+		}
+	}
+
+	targets := objectTargets(pod(map[string]string{"prometheus.io/scrape-timeout": "60s"}, nil))
+	require.Len(t, targets, 2)
+	for _, target := range targets {
+		assert.Equal(t, time.Minute, target.ScrapeTimeout)
+	}
+
+	targets = objectTargets(pod(map[string]string{"prometheus.io/scrape-timeout": "5s"}, map[string]string{"prometheus.io/scrape-timeout": "60s"}))
+	assert.Equal(t, 5*time.Second, targets[0].ScrapeTimeout, "annotations take precedence over labels")
+
+	targets = objectTargets(pod(map[string]string{"prometheus.io/scrape-timeout": "soon"}, nil))
+	assert.Zero(t, targets[0].ScrapeTimeout, "invalid timeouts are ignored")
+
+	targets = objectTargets(pod(nil, nil))
+	assert.Zero(t, targets[0].ScrapeTimeout)
+}
+
+func TestPodProxyURL(t *testing.T) {
+	target := New("my-pod", url.URL{Scheme: "https", Host: "10.10.10.1:8443", Path: "/stats/prometheus", RawQuery: "format=text"},
+		Object{Name: "my-pod", Kind: "pod", Labels: labels.Set{"namespaceName": "shop"}})
+	proxied := podProxyURL("edge-1.example.com:6443", target)
+	assert.Equal(t, "https://edge-1.example.com:6443/api/v1/namespaces/shop/pods/https:my-pod:8443/proxy/stats/prometheus?format=text", proxied.String())
+}
@@ -0,0 +1,156 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// Supported service meshes.
+const (
+	MeshIstio   = "istio"
+	MeshLinkerd = "linkerd"
+)
+
+const (
+	istioSidecarStatusAnnotation = "sidecar.istio.io/status"
+	istioMergeMetricsAnnotation  = "prometheus.istio.io/merge-metrics"
+	// istioMergedMetricsPort is the port of the Istio agent, which merges the
+	// metrics of the application with the ones of the Envoy proxy.
+	istioMergedMetricsPort = "15020"
+	istioEnvoyMetricsPort  = "15090"
+	istioMetricsPath       = "/stats/prometheus"
+
+	linkerdProxyVersionAnnotation  = "linkerd.io/proxy-version"
+	linkerdInboundPolicyAnnotation = "config.linkerd.io/default-inbound-policy"
+	linkerdProxyMetricsPort        = "4191"
+	linkerdProxyMetricsPath        = "/metrics"
+
+	// MeshProxyLabel is the label set on the targets of the mesh proxies,
+	// which holds the name of the proxy.
+	MeshProxyLabel = "meshProxy"
+)
+
+// envoyMetricPrefixes are the Envoy metrics kept when the proxy metrics are
+// scraped as their own target. Envoy exposes thousands of series per pod,
+// most of them only useful to debug the proxy itself.
+var envoyMetricPrefixes = []string{
+	"istio_requests_total",
+	"istio_request_duration_milliseconds",
+	"istio_request_bytes",
+	"istio_response_bytes",
+	"istio_tcp_",
+	"envoy_cluster_upstream_cx_active",
+	"envoy_cluster_upstream_rq_total",
+	"envoy_cluster_upstream_rq_retry",
+	"envoy_server_live",
+	"envoy_server_uptime",
+}
+
+// linkerdProxyMetricPrefixes are the Linkerd proxy metrics kept when the
+// proxy metrics are scraped as their own target.
+var linkerdProxyMetricPrefixes = []string{
+	"request_total",
+	"response_total",
+	"response_latency_ms",
+	"tcp_open_connections",
+	"tcp_read_bytes_total",
+	"tcp_write_bytes_total",
+}
+
+// WithServiceMesh makes the KubernetesTargetRetriever aware of the pods
+// injected with the sidecar proxy of the given service mesh:
+//   - istio: the pods are scraped through the metrics endpoint of the Istio
+//     agent, which merges the application metrics with the Envoy ones, given
+//     the application ports are protected by mTLS.
+//   - linkerd: the application ports are skipped when the pod only accepts
+//     authenticated traffic.
+//
+// If splitProxyMetrics is set, the proxy metrics are scraped as their own
+// target, keeping only a preset list of metrics, and removed from the
+// application target.
+func WithServiceMesh(mesh string, splitProxyMetrics bool) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		switch mesh {
+		case "", MeshIstio, MeshLinkerd:
+		default:
+			return fmt.Errorf("unsupported service mesh %q, supported values are %q and %q", mesh, MeshIstio, MeshLinkerd)
+		}
+		ktr.serviceMesh = mesh
+		ktr.splitMeshProxyMetrics = splitProxyMetrics
+		return nil
+	}
+}
+
+// meshPodTargets adapts the targets of a pod to the sidecar proxy of the
+// service mesh it's injected with. Pods without a sidecar are returned as is.
+func meshPodTargets(p *apiv1.Pod, targets []Target, mesh string, splitProxyMetrics bool) []Target {
+	if podIP(p) == "" {
+		return targets
+	}
+	switch mesh {
+	case MeshIstio:
+		if _, ok := p.Annotations[istioSidecarStatusAnnotation]; ok {
+			return istioPodTargets(p, splitProxyMetrics)
+		}
+	case MeshLinkerd:
+		if _, ok := p.Annotations[linkerdProxyVersionAnnotation]; ok {
+			return linkerdPodTargets(p, targets, splitProxyMetrics)
+		}
+	}
+	return targets
+}
+
+func istioPodTargets(p *apiv1.Pod, splitProxyMetrics bool) []Target {
+	var targets []Target
+	// The application ports only accept mTLS traffic, so the application
+	// metrics can only be scraped through the Istio agent when merging is
+	// enabled.
+	if p.Annotations[istioMergeMetricsAnnotation] != "false" {
+		if target := podTarget(p, istioMergedMetricsPort, istioMetricsPath); target != nil {
+			if splitProxyMetrics {
+				// Envoy metrics are reported by the proxy target.
+				target.MetricFilter = MetricFilter{Prefixes: []string{"envoy_", "istio_"}}
+			}
+			targets = append(targets, *target)
+		}
+	}
+	if splitProxyMetrics {
+		if target := meshProxyTarget(p, "envoy", istioEnvoyMetricsPort, istioMetricsPath, envoyMetricPrefixes); target != nil {
+			targets = append(targets, *target)
+		}
+	}
+	return targets
+}
+
+func linkerdPodTargets(p *apiv1.Pod, targets []Target, splitProxyMetrics bool) []Target {
+	switch p.Annotations[linkerdInboundPolicyAnnotation] {
+	case "all-authenticated", "cluster-authenticated", "deny":
+		// Unmeshed clients like the integration can't reach the application
+		// ports.
+		klog.WithField("pod", p.Name).Debug("skipping mTLS protected application ports")
+		targets = nil
+	}
+	if splitProxyMetrics {
+		if target := meshProxyTarget(p, "linkerd-proxy", linkerdProxyMetricsPort, linkerdProxyMetricsPath, linkerdProxyMetricPrefixes); target != nil {
+			targets = append(targets, *target)
+		}
+	}
+	return targets
+}
+
+// meshProxyTarget returns the target of the sidecar proxy of a pod, keeping
+// only the metrics with the given prefixes.
+func meshProxyTarget(p *apiv1.Pod, proxy, port, path string, keep []string) *Target {
+	target := podTarget(p, port, path)
+	if target == nil {
+		return nil
+	}
+	target.Name = proxy + "-" + p.Name
+	target.Object.Labels[MeshProxyLabel] = proxy
+	target.MetricFilter = MetricFilter{Except: keep}
+	return target
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newMeshPod(annotations map[string]string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my-pod",
+			Namespace:   "test-ns",
+			UID:         "my-pod",
+			Annotations: annotations,
+			Labels:      map[string]string{"prometheus.io/scrape": "true"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{Name: "app", Ports: []apiv1.ContainerPort{{ContainerPort: 8080}}},
+			},
+		},
+		Status: apiv1.PodStatus{PodIP: "10.0.0.1"},
+	}
+}
+
+func TestMeshPodTargets(t *testing.T) {
+	cases := []struct {
+		name         string
+		mesh         string
+		split        bool
+		annotations  map[string]string
+		expectedURLs []string
+	}{
+		{
+			name:         "no sidecar",
+			mesh:         MeshIstio,
+			expectedURLs: []string{"http://10.0.0.1:8080/metrics"},
+		},
+		{
+			name:         "istio merged metrics",
+			mesh:         MeshIstio,
+			annotations:  map[string]string{istioSidecarStatusAnnotation: "{}"},
+			expectedURLs: []string{"http://10.0.0.1:15020/stats/prometheus"},
+		},
+		{
+			name:        "istio split proxy metrics",
+			mesh:        MeshIstio,
+			split:       true,
+			annotations: map[string]string{istioSidecarStatusAnnotation: "{}"},
+			expectedURLs: []string{
+				"http://10.0.0.1:15020/stats/prometheus",
+				"http://10.0.0.1:15090/stats/prometheus",
+			},
+		},
+		{
+			name:  "istio without merged metrics",
+			mesh:  MeshIstio,
+			split: true,
+			annotations: map[string]string{
+				istioSidecarStatusAnnotation: "{}",
+				istioMergeMetricsAnnotation:  "false",
+			},
+			expectedURLs: []string{"http://10.0.0.1:15090/stats/prometheus"},
+		},
+		{
+			name:         "linkerd",
+			mesh:         MeshLinkerd,
+			annotations:  map[string]string{linkerdProxyVersionAnnotation: "stable-2.11.0"},
+			expectedURLs: []string{"http://10.0.0.1:8080/metrics"},
+		},
+		{
+			name:  "linkerd authenticated only",
+			mesh:  MeshLinkerd,
+			split: true,
+			annotations: map[string]string{
+				linkerdProxyVersionAnnotation:  "stable-2.11.0",
+				linkerdInboundPolicyAnnotation: "all-authenticated",
+			},
+			expectedURLs: []string{"http://10.0.0.1:4191/metrics"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := newMeshPod(c.annotations)
+			targets := meshPodTargets(pod, podTargets(pod), c.mesh, c.split)
+
+			urls := make([]string, 0, len(targets))
+			for _, target := range targets {
+				urls = append(urls, target.URL.String())
+			}
+			assert.Equal(t, c.expectedURLs, urls)
+		})
+	}
+}
+
+func TestMeshPodTargets_ProxyTarget(t *testing.T) {
+	pod := newMeshPod(map[string]string{istioSidecarStatusAnnotation: "{}"})
+	targets := meshPodTargets(pod, podTargets(pod), MeshIstio, true)
+	require.Len(t, targets, 2)
+
+	app, proxy := targets[0], targets[1]
+	assert.Equal(t, "my-pod", app.Name)
+	assert.Equal(t, []string{"envoy_", "istio_"}, app.MetricFilter.Prefixes)
+	assert.NotContains(t, app.Object.Labels, MeshProxyLabel)
+
+	assert.Equal(t, "envoy-my-pod", proxy.Name)
+	assert.Equal(t, "envoy", proxy.Object.Labels[MeshProxyLabel])
+	assert.Equal(t, envoyMetricPrefixes, proxy.MetricFilter.Except)
+	assert.Empty(t, proxy.MetricFilter.Prefixes)
+}
+
+func TestWithServiceMesh(t *testing.T) {
+	client := fake.NewSimpleClientset(newMeshPod(map[string]string{istioSidecarStatusAnnotation: "{}"}))
+
+	ktr := newFakeKubernetesTargetRetriever(client)
+	assert.Error(t, WithServiceMesh("consul", false)(ktr))
+	require.NoError(t, WithServiceMesh(MeshIstio, false)(ktr))
+	require.NoError(t, ktr.listPods())
+
+	targets, err := ktr.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, "http://10.0.0.1:15020/stats/prometheus", targets[0].URL.String())
+}
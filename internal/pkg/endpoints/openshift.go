@@ -0,0 +1,110 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"fmt"
+	"net/url"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// routeResource identifies the OpenShift Route resource.
+var routeResource = schema.GroupVersionResource{
+	Group:    "route.openshift.io",
+	Version:  "v1",
+	Resource: "routes",
+}
+
+// WithOpenShiftRoutes enables the discovery of targets from annotated
+// OpenShift Routes. Routes are scraped through the OpenShift router, using
+// https when the route has TLS termination configured.
+func WithOpenShiftRoutes() Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.openShiftRoutes = true
+		return nil
+	}
+}
+
+// newDynamicClient creates the client used to query the OpenShift and the
+// edge resources, which are not available in the Kubernetes typed client.
+func (k *KubernetesTargetRetriever) newDynamicClient() (dynamic.Interface, error) {
+	client, err := dynamic.NewForConfig(k.restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could create dynamic kubernetes client: %w", err)
+	}
+	return client, nil
+}
+
+// listRoutes gets the scrapable routes that are currently available
+func (k *KubernetesTargetRetriever) listRoutes() error {
+	routes, err := k.dynamicClient.Resource(routeResource).Namespace("").List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range routes.Items {
+		r := &routes.Items[i]
+		if isObjectScrapable(r, k.scrapeEnabledLabel) {
+			k.targets.Store(string(r.GetUID()), routeTargets(r))
+		}
+	}
+	return nil
+}
+
+func (k *KubernetesTargetRetriever) routeWatchableResource() watchableResource {
+	return watchableResource{
+		name:                      "route",
+		listFunction:              k.listRoutes,
+		requireScrapeEnabledLabel: true,
+		watchFunction: func() (watch.Interface, error) {
+			return k.dynamicClient.Resource(routeResource).Namespace("").Watch(metav1.ListOptions{})
+		},
+	}
+}
+
+// routeTargets returns the target for an OpenShift Route. Routes without
+// an assigned host are not scrapable yet.
+func routeTargets(r *unstructured.Unstructured) []Target {
+	host, _, _ := unstructured.NestedString(r.Object, "spec", "host")
+	if host == "" {
+		return nil
+	}
+
+	scheme := "http"
+	if tls, ok, _ := unstructured.NestedMap(r.Object, "spec", "tls"); ok && tls != nil {
+		scheme = "https"
+	}
+
+	// Annotations take precedence over labels.
+	path, ok := r.GetAnnotations()[defaultScrapePathLabel]
+	if !ok {
+		path, ok = r.GetLabels()[defaultScrapePathLabel]
+		if !ok {
+			path = defaultScrapePath
+		}
+	}
+	if path[0] != '/' {
+		path = "/" + path
+	}
+
+	addr, err := url.Parse(fmt.Sprintf("%s://%s%s", scheme, host, path))
+	if err != nil {
+		klog.WithError(err).WithField("route", r.GetName()).Errorf("couldn't parse route url, skipping")
+		return nil
+	}
+
+	lbls := labels.Set{}
+	for lk, lv := range r.GetLabels() {
+		lbls["label."+lk] = lv
+	}
+	lbls["routeName"] = r.GetName()
+	lbls["namespaceName"] = r.GetNamespace()
+	return []Target{New(r.GetName(), *addr, Object{Name: r.GetName(), Kind: "route", Labels: lbls})}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func newRoute(name string, spec map[string]interface{}, annotations map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "route.openshift.io/v1",
+		"kind":       "Route",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   "test-ns",
+			"uid":         name,
+			"annotations": annotations,
+			"labels":      map[string]interface{}{"app": name},
+		},
+		"spec": spec,
+	}}
+}
+
+func TestRouteTargets(t *testing.T) {
+	cases := []struct {
+		name        string
+		spec        map[string]interface{}
+		annotations map[string]interface{}
+		expectedURL string
+	}{
+		{
+			name:        "plain route",
+			spec:        map[string]interface{}{"host": "app.apps.example.com"},
+			expectedURL: "http://app.apps.example.com/metrics",
+		},
+		{
+			name: "tls route with path",
+			spec: map[string]interface{}{
+				"host": "app.apps.example.com",
+				"tls":  map[string]interface{}{"termination": "edge"},
+			},
+			annotations: map[string]interface{}{"prometheus.io/path": "custom/metrics"},
+			expectedURL: "https://app.apps.example.com/custom/metrics",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			targets := routeTargets(newRoute("my-route", c.spec, c.annotations))
+			require.Len(t, targets, 1)
+			assert.Equal(t, c.expectedURL, targets[0].URL.String())
+			assert.Equal(t, "route", targets[0].Object.Kind)
+			assert.Equal(t, "my-route", targets[0].Object.Labels["routeName"])
+			assert.Equal(t, "test-ns", targets[0].Object.Labels["namespaceName"])
+			assert.Equal(t, "my-route", targets[0].Object.Labels["label.app"])
+		})
+	}
+
+	assert.Empty(t, routeTargets(newRoute("no-host", map[string]interface{}{}, nil)))
+}
+
+func TestProcessEvent_Route(t *testing.T) {
+	retriever := newFakeKubernetesTargetRetriever(nil)
+	route := newRoute("my-route", map[string]interface{}{"host": "app.apps.example.com"}, map[string]interface{}{"prometheus.io/scrape": "true"})
+
+	retriever.processEvent(watch.Event{Type: watch.Added, Object: route}, true)
+
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, "http://app.apps.example.com/metrics", targets[0].URL.String())
+}
@@ -0,0 +1,90 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Permission is an action on a Kubernetes resource.
+type Permission struct {
+	Verb        string
+	Group       string
+	Resource    string
+	Subresource string
+}
+
+// String returns the permission in the format used by `kubectl auth can-i`.
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	return p.Verb + " " + resource
+}
+
+// requiredPermissions returns the permissions the service account needs to
+// discover and scrape the configured targets.
+func (k *KubernetesTargetRetriever) requiredPermissions() []Permission {
+	var permissions []Permission
+	for _, resource := range []string{"pods", "services", "nodes"} {
+		permissions = append(permissions,
+			Permission{Verb: "list", Resource: resource},
+			Permission{Verb: "watch", Resource: resource},
+		)
+	}
+	// Nodes are scraped through the API server proxy.
+	permissions = append(permissions, Permission{Verb: "get", Resource: "nodes", Subresource: "proxy"})
+	if k.openShiftRoutes {
+		permissions = append(permissions,
+			Permission{Verb: "list", Group: routeResource.Group, Resource: routeResource.Resource},
+			Permission{Verb: "watch", Group: routeResource.Group, Resource: routeResource.Resource},
+		)
+	}
+	if k.edge.Ingresses {
+		permissions = append(permissions,
+			Permission{Verb: "list", Group: ingressResource.Group, Resource: ingressResource.Resource},
+			Permission{Verb: "watch", Group: ingressResource.Group, Resource: ingressResource.Resource},
+		)
+	}
+	if k.edge.HTTPRoutes {
+		permissions = append(permissions,
+			Permission{Verb: "list", Group: httpRouteResource.Group, Resource: httpRouteResource.Resource},
+			Permission{Verb: "watch", Group: httpRouteResource.Group, Resource: httpRouteResource.Resource},
+		)
+	}
+	return permissions
+}
+
+// MissingPermissions checks, through SelfSubjectAccessReviews, which of the
+// permissions needed for the discovery are not granted to the service
+// account, so they can be reported at startup instead of as forbidden errors
+// when listing or watching the resources.
+func (k *KubernetesTargetRetriever) MissingPermissions() ([]Permission, error) {
+	var missing []Permission
+	for _, p := range k.requiredPermissions() {
+		review, err := k.client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:        p.Verb,
+					Group:       p.Group,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not review permission %q: %w", p, err)
+		}
+		if !review.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMissingPermissions(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		// Grant everything but watching nodes and the routes.
+		review.Status.Allowed = !(attrs.Resource == "nodes" && attrs.Verb == "watch") && attrs.Group == ""
+		return true, review, nil
+	})
+
+	ktr := newFakeKubernetesTargetRetriever(client)
+	missing, err := ktr.MissingPermissions()
+	require.NoError(t, err)
+	assert.Equal(t, []Permission{{Verb: "watch", Resource: "nodes"}}, missing)
+
+	require.NoError(t, WithOpenShiftRoutes()(ktr))
+	missing, err = ktr.MissingPermissions()
+	require.NoError(t, err)
+
+	var names []string
+	for _, p := range missing {
+		names = append(names, p.String())
+	}
+	assert.Equal(t, []string{"watch nodes", "list routes.route.openshift.io", "watch routes.route.openshift.io"}, names)
+}
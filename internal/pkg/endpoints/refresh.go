@@ -0,0 +1,83 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Refresher is implemented by the TargetRetrievers whose targets can be
+// re-discovered on demand.
+type Refresher interface {
+	Refresh() error
+}
+
+// WithRefreshInterval configures the KubernetesTargetRetriever to list all
+// the resources periodically, on top of watching them, so changes missed by
+// the watches are eventually picked up. A zero interval disables it.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		if interval < 0 {
+			return errors.New("refresh interval can't be negative")
+		}
+		ktr.refreshInterval = interval
+		return nil
+	}
+}
+
+// Refresh lists all the resources again, replacing the current targets with
+// the listed ones. The current targets are kept if any of the lists fails.
+// The watch events wait for the refresh to complete, so they're applied on
+// top of the listed targets.
+func (k *KubernetesTargetRetriever) Refresh() error {
+	k.events.Lock()
+	defer k.events.Unlock()
+
+	listed := *k
+	listed.targets = new(sync.Map)
+	for _, r := range listed.getWatchableResources() {
+		if err := r.listFunction(); err != nil {
+			return err
+		}
+	}
+
+	k.targets.Range(func(uid, _ interface{}) bool {
+		if _, ok := listed.targets.Load(uid); !ok {
+			k.targets.Delete(uid)
+		}
+		return true
+	})
+	listed.targets.Range(func(uid, targets interface{}) bool {
+		k.targets.Store(uid, targets)
+		return true
+	})
+	return nil
+}
+
+// refreshPeriodically refreshes the targets on every refresh interval.
+func (k *KubernetesTargetRetriever) refreshPeriodically() {
+	for range time.Tick(k.refreshInterval) {
+		if err := k.Refresh(); err != nil {
+			klog.WithError(err).Warn("couldn't refresh targets, keeping the current ones")
+		}
+	}
+}
+
+// Refresh refreshes the wrapped retriever, if it supports it.
+func (c *cachedRetriever) Refresh() error {
+	if r, ok := c.retriever.(Refresher); ok {
+		return r.Refresh()
+	}
+	return nil
+}
+
+// Refresh refreshes the wrapped retriever, if it supports it.
+func (s *shardedRetriever) Refresh() error {
+	if r, ok := s.retriever.(Refresher); ok {
+		return r.Refresh()
+	}
+	return nil
+}
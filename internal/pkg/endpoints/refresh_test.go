@@ -0,0 +1,93 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRefresh(t *testing.T) {
+	newPod := func(name string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				UID:    types.UID(name),
+				Labels: map[string]string{"prometheus.io/scrape": "true", "prometheus.io/port": "8080"},
+			},
+			Status: v1.PodStatus{PodIP: "10.0.0.1"},
+		}
+	}
+	client := fake.NewSimpleClientset(newPod("kept"))
+	ktr := newFakeKubernetesTargetRetriever(client)
+	// A pod whose deletion was missed by the watch.
+	ktr.targets.Store("stale", podTargets(newPod("stale")))
+	_, err := client.CoreV1().Pods("").Create(newPod("added"))
+	require.NoError(t, err)
+
+	require.NoError(t, ktr.Refresh())
+
+	targets, err := ktr.GetTargets()
+	require.NoError(t, err)
+	var names []string
+	for _, target := range targets {
+		names = append(names, target.Name)
+	}
+	assert.ElementsMatch(t, []string{"kept", "added"}, names)
+}
+
+func TestRefresh_SerializedWithEvents(t *testing.T) {
+	deleted := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "deleted",
+			UID:    types.UID("deleted"),
+			Labels: map[string]string{"prometheus.io/scrape": "true", "prometheus.io/port": "8080"},
+		},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	client := fake.NewSimpleClientset(deleted)
+	ktr := newFakeKubernetesTargetRetriever(client)
+	ktr.targets.Store("deleted", podTargets(deleted))
+
+	// The pod is deleted while the refresh lists the pods, after they're
+	// read from the API.
+	processed := make(chan struct{})
+	var once sync.Once
+	client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		once.Do(func() {
+			go func() {
+				ktr.processEvent(watch.Event{Type: watch.Deleted, Object: deleted}, true)
+				close(processed)
+			}()
+			select {
+			case <-processed:
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+		return false, nil, nil
+	})
+
+	require.NoError(t, ktr.Refresh())
+	<-processed
+
+	targets, err := ktr.GetTargets()
+	require.NoError(t, err)
+	assert.Empty(t, targets)
+}
+
+func TestWithRefreshInterval(t *testing.T) {
+	ktr := newFakeKubernetesTargetRetriever(fake.NewSimpleClientset())
+	assert.Error(t, WithRefreshInterval(-1)(ktr))
+	require.NoError(t, WithRefreshInterval(0)(ktr))
+}
@@ -0,0 +1,61 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// schemeFallbackLabel sets the SchemeFallback of the targets of an object.
+const schemeFallbackLabel = "prometheus.io/scheme-fallback"
+
+// SchemeFallback is the policy of the fallback between https and http of
+// the scrapes of a target, for the targets that upgrade or downgrade their
+// protocol during a migration.
+type SchemeFallback string
+
+const (
+	// SchemeFallbackNone only scrapes the scheme of the URL, the default.
+	SchemeFallbackNone SchemeFallback = "none"
+	// SchemeFallbackDowngrade falls back from https to http.
+	SchemeFallbackDowngrade SchemeFallback = "downgrade"
+	// SchemeFallbackUpgrade falls back from http to https.
+	SchemeFallbackUpgrade SchemeFallback = "upgrade"
+	// SchemeFallbackAny falls back from either scheme to the other.
+	SchemeFallbackAny SchemeFallback = "any"
+)
+
+// Validate returns an error if the policy is unknown.
+func (p SchemeFallback) Validate() error {
+	switch p {
+	case "", SchemeFallbackNone, SchemeFallbackDowngrade, SchemeFallbackUpgrade, SchemeFallbackAny:
+		return nil
+	}
+	return fmt.Errorf("unknown scheme_fallback %q, expected none, downgrade, upgrade or any", p)
+}
+
+// Fallback returns the scheme the scrapes of a URL with the scheme fall back
+// to, or an empty string if they don't.
+func (p SchemeFallback) Fallback(scheme string) string {
+	switch {
+	case scheme == "https" && (p == SchemeFallbackDowngrade || p == SchemeFallbackAny):
+		return "http"
+	case scheme == "http" && (p == SchemeFallbackUpgrade || p == SchemeFallbackAny):
+		return "https"
+	}
+	return ""
+}
+
+// objectSchemeFallback returns the policy of the schemeFallbackLabel of the
+// object, or an empty one if it has none or it's unknown.
+func objectSchemeFallback(object metav1.Object) SchemeFallback {
+	policy := SchemeFallback(objectLabel(object, schemeFallbackLabel))
+	if err := policy.Validate(); err != nil {
+		klog.WithError(err).WithField("object", object.GetName()).Warnf("ignoring %s", schemeFallbackLabel)
+		return ""
+	}
+	return policy
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSchemeFallback(t *testing.T) {
+	cases := []struct {
+		policy        SchemeFallback
+		https, http   string
+		expectInvalid bool
+	}{
+		{policy: ""},
+		{policy: SchemeFallbackNone},
+		{policy: SchemeFallbackDowngrade, https: "http"},
+		{policy: SchemeFallbackUpgrade, http: "https"},
+		{policy: SchemeFallbackAny, https: "http", http: "https"},
+		{policy: "sideways", expectInvalid: true},
+	}
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			if c.expectInvalid {
+				assert.Error(t, c.policy.Validate())
+				return
+			}
+			assert.NoError(t, c.policy.Validate())
+			assert.Equal(t, c.https, c.policy.Fallback("https"))
+			assert.Equal(t, c.http, c.policy.Fallback("http"))
+		})
+	}
+}
+
+func TestEndpointToTargetSchemeFallback(t *testing.T) {
+	targets, err := EndpointToTarget(TargetConfig{URLs: []string{"https://exporter:9100"}, SchemeFallback: SchemeFallbackDowngrade})
+	require.NoError(t, err)
+	assert.Equal(t, SchemeFallbackDowngrade, targets[0].SchemeFallback)
+
+	_, err = EndpointToTarget(TargetConfig{URLs: []string{"https://exporter:9100"}, SchemeFallback: "sideways"})
+	assert.Error(t, err)
+}
+
+func TestObjectTargetsSchemeFallback(t *testing.T) {
+	pod := func(annotations map[string]string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "my-pod", Annotations: annotations},
+			Spec: apiv1.PodSpec{Containers: []apiv1.Container{{
+				Ports: []apiv1.ContainerPort{{Name: "metrics", ContainerPort: 8080}},
+			}}},
+			Status: apiv1.PodStatus{PodIP: "10.0.0.1"},
+		}
+	}
+
+	targets := objectTargets(pod(map[string]string{"prometheus.io/scheme-fallback": "upgrade"}))
+	require.Len(t, targets, 1)
+	assert.Equal(t, SchemeFallbackUpgrade, targets[0].SchemeFallback)
+
+	targets = objectTargets(pod(map[string]string{"prometheus.io/scheme-fallback": "sideways"}))
+	assert.Empty(t, targets[0].SchemeFallback, "unknown policies are ignored")
+}
@@ -0,0 +1,80 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+)
+
+// serviceAccountAuthLabel scrapes the targets of the object with the
+// service account token of the integration when "true", like the kubelets
+// or the metrics-server. It's only honored for the objects allowed by the
+// ServiceAccountAuthConfig.
+const serviceAccountAuthLabel = "prometheus.io/service-account-auth"
+
+// The token of the service account the integration runs with, and the CA of
+// the cluster, as mounted into its pod. They're variables so the tests can
+// replace them.
+var (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// ServiceAccountAuth returns the authentication method sending the token of
+// the service account of the integration, verifying the targets with the CA
+// of the cluster. The token is read for every scrape, so the rotations of
+// the projected tokens are picked up.
+func ServiceAccountAuth() AuthConfig {
+	return AuthConfig{
+		TLSConfig:       TLSConfig{CaFilePath: serviceAccountCAFile},
+		BearerTokenFile: serviceAccountTokenFile,
+	}
+}
+
+// IsServiceAccount returns true if the authentication method sends the
+// token of the service account of the integration.
+func (c AuthConfig) IsServiceAccount() bool {
+	return c.BearerTokenFile == serviceAccountTokenFile
+}
+
+// ServiceAccountAuthConfig are the objects the serviceAccountAuthLabel is
+// honored for: the ones in one of the Namespaces, or whose labels match the
+// Selector. The token of the integration can read the whole cluster, so
+// without any of them the label is ignored, and any workload could
+// otherwise have it sent to itself.
+type ServiceAccountAuthConfig struct {
+	Namespaces []string `mapstructure:"namespaces"`
+	Selector   string   `mapstructure:"selector"`
+}
+
+// WithServiceAccountAuth sets the objects the serviceAccountAuthLabel is
+// honored for.
+func WithServiceAccountAuth(cfg ServiceAccountAuthConfig) Option {
+	return func(ktr *KubernetesTargetRetriever) error {
+		ktr.serviceAccountAuthNamespaces = cfg.Namespaces
+		ktr.serviceAccountAuthSelector = nil
+		if cfg.Selector != "" {
+			selector, err := klabels.Parse(cfg.Selector)
+			if err != nil {
+				return fmt.Errorf("invalid service account auth selector %q: %w", cfg.Selector, err)
+			}
+			ktr.serviceAccountAuthSelector = selector
+		}
+		return nil
+	}
+}
+
+// serviceAccountAuthAllowed returns true if the serviceAccountAuthLabel of
+// the object is honored.
+func (k *KubernetesTargetRetriever) serviceAccountAuthAllowed(o metav1.Object) bool {
+	for _, ns := range k.serviceAccountAuthNamespaces {
+		if ns == o.GetNamespace() {
+			return true
+		}
+	}
+	return k.serviceAccountAuthSelector != nil && k.serviceAccountAuthSelector.Matches(klabels.Set(o.GetLabels()))
+}
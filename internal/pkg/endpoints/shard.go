@@ -0,0 +1,303 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ringVirtualNodes is the number of points of every replica in the hash
+// ring, which evens the number of targets of the replicas.
+const ringVirtualNodes = 128
+
+// hostnameOrdinal matches the ordinal of the StatefulSet pod names.
+var hostnameOrdinal = regexp.MustCompile(`-(\d+)$`)
+
+var (
+	shardOwnedTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "shard_owned_target",
+		Help:      "Set to 1 for every target scraped by the replica in sharded mode",
+	},
+		[]string{
+			"target",
+			"replica",
+		},
+	)
+	shardTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "shard_targets",
+		Help:      "Number of targets discovered and owned by the replica in sharded mode",
+	},
+		[]string{
+			"replica",
+			"replicas",
+			"state",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shardOwnedTargets, shardTargets)
+}
+
+// ShardingConfig splits the targets among the replicas of a StatefulSet,
+// each one scraping the targets the hash ring of the replicas assigns to it.
+type ShardingConfig struct {
+	// Replicas is the number of replicas sharing the targets. Sharding is
+	// disabled if 0.
+	Replicas int `mapstructure:"replicas"`
+	// Replica is the index of this replica, from 0 to Replicas-1. Defaults
+	// to the ordinal at the end of the hostname, like 2 for
+	// nri-prometheus-2.
+	Replica *int `mapstructure:"replica"`
+}
+
+// IsEmpty returns true if sharding is disabled.
+func (c ShardingConfig) IsEmpty() bool {
+	return c.Replicas == 0
+}
+
+// Validate returns an error if the number of replicas or the index of the
+// replica are not valid.
+func (c ShardingConfig) Validate() error {
+	if c.Replicas < 0 {
+		return fmt.Errorf("sharding replicas must be greater than or equal to 0, got %d", c.Replicas)
+	}
+	if c.Replica != nil && (*c.Replica < 0 || *c.Replica >= c.Replicas) {
+		return fmt.Errorf("sharding replica must be between 0 and %d, got %d", c.Replicas-1, *c.Replica)
+	}
+	return nil
+}
+
+// ReplicaIndex returns the configured index of the replica, or the ordinal
+// at the end of the hostname.
+func (c ShardingConfig) ReplicaIndex(hostname string) (int, error) {
+	if c.Replica != nil {
+		return *c.Replica, nil
+	}
+	m := hostnameOrdinal.FindStringSubmatch(hostname)
+	if m == nil {
+		return 0, fmt.Errorf("the hostname %q has no ordinal, set the sharding replica", hostname)
+	}
+	replica, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, err
+	}
+	if replica >= c.Replicas {
+		return 0, fmt.Errorf("the hostname ordinal %d is out of the %d sharding replicas", replica, c.Replicas)
+	}
+	return replica, nil
+}
+
+// Ring is a consistent hash ring of replicas. When the number of replicas
+// changes, only the targets of the added or removed replicas move.
+type Ring struct {
+	hashes []uint64
+	owners []int
+}
+
+// NewRing returns the hash ring of the replicas.
+func NewRing(replicas int) *Ring {
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	points := make([]point, 0, replicas*ringVirtualNodes)
+	for r := 0; r < replicas; r++ {
+		for v := 0; v < ringVirtualNodes; v++ {
+			points = append(points, point{hash: hashKey(fmt.Sprintf("%d-%d", r, v)), owner: r})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	ring := &Ring{hashes: make([]uint64, len(points)), owners: make([]int, len(points))}
+	for i, p := range points {
+		ring.hashes[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return ring
+}
+
+// Owner returns the replica owning the key: the one of the first point of
+// the ring after the hash of the key.
+func (r *Ring) Owner(key string) int {
+	if len(r.hashes) == 0 {
+		return 0
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	// The FNV hashes of similar keys are close, so they are mixed to spread
+	// them over the ring.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// TargetOwnership is the replica owning a target. The user info of the URL
+// is redacted.
+type TargetOwnership struct {
+	Target string `json:"target"`
+	URL    string `json:"url"`
+	Owner  int    `json:"owner"`
+	Owned  bool   `json:"owned"`
+}
+
+// Sharder assigns the targets to the replicas, and publishes the targets
+// owned by this replica as metrics. It's an http.Handler serving the
+// ownership of all the discovered targets as JSON.
+type Sharder struct {
+	ring     *Ring
+	replica  int
+	replicas int
+
+	mu sync.Mutex
+	// targets are the ownerships of the targets of every retriever, and
+	// published the targets with an owned target metric.
+	targets   map[string][]TargetOwnership
+	published map[string]bool
+}
+
+// NewSharder returns the Sharder of the replica, among the given number of
+// replicas.
+func NewSharder(replica, replicas int) *Sharder {
+	return &Sharder{
+		ring:      NewRing(replicas),
+		replica:   replica,
+		replicas:  replicas,
+		targets:   map[string][]TargetOwnership{},
+		published: map[string]bool{},
+	}
+}
+
+// assign returns the targets of the retriever owned by this replica, and
+// records the ownership of all of them.
+func (s *Sharder) assign(retriever string, targets []Target) []Target {
+	owned := make([]Target, 0, len(targets)/s.replicas+1)
+	ownerships := make([]TargetOwnership, 0, len(targets))
+	for _, t := range targets {
+		owner := s.ring.Owner(t.URL.String())
+		ownerships = append(ownerships, TargetOwnership{
+			Target: t.Name,
+			URL:    RedactedURL(t.URL),
+			Owner:  owner,
+			Owned:  owner == s.replica,
+		})
+		if owner == s.replica {
+			owned = append(owned, t)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets[retriever] = ownerships
+	s.publish()
+	return owned
+}
+
+// publish updates the metrics of the owned targets. It's called with the
+// lock held.
+func (s *Sharder) publish() {
+	replica := strconv.Itoa(s.replica)
+	owned := map[string]bool{}
+	discovered := 0
+	for _, ownerships := range s.targets {
+		discovered += len(ownerships)
+		for _, o := range ownerships {
+			if o.Owned {
+				owned[o.Target] = true
+			}
+		}
+	}
+	for target := range s.published {
+		if !owned[target] {
+			shardOwnedTargets.DeleteLabelValues(target, replica)
+		}
+	}
+	for target := range owned {
+		shardOwnedTargets.WithLabelValues(target, replica).Set(1)
+	}
+	s.published = owned
+
+	replicas := strconv.Itoa(s.replicas)
+	shardTargets.WithLabelValues(replica, replicas, "discovered").Set(float64(discovered))
+	shardTargets.WithLabelValues(replica, replicas, "owned").Set(float64(len(owned)))
+}
+
+// Ownerships returns the ownership of the discovered targets, sorted by URL.
+func (s *Sharder) Ownerships() []TargetOwnership {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []TargetOwnership
+	for _, ownerships := range s.targets {
+		all = append(all, ownerships...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].URL < all[j].URL })
+	return all
+}
+
+// ServeHTTP writes the replica and the ownership of the discovered targets
+// as JSON.
+func (s *Sharder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Replica  int               `json:"replica"`
+		Replicas int               `json:"replicas"`
+		Targets  []TargetOwnership `json:"targets"`
+	}{s.replica, s.replicas, s.Ownerships()})
+}
+
+// shardedRetriever wraps a TargetRetriever, keeping only the targets owned
+// by the replica.
+type shardedRetriever struct {
+	retriever TargetRetriever
+	sharder   *Sharder
+}
+
+// ShardedRetriever returns a TargetRetriever returning the targets of the
+// given retriever owned by the replica of the sharder.
+func ShardedRetriever(retriever TargetRetriever, sharder *Sharder) TargetRetriever {
+	return &shardedRetriever{retriever: retriever, sharder: sharder}
+}
+
+// Watch starts the wrapped retriever.
+func (s *shardedRetriever) Watch() error {
+	return s.retriever.Watch()
+}
+
+// Name returns the name of the wrapped retriever.
+func (s *shardedRetriever) Name() string {
+	return s.retriever.Name()
+}
+
+// GetTargets returns the targets of the wrapped retriever owned by the
+// replica.
+func (s *shardedRetriever) GetTargets() ([]Target, error) {
+	targets, err := s.retriever.GetTargets()
+	if err != nil {
+		return nil, err
+	}
+	return s.sharder.assign(s.retriever.Name(), targets), nil
+}
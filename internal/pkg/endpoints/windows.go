@@ -0,0 +1,85 @@
+// Package endpoints ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Supported target presets.
+const (
+	PresetWindowsExporter = "windows_exporter"
+)
+
+// windowsExporterPort is the default port of the windows_exporter.
+const windowsExporterPort = "9182"
+
+// windowsExporterMetricPrefixes are the windows_exporter metrics kept by its
+// preset: the ones of its default collectors, which cover the host CPU,
+// memory, disks, network, OS and services. Other collectors, like the
+// process or IIS ones, expose many series per host and have to be scraped
+// with a target without preset.
+var windowsExporterMetricPrefixes = []string{
+	"windows_cpu_",
+	"windows_cs_",
+	"windows_exporter_build_info",
+	"windows_logical_disk_",
+	"windows_memory_",
+	"windows_net_",
+	"windows_os_",
+	"windows_service_state",
+	"windows_system_",
+}
+
+// checkPreset returns an error if the target preset is not supported.
+func checkPreset(preset string) error {
+	switch preset {
+	case "", PresetWindowsExporter:
+		return nil
+	default:
+		return fmt.Errorf("unsupported target preset %q, the supported value is %q", preset, PresetWindowsExporter)
+	}
+}
+
+// applyPreset sets the defaults of the target preset on the target: the
+// port when the URL doesn't have any and its metric filter.
+func applyPreset(t *Target, preset string) error {
+	if err := checkPreset(preset); err != nil {
+		return err
+	}
+	if preset == PresetWindowsExporter {
+		if t.URL.Port() == "" {
+			t.URL.Host = net.JoinHostPort(t.URL.Hostname(), windowsExporterPort)
+			t.Name = t.URL.Host
+			t.Object.Name = t.URL.Host
+		}
+		t.MetricFilter = MetricFilter{Except: windowsExporterMetricPrefixes}
+	}
+	return nil
+}
+
+// readHostsFile returns the hosts listed in the file, one per line. Empty
+// lines and lines starting with # are skipped.
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	return hosts, scanner.Err()
+}
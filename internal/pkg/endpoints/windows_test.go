@@ -0,0 +1,92 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package endpoints
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowsExporterPreset(t *testing.T) {
+	targets, err := EndpointToTarget(TargetConfig{
+		URLs:   []string{"win-1", "win-2:9100", "https://win-3/custom"},
+		Preset: PresetWindowsExporter,
+	})
+	require.NoError(t, err)
+	require.Len(t, targets, 3)
+
+	assert.Equal(t, "http://win-1:9182/metrics", targets[0].URL.String())
+	assert.Equal(t, "win-1:9182", targets[0].Name)
+	assert.Equal(t, "http://win-2:9100/metrics", targets[1].URL.String())
+	assert.Equal(t, "https://win-3:9182/custom", targets[2].URL.String())
+	for _, target := range targets {
+		assert.Equal(t, MetricFilter{Except: windowsExporterMetricPrefixes}, target.MetricFilter)
+	}
+}
+
+func TestUnsupportedPreset(t *testing.T) {
+	_, err := FixedRetriever(TargetConfig{HostsFile: "hosts", Preset: "linux_exporter"})
+	assert.Error(t, err)
+}
+
+func TestFixedRetrieverHostsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# OU=Servers\nwin-1.corp.example\n\n  win-2.corp.example  \n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	retriever, err := FixedRetriever(
+		TargetConfig{URLs: []string{"linux-1:9100"}},
+		TargetConfig{HostsFile: f.Name(), Preset: PresetWindowsExporter},
+	)
+	require.NoError(t, err)
+
+	targetNames := func() []string {
+		targets, err := retriever.GetTargets()
+		require.NoError(t, err)
+		var names []string
+		for _, target := range targets {
+			names = append(names, target.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"linux-1:9100", "win-1.corp.example:9182", "win-2.corp.example:9182"}, targetNames())
+
+	require.NoError(t, ioutil.WriteFile(f.Name(), []byte("win-3.corp.example\n"), 0644))
+	assert.Equal(t, []string{"linux-1:9100", "win-3.corp.example:9182"}, targetNames())
+
+	// The previous targets are kept while the file can't be read.
+	require.NoError(t, os.Remove(f.Name()))
+	assert.Equal(t, []string{"linux-1:9100", "win-3.corp.example:9182"}, targetNames())
+}
+
+func TestFixedRetrieverHostsFile_Concurrent(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("win-1.corp.example\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	retriever, err := FixedRetriever(TargetConfig{HostsFile: f.Name(), Preset: PresetWindowsExporter})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			targets, err := retriever.GetTargets()
+			assert.NoError(t, err)
+			assert.Len(t, targets, 1)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,179 @@
+// Package gateway reaches the targets through a gateway host, for
+// hub-and-spoke networks where the targets aren't directly reachable.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Gateway modes.
+const (
+	// ModeConnect opens a tunnel to the target with an HTTP CONNECT request
+	// to the gateway, for both http and https targets.
+	ModeConnect = "connect"
+	// ModePath sends the scrape to the gateway with the target host and
+	// path appended to the gateway URL path, like
+	// http://gateway/proxy/host:port/metrics.
+	ModePath = "path"
+)
+
+// dialTimeout bounds the connection to the gateway and the CONNECT request
+// when the context has no deadline.
+const dialTimeout = 30 * time.Second
+
+// Config is used to parse the gateway configuration of the targets.
+type Config struct {
+	// URL of the gateway. Its user info, if any, is sent as the basic
+	// credentials of the CONNECT requests.
+	URL string `mapstructure:"url"`
+	// Mode is connect, the default, or path.
+	Mode string `mapstructure:"mode"`
+}
+
+// IsEmpty returns true if no gateway is set.
+func (c Config) IsEmpty() bool {
+	return c.URL == ""
+}
+
+// Validate returns an error if the gateway URL or mode are not valid.
+func (c Config) Validate() error {
+	if c.IsEmpty() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid gateway URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid gateway URL %q, it must be an http or https URL", c.URL)
+	}
+	switch c.Mode {
+	case "", ModeConnect, ModePath:
+		return nil
+	default:
+		return fmt.Errorf("invalid gateway mode %q, must be %s or %s", c.Mode, ModeConnect, ModePath)
+	}
+}
+
+// IsPath returns true if the targets are reached with path-based requests.
+func (c Config) IsPath() bool {
+	return !c.IsEmpty() && c.Mode == ModePath
+}
+
+// IsConnect returns true if the targets are reached through CONNECT tunnels.
+func (c Config) IsConnect() bool {
+	return !c.IsEmpty() && (c.Mode == "" || c.Mode == ModeConnect)
+}
+
+// RewriteURL returns the gateway URL of a path-based scrape of the target
+// URL. The URL of the target is returned as is in connect mode.
+func (c Config) RewriteURL(target url.URL) (url.URL, error) {
+	if !c.IsPath() {
+		return target, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return target, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + target.Host + target.Path
+	u.RawQuery = target.RawQuery
+	return *u, nil
+}
+
+// Dialer opens the connections to the targets through CONNECT tunnels.
+type Dialer struct {
+	gateway       *url.URL
+	authorization string
+	dialer        net.Dialer
+}
+
+// NewDialer returns the Dialer of the gateway configuration.
+func NewDialer(c Config) (*Dialer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialer{gateway: u}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		d.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+	}
+	return d, nil
+}
+
+// address returns the host:port of the gateway.
+func (d *Dialer) address() string {
+	if d.gateway.Port() != "" {
+		return d.gateway.Host
+	}
+	if d.gateway.Scheme == "https" {
+		return net.JoinHostPort(d.gateway.Hostname(), "443")
+	}
+	return net.JoinHostPort(d.gateway.Hostname(), "80")
+}
+
+// DialContext connects to the address through a CONNECT tunnel opened by the
+// gateway.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+	}
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.address())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to gateway %s: %w", d.gateway.Host, err)
+	}
+	if d.gateway.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.gateway.Hostname()})
+	}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if err := d.connect(conn, address); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connect sends the CONNECT request of the address and reads its response.
+func (d *Dialer) connect(conn net.Conn, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if d.authorization != "" {
+		req.Header.Set("Proxy-Authorization", d.authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("sending CONNECT to gateway %s: %w", d.gateway.Host, err)
+	}
+	// The gateway doesn't send anything else until the tunnel is used, so
+	// the buffered reader can be dropped after the response. The body isn't
+	// closed, as it would read from the tunnel.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("reading CONNECT response of gateway %s: %w", d.gateway.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gateway %s refused to connect to %s: %s", d.gateway.Host, address, resp.Status)
+	}
+	return nil
+}
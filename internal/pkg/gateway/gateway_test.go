@@ -0,0 +1,117 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package gateway
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectGateway tunnels the CONNECT requests it accepts to their address,
+// recording the addresses and the credentials of the requests.
+type connectGateway struct {
+	mu             sync.Mutex
+	addresses      []string
+	authorizations []string
+}
+
+func (g *connectGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	g.mu.Lock()
+	g.addresses = append(g.addresses, r.Host)
+	g.authorizations = append(g.authorizations, r.Header.Get("Proxy-Authorization"))
+	g.mu.Unlock()
+
+	target, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go func() {
+		_, _ = io.Copy(target, buf)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(conn, target)
+	_ = conn.Close()
+}
+
+func TestDialer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "up 1\n")
+	}))
+	defer target.Close()
+	gw := &connectGateway{}
+	gwServer := httptest.NewServer(gw)
+	defer gwServer.Close()
+
+	gwURL, err := url.Parse(gwServer.URL)
+	require.NoError(t, err)
+	gwURL.User = url.UserPassword("scraper", "secret")
+	d, err := NewDialer(Config{URL: gwURL.String()})
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	resp, err := client.Get(target.URL + "/metrics")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, "up 1\n", string(body))
+	targetURL, _ := url.Parse(target.URL)
+	assert.Equal(t, []string{targetURL.Host}, gw.addresses)
+	assert.Equal(t, []string{"Basic c2NyYXBlcjpzZWNyZXQ="}, gw.authorizations)
+}
+
+func TestDialer_Refused(t *testing.T) {
+	gwServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer gwServer.Close()
+
+	d, err := NewDialer(Config{URL: gwServer.URL})
+	require.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+	_, err = client.Get("http://exporter:9100/metrics")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refused to connect to exporter:9100")
+}
+
+func TestConfig_RewriteURL(t *testing.T) {
+	target := url.URL{Scheme: "http", Host: "10.1.2.3:9100", Path: "/metrics", RawQuery: "collect%5B%5D=cpu"}
+
+	u, err := Config{URL: "https://bastion.example.com/proxy/", Mode: ModePath}.RewriteURL(target)
+	require.NoError(t, err)
+	assert.Equal(t, "https://bastion.example.com/proxy/10.1.2.3:9100/metrics?collect%5B%5D=cpu", u.String())
+
+	u, err = Config{URL: "http://bastion:3128"}.RewriteURL(target)
+	require.NoError(t, err)
+	assert.Equal(t, target, u, "connect mode keeps the target URL")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{URL: "http://bastion:3128"}.Validate())
+	assert.NoError(t, Config{URL: "https://bastion/proxy", Mode: ModePath}.Validate())
+	assert.Error(t, Config{URL: "bastion:3128"}.Validate())
+	assert.Error(t, Config{URL: "socks5://bastion:1080"}.Validate())
+	assert.Error(t, Config{URL: "http://bastion:3128", Mode: "socks"}.Validate())
+}
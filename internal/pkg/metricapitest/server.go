@@ -0,0 +1,212 @@
+// Package metricapitest provides a mock of the New Relic Metric API, which
+// records the payloads it accepts and can simulate its error responses.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package metricapitest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metric is a metric of a Metric API payload.
+type Metric struct {
+	Name       string                 `json:"name"`
+	Type       string                 `json:"type"`
+	Value      interface{}            `json:"value"`
+	Timestamp  int64                  `json:"timestamp"`
+	IntervalMs int64                  `json:"interval.ms"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// Request is a request received by the Server.
+type Request struct {
+	// Status is the status code the request was responded with.
+	Status int
+	// LicenseKey is the license key or the API key of the request.
+	LicenseKey string
+	// PayloadBytes is the size of the payload, as sent.
+	PayloadBytes int
+	// CommonAttributes and Metrics are the decoded payload. They are empty
+	// if the request was rejected.
+	CommonAttributes map[string]interface{}
+	Metrics          []Metric
+}
+
+type payload struct {
+	Common struct {
+		Attributes map[string]interface{} `json:"attributes"`
+	} `json:"common"`
+	Metrics []Metric `json:"metrics"`
+}
+
+// Server is a mock Metric API server. Requests are accepted with a 202,
+// unless a response is queued with RespondWith or the payload is larger
+// than the maximum set with SetMaxPayloadBytes.
+type Server struct {
+	// URL of the server, to be used as the metric API URL.
+	URL string
+
+	server *httptest.Server
+
+	mu              sync.Mutex
+	responses       []int
+	retryAfter      time.Duration
+	maxPayloadBytes int
+	requests        []Request
+	received        chan struct{}
+}
+
+// NewServer starts a Server. It must be closed when not used anymore.
+func NewServer() *Server {
+	s := &Server{received: make(chan struct{}, 1)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// RespondWith queues the status codes of the next requests, e.g. 429, 413 or
+// 503, so the errors of the Metric API can be simulated. Once the queue is
+// empty the requests are accepted again.
+func (s *Server) RespondWith(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, statuses...)
+}
+
+// SetRetryAfter sets the Retry-After header of the 429 responses.
+func (s *Server) SetRetryAfter(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retryAfter = d
+}
+
+// SetMaxPayloadBytes makes the server respond with a 413 to the payloads
+// larger than max bytes, as sent. Disabled if 0.
+func (s *Server) SetMaxPayloadBytes(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxPayloadBytes = max
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Metrics returns the metrics of the accepted requests.
+func (s *Server) Metrics() []Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var metrics []Metric
+	for _, r := range s.requests {
+		metrics = append(metrics, r.Metrics...)
+	}
+	return metrics
+}
+
+// WaitForMetrics waits until the server accepted metrics, returning false if
+// the timeout elapses first.
+func (s *Server) WaitForMetrics(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		if len(s.Metrics()) > 0 {
+			return true
+		}
+		select {
+		case <-s.received:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := Request{
+		Status:       s.nextStatus(len(body)),
+		LicenseKey:   r.Header.Get("X-License-Key"),
+		PayloadBytes: len(body),
+	}
+	if req.LicenseKey == "" {
+		req.LicenseKey = r.Header.Get("Api-Key")
+	}
+	if req.LicenseKey == "" {
+		req.Status = http.StatusForbidden
+	}
+	if req.Status == http.StatusAccepted {
+		payloads, err := decode(r.Header.Get("Content-Encoding"), body)
+		if err != nil {
+			req.Status = http.StatusBadRequest
+		}
+		for _, p := range payloads {
+			req.CommonAttributes = p.Common.Attributes
+			req.Metrics = append(req.Metrics, p.Metrics...)
+		}
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	if req.Status == http.StatusTooManyRequests && s.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.retryAfter.Seconds())))
+	}
+	s.mu.Unlock()
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+
+	w.WriteHeader(req.Status)
+	if req.Status == http.StatusAccepted {
+		_, _ = io.WriteString(w, `{"requestId":"mock"}`)
+	}
+}
+
+// nextStatus returns the status code of the next request.
+func (s *Server) nextStatus(payloadBytes int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.responses) > 0 {
+		status := s.responses[0]
+		s.responses = s.responses[1:]
+		return status
+	}
+	if s.maxPayloadBytes > 0 && payloadBytes > s.maxPayloadBytes {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusAccepted
+}
+
+func decode(encoding string, body []byte) ([]payload, error) {
+	var reader io.Reader = bytes.NewReader(body)
+	if encoding == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	var payloads []payload
+	err := json.NewDecoder(reader).Decode(&payloads)
+	return payloads, err
+}
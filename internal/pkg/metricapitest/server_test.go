@@ -0,0 +1,94 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package metricapitest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPayload = `[{"common":{"attributes":{"clusterName":"test"}},"metrics":[` +
+	`{"name":"up","type":"gauge","value":1,"timestamp":1600000000000,"attributes":{"job":"node"}},` +
+	`{"name":"requests","type":"count","value":3,"timestamp":1600000000000,"interval.ms":1000}]}]`
+
+func post(t *testing.T, url, body string, gzipped bool) *http.Response {
+	var buf bytes.Buffer
+	if gzipped {
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+	} else {
+		buf.WriteString(body)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	require.NoError(t, err)
+	req.Header.Set("X-License-Key", "license")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	resp := post(t, s.URL, testPayload, true)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.True(t, s.WaitForMetrics(time.Second))
+
+	requests := s.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "license", requests[0].LicenseKey)
+	assert.Equal(t, map[string]interface{}{"clusterName": "test"}, requests[0].CommonAttributes)
+
+	metrics := s.Metrics()
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "up", metrics[0].Name)
+	assert.Equal(t, "gauge", metrics[0].Type)
+	assert.Equal(t, map[string]interface{}{"job": "node"}, metrics[0].Attributes)
+	assert.Equal(t, int64(1000), metrics[1].IntervalMs)
+}
+
+func TestServer_Errors(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RespondWith(http.StatusTooManyRequests, http.StatusInternalServerError)
+	s.SetRetryAfter(2 * time.Second)
+	s.SetMaxPayloadBytes(len(testPayload))
+
+	resp := post(t, s.URL, testPayload, false)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusInternalServerError, post(t, s.URL, testPayload, false).StatusCode)
+	assert.Equal(t, http.StatusAccepted, post(t, s.URL, testPayload, false).StatusCode)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(t, s.URL, testPayload+strings.Repeat(" ", 10), false).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, post(t, s.URL, "not json", false).StatusCode)
+
+	statuses := []int{}
+	for _, r := range s.Requests() {
+		statuses = append(statuses, r.Status)
+	}
+	assert.Equal(t, []int{429, 500, 202, 413, 400}, statuses)
+	assert.Len(t, s.Metrics(), 2, "only the accepted metrics are recorded")
+}
+
+func TestServer_WaitForMetricsTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RespondWith(http.StatusServiceUnavailable)
+
+	post(t, s.URL, testPayload, false)
+	assert.False(t, s.WaitForMetrics(50*time.Millisecond))
+}
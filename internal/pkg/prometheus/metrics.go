@@ -5,6 +5,10 @@ package prometheus
 
 import prom "github.com/prometheus/client_golang/prometheus"
 
+// payloadSizeObjectives are the quantiles of the payload size summaries and
+// their allowed errors.
+var payloadSizeObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
 var (
 	targetSize = prom.NewGaugeVec(prom.GaugeOpts{
 		Namespace: "nr_stats",
@@ -16,15 +20,59 @@ var (
 			"target",
 		},
 	)
+	// The payload sizes are summaries so their percentiles show the sizes
+	// to plan the network and memory for, and to set size limits from.
+	targetSizeSummary = prom.NewSummaryVec(prom.SummaryOpts{
+		Namespace:  "nr_stats",
+		Subsystem:  "integration",
+		Name:       "payload_size_bytes",
+		Help:       "Distribution of the sizes of target's payloads",
+		Objectives: payloadSizeObjectives,
+	},
+		[]string{
+			"target",
+		},
+	)
+	payloadSizeSummary = prom.NewSummary(prom.SummaryOpts{
+		Namespace:  "nr_stats",
+		Subsystem:  "integration",
+		Name:       "scraped_payload_size_bytes",
+		Help:       "Distribution of the sizes of the payloads of all the targets",
+		Objectives: payloadSizeObjectives,
+	})
 	totalScrapedPayload = prom.NewGauge(prom.GaugeOpts{
 		Namespace: "nr_stats",
 		Subsystem: "integration",
 		Name:      "total_payload_size",
 		Help:      "Total size of the payloads scraped",
 	})
+	invalidContentTypeTotal = prom.NewCounterVec(prom.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "invalid_content_type_total",
+		Help:      "Payloads scraped without a Prometheus or OpenMetrics text content type",
+	},
+		[]string{
+			"target",
+		},
+	)
+	protobufFallbackTotal = prom.NewCounterVec(prom.CounterOpts{
+		Namespace: "nr_stats",
+		Subsystem: "integration",
+		Name:      "protobuf_fallback_total",
+		Help:      "Scrapes requested again in a text format after the target rejected the protocol buffer format",
+	},
+		[]string{
+			"target",
+		},
+	)
 )
 
 func init() {
 	prom.MustRegister(targetSize)
+	prom.MustRegister(targetSizeSummary)
+	prom.MustRegister(payloadSizeSummary)
 	prom.MustRegister(totalScrapedPayload)
+	prom.MustRegister(invalidContentTypeTotal)
+	prom.MustRegister(protobufFallbackTotal)
 }
@@ -0,0 +1,343 @@
+// Package prometheus ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Native histogram schemas. A schema s has buckets with bounds growing by a
+// factor of 2^(2^-s).
+const (
+	minNativeSchema = -4
+	maxNativeSchema = 8
+)
+
+// Fields of the native histograms in the Histogram message. They are newer
+// than the client_model version the integration is built with, so they are
+// decoded from the unrecognized fields of the histograms.
+const (
+	fieldSampleCountFloat = 4
+	fieldSchema           = 5
+	fieldZeroThreshold    = 6
+	fieldZeroCount        = 7
+	fieldZeroCountFloat   = 8
+	fieldNegativeSpan     = 9
+	fieldNegativeDelta    = 10
+	fieldNegativeCount    = 11
+	fieldPositiveSpan     = 12
+	fieldPositiveDelta    = 13
+	fieldPositiveCount    = 14
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncatedField = errors.New("truncated protocol buffer field")
+
+// bucketSpan is a run of consecutive buckets, starting Offset indexes after
+// the end of the previous span.
+type bucketSpan struct {
+	offset int32
+	length uint32
+}
+
+// nativeHistogram are the native fields of a histogram.
+type nativeHistogram struct {
+	schema           int32
+	zeroThreshold    float64
+	zeroCount        float64
+	sampleCountFloat float64
+	negativeSpans    []bucketSpan
+	negativeDeltas   []int64
+	negativeCounts   []float64
+	positiveSpans    []bucketSpan
+	positiveDeltas   []int64
+	positiveCounts   []float64
+}
+
+// decodeNativeHistogram decodes the native fields of the histogram. It
+// returns false if the histogram has none, being a classic histogram.
+func decodeNativeHistogram(h *dto.Histogram) (*nativeHistogram, bool, error) {
+	b := h.XXX_unrecognized
+	if len(b) == 0 {
+		return nil, false, nil
+	}
+	nh := &nativeHistogram{}
+	native := false
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, false, errTruncatedField
+		}
+		b = b[n:]
+		field, wire := key>>3, key&7
+
+		var value uint64
+		var bytes []byte
+		switch wire {
+		case wireVarint:
+			if value, n = binary.Uvarint(b); n <= 0 {
+				return nil, false, errTruncatedField
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, false, errTruncatedField
+			}
+			value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, false, errTruncatedField
+			}
+			b = b[4:]
+			continue
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, false, errTruncatedField
+			}
+			bytes, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return nil, false, fmt.Errorf("unsupported protocol buffer wire type %d", wire)
+		}
+
+		var err error
+		switch field {
+		case fieldSampleCountFloat:
+			nh.sampleCountFloat = math.Float64frombits(value)
+		case fieldSchema:
+			nh.schema = int32(unzigzag(value))
+		case fieldZeroThreshold:
+			nh.zeroThreshold = math.Float64frombits(value)
+		case fieldZeroCount:
+			nh.zeroCount = float64(value)
+		case fieldZeroCountFloat:
+			nh.zeroCount = math.Float64frombits(value)
+		case fieldNegativeSpan:
+			nh.negativeSpans, err = appendSpan(nh.negativeSpans, bytes)
+		case fieldNegativeDelta:
+			nh.negativeDeltas, err = appendDeltas(nh.negativeDeltas, wire, value, bytes)
+		case fieldNegativeCount:
+			nh.negativeCounts, err = appendCounts(nh.negativeCounts, wire, value, bytes)
+		case fieldPositiveSpan:
+			nh.positiveSpans, err = appendSpan(nh.positiveSpans, bytes)
+		case fieldPositiveDelta:
+			nh.positiveDeltas, err = appendDeltas(nh.positiveDeltas, wire, value, bytes)
+		case fieldPositiveCount:
+			nh.positiveCounts, err = appendCounts(nh.positiveCounts, wire, value, bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		native = true
+	}
+	if native && (nh.schema < minNativeSchema || nh.schema > maxNativeSchema) {
+		return nil, false, fmt.Errorf("unsupported native histogram schema %d", nh.schema)
+	}
+	return nh, native, nil
+}
+
+// unzigzag decodes a zigzag encoded signed integer.
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// appendSpan decodes a BucketSpan message.
+func appendSpan(spans []bucketSpan, b []byte) ([]bucketSpan, error) {
+	var span bucketSpan
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 || key&7 != wireVarint {
+			return nil, errTruncatedField
+		}
+		b = b[n:]
+		value, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncatedField
+		}
+		b = b[n:]
+		switch key >> 3 {
+		case 1:
+			span.offset = int32(unzigzag(value))
+		case 2:
+			span.length = uint32(value)
+		}
+	}
+	return append(spans, span), nil
+}
+
+// appendDeltas decodes the packed or single zigzag encoded deltas.
+func appendDeltas(deltas []int64, wire, value uint64, b []byte) ([]int64, error) {
+	if wire == wireVarint {
+		return append(deltas, unzigzag(value)), nil
+	}
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncatedField
+		}
+		deltas, b = append(deltas, unzigzag(v)), b[n:]
+	}
+	return deltas, nil
+}
+
+// appendCounts decodes the packed or single counts of a float histogram.
+func appendCounts(counts []float64, wire, value uint64, b []byte) ([]float64, error) {
+	if wire == wireFixed64 {
+		return append(counts, math.Float64frombits(value)), nil
+	}
+	if len(b)%8 != 0 {
+		return nil, errTruncatedField
+	}
+	for ; len(b) > 0; b = b[8:] {
+		counts = append(counts, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	}
+	return counts, nil
+}
+
+// bucketCounts returns the counts of the buckets of the spans by index,
+// from the deltas of an integer histogram or the counts of a float one.
+func bucketCounts(spans []bucketSpan, deltas []int64, counts []float64) (map[int]float64, error) {
+	buckets := map[int]float64{}
+	index, i := 0, 0
+	var count int64
+	for _, span := range spans {
+		index += int(span.offset)
+		for j := uint32(0); j < span.length; j, index, i = j+1, index+1, i+1 {
+			switch {
+			case i < len(deltas):
+				count += deltas[i]
+				buckets[index] = float64(count)
+			case i < len(counts):
+				buckets[index] = counts[i]
+			default:
+				return nil, errors.New("native histogram spans have more buckets than counts")
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// reduceResolution merges the buckets into the ones of a lower schema.
+func reduceResolution(buckets map[int]float64, delta uint) map[int]float64 {
+	reduced := make(map[int]float64, len(buckets))
+	for index, count := range buckets {
+		reduced[((index-1)>>delta)+1] += count
+	}
+	return reduced
+}
+
+// bucketBound returns the upper bound of the positive bucket of the index.
+func bucketBound(schema int32, index int) float64 {
+	return math.Exp2(float64(index) * math.Exp2(-float64(schema)))
+}
+
+// convertNativeHistogram replaces the buckets of the histogram by classic
+// cumulative buckets with the bounds of its native buckets: the negative
+// ones, the zero bucket and the positive ones, followed by the +Inf one.
+// With a bucket limit greater than 0, the resolution of the buckets is
+// reduced until there are at most that many.
+func convertNativeHistogram(h *dto.Histogram, nh *nativeHistogram, maxBuckets int) error {
+	negative, err := bucketCounts(nh.negativeSpans, nh.negativeDeltas, nh.negativeCounts)
+	if err != nil {
+		return err
+	}
+	positive, err := bucketCounts(nh.positiveSpans, nh.positiveDeltas, nh.positiveCounts)
+	if err != nil {
+		return err
+	}
+	schema := nh.schema
+	for maxBuckets > 0 && len(negative)+len(positive) > maxBuckets && schema > minNativeSchema {
+		negative, positive = reduceResolution(negative, 1), reduceResolution(positive, 1)
+		schema--
+	}
+
+	type bound struct {
+		upper float64
+		count float64
+	}
+	bounds := make([]bound, 0, len(negative)+len(positive)+1)
+	for index, count := range negative {
+		bounds = append(bounds, bound{upper: -bucketBound(schema, index-1), count: count})
+	}
+	bounds = append(bounds, bound{upper: nh.zeroThreshold, count: nh.zeroCount})
+	for index, count := range positive {
+		bounds = append(bounds, bound{upper: bucketBound(schema, index), count: count})
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].upper < bounds[j].upper })
+
+	sampleCount := h.GetSampleCount()
+	if sampleCount == 0 && nh.sampleCountFloat > 0 {
+		sampleCount = uint64(math.Round(nh.sampleCountFloat))
+		h.SampleCount = &sampleCount
+	}
+	h.Bucket = make([]*dto.Bucket, 0, len(bounds)+1)
+	var cumulative float64
+	for _, b := range bounds {
+		cumulative += b.count
+		h.Bucket = append(h.Bucket, newBucket(b.upper, uint64(math.Round(cumulative))))
+	}
+	h.Bucket = append(h.Bucket, newBucket(math.Inf(1), sampleCount))
+	h.XXX_unrecognized = nil
+	return nil
+}
+
+func newBucket(upperBound float64, cumulativeCount uint64) *dto.Bucket {
+	return &dto.Bucket{UpperBound: &upperBound, CumulativeCount: &cumulativeCount}
+}
+
+// completeHistograms converts the native histograms of the family to
+// classic ones, and adds the +Inf bucket the protocol buffer format omits
+// to the classic ones.
+func completeHistograms(mf *dto.MetricFamily, maxBuckets int) error {
+	if mf.GetType() != dto.MetricType_HISTOGRAM {
+		return nil
+	}
+	for _, m := range mf.GetMetric() {
+		h := m.GetHistogram()
+		if h == nil {
+			continue
+		}
+		nh, native, err := decodeNativeHistogram(h)
+		if err != nil {
+			return fmt.Errorf("decoding native histogram %s: %w", mf.GetName(), err)
+		}
+		// The classic buckets are kept when the target exposes both.
+		if native && !hasClassicBuckets(h) {
+			if err := convertNativeHistogram(h, nh, maxBuckets); err != nil {
+				return fmt.Errorf("converting native histogram %s: %w", mf.GetName(), err)
+			}
+			continue
+		}
+		if n := len(h.Bucket); n == 0 || !math.IsInf(h.Bucket[n-1].GetUpperBound(), 1) {
+			h.Bucket = append(h.Bucket, newBucket(math.Inf(1), h.GetSampleCount()))
+		}
+	}
+	return nil
+}
+
+// hasClassicBuckets returns true if the histogram has buckets besides the
+// +Inf one.
+func hasClassicBuckets(h *dto.Histogram) bool {
+	for _, b := range h.GetBucket() {
+		if !math.IsInf(b.GetUpperBound(), 1) {
+			return true
+		}
+	}
+	return false
+}
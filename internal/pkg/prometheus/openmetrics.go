@@ -0,0 +1,289 @@
+// Package prometheus ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ExemplarSuffix is appended to the name of the sample of an exemplar to
+	// name the gauge family of its exemplars.
+	ExemplarSuffix = "_exemplar"
+	// ExemplarHelp is the help of the exemplar families.
+	ExemplarHelp = "OpenMetrics exemplars"
+	// exemplarLabelPrefix prefixes the exemplar labels that are also labels
+	// of their sample.
+	exemplarLabelPrefix = "exemplar_"
+)
+
+// openMetricsTypes maps the OpenMetrics types to the Prometheus text ones.
+// The types not mapped, like gaugehistogram, are decoded as untyped.
+var openMetricsTypes = map[string]string{
+	"counter":   "counter",
+	"gauge":     "gauge",
+	"histogram": "histogram",
+	"summary":   "summary",
+	"unknown":   "untyped",
+	"info":      "gauge",
+	"stateset":  "gauge",
+}
+
+// label is a label of a sample, whose value is kept escaped.
+type label struct {
+	name  string
+	value string
+}
+
+// exemplarFamily are the samples of the exemplars of a sample name.
+type exemplarFamily struct {
+	name    string
+	samples []string
+}
+
+// translateOpenMetrics translates an OpenMetrics payload to the Prometheus
+// text format. The counter families are named after their _total samples,
+// the info families after their _info samples, and the _created samples,
+// the HELP, UNIT and EOF lines are dropped. The timestamps are converted
+// from seconds to milliseconds. The exemplars are removed from their
+// samples, and written at the end as the gauges of the <sample>_exemplar
+// families, with the labels of their sample and their own labels, prefixed
+// with exemplar_ if the sample has them too. The payload is written to w as
+// it's translated, only the exemplars are kept until the end.
+func translateOpenMetrics(r io.Reader, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	types := map[string]string{}
+	exemplars := map[string]*exemplarFamily{}
+	var order []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || fields[1] != "TYPE" {
+				continue
+			}
+			name, omType := fields[2], fields[3]
+			types[name] = omType
+			switch omType {
+			case "counter":
+				if !strings.HasSuffix(name, "_total") {
+					name += "_total"
+				}
+			case "info":
+				name += "_info"
+			}
+			promType, ok := openMetricsTypes[omType]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(out, "# TYPE %s %s\n", name, promType)
+			// The previous families are decoded while this one is read, as
+			// its TYPE line ends them.
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		s, err := parseOpenMetricsSample(line)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(s.name, "_created") {
+			switch types[strings.TrimSuffix(s.name, "_created")] {
+			case "counter", "histogram", "summary":
+				continue
+			}
+		}
+		if _, err := out.WriteString(s.text(s.name, s.labels, s.value, s.timestamp)); err != nil {
+			// The decoding stopped.
+			return err
+		}
+		if s.exemplar == nil {
+			continue
+		}
+
+		family, ok := exemplars[s.name]
+		if !ok {
+			family = &exemplarFamily{name: s.name + ExemplarSuffix}
+			exemplars[s.name] = family
+			order = append(order, s.name)
+		}
+		family.samples = append(family.samples, s.text(family.name, s.exemplarLabels(), s.exemplar.value, s.exemplar.timestamp))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		family := exemplars[name]
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", family.name, ExemplarHelp, family.name)
+		for _, sample := range family.samples {
+			out.WriteString(sample)
+		}
+	}
+	return out.Flush()
+}
+
+// openMetricsSample is a sample line of an OpenMetrics payload.
+type openMetricsSample struct {
+	name      string
+	labels    []label
+	value     string
+	timestamp string
+	exemplar  *openMetricsSample
+}
+
+// text returns the sample line in the Prometheus text format.
+func (s *openMetricsSample) text(name string, labels []label, value, timestamp string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l.name)
+			b.WriteString(`="`)
+			b.WriteString(l.value)
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(value)
+	if timestamp != "" {
+		b.WriteByte(' ')
+		b.WriteString(timestamp)
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// exemplarLabels returns the labels of the sample followed by the ones of
+// its exemplar, sorted.
+func (s *openMetricsSample) exemplarLabels() []label {
+	names := make(map[string]bool, len(s.labels))
+	labels := make([]label, 0, len(s.labels)+len(s.exemplar.labels))
+	for _, l := range s.labels {
+		names[l.name] = true
+		labels = append(labels, l)
+	}
+	for _, l := range s.exemplar.labels {
+		if names[l.name] {
+			l.name = exemplarLabelPrefix + l.name
+		}
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+	return labels
+}
+
+// parseOpenMetricsSample parses a sample line, with its optional timestamp
+// and exemplar.
+func parseOpenMetricsSample(line string) (*openMetricsSample, error) {
+	s := &openMetricsSample{}
+	i := strings.IndexAny(line, "{ ")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid OpenMetrics sample %q", line)
+	}
+	s.name = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		var err error
+		if s.labels, rest, err = parseLabels(rest); err != nil {
+			return nil, fmt.Errorf("invalid OpenMetrics sample %q: %w", line, err)
+		}
+	}
+
+	var exemplar string
+	if j := strings.Index(rest, " # "); j >= 0 {
+		rest, exemplar = rest[:j], strings.TrimSpace(rest[j+3:])
+	}
+	var err error
+	if s.value, s.timestamp, err = parseValue(rest); err != nil {
+		return nil, fmt.Errorf("invalid OpenMetrics sample %q: %w", line, err)
+	}
+	if exemplar == "" {
+		return s, nil
+	}
+
+	s.exemplar = &openMetricsSample{}
+	if !strings.HasPrefix(exemplar, "{") {
+		return nil, fmt.Errorf("invalid OpenMetrics exemplar %q", line)
+	}
+	if s.exemplar.labels, rest, err = parseLabels(exemplar); err != nil {
+		return nil, fmt.Errorf("invalid OpenMetrics exemplar %q: %w", line, err)
+	}
+	if s.exemplar.value, s.exemplar.timestamp, err = parseValue(rest); err != nil {
+		return nil, fmt.Errorf("invalid OpenMetrics exemplar %q: %w", line, err)
+	}
+	return s, nil
+}
+
+// parseLabels parses the labels between braces at the beginning of the
+// string, returning the rest of it.
+func parseLabels(s string) ([]label, string, error) {
+	var labels []label
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("unterminated labels")
+		}
+		if s[i] == '}' {
+			return labels, s[i+1:], nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq < 0 || i+eq+1 >= len(s) || s[i+eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid label")
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		start := i + eq + 2
+		end := start
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return nil, "", fmt.Errorf("unterminated label value")
+		}
+		labels = append(labels, label{name: name, value: s[start:end]})
+		i = end + 1
+	}
+}
+
+// parseValue parses the value and the optional timestamp, in seconds,
+// returning the timestamp in milliseconds.
+func parseValue(s string) (string, string, error) {
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		return fields[0], "", nil
+	case 2:
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		return fields[0], strconv.FormatInt(int64(seconds*1000), 10), nil
+	default:
+		return "", "", fmt.Errorf("invalid value %q", s)
+	}
+}
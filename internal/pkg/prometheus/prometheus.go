@@ -4,8 +4,11 @@
 package prometheus
 
 import (
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strings"
 
 	prom "github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -16,6 +19,20 @@ import (
 // representation.
 type MetricFamiliesByName map[string]dto.MetricFamily
 
+// Add stores the family, appending its metrics to those of a family of the
+// same name already stored. The text formats don't require the lines of a
+// family to be contiguous, so the decoders can return a family more than
+// once.
+func (mfs MetricFamiliesByName) Add(mf *dto.MetricFamily) {
+	stored, ok := mfs[mf.GetName()]
+	if !ok {
+		mfs[mf.GetName()] = *mf
+		return
+	}
+	stored.Metric = append(stored.Metric, mf.Metric...)
+	mfs[mf.GetName()] = stored
+}
+
 // HTTPDoer executes http requests. It is implemented by *http.Client.
 type HTTPDoer interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -24,6 +41,9 @@ type HTTPDoer interface {
 type countReadCloser struct {
 	innerReadCloser io.ReadCloser
 	count           int
+	// err is the first read error, the text decoder ignores when it happens
+	// at the beginning of a line.
+	err error
 }
 
 func (rc *countReadCloser) Close() error {
@@ -33,6 +53,9 @@ func (rc *countReadCloser) Close() error {
 func (rc *countReadCloser) Read(p []byte) (n int, err error) {
 	n, err = rc.innerReadCloser.Read(p)
 	rc.count += n
+	if err != nil && err != io.EOF && rc.err == nil {
+		rc.err = err
+	}
 	return
 }
 
@@ -42,38 +65,252 @@ func ResetTotalScrapedPayload() {
 	totalScrapedPayload.Set(0)
 }
 
+// ParseError is returned when the payload of a target can't be decoded. Body
+// holds the beginning of the payload, when it's captured.
+type ParseError struct {
+	Err  error
+	Body []byte
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the decoding error.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// captureWriter keeps up to limit bytes of what's written to it.
+type captureWriter struct {
+	limit int
+	buf   []byte
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if room := w.limit - len(w.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// ContentTypeError is returned when the content type of a payload is not a
+// Prometheus or OpenMetrics text format, and the content type is strictly
+// checked.
+type ContentTypeError struct {
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("invalid content type %q, expected a Prometheus or OpenMetrics text format", e.ContentType)
+}
+
+// AuthError is returned when a target rejects the credentials of the scrape,
+// with a 401 or a 403 status code.
+type AuthError struct {
+	StatusCode int
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("target rejected the credentials with status %d", e.StatusCode)
+}
+
+// GetOptions configure how the payloads are retrieved.
+type GetOptions struct {
+	// CaptureLimit is the maximum number of bytes of the beginning of the
+	// payload kept in the ParseError returned when it can't be decoded.
+	CaptureLimit int
+	// StrictContentType rejects the payloads without a Prometheus,
+	// OpenMetrics or protocol buffer content type.
+	StrictContentType bool
+	// Exemplars requests the OpenMetrics format, whose exemplars are decoded
+	// as the gauges of the <sample>_exemplar families, with the ExemplarHelp
+	// help.
+	Exemplars bool
+	// Protobuf requests the protocol buffer format, which is faster to
+	// decode than the text ones. It's preferred to the OpenMetrics format if
+	// both are requested, and the text formats are requested again from the
+	// targets rejecting it with a 406 status code.
+	Protobuf bool
+	// NativeHistograms requests the protocol buffer format, like Protobuf,
+	// whose native histograms are decoded as classic histograms with their
+	// bucket bounds.
+	NativeHistograms bool
+	// NativeHistogramMaxBuckets reduces the resolution of the native
+	// histograms until they have at most that many buckets, if greater
+	// than 0.
+	NativeHistogramMaxBuckets int
+}
+
+// protobuf returns true if the protocol buffer format is requested.
+func (o GetOptions) protobuf() bool {
+	return o.Protobuf || o.NativeHistograms
+}
+
+// accept returns the Accept header of the requested formats, if any. The
+// protocol buffer format is left out if protobuf is false.
+func (o GetOptions) accept(protobuf bool) string {
+	if !protobuf && !o.Exemplars {
+		return ""
+	}
+	var formats []string
+	if protobuf {
+		formats = append(formats, string(expfmt.FmtProtoDelim))
+	}
+	if o.Exemplars {
+		formats = append(formats, "application/openmetrics-text;version=1.0.0;q=0.8", "application/openmetrics-text;version=0.0.1;q=0.75")
+	}
+	return strings.Join(append(formats, "text/plain;version=0.0.4;q=0.5", "*/*;q=0.1"), ",")
+}
+
+// validContentType returns true if the content type is a format that can be
+// decoded.
+func validContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/plain" || mediaType == "application/openmetrics-text" || mediaType == expfmt.ProtoType
+}
+
+// do requests the given URL, with the Accept header if not empty.
+func do(client HTTPDoer, url, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return client.Do(req)
+}
+
 // Get scrapes the given URL and decodes the retrieved payload.
 func Get(client HTTPDoer, url string) (MetricFamiliesByName, error) {
+	return GetWithOptions(client, url, GetOptions{})
+}
+
+// GetWithOptions scrapes the given URL and decodes the retrieved payload,
+// according to the given options.
+func GetWithOptions(client HTTPDoer, url string, opts GetOptions) (MetricFamiliesByName, error) {
 	mfs := MetricFamiliesByName{}
-	req, err := http.NewRequest("GET", url, nil)
+	err := Stream(client, url, opts, func(mf *dto.MetricFamily) error {
+		mfs.Add(mf)
+		return nil
+	})
 	if err != nil {
-		return mfs, err
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	return mfs, nil
+}
+
+// Stream scrapes the given URL and passes the metric families of the
+// retrieved payload to handle as they are decoded, according to the given
+// options, so only one of them is kept in memory at a time. All the formats
+// are decoded as the payload is read. It stops at the first error returned by
+// handle, and returns it.
+func Stream(client HTTPDoer, url string, opts GetOptions, handle func(*dto.MetricFamily) error) error {
+	captureLimit := opts.CaptureLimit
+	resp, err := do(client, url, opts.accept(opts.protobuf()))
 	if err != nil {
-		return mfs, err
+		return err
+	}
+	if resp.StatusCode == http.StatusNotAcceptable && opts.protobuf() {
+		// The target doesn't support the protocol buffer format.
+		_ = resp.Body.Close()
+		protobufFallbackTotal.WithLabelValues(url).Inc()
+		if resp, err = do(client, url, opts.accept(false)); err != nil {
+			return err
+		}
 	}
 
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return &AuthError{StatusCode: resp.StatusCode}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !validContentType(contentType) {
+		invalidContentTypeTotal.WithLabelValues(url).Inc()
+		if opts.StrictContentType {
+			return &ContentTypeError{ContentType: contentType}
+		}
+	}
+
 	countedBody := &countReadCloser{innerReadCloser: resp.Body}
-	d := expfmt.NewDecoder(countedBody, expfmt.FmtText)
+	var body io.Reader = countedBody
+	capture := &captureWriter{limit: captureLimit}
+	if captureLimit > 0 {
+		body = io.TeeReader(countedBody, capture)
+	}
+	// stopTranslation stops the translation of the OpenMetrics payloads, so
+	// the body and its capture are only read by the decoding after it.
+	stopTranslation := func() {}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); opts.Exemplars && mediaType == "application/openmetrics-text" {
+		// The payload is translated as it's decoded.
+		translated, w := io.Pipe()
+		done := make(chan struct{})
+		go func(source io.Reader) {
+			defer close(done)
+			_ = w.CloseWithError(translateOpenMetrics(source, w))
+		}(body)
+		stopTranslation = func() {
+			_ = translated.Close()
+			<-done
+		}
+		defer stopTranslation()
+		body = translated
+	}
+	format := expfmt.FmtText
+	if expfmt.ResponseFormat(resp.Header) == expfmt.FmtProtoDelim {
+		format = expfmt.FmtProtoDelim
+	}
+	var d expfmt.Decoder = newTextDecoder(body)
+	if format == expfmt.FmtProtoDelim {
+		d = expfmt.NewDecoder(body, format)
+	}
 	for {
 		var mf dto.MetricFamily
 		if err := d.Decode(&mf); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			stopTranslation()
+			if countedBody.err != nil {
+				// The payload was cut, like by a body read timeout.
+				return countedBody.err
+			}
+			if room := captureLimit - len(capture.buf); room > 0 {
+				// The decoder stops reading on the first error.
+				_, _ = io.CopyN(capture, countedBody, int64(room))
+			}
+			return &ParseError{Err: err, Body: capture.buf}
+		}
+		if format == expfmt.FmtProtoDelim {
+			if err := completeHistograms(&mf, opts.NativeHistogramMaxBuckets); err != nil {
+				return &ParseError{Err: err, Body: capture.buf}
+			}
+		}
+		if err := handle(&mf); err != nil {
+			return err
 		}
-		mfs[mf.GetName()] = mf
+	}
+	if countedBody.err != nil {
+		// The payload was cut, like by a body read timeout.
+		return countedBody.err
 	}
 
 	bodySize := float64(countedBody.count)
 	targetSize.With(prom.Labels{"target": url}).Set(bodySize)
+	targetSizeSummary.With(prom.Labels{"target": url}).Observe(bodySize)
+	payloadSizeSummary.Observe(bodySize)
 	totalScrapedPayload.Add(bodySize)
-	return mfs, nil
+	return nil
 }
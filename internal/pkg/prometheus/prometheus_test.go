@@ -3,11 +3,21 @@
 package prometheus_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	prom "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/newrelic/nri-prometheus/internal/pkg/prometheus"
 )
@@ -26,3 +36,368 @@ func TestGet(t *testing.T) {
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, expected, actual)
 }
+
+func TestGet_RepeatedFamily(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte("a{x=\"1\"} 1\nb 2\na{x=\"2\"} 3\n"))
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.Get(http.DefaultClient, ts.URL)
+	require.NoError(t, err)
+	require.Contains(t, mfs, "a")
+	mf := mfs["a"]
+	assert.Len(t, mf.Metric, 2, "the lines of a family that aren't contiguous are merged")
+	assert.Contains(t, mfs, "b")
+}
+
+func TestGet_BodyCapture(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html><body>" + strings.Repeat("not metrics ", 100) + "</body></html>"))
+	}))
+	defer ts.Close()
+
+	_, err := prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{CaptureLimit: 20})
+	require.Error(t, err)
+	var parseErr *prometheus.ParseError
+	require.True(t, errors.As(err, &parseErr))
+	assert.Equal(t, "<html><body>not metr", string(parseErr.Body))
+
+	_, err = prometheus.Get(http.DefaultClient, ts.URL)
+	require.True(t, errors.As(err, &parseErr))
+	assert.Empty(t, parseErr.Body)
+}
+
+func TestGet_StrictContentType(t *testing.T) {
+	cases := []struct {
+		contentType string
+		valid       bool
+	}{
+		{contentType: "text/plain; version=0.0.4; charset=utf-8", valid: true},
+		{contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8", valid: true},
+		{contentType: "text/html; charset=utf-8", valid: false},
+		{contentType: "", valid: false},
+	}
+	for _, c := range cases {
+		t.Run(c.contentType, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{c.contentType}
+				_, _ = w.Write([]byte("http_requests_total 3\n"))
+			}))
+			defer ts.Close()
+
+			_, err := prometheus.Get(http.DefaultClient, ts.URL)
+			assert.NoError(t, err, "content type is only checked in strict mode")
+
+			mfs, err := prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{StrictContentType: true})
+			if c.valid {
+				require.NoError(t, err)
+				assert.Contains(t, mfs, "http_requests_total")
+				return
+			}
+			var contentTypeErr *prometheus.ContentTypeError
+			require.True(t, errors.As(err, &contentTypeErr))
+			assert.Equal(t, c.contentType, contentTypeErr.ContentType)
+		})
+	}
+}
+
+func TestGet_AuthError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("http_requests_total 3\n"))
+	}))
+	defer ts.Close()
+
+	_, err := prometheus.Get(http.DefaultClient, ts.URL)
+	var authErr *prometheus.AuthError
+	require.True(t, errors.As(err, &authErr))
+	assert.Equal(t, http.StatusUnauthorized, authErr.StatusCode)
+}
+
+func TestGet_PayloadSizeSummary(t *testing.T) {
+	payload := "# TYPE up gauge\nup 1\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := prometheus.Get(http.DefaultClient, ts.URL)
+		require.NoError(t, err)
+	}
+
+	mfs, err := prom.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	var summary *dto.Summary
+	for _, mf := range mfs {
+		if mf.GetName() != "nr_stats_integration_payload_size_bytes" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == ts.URL {
+				summary = m.GetSummary()
+			}
+		}
+	}
+	require.NotNil(t, summary)
+	assert.Equal(t, uint64(3), summary.GetSampleCount())
+	assert.Equal(t, float64(3*len(payload)), summary.GetSampleSum())
+	for _, q := range summary.GetQuantile() {
+		assert.Equal(t, float64(len(payload)), q.GetValue())
+	}
+}
+
+func TestGet_Exemplars(t *testing.T) {
+	var accept string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		http.ServeFile(w, r, "testdata/openmetrics-exemplars")
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{Exemplars: true})
+	require.NoError(t, err)
+	assert.Contains(t, accept, "application/openmetrics-text")
+	actual := []string{}
+	for k := range mfs {
+		actual = append(actual, k)
+	}
+	assert.ElementsMatch(t, []string{"http_requests_total", "http_requests_total_exemplar", "request_duration_seconds",
+		"request_duration_seconds_bucket_exemplar", "build_info"}, actual)
+
+	requests := mfs["http_requests_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, requests.GetType())
+	assert.Equal(t, 3.0, requests.GetMetric()[0].GetCounter().GetValue())
+
+	exemplars := mfs["request_duration_seconds_bucket_exemplar"]
+	assert.Equal(t, prometheus.ExemplarHelp, exemplars.GetHelp())
+	assert.Equal(t, dto.MetricType_GAUGE, exemplars.GetType())
+	require.Len(t, exemplars.GetMetric(), 2)
+	first := exemplars.GetMetric()[0]
+	assert.Equal(t, 0.05, first.GetGauge().GetValue())
+	lbls := map[string]string{}
+	for _, l := range first.GetLabel() {
+		lbls[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"le": "0.1", "trace_id": "a1b2", "code": "200"}, lbls)
+
+	counterExemplars := mfs["http_requests_total_exemplar"]
+	counterExemplar := counterExemplars.GetMetric()[0]
+	assert.Equal(t, int64(1600000000500), counterExemplar.GetTimestampMs())
+	assert.Len(t, counterExemplar.GetLabel(), 2, "the sample and exemplar labels")
+}
+
+// protoField appends a protocol buffer field to the message.
+func protoField(msg []byte, field, wire uint64, value []byte) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	msg = append(msg, varint[:binary.PutUvarint(varint[:], field<<3|wire)]...)
+	if wire == 2 {
+		msg = append(msg, varint[:binary.PutUvarint(varint[:], uint64(len(value)))]...)
+	}
+	return append(msg, value...)
+}
+
+func zigzag(values ...int64) []byte {
+	var b []byte
+	var varint [binary.MaxVarintLen64]byte
+	for _, v := range values {
+		b = append(b, varint[:binary.PutUvarint(varint[:], uint64((v<<1)^(v>>63)))]...)
+	}
+	return b
+}
+
+func span(offset int64, length uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	b := protoField(nil, 1, 0, zigzag(offset))
+	return protoField(b, 2, 0, varint[:binary.PutUvarint(varint[:], length)])
+}
+
+func nativeHistogramsPayload(t *testing.T) []byte {
+	threshold := make([]byte, 8)
+	binary.LittleEndian.PutUint64(threshold, math.Float64bits(0.001))
+	var native []byte
+	native = protoField(native, 5, 0, zigzag(0))
+	native = protoField(native, 6, 1, threshold)
+	native = protoField(native, 7, 0, []byte{1})
+	native = protoField(native, 9, 2, span(1, 1))
+	native = protoField(native, 10, 2, zigzag(1))
+	native = protoField(native, 12, 2, span(0, 2))
+	native = protoField(native, 12, 2, span(1, 1))
+	native = protoField(native, 13, 2, zigzag(2, 1, -2))
+
+	count, sum, bound, cumulative := uint64(8), 10.0, 0.5, uint64(3)
+	histogram := dto.MetricType_HISTOGRAM
+	nativeName, classicName := "native_seconds", "classic_seconds"
+	var payload bytes.Buffer
+	enc := expfmt.NewEncoder(&payload, expfmt.FmtProtoDelim)
+	require.NoError(t, enc.Encode(&dto.MetricFamily{Name: &nativeName, Type: &histogram, Metric: []*dto.Metric{{
+		Histogram: &dto.Histogram{SampleCount: &count, SampleSum: &sum, XXX_unrecognized: native},
+	}}}))
+	require.NoError(t, enc.Encode(&dto.MetricFamily{Name: &classicName, Type: &histogram, Metric: []*dto.Metric{{
+		Histogram: &dto.Histogram{SampleCount: &count, SampleSum: &sum, Bucket: []*dto.Bucket{{UpperBound: &bound, CumulativeCount: &cumulative}}},
+	}}}))
+	return payload.Bytes()
+}
+
+func buckets(mf dto.MetricFamily) map[float64]uint64 {
+	buckets := map[float64]uint64{}
+	for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return buckets
+}
+
+func TestGet_NativeHistograms(t *testing.T) {
+	payload := nativeHistogramsPayload(t)
+	var accept string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		_, _ = w.Write(payload)
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{NativeHistograms: true, StrictContentType: true})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(accept, "application/vnd.google.protobuf"), accept)
+	assert.Equal(t, map[float64]uint64{-1: 1, 0.001: 2, 1: 4, 2: 7, 8: 8, math.Inf(1): 8}, buckets(mfs["native_seconds"]))
+	assert.Equal(t, map[float64]uint64{0.5: 3, math.Inf(1): 8}, buckets(mfs["classic_seconds"]),
+		"the +Inf bucket is added to the classic histograms")
+
+	mfs, err = prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{NativeHistograms: true, NativeHistogramMaxBuckets: 3})
+	require.NoError(t, err)
+	assert.Equal(t, map[float64]uint64{-1: 1, 0.001: 2, 1: 4, 16: 8, math.Inf(1): 8}, buckets(mfs["native_seconds"]),
+		"the resolution is reduced to 3 buckets")
+}
+
+func TestGet_Protobuf(t *testing.T) {
+	var accepts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		accepts = append(accepts, accept)
+		if !strings.HasPrefix(accept, "application/vnd.google.protobuf") {
+			_, _ = w.Write([]byte("text_metric 1\n"))
+			return
+		}
+		var payload bytes.Buffer
+		name, value, gauge := "proto_metric", 2.0, dto.MetricType_GAUGE
+		require.NoError(t, expfmt.NewEncoder(&payload, expfmt.FmtProtoDelim).Encode(&dto.MetricFamily{Name: &name, Type: &gauge, Metric: []*dto.Metric{{
+			Gauge: &dto.Gauge{Value: &value},
+		}}}))
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		_, _ = w.Write(payload.Bytes())
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{Protobuf: true})
+	require.NoError(t, err)
+	mf := mfs["proto_metric"]
+	assert.Equal(t, 2.0, mf.GetMetric()[0].GetGauge().GetValue())
+	assert.Len(t, accepts, 1)
+	assert.Contains(t, accepts[0], "text/plain", "the text format is accepted too")
+
+	mfs, err = prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, mfs, "text_metric")
+	assert.Equal(t, "", accepts[1], "no format is requested by default")
+}
+
+func TestGet_ProtobufNotAcceptable(t *testing.T) {
+	var accepts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		accepts = append(accepts, accept)
+		if strings.Contains(accept, "protobuf") {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		_, _ = w.Write([]byte("text_metric 1\n"))
+	}))
+	defer ts.Close()
+
+	mfs, err := prometheus.GetWithOptions(http.DefaultClient, ts.URL, prometheus.GetOptions{Protobuf: true, Exemplars: true})
+	require.NoError(t, err)
+	assert.Contains(t, mfs, "text_metric")
+	require.Len(t, accepts, 2)
+	assert.NotContains(t, accepts[1], "protobuf")
+	assert.Contains(t, accepts[1], "application/openmetrics-text", "the other formats are still requested")
+}
+
+func TestStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/simple-metrics")
+	}))
+	defer ts.Close()
+
+	var names []string
+	err := prometheus.Stream(http.DefaultClient, ts.URL, prometheus.GetOptions{}, func(mf *dto.MetricFamily) error {
+		names = append(names, mf.GetName())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go_goroutines", "go_memstats_heap_idle_bytes", "go_gc_duration_seconds", "http_requests_total"}, names,
+		"the families are handled in the order of the payload")
+
+	stop := errors.New("stop")
+	names = nil
+	err = prometheus.Stream(http.DefaultClient, ts.URL, prometheus.GetOptions{}, func(mf *dto.MetricFamily) error {
+		names = append(names, mf.GetName())
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Len(t, names, 1, "the decoding stops at the first handler error")
+}
+
+func TestStream_Incremental(t *testing.T) {
+	contentTypes := []string{
+		"text/plain; version=0.0.4",
+		"application/openmetrics-text; version=1.0.0",
+	}
+	for _, contentType := range contentTypes {
+		t.Run(contentType, func(t *testing.T) {
+			handled, timedOut := make(chan struct{}), make(chan struct{}, 1)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				_, _ = w.Write([]byte("# TYPE first gauge\nfirst 1\n# TYPE second gauge\nsecond 2\n"))
+				w.(http.Flusher).Flush()
+				// The rest of the payload is only sent once the first
+				// family is handled.
+				select {
+				case <-handled:
+				case <-time.After(5 * time.Second):
+					timedOut <- struct{}{}
+				}
+				_, _ = w.Write([]byte("# TYPE third gauge\nthird 3\n"))
+			}))
+			defer ts.Close()
+
+			var names []string
+			err := prometheus.Stream(http.DefaultClient, ts.URL, prometheus.GetOptions{Exemplars: true}, func(mf *dto.MetricFamily) error {
+				if len(names) == 0 {
+					close(handled)
+				}
+				names = append(names, mf.GetName())
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"first", "second", "third"}, names)
+			assert.Empty(t, timedOut, "the first family is handled before the whole payload is read")
+		})
+	}
+}
+
+func TestGet_CutPayload(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The connection is closed before the announced length is sent.
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("up 1\n"))
+	}))
+	defer ts.Close()
+
+	_, err := prometheus.Get(http.DefaultClient, ts.URL)
+	assert.Error(t, err, "the read error is returned even at the beginning of a line")
+}
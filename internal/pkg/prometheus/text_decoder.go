@@ -0,0 +1,148 @@
+// Package prometheus ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// textDecoder decodes a payload in the Prometheus text format family by
+// family, unlike the decoder of expfmt that parses the whole payload on its
+// first call, so only the lines of one family are kept in memory at a time.
+// The lines are grouped into the blocks of their families, which are parsed
+// one at a time by the text parser of expfmt.
+type textDecoder struct {
+	reader *bufio.Reader
+	// family and familyType are the name and the type of the family of the
+	// block being read, and next is the first line of the following block.
+	family     string
+	familyType string
+	block      bytes.Buffer
+	next       []byte
+	// decoded are the families of the last block not yet returned.
+	decoded []*dto.MetricFamily
+	err     error
+}
+
+func newTextDecoder(r io.Reader) *textDecoder {
+	return &textDecoder{reader: bufio.NewReader(r)}
+}
+
+// Decode decodes the next family of the payload, returning io.EOF after
+// the last one.
+func (d *textDecoder) Decode(mf *dto.MetricFamily) error {
+	for len(d.decoded) == 0 {
+		if d.err != nil {
+			return d.err
+		}
+		block, err := d.readBlock()
+		if err != nil && err != io.EOF {
+			d.err = err
+			return err
+		}
+		var parser expfmt.TextParser
+		mfs, parseErr := parser.TextToMetricFamilies(bytes.NewReader(block))
+		if parseErr != nil {
+			d.err = parseErr
+			return parseErr
+		}
+		names := make([]string, 0, len(mfs))
+		for name := range mfs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d.decoded = append(d.decoded, mfs[name])
+		}
+		if err == io.EOF {
+			d.err = io.EOF
+		}
+	}
+	*mf = *d.decoded[0]
+	d.decoded = d.decoded[1:]
+	return nil
+}
+
+// readBlock returns the lines of the next family, with the comments and
+// blank lines preceding the first line of the following one.
+func (d *textDecoder) readBlock() ([]byte, error) {
+	d.block.Reset()
+	d.family, d.familyType = "", ""
+	if d.next != nil {
+		d.add(d.next)
+		d.next = nil
+	}
+	for {
+		line, err := d.reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if name, typ := lineFamily(line); name != "" && !d.belongs(name) {
+				if d.family != "" {
+					d.next = line
+					return d.block.Bytes(), nil
+				}
+				d.family, d.familyType = name, typ
+			} else if typ != "" {
+				d.familyType = typ
+			}
+			d.block.Write(line)
+		}
+		if err != nil {
+			return d.block.Bytes(), err
+		}
+	}
+}
+
+// add starts the block with its first line.
+func (d *textDecoder) add(line []byte) {
+	d.family, d.familyType = lineFamily(line)
+	d.block.Write(line)
+}
+
+// belongs returns true if the metric name is the one of the family of the
+// block, or one of the samples of its histogram or summary.
+func (d *textDecoder) belongs(name string) bool {
+	if d.family == "" {
+		return false
+	}
+	if name == d.family {
+		return true
+	}
+	switch d.familyType {
+	case "histogram":
+		return name == d.family+"_bucket" || name == d.family+"_sum" || name == d.family+"_count"
+	case "summary":
+		return name == d.family+"_sum" || name == d.family+"_count"
+	}
+	return false
+}
+
+// lineFamily returns the metric name of a HELP, TYPE or sample line, with
+// the type of the TYPE lines. The other lines have no name.
+func lineFamily(line []byte) (name, typ string) {
+	text := strings.TrimSpace(string(line))
+	if text == "" {
+		return "", ""
+	}
+	if text[0] == '#' {
+		fields := strings.Fields(text[1:])
+		if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+			return "", ""
+		}
+		if fields[0] == "TYPE" && len(fields) > 2 {
+			typ = strings.ToLower(fields[2])
+		}
+		return fields[1], typ
+	}
+	if i := strings.IndexAny(text, "{ \t"); i >= 0 {
+		return text[:i], ""
+	}
+	return text, ""
+}
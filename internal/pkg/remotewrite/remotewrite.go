@@ -0,0 +1,207 @@
+// Package remotewrite encodes the write requests of the Prometheus remote
+// write protocol: protobuf messages compressed with Snappy.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package remotewrite
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/newrelic/nri-prometheus/internal/pkg/snappy"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// ErrInvalid is returned when a write request can't be decoded.
+var ErrInvalid = errors.New("remotewrite: invalid write request")
+
+// WriteRequest is the prometheus.WriteRequest message.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is the prometheus.TimeSeries message. The labels include the
+// metric name as the __name__ label and must be sorted by name.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// Label is the prometheus.Label message.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is the prometheus.Sample message. The timestamp is in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// Encode returns the Snappy compressed protobuf encoding of the request, the
+// body of the remote write requests.
+func Encode(req *WriteRequest) []byte {
+	return snappy.Encode(req.Marshal())
+}
+
+// Decode decodes the body of a remote write request.
+func Decode(body []byte) (*WriteRequest, error) {
+	b, err := snappy.Decode(body)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(b)
+}
+
+// Marshal returns the protobuf encoding of the request.
+func (r *WriteRequest) Marshal() []byte {
+	var b, ts, msg []byte
+	for _, series := range r.Timeseries {
+		ts = ts[:0]
+		for _, l := range series.Labels {
+			msg = appendString(msg[:0], 1, l.Name)
+			msg = appendString(msg, 2, l.Value)
+			ts = appendBytes(ts, 1, msg)
+		}
+		for _, s := range series.Samples {
+			msg = msg[:0]
+			if s.Value != 0 {
+				msg = appendKey(msg, 1, wireFixed64)
+				msg = appendFixed64(msg, math.Float64bits(s.Value))
+			}
+			if s.Timestamp != 0 {
+				msg = appendKey(msg, 2, wireVarint)
+				msg = appendUvarint(msg, uint64(s.Timestamp))
+			}
+			ts = appendBytes(ts, 2, msg)
+		}
+		b = appendBytes(b, 1, ts)
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendKey(b []byte, field int, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = appendKey(b, field, wireBytes)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendString(b []byte, field int, value string) []byte {
+	if value == "" {
+		return b
+	}
+	return appendBytes(b, field, []byte(value))
+}
+
+// Unmarshal decodes the protobuf encoding of a request.
+func Unmarshal(b []byte) (*WriteRequest, error) {
+	req := &WriteRequest{}
+	err := forEachField(b, func(field int, value []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		var series TimeSeries
+		err := forEachField(value, func(field int, value []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var l Label
+				err := forEachField(value, func(field int, value []byte, _ uint64) error {
+					switch field {
+					case 1:
+						l.Name = string(value)
+					case 2:
+						l.Value = string(value)
+					}
+					return nil
+				})
+				series.Labels = append(series.Labels, l)
+				return err
+			case 2:
+				var s Sample
+				err := forEachField(value, func(field int, _ []byte, n uint64) error {
+					switch field {
+					case 1:
+						s.Value = math.Float64frombits(n)
+					case 2:
+						s.Timestamp = int64(n)
+					}
+					return nil
+				})
+				series.Samples = append(series.Samples, s)
+				return err
+			}
+			return nil
+		})
+		req.Timeseries = append(req.Timeseries, series)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// forEachField calls f with the number and the value of every field of the
+// message. Length-delimited values are passed as bytes, and the other ones as
+// a number.
+func forEachField(b []byte, f func(field int, value []byte, n uint64) error) error {
+	for len(b) > 0 {
+		key, read := binary.Uvarint(b)
+		if read <= 0 {
+			return ErrInvalid
+		}
+		b = b[read:]
+		field := int(key >> 3)
+		var value []byte
+		var n uint64
+		switch key & 0x07 {
+		case wireVarint:
+			if n, read = binary.Uvarint(b); read <= 0 {
+				return ErrInvalid
+			}
+			b = b[read:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return ErrInvalid
+			}
+			n = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			length, read := binary.Uvarint(b)
+			if read <= 0 || uint64(len(b)-read) < length {
+				return ErrInvalid
+			}
+			value = b[read : read+int(length)]
+			b = b[read+int(length):]
+		default:
+			return ErrInvalid
+		}
+		if err := f(field, value, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package remotewrite
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	req := &WriteRequest{Timeseries: []TimeSeries{{
+		Labels:  []Label{{Name: "__name__", Value: "up"}},
+		Samples: []Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+
+	// Hand-encoded: timeseries{labels{name, value}, samples{value, timestamp}}.
+	expected := []byte{
+		0x0a, 0x1e,
+		0x0a, 0x0e, 0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_', 0x12, 0x02, 'u', 'p',
+		0x12, 0x0c, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0xe8, 0x07,
+	}
+	assert.Equal(t, expected, req.Marshal())
+}
+
+func TestEncodeDecode(t *testing.T) {
+	req := &WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "http_requests_total"}, {Name: "code", Value: "200"}},
+			Samples: []Sample{{Value: 1027, Timestamp: 1600000000000}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "temperature"}, {Name: "empty", Value: ""}},
+			Samples: []Sample{{Value: -3.5, Timestamp: -1}, {Value: 0, Timestamp: 0}, {Value: math.Inf(1)}},
+		},
+	}}
+
+	decoded, err := Decode(Encode(req))
+	require.NoError(t, err)
+	assert.Equal(t, req, decoded)
+}
+
+func TestUnmarshal_Invalid(t *testing.T) {
+	_, err := Unmarshal([]byte{0x0a, 0x10, 0x0a})
+	assert.Equal(t, ErrInvalid, err)
+	_, err = Decode([]byte{0x0a})
+	assert.Error(t, err)
+}
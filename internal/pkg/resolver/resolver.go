@@ -0,0 +1,340 @@
+// Package resolver resolves the hostnames of the targets with custom DNS
+// servers and search domains, caching the resolutions for their TTL.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	queryTimeout = 2 * time.Second
+	// defaultTTL is used for the resolutions of the system resolver, which
+	// doesn't expose the TTL of the records.
+	defaultTTL = 30 * time.Second
+	// negativeTTL is how long a failed resolution is cached.
+	negativeTTL = 5 * time.Second
+)
+
+// Config is used to parse the DNS configuration of the targets.
+type Config struct {
+	// Servers are the DNS servers to query, in host or host:port format. The
+	// system resolver is used if empty.
+	Servers []string `mapstructure:"servers"`
+	// SearchDomains are appended to the hostnames without dots, or tried
+	// after the hostname itself if it has any.
+	SearchDomains []string `mapstructure:"search_domains"`
+}
+
+// IsEmpty returns true if no custom DNS configuration is set.
+func (c Config) IsEmpty() bool {
+	return len(c.Servers) == 0 && len(c.SearchDomains) == 0
+}
+
+type entry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// Resolver resolves hostnames according to its Config and caches the results
+// for the TTL of the records.
+type Resolver struct {
+	config Config
+
+	mu    sync.Mutex
+	cache map[string]entry
+	// exchange sends the DNS query to the server over the network, udp or
+	// tcp, and returns the response.
+	exchange func(ctx context.Context, network, server string, query []byte) ([]byte, error)
+	now      func() time.Time
+}
+
+// New returns a Resolver for the given configuration.
+func New(config Config) *Resolver {
+	servers := make([]string, 0, len(config.Servers))
+	for _, s := range config.Servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		servers = append(servers, s)
+	}
+	config.Servers = servers
+	return &Resolver{
+		config:   config,
+		cache:    map[string]entry{},
+		exchange: exchange,
+		now:      time.Now,
+	}
+}
+
+// DialContext connects to the address, resolving its host with the Resolver.
+// It can be used as the DialContext of an http.Transport.
+func (r *Resolver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// candidates returns the names to try for the host, in order.
+func (r *Resolver) candidates(host string) []string {
+	host = strings.TrimSuffix(host, ".")
+	var names []string
+	if strings.Contains(host, ".") {
+		names = append(names, host)
+	}
+	for _, domain := range r.config.SearchDomains {
+		names = append(names, host+"."+strings.Trim(domain, "."))
+	}
+	if !strings.Contains(host, ".") {
+		names = append(names, host)
+	}
+	return names
+}
+
+// LookupIP returns the IPs of the host, trying the search domains in order.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var lastErr error
+	for _, name := range r.candidates(host) {
+		ips, err := r.lookupCached(ctx, name)
+		if err == nil && len(ips) > 0 {
+			return ips, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) lookupCached(ctx context.Context, name string) ([]net.IP, error) {
+	r.mu.Lock()
+	e, ok := r.cache[name]
+	r.mu.Unlock()
+	if ok && r.now().Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	ips, ttl, err := r.lookup(ctx, name)
+	if err != nil || len(ips) == 0 {
+		ttl = negativeTTL
+	}
+	r.mu.Lock()
+	r.cache[name] = entry{ips: ips, err: err, expires: r.now().Add(ttl)}
+	r.mu.Unlock()
+	return ips, err
+}
+
+// lookup resolves the name, returning its IPs and the lowest TTL of them.
+func (r *Resolver) lookup(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	if len(r.config.Servers) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+		return ips, defaultTTL, nil
+	}
+
+	var lastErr error
+	for _, server := range r.config.Servers {
+		var ips []net.IP
+		ttl := time.Duration(-1)
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			qips, qttl, err := r.query(ctx, server, name, qtype)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ips = append(ips, qips...)
+			if len(qips) > 0 && (ttl < 0 || qttl < ttl) {
+				ttl = qttl
+			}
+		}
+		if len(ips) > 0 {
+			return ips, ttl, nil
+		}
+	}
+	return nil, 0, lastErr
+}
+
+var (
+	errNotFound  = errors.New("no such host")
+	errTruncated = errors.New("truncated DNS response")
+)
+
+func (r *Resolver) query(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := r.exchange(ctx, "udp", server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips, ttl, err := parseResponse(resp, id, name)
+	// The answers that don't fit in a UDP response are only complete over
+	// TCP.
+	if errors.Is(err, errTruncated) {
+		if resp, err = r.exchange(ctx, "tcp", server, query); err != nil {
+			return nil, 0, err
+		}
+		return parseResponse(resp, id, name)
+	}
+	return ips, ttl, err
+}
+
+// parseResponse returns the IPs of the answers of the response and their
+// lowest TTL.
+func parseResponse(resp []byte, id uint16, name string) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id {
+		return nil, 0, errors.New("DNS response ID mismatch")
+	}
+	if h.Truncated {
+		return nil, 0, fmt.Errorf("resolving %s: %w", name, errTruncated)
+	}
+	if h.RCode == dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("%s: %w", name, errNotFound)
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("resolving %s: DNS server returned %s", name, h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if len(ips) == 1 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange sends the query to the server over UDP, or over TCP with the
+// length prefix of the messages.
+func exchange(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if network == "tcp" {
+		return tcpExchange(conn, query)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 1232)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+func tcpExchange(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package resolver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeServer answers the A queries of the names in records with 127.0.0.1
+// and the given TTL, and NXDOMAIN for the rest. With truncateUDP, the UDP
+// responses are truncated.
+type fakeServer struct {
+	records     map[string]uint32
+	truncateUDP bool
+	queries     []string
+}
+
+func (f *fakeServer) exchange(_ context.Context, network, server string, query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := q.Name.String()
+	f.queries = append(f.queries, name+q.Type.String())
+
+	ttl, ok := f.records[name]
+	rcode := dnsmessage.RCodeSuccess
+	if !ok {
+		rcode = dnsmessage.RCodeNameError
+	}
+	truncated := f.truncateUDP && network == "udp"
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RCode: rcode, Truncated: truncated})
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	if ok && q.Type == dnsmessage.TypeA && !truncated {
+		_ = b.AResource(
+			dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+		)
+	}
+	return b.Finish()
+}
+
+func newTestResolver(config Config, server *fakeServer, now *time.Time) *Resolver {
+	r := New(config)
+	r.exchange = server.exchange
+	r.now = func() time.Time { return *now }
+	return r
+}
+
+func TestLookupIP_SearchDomains(t *testing.T) {
+	server := &fakeServer{records: map[string]uint32{"exporter.internal.corp.": 60}}
+	now := time.Now()
+	r := newTestResolver(Config{Servers: []string{"10.0.0.53"}, SearchDomains: []string{"svc.corp", "internal.corp"}}, server, &now)
+
+	ips, err := r.LookupIP(context.Background(), "exporter")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "127.0.0.1", ips[0].String())
+	assert.Equal(t, []string{
+		"exporter.svc.corp.TypeA", "exporter.svc.corp.TypeAAAA",
+		"exporter.internal.corp.TypeA", "exporter.internal.corp.TypeAAAA",
+	}, server.queries)
+
+	_, err = r.LookupIP(context.Background(), "missing")
+	assert.Error(t, err)
+}
+
+func TestLookupIP_TruncatedOverTCP(t *testing.T) {
+	server := &fakeServer{records: map[string]uint32{"exporter.corp.": 60}, truncateUDP: true}
+	now := time.Now()
+	r := newTestResolver(Config{Servers: []string{"10.0.0.53"}}, server, &now)
+
+	ips, err := r.LookupIP(context.Background(), "exporter.corp")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "127.0.0.1", ips[0].String())
+}
+
+func TestExchange_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Echoes the query, with its length prefix.
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		msg := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		_, _ = conn.Write(append(length[:], msg...))
+	}()
+
+	resp, err := exchange(context.Background(), "tcp", listener.Addr().String(), []byte("query"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("query"), resp)
+}
+
+func TestLookupIP_TTLCache(t *testing.T) {
+	server := &fakeServer{records: map[string]uint32{"exporter.corp.": 60}}
+	now := time.Now()
+	r := newTestResolver(Config{Servers: []string{"10.0.0.53:5353"}}, server, &now)
+
+	_, err := r.LookupIP(context.Background(), "exporter.corp")
+	require.NoError(t, err)
+	_, err = r.LookupIP(context.Background(), "exporter.corp")
+	require.NoError(t, err)
+	assert.Len(t, server.queries, 2, "the resolution must be cached")
+
+	now = now.Add(61 * time.Second)
+	_, err = r.LookupIP(context.Background(), "exporter.corp")
+	require.NoError(t, err)
+	assert.Len(t, server.queries, 4, "the resolution must expire after its TTL")
+}
+
+func TestDialContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(tsURL.Host)
+	require.NoError(t, err)
+
+	now := time.Now()
+	r := newTestResolver(Config{Servers: []string{"10.0.0.53"}}, &fakeServer{records: map[string]uint32{"exporter.corp.": 60}}, &now)
+	client := &http.Client{Transport: &http.Transport{DialContext: r.DialContext}}
+
+	resp, err := client.Get("http://exporter.corp:" + port)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+}
@@ -0,0 +1,182 @@
+// Package snappy encodes and decodes the Snappy block format, used by the
+// Prometheus remote write protocol. The encoder favors simplicity over
+// compression ratio.
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+
+	// maxBlockSize is the size of the blocks the input is encoded in, so
+	// the offsets of the copies fit in 2 bytes.
+	maxBlockSize = 65536
+	// minMatch is the shortest match encoded as a copy.
+	minMatch  = 4
+	tableBits = 14
+)
+
+// ErrCorrupt is returned when the input is not valid Snappy.
+var ErrCorrupt = errors.New("snappy: corrupt input")
+
+// Encode returns the Snappy block encoding of src.
+func Encode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	for len(src) > 0 {
+		block := src
+		if len(block) > maxBlockSize {
+			block = block[:maxBlockSize]
+		}
+		dst = encodeBlock(dst, block)
+		src = src[len(block):]
+	}
+	return dst
+}
+
+func load32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
+
+func hash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - tableBits)
+}
+
+// encodeBlock appends the encoding of src, which is at most maxBlockSize
+// long, to dst. Sequences of 4 bytes are looked up in a hash table of their
+// last positions, and the matches are extended as much as possible.
+func encodeBlock(dst, src []byte) []byte {
+	var table [1 << tableBits]int32
+	literal := 0
+	for s := 0; s+minMatch <= len(src); {
+		h := hash(load32(src, s))
+		candidate := int(table[h])
+		table[h] = int32(s)
+		if candidate >= s || load32(src, candidate) != load32(src, s) {
+			s++
+			continue
+		}
+		dst = emitLiteral(dst, src[literal:s])
+		length := minMatch
+		for s+length < len(src) && src[candidate+length] == src[s+length] {
+			length++
+		}
+		dst = emitCopy(dst, s-candidate, length)
+		s += length
+		literal = s
+	}
+	return emitLiteral(dst, src[literal:])
+}
+
+// emitLiteral appends the literal to dst.
+func emitLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+	n := uint32(len(literal) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2)|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, literal...)
+}
+
+// emitCopy appends the copy of length bytes from offset bytes back to dst.
+// The offset is lower than maxBlockSize and the length at least minMatch.
+func emitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|tagCopy1, byte(offset))
+}
+
+// Decode returns the decoded Snappy block src.
+func Decode(src []byte) ([]byte, error) {
+	n, read := binary.Uvarint(src)
+	if read <= 0 || n > uint64(len(src))*255 {
+		return nil, ErrCorrupt
+	}
+	dst := make([]byte, 0, n)
+	for s := read; s < len(src); {
+		var length, offset int
+		tag := src[s]
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			s++
+			if x >= 60 {
+				extra := int(x - 59)
+				if s+extra > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = 0
+				for i := extra - 1; i >= 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+				s += extra
+			}
+			length = int(x) + 1
+			if length <= 0 || s+length > len(src) {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case tagCopy1:
+			if s+2 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case tagCopy2:
+			if s+3 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case tagCopy4:
+			if s+5 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, ErrCorrupt
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package snappy
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	assert.Equal(t, []byte{0x0c, 0x0c, 'a', 'b', 'c', 'd', 0x11, 0x04}, Encode([]byte("abcdabcdabcd")))
+	assert.Equal(t, []byte{0x00}, Encode(nil))
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"repetitive": []byte(strings.Repeat(`http_requests_total{code="200",method="GET"} 1027`+"\n", 5000)),
+		"random":     random,
+		"long match": bytes.Repeat([]byte{'x'}, 100000),
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			encoded := Encode(input)
+			decoded, err := Decode(encoded)
+			require.NoError(t, err)
+			assert.Equal(t, len(input), len(decoded))
+			assert.True(t, bytes.Equal(input, decoded))
+		})
+	}
+	assert.Less(t, len(Encode(inputs["repetitive"])), len(inputs["repetitive"])/10)
+}
+
+func TestDecode_Corrupt(t *testing.T) {
+	for _, input := range [][]byte{
+		{},
+		{0x05, 0x10, 'a'},
+		{0x08, 0x00, 'a', 0x11, 0x05},
+		{0x02, 0x00, 'a'},
+	} {
+		_, err := Decode(input)
+		assert.Equal(t, ErrCorrupt, err, "%x", input)
+	}
+}
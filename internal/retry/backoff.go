@@ -0,0 +1,45 @@
+// Package retry ...
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package retry
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff calculates exponentially increasing delays between retries. Half
+// of every delay is randomized to avoid many clients retrying at the same
+// time.
+type Backoff struct {
+	// Min is the delay before the first retry.
+	Min time.Duration
+	// Max is the maximum delay between retries.
+	Max time.Duration
+
+	attempt uint
+}
+
+// Next returns the delay to wait before the next retry.
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min
+	for i := uint(0); i < b.attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	b.attempt++
+
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// Reset restarts the delays from the Min value. It should be called after a
+// successful execution.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
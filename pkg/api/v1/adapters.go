@@ -0,0 +1,179 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package v1
+
+import (
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+	"github.com/newrelic/nri-prometheus/internal/pkg/labels"
+)
+
+// The adapters between the types of the API and the internal ones, so the
+// internal types can change without breaking the API.
+var (
+	_ Emitter         = apiEmitter{}
+	_ TargetRetriever = apiRetriever{}
+	_ Fetcher         = apiFetcher{}
+)
+
+func toInternalMetric(m Metric) integration.Metric {
+	return integration.NewMetric(m.Name, m.Type, m.Value, m.Summary, m.Histogram, m.Attributes, m.Timestamp)
+}
+
+func fromInternalMetric(m integration.Metric) Metric {
+	return Metric{
+		Name:       m.Name(),
+		Type:       m.Type(),
+		Value:      m.Value(),
+		Summary:    m.Summary(),
+		Histogram:  m.Histogram(),
+		Attributes: m.Attributes(),
+		Timestamp:  m.Timestamp(),
+	}
+}
+
+func toInternalMetrics(metrics []Metric) []integration.Metric {
+	converted := make([]integration.Metric, len(metrics))
+	for i, m := range metrics {
+		converted[i] = toInternalMetric(m)
+	}
+	return converted
+}
+
+func fromInternalMetrics(metrics []integration.Metric) []Metric {
+	converted := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		converted[i] = fromInternalMetric(m)
+	}
+	return converted
+}
+
+func toInternalTarget(t Target) endpoints.Target {
+	return endpoints.New(t.Name, t.URL, endpoints.Object{Name: t.Object.Name, Kind: t.Object.Kind, Labels: labels.Set(t.Object.Labels)})
+}
+
+func fromInternalTarget(t endpoints.Target) Target {
+	return Target{
+		Name:   t.Name,
+		Object: Object{Name: t.Object.Name, Kind: t.Object.Kind, Labels: t.Object.Labels},
+		URL:    t.URL,
+	}
+}
+
+func toInternalTargets(targets []Target) []endpoints.Target {
+	converted := make([]endpoints.Target, len(targets))
+	for i, t := range targets {
+		converted[i] = toInternalTarget(t)
+	}
+	return converted
+}
+
+func fromInternalTargets(targets []endpoints.Target) []Target {
+	converted := make([]Target, len(targets))
+	for i, t := range targets {
+		converted[i] = fromInternalTarget(t)
+	}
+	return converted
+}
+
+// toInternalPairs converts the target metrics of the channel until it's
+// closed.
+func toInternalPairs(pairs <-chan TargetMetrics, queueLength int) <-chan integration.TargetMetrics {
+	converted := make(chan integration.TargetMetrics, queueLength)
+	go func() {
+		defer close(converted)
+		for pair := range pairs {
+			converted <- integration.TargetMetrics{
+				Target:  toInternalTarget(pair.Target),
+				Metrics: toInternalMetrics(pair.Metrics),
+				Job:     pair.Job,
+			}
+		}
+	}()
+	return converted
+}
+
+// fromInternalPairs converts the target metrics of the channel until it's
+// closed.
+func fromInternalPairs(pairs <-chan integration.TargetMetrics, queueLength int) <-chan TargetMetrics {
+	converted := make(chan TargetMetrics, queueLength)
+	go func() {
+		defer close(converted)
+		for pair := range pairs {
+			converted <- TargetMetrics{
+				Target:  fromInternalTarget(pair.Target),
+				Metrics: fromInternalMetrics(pair.Metrics),
+				Job:     pair.Job,
+			}
+		}
+	}()
+	return converted
+}
+
+func toInternalRules(rules []ProcessingRule) []integration.ProcessingRule {
+	converted := make([]integration.ProcessingRule, len(rules))
+	for i, r := range rules {
+		c := integration.ProcessingRule{Description: r.Description}
+		for _, a := range r.AddAttributes {
+			c.AddAttributes = append(c.AddAttributes, integration.AddAttributesRule{MetricPrefix: a.MetricPrefix, Attributes: a.Attributes})
+		}
+		for _, a := range r.RenameAttributes {
+			c.RenameAttributes = append(c.RenameAttributes, integration.RenameRule{MetricPrefix: a.MetricPrefix, Attributes: a.Attributes})
+		}
+		for _, a := range r.IgnoreMetrics {
+			c.IgnoreMetrics = append(c.IgnoreMetrics, integration.IgnoreRule{Prefixes: a.Prefixes, Except: a.Except})
+		}
+		for _, a := range r.CopyAttributes {
+			c.CopyAttributes = append(c.CopyAttributes, integration.CopyAttributesRule{
+				FromMetric: a.FromMetric,
+				ToMetrics:  a.ToMetrics,
+				MatchBy:    a.MatchBy,
+				Attributes: a.Attributes,
+			})
+		}
+		for _, a := range r.TemplateAttributes {
+			c.TemplateAttributes = append(c.TemplateAttributes, integration.TemplateAttributesRule{MetricPrefix: a.MetricPrefix, Attributes: a.Attributes})
+		}
+		for _, a := range r.RedactAttributes {
+			c.RedactAttributes = append(c.RedactAttributes, integration.RedactRule{
+				MetricPrefix:  a.MetricPrefix,
+				AttributeName: a.AttributeName,
+				ValuePattern:  a.ValuePattern,
+				Action:        a.Action,
+				Salt:          a.Salt,
+			})
+		}
+		converted[i] = c
+	}
+	return converted
+}
+
+// apiEmitter is an emitter of the integration used through the API.
+type apiEmitter struct {
+	integration.Emitter
+}
+
+func (e apiEmitter) Emit(metrics []Metric) error {
+	return e.Emitter.Emit(toInternalMetrics(metrics))
+}
+
+// apiRetriever is a target retriever of the integration used through the
+// API.
+type apiRetriever struct {
+	endpoints.TargetRetriever
+}
+
+func (r apiRetriever) GetTargets() ([]Target, error) {
+	targets, err := r.TargetRetriever.GetTargets()
+	return fromInternalTargets(targets), err
+}
+
+// apiFetcher is a fetcher of the integration used through the API.
+type apiFetcher struct {
+	fetcher     integration.Fetcher
+	queueLength int
+}
+
+func (f apiFetcher) Fetch(targets []Target) <-chan TargetMetrics {
+	return fromInternalPairs(f.fetcher.Fetch(toInternalTargets(targets)), f.queueLength)
+}
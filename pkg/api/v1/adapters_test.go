@@ -0,0 +1,32 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package v1
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricAdapters(t *testing.T) {
+	count, sum := uint64(2), float64(3)
+	m := Metric{
+		Name:       "latency",
+		Type:       MetricTypeSummary,
+		Summary:    &dto.Summary{SampleCount: &count, SampleSum: &sum},
+		Attributes: map[string]interface{}{"instance": "a"},
+		Timestamp:  time.Unix(1600000000, 0),
+	}
+	assert.Equal(t, m, fromInternalMetric(toInternalMetric(m)))
+}
+
+func TestTargetAdapters(t *testing.T) {
+	u, _ := url.Parse("https://exporter:9100/metrics")
+	target := NewTarget("exporter", *u, Object{Name: "exporter", Kind: "pod", Labels: map[string]interface{}{"app": "shop"}})
+	internal := toInternalTarget(target)
+	assert.Equal(t, "shop", internal.Metadata()["app"])
+	assert.Equal(t, target, fromInternalTarget(internal))
+}
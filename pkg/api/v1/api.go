@@ -0,0 +1,201 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package v1
+
+import (
+	"net/url"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/newrelic/nri-prometheus/internal/integration"
+	"github.com/newrelic/nri-prometheus/internal/pkg/endpoints"
+)
+
+// The types of the metrics.
+const (
+	MetricTypeCount     = "count"
+	MetricTypeGauge     = "gauge"
+	MetricTypeSummary   = "summary"
+	MetricTypeHistogram = "histogram"
+)
+
+// Metric is a metric scraped from a target.
+type Metric struct {
+	Name string
+	// Type is one of the MetricType constants.
+	Type string
+	// Value is the value of the gauges and counters, the cumulative one for
+	// the counters.
+	Value float64
+	// Summary and Histogram are the distributions of the summaries and the
+	// histograms, or nil.
+	Summary   *dto.Summary
+	Histogram *dto.Histogram
+	// Attributes are shared with the metrics they're converted from, so
+	// they must not be modified.
+	Attributes map[string]interface{}
+	// Timestamp is the time of the sample, or the zero time if the metric
+	// is emitted at the scrape time.
+	Timestamp time.Time
+}
+
+// NewGaugeMetric returns a gauge with the attributes.
+func NewGaugeMetric(name string, value float64, attributes map[string]interface{}) Metric {
+	return newValueMetric(name, MetricTypeGauge, value, attributes)
+}
+
+// NewCounterMetric returns a counter with its cumulative value and the
+// attributes.
+func NewCounterMetric(name string, value float64, attributes map[string]interface{}) Metric {
+	return newValueMetric(name, MetricTypeCount, value, attributes)
+}
+
+func newValueMetric(name, typ string, value float64, attributes map[string]interface{}) Metric {
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	return Metric{Name: name, Type: typ, Value: value, Attributes: attributes}
+}
+
+// Emitter sends the processed metrics of the targets to a backend.
+type Emitter interface {
+	Name() string
+	Emit([]Metric) error
+}
+
+// NewStdoutEmitter returns the emitter printing the metrics to the
+// standard output, for debugging.
+func NewStdoutEmitter() Emitter {
+	return apiEmitter{integration.NewStdoutEmitter()}
+}
+
+// Object is the Kubernetes object, or the configuration, a target comes
+// from. Its labels are added to the metrics of its targets.
+type Object struct {
+	Name   string
+	Kind   string
+	Labels map[string]interface{}
+}
+
+// Target is an endpoint scraped by the integration.
+type Target struct {
+	Name   string
+	Object Object
+	URL    url.URL
+}
+
+// NewTarget returns the target of the URL, named name, of the object.
+func NewTarget(name string, addr url.URL, object Object) Target {
+	return Target{Name: name, Object: object, URL: addr}
+}
+
+// TargetRetriever discovers the targets to scrape.
+type TargetRetriever interface {
+	GetTargets() ([]Target, error)
+	Watch() error
+	Name() string
+}
+
+// StaticRetriever returns the target retriever of the URLs. Without a
+// scheme, they're scraped over http, and without a path, on /metrics.
+func StaticRetriever(urls ...string) (TargetRetriever, error) {
+	retriever, err := endpoints.FixedRetriever(endpoints.TargetConfig{URLs: urls})
+	if err != nil {
+		return nil, err
+	}
+	return apiRetriever{retriever}, nil
+}
+
+// TargetMetrics are the metrics scraped from a target.
+type TargetMetrics struct {
+	Target  Target
+	Metrics []Metric
+	// Job is the scrape job of the target, if any.
+	Job string
+}
+
+// Fetcher scrapes the metrics of the targets, sending them on the returned
+// channel, which is closed once they're all scraped.
+type Fetcher interface {
+	Fetch([]Target) <-chan TargetMetrics
+}
+
+// NewFetcher returns the fetcher scraping the targets over fetchDuration,
+// with maxConnections scrapes at a time timing out after fetchTimeout, and
+// a queue of queueLength target metrics.
+func NewFetcher(fetchDuration, fetchTimeout time.Duration, maxConnections, queueLength int) Fetcher {
+	return apiFetcher{
+		fetcher:     integration.NewFetcher(fetchDuration, fetchTimeout, maxConnections, "", "", false, queueLength),
+		queueLength: queueLength,
+	}
+}
+
+// Processor transforms the metrics of the targets.
+type Processor func(pairs <-chan TargetMetrics) <-chan TargetMetrics
+
+// ProcessingRule is a set of transformations of the metrics, as in the
+// transformations of the configuration.
+type ProcessingRule struct {
+	Description        string
+	AddAttributes      []AddAttributesRule      `mapstructure:"add_attributes"`
+	RenameAttributes   []RenameRule             `mapstructure:"rename_attributes"`
+	IgnoreMetrics      []IgnoreRule             `mapstructure:"ignore_metrics"`
+	CopyAttributes     []CopyAttributesRule     `mapstructure:"copy_attributes"`
+	TemplateAttributes []TemplateAttributesRule `mapstructure:"template_attributes"`
+	RedactAttributes   []RedactRule             `mapstructure:"redact_attributes"`
+}
+
+// AddAttributesRule adds the attributes to the metrics with the prefix.
+type AddAttributesRule struct {
+	MetricPrefix string                 `mapstructure:"metric_prefix"`
+	Attributes   map[string]interface{} `mapstructure:"attributes"`
+}
+
+// RenameRule renames the attributes of the metrics with the prefix.
+type RenameRule struct {
+	MetricPrefix string                 `mapstructure:"metric_prefix"`
+	Attributes   map[string]interface{} `mapstructure:"attributes"`
+}
+
+// IgnoreRule drops the metrics with the prefixes, but the ones with the
+// exceptions.
+type IgnoreRule struct {
+	Prefixes []string `mapstructure:"prefixes"`
+	Except   []string `mapstructure:"except"`
+}
+
+// CopyAttributesRule copies the attributes of a metric to the metrics of
+// the target matching it by the attributes of MatchBy.
+type CopyAttributesRule struct {
+	FromMetric string   `mapstructure:"from_metric"`
+	ToMetrics  []string `mapstructure:"to_metrics"`
+	MatchBy    []string `mapstructure:"match_by"`
+	Attributes []string `mapstructure:"attributes"`
+}
+
+// TemplateAttributesRule sets the attributes of the metrics with the prefix
+// from templates of their other attributes.
+type TemplateAttributesRule struct {
+	MetricPrefix string            `mapstructure:"metric_prefix"`
+	Attributes   map[string]string `mapstructure:"attributes"`
+}
+
+// RedactRule drops, masks or hashes the values of the attributes matching
+// it.
+type RedactRule struct {
+	MetricPrefix  string `mapstructure:"metric_prefix"`
+	AttributeName string `mapstructure:"attribute_name"`
+	ValuePattern  string `mapstructure:"value_pattern"`
+	Action        string `mapstructure:"action"`
+	Salt          string `mapstructure:"salt"`
+}
+
+// RuleProcessor returns the processor applying the processing rules, with a
+// queue of queueLength target metrics.
+func RuleProcessor(rules []ProcessingRule, queueLength int) Processor {
+	process := integration.RuleProcessor(toInternalRules(rules), queueLength)
+	return func(pairs <-chan TargetMetrics) <-chan TargetMetrics {
+		return fromInternalPairs(process(toInternalPairs(pairs, queueLength)), queueLength)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+package v1_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/newrelic/nri-prometheus/pkg/api/v1"
+)
+
+// The types of an embedder, implemented with the API only.
+type emitter struct {
+	metrics []v1.Metric
+}
+
+func (e *emitter) Name() string {
+	return "embedded"
+}
+
+func (e *emitter) Emit(metrics []v1.Metric) error {
+	e.metrics = append(e.metrics, metrics...)
+	return nil
+}
+
+type retriever struct {
+	targets []v1.Target
+}
+
+func (r *retriever) GetTargets() ([]v1.Target, error) { return r.targets, nil }
+func (r *retriever) Watch() error                     { return nil }
+func (r *retriever) Name() string                     { return "embedded" }
+
+var (
+	_ v1.Emitter         = &emitter{}
+	_ v1.TargetRetriever = &retriever{}
+)
+
+func TestAPI(t *testing.T) {
+	u, err := url.Parse("http://exporter:9100/metrics")
+	require.NoError(t, err)
+	target := v1.NewTarget("exporter", *u, v1.Object{Name: "exporter", Kind: "user_provided"})
+	targets, err := (&retriever{targets: []v1.Target{target}}).GetTargets()
+	require.NoError(t, err)
+
+	pairs := make(chan v1.TargetMetrics, 1)
+	pairs <- v1.TargetMetrics{
+		Target: targets[0],
+		Metrics: []v1.Metric{
+			v1.NewGaugeMetric("go_goroutines", 12, map[string]interface{}{"instance": "a"}),
+			v1.NewCounterMetric("http_requests_total", 42, nil),
+		},
+	}
+	close(pairs)
+	rules := []v1.ProcessingRule{{
+		IgnoreMetrics: []v1.IgnoreRule{{Prefixes: []string{"go_"}}},
+		AddAttributes: []v1.AddAttributesRule{{MetricPrefix: "http_", Attributes: map[string]interface{}{"team": "web"}}},
+	}}
+
+	e := &emitter{}
+	for pair := range v1.RuleProcessor(rules, 1)(pairs) {
+		require.NoError(t, e.Emit(pair.Metrics))
+	}
+
+	require.Len(t, e.metrics, 1)
+	m := e.metrics[0]
+	assert.Equal(t, "http_requests_total", m.Name)
+	assert.Equal(t, v1.MetricTypeCount, m.Type)
+	assert.Equal(t, float64(42), m.Value)
+	assert.Equal(t, "web", m.Attributes["team"])
+	assert.True(t, m.Timestamp.IsZero())
+	assert.Nil(t, m.Summary)
+	assert.Nil(t, m.Histogram)
+	assert.Equal(t, v1.MetricTypeGauge, v1.NewGaugeMetric("up", 1, nil).Type)
+}
+
+func TestFetcher(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("# TYPE up gauge\nup 1\n"))
+	}))
+	defer ts.Close()
+
+	retriever, err := v1.StaticRetriever(ts.URL)
+	require.NoError(t, err)
+	targets, err := retriever.GetTargets()
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	assert.Equal(t, "/metrics", targets[0].URL.Path)
+
+	var fetched []v1.TargetMetrics
+	for pair := range v1.NewFetcher(time.Millisecond, time.Second, 1, 1).Fetch(targets) {
+		fetched = append(fetched, pair)
+	}
+	require.Len(t, fetched, 1)
+	assert.Equal(t, targets[0].URL, fetched[0].Target.URL)
+	require.Len(t, fetched[0].Metrics, 1)
+	assert.Equal(t, "up", fetched[0].Metrics[0].Name)
+	assert.Equal(t, v1.MetricTypeGauge, fetched[0].Metrics[0].Type)
+	assert.Equal(t, float64(1), fetched[0].Metrics[0].Value)
+}
@@ -0,0 +1,20 @@
+// Copyright 2019 New Relic Corporation. All rights reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package v1 is the stable API of nri-prometheus for the programs embedding
+// it and the forks extending it, instead of importing its internal packages,
+// which change between releases.
+//
+// # Compatibility
+//
+// The identifiers of this package follow semantic versioning: they are only
+// changed in backwards compatible ways within a major release, like adding a
+// method to a type or a field to a struct. A breaking change adds a v2
+// package next to this one, which is kept until the next major release.
+//
+// Only the identifiers of this package, and the exported fields and methods
+// of its types, are covered. The types are its own, converted to and from
+// the internal ones of the integration by adapters, so the internal packages
+// can change without breaking them. The internal packages themselves are
+// not covered.
+package v1